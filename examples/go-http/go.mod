@@ -1,3 +1,9 @@
 module github.com/3meam/ash-example
 
 go 1.21
+
+require github.com/3maem/ash-go v0.0.0
+
+require golang.org/x/text v0.14.0 // indirect
+
+replace github.com/3maem/ash-go => ../../packages/ash-go
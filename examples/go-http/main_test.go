@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ash "github.com/3maem/ash-go"
+)
+
+// TestExample runs the server and client demo in process.
+func TestExample(t *testing.T) {
+	handler, err := newServer()
+	if err != nil {
+		t.Fatalf("newServer failed: %v", err)
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	result, err := runClient(io.Discard, srv.URL)
+	if err != nil {
+		t.Fatalf("runClient failed: %v", err)
+	}
+	if result.Status != http.StatusOK {
+		t.Errorf("Signed request status = %d, want 200", result.Status)
+	}
+	if result.Replay != ash.ErrReplayDetected {
+		t.Errorf("Replay = %q, want %s", result.Replay, ash.ErrReplayDetected)
+	}
+	if result.Tamper != ash.ErrIntegrityFailed {
+		t.Errorf("Tamper = %q, want %s", result.Tamper, ash.ErrIntegrityFailed)
+	}
+	// One context per request: the Transport's, the replayed one and the
+	// tampered one.
+	if result.Health.Status != "ok" || result.Health.Contexts == nil || *result.Health.Contexts != 3 {
+		t.Errorf("Health = %+v", result.Health)
+	}
+}
@@ -8,9 +8,12 @@
 package ash
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,8 +22,7 @@ import (
 	"strconv"
 	"strings"
 	"unicode"
-
-	"golang.org/x/text/unicode/norm"
+	"unicode/utf8"
 )
 
 // Version is the ASH protocol version.
@@ -29,6 +31,11 @@ const Version = "2.1.0"
 // ASH protocol version prefix used in proof generation.
 const ashVersionPrefix = "ASHv1"
 
+// ashLengthVersionPrefix replaces ashVersionPrefix in proofs that bind the
+// payload length, so that a proof built with and verified without the
+// length line (or the reverse) never matches.
+const ashLengthVersionPrefix = "ASHv1+len"
+
 // AshMode represents security modes for ASH protocol.
 type AshMode string
 
@@ -61,14 +68,46 @@ const (
 	ErrUnsupportedContentType AshErrorCode = "ASH_UNSUPPORTED_CONTENT_TYPE"
 	// ErrMalformedRequest indicates a malformed request.
 	ErrMalformedRequest AshErrorCode = "ASH_MALFORMED_REQUEST"
+	// ErrMissingHeaders indicates the context ID or proof is absent.
+	ErrMissingHeaders AshErrorCode = "ASH_MISSING_HEADERS"
+	// ErrMalformedProof indicates a proof of the wrong length or alphabet.
+	ErrMalformedProof AshErrorCode = "ASH_MALFORMED_PROOF"
 	// ErrCanonicalizationFailed indicates canonicalization failed.
 	ErrCanonicalizationFailed AshErrorCode = "ASH_CANONICALIZATION_FAILED"
+	// ErrRateLimited indicates too many outstanding contexts for a binding.
+	ErrRateLimited AshErrorCode = "ASH_RATE_LIMITED"
+	// ErrTenantMismatch indicates a context used for another tenant.
+	ErrTenantMismatch AshErrorCode = "ASH_TENANT_MISMATCH"
+	// ErrInternalError indicates a server-side failure unrelated to the request.
+	ErrInternalError AshErrorCode = "ASH_INTERNAL_ERROR"
+	// ErrOverloaded indicates too many verifications in progress (see
+	// WithVerifyConcurrency).
+	ErrOverloaded AshErrorCode = "ASH_OVERLOADED"
 )
 
 // AshError represents an error in the ASH protocol.
+//
+// Verification and the stores return shared AshError values for common
+// failures, so returned AshErrors must not be modified; copy one to change
+// it.
 type AshError struct {
 	Code    AshErrorCode
 	Message string
+	// Pointer is the JSON Pointer (RFC 6901) of the offending value for
+	// canonicalization failures, e.g. "/settings/flags/3/value".
+	Pointer string
+	// Status is the HTTP status of the response carrying the error. When
+	// zero, StatusForCode(Code) is used.
+	Status int
+	// Docs is the URL of the documentation for Code, if configured with
+	// WithErrorDocs.
+	Docs string
+	// Reason classifies errors from the canonicalizer, and is empty for
+	// others. It is not part of the JSON form.
+	Reason CanonicalizationReason
+	// Supported lists the media types the server canonicalizes, for
+	// ErrUnsupportedContentType errors.
+	Supported []string
 }
 
 func (e *AshError) Error() string {
@@ -90,8 +129,27 @@ type BuildProofInput struct {
 	ContextID string
 	// Nonce is the optional server-issued nonce.
 	Nonce string
-	// CanonicalPayload is the canonicalized payload string.
+	// Tenant is the optional tenant the context was issued to.
+	Tenant string
+	// SessionKey is the optional session key of the context:
+	// ContextPublicInfo.SessionKey.
+	SessionKey string
+	// Metadata is the canonical JSON of the context metadata bound into
+	// the proof: ContextPublicInfo.ProofMetadata canonicalized with
+	// ParseJSON (see BuildProof).
+	Metadata string
+	// Extensions are optional application-specific values bound into the
+	// proof preamble (see BuildProof).
+	Extensions []KV
+	// CanonicalPayload is the canonicalized payload string, or the body
+	// bytes as sent for a context with ContextPublicInfo.RawBody set.
 	CanonicalPayload string
+	// IncludeLength binds the byte length of CanonicalPayload into the
+	// proof (see BuildProof).
+	IncludeLength bool
+	// Encoding is the text encoding of the proof (default: ProofBase64URL).
+	// It is not part of the preimage.
+	Encoding ProofEncoding
 }
 
 // StoredContext represents context as stored on server.
@@ -122,6 +180,43 @@ type ContextPublicInfo struct {
 	Mode AshMode `json:"mode"`
 	// Nonce is the optional nonce (if server-assisted mode).
 	Nonce string `json:"nonce,omitempty"`
+	// ProofMetadata is the JSON object of the context metadata proofs
+	// cover. Clients canonicalize it with ParseJSON and pass it as
+	// BuildProofInput.Metadata.
+	ProofMetadata json.RawMessage `json:"proofMetadata,omitempty"`
+	// SessionKey is the key binding proofs to the session the context was
+	// issued to, if it was issued with ContextOptions.SessionSalt. Clients
+	// pass it as BuildProofInput.SessionKey.
+	SessionKey string `json:"sessionKey,omitempty"`
+	// UnicodeForm is the normalization form to canonicalize with, when it
+	// is not NFC.
+	UnicodeForm UnicodeForm `json:"unicodeForm,omitempty"`
+	// RawStrings are the JSON Pointers of string values to canonicalize
+	// without normalization. See WithRawStrings.
+	RawStrings []string `json:"rawStrings,omitempty"`
+	// OptionalFields are the object members to leave out of the canonical
+	// form when equal to their default. See WithOptionalFields.
+	OptionalFields []OptionalField `json:"optionalFields,omitempty"`
+	// DecimalStrings are the JSON Pointers of values to canonicalize as
+	// decimal strings. See WithDecimalStrings and
+	// DecimalStringsExtension.
+	DecimalStrings []string `json:"decimalStrings,omitempty"`
+	// IncludeLength reports that proofs must bind the canonical payload
+	// length. See BuildProofInput.IncludeLength.
+	IncludeLength bool `json:"includeLength,omitempty"`
+	// RawBody reports that proofs cover the body bytes as sent instead of
+	// their canonical form. See ContextOptions.RawBody.
+	RawBody bool `json:"rawBody,omitempty"`
+	// MultiUse reports that the context can be used for any number of
+	// requests until it expires.
+	MultiUse bool `json:"multiUse,omitempty"`
+	// Meta is the metadata the server chose to share with the client (see
+	// ContextHandler.PublicMetadata).
+	Meta map[string]interface{} `json:"meta,omitempty"`
+	// Token is the context token, sent in the HeaderContextToken header in
+	// place of the context ID, when the server issues them (see
+	// WithContextTokenSecret).
+	Token string `json:"token,omitempty"`
 }
 
 // HttpMethod represents HTTP methods.
@@ -141,6 +236,10 @@ type SupportedContentType string
 const (
 	ContentTypeJSON       SupportedContentType = "application/json"
 	ContentTypeURLEncoded SupportedContentType = "application/x-www-form-urlencoded"
+	// ContentTypeMultipartForm is multipart form data with text fields
+	// only, as browsers send a FormData without files. See
+	// CanonicalizeMultipartForm.
+	ContentTypeMultipartForm SupportedContentType = "multipart/form-data"
 )
 
 // BuildProof builds a deterministic proof from the given inputs.
@@ -153,14 +252,56 @@ const (
 //	  binding + "\n" +
 //	  contextId + "\n" +
 //	  (nonce? + "\n" : "") +
+//	  (tenant? "tenant:" + tenant + "\n" : "") +
+//	  (sessionKey? "session:" + sessionKey + "\n" : "") +
+//	  (metadata? "meta:" + metadata + "\n" : "") +
+//	  ("ext:" + key + "=" + value + "\n")* +
+//	  (includeLength? "len:" + byteLength(canonicalPayload) + "\n" : "") +
 //	  canonicalPayload
 //	)
 //
-// Output: Base64URL encoded (no padding)
+// With IncludeLength, the first line is "ASHv1+len" instead of "ASHv1",
+// and the decimal byte length of the canonical payload follows the
+// extensions.
+//
+// The tenant line scopes the proof to a tenant and is omitted when there
+// is none, so untenanted proofs are unchanged. The session line, likewise
+// omitted when empty, binds the proof to the session the context was
+// issued to (see ContextOptions.SessionSalt). The metadata line, likewise
+// omitted when empty, binds context metadata chosen by the server (see
+// ContextOptions.ProofMetadata). Extensions are written in ascending key
+// order after the nonce, one line each, so future official preamble fields
+// can be placed before them without colliding. Use BuildProofChecked to
+// reject extensions that would make the preamble ambiguous.
+//
+// Output: Base64URL encoded (no padding), or as chosen by input.Encoding
 func BuildProof(input BuildProofInput) string {
-	// Build the proof input string
+	// Compute SHA-256 hash
+	hash := sha256.Sum256([]byte(proofPreimage(input)))
+
+	// Encode as Base64URL (no padding) unless another encoding is chosen
+	return input.Encoding.Encode(hash[:])
+}
+
+// proofPreimage builds the proof input string hashed by BuildProof.
+func proofPreimage(input BuildProofInput) string {
 	var sb strings.Builder
-	sb.WriteString(ashVersionPrefix)
+	writePreamble(&sb, input)
+
+	// Add canonical payload
+	sb.WriteString(input.CanonicalPayload)
+
+	return sb.String()
+}
+
+// writePreamble writes the part of the proof preimage that precedes the
+// canonical payload.
+func writePreamble(sb *strings.Builder, input BuildProofInput) {
+	if input.IncludeLength {
+		sb.WriteString(ashLengthVersionPrefix)
+	} else {
+		sb.WriteString(ashVersionPrefix)
+	}
 	sb.WriteByte('\n')
 	sb.WriteString(string(input.Mode))
 	sb.WriteByte('\n')
@@ -175,14 +316,36 @@ func BuildProof(input BuildProofInput) string {
 		sb.WriteByte('\n')
 	}
 
-	// Add canonical payload
-	sb.WriteString(input.CanonicalPayload)
+	// Add tenant if present
+	if input.Tenant != "" {
+		sb.WriteString("tenant:")
+		sb.WriteString(input.Tenant)
+		sb.WriteByte('\n')
+	}
 
-	// Compute SHA-256 hash
-	hash := sha256.Sum256([]byte(sb.String()))
+	// Add session key if present
+	if input.SessionKey != "" {
+		sb.WriteString("session:")
+		sb.WriteString(input.SessionKey)
+		sb.WriteByte('\n')
+	}
+
+	// Add bound context metadata if present
+	if input.Metadata != "" {
+		sb.WriteString("meta:")
+		sb.WriteString(input.Metadata)
+		sb.WriteByte('\n')
+	}
 
-	// Encode as Base64URL (no padding)
-	return Base64URLEncode(hash[:])
+	// Add extensions, sorted by key
+	writeExtensions(sb, input.Extensions)
+
+	// Add payload length if bound
+	if input.IncludeLength {
+		sb.WriteString("len:")
+		sb.WriteString(strconv.Itoa(len(input.CanonicalPayload)))
+		sb.WriteByte('\n')
+	}
 }
 
 // Base64URLEncode encodes data as Base64URL (no padding).
@@ -199,42 +362,106 @@ func Base64URLDecode(input string) ([]byte, error) {
 	return base64.RawURLEncoding.DecodeString(input)
 }
 
+// Canonical forms of empty payloads. They are three different proof inputs:
+// a request without a body is not the same as one whose body is {} or [].
+const (
+	// CanonicalEmptyBody is the canonical form of a missing or empty body,
+	// whatever its content type.
+	CanonicalEmptyBody = ""
+	// CanonicalEmptyObject is the canonical form of the JSON body {}.
+	CanonicalEmptyObject = "{}"
+	// CanonicalEmptyArray is the canonical form of the JSON body [].
+	CanonicalEmptyArray = "[]"
+)
+
 // CanonicalizeJSON canonicalizes a JSON value to a deterministic string.
 //
 // Rules (from ASH-Spec-v1.0):
 //   - JSON minified (no whitespace)
-//   - Object keys sorted lexicographically (ascending)
+//   - Object keys sorted by their UTF-8 bytes, which is Unicode code point
+//     order (not UTF-16 code unit order, as JavaScript's default sort uses)
+//   - Invalid UTF-8 in keys is replaced with U+FFFD before sorting, as it
+//     is written
 //   - Arrays preserve order
-//   - Unicode normalization: NFC
+//   - Unicode normalization: NFC (see WithUnicodeForm and WithRawStrings)
+//   - Optional members equal to their default are left out (see
+//     WithOptionalFields)
+//   - Designated values are canonicalized as decimal strings (see
+//     WithDecimalStrings)
 //   - Numbers: no scientific notation, remove trailing zeros, -0 becomes 0
 //   - Unsupported values REJECT: NaN, Infinity
-func CanonicalizeJSON(value interface{}) (string, error) {
-	canonicalized, err := canonicalizeValue(value)
+func CanonicalizeJSON(value interface{}, opts ...CanonicalizeOption) (string, error) {
+	o := newCanonicalizeOptions(opts)
+	if o.err != nil {
+		return "", o.err
+	}
+	canonicalized, err := canonicalizeValue(value, "", o)
 	if err != nil {
 		return "", err
 	}
-	return buildCanonicalJSON(canonicalized)
+	return buildCanonicalJSON(canonicalized, "")
+}
+
+// canonicalizationError creates an ErrCanonicalizationFailed error for the
+// value at the given JSON Pointer.
+func canonicalizationError(reason CanonicalizationReason, pointer, message string) *AshError {
+	if pointer != "" {
+		message += " at " + pointer
+	}
+	return &AshError{Code: ErrCanonicalizationFailed, Message: message, Pointer: pointer, Reason: reason}
+}
+
+// numberError returns the error for a json.Number that does not parse as
+// a float64: out of range, or not a number at all.
+func numberError(pointer string, err error) *AshError {
+	reason := ReasonInvalidNumber
+	if errors.Is(err, strconv.ErrRange) {
+		reason = ReasonInfinity
+	}
+	return canonicalizationError(reason, pointer, "invalid json.Number")
+}
+
+// invalidJSON is the error for a JSON decoding failure.
+func invalidJSON(err error) error {
+	reason := ReasonInvalidJSON
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) && syntaxErr.Error() == "exceeded max depth" {
+		reason = ReasonDepthExceeded
+	}
+	return &AshError{Code: ErrCanonicalizationFailed, Message: "invalid JSON: " + err.Error(), Reason: reason}
+}
+
+// jsonPointerEscaper escapes a reference token per RFC 6901.
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// childPointer appends an object key or array index to a JSON Pointer.
+func childPointer(pointer, token string) string {
+	return pointer + "/" + jsonPointerEscaper.Replace(token)
 }
 
-// canonicalizeValue recursively canonicalizes a value.
-func canonicalizeValue(value interface{}) (interface{}, error) {
+// canonicalizeValue recursively canonicalizes a value. pointer is the
+// JSON Pointer of value, used to locate failures.
+func canonicalizeValue(value interface{}, pointer string, o *canonicalizeOptions) (interface{}, error) {
+	if o.isDecimal(pointer) {
+		return o.canonicalDecimalValue(value, pointer)
+	}
 	if value == nil {
 		return nil, nil
 	}
 
 	switch v := value.(type) {
 	case string:
-		// Apply NFC normalization to strings
-		return norm.NFC.String(v), nil
+		// Apply Unicode normalization to strings
+		return o.normalizeValue(v, pointer), nil
 
 	case bool:
 		return v, nil
 
 	case float64:
-		return canonicalizeNumber(v)
+		return canonicalizeNumberAt(v, pointer)
 
 	case float32:
-		return canonicalizeNumber(float64(v))
+		return canonicalizeNumberAt(float64(v), pointer)
 
 	case int:
 		return float64(v), nil
@@ -267,16 +494,19 @@ func canonicalizeValue(value interface{}) (interface{}, error) {
 		return float64(v), nil
 
 	case json.Number:
+		if canonical, ok := canonicalDecimal(string(v)); ok {
+			return json.Number(canonical), nil
+		}
 		f, err := v.Float64()
 		if err != nil {
-			return nil, NewAshError(ErrCanonicalizationFailed, "invalid json.Number")
+			return nil, numberError(pointer, err)
 		}
-		return canonicalizeNumber(f)
+		return canonicalizeNumberAt(f, pointer)
 
 	case []interface{}:
 		result := make([]interface{}, len(v))
 		for i, item := range v {
-			canonicalized, err := canonicalizeValue(item)
+			canonicalized, err := canonicalizeValue(item, childPointer(pointer, strconv.Itoa(i)), o)
 			if err != nil {
 				return nil, err
 			}
@@ -286,32 +516,58 @@ func canonicalizeValue(value interface{}) (interface{}, error) {
 
 	case map[string]interface{}:
 		result := make(map[string]interface{})
+		// Of distinct keys that normalize to the same form, the one that
+		// sorts last keeps its value, as in ash-core.
+		winners := make(map[string]string, len(v))
 		for key, val := range v {
-			// Normalize key using NFC
-			normalizedKey := norm.NFC.String(key)
-			canonicalized, err := canonicalizeValue(val)
+			// Normalize key. Invalid UTF-8 is replaced first so that keys
+			// sort and collide as they are written.
+			normalizedKey := o.form.String(validUTF8(key))
+			keyPointer := childPointer(pointer, normalizedKey)
+			canonicalized, err := canonicalizeValue(val, keyPointer, o)
 			if err != nil {
 				return nil, err
 			}
+			if winner, exists := winners[normalizedKey]; exists && winner > key {
+				continue
+			}
+			winners[normalizedKey] = key
 			result[normalizedKey] = canonicalized
 		}
+		// Omitted members are removed only now, so that they still
+		// collide with keys normalizing alike.
+		for key, canonicalized := range result {
+			keyPointer := childPointer(pointer, key)
+			if o.omitMember(keyPointer, func() (string, error) { return buildCanonicalJSON(canonicalized, keyPointer) }) {
+				delete(result, key)
+			}
+		}
 		return result, nil
 
 	default:
-		return nil, NewAshError(ErrCanonicalizationFailed, fmt.Sprintf("unsupported type: %T", value))
+		return nil, canonicalizationError(ReasonUnsupportedType, pointer, fmt.Sprintf("unsupported type: %T", value))
+	}
+}
+
+// canonicalizeNumberAt canonicalizes a number, locating failures at pointer.
+func canonicalizeNumberAt(num float64, pointer string) (float64, error) {
+	result, err := canonicalizeNumber(num)
+	if err != nil {
+		return 0, canonicalizationError(err.(*AshError).Reason, pointer, err.(*AshError).Message)
 	}
+	return result, nil
 }
 
 // canonicalizeNumber canonicalizes a number according to ASH spec.
 func canonicalizeNumber(num float64) (float64, error) {
 	// Check for NaN
 	if num != num { // NaN is the only value that's not equal to itself
-		return 0, NewAshError(ErrCanonicalizationFailed, "NaN values are not allowed")
+		return 0, &AshError{Code: ErrCanonicalizationFailed, Message: "NaN values are not allowed", Reason: ReasonNaN}
 	}
 
 	// Check for Infinity
 	if num > 1e308 || num < -1e308 {
-		return 0, NewAshError(ErrCanonicalizationFailed, "Infinity values are not allowed")
+		return 0, &AshError{Code: ErrCanonicalizationFailed, Message: "Infinity values are not allowed", Reason: ReasonInfinity}
 	}
 
 	// Convert -0 to 0
@@ -323,18 +579,15 @@ func canonicalizeNumber(num float64) (float64, error) {
 }
 
 // buildCanonicalJSON builds canonical JSON string with sorted keys.
-func buildCanonicalJSON(value interface{}) (string, error) {
+// pointer is the JSON Pointer of value, used to locate failures.
+func buildCanonicalJSON(value interface{}, pointer string) (string, error) {
 	if value == nil {
 		return "null", nil
 	}
 
 	switch v := value.(type) {
 	case string:
-		bytes, err := json.Marshal(v)
-		if err != nil {
-			return "", err
-		}
-		return string(bytes), nil
+		return quoteJSONString(v), nil
 
 	case bool:
 		if v {
@@ -345,6 +598,10 @@ func buildCanonicalJSON(value interface{}) (string, error) {
 	case float64:
 		return formatNumber(v), nil
 
+	case json.Number:
+		// Left by canonicalizeValue, already in canonical form.
+		return string(v), nil
+
 	case []interface{}:
 		var sb strings.Builder
 		sb.WriteByte('[')
@@ -352,7 +609,7 @@ func buildCanonicalJSON(value interface{}) (string, error) {
 			if i > 0 {
 				sb.WriteByte(',')
 			}
-			itemStr, err := buildCanonicalJSON(item)
+			itemStr, err := buildCanonicalJSON(item, childPointer(pointer, strconv.Itoa(i)))
 			if err != nil {
 				return "", err
 			}
@@ -362,7 +619,8 @@ func buildCanonicalJSON(value interface{}) (string, error) {
 		return sb.String(), nil
 
 	case map[string]interface{}:
-		// Get keys and sort them
+		// Get keys and sort them by UTF-8 bytes, which for the valid UTF-8
+		// left by canonicalizeValue is code point order
 		keys := make([]string, 0, len(v))
 		for key := range v {
 			keys = append(keys, key)
@@ -375,14 +633,10 @@ func buildCanonicalJSON(value interface{}) (string, error) {
 			if i > 0 {
 				sb.WriteByte(',')
 			}
-			keyBytes, err := json.Marshal(key)
-			if err != nil {
-				return "", err
-			}
-			sb.Write(keyBytes)
+			sb.WriteString(quoteJSONString(key))
 			sb.WriteByte(':')
 
-			valStr, err := buildCanonicalJSON(v[key])
+			valStr, err := buildCanonicalJSON(v[key], childPointer(pointer, key))
 			if err != nil {
 				return "", err
 			}
@@ -392,8 +646,79 @@ func buildCanonicalJSON(value interface{}) (string, error) {
 		return sb.String(), nil
 
 	default:
-		return "", NewAshError(ErrCanonicalizationFailed, fmt.Sprintf("cannot serialize type: %T", value))
+		return "", canonicalizationError(ReasonUnsupportedType, pointer, fmt.Sprintf("cannot serialize type: %T", value))
+	}
+}
+
+// quoteJSONString quotes s as a JSON string exactly as JavaScript's
+// JSON.stringify does: only '"', '\' and control characters are escaped,
+// using the short forms \b \f \n \r \t where they exist and lowercase
+// \u00xx otherwise. Invalid UTF-8 is replaced with U+FFFD.
+func quoteJSONString(s string) string {
+	const hexDigits = "0123456789abcdef"
+	var sb strings.Builder
+	sb.Grow(len(s) + 2)
+	sb.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= utf8.RuneSelf {
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				sb.WriteRune(utf8.RuneError)
+			} else {
+				sb.WriteString(s[i : i+size])
+			}
+			i += size
+			continue
+		}
+		switch c {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\b':
+			sb.WriteString(`\b`)
+		case '\f':
+			sb.WriteString(`\f`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			if c < 0x20 {
+				sb.WriteString(`\u00`)
+				sb.WriteByte(hexDigits[c>>4])
+				sb.WriteByte(hexDigits[c&0xf])
+			} else {
+				sb.WriteByte(c)
+			}
+		}
+		i++
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// validUTF8 returns s with each byte that is not part of a valid UTF-8
+// sequence replaced by U+FFFD, as quoteJSONString writes it.
+func validUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	var sb strings.Builder
+	sb.Grow(len(s) + 2)
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			sb.WriteRune(utf8.RuneError)
+		} else {
+			sb.WriteString(s[i : i+size])
+		}
+		i += size
 	}
+	return sb.String()
 }
 
 // formatNumber formats a number without scientific notation.
@@ -403,8 +728,10 @@ func formatNumber(num float64) string {
 		return "0"
 	}
 
-	// Check if it's an integer
-	if num == float64(int64(num)) {
+	// Check if it's an integer. The range check comes first: converting a
+	// float outside the int64 range gives a different result on each
+	// architecture.
+	if num >= -(1<<63) && num < 1<<63 && num == float64(int64(num)) {
 		return strconv.FormatInt(int64(num), 10)
 	}
 
@@ -413,6 +740,86 @@ func formatNumber(num float64) string {
 	return str
 }
 
+// canonicalDecimal returns the canonical form of the JSON number s
+// computed from its digits, without converting it to a float64: trailing
+// zeros are stripped, the exponent is written out, and -0 becomes 0, so
+// that "1.230" is "1.23", "1e2" is "100" and "-0.0" is "0".
+//
+// It only handles numbers whose float64 conversion formatNumber renders
+// with the same digits: at most 15 significant digits, a magnitude below
+// 1e15 and, unless zero, of at least 1e-300. It reports false for other
+// numbers, and for text that is not a JSON number, which are canonicalized
+// through float64 instead.
+func canonicalDecimal(s string) (string, bool) {
+	neg := strings.HasPrefix(s, "-")
+	if neg {
+		s = s[1:]
+	}
+	mantissa, expText, hasExp := strings.Cut(s, "e")
+	if !hasExp {
+		mantissa, expText, hasExp = strings.Cut(s, "E")
+	}
+	intPart, fracPart, hasFrac := strings.Cut(mantissa, ".")
+	if !isDigits(intPart) || len(intPart) > 1 && intPart[0] == '0' || hasFrac && !isDigits(fracPart) {
+		return "", false
+	}
+	exp := 0
+	if hasExp {
+		digits := strings.TrimLeft(expText, "+-")
+		if !isDigits(digits) || len(expText)-len(digits) > 1 || len(digits) > 4 {
+			return "", false
+		}
+		exp, _ = strconv.Atoi(expText)
+	}
+
+	// The value is digits × 10^exp, with digits free of leading and
+	// trailing zeros.
+	digits := intPart + fracPart
+	exp -= len(fracPart)
+	digits = strings.TrimLeft(digits, "0")
+	if digits == "" {
+		return "0", true
+	}
+	trimmed := strings.TrimRight(digits, "0")
+	exp += len(digits) - len(trimmed)
+	digits = trimmed
+	if magnitude := len(digits) - 1 + exp; len(digits) > 15 || magnitude >= 15 || magnitude < -300 {
+		return "", false
+	}
+
+	var sb strings.Builder
+	if neg {
+		sb.WriteByte('-')
+	}
+	switch point := len(digits) + exp; {
+	case exp >= 0:
+		sb.WriteString(digits)
+		sb.WriteString(strings.Repeat("0", exp))
+	case point > 0:
+		sb.WriteString(digits[:point])
+		sb.WriteByte('.')
+		sb.WriteString(digits[point:])
+	default:
+		sb.WriteString("0.")
+		sb.WriteString(strings.Repeat("0", -point))
+		sb.WriteString(digits)
+	}
+	return sb.String(), true
+}
+
+// isDigits reports whether s is a non-empty run of ASCII digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
 // CanonicalizeURLEncoded canonicalizes URL-encoded form data.
 //
 // Rules (from ASH-Spec-v1.0):
@@ -421,17 +828,24 @@ func formatNumber(num float64) string {
 //   - Sort keys lexicographically
 //   - For duplicate keys: preserve value order per key
 //   - Output format: k1=v1&k1=v2&k2=v3
-//   - Unicode NFC applies after decoding
-func CanonicalizeURLEncoded(input string) (string, error) {
-	pairs, err := parseURLEncoded(input)
+//   - Unicode NFC applies after decoding (see WithUnicodeForm)
+//   - Output encoding: see percentEncode
+//   - At most DefaultMaxParams pairs (see WithMaxParams)
+func CanonicalizeURLEncoded(input string, opts ...CanonicalizeOption) (string, error) {
+	o := newCanonicalizeOptions(opts)
+	pairs, err := parseURLEncoded(o.trimURLEncoded(input), o)
 	if err != nil {
 		return "", err
 	}
+	return encodeCanonicalPairs(pairs, o), nil
+}
 
-	// Normalize all keys and values with NFC
+// encodeCanonicalPairs normalizes, sorts and encodes key-value pairs.
+func encodeCanonicalPairs(pairs []keyValuePair, o *canonicalizeOptions) string {
+	// Normalize all keys and values
 	for i := range pairs {
-		pairs[i].Key = norm.NFC.String(pairs[i].Key)
-		pairs[i].Value = norm.NFC.String(pairs[i].Value)
+		pairs[i].Key = o.form.String(pairs[i].Key)
+		pairs[i].Value = o.form.String(pairs[i].Value)
 	}
 
 	// Sort by key (stable sort preserves value order for same keys)
@@ -439,15 +853,50 @@ func CanonicalizeURLEncoded(input string) (string, error) {
 		return pairs[i].Key < pairs[j].Key
 	})
 
-	// Encode and join (use %20 for spaces instead of +)
+	// Encode and join
 	var parts []string
 	for _, pair := range pairs {
-		key := strings.ReplaceAll(url.QueryEscape(pair.Key), "+", "%20")
-		value := strings.ReplaceAll(url.QueryEscape(pair.Value), "+", "%20")
-		parts = append(parts, key+"="+value)
+		parts = append(parts, percentEncode(pair.Key)+"="+percentEncode(pair.Value))
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// percentEncode encodes s for canonical URL-encoded output.
+//
+// Only the RFC 3986 unreserved characters (A-Z a-z 0-9 - . _ ~) are left
+// as-is. Every other byte of the UTF-8 encoding, including space and '+',
+// is written as %XX with uppercase hex digits, so a space is always %20
+// and never '+'.
+func percentEncode(s string) string {
+	const upperHex = "0123456789ABCDEF"
+
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isUnreserved(c) {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte('%')
+		sb.WriteByte(upperHex[c>>4])
+		sb.WriteByte(upperHex[c&0x0F])
 	}
+	return sb.String()
+}
+
+// isUnreserved reports whether c is an RFC 3986 unreserved character.
+func isUnreserved(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
 
-	return strings.Join(parts, "&"), nil
+// CanonicalizeQuery canonicalizes the query component of a URL (as in
+// url.URL.RawQuery) using the CanonicalizeURLEncoded rules. A leading '?'
+// is ignored and an empty query canonicalizes to "".
+func CanonicalizeQuery(rawQuery string, opts ...CanonicalizeOption) (string, error) {
+	return CanonicalizeURLEncoded(strings.TrimPrefix(rawQuery, "?"), opts...)
 }
 
 // keyValuePair represents a key-value pair for URL encoding.
@@ -456,15 +905,24 @@ type keyValuePair struct {
 	Value string
 }
 
-// parseURLEncoded parses URL-encoded string into key-value pairs.
-func parseURLEncoded(input string) ([]keyValuePair, error) {
+// errInvalidURLEncoding is returned for a malformed percent escape.
+var errInvalidURLEncoding = &AshError{Code: ErrCanonicalizationFailed, Message: "invalid URL encoding", Reason: ReasonInvalidURLEncoding}
+
+// parseURLEncoded parses URL-encoded string into key-value pairs, failing
+// once there are more than o allows (see WithMaxParams). A nil o sets no
+// limit.
+func parseURLEncoded(input string, o *canonicalizeOptions) ([]keyValuePair, error) {
 	if input == "" {
 		return nil, nil
 	}
 
 	var pairs []keyValuePair
 
-	for _, part := range strings.Split(input, "&") {
+	// Parts are cut one at a time rather than split, so that the limit is
+	// reached before a slice of every part is allocated.
+	for rest := input; rest != ""; {
+		var part string
+		part, rest, _ = strings.Cut(rest, "&")
 		// Skip empty parts
 		if part == "" {
 			continue
@@ -473,85 +931,92 @@ func parseURLEncoded(input string) ([]keyValuePair, error) {
 		// Replace + with space before decoding
 		part = strings.ReplaceAll(part, "+", " ")
 
-		eqIndex := strings.Index(part, "=")
-		if eqIndex == -1 {
-			// Key with no value
-			key, err := url.QueryUnescape(part)
-			if err != nil {
-				return nil, NewAshError(ErrCanonicalizationFailed, "invalid URL encoding")
-			}
-			if key != "" {
-				pairs = append(pairs, keyValuePair{Key: key, Value: ""})
-			}
-		} else {
-			key, err := url.QueryUnescape(part[:eqIndex])
-			if err != nil {
-				return nil, NewAshError(ErrCanonicalizationFailed, "invalid URL encoding")
-			}
-			value, err := url.QueryUnescape(part[eqIndex+1:])
-			if err != nil {
-				return nil, NewAshError(ErrCanonicalizationFailed, "invalid URL encoding")
-			}
-			if key != "" {
-				pairs = append(pairs, keyValuePair{Key: key, Value: value})
+		rawKey, rawValue, _ := strings.Cut(part, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			return nil, errInvalidURLEncoding
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			return nil, errInvalidURLEncoding
+		}
+		if key == "" {
+			continue
+		}
+		if o != nil {
+			if err := o.checkParams(len(pairs)); err != nil {
+				return nil, err
 			}
 		}
+		pairs = append(pairs, keyValuePair{Key: key, Value: value})
 	}
 
 	return pairs, nil
 }
 
-// CanonicalizeURLEncodedFromMap canonicalizes URL-encoded data from a map.
-func CanonicalizeURLEncodedFromMap(data map[string][]string) string {
-	var pairs []keyValuePair
-
-	for key, values := range data {
-		for _, value := range values {
-			pairs = append(pairs, keyValuePair{Key: key, Value: value})
+// CanonicalizeURLEncodedFromMap canonicalizes URL-encoded data from a map,
+// such as url.Values. Keys and values are taken as decoded text and encoded
+// with the same rules as CanonicalizeURLEncoded, so spaces serialize as %20
+// and '&', '=' and '+' are escaped.
+//
+// The output is that of CanonicalizeURLEncoded on url.Values(data).Encode():
+//   - A key with a nil or empty slice contributes no pairs; a key with the
+//     value "" contributes "key="
+//   - The empty key is dropped, as a pair with an empty key is when parsed
+//   - Values of one key keep their slice order
+//   - Keys that normalize to the same key (see WithUnicodeForm) are
+//     merged in the order of their unnormalized bytes, so the output never
+//     depends on map iteration order
+func CanonicalizeURLEncodedFromMap(data map[string][]string, opts ...CanonicalizeOption) string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		if key != "" {
+			keys = append(keys, key)
 		}
 	}
+	sort.Strings(keys)
 
-	// Normalize all keys and values with NFC
-	for i := range pairs {
-		pairs[i].Key = norm.NFC.String(pairs[i].Key)
-		pairs[i].Value = norm.NFC.String(pairs[i].Value)
-	}
-
-	// Sort by key (stable sort preserves value order for same keys)
-	sort.SliceStable(pairs, func(i, j int) bool {
-		return pairs[i].Key < pairs[j].Key
-	})
-
-	// Encode and join (use %20 for spaces instead of +)
-	var parts []string
-	for _, pair := range pairs {
-		key := strings.ReplaceAll(url.QueryEscape(pair.Key), "+", "%20")
-		value := strings.ReplaceAll(url.QueryEscape(pair.Value), "+", "%20")
-		parts = append(parts, key+"="+value)
+	var pairs []keyValuePair
+	for _, key := range keys {
+		for _, value := range data[key] {
+			pairs = append(pairs, keyValuePair{Key: key, Value: value})
+		}
 	}
 
-	return strings.Join(parts, "&")
+	return encodeCanonicalPairs(pairs, newCanonicalizeOptions(opts))
 }
 
 // NormalizeBinding normalizes a binding string.
 //
-// Rules (from ASH-Spec-v1.0):
+// Rules (from ASH-Spec-v1.0; see testdata/bindings/vectors.json for the
+// test vectors):
 //   - Format: "METHOD /path"
 //   - Method uppercased
-//   - Path must start with /
-//   - Path excludes query string
+//   - Path excludes the fragment (from the first '#') and the query string
+//     (from the first '?')
+//   - Path must start with /, which is added if missing
 //   - Collapse duplicate slashes
+//   - Trailing slash removed (except for the root)
+//   - Bytes that are not valid UTF-8 become U+FFFD
+//
+// Nothing else changes. The path is taken as decoded (as r.URL.Path is),
+// so percent-escapes are not decoded again and "%2F" is not a separator,
+// and "." and ".." segments, control characters, backslashes and
+// non-ASCII characters are kept as is. For a path that starts with / and
+// has no fragment or surrounding whitespace, the result is the same as
+// ash-core's normalize_binding, so the rules must change there first. See
+// RequestPath for building the path of a request.
 func NormalizeBinding(method, path string) string {
 	// Uppercase method
 	normalizedMethod := strings.ToUpper(method)
 
 	// Remove fragment (#...) first
-	if fragIndex := strings.Index(path, "#"); fragIndex != -1 {
+	if fragIndex := strings.IndexByte(path, '#'); fragIndex != -1 {
 		path = path[:fragIndex]
 	}
 
 	// Remove query string
-	if queryIndex := strings.Index(path, "?"); queryIndex != -1 {
+	if queryIndex := strings.IndexByte(path, '?'); queryIndex != -1 {
 		path = path[:queryIndex]
 	}
 
@@ -562,6 +1027,9 @@ func NormalizeBinding(method, path string) string {
 
 	// Collapse duplicate slashes
 	var sb strings.Builder
+	sb.Grow(len(normalizedMethod) + 1 + len(path))
+	sb.WriteString(normalizedMethod)
+	sb.WriteByte(' ')
 	prevSlash := false
 	for _, r := range path {
 		if r == '/' {
@@ -574,14 +1042,14 @@ func NormalizeBinding(method, path string) string {
 			prevSlash = false
 		}
 	}
-	path = sb.String()
+	binding := sb.String()
 
 	// Remove trailing slash (except for root)
-	if len(path) > 1 && strings.HasSuffix(path, "/") {
-		path = path[:len(path)-1]
+	if len(binding) > len(normalizedMethod)+2 && strings.HasSuffix(binding, "/") {
+		binding = binding[:len(binding)-1]
 	}
 
-	return normalizedMethod + " " + path
+	return binding
 }
 
 // TimingSafeCompare compares two strings in constant time.
@@ -615,12 +1083,8 @@ func TimingSafeCompareBytes(a, b []byte) bool {
 
 // IsValidMode checks if a mode is valid.
 func IsValidMode(mode AshMode) bool {
-	switch mode {
-	case ModeMinimal, ModeBalanced, ModeStrict:
-		return true
-	default:
-		return false
-	}
+	_, ok := mode.Requirements()
+	return ok
 }
 
 // IsValidHTTPMethod checks if an HTTP method is valid.
@@ -633,15 +1097,23 @@ func IsValidHTTPMethod(method HttpMethod) bool {
 	}
 }
 
-// ParseJSON parses a JSON string and canonicalizes it.
-func ParseJSON(jsonStr string) (string, error) {
+// ParseJSON parses a JSON string and canonicalizes it. Anything after the
+// first value is ignored unless WithRejectTrailingData is given.
+func ParseJSON(jsonStr string, opts ...CanonicalizeOption) (string, error) {
 	var data interface{}
 	decoder := json.NewDecoder(strings.NewReader(jsonStr))
 	decoder.UseNumber()
 	if err := decoder.Decode(&data); err != nil {
-		return "", NewAshError(ErrCanonicalizationFailed, "invalid JSON: "+err.Error())
+		return "", invalidJSON(err)
+	}
+	o := newCanonicalizeOptions(opts)
+	if err := o.checkTopLevel(data); err != nil {
+		return "", err
+	}
+	if err := o.checkTrailing(decoder); err != nil {
+		return "", err
 	}
-	return CanonicalizeJSON(data)
+	return CanonicalizeJSON(data, opts...)
 }
 
 // Common errors
@@ -652,20 +1124,54 @@ var (
 	ErrEmptyContextID = errors.New("empty context ID")
 	// ErrEmptyBinding is returned when binding is empty.
 	ErrEmptyBinding = errors.New("empty binding")
+	// ErrInvalidTenant is returned when a tenant is not printable ASCII.
+	ErrInvalidTenant = errors.New("invalid tenant")
 )
 
+// validateTenant checks that a tenant fits on one preamble line.
+func validateTenant(tenant string) error {
+	for i := 0; i < len(tenant); i++ {
+		if tenant[i] < 0x20 || tenant[i] > 0x7e {
+			return ErrInvalidTenant
+		}
+	}
+	return nil
+}
+
 // ValidateProofInput validates the proof input.
 func ValidateProofInput(input BuildProofInput) error {
-	if !IsValidMode(input.Mode) {
+	req, ok := input.Mode.Requirements()
+	if !ok {
 		return NewAshError(ErrModeViolation, "invalid mode")
 	}
+	if err := req.checkBound(input.Mode, input.Nonce, input.Tenant); err != nil {
+		return err
+	}
 	if input.ContextID == "" {
 		return ErrEmptyContextID
 	}
 	if input.Binding == "" {
 		return ErrEmptyBinding
 	}
-	return nil
+	if err := validateTenant(input.Tenant); err != nil {
+		return err
+	}
+	if strings.ContainsAny(input.Metadata, "\r\n") {
+		return NewAshError(ErrMalformedRequest, "invalid metadata")
+	}
+	if strings.ContainsAny(input.SessionKey, "\r\n") {
+		return NewAshError(ErrMalformedRequest, "invalid session key")
+	}
+	return validateExtensions(input.Extensions)
+}
+
+// BuildProofChecked validates the input with ValidateProofInput and then
+// builds the proof.
+func BuildProofChecked(input BuildProofInput) (string, error) {
+	if err := ValidateProofInput(input); err != nil {
+		return "", err
+	}
+	return BuildProof(input), nil
 }
 
 // IsASCII checks if a string contains only ASCII characters.
@@ -682,12 +1188,6 @@ func IsASCII(s string) bool {
 // ASH v2.1 - Derived Client Secret & Cryptographic Proof
 // =========================================================================
 
-import (
-	"crypto/hmac"
-	"crypto/rand"
-	"encoding/hex"
-)
-
 // GenerateNonce generates a cryptographically secure random nonce.
 // Returns hex-encoded nonce (64 chars for 32 bytes).
 func GenerateNonce(bytes int) (string, error) {
@@ -2,6 +2,10 @@ package ash
 
 import (
 	"encoding/json"
+	"math"
+	"math/rand"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -292,6 +296,101 @@ func TestCanonicalizeJSONKeyOrder(t *testing.T) {
 	}
 }
 
+// TestCanonicalizeJSONCodePointOrder tests that keys sort by code point,
+// including keys with invalid UTF-8, which sort as written.
+func TestCanonicalizeJSONCodePointOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    map[string]interface{}
+		expected string
+	}{
+		{
+			// A UTF-16 sort puts U+1F600 (a surrogate pair) before U+FF61.
+			name:     "astral after BMP",
+			input:    map[string]interface{}{"\U0001F600": 1.0, "\uFF61": 2.0, "\uE000": 3.0},
+			expected: "{\"\uE000\":3,\"\uFF61\":2,\"\U0001F600\":1}",
+		},
+		{
+			// Raw, "\x80" sorts before U+4E00; as written, U+FFFD does not.
+			name:     "invalid UTF-8",
+			input:    map[string]interface{}{"\x80": 1.0, "\u4e00": 2.0},
+			expected: "{\"\u4e00\":2,\"\uFFFD\":1}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := CanonicalizeJSON(tt.input)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+
+	// Of keys that are written the same, the one that sorts last wins.
+	result, err := CanonicalizeJSON(map[string]interface{}{"\xfe": 1.0, "\xff": 2.0})
+	if err != nil || result != "{\"\ufffd\":2}" {
+		t.Errorf("Keys written alike: got %q, %v", result, err)
+	}
+}
+
+// TestCanonicalizeJSONErrorPointer tests that canonicalization errors
+// locate the offending value with a JSON Pointer.
+func TestCanonicalizeJSONErrorPointer(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   interface{}
+		pointer string
+	}{
+		{
+			name:    "root value",
+			input:   make(chan int),
+			pointer: "",
+		},
+		{
+			name: "nested map",
+			input: map[string]interface{}{
+				"settings": map[string]interface{}{
+					"limits": map[string]interface{}{"max": math.NaN()},
+				},
+			},
+			pointer: "/settings/limits/max",
+		},
+		{
+			name: "array index",
+			input: map[string]interface{}{
+				"settings": map[string]interface{}{
+					"flags": []interface{}{true, true, false, map[string]interface{}{"value": make(chan int)}},
+				},
+			},
+			pointer: "/settings/flags/3/value",
+		},
+		{
+			name:    "escaped key",
+			input:   map[string]interface{}{"a/b": map[string]interface{}{"c~d": math.Inf(1)}},
+			pointer: "/a~1b/c~0d",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CanonicalizeJSON(tt.input)
+			ashErr, ok := err.(*AshError)
+			if !ok || ashErr.Code != ErrCanonicalizationFailed {
+				t.Fatalf("Expected ErrCanonicalizationFailed, got %v", err)
+			}
+			if ashErr.Pointer != tt.pointer {
+				t.Errorf("Expected pointer %q, got %q", tt.pointer, ashErr.Pointer)
+			}
+			if tt.pointer != "" && !strings.HasSuffix(ashErr.Message, " at "+tt.pointer) {
+				t.Errorf("Expected message to include pointer, got %q", ashErr.Message)
+			}
+		})
+	}
+}
+
 // TestParseJSON tests JSON parsing and canonicalization.
 func TestParseJSON(t *testing.T) {
 	tests := []struct {
@@ -337,6 +436,87 @@ func TestParseJSON(t *testing.T) {
 	}
 }
 
+// TestParseJSONNumbers tests the canonical form of JSON numbers, by
+// ParseJSON and CanonicalizeJSONStream alike.
+func TestParseJSONNumbers(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"1.230", "1.23"},
+		{"-0.0", "0"},
+		{"-0", "0"},
+		{"0e5", "0"},
+		{"1e2", "100"},
+		{"1E+2", "100"},
+		{"100.000", "100"},
+		{"1.0", "1"},
+		{"0.5", "0.5"},
+		{"-0.050", "-0.05"},
+		{"12.5e-3", "0.0125"},
+		{"1.5e-7", "0.00000015"},
+		{"123456789012345", "123456789012345"},
+		{"0.1", "0.1"},
+		// Through float64: more than 15 significant digits, or too large
+		// or small to be written from the digits.
+		{"0.30000000000000004441", "0.30000000000000004"},
+		{"1e20", "100000000000000000000"},
+		{"9007199254740993", "9007199254740992"},
+		{"1e-320", "0." + strings.Repeat("0", 319) + "1"},
+	}
+	for _, tt := range tests {
+		got, err := ParseJSON(tt.input)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseJSON(%s) = %q, %v; want %q", tt.input, got, err, tt.want)
+		}
+		var buf strings.Builder
+		if err := CanonicalizeJSONStream(strings.NewReader(tt.input), &buf); err != nil || buf.String() != tt.want {
+			t.Errorf("CanonicalizeJSONStream(%s) = %q, %v; want %q", tt.input, buf.String(), err, tt.want)
+		}
+	}
+	if _, err := ParseJSON("1e400"); err == nil {
+		t.Error("Expected 1e400 to be rejected as Infinity")
+	}
+}
+
+// TestCanonicalDecimal tests that numbers canonicalized from their digits
+// match their canonicalization through float64.
+func TestCanonicalDecimal(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		digits := strconv.FormatInt(rng.Int63n(1e15), 10)
+		var s string
+		switch i % 3 {
+		case 0:
+			s = digits
+		case 1:
+			point := rng.Intn(len(digits) + 1)
+			s = digits[:point] + "." + digits[point:] + strings.Repeat("0", rng.Intn(3))
+			if point == 0 {
+				s = "0" + s
+			}
+		default:
+			s = digits + "e" + strconv.Itoa(rng.Intn(40)-30)
+		}
+		if rng.Intn(2) == 0 {
+			s = "-" + s
+		}
+		got, ok := canonicalDecimal(s)
+		if !ok {
+			continue
+		}
+		f, _ := strconv.ParseFloat(s, 64)
+		if want := formatNumber(f); got != want {
+			t.Fatalf("canonicalDecimal(%s) = %s, float64 gives %s", s, got, want)
+		}
+	}
+
+	for _, s := range []string{"", "-", "01", "1.", ".5", "1e", "1e+-2", "+1", "0x10", "Inf", "NaN", "1_000"} {
+		if got, ok := canonicalDecimal(s); ok {
+			t.Errorf("canonicalDecimal(%q) = %q, want not handled", s, got)
+		}
+	}
+}
+
 // TestCanonicalizeURLEncoded tests URL-encoded canonicalization.
 func TestCanonicalizeURLEncoded(t *testing.T) {
 	tests := []struct {
@@ -385,6 +565,26 @@ func TestCanonicalizeURLEncoded(t *testing.T) {
 			input:    "a=1&&b=2",
 			expected: "a=1&b=2",
 		},
+		{
+			name:     "encoded plus stays plus",
+			input:    "key=a%2Bb",
+			expected: "key=a%2Bb",
+		},
+		{
+			name:     "reserved characters encoded",
+			input:    "q=%21%2A%27%28%29%3B%3A%40%26%3D%24%2C%2F%3F%23%5B%5D",
+			expected: "q=%21%2A%27%28%29%3B%3A%40%26%3D%24%2C%2F%3F%23%5B%5D",
+		},
+		{
+			name:     "unreserved characters left as-is",
+			input:    "q=AZaz09-._%7E",
+			expected: "q=AZaz09-._~",
+		},
+		{
+			name:     "lowercase hex normalized",
+			input:    "q=%c3%a9",
+			expected: "q=%C3%A9",
+		},
 	}
 
 	for _, tt := range tests {
@@ -407,6 +607,83 @@ func TestCanonicalizeURLEncoded(t *testing.T) {
 	}
 }
 
+// TestPercentEncode tests the pinned output encoding.
+func TestPercentEncode(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"hello world", "hello%20world"},
+		{"a+b", "a%2Bb"},
+		{"a&b=c", "a%26b%3Dc"},
+		{"~user.name_1-2", "~user.name_1-2"},
+		{"*!'()", "%2A%21%27%28%29"},
+		{"é", "%C3%A9"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if result := percentEncode(tt.input); result != tt.expected {
+			t.Errorf("percentEncode(%q) = %q, want %q", tt.input, result, tt.expected)
+		}
+	}
+}
+
+// TestCanonicalizeQuery tests query string canonicalization.
+func TestCanonicalizeQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"empty", "", ""},
+		{"question mark only", "?", ""},
+		{"leading question mark", "?b=2&a=1", "a=1&b=2"},
+		{"single pair", "key=value", "key=value"},
+		{"multiple pairs sorted", "b=2&a=1", "a=1&b=2"},
+		{"repeated parameters preserve order", "tag=z&id=1&tag=a&tag=m", "id=1&tag=z&tag=a&tag=m"},
+		{"plus as space", "q=hello+world", "q=hello%20world"},
+		{"percent encoded", "q=hello%20world", "q=hello%20world"},
+		{"key without value", "flag", "flag="},
+		{"empty parts skipped", "a=1&&b=2", "a=1&b=2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := CanonicalizeQuery(tt.input)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+
+	if _, err := CanonicalizeQuery("q=%zz"); err == nil {
+		t.Error("Expected error for invalid percent encoding")
+	}
+}
+
+// TestURLEncodedSpacesNeverPlus tests that spaces always serialize as %20,
+// whichever way they arrive.
+func TestURLEncodedSpacesNeverPlus(t *testing.T) {
+	for _, input := range []string{"key=hello world", "key=hello+world", "key=hello%20world"} {
+		result, err := CanonicalizeURLEncoded(input)
+		if err != nil {
+			t.Fatalf("CanonicalizeURLEncoded(%q) failed: %v", input, err)
+		}
+		if result != "key=hello%20world" {
+			t.Errorf("CanonicalizeURLEncoded(%q) = %q, want key=hello%%20world", input, result)
+		}
+	}
+
+	result := CanonicalizeURLEncodedFromMap(map[string][]string{"my key": {"hello world"}})
+	if result != "my%20key=hello%20world" {
+		t.Errorf("CanonicalizeURLEncodedFromMap = %q, want my%%20key=hello%%20world", result)
+	}
+}
+
 // TestNormalizeBinding tests binding normalization.
 func TestNormalizeBinding(t *testing.T) {
 	tests := []struct {
@@ -757,31 +1034,81 @@ func TestContextPublicInfoJSON(t *testing.T) {
 	}
 }
 
-// TestCanonicalizeURLEncodedFromMap tests URL encoding from map.
+// TestCanonicalizeURLEncodedFromMap tests URL encoding from a map against
+// exact expected output.
 func TestCanonicalizeURLEncodedFromMap(t *testing.T) {
-	data := map[string][]string{
-		"b": {"2"},
-		"a": {"1", "3"},
+	for _, tt := range []struct {
+		name string
+		data map[string][]string
+		want string
+	}{
+		{"sorted keys, values in order", map[string][]string{"b": {"2"}, "a": {"3", "1"}}, "a=3&a=1&b=2"},
+		{"empty", map[string][]string{}, ""},
+		{"nil map", nil, ""},
+		{"nil slice", map[string][]string{"a": nil, "b": {"1"}}, "b=1"},
+		{"empty slice", map[string][]string{"a": {}}, ""},
+		{"empty value", map[string][]string{"a": {""}}, "a="},
+		{"empty key", map[string][]string{"": {"1"}, "a": {"2"}}, "a=2"},
+		{"reserved characters", map[string][]string{"a&b": {"c=d&e"}, "f": {"1+1 = 2"}}, "a%26b=c%3Dd%26e&f=1%2B1%20%3D%202"},
+		{"percent", map[string][]string{"%41": {"100%"}}, "%2541=100%25"},
+		{"unicode", map[string][]string{"caf\u00e9": {"na\u00efve"}}, "caf%C3%A9=na%C3%AFve"},
+		// "e\u0301" normalizes to "\u00e9", so both keys merge, ordered by
+		// their unnormalized bytes ("e" sorts before "\u00e9").
+		{"normalized keys merge", map[string][]string{"\u00e9": {"1"}, "e\u0301": {"2"}}, "%C3%A9=2&%C3%A9=1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CanonicalizeURLEncodedFromMap(tt.data); got != tt.want {
+				t.Errorf("CanonicalizeURLEncodedFromMap = %q, want %q", got, tt.want)
+			}
+		})
 	}
+}
 
-	result := CanonicalizeURLEncodedFromMap(data)
-
-	// Should have a=1, a=3, b=2 (sorted by key, values in order)
-	if !strings.Contains(result, "a=1") {
-		t.Error("Result should contain a=1")
-	}
-	if !strings.Contains(result, "a=3") {
-		t.Error("Result should contain a=3")
-	}
-	if !strings.Contains(result, "b=2") {
-		t.Error("Result should contain b=2")
+// TestCanonicalizeURLEncodedFromMapEquivalence tests that randomized
+// url.Values canonicalize the same from the map, from their encoding and
+// from the map parsed back from their encoding.
+func TestCanonicalizeURLEncodedFromMapEquivalence(t *testing.T) {
+	alphabet := []string{"a", "b", "Z", "0", " ", "&", "=", "+", "%", "/", "?", "#", "~", "-", "\u00e9", "e\u0301", "\u00fc", "\U0001F600"}
+	rng := rand.New(rand.NewSource(1))
+	text := func(max int) string {
+		var sb strings.Builder
+		for n := rng.Intn(max + 1); n > 0; n-- {
+			sb.WriteString(alphabet[rng.Intn(len(alphabet))])
+		}
+		return sb.String()
 	}
+	for i := 0; i < 2000; i++ {
+		values := url.Values{}
+		for n := rng.Intn(6); n > 0; n-- {
+			key := text(3)
+			switch rng.Intn(4) {
+			case 0:
+				values[key] = nil
+			case 1:
+				values[key] = []string{}
+			default:
+				for m := rng.Intn(3) + 1; m > 0; m-- {
+					values[key] = append(values[key], text(4))
+				}
+			}
+		}
 
-	// Verify a comes before b
-	aIdx := strings.Index(result, "a=")
-	bIdx := strings.Index(result, "b=")
-	if aIdx > bIdx {
-		t.Error("a should come before b in sorted result")
+		fromMap := CanonicalizeURLEncodedFromMap(values)
+		encoded := values.Encode()
+		fromString, err := CanonicalizeURLEncoded(encoded)
+		if err != nil {
+			t.Fatalf("CanonicalizeURLEncoded(%q) failed: %v", encoded, err)
+		}
+		if fromMap != fromString {
+			t.Fatalf("%#v: from map %q, from %q %q", values, fromMap, encoded, fromString)
+		}
+		parsed, err := url.ParseQuery(encoded)
+		if err != nil {
+			t.Fatalf("ParseQuery(%q) failed: %v", encoded, err)
+		}
+		if got := CanonicalizeURLEncodedFromMap(parsed); got != fromMap {
+			t.Fatalf("%#v: round-tripped %q, want %q", values, got, fromMap)
+		}
 	}
 }
 
@@ -0,0 +1,68 @@
+package ashtest_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ash "github.com/3maem/ash-go"
+	"github.com/3maem/ash-go/ashtest"
+)
+
+// newProtectedHandler returns a handler behind HTTPMiddleware that echoes
+// the verified body.
+func newProtectedHandler(t *testing.T) (*ash.Ash, http.Handler) {
+	t.Helper()
+	a, err := ash.New(ash.NewMemoryStore(ash.MemoryStoreOptions{}))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+	return a, a.HTTPMiddleware(ash.MiddlewareOptions{})(echo)
+}
+
+// TestSignRequest tests that signed requests pass the middleware once.
+func TestSignRequest(t *testing.T) {
+	a, handler := newProtectedHandler(t)
+
+	const body = `{"to":"bob","amount":10}`
+	req := httptest.NewRequest("POST", "/api/transfer", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	ctx := ashtest.SignRequest(t, a, req)
+	if ctx.Binding != "POST /api/transfer" {
+		t.Errorf("Binding = %q", ctx.Binding)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != body {
+		t.Fatalf("Response = %d %q, want 200 with the body", rec.Code, rec.Body.String())
+	}
+
+	replay := httptest.NewRequest("POST", "/api/transfer", strings.NewReader(body))
+	replay.Header = req.Header.Clone()
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, replay)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Replay status = %d, want 409: %s", rec.Code, rec.Body.String())
+	}
+}
+
+// TestSignRequestWithoutBody tests signing a request that has no body.
+func TestSignRequestWithoutBody(t *testing.T) {
+	a, handler := newProtectedHandler(t)
+
+	req := httptest.NewRequest("GET", "/api/balance", nil)
+	ashtest.SignRequestWith(t, a, req, ash.ContextOptions{Mode: ash.ModeStrict})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+}
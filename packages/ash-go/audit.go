@@ -0,0 +1,126 @@
+package ash
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEvent records the consumption of a context.
+type AuditEvent struct {
+	// ContextID is the consumed context.
+	ContextID string `json:"contextId"`
+	// Binding is the binding of the context.
+	Binding string `json:"binding"`
+	// Mode is the security mode of the context.
+	Mode AshMode `json:"mode"`
+	// Tenant is the tenant of the context, if any.
+	Tenant string `json:"tenant,omitempty"`
+	// ConsumedAt is when verification consumed the context.
+	ConsumedAt time.Time `json:"consumedAt"`
+	// Metadata is the server-side metadata of the context.
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// Payload is the canonical payload, redacted by the Redactor set with
+	// WithRedaction. It is set only with WithAuditPayload, and never for
+	// VerifyStream.
+	Payload string `json:"payload,omitempty"`
+}
+
+// AuditSink receives an AuditEvent for every successful verification,
+// after the context has been consumed.
+type AuditSink interface {
+	Record(event AuditEvent) error
+}
+
+// WithAuditSink sets the audit sink. By default a sink error is logged and
+// verification still succeeds; see WithAuditRequired.
+func WithAuditSink(sink AuditSink) Option {
+	return func(a *Ash) { a.auditSink = sink }
+}
+
+// WithAuditRequired makes a sink error fail verification with
+// ErrInternalError. The context stays consumed, so the client must obtain
+// a new one to retry.
+func WithAuditRequired(required bool) Option {
+	return func(a *Ash) { a.auditRequired = required }
+}
+
+// WithAuditPayload includes the canonical payload of each request in its
+// AuditEvent. Use WithRedaction to keep secrets such as passwords out of
+// the audit log.
+func WithAuditPayload(on bool) Option {
+	return func(a *Ash) { a.auditPayload = on }
+}
+
+// NopAuditSink discards events.
+type NopAuditSink struct{}
+
+// Record discards event.
+func (NopAuditSink) Record(AuditEvent) error { return nil }
+
+// FileAuditSink appends events to a file as JSON lines.
+type FileAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewFileAuditSink opens path for appending, creating it with mode 0600 if
+// it does not exist.
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record appends event as one line.
+func (s *FileAuditSink) Record(event AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(event)
+}
+
+// Close closes the file.
+func (s *FileAuditSink) Close() error {
+	return s.file.Close()
+}
+
+// audit records the consumption of ctx, verified against payload. Unless
+// the audit is required, the record is delivered asynchronously when
+// WithAsyncDelivery is set.
+func (a *Ash) audit(ctx *Context, payload verifyPayload, contentType string) error {
+	if a.auditSink == nil {
+		return nil
+	}
+	event := AuditEvent{
+		ContextID:  ctx.ID,
+		Binding:    ctx.Binding,
+		Mode:       ctx.Mode,
+		Tenant:     ctx.Tenant,
+		ConsumedAt: a.now(),
+		Metadata:   ctx.Metadata,
+	}
+	if a.auditPayload {
+		event.Payload, _ = a.emittedPayload(payload, contentType, ctx)
+	}
+	if !a.auditRequired {
+		a.deliver(ctx.ID, func() { a.recordAudit(event) })
+		return nil
+	}
+	if err := a.recordAudit(event); err != nil {
+		return NewAshError(ErrInternalError, "audit failed")
+	}
+	return nil
+}
+
+// recordAudit passes event to the sink, logging a failure.
+func (a *Ash) recordAudit(event AuditEvent) error {
+	err := a.auditSink.Record(event)
+	if err != nil {
+		a.logger.Error("ash: audit sink failed", "contextId", event.ContextID, "error", err)
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package ash
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// auditSinkFunc adapts a function to an AuditSink.
+type auditSinkFunc func(AuditEvent) error
+
+func (f auditSinkFunc) Record(event AuditEvent) error { return f(event) }
+
+// TestFileAuditSink tests that consumption is appended to the audit file.
+func TestFileAuditSink(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileAuditSink(path)
+	if err != nil {
+		t.Fatalf("NewFileAuditSink failed: %v", err)
+	}
+	a, _ := newTestAsh(t, now, WithAuditSink(sink))
+
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/test", Metadata: map[string]interface{}{"user": "u1"}})
+	if _, err := a.Verify(ctx.ID, clientProof(t, ctx, "", ""), ctx.Binding, nil, ""); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	// Failed verifications are not audited.
+	a.Verify(ctx.ID, clientProof(t, ctx, "", ""), ctx.Binding, nil, "")
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid audit line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 audit event, got %d", len(events))
+	}
+	event := events[0]
+	if event.ContextID != ctx.ID || event.Binding != ctx.Binding || !event.ConsumedAt.Equal(now) || event.Metadata["user"] != "u1" {
+		t.Errorf("Unexpected audit event: %+v", event)
+	}
+}
+
+// TestAuditSinkFailure tests that sink failures only fail verification
+// when auditing is required.
+func TestAuditSinkFailure(t *testing.T) {
+	failing := auditSinkFunc(func(AuditEvent) error { return errors.New("disk full") })
+
+	for _, required := range []bool{false, true} {
+		a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithAuditSink(failing), WithAuditRequired(required))
+		ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/test"})
+		_, err := a.Verify(ctx.ID, clientProof(t, ctx, "", ""), ctx.Binding, nil, "")
+
+		var ashErr *AshError
+		if required {
+			if !errors.As(err, &ashErr) || ashErr.Code != ErrInternalError {
+				t.Errorf("required: expected %s, got %v", ErrInternalError, err)
+			}
+		} else if err != nil {
+			t.Errorf("not required: Verify failed: %v", err)
+		}
+	}
+}
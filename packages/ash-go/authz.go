@@ -0,0 +1,165 @@
+package ash
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AuthzCheckRequest is the check request accepted by AuthzHandler. It has
+// the JSON shape of an Envoy ext_authz CheckRequest, of which only
+// attributes.request.http is read.
+type AuthzCheckRequest struct {
+	Attributes struct {
+		Request struct {
+			HTTP AuthzHTTPRequest `json:"http"`
+		} `json:"request"`
+	} `json:"attributes"`
+}
+
+// AuthzHTTPRequest describes the request being checked.
+type AuthzHTTPRequest struct {
+	// Method is the request method.
+	Method string `json:"method"`
+	// Path is the request path as sent, optionally with a query string.
+	// It is decoded with RequestPath before normalization when it parses
+	// as a request URI, and used as is otherwise.
+	Path string `json:"path"`
+	// Headers are the request headers. Names are matched
+	// case-insensitively.
+	Headers map[string]string `json:"headers"`
+	// Body is the request body as a string.
+	Body string `json:"body"`
+	// RawBody is the request body as base64, used when Body is empty.
+	RawBody []byte `json:"raw_body"`
+}
+
+// header returns the value of the named header.
+func (r *AuthzHTTPRequest) header(name string) string {
+	for k, v := range r.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// AuthzHandler verifies requests on behalf of a gateway, such as an Envoy
+// ext_authz HTTP service.
+//
+// It accepts a POSTed AuthzCheckRequest and responds with the VerifyResult
+// JSON: 200 when the request is allowed, and the status StatusForCode gives
+// for the failure code when it is denied. The check is a dry run unless the
+// URL has consume=true, so a gateway that verifies before forwarding should
+// set it exactly once per request.
+//
+// The checked request is verified as HTTPMiddleware verifies a request, so
+// WithSessionSaltFunc and WithTenantFunc see its headers, and its ASH
+// headers may name the context with a token and must not repeat.
+type AuthzHandler struct {
+	// EncodedSlashes is how an encoded slash in the checked path is treated,
+	// which should match the upstream's router.
+	EncodedSlashes EncodedSlashes
+
+	ash *Ash
+}
+
+// NewAuthzHandler creates a check handler verifying against a.
+func NewAuthzHandler(a *Ash) *AuthzHandler {
+	return &AuthzHandler{ash: a}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *AuthzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		h.ash.writeError(w, http.StatusMethodNotAllowed, NewAshError(ErrMalformedRequest, "method not allowed"))
+		return
+	}
+
+	// Leave room for the JSON envelope and a base64-encoded body.
+	limit := 2*h.ash.maxBodyBytes + 64<<10
+	var check AuthzCheckRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(&check); err != nil {
+		h.ash.writeError(w, http.StatusBadRequest, NewAshError(ErrMalformedRequest, "invalid check request"))
+		return
+	}
+	req := &check.Attributes.Request.HTTP
+	if req.Method == "" || req.Path == "" {
+		h.ash.writeError(w, http.StatusBadRequest, NewAshError(ErrMalformedRequest, "check request needs method and path"))
+		return
+	}
+	body := []byte(req.Body)
+	if len(body) == 0 {
+		body = req.RawBody
+	}
+	if int64(len(body)) > h.ash.maxBodyBytes {
+		h.ash.writeError(w, http.StatusRequestEntityTooLarge, errBodyTooLarge)
+		return
+	}
+
+	var opts []VerifyOption
+	if r.URL.Query().Get("consume") != "true" {
+		opts = append(opts, WithDryRun())
+	}
+	checked := h.checkedRequest(r, req, body)
+	result, _, err := h.ash.verifyRequest(checked, NormalizeBinding(req.Method, h.requestPath(req.Path)), opts...)
+
+	status := http.StatusOK
+	if err != nil {
+		ashErr, _ := asAshError(err)
+		status = StatusForCode(ashErr.Code)
+		redacted := *result
+		redacted.Message = h.ash.responseError(ashErr).Message
+		result = &redacted
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// checkedRequest rebuilds the checked request, so that it is verified as
+// HTTPMiddleware would verify it: with its session salt, tenant, context
+// token and canonical hint, and with its ASH headers checked for
+// duplicates. It carries the context of r, the check request.
+func (h *AuthzHandler) checkedRequest(r *http.Request, req *AuthzHTTPRequest, body []byte) *http.Request {
+	u, err := url.ParseRequestURI(req.Path)
+	if err != nil {
+		u = &url.URL{Path: req.Path}
+	}
+	header := make(http.Header, len(req.Headers))
+	for k, v := range req.Headers {
+		header.Add(k, v)
+	}
+	checked := (&http.Request{
+		Method:     req.Method,
+		URL:        u,
+		RequestURI: req.Path,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Host:       req.header("Host"),
+	}).WithContext(r.Context())
+	if checked.Host == "" {
+		checked.Host = req.header(":authority")
+	}
+	checked.Header.Del("Host")
+	if len(body) == 0 {
+		checked.Body = http.NoBody
+	} else {
+		setBody(checked, body)
+	}
+	return checked
+}
+
+// requestPath returns the path of the checked request to bind to.
+func (h *AuthzHandler) requestPath(path string) string {
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		return path
+	}
+	return RequestPath(u, h.EncodedSlashes)
+}
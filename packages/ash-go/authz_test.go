@@ -0,0 +1,214 @@
+package ash
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestVerifyResultJSON tests the stable JSON encoding of VerifyResult.
+func TestVerifyResultJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   VerifyResult
+		expected string
+	}{
+		{
+			name: "valid",
+			result: VerifyResult{
+				Valid: true, ContextID: "ash_1", Binding: "POST /api/test", Mode: ModeBalanced,
+				Metadata: map[string]interface{}{"user": "u1"}, Duration: 42 * time.Microsecond,
+			},
+			expected: `{"version":1,"valid":true,"contextId":"ash_1","binding":"POST /api/test","mode":"balanced","metadata":{"user":"u1"},"timings":{"totalMicros":42}}`,
+		},
+		{
+			name: "failed dry run",
+			result: VerifyResult{
+				Code: ErrIntegrityFailed, Message: "proof verification failed", ContextID: "ash_1",
+				Binding: "POST /api/test", DryRun: true,
+			},
+			expected: `{"version":1,"valid":false,"code":"ASH_INTEGRITY_FAILED","message":"proof verification failed","contextId":"ash_1","binding":"POST /api/test","dryRun":true,"timings":{"totalMicros":0}}`,
+		},
+		{
+			name: "failed with stage",
+			result: VerifyResult{
+				Code: ErrContextExpired, Message: "context has expired", ContextID: "ash_1",
+				Binding: "POST /api/test", Stage: StageExpiry,
+			},
+			expected: `{"version":1,"valid":false,"code":"ASH_CONTEXT_EXPIRED","message":"context has expired","contextId":"ash_1","binding":"POST /api/test","stage":"expiry","timings":{"totalMicros":0}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(&tt.result)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+			if string(got) != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+// checkRequest renders an ext_authz-style check request.
+func checkRequest(method, path, body string, headers map[string]string) string {
+	h, _ := json.Marshal(headers)
+	b, _ := json.Marshal(body)
+	return fmt.Sprintf(`{"attributes":{"source":{"address":{"socketAddress":{"address":"10.0.0.7","portValue":51234}}},`+
+		`"request":{"time":"2023-11-14T22:13:20Z","http":{"id":"1234567890","method":%q,"path":%q,"host":"api.example.com",`+
+		`"scheme":"https","protocol":"HTTP/1.1","headers":%s,"body":%s}}}}`, method, path, h, b)
+}
+
+// TestAuthzHandler tests gateway checks of recorded requests.
+func TestAuthzHandler(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	handler := NewAuthzHandler(a)
+	body := `{"amount":100}`
+
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/transfer", Metadata: map[string]interface{}{"user": "u1"}})
+	headers := map[string]string{
+		":authority":       "api.example.com",
+		"content-type":     "application/json",
+		"x-ash-context-id": ctx.ID,
+		"x-ash-proof":      clientProof(t, ctx, body, "application/json"),
+		"x-request-id":     "5f0c8e1a",
+	}
+
+	check := func(target, request string) (int, map[string]interface{}) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", target, strings.NewReader(request)))
+		var resp map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Invalid response: %v: %s", err, rec.Body)
+		}
+		return rec.Code, resp
+	}
+
+	// Dry runs leave the context usable.
+	for i := 0; i < 2; i++ {
+		code, resp := check("/authz", checkRequest("POST", "/api/transfer?ref=1", body, headers))
+		if code != http.StatusOK || resp["valid"] != true || resp["dryRun"] != true {
+			t.Fatalf("Dry run %d: expected allow, got %d %v", i, code, resp)
+		}
+	}
+
+	tampered := checkRequest("POST", "/api/transfer", `{"amount":1000000}`, headers)
+	if code, resp := check("/authz?consume=true", tampered); code != http.StatusForbidden || resp["code"] != string(ErrIntegrityFailed) {
+		t.Errorf("Expected 403 %s for tampered body, got %d %v", ErrIntegrityFailed, code, resp)
+	}
+
+	code, resp := check("/authz?consume=true", checkRequest("POST", "/api/transfer", body, headers))
+	if code != http.StatusOK || resp["valid"] != true || resp["dryRun"] != nil {
+		t.Fatalf("Expected allow with consume, got %d %v", code, resp)
+	}
+	if resp["version"] != float64(VerifyResultSchemaVersion) || resp["contextId"] != ctx.ID || resp["mode"] != "balanced" {
+		t.Errorf("Unexpected result fields: %v", resp)
+	}
+	if metadata, _ := resp["metadata"].(map[string]interface{}); metadata["user"] != "u1" {
+		t.Errorf("Expected metadata in result, got %v", resp["metadata"])
+	}
+
+	if code, resp := check("/authz", checkRequest("POST", "/api/transfer", body, headers)); code != http.StatusConflict || resp["code"] != string(ErrReplayDetected) {
+		t.Errorf("Expected 409 %s after consume, got %d %v", ErrReplayDetected, code, resp)
+	}
+}
+
+// TestAuthzHandlerBadRequest tests rejection of malformed check requests.
+func TestAuthzHandlerBadRequest(t *testing.T) {
+	a, _ := newTestAsh(t, time.Now())
+	for _, body := range []string{`not json`, `{"attributes":{}}`} {
+		rec := httptest.NewRecorder()
+		NewAuthzHandler(a).ServeHTTP(rec, httptest.NewRequest("POST", "/authz", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Check request %q: expected 400, got %d", body, rec.Code)
+		}
+	}
+}
+
+// TestAuthzHandlerRequestData tests that checks are verified with the
+// session, tenant and context token of the checked request, as the
+// middleware verifies them.
+func TestAuthzHandlerRequestData(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000),
+		WithContextTokenSecret([]byte("token-secret")),
+		WithTenantFunc(func(r *http.Request) string { return r.Header.Get("X-Tenant") }),
+		WithSessionSaltFunc(func(r *http.Request) []byte {
+			if c, err := r.Cookie("session"); err == nil {
+				return []byte("salt-of-" + c.Value)
+			}
+			return nil
+		}))
+	handler := NewAuthzHandler(a)
+	body := `{"amount":100}`
+
+	// signed issues a context and returns the headers of a request signed
+	// with it.
+	signed := func(opts ContextOptions, signOpts ...SignOption) map[string]string {
+		t.Helper()
+		opts.Binding = "POST /api/transfer"
+		ctx, err := a.IssueContext(opts)
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		req := httptest.NewRequest("POST", "/api/transfer", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if err := SignRequest(req, a.PublicInfo(ctx), []byte(body), signOpts...); err != nil {
+			t.Fatalf("SignRequest failed: %v", err)
+		}
+		headers := make(map[string]string)
+		for k := range req.Header {
+			headers[strings.ToLower(k)] = req.Header.Get(k)
+		}
+		return headers
+	}
+	with := func(headers map[string]string, k, v string) map[string]string {
+		out := map[string]string{k: v}
+		for k, v := range headers {
+			out[k] = v
+		}
+		return out
+	}
+
+	session := signed(ContextOptions{SessionSalt: []byte("salt-of-alice")})
+	tenant := signed(ContextOptions{Tenant: "acme"}, SignTenant("acme"))
+	plain := signed(ContextOptions{})
+	tests := []struct {
+		name    string
+		headers map[string]string
+		code    AshErrorCode
+	}{
+		{"issuing session", with(session, "cookie", "session=alice"), ""},
+		{"other session", with(session, "cookie", "session=bob"), ErrIntegrityFailed},
+		{"no session", session, ErrIntegrityFailed},
+		{"tenant", with(tenant, "x-tenant", "acme"), ""},
+		{"other tenant", with(tenant, "x-tenant", "globex"), ErrTenantMismatch},
+		{"context token", plain, ""},
+		{"duplicate header", with(plain, "X-ASH-Proof", plain["x-ash-proof"]), ErrMalformedRequest},
+	}
+	if plain["x-ash-context-token"] == "" || plain["x-ash-context-id"] != "" {
+		t.Fatalf("Expected a request naming its context by token, got %v", plain)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("POST", "/authz", strings.NewReader(checkRequest("POST", "/api/transfer", body, tt.headers))))
+			var result struct {
+				Valid bool         `json:"valid"`
+				Code  AshErrorCode `json:"code"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+				t.Fatalf("Invalid response: %v: %s", err, rec.Body)
+			}
+			if result.Code != tt.code || result.Valid != (tt.code == "") {
+				t.Errorf("Got %d %s, want %s: %s", rec.Code, result.Code, tt.code, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package ash
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// BindingNonceStore is a ContextStore that keeps a nonce per binding, for
+// WithBindingNonceWindow.
+type BindingNonceStore interface {
+	ContextStore
+	// BindingNonce returns the current nonce of binding. A nonce is
+	// current for window after it was set; once none is, BindingNonce sets
+	// one from generate. Rotation is atomic: callers racing over a
+	// rotation all get the same nonce.
+	BindingNonce(binding string, window time.Duration, generate func() (string, error)) (string, error)
+}
+
+// WithBindingNonceWindow makes contexts whose mode requires a nonce (see
+// ModeRequirements) share the nonce of their binding, rotated every
+// window, instead of each getting its own. The NonceProvider is then only
+// called on rotation. A client issuing many contexts for a binding, such
+// as a single-page app in strict mode, sees the same nonce until it
+// rotates and may cache it.
+//
+// Contexts remain single-use, and each proof still covers the nonce.
+// Every context records the nonce it was issued with, so a context issued
+// before a rotation verifies against its own nonce afterwards. Contexts of
+// every tenant share the nonce of a binding.
+//
+// The store must be a BindingNonceStore, as MemoryStore and RedisStore
+// are; otherwise each context gets its own nonce and Validate reports the
+// option. Stores keep the window in milliseconds, so New fails for a
+// window under 1ms.
+func WithBindingNonceWindow(window time.Duration) Option {
+	return func(a *Ash) { a.nonceWindow = window }
+}
+
+// contextNonce returns the nonce for a context issued with opts: the nonce
+// of its binding under WithBindingNonceWindow, if its mode requires one,
+// and otherwise a nonce from the NonceProvider.
+func (a *Ash) contextNonce(opts ContextOptions) (string, error) {
+	store, ok := storeAs[BindingNonceStore](a.store)
+	if a.nonceWindow <= 0 || !ok {
+		return a.nonceProvider.Nonce(opts)
+	}
+	if req, _ := opts.Mode.Requirements(); !req.NonceRequired {
+		return a.nonceProvider.Nonce(opts)
+	}
+	return store.BindingNonce(opts.Binding, a.nonceWindow, func() (string, error) {
+		return a.nonceProvider.Nonce(opts)
+	})
+}
+
+// bindingNonce is the nonce of a binding in a MemoryStore.
+type bindingNonce struct {
+	nonce   string
+	expires time.Time
+}
+
+// BindingNonce returns the current nonce of binding. See
+// BindingNonceStore.
+func (s *MemoryStore) BindingNonce(binding string, window time.Duration, generate func() (string, error)) (string, error) {
+	s.nonceMu.Lock()
+	defer s.nonceMu.Unlock()
+	now := s.now()
+	if n, ok := s.bindingNonces[binding]; ok && now.Before(n.expires) {
+		return n.nonce, nil
+	}
+	nonce, err := generate()
+	if err != nil || nonce == "" {
+		return "", err
+	}
+	// Nonces of bindings no longer issued for are swept once the map has
+	// doubled in size since the last sweep, as in expiringSet.
+	if len(s.bindingNonces) >= s.nonceSweepAt {
+		s.sweepBindingNoncesLocked(now)
+	}
+	s.bindingNonces[binding] = bindingNonce{nonce: nonce, expires: now.Add(window)}
+	return nonce, nil
+}
+
+// sweepBindingNonces removes the binding nonces that are no longer
+// current.
+func (s *MemoryStore) sweepBindingNonces(now time.Time) {
+	s.nonceMu.Lock()
+	defer s.nonceMu.Unlock()
+	s.sweepBindingNoncesLocked(now)
+}
+
+// sweepBindingNoncesLocked is sweepBindingNonces with nonceMu held.
+func (s *MemoryStore) sweepBindingNoncesLocked(now time.Time) {
+	for binding, n := range s.bindingNonces {
+		if !now.Before(n.expires) {
+			delete(s.bindingNonces, binding)
+		}
+	}
+	s.nonceSweepAt = max(2*len(s.bindingNonces), 64)
+}
+
+// redisBindingNonceScript returns the current nonce of a binding, stored
+// as "<expiresAt>:<nonce>", or sets it to the candidate in ARGV[2] if
+// there is none. Without a candidate it only looks the nonce up, and
+// returns "" if there is none.
+//
+// KEYS: binding nonce.
+// ARGV: now, candidate, expiresAt, window ms.
+const redisBindingNonceScript = `
+local v = redis.call('GET', KEYS[1])
+if v then
+  local sep = string.find(v, ':', 1, true)
+  if tonumber(string.sub(v, 1, sep - 1)) > tonumber(ARGV[1]) then
+    return string.sub(v, sep + 1)
+  end
+end
+if ARGV[2] == '' then
+  return ''
+end
+redis.call('SET', KEYS[1], ARGV[3] .. ':' .. ARGV[2], 'PX', ARGV[4])
+return ARGV[2]
+`
+
+func (s *RedisStore) bindingNonceKey(binding string) string {
+	return s.prefix + "nonce:" + binding
+}
+
+// BindingNonce returns the current nonce of binding. See
+// BindingNonceStore. It looks the nonce up first, so that a nonce is only
+// generated on rotation, then sets it in the same script that checks that
+// no other instance has meanwhile.
+func (s *RedisStore) BindingNonce(binding string, window time.Duration, generate func() (string, error)) (string, error) {
+	now := s.now()
+	key := []string{s.bindingNonceKey(binding)}
+	reply, err := s.client.Eval(context.Background(), redisBindingNonceScript, key, now.UnixMilli(), "", 0, 0)
+	if err != nil {
+		return "", fmt.Errorf("ash: redis binding nonce: %w", err)
+	}
+	if nonce, _ := reply.(string); nonce != "" {
+		return nonce, nil
+	}
+	candidate, err := generate()
+	if err != nil {
+		return "", err
+	}
+	if candidate == "" {
+		return "", nil
+	}
+	reply, err = s.client.Eval(context.Background(), redisBindingNonceScript, key,
+		now.UnixMilli(), candidate, now.Add(window).UnixMilli(), window.Milliseconds())
+	if err != nil {
+		return "", fmt.Errorf("ash: redis binding nonce: %w", err)
+	}
+	nonce, ok := reply.(string)
+	if !ok {
+		return "", fmt.Errorf("ash: redis binding nonce: unexpected reply %T", reply)
+	}
+	return nonce, nil
+}
@@ -0,0 +1,170 @@
+package ash
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestBindingNonceWindow tests contexts sharing the nonce of their binding
+// across a rotation, with each store.
+func TestBindingNonceWindow(t *testing.T) {
+	stores := map[string]func(clock func() time.Time) ContextStore{
+		"memory": func(clock func() time.Time) ContextStore {
+			return NewMemoryStore(MemoryStoreOptions{Now: clock})
+		},
+		"redis": func(clock func() time.Time) ContextStore {
+			return NewRedisStore(RedisStoreOptions{Client: newFakeRedis(), Now: clock})
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			now := time.UnixMilli(1700000000000)
+			clock := func() time.Time { return now }
+			var generated atomic.Int64
+			provider := NonceProviderFunc(func(opts ContextOptions) (string, error) {
+				return fmt.Sprintf("nonce-%d", generated.Add(1)), nil
+			})
+			a, err := New(newStore(clock), WithClock(clock), WithMode(ModeStrict), WithTTL(time.Minute),
+				WithNonceProvider(provider), WithBindingNonceWindow(10*time.Second),
+				WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			issue := func(binding string) *Context {
+				t.Helper()
+				ctx, err := a.IssueContext(ContextOptions{Binding: binding})
+				if err != nil {
+					t.Fatalf("IssueContext failed: %v", err)
+				}
+				return ctx
+			}
+			verify := func(ctx *Context) error {
+				_, err := a.Verify(ctx.ID, clientProof(t, ctx, "", ""), ctx.Binding, nil, "")
+				return err
+			}
+
+			first, second := issue("POST /api/transfer"), issue("POST /api/transfer")
+			other := issue("POST /api/other")
+			if first.Nonce != "nonce-1" || second.Nonce != first.Nonce || first.ID == second.ID {
+				t.Errorf("Contexts of a binding got nonces %q and %q, want nonce-1 for both", first.Nonce, second.Nonce)
+			}
+			if other.Nonce == first.Nonce {
+				t.Errorf("Another binding shares nonce %q", other.Nonce)
+			}
+
+			now = now.Add(10 * time.Second)
+			rotated := issue("POST /api/transfer")
+			if rotated.Nonce == first.Nonce || rotated.Nonce == "" {
+				t.Errorf("Nonce not rotated: %q", rotated.Nonce)
+			}
+			if n := generated.Load(); n != 3 {
+				t.Errorf("Generated %d nonces, want 3", n)
+			}
+
+			// Contexts issued before the rotation verify with the nonce they
+			// recorded, and each stays single-use.
+			for _, ctx := range []*Context{first, rotated, second} {
+				if err := verify(ctx); err != nil {
+					t.Errorf("Verify with nonce %q failed: %v", ctx.Nonce, err)
+				}
+			}
+			if err := verify(first); err == nil {
+				t.Errorf("A context sharing its nonce was verified twice")
+			}
+
+			// Other modes keep a nonce per context.
+			balanced, err := a.IssueContext(ContextOptions{Binding: "POST /api/transfer", Mode: ModeBalanced})
+			if err != nil || balanced.Nonce != "nonce-4" {
+				t.Errorf("Balanced context got nonce %q (%v), want nonce-4", balanced.Nonce, err)
+			}
+		})
+	}
+}
+
+// TestBindingNonceRotationRace tests that callers racing over a rotation
+// all get the same nonce.
+func TestBindingNonceRotationRace(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	clock := func() time.Time { return now }
+	stores := map[string]BindingNonceStore{
+		"memory": NewMemoryStore(MemoryStoreOptions{Now: clock}),
+		"redis":  NewRedisStore(RedisStoreOptions{Client: newFakeRedis(), Now: clock}),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			var generated atomic.Int64
+			generate := func() (string, error) {
+				return fmt.Sprintf("nonce-%d", generated.Add(1)), nil
+			}
+			nonces := make([]string, 16)
+			var wg sync.WaitGroup
+			for i := range nonces {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					nonces[i], _ = store.BindingNonce("POST /api/transfer", time.Second, generate)
+				}(i)
+			}
+			wg.Wait()
+			for _, nonce := range nonces {
+				if nonce == "" || nonce != nonces[0] {
+					t.Fatalf("Racing callers got %q", nonces)
+				}
+			}
+		})
+	}
+}
+
+// TestBindingNonceValidate tests that Validate reports a window the store
+// cannot honour.
+func TestBindingNonceValidate(t *testing.T) {
+	a, err := New(nonReleasingStore{NewMemoryStore(MemoryStoreOptions{})}, WithMode(ModeStrict), WithBindingNonceWindow(time.Second))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	found := false
+	for _, w := range a.Validate() {
+		found = found || w.Check == "binding-nonce"
+	}
+	if !found {
+		t.Errorf("Validate does not report binding-nonce")
+	}
+	first, _ := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+	second, _ := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+	if first.Nonce == "" || first.Nonce == second.Nonce {
+		t.Errorf("Without a BindingNonceStore, contexts got nonces %q and %q", first.Nonce, second.Nonce)
+	}
+}
+
+// TestBindingNonceSubMillisecondWindow tests that New rejects a window
+// the stores cannot keep.
+func TestBindingNonceSubMillisecondWindow(t *testing.T) {
+	if _, err := New(NewMemoryStore(MemoryStoreOptions{}), WithBindingNonceWindow(500*time.Microsecond)); err == nil {
+		t.Error("Expected New to reject a window under 1ms")
+	}
+}
+
+// TestMemoryStoreBindingNonceSweep tests that the nonces of bindings no
+// longer issued for are swept without CleanupBatched.
+func TestMemoryStoreBindingNonceSweep(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	s := NewMemoryStore(MemoryStoreOptions{Now: func() time.Time { return now }})
+	generate := func() (string, error) { return "nonce", nil }
+	for i := 0; i < 1000; i++ {
+		if _, err := s.BindingNonce(fmt.Sprintf("POST /api/%d", i), time.Second, generate); err != nil {
+			t.Fatalf("BindingNonce failed: %v", err)
+		}
+		now = now.Add(time.Second)
+	}
+	s.nonceMu.Lock()
+	n := len(s.bindingNonces)
+	s.nonceMu.Unlock()
+	if n > 64 {
+		t.Errorf("Expected expired binding nonces to be swept, %d held", n)
+	}
+}
@@ -0,0 +1,206 @@
+package ash
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bindingVectors is testdata/bindings/vectors.json.
+type bindingVectors struct {
+	Vectors []struct {
+		Name    string `json:"name"`
+		Method  string `json:"method"`
+		Path    string `json:"path"`
+		PathHex string `json:"pathHex"`
+		Binding string `json:"binding"`
+	} `json:"vectors"`
+	RequestVectors []struct {
+		Name    string `json:"name"`
+		Method  string `json:"method"`
+		Target  string `json:"target"`
+		Decoded string `json:"decoded"`
+		Opaque  string `json:"opaque"`
+	} `json:"requestVectors"`
+}
+
+func readBindingVectors(t *testing.T) *bindingVectors {
+	t.Helper()
+	data, err := os.ReadFile("testdata/bindings/vectors.json")
+	if err != nil {
+		t.Fatalf("Failed to read vectors: %v", err)
+	}
+	var file bindingVectors
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("Failed to decode vectors: %v", err)
+	}
+	if len(file.Vectors) == 0 || len(file.RequestVectors) == 0 {
+		t.Fatal("No vectors")
+	}
+	return &file
+}
+
+// TestBindingVectors tests NormalizeBinding against the vectors, and
+// that normalizing a binding's own path leaves it unchanged.
+func TestBindingVectors(t *testing.T) {
+	for _, v := range readBindingVectors(t).Vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			path := v.Path
+			if v.PathHex != "" {
+				b, err := hex.DecodeString(v.PathHex)
+				if err != nil {
+					t.Fatalf("Invalid pathHex: %v", err)
+				}
+				path = string(b)
+			}
+			if got := NormalizeBinding(v.Method, path); got != v.Binding {
+				t.Errorf("NormalizeBinding(%q, %q) = %q, want %q", v.Method, path, got, v.Binding)
+			}
+			method, rest, _ := strings.Cut(v.Binding, " ")
+			if got := NormalizeBinding(method, rest); got != v.Binding {
+				t.Errorf("NormalizeBinding is not idempotent: %q became %q", v.Binding, got)
+			}
+		})
+	}
+}
+
+// TestRequestPathVectors tests the bindings of request targets with encoded
+// slashes decoded and kept opaque.
+func TestRequestPathVectors(t *testing.T) {
+	for _, v := range readBindingVectors(t).RequestVectors {
+		t.Run(v.Name, func(t *testing.T) {
+			u, err := url.ParseRequestURI(v.Target)
+			if err != nil {
+				t.Fatalf("ParseRequestURI failed: %v", err)
+			}
+			if got := NormalizeBinding(v.Method, RequestPath(u, EncodedSlashesDecode)); got != v.Decoded {
+				t.Errorf("Decoded binding = %q, want %q", got, v.Decoded)
+			}
+			if got := NormalizeBinding(v.Method, RequestPath(u, EncodedSlashesOpaque)); got != v.Opaque {
+				t.Errorf("Opaque binding = %q, want %q", got, v.Opaque)
+			}
+			req := &http.Request{Method: v.Method, URL: u}
+			if got := BindingFromRequest(req); got != v.Decoded {
+				t.Errorf("BindingFromRequest = %q, want %q", got, v.Decoded)
+			}
+			if got := BindingFromRequest(req, BindingEncodedSlashes(EncodedSlashesOpaque)); got != v.Opaque {
+				t.Errorf("Opaque BindingFromRequest = %q, want %q", got, v.Opaque)
+			}
+		})
+	}
+}
+
+// TestBindingFromRequest tests the bindings of requests under combinations
+// of options.
+func TestBindingFromRequest(t *testing.T) {
+	const forwarded = "X-Forwarded-Path"
+	for _, tt := range []struct {
+		name   string
+		target string
+		header string
+		opts   []BindingOption
+		want   string
+	}{
+		{"path", "/api//orders/42/", "", nil, "POST /api/orders/42"},
+		{"query and host", "http://api.example.com/api/orders?x=1", "", nil, "POST /api/orders"},
+		{"encoded query", "/api/a%3Fb?x=1", "", nil, "POST /api/a%3Fb"},
+		{"decoded slash", "/files/a%2Fb", "", nil, "POST /files/a/b"},
+		{"opaque slash", "/files/a%2Fb", "", []BindingOption{BindingEncodedSlashes(EncodedSlashesOpaque)}, "POST /files/a%2Fb"},
+		{"header unset", "/internal/orders", "/api/orders", nil, "POST /internal/orders"},
+		{"header", "/internal/orders", "/api/orders?x=1", []BindingOption{BindingPathHeader(forwarded)}, "POST /api/orders"},
+		{"header absent", "/internal/orders", "", []BindingOption{BindingPathHeader(forwarded)}, "POST /internal/orders"},
+		{"header decoded slash", "/internal", "/files/a%2Fb", []BindingOption{BindingPathHeader(forwarded)}, "POST /files/a/b"},
+		{"header opaque slash", "/internal", "/files/a%2Fb", []BindingOption{BindingPathHeader(forwarded), BindingEncodedSlashes(EncodedSlashesOpaque)}, "POST /files/a%2Fb"},
+		{"header not a path", "/internal", "api/orders", []BindingOption{BindingPathHeader(forwarded)}, "POST /api/orders"},
+		{"no pattern", "/api/orders/42", "/api/items/7", []BindingOption{BindingRoutePattern(), BindingPathHeader(forwarded)}, "POST /api/items/7"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set(forwarded, tt.header)
+			}
+			if got := BindingFromRequest(req, tt.opts...); got != tt.want {
+				t.Errorf("BindingFromRequest = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestNormalizeBindingLongPath tests that very long paths and long runs
+// of slashes are normalized in full.
+func TestNormalizeBindingLongPath(t *testing.T) {
+	segment := strings.Repeat("x", 1000)
+	long := strings.Repeat("/"+segment, 1<<10)
+	if got := NormalizeBinding("GET", long+"/"); got != "GET "+long {
+		t.Errorf("Long path binding has length %d, want %d", len(got), len("GET "+long))
+	}
+
+	if got := NormalizeBinding("GET", strings.Repeat("/", 1<<18)+"a"+strings.Repeat("/", 1<<18)); got != "GET /a" {
+		t.Errorf("Slash run binding = %.40q, want %q", got, "GET /a")
+	}
+}
+
+// TestEncodedSlashes tests that clients and servers agree on the binding of
+// a path with an encoded slash in both modes.
+func TestEncodedSlashes(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	body := `{"a":1}`
+	send := func(t *testing.T, slashes EncodedSlashes, binding string, opts ...SignOption) *httptest.ResponseRecorder {
+		t.Helper()
+		ctx, err := a.IssueContext(ContextOptions{Binding: binding})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		req, _ := http.NewRequest("POST", "http://example.com/files/a%2Fb", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if err := SignRequest(req, ctx.PublicInfo(), nil, opts...); err != nil {
+			t.Fatalf("SignRequest failed: %v", err)
+		}
+		rec := httptest.NewRecorder()
+		a.HTTPMiddleware(MiddlewareOptions{EncodedSlashes: slashes})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("decode", func(t *testing.T) {
+		if rec := send(t, EncodedSlashesDecode, "POST /files/a/b"); rec.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+	})
+	t.Run("opaque", func(t *testing.T) {
+		rec := send(t, EncodedSlashesOpaque, "POST /files/a%2Fb", SignBinding("POST /files/a%2Fb"))
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+	})
+	t.Run("mismatch", func(t *testing.T) {
+		rec := send(t, EncodedSlashesOpaque, "POST /files/a/b")
+		if rec.Code != http.StatusForbidden || decodeError(t, rec).Code != ErrEndpointMismatch {
+			t.Errorf("Expected 403 %s, got %d: %s", ErrEndpointMismatch, rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("authz", func(t *testing.T) {
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /files/a%2Fb"})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		headers := map[string]string{
+			"content-type":     "application/json",
+			"x-ash-context-id": ctx.ID,
+			"x-ash-proof":      clientProof(t, ctx, body, "application/json"),
+		}
+		handler := NewAuthzHandler(a)
+		handler.EncodedSlashes = EncodedSlashesOpaque
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/authz", strings.NewReader(checkRequest("POST", "/files/a%2fb?x=1", body, headers))))
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package ash
+
+import (
+	"bytes"
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultCanonicalCacheMaxBody is the default size of the largest body
+// whose canonical form is cached.
+const DefaultCanonicalCacheMaxBody = 64 << 10
+
+// WithCanonicalCache caches the canonical form of up to entries recently
+// verified bodies, so repeated payloads are not canonicalized again. It is
+// disabled by default. Entries are looked up by a hash of the content type
+// and body and keep the body itself, so a hash collision is detected and
+// canonicalized in full. Bodies that differ in any byte, even only in
+// whitespace, are cached separately.
+func WithCanonicalCache(entries int) Option {
+	return func(a *Ash) {
+		if entries > 0 {
+			a.canonicalCache = newCanonicalCache(entries)
+		}
+	}
+}
+
+// WithCanonicalCacheMaxBody sets the size of the largest body cached by
+// WithCanonicalCache (default: DefaultCanonicalCacheMaxBody). Larger
+// bodies bypass the cache.
+func WithCanonicalCacheMaxBody(n int) Option {
+	return func(a *Ash) { a.canonicalCacheMaxBody = n }
+}
+
+// CanonicalCacheStats reports the use of the canonical cache.
+type CanonicalCacheStats struct {
+	// Hits and Misses count lookups of bodies eligible for the cache.
+	Hits   int64
+	Misses int64
+	// Entries is the number of cached bodies.
+	Entries int
+}
+
+// CanonicalCacheStats returns the canonical cache counters, which are zero
+// when WithCanonicalCache is not enabled.
+func (a *Ash) CanonicalCacheStats() CanonicalCacheStats {
+	c := a.canonicalCache
+	if c == nil {
+		return CanonicalCacheStats{}
+	}
+	c.mu.Lock()
+	entries := c.order.Len()
+	c.mu.Unlock()
+	return CanonicalCacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Entries: entries}
+}
+
+// canonicalCache is an LRU cache of canonicalized payloads.
+type canonicalCache struct {
+	mu      sync.Mutex
+	limit   int
+	order   *list.List // of *canonicalEntry, most recent first
+	entries map[uint64]*list.Element
+	hash    func(form UnicodeForm, contentType string, body []byte) uint64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// canonicalEntry is a cached canonicalization.
+type canonicalEntry struct {
+	key         uint64
+	form        UnicodeForm
+	contentType string
+	body        []byte
+	canonical   string
+}
+
+// newCanonicalCache creates a cache of at most limit entries.
+func newCanonicalCache(limit int) *canonicalCache {
+	return &canonicalCache{
+		limit:   limit,
+		order:   list.New(),
+		entries: make(map[uint64]*list.Element, limit),
+		hash:    hashPayload,
+	}
+}
+
+// hashPayload is the FNV-1a hash of the form, content type and body.
+func hashPayload(form UnicodeForm, contentType string, body []byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(form))
+	h.Write([]byte{0})
+	h.Write([]byte(contentType))
+	h.Write([]byte{0})
+	h.Write(body)
+	return h.Sum64()
+}
+
+// get returns the cached canonical form of body, if any.
+func (c *canonicalCache) get(key uint64, form UnicodeForm, contentType string, body []byte) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := el.Value.(*canonicalEntry)
+	if entry.form != form || entry.contentType != contentType || !bytes.Equal(entry.body, body) {
+		return "", false
+	}
+	c.order.MoveToFront(el)
+	return entry.canonical, true
+}
+
+// put caches the canonical form of body, replacing any entry with the same
+// key and evicting the least recently used entry when full.
+func (c *canonicalCache) put(key uint64, form UnicodeForm, contentType string, body []byte, canonical string) {
+	entry := &canonicalEntry{
+		key:         key,
+		form:        form,
+		contentType: contentType,
+		body:        append([]byte(nil), body...),
+		canonical:   canonical,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	if c.order.Len() > c.limit {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*canonicalEntry).key)
+	}
+}
+
+// canonicalize is CanonicalizePayload with the instance's canonicalizers,
+// as configured by ctx, through the canonical cache, if enabled. Failures
+// are not cached, and payloads with raw strings, optional fields or
+// decimal strings (see WithRawStrings, WithOptionalFields and
+// WithDecimalStrings) bypass the cache.
+func (a *Ash) canonicalize(payload []byte, contentType string, ctx *Context) (string, error) {
+	if len(payload) == 0 {
+		return "", nil
+	}
+	c := a.canonicalCache
+	form := ctx.UnicodeForm.orDefault()
+	opts := append(ctx.canonicalizeOptions(), a.strictOptions()...)
+	if len(ctx.RawStrings) > 0 || len(ctx.OptionalFields) > 0 || len(ctx.DecimalStrings) > 0 {
+		return a.canonicalizers.canonicalize(payload, contentType, opts)
+	}
+	if c == nil || len(payload) == 0 || len(payload) > a.canonicalCacheMaxBody {
+		return a.canonicalizers.canonicalize(payload, contentType, opts)
+	}
+	key := c.hash(form, contentType, payload)
+	if canonical, ok := c.get(key, form, contentType, payload); ok {
+		c.hits.Add(1)
+		return canonical, nil
+	}
+	c.misses.Add(1)
+	canonical, err := a.canonicalizers.canonicalize(payload, contentType, opts)
+	if err != nil {
+		return "", err
+	}
+	c.put(key, form, contentType, payload, canonical)
+	return canonical, nil
+}
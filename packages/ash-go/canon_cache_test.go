@@ -0,0 +1,118 @@
+package ash
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCanonicalCacheCollision tests that bodies with the same hash are
+// each canonicalized correctly.
+func TestCanonicalCacheCollision(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithCanonicalCache(8))
+	a.canonicalCache.hash = func(UnicodeForm, string, []byte) uint64 { return 1 }
+
+	tests := []struct {
+		body, contentType, want string
+	}{
+		{`{"b":2,"a":1}`, "application/json", `{"a":1,"b":2}`},
+		{`{"c":3}`, "application/json", `{"c":3}`},
+		{`b=2&a=1`, "application/x-www-form-urlencoded", `a=1&b=2`},
+		{`{"b":2,"a":1}`, "application/json", `{"a":1,"b":2}`},
+	}
+	for _, tt := range tests {
+		got, err := a.canonicalize([]byte(tt.body), tt.contentType, &Context{})
+		if err != nil || got != tt.want {
+			t.Errorf("canonicalize(%q) = %q, %v; want %q", tt.body, got, err, tt.want)
+		}
+	}
+}
+
+// TestCanonicalCacheEviction tests that the least recently used entry is
+// evicted and that failures are not cached.
+func TestCanonicalCacheEviction(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithCanonicalCache(2))
+	c := a.canonicalCache
+	for _, body := range []string{`{"a":1}`, `{"b":2}`, `{"a":1}`, `{"c":3}`} {
+		if _, err := a.canonicalize([]byte(body), "application/json", &Context{}); err != nil {
+			t.Fatalf("canonicalize(%q) failed: %v", body, err)
+		}
+	}
+	cached := func(body string) bool {
+		_, ok := c.get(c.hash(UnicodeNFC, "application/json", []byte(body)), UnicodeNFC, "application/json", []byte(body))
+		return ok
+	}
+	if !cached(`{"a":1}`) || cached(`{"b":2}`) || !cached(`{"c":3}`) {
+		t.Errorf("Unexpected cache contents after eviction")
+	}
+
+	if _, err := a.canonicalize([]byte(`{"a":`), "application/json", &Context{}); err == nil {
+		t.Fatal("Expected malformed body to fail")
+	}
+	if cached(`{"a":`) {
+		t.Error("Failure was cached")
+	}
+}
+
+// TestCanonicalCacheWhitespace tests that bodies differing only in
+// whitespace are cached separately and each verify, and that hits and
+// misses are counted.
+func TestCanonicalCacheWhitespace(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithCanonicalCache(8))
+	bodies := []string{`{"b":2,"a":1}`, `{ "b": 2, "a": 1 }`, `{"b":2,"a":1}`, "{\n\t\"b\": 2,\n\t\"a\": 1\n}"}
+	for _, body := range bodies {
+		req := signedRequest(t, a, "POST", "/api/heartbeat", body, "application/json")
+		if _, err := a.VerifyRequest(req); err != nil {
+			t.Errorf("VerifyRequest(%q) failed: %v", body, err)
+		}
+	}
+	want := CanonicalCacheStats{Hits: 1, Misses: 3, Entries: 3}
+	if got := a.CanonicalCacheStats(); got != want {
+		t.Errorf("CanonicalCacheStats() = %+v, want %+v", got, want)
+	}
+}
+
+// TestCanonicalCacheMaxBody tests that bodies over the size threshold
+// bypass the cache.
+func TestCanonicalCacheMaxBody(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithCanonicalCache(8), WithCanonicalCacheMaxBody(8))
+	for _, body := range []string{`{"a":1}`, `{"a":1}`, `{"a":123}`, `{"a":123}`} {
+		if _, err := a.canonicalize([]byte(body), "application/json", &Context{}); err != nil {
+			t.Fatalf("canonicalize(%q) failed: %v", body, err)
+		}
+	}
+	want := CanonicalCacheStats{Hits: 1, Misses: 1, Entries: 1}
+	if got := a.CanonicalCacheStats(); got != want {
+		t.Errorf("CanonicalCacheStats() = %+v, want %+v", got, want)
+	}
+}
+
+// BenchmarkCanonicalize compares canonicalizing a payload with a cache hit.
+func BenchmarkCanonicalize(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i := 0; i < 50; i++ {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		fmt.Fprintf(&sb, `"field%02d":{"value":%d.50,"name":"café %d"}`, 49-i, i, i)
+	}
+	sb.WriteString("}")
+	body := []byte(sb.String())
+
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached=%v", cached), func(b *testing.B) {
+			a := &Ash{canonicalizers: defaultCanonicalizers, canonicalCacheMaxBody: DefaultCanonicalCacheMaxBody}
+			if cached {
+				a.canonicalCache = newCanonicalCache(16)
+			}
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				if _, err := a.canonicalize(body, "application/json", &Context{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package ash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+	"net/http"
+)
+
+const (
+	// HeaderCanonicalSHA256 is the header in which a trusted gateway sends
+	// the SHA-256 of the canonical payload it forwards, Base64URL-encoded.
+	// See WithTrustedCanonicalHints.
+	HeaderCanonicalSHA256 = "X-ASH-Canonical-SHA256"
+	// HeaderCanonicalMAC is the header authenticating HeaderCanonicalSHA256.
+	HeaderCanonicalMAC = "X-ASH-Canonical-MAC"
+)
+
+var (
+	headerCanonicalSHA256 = http.CanonicalHeaderKey(HeaderCanonicalSHA256)
+	headerCanonicalMAC    = http.CanonicalHeaderKey(HeaderCanonicalMAC)
+)
+
+// canonicalHintLabel prefixes the canonical hint MAC input, so that a
+// secret shared with other options cannot yield a valid hint.
+const canonicalHintLabel = "ASHv1-canonical\n"
+
+// WithTrustedCanonicalHints makes HTTPMiddleware and VerifyRequest trust a
+// gateway that has already canonicalized the body. DANGEROUS: anyone
+// holding secret can make the instance verify proofs against a payload of
+// their choosing, so it must be shared only with the gateway, and the
+// gateway must canonicalize exactly as the instance would for the context.
+//
+// The proof hashes the preamble and the payload together, so a digest of
+// the payload cannot stand in for it. Instead the gateway forwards the
+// canonical payload as the body, with SetCanonicalHint. A request whose
+// body hashes to its authenticated HeaderCanonicalSHA256 is verified with
+// the body as its canonical payload, without parsing it. A request without
+// a hint, or whose hint fails to authenticate or does not match the body,
+// is verified as if the option were off. Raw-body contexts are unaffected.
+//
+// The secret must be non-empty and should differ from other secrets.
+// Validate reports the option as a warning.
+func WithTrustedCanonicalHints(secret []byte) Option {
+	return func(a *Ash) { a.canonicalHintSecret = append([]byte{}, secret...) }
+}
+
+// SetCanonicalHint replaces the body of r with canonical, the canonical
+// payload of its original body, and sets the headers that vouch for it to
+// an instance configured with WithTrustedCanonicalHints under secret. It
+// must be called after the HeaderProof header is set, since the hint is
+// bound to the proof.
+func SetCanonicalHint(r *http.Request, secret []byte, canonical string) {
+	digest := canonicalDigest([]byte(canonical))
+	setBody(r, []byte(canonical))
+	r.Header.Set(HeaderCanonicalSHA256, digest)
+	r.Header.Set(HeaderCanonicalMAC, canonicalHintMAC(secret, r.Header.Get(headerProof), digest))
+}
+
+// canonicalDigest returns the HeaderCanonicalSHA256 value for body.
+func canonicalDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return Base64URLEncode(sum[:])
+}
+
+// canonicalHintMAC returns the HeaderCanonicalMAC value binding digest to
+// proof.
+func canonicalHintMAC(secret []byte, proof, digest string) string {
+	h := hmac.New(sha256.New, secret)
+	io.WriteString(h, canonicalHintLabel+proof+"\n"+digest)
+	return Base64URLEncode(h.Sum(nil))
+}
+
+// trustedCanonical reports whether r carries a canonical hint that
+// authenticates under WithTrustedCanonicalHints and matches body.
+func (a *Ash) trustedCanonical(r *http.Request, body []byte) bool {
+	if a.canonicalHintSecret == nil {
+		return false
+	}
+	digest, mac := r.Header.Get(headerCanonicalSHA256), r.Header.Get(headerCanonicalMAC)
+	if digest == "" || mac == "" {
+		return false
+	}
+	if !TimingSafeCompare(canonicalHintMAC(a.canonicalHintSecret, r.Header.Get(headerProof), digest), mac) {
+		return false
+	}
+	return TimingSafeCompare(canonicalDigest(body), digest)
+}
+
+// withTrustedCanonical verifies the body as its own canonical form.
+func withTrustedCanonical() VerifyOption {
+	return func(o *verifyOptions) { o.trustedCanonical = true }
+}
+
+// trustedCanonicalPayload is a body a trusted gateway vouched is already
+// in canonical form.
+type trustedCanonicalPayload []byte
+
+// writeCanonical writes the body as is, if its content type is supported.
+func (p trustedCanonicalPayload) writeCanonical(a *Ash, w io.Writer, contentType string, ctx *Context) error {
+	// The gateway vouches for the canonical form, not for the content type.
+	if len(p) > 0 && !ctx.RawBody {
+		if _, _, err := a.canonicalizers.lookup(contentType); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+// canonical returns the body, which is already canonical.
+func (p trustedCanonicalPayload) canonical(*Ash, string, *Context) (string, bool) {
+	return string(p), true
+}
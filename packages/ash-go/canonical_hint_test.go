@@ -0,0 +1,140 @@
+package ash
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// countingJSON is the built-in JSON canonicalizer, counting its calls.
+type countingJSON struct{ calls *int }
+
+func (countingJSON) ContentTypes() []string { return []string{"application/json"} }
+
+func (c countingJSON) Canonicalize(body []byte, _ map[string]string) (string, error) {
+	*c.calls++
+	return ParseJSON(string(body))
+}
+
+// TestTrustedCanonicalHints tests requests forwarded by a gateway that
+// vouches for their canonical payload.
+func TestTrustedCanonicalHints(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	secret := []byte("gateway-secret")
+	body, canonical := `{"b":2,"a":1}`, `{"a":1,"b":2}`
+
+	setup := func(opts ...Option) (*Ash, *int) {
+		t.Helper()
+		calls := new(int)
+		a, _ := newTestAsh(t, now, append([]Option{WithCanonicalizer(countingJSON{calls})}, opts...)...)
+		return a, calls
+	}
+	serve := func(a *Ash, req *http.Request) (*httptest.ResponseRecorder, string) {
+		t.Helper()
+		var seen []byte
+		handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen, _ = io.ReadAll(r.Body)
+		}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec, string(seen)
+	}
+
+	t.Run("authenticated", func(t *testing.T) {
+		a, calls := setup(WithTrustedCanonicalHints(secret))
+		req := signedRequest(t, a, "POST", "/api/transfer", body, "application/json")
+		SetCanonicalHint(req, secret, canonical)
+		rec, seen := serve(a, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+		if *calls != 0 {
+			t.Errorf("Canonicalizer called %d times, want 0", *calls)
+		}
+		if seen != canonical {
+			t.Errorf("Handler saw %q, want %q", seen, canonical)
+		}
+	})
+
+	t.Run("forged", func(t *testing.T) {
+		a, calls := setup(WithTrustedCanonicalHints(secret))
+		req := signedRequest(t, a, "POST", "/api/transfer", body, "application/json")
+		SetCanonicalHint(req, []byte("other-secret"), canonical)
+		if rec, _ := serve(a, req); rec.Code != http.StatusOK {
+			t.Fatalf("Expected the hint to be ignored, got %d: %s", rec.Code, rec.Body)
+		}
+		if *calls != 1 {
+			t.Errorf("Canonicalizer called %d times, want 1", *calls)
+		}
+
+		// Trusting a forged hint would verify a proof over a payload that is
+		// not canonical.
+		notCanonical := `{"a": 1}`
+		ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+		req = httptest.NewRequest("POST", "/api/transfer", nil)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(HeaderContextID, ctx.ID)
+		req.Header.Set(HeaderProof, BuildProof(BuildProofInput{
+			Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, Nonce: ctx.Nonce, CanonicalPayload: notCanonical,
+		}))
+		SetCanonicalHint(req, []byte("other-secret"), notCanonical)
+		if rec, _ := serve(a, req); rec.Code != http.StatusForbidden || decodeError(t, rec).Code != ErrIntegrityFailed {
+			t.Errorf("Expected 403 %s, got %d: %s", ErrIntegrityFailed, rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("other request", func(t *testing.T) {
+		a, calls := setup(WithTrustedCanonicalHints(secret))
+		hinted := signedRequest(t, a, "POST", "/api/transfer", body, "application/json")
+		SetCanonicalHint(hinted, secret, canonical)
+		req := signedRequest(t, a, "POST", "/api/transfer", canonical, "application/json")
+		for _, key := range []string{HeaderCanonicalSHA256, HeaderCanonicalMAC} {
+			req.Header.Set(key, hinted.Header.Get(key))
+		}
+		if rec, _ := serve(a, req); rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+		if *calls != 1 {
+			t.Errorf("A hint bound to another proof was trusted")
+		}
+	})
+
+	t.Run("altered body", func(t *testing.T) {
+		a, calls := setup(WithTrustedCanonicalHints(secret))
+		req := signedRequest(t, a, "POST", "/api/transfer", body, "application/json")
+		SetCanonicalHint(req, secret, canonical)
+		setBody(req, []byte(`{"a":1,"b":3}`))
+		if rec, _ := serve(a, req); rec.Code != http.StatusForbidden || decodeError(t, rec).Code != ErrIntegrityFailed {
+			t.Errorf("Expected 403 %s, got %d: %s", ErrIntegrityFailed, rec.Code, rec.Body)
+		}
+		if *calls != 1 {
+			t.Errorf("A hint not matching the body was trusted")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		a, calls := setup()
+		req := signedRequest(t, a, "POST", "/api/transfer", body, "application/json")
+		SetCanonicalHint(req, secret, canonical)
+		if rec, _ := serve(a, req); rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+		if *calls != 1 {
+			t.Errorf("Hint trusted without WithTrustedCanonicalHints")
+		}
+	})
+
+	if _, err := New(NewMemoryStore(MemoryStoreOptions{}), WithTrustedCanonicalHints([]byte{})); err != ErrInvalidKey {
+		t.Errorf("Expected ErrInvalidKey for an empty secret, got %v", err)
+	}
+	a, _ := setup(WithTrustedCanonicalHints(secret))
+	found := false
+	for _, w := range a.Validate() {
+		found = found || w.Check == "canonical-hints"
+	}
+	if !found {
+		t.Errorf("Validate does not report WithTrustedCanonicalHints")
+	}
+}
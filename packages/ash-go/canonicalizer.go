@@ -0,0 +1,180 @@
+package ash
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strings"
+)
+
+// Canonicalizer canonicalizes request bodies of the media types it
+// reports, such as "application/cbor". Register one with WithCanonicalizer
+// to verify a body format ASH does not support.
+//
+// Canonicalize receives a non-empty body and the parameters of its
+// Content-Type, such as charset. It must return the same canonical form for
+// every encoding of the same value, or proofs fail to verify. Returning an
+// AshError controls the error the request is rejected with; other errors
+// are reported as ErrCanonicalizationFailed with ReasonCustom.
+type Canonicalizer interface {
+	ContentTypes() []string
+	Canonicalize(body []byte, params map[string]string) (string, error)
+}
+
+// WithCanonicalizer registers c for its content types. It replaces the
+// built-in canonicalizer of a media type it reports, and an earlier
+// canonicalizer for the same media type. Context
+// options such as the Unicode form, raw strings and optional fields only
+// apply to the built-in canonicalizers.
+func WithCanonicalizer(c Canonicalizer) Option {
+	return func(a *Ash) { a.customCanonicalizers = append(a.customCanonicalizers, c) }
+}
+
+// optionCanonicalizer is implemented by the built-in canonicalizers, which
+// take CanonicalizeOptions.
+type optionCanonicalizer interface {
+	canonicalizeWith(body []byte, params map[string]string, opts []CanonicalizeOption) (string, error)
+}
+
+// streamCanonicalizer is implemented by canonicalizers that read the body
+// as a stream in VerifyStream rather than in full.
+type streamCanonicalizer interface {
+	canonicalizeStream(r io.Reader, w io.Writer, opts []CanonicalizeOption) error
+}
+
+type jsonCanonicalizer struct{}
+
+func (jsonCanonicalizer) ContentTypes() []string { return []string{string(ContentTypeJSON)} }
+
+func (c jsonCanonicalizer) Canonicalize(body []byte, params map[string]string) (string, error) {
+	return c.canonicalizeWith(body, params, nil)
+}
+
+func (jsonCanonicalizer) canonicalizeWith(body []byte, _ map[string]string, opts []CanonicalizeOption) (string, error) {
+	return ParseJSON(string(body), opts...)
+}
+
+func (jsonCanonicalizer) canonicalizeStream(r io.Reader, w io.Writer, opts []CanonicalizeOption) error {
+	return CanonicalizeJSONStream(r, w, opts...)
+}
+
+type urlEncodedCanonicalizer struct{}
+
+func (urlEncodedCanonicalizer) ContentTypes() []string {
+	return []string{string(ContentTypeURLEncoded)}
+}
+
+func (c urlEncodedCanonicalizer) Canonicalize(body []byte, params map[string]string) (string, error) {
+	return c.canonicalizeWith(body, params, nil)
+}
+
+func (urlEncodedCanonicalizer) canonicalizeWith(body []byte, _ map[string]string, opts []CanonicalizeOption) (string, error) {
+	return CanonicalizeURLEncoded(string(body), opts...)
+}
+
+type multipartFormCanonicalizer struct{}
+
+func (multipartFormCanonicalizer) ContentTypes() []string {
+	return []string{string(ContentTypeMultipartForm)}
+}
+
+func (c multipartFormCanonicalizer) Canonicalize(body []byte, params map[string]string) (string, error) {
+	return c.canonicalizeWith(body, params, nil)
+}
+
+func (multipartFormCanonicalizer) canonicalizeWith(body []byte, params map[string]string, opts []CanonicalizeOption) (string, error) {
+	return CanonicalizeMultipartForm(body, params["boundary"], opts...)
+}
+
+// canonicalizerRegistry maps media types to their canonicalizer.
+type canonicalizerRegistry map[string]Canonicalizer
+
+// defaultCanonicalizers holds the built-in canonicalizers. It is used by
+// CanonicalizePayload and by instances without WithCanonicalizer.
+var defaultCanonicalizers = canonicalizerRegistry{
+	string(ContentTypeJSON):          jsonCanonicalizer{},
+	string(ContentTypeURLEncoded):    urlEncodedCanonicalizer{},
+	string(ContentTypeMultipartForm): multipartFormCanonicalizer{},
+}
+
+// withCustom returns a copy of r with cs registered in order, or an error
+// if one of them is nil or reports an invalid media type.
+func (r canonicalizerRegistry) withCustom(cs []Canonicalizer) (canonicalizerRegistry, error) {
+	out := make(canonicalizerRegistry, len(r)+len(cs))
+	for mediaType, c := range r {
+		out[mediaType] = c
+	}
+	for _, c := range cs {
+		if c == nil {
+			return nil, errors.New("ash: nil canonicalizer")
+		}
+		for _, contentType := range c.ContentTypes() {
+			mediaType, params, err := mime.ParseMediaType(contentType)
+			if err != nil || len(params) > 0 {
+				return nil, fmt.Errorf("ash: invalid canonicalizer content type %q", contentType)
+			}
+			out[mediaType] = c
+		}
+	}
+	return out, nil
+}
+
+// lookup returns the canonicalizer for contentType and its parameters, or
+// an ErrUnsupportedContentType AshError listing the supported media types
+// if there is none, including when contentType is missing or malformed.
+func (r canonicalizerRegistry) lookup(contentType string) (Canonicalizer, map[string]string, error) {
+	if strings.TrimSpace(contentType) == "" {
+		return nil, nil, r.unsupported("missing content type")
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, nil, r.unsupported(errInvalidContentType.Message)
+	}
+	c, ok := r[mediaType]
+	if !ok {
+		return nil, nil, r.unsupported("unsupported content type: " + mediaType)
+	}
+	return c, params, nil
+}
+
+// unsupported returns an ErrUnsupportedContentType AshError with message,
+// listing the media types of r.
+func (r canonicalizerRegistry) unsupported(message string) *AshError {
+	supported := make([]string, 0, len(r))
+	for mediaType := range r {
+		supported = append(supported, mediaType)
+	}
+	sort.Strings(supported)
+	return &AshError{Code: ErrUnsupportedContentType, Message: message, Supported: supported}
+}
+
+// canonicalize canonicalizes a request body according to its content
+// type, as CanonicalizePayload does.
+func (r canonicalizerRegistry) canonicalize(body []byte, contentType string, opts []CanonicalizeOption) (string, error) {
+	if len(body) == 0 {
+		return "", nil
+	}
+	c, params, err := r.lookup(contentType)
+	if err != nil {
+		return "", err
+	}
+	return canonicalizeWith(c, body, params, opts)
+}
+
+// canonicalizeWith canonicalizes a non-empty body with c, passing opts to
+// the built-in canonicalizers.
+func canonicalizeWith(c Canonicalizer, body []byte, params map[string]string, opts []CanonicalizeOption) (string, error) {
+	if oc, ok := c.(optionCanonicalizer); ok {
+		return oc.canonicalizeWith(body, params, opts)
+	}
+	canonical, err := c.Canonicalize(body, params)
+	if err != nil {
+		if _, ok := asAshError(err); ok {
+			return "", err
+		}
+		return "", canonicalizationError(ReasonCustom, "", err.Error())
+	}
+	return canonical, nil
+}
@@ -0,0 +1,249 @@
+package ash
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// linesCanonicalizer canonicalizes a newline-separated list by sorting
+// its lines, prefixed with the charset parameter.
+type linesCanonicalizer struct{}
+
+func (linesCanonicalizer) ContentTypes() []string {
+	return []string{"text/x-lines", "Application/X-Lines"}
+}
+
+func (linesCanonicalizer) Canonicalize(body []byte, params map[string]string) (string, error) {
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	for _, line := range lines {
+		if line == "" {
+			return "", errors.New("empty line")
+		}
+		if line == "!" {
+			return "", NewAshError(ErrMalformedRequest, "bang")
+		}
+	}
+	sort.Strings(lines)
+	return params["charset"] + ":" + strings.Join(lines, ","), nil
+}
+
+// linesProof builds the proof a client using linesCanonicalizer would send.
+func linesProof(t *testing.T, ctx *Context, body, contentType string) string {
+	t.Helper()
+	canonical, err := linesCanonicalizer{}.Canonicalize([]byte(body), map[string]string{"charset": "utf-8"})
+	if err != nil {
+		t.Fatalf("Canonicalize failed: %v", err)
+	}
+	return BuildProof(BuildProofInput{
+		Mode:             ctx.Mode,
+		Binding:          ctx.Binding,
+		ContextID:        ctx.ID,
+		Nonce:            ctx.Nonce,
+		CanonicalPayload: canonical,
+	})
+}
+
+// TestWithCanonicalizer tests verification with a registered canonicalizer
+// alongside the built-in ones.
+func TestWithCanonicalizer(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, _ := newTestAsh(t, now, WithCanonicalizer(linesCanonicalizer{}))
+	const contentType = "text/x-lines; charset=utf-8"
+
+	issue := func() *Context {
+		t.Helper()
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/lines"})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		return ctx
+	}
+
+	ctx := issue()
+	proof := linesProof(t, ctx, "b\na\n", contentType)
+	if _, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte("a\nb"), contentType); err != nil {
+		t.Errorf("Verify failed: %v", err)
+	}
+
+	ctx = issue()
+	proof = linesProof(t, ctx, "b\na", contentType)
+	if _, err := a.VerifyStream(ctx.ID, proof, ctx.Binding, strings.NewReader("a\nb"), "application/x-lines; charset=utf-8"); err != nil {
+		t.Errorf("VerifyStream failed: %v", err)
+	}
+
+	ctx = issue()
+	json := `{"b":2,"a":1}`
+	if _, err := a.Verify(ctx.ID, clientProof(t, ctx, json, "application/json"), ctx.Binding, []byte(json), "application/json"); err != nil {
+		t.Errorf("Verify of JSON failed: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		code        AshErrorCode
+		reason      CanonicalizationReason
+	}{
+		{name: "unknown content type", body: "a", contentType: "text/plain", code: ErrUnsupportedContentType},
+		{name: "plain error", body: "a\n\nb", contentType: contentType, code: ErrCanonicalizationFailed, reason: ReasonCustom},
+		{name: "AshError", body: "!", contentType: contentType, code: ErrMalformedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := issue()
+			result, err := a.Verify(ctx.ID, linesProof(t, ctx, "a", contentType), ctx.Binding, []byte(tt.body), tt.contentType)
+			if !errors.Is(err, tt.code) {
+				t.Fatalf("Expected %s, got %v", tt.code, err)
+			}
+			if result.Reason != tt.reason {
+				t.Errorf("Reason = %q, want %q", result.Reason, tt.reason)
+			}
+		})
+	}
+
+	// The package functions only know the built-in canonicalizers.
+	if _, err := CanonicalizePayload([]byte("a"), contentType); !errors.Is(err, ErrUnsupportedContentType) {
+		t.Errorf("Expected %s from CanonicalizePayload, got %v", ErrUnsupportedContentType, err)
+	}
+}
+
+// upperJSON replaces the built-in JSON canonicalizer.
+type upperJSON struct{}
+
+func (upperJSON) ContentTypes() []string { return []string{"application/json"} }
+
+func (upperJSON) Canonicalize(body []byte, _ map[string]string) (string, error) {
+	return strings.ToUpper(string(body)), nil
+}
+
+// TestWithCanonicalizerReplacesBuiltin tests that a registered
+// canonicalizer takes over the built-in one's media type.
+func TestWithCanonicalizerReplacesBuiltin(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, _ := newTestAsh(t, now, WithCanonicalizer(upperJSON{}))
+	ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/update"})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	proof := BuildProof(BuildProofInput{
+		Mode:             ctx.Mode,
+		Binding:          ctx.Binding,
+		ContextID:        ctx.ID,
+		Nonce:            ctx.Nonce,
+		CanonicalPayload: `{"B": 2}`,
+	})
+	if _, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte(`{"b": 2}`), "application/json"); err != nil {
+		t.Errorf("Verify failed: %v", err)
+	}
+}
+
+// badCanonicalizer reports an invalid content type.
+type badCanonicalizer struct{}
+
+func (badCanonicalizer) ContentTypes() []string { return []string{"text/plain; charset=utf-8"} }
+
+func (badCanonicalizer) Canonicalize([]byte, map[string]string) (string, error) { return "", nil }
+
+// TestWithCanonicalizerInvalid tests that New rejects canonicalizers it
+// cannot register.
+func TestWithCanonicalizerInvalid(t *testing.T) {
+	store := NewMemoryStore(MemoryStoreOptions{})
+	for _, c := range []Canonicalizer{nil, badCanonicalizer{}} {
+		if _, err := New(store, WithCanonicalizer(c)); err == nil {
+			t.Errorf("New accepted canonicalizer %#v", c)
+		}
+	}
+}
+
+// TestUnsupportedContentType tests that a body whose Content-Type cannot
+// be canonicalized fails with ErrUnsupportedContentType listing the
+// supported media types, whatever the path through verification.
+func TestUnsupportedContentType(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	secret := []byte("gateway-secret")
+	builtin := []string{"application/json", "application/x-www-form-urlencoded", "multipart/form-data"}
+	withLines := []string{"application/json", "application/x-lines", "application/x-www-form-urlencoded", "multipart/form-data", "text/x-lines"}
+	body := `{"a":1}`
+
+	tests := []struct {
+		name        string
+		opts        []Option
+		contentType string
+		body        string
+		hint        bool
+		message     string
+		supported   []string
+	}{
+		{"text/json", nil, "text/json", body, false, "unsupported content type: text/json", builtin},
+		{"missing", nil, "", body, false, "missing content type", builtin},
+		{"malformed", nil, "application/json; charset", body, false, "invalid content type", builtin},
+		{"custom registered", []Option{WithCanonicalizer(linesCanonicalizer{})}, "text/json", body, false, "unsupported content type: text/json", withLines},
+		{"trusted hint", []Option{WithTrustedCanonicalHints(secret)}, "text/json", body, true, "unsupported content type: text/json", builtin},
+		{"cached", []Option{WithCanonicalCache(16)}, "text/json", body, false, "unsupported content type: text/json", builtin},
+		{"missing, no body", nil, "", "", false, "", nil},
+		{"custom type", []Option{WithCanonicalizer(linesCanonicalizer{})}, "text/x-lines; charset=utf-8", "a", false, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestAsh(t, now, tt.opts...)
+			handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+			if err != nil {
+				t.Fatalf("IssueContext failed: %v", err)
+			}
+			req := httptest.NewRequest("POST", "/api/transfer", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			// The client canonicalized the body as JSON, whatever it declared.
+			var proof string
+			if strings.HasPrefix(tt.contentType, "text/x-lines") {
+				proof = linesProof(t, ctx, tt.body, tt.contentType)
+			} else {
+				proof = clientProof(t, ctx, tt.body, "application/json")
+			}
+			req.Header.Set(HeaderContextID, ctx.ID)
+			req.Header.Set(HeaderProof, proof)
+			if tt.hint {
+				SetCanonicalHint(req, secret, tt.body)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if tt.supported == nil {
+				if rec.Code != http.StatusOK {
+					t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+				}
+				return
+			}
+			if rec.Code != http.StatusUnsupportedMediaType {
+				t.Fatalf("Expected 415, got %d: %s", rec.Code, rec.Body)
+			}
+			got := decodeError(t, rec)
+			if got.Code != ErrUnsupportedContentType || got.Message != tt.message {
+				t.Errorf("Error = %v, want %s: %s", got, ErrUnsupportedContentType, tt.message)
+			}
+			if !reflect.DeepEqual(got.Supported, tt.supported) {
+				t.Errorf("Supported = %q, want %q", got.Supported, tt.supported)
+			}
+		})
+	}
+
+	// VerifyStream and CanonicalizePayload report the same list.
+	a, _ := newTestAsh(t, now)
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+	_, err := a.VerifyStream(ctx.ID, clientProof(t, ctx, body, "application/json"), ctx.Binding, strings.NewReader(body), "text/json")
+	if e, ok := asAshError(err); !ok || e.Code != ErrUnsupportedContentType || !reflect.DeepEqual(e.Supported, builtin) {
+		t.Errorf("VerifyStream = %#v, want %s listing %q", err, ErrUnsupportedContentType, builtin)
+	}
+	_, err = CanonicalizePayload([]byte(body), "")
+	if e, ok := asAshError(err); !ok || e.Message != "missing content type" || !reflect.DeepEqual(e.Supported, builtin) {
+		t.Errorf("CanonicalizePayload = %#v, want %s listing %q", err, ErrUnsupportedContentType, builtin)
+	}
+}
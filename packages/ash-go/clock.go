@@ -0,0 +1,94 @@
+package ash
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultClockSkew is the default clock skew tolerated between instances.
+const DefaultClockSkew = 5 * time.Second
+
+// WithClockSkew sets how far the clocks of the instances sharing a store
+// may disagree (default: DefaultClockSkew). Verification rejects a context
+// issued more than skew in the future with ErrInvalidContext, since its
+// issuer's clock is ahead or this instance's clock has stepped back, and
+// steps of the clock larger than skew are logged as warnings.
+func WithClockSkew(skew time.Duration) Option {
+	return func(a *Ash) { a.clockSkew = skew }
+}
+
+// errContextFromFuture is the response to a context issued in the future.
+var errContextFromFuture = NewAshError(ErrInvalidContext, "context issued in the future")
+
+// expired reports whether the context has expired at now. A context
+// created by a store reading time.Now expires by the monotonic clock when
+// now also carries a monotonic reading, so that a step of the wall clock
+// between issuance and verification in the same process neither shortens
+// nor extends its lifetime. Otherwise it expires at ExpiresAt.
+func (c *Context) expired(now time.Time) bool {
+	if c.deadline.IsZero() {
+		return now.UnixMilli() >= c.ExpiresAt
+	}
+	return !now.Before(c.deadline)
+}
+
+// contextDeadline returns the deadline of a context issued at now and
+// expiring at expiresAt (ms epoch). It is expiresAt, carrying the
+// monotonic reading of now if it has one.
+func contextDeadline(now time.Time, expiresAt int64) time.Time {
+	return now.Add(time.UnixMilli(expiresAt).Sub(now.Round(0)))
+}
+
+// clockWatch detects steps of the clock between successive readings.
+type clockWatch struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+// observe records the reading now and returns how far the clock stepped
+// since the previous reading. With monotonic readings, the step is the
+// difference between the wall and monotonic time elapsed, either way;
+// without, only a backward step can be told apart from time passing.
+func (w *clockWatch) observe(now time.Time) time.Duration {
+	w.mu.Lock()
+	last := w.last
+	w.last = now
+	w.mu.Unlock()
+	if last.IsZero() {
+		return 0
+	}
+	wall := now.Round(0).Sub(last.Round(0))
+	step := wall - now.Sub(last)
+	if step == 0 && wall < 0 {
+		step = wall
+	}
+	return step
+}
+
+// checkClock reads the clock and logs a warning if it stepped by more than
+// the clock skew since the last check.
+func (a *Ash) checkClock() time.Time {
+	now := a.now()
+	if step := a.clock.observe(now); step > a.clockSkew || step < -a.clockSkew {
+		a.logger.Warn("ash: clock stepped", "step", step, "now", now.UnixMilli())
+	}
+	return now
+}
+
+// checkIssuedAt fails a context issued more than the clock skew after now.
+// Like expired, it reads the monotonic clock for a context with a
+// deadline when now has a monotonic reading, so that a backward step of
+// the wall clock does not fail the contexts issued before it.
+func (a *Ash) checkIssuedAt(ctx *Context, now time.Time) *AshError {
+	ahead := time.Duration(ctx.IssuedAt-now.UnixMilli()) * time.Millisecond
+	if !ctx.deadline.IsZero() {
+		issued := ctx.deadline.Add(-time.Duration(ctx.ExpiresAt-ctx.IssuedAt) * time.Millisecond)
+		ahead = issued.Sub(now)
+	}
+	if ahead > a.clockSkew {
+		a.logger.Warn("ash: context issued in the future; check clock synchronization",
+			"contextId", ctx.ID, "issuedAt", ctx.IssuedAt, "now", now.UnixMilli(), "ahead", ahead)
+		return errContextFromFuture
+	}
+	return nil
+}
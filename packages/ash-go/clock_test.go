@@ -0,0 +1,188 @@
+package ash
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestClockSteps tests verification while the clock steps backward and
+// forward.
+func TestClockSteps(t *testing.T) {
+	start := time.UnixMilli(1700000000000)
+	setup := func(opts ...Option) (*Ash, *time.Time, *bytes.Buffer) {
+		t.Helper()
+		now := start
+		clock := func() time.Time { return now }
+		var logs bytes.Buffer
+		store := NewMemoryStore(MemoryStoreOptions{Now: clock})
+		a, err := New(store, append([]Option{WithClock(clock), WithLogger(slog.New(slog.NewTextHandler(&logs, nil)))}, opts...)...)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		return a, &now, &logs
+	}
+	issue := func(a *Ash) *Context {
+		t.Helper()
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		return ctx
+	}
+	verify := func(a *Ash, ctx *Context) (*VerifyResult, error) {
+		return a.Verify(ctx.ID, clientProof(t, ctx, "", ""), ctx.Binding, nil, "")
+	}
+
+	t.Run("backward", func(t *testing.T) {
+		a, now, logs := setup()
+		first, second := issue(a), issue(a)
+		if _, err := verify(a, first); err != nil {
+			t.Fatalf("Verify failed: %v", err)
+		}
+		*now = now.Add(-40 * time.Second)
+		result, err := verify(a, second)
+		if !errors.Is(err, ErrInvalidContext) || result.Stage != StageExpiry {
+			t.Fatalf("Expected %s at %s, got %v at %s", ErrInvalidContext, StageExpiry, err, result.Stage)
+		}
+		if err.Error() != errContextFromFuture.Error() {
+			t.Errorf("Error = %v, want %v", err, errContextFromFuture)
+		}
+		for _, want := range []string{"ash: clock stepped", "step=-40s", "ash: context issued in the future"} {
+			if !strings.Contains(logs.String(), want) {
+				t.Errorf("Logs lack %q:\n%s", want, logs)
+			}
+		}
+	})
+
+	t.Run("within skew", func(t *testing.T) {
+		a, now, logs := setup()
+		first, second := issue(a), issue(a)
+		if _, err := verify(a, first); err != nil {
+			t.Fatalf("Verify failed: %v", err)
+		}
+		*now = now.Add(-3 * time.Second)
+		if _, err := verify(a, second); err != nil {
+			t.Errorf("Expected a step within the skew to pass, got %v", err)
+		}
+		if logs.Len() != 0 {
+			t.Errorf("Unexpected logs:\n%s", logs)
+		}
+	})
+
+	t.Run("configured skew", func(t *testing.T) {
+		a, now, _ := setup(WithClockSkew(time.Minute))
+		ctx := issue(a)
+		*now = now.Add(-40 * time.Second)
+		if _, err := verify(a, ctx); err != nil {
+			t.Errorf("Expected a step within WithClockSkew to pass, got %v", err)
+		}
+	})
+
+	t.Run("forward", func(t *testing.T) {
+		a, now, logs := setup()
+		ctx := issue(a)
+		if _, err := verify(a, issue(a)); err != nil {
+			t.Fatalf("Verify failed: %v", err)
+		}
+		// Without monotonic readings, a step forward cannot be told apart
+		// from time passing: the context expires by the wall clock.
+		*now = now.Add(40 * time.Second)
+		result, err := verify(a, ctx)
+		if !errors.Is(err, ErrContextExpired) || result.Stage != StageExpiry {
+			t.Errorf("Expected %s at %s, got %v", ErrContextExpired, StageExpiry, err)
+		}
+		if logs.Len() != 0 {
+			t.Errorf("Unexpected logs:\n%s", logs)
+		}
+	})
+}
+
+// TestClockStepMonotonic tests that a backward step of the wall clock does
+// not fail MemoryStore contexts issued before it, which are checked on the
+// monotonic clock.
+func TestClockStepMonotonic(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	// A context issued just now, when the wall clock read 40s later than
+	// it does after stepping back.
+	issued := time.Now()
+	step := 40 * time.Second
+	ctx := &Context{
+		ID:        "ash_stepped",
+		IssuedAt:  issued.Add(step).UnixMilli(),
+		ExpiresAt: issued.Add(step + time.Minute).UnixMilli(),
+	}
+	// MemoryStore sets the deadline from the monotonic reading of issued.
+	ctx.deadline = issued.Add(time.Minute)
+
+	now := time.Now()
+	if err := a.checkIssuedAt(ctx, now); err != nil {
+		t.Errorf("checkIssuedAt after a backward step = %v, want nil", err)
+	}
+	if ctx.expired(now) {
+		t.Error("Context expired after a backward step")
+	}
+	// A context without a deadline, as other stores return, is checked on
+	// the wall clock.
+	ctx.deadline = time.Time{}
+	if err := a.checkIssuedAt(ctx, now); err != errContextFromFuture {
+		t.Errorf("checkIssuedAt without a deadline = %v, want %v", err, errContextFromFuture)
+	}
+}
+
+// TestClockWatch tests clock step detection.
+func TestClockWatch(t *testing.T) {
+	var w clockWatch
+	now := time.UnixMilli(1700000000000)
+	for _, tc := range []struct {
+		advance time.Duration
+		want    time.Duration
+	}{
+		{0, 0},
+		{10 * time.Second, 0},
+		{-40 * time.Second, -40 * time.Second},
+		{time.Hour, 0},
+	} {
+		now = now.Add(tc.advance)
+		if got := w.observe(now); got != tc.want {
+			t.Errorf("observe after %v = %v, want %v", tc.advance, got, tc.want)
+		}
+	}
+
+	// Monotonic readings advancing with the wall clock are not steps.
+	w = clockWatch{}
+	base := time.Now()
+	w.observe(base)
+	if got := w.observe(base.Add(time.Minute)); got != 0 {
+		t.Errorf("observe of a monotonic reading = %v, want 0", got)
+	}
+}
+
+// TestContextDeadline tests that MemoryStore contexts carry a deadline on
+// the monotonic clock that agrees with ExpiresAt.
+func TestContextDeadline(t *testing.T) {
+	store := NewMemoryStore(MemoryStoreOptions{})
+	created, err := store.Create(ContextOptions{Binding: "POST /api/test", TTL: time.Minute})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	ctx, _ := store.Get(created.ID)
+	if !ctx.deadline.Equal(time.UnixMilli(ctx.ExpiresAt)) {
+		t.Errorf("deadline = %v, want %v", ctx.deadline, time.UnixMilli(ctx.ExpiresAt))
+	}
+	if ctx.deadline == ctx.deadline.Round(0) {
+		t.Errorf("deadline %v lacks a monotonic reading", ctx.deadline)
+	}
+	// Against a monotonic reading the monotonic clock decides, and against
+	// a wall reading ExpiresAt does.
+	if now := time.Now(); ctx.expired(now) || !ctx.expired(now.Add(time.Minute+time.Millisecond)) {
+		t.Errorf("Monotonic expiry disagrees with the TTL")
+	}
+	issued := time.UnixMilli(ctx.IssuedAt)
+	if ctx.expired(issued.Add(time.Minute-time.Millisecond)) || !ctx.expired(issued.Add(time.Minute)) {
+		t.Errorf("Wall clock expiry disagrees with ExpiresAt")
+	}
+}
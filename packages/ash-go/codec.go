@@ -0,0 +1,89 @@
+package ash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ContextCodec encodes the contexts RedisStore stores, for deployments that
+// prefer a more compact encoding than JSON. See RedisStoreOptions.Codec.
+//
+// Marshal must encode every field of the context but Used and ConsumedAt,
+// which RedisStore keeps beside the encoded context.
+type ContextCodec interface {
+	// Name identifies the codec in stored contexts. It must not be empty,
+	// start with '{' or contain ':'.
+	Name() string
+	Marshal(ctx *Context) ([]byte, error)
+	Unmarshal(data []byte, ctx *Context) error
+}
+
+// JSONCodec is the default ContextCodec. Its contexts are stored as plain
+// JSON objects, as before codecs could be configured, so that they stay
+// readable by every instance and by the other ASH SDKs.
+var JSONCodec ContextCodec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(ctx *Context) ([]byte, error) { return json.Marshal(ctx) }
+
+func (jsonCodec) Unmarshal(data []byte, ctx *Context) error { return json.Unmarshal(data, ctx) }
+
+// contextCodecs encodes contexts with one codec and decodes them with
+// whichever known codec encoded them.
+//
+// JSONCodec writes a bare JSON object. Any other codec writes its name and
+// a ':' before the encoded context, so a stored context that starts with
+// '{' is always JSON.
+type contextCodecs struct {
+	encode ContextCodec
+	decode map[string]ContextCodec
+}
+
+// newContextCodecs returns the codecs encoding with encode (JSONCodec if
+// nil) and decoding JSON, encode and decode. It panics on an invalid codec
+// name.
+func newContextCodecs(encode ContextCodec, decode []ContextCodec) *contextCodecs {
+	if encode == nil {
+		encode = JSONCodec
+	}
+	c := &contextCodecs{encode: encode, decode: map[string]ContextCodec{}}
+	for _, codec := range append([]ContextCodec{JSONCodec, encode}, decode...) {
+		name := codec.Name()
+		if name == "" || name[0] == '{' || strings.Contains(name, ":") {
+			panic(fmt.Sprintf("ash: invalid context codec name %q", name))
+		}
+		c.decode[name] = codec
+	}
+	return c
+}
+
+func (c *contextCodecs) marshal(ctx *Context) (string, error) {
+	data, err := c.encode.Marshal(ctx)
+	if err != nil {
+		return "", err
+	}
+	if c.encode == JSONCodec {
+		return string(data), nil
+	}
+	return c.encode.Name() + ":" + string(data), nil
+}
+
+func (c *contextCodecs) unmarshal(data string, ctx *Context) error {
+	codec := JSONCodec
+	if !strings.HasPrefix(data, "{") {
+		name, rest, ok := strings.Cut(data, ":")
+		if !ok {
+			return errors.New("stored context has no codec name")
+		}
+		if codec = c.decode[name]; codec == nil {
+			return fmt.Errorf("unknown context codec %q", name)
+		}
+		data = rest
+	}
+	return codec.Unmarshal([]byte(data), ctx)
+}
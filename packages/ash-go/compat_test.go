@@ -0,0 +1,76 @@
+package ash
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// compatFixture is a request recorded from an earlier release together with
+// the proof it was accepted with. The v1 fixtures were recorded with the
+// canonicalization and proof of the first Go release; see
+// testdata/compat/record.go for adding fixtures at a release.
+type compatFixture struct {
+	Name        string            `json:"name"`
+	Binding     string            `json:"binding"`
+	ContentType string            `json:"contentType"`
+	Body        string            `json:"body"`
+	ContextID   string            `json:"contextId"`
+	Mode        AshMode           `json:"mode"`
+	Nonce       string            `json:"nonce"`
+	Extensions  map[string]string `json:"extensions"`
+	Proof       string            `json:"proof"`
+}
+
+// compatBreaks names the v1 fixtures that intentionally stopped verifying,
+// with the change that broke them.
+var compatBreaks = map[string]string{
+	// Strings are escaped as JSON.stringify does, so "<", ">", "&" and
+	// U+2028 are no longer written as \u escapes.
+	"json-escaping": "synth-416",
+}
+
+// TestCompatV1Fixtures tests that every recorded v1 proof still verifies
+// through the full pipeline, except for the intentional breaks, which must
+// still fail. A failure here means a change would break existing clients.
+func TestCompatV1Fixtures(t *testing.T) {
+	paths, err := filepath.Glob("testdata/compat/v1/*.json")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("No fixtures found: %v", err)
+	}
+	now := time.UnixMilli(1700000000000)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", path, err)
+		}
+		var f compatFixture
+		if err := json.Unmarshal(data, &f); err != nil {
+			t.Fatalf("Failed to parse %s: %v", path, err)
+		}
+		t.Run(f.Name, func(t *testing.T) {
+			a, store := newTestAsh(t, now)
+			if _, err := store.Create(ContextOptions{
+				ID: f.ContextID, Binding: f.Binding, TTL: time.Minute, Mode: f.Mode, Nonce: f.Nonce,
+			}); err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			var exts []KV
+			for k, v := range f.Extensions {
+				exts = append(exts, KV{Key: k, Value: v})
+			}
+			result, err := a.Verify(f.ContextID, f.Proof, f.Binding, []byte(f.Body), f.ContentType, WithExtensions(exts...))
+			if change, ok := compatBreaks[f.Name]; ok {
+				if err == nil && result.Valid {
+					t.Errorf("Proof broken by %s verifies again; remove it from compatBreaks", change)
+				}
+				return
+			}
+			if err != nil || !result.Valid {
+				t.Errorf("Recorded proof no longer verifies: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package ash
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrInvalidConfig is returned by New under WithStrictConfig when Validate
+// reports errors.
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// ConfigSeverity grades a ConfigWarning.
+type ConfigSeverity int
+
+const (
+	// ConfigWarn is a setting that is likely unintended but lets requests
+	// verify.
+	ConfigWarn ConfigSeverity = iota
+	// ConfigError is a setting under which some or all requests can never
+	// verify, or contexts can never be issued.
+	ConfigError
+)
+
+// String returns "warning" or "error".
+func (s ConfigSeverity) String() string {
+	if s == ConfigError {
+		return "error"
+	}
+	return "warning"
+}
+
+// ConfigWarning is a misconfiguration reported by Validate.
+type ConfigWarning struct {
+	Severity ConfigSeverity
+	// Check identifies the check that failed, such as "policy-binding".
+	// It is stable for use in tests and alerts.
+	Check string
+	// Binding is the binding the warning is about, if any.
+	Binding string
+	Message string
+}
+
+// String formats the warning as "error: policy-binding: message".
+func (w ConfigWarning) String() string {
+	return w.Severity.String() + ": " + w.Check + ": " + w.Message
+}
+
+// WithStrictConfig makes New fail with ErrInvalidConfig when Validate
+// reports an error, and log its warnings. Middleware is created after New,
+// so call Validate again once it is in place.
+func WithStrictConfig(on bool) Option {
+	return func(a *Ash) { a.strictConfig = on }
+}
+
+// consumedRetainer is implemented by stores that keep consumed contexts for
+// a while (see MemoryStoreOptions.ConsumedRetention).
+type consumedRetainer interface {
+	consumedRetention() time.Duration
+}
+
+// Validate cross-checks the configuration: binding policies against the
+// protected paths of the instance's HTTPMiddleware, the default mode's
+// requirements against the TTL and tenant setup, and options against the
+// store's capabilities. It reports misconfigurations that would otherwise
+// surface as rejected requests at runtime, errors first, and returns nil if
+// it finds none.
+func (a *Ash) Validate() []ConfigWarning {
+	var warnings []ConfigWarning
+	add := func(severity ConfigSeverity, check, binding, format string, args ...interface{}) {
+		warnings = append(warnings, ConfigWarning{Severity: severity, Check: check, Binding: binding, Message: fmt.Sprintf(format, args...)})
+	}
+
+	bindings := make([]string, 0, len(a.policies))
+	for binding := range a.policies {
+		bindings = append(bindings, binding)
+	}
+	sort.Strings(bindings)
+	a.mu.Lock()
+	protections := append([]*protection(nil), a.protections...)
+	a.mu.Unlock()
+	for _, binding := range bindings {
+		policy := a.policies[binding]
+		method, path, ok := strings.Cut(binding, " ")
+		if !ok || NormalizeBinding(method, path) != binding {
+			add(ConfigError, "policy-binding", binding,
+				"policy binding %q is not normalized and never applies; use %q", binding, NormalizeBinding(method, path))
+			continue
+		}
+		for _, key := range policy.RequiredExtensions {
+			if validateExtensions([]KV{{Key: key}}) != nil {
+				add(ConfigError, "policy-extension", binding,
+					"required extension key %q is invalid, so no request to %s can verify", key, binding)
+			}
+		}
+		if _, err := compilePointerPatterns(policy.DecimalStrings); err != nil {
+			add(ConfigError, "policy-decimal-strings", binding,
+				"decimal strings of %s are invalid, so no context can be issued for it: %v", binding, err)
+		}
+		if len(protections) > 0 && !anyProtects(protections, method, path) {
+			add(ConfigWarn, "policy-unprotected", binding,
+				"%s has a policy but no HTTPMiddleware verifies it", binding)
+		}
+	}
+
+	if req, ok := a.mode.Requirements(); ok {
+		if req.TenantRequired && a.tenantFunc == nil {
+			add(ConfigError, "mode-tenant", "",
+				"mode %s requires a tenant but WithTenantFunc is not set, so ContextHandler cannot issue contexts", a.mode)
+		}
+		if err := req.checkTTL(a.mode, a.ttl); err != nil {
+			add(ConfigError, "mode-ttl", "",
+				"the default TTL %v does not meet mode %s: %v", a.ttl, a.mode, err.(*AshError).Message)
+		}
+	}
+
+	if a.duplicates != nil {
+		retention := time.Duration(0)
+		if r, ok := storeAs[consumedRetainer](a.store); ok {
+			retention = r.consumedRetention()
+		}
+		if retention < a.duplicates.window {
+			add(ConfigWarn, "duplicate-retention", "",
+				"the duplicate window %v exceeds the store's consumed retention %v, so later resubmissions fail as unknown contexts", a.duplicates.window, retention)
+		}
+	}
+	if a.auditRequired && a.auditSink == nil {
+		add(ConfigWarn, "audit-required", "", "WithAuditRequired has no effect without WithAuditSink")
+	}
+	if a.debugResponses {
+		add(ConfigWarn, "debug-responses", "", "WithDebugResponses exposes payload details and must stay off in production")
+	}
+	if _, ok := storeAs[BindingNonceStore](a.store); a.nonceWindow > 0 && !ok {
+		add(ConfigWarn, "binding-nonce", "", "WithBindingNonceWindow has no effect: the store is not a BindingNonceStore, so each context gets its own nonce")
+	}
+	if a.canonicalHintSecret != nil {
+		add(ConfigWarn, "canonical-hints", "", "WithTrustedCanonicalHints lets whoever holds its secret choose the payload proofs are checked against")
+	}
+
+	sort.SliceStable(warnings, func(i, j int) bool { return warnings[i].Severity > warnings[j].Severity })
+	return warnings
+}
+
+// anyProtects reports whether one of the middleware protections verifies
+// requests with the given method and path.
+func anyProtects(protections []*protection, method, path string) bool {
+	for _, p := range protections {
+		if p.isProtected(method, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateStrict implements WithStrictConfig.
+func (a *Ash) validateStrict() error {
+	var errs []string
+	for _, w := range a.Validate() {
+		if w.Severity == ConfigError {
+			errs = append(errs, w.Check+": "+w.Message)
+		} else {
+			a.logger.Warn("ash: configuration warning", "check", w.Check, "binding", w.Binding, "message", w.Message)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidConfig, strings.Join(errs, "; "))
+	}
+	return nil
+}
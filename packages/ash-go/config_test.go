@@ -0,0 +1,135 @@
+package ash
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// checks returns the checks of warnings, in order.
+func checks(warnings []ConfigWarning) []string {
+	var names []string
+	for _, w := range warnings {
+		names = append(names, w.Severity.String()+" "+w.Check)
+	}
+	return names
+}
+
+// TestValidate tests each misconfiguration Validate detects.
+func TestValidate(t *testing.T) {
+	withTestModes(t)
+	now := time.UnixMilli(1700000000000)
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		setup  func(a *Ash)
+		want   []string
+		detail string
+	}{
+		{name: "clean", opts: []Option{WithBindingPolicy("POST /api/orders", BindingPolicy{RequiredExtensions: []string{"device"}})}},
+		{
+			name: "unnormalized policy binding",
+			opts: []Option{WithBindingPolicy("post /api/orders/", BindingPolicy{})},
+			want: []string{"error policy-binding"},
+		},
+		{
+			name: "invalid required extension",
+			opts: []Option{WithBindingPolicy("POST /api/orders", BindingPolicy{RequiredExtensions: []string{"device", "a=b"}})},
+			want: []string{"error policy-extension"},
+		},
+		{
+			name: "invalid decimal strings",
+			opts: []Option{WithBindingPolicy("POST /api/orders", BindingPolicy{DecimalStrings: []string{"/amount", "price"}})},
+			want: []string{"error policy-decimal-strings"},
+		},
+		{
+			name:  "policy outside protected paths",
+			opts:  []Option{WithBindingPolicy("POST /api/orders", BindingPolicy{RequiredExtensions: []string{"device"}})},
+			setup: func(a *Ash) { a.HTTPMiddleware(MiddlewareOptions{Protected: []string{"/v1/**"}}) },
+			want:  []string{"warning policy-unprotected"},
+		},
+		{
+			name:  "policy exempted",
+			opts:  []Option{WithBindingPolicy("POST /api/orders", BindingPolicy{})},
+			setup: func(a *Ash) { a.HTTPMiddleware(MiddlewareOptions{Exempt: []string{"/api/orders"}}) },
+			want:  []string{"warning policy-unprotected"},
+		},
+		{
+			name: "policy covered by one of several middlewares",
+			opts: []Option{WithBindingPolicy("POST /api/orders", BindingPolicy{})},
+			setup: func(a *Ash) {
+				a.HTTPMiddleware(MiddlewareOptions{Protected: []string{"/v1/**"}})
+				a.HTTPMiddleware(MiddlewareOptions{Protected: []string{"POST /api/*"}})
+			},
+		},
+		{
+			name: "tenant mode without tenant func",
+			opts: []Option{WithMode("test-tenant")},
+			want: []string{"error mode-tenant"},
+		},
+		{
+			name: "tenant mode with tenant func",
+			opts: []Option{WithMode("test-tenant"), WithTenantFunc(func(r *http.Request) string { return r.Host })},
+		},
+		{
+			name: "TTL outside mode range",
+			opts: []Option{WithMode("test-ttl"), WithTTL(30 * time.Second)},
+			want: []string{"error mode-ttl"},
+		},
+		{
+			name: "duplicate window beyond retention",
+			opts: []Option{WithDuplicateWindow(time.Minute)},
+			want: []string{"warning duplicate-retention"},
+		},
+		{
+			name: "required audit without sink, debug responses, and an error",
+			opts: []Option{WithAuditRequired(true), WithDebugResponses(true), WithBindingPolicy("POST api", BindingPolicy{})},
+			want: []string{"error policy-binding", "warning audit-required", "warning debug-responses"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestAsh(t, now, tt.opts...)
+			if tt.setup != nil {
+				tt.setup(a)
+			}
+			warnings := a.Validate()
+			if got := checks(warnings); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %v, want %v", warnings, tt.want)
+			}
+		})
+	}
+
+	// The duplicate window is covered by a store that retains consumed
+	// contexts long enough.
+	store := NewMemoryStore(MemoryStoreOptions{ConsumedRetention: time.Minute})
+	a, err := New(store, WithDuplicateWindow(time.Minute))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if warnings := a.Validate(); warnings != nil {
+		t.Errorf("Validate() = %v, want none", warnings)
+	}
+}
+
+// TestWithStrictConfig tests that New fails on configuration errors, but
+// not on warnings, under WithStrictConfig.
+func TestWithStrictConfig(t *testing.T) {
+	store := NewMemoryStore(MemoryStoreOptions{})
+	_, err := New(store, WithStrictConfig(true), WithBindingPolicy("post /api/orders", BindingPolicy{}))
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig, got %v", err)
+	}
+	if _, err := New(store, WithBindingPolicy("post /api/orders", BindingPolicy{})); err != nil {
+		t.Errorf("New without strict config failed: %v", err)
+	}
+	discard := WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if _, err := New(store, WithStrictConfig(true), WithDebugResponses(true), discard); err != nil {
+		t.Errorf("New with only warnings failed: %v", err)
+	}
+}
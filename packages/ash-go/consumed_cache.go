@@ -0,0 +1,54 @@
+package ash
+
+import "time"
+
+// WithConsumedCache remembers the IDs of the contexts this instance
+// consumed for ttl, and treats them as consumed even if the store reports
+// them unused. It guards against a replay right after a store failover,
+// such as to a Redis replica that had not yet received the consumption:
+// the replica would let the context be consumed a second time.
+//
+// It is best-effort. It only covers replays sent to the instance that
+// consumed the context, within ttl, and the memory it takes grows with
+// ttl and the rate of consumption. A ttl a little over the store's
+// replication lag and failover time is enough.
+func WithConsumedCache(ttl time.Duration) Option {
+	return func(a *Ash) {
+		if ttl > 0 {
+			a.consumedIDs = &consumedCache{ttl: ttl}
+		}
+	}
+}
+
+// consumedCache remembers the IDs of recently consumed contexts.
+type consumedCache struct {
+	ttl time.Duration
+	ids expiringSet
+}
+
+// add remembers that the context id was consumed at now.
+func (c *consumedCache) add(id string, now time.Time) {
+	c.ids.add(id, now, now.Add(c.ttl))
+}
+
+// seen reports whether the context id was consumed within the TTL.
+func (c *consumedCache) seen(id string, now time.Time) bool {
+	return c.ids.has(id, now)
+}
+
+// locallyConsumed reports whether ctx, which the store reports unused, was
+// consumed by this instance, logging the stale read.
+func (a *Ash) locallyConsumed(ctx *Context) bool {
+	if a.consumedIDs == nil || ctx.Used || !a.consumedIDs.seen(ctx.ID, a.now()) {
+		return false
+	}
+	a.logger.Warn("ash: store reported a consumed context as unused", "contextId", ctx.ID)
+	return true
+}
+
+// rememberConsumed records that the context id was consumed.
+func (a *Ash) rememberConsumed(id string) {
+	if a.consumedIDs != nil {
+		a.consumedIDs.add(id, a.now())
+	}
+}
@@ -0,0 +1,84 @@
+package ash
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// staleStore simulates a store that failed over to a replica which never
+// saw any consumption: contexts always read as unused and can be consumed
+// again.
+type staleStore struct{ ContextStore }
+
+func (s staleStore) Get(id string) (*Context, error) {
+	ctx, err := s.ContextStore.Get(id)
+	if err == nil {
+		ctx.Used, ctx.ConsumedAt = false, 0
+	}
+	return ctx, err
+}
+
+func (s staleStore) Consume(id string) error {
+	_, err := s.Get(id)
+	return err
+}
+
+// TestConsumedCache tests that the consumed-ID cache rejects a replay that
+// a stale store read would let through.
+func TestConsumedCache(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	clock := func() time.Time { return now }
+	newAsh := func(opts ...Option) *Ash {
+		t.Helper()
+		store := staleStore{NewMemoryStore(MemoryStoreOptions{Now: clock})}
+		a, err := New(store, append([]Option{WithClock(clock), WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))}, opts...)...)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		return a
+	}
+	consume := func(a *Ash) (*Context, string) {
+		t.Helper()
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		proof := clientProof(t, ctx, "", "")
+		if _, err := a.Verify(ctx.ID, proof, ctx.Binding, nil, ""); err != nil {
+			t.Fatalf("Verify failed: %v", err)
+		}
+		return ctx, proof
+	}
+
+	// Without the cache, the stale store accepts the replay.
+	a := newAsh()
+	ctx, proof := consume(a)
+	if _, err := a.Verify(ctx.ID, proof, ctx.Binding, nil, ""); err != nil {
+		t.Fatalf("Expected the stale store to accept the replay, got %v", err)
+	}
+
+	a = newAsh(WithConsumedCache(5 * time.Second))
+	ctx, proof = consume(a)
+	result, err := a.Verify(ctx.ID, proof, ctx.Binding, nil, "")
+	if !errors.Is(err, ErrReplayDetected) || result.Stage != StageContextLookup {
+		t.Errorf("Expected %s at context lookup, got %v", ErrReplayDetected, err)
+	}
+
+	// A resubmission within the duplicate window is still a duplicate.
+	a = newAsh(WithConsumedCache(5*time.Second), WithDuplicateWindow(5*time.Second))
+	ctx, proof = consume(a)
+	if result, err := a.Verify(ctx.ID, proof, ctx.Binding, nil, ""); err != nil || !result.Duplicate {
+		t.Errorf("Expected a duplicate, got %+v, %v", result, err)
+	}
+
+	// The cache is best-effort: past its TTL, the stale read wins.
+	a = newAsh(WithConsumedCache(5 * time.Second))
+	ctx, proof = consume(a)
+	now = now.Add(5 * time.Second)
+	if _, err := a.Verify(ctx.ID, proof, ctx.Binding, nil, ""); err != nil {
+		t.Errorf("Expected the replay past the TTL to pass, got %v", err)
+	}
+}
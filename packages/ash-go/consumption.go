@@ -0,0 +1,89 @@
+package ash
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"time"
+)
+
+// consumptionTokenLabel prefixes the context ID in the consumption token
+// MAC, so that a secret shared with a KeyRing cannot yield a token that is
+// also a proof, or the reverse.
+const consumptionTokenLabel = "ASHv1-consumed\n"
+
+// ErrInvalidConsumptionToken is returned by ValidateConsumptionToken when
+// the token was not issued for the context ID under the secret.
+var ErrInvalidConsumptionToken = errors.New("ash: invalid consumption token")
+
+// WithConsumptionSecret sets the secret consumption tokens are issued
+// under. With it, every verification that consumes a context sets
+// VerifyResult.ConsumptionToken. The secret must be non-empty, and only
+// the systems that check tokens with ValidateConsumptionToken need it.
+func WithConsumptionSecret(secret []byte) Option {
+	return func(a *Ash) { a.consumptionSecret = append([]byte{}, secret...) }
+}
+
+// ConsumptionToken returns the consumption token of a context ID:
+//
+//	Base64URL(HMAC-SHA256(secret, "ASHv1-consumed\n" + contextID))
+//
+// A handler can pass it with the context ID to downstream systems, as
+// proof that ASH verification consumed the context, and the context ID
+// doubles as an idempotency key there. The token does not expire; systems
+// that care should bound how long they accept it themselves.
+func ConsumptionToken(secret []byte, contextID string) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(consumptionTokenLabel + contextID))
+	return Base64URLEncode(h.Sum(nil))
+}
+
+// ValidateConsumptionToken checks a token from ConsumptionToken in
+// constant time and fails with ErrInvalidConsumptionToken if it was not
+// issued for contextID under secret.
+func ValidateConsumptionToken(secret []byte, contextID, token string) error {
+	if len(secret) == 0 || !TimingSafeCompare(ConsumptionToken(secret, contextID), token) {
+		return ErrInvalidConsumptionToken
+	}
+	return nil
+}
+
+// Consumption identifies the verification that consumed a context.
+type Consumption struct {
+	// ContextID is the ID of the consumed context.
+	ContextID string
+	// ConsumedAt is when the context was consumed.
+	ConsumedAt time.Time
+	// Token is the consumption token, or empty without
+	// WithConsumptionSecret.
+	Token string
+}
+
+// ConsumptionFromContext returns the consumption recorded by
+// HTTPMiddleware for the request. It reports false unless verification
+// succeeded and consumed the context: not for dry runs, multi-use modes or
+// MiddlewareOptions.DeferConsume, whose context is consumed after the
+// handler. An accepted duplicate (see WithDuplicateWindow) reports the
+// original consumption, when the store records its time.
+//
+// Unlike request headers, the values cannot be set by the client.
+func ConsumptionFromContext(ctx context.Context) (Consumption, bool) {
+	result, ok := ResultFromContext(ctx)
+	if !ok || !result.Valid || result.ConsumedAt.IsZero() {
+		return Consumption{}, false
+	}
+	return Consumption{
+		ContextID:  result.ContextID,
+		ConsumedAt: result.ConsumedAt,
+		Token:      result.ConsumptionToken,
+	}, true
+}
+
+// consumed records on result that its context was consumed at at.
+func (a *Ash) consumed(result *VerifyResult, at time.Time) {
+	result.ConsumedAt = at
+	if a.consumptionSecret != nil {
+		result.ConsumptionToken = ConsumptionToken(a.consumptionSecret, result.ContextID)
+	}
+}
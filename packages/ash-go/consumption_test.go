@@ -0,0 +1,91 @@
+package ash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestConsumptionToken tests token generation and validation.
+func TestConsumptionToken(t *testing.T) {
+	secret := []byte("consumption-secret")
+	token := ConsumptionToken(secret, "ash_ctx1")
+	if token != ConsumptionToken(secret, "ash_ctx1") {
+		t.Error("ConsumptionToken is not deterministic")
+	}
+	if err := ValidateConsumptionToken(secret, "ash_ctx1", token); err != nil {
+		t.Errorf("ValidateConsumptionToken failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		secret    []byte
+		contextID string
+		token     string
+	}{
+		{"other context", secret, "ash_ctx2", token},
+		{"other secret", []byte("other-secret"), "ash_ctx1", token},
+		{"empty secret", nil, "ash_ctx1", ConsumptionToken(nil, "ash_ctx1")},
+		{"forged", secret, "ash_ctx1", ConsumptionToken([]byte("guess"), "ash_ctx1")},
+		{"truncated", secret, "ash_ctx1", token[:len(token)-1]},
+		{"empty", secret, "ash_ctx1", ""},
+		{"unlabelled MAC", secret, "ash_ctx1", hmacBase64URL(secret, "ash_ctx1")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateConsumptionToken(tt.secret, tt.contextID, tt.token); err != ErrInvalidConsumptionToken {
+				t.Errorf("ValidateConsumptionToken = %v, want ErrInvalidConsumptionToken", err)
+			}
+		})
+	}
+
+	if _, err := New(NewMemoryStore(MemoryStoreOptions{}), WithConsumptionSecret(nil)); err != ErrInvalidKey {
+		t.Errorf("New with empty secret = %v, want ErrInvalidKey", err)
+	}
+}
+
+// hmacBase64URL returns the Base64URL HMAC-SHA256 of message, to check
+// that tokens are not a bare MAC of the context ID.
+func hmacBase64URL(secret []byte, message string) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(message))
+	return Base64URLEncode(h.Sum(nil))
+}
+
+// TestConsumptionFromContext tests the consumption handed to handlers.
+func TestConsumptionFromContext(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	secret := []byte("consumption-secret")
+	a, _ := newTestAsh(t, now, WithConsumptionSecret(secret))
+
+	var got Consumption
+	var ok bool
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok = ConsumptionFromContext(r.Context())
+	}))
+	req := signedRequest(t, a, "POST", "/api/transfer", `{"amount":100}`, "application/json")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !ok {
+		t.Fatal("ConsumptionFromContext reported no consumption")
+	}
+	if got.ContextID != req.Header.Get(HeaderContextID) || !got.ConsumedAt.Equal(now) {
+		t.Errorf("Consumption = %+v", got)
+	}
+	if err := ValidateConsumptionToken(secret, got.ContextID, got.Token); err != nil {
+		t.Errorf("Token does not validate: %v", err)
+	}
+
+	// A dry run consumes nothing.
+	req = signedRequest(t, a, "POST", "/api/transfer", `{"amount":100}`, "application/json")
+	result, err := a.Verify(req.Header.Get(HeaderContextID), req.Header.Get(HeaderProof), "POST /api/transfer",
+		[]byte(`{"amount":100}`), "application/json", WithDryRun())
+	if err != nil || !result.Valid || !result.ConsumedAt.IsZero() || result.ConsumptionToken != "" {
+		t.Errorf("Dry run result = %+v, %v", result, err)
+	}
+
+	if _, ok := ConsumptionFromContext(req.Context()); ok {
+		t.Error("ConsumptionFromContext reported a consumption for an unverified request")
+	}
+}
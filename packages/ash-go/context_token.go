@@ -0,0 +1,132 @@
+package ash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// contextTokenLabel prefixes the claims in the context token MAC, so that
+// a secret shared with a KeyRing or WithConsumptionSecret cannot yield a
+// token that is also a proof or a consumption token.
+const contextTokenLabel = "ASHv1-context\n"
+
+var (
+	// ErrInvalidContextToken is returned by ParseContextToken for a
+	// malformed token or one not issued under the secret.
+	ErrInvalidContextToken = errors.New("ash: invalid context token")
+	// ErrContextTokenExpired is returned by ParseContextToken for a token
+	// whose context has expired.
+	ErrContextTokenExpired = errors.New("ash: context token expired")
+)
+
+// ContextTokenClaims are the context fields a context token carries.
+type ContextTokenClaims struct {
+	// ContextID is the context ID.
+	ContextID string `json:"id"`
+	// Binding is the binding the context was issued for.
+	Binding string `json:"binding"`
+	// Mode is the security mode.
+	Mode AshMode `json:"mode"`
+	// ExpiresAt is the expiration timestamp (ms epoch).
+	ExpiresAt int64 `json:"exp"`
+}
+
+// WithContextTokenSecret sets the secret context tokens are signed with.
+// With it, issued contexts carry a token in ContextPublicInfo.Token, which
+// clients may send in the HeaderContextToken header instead of the context
+// ID. The secret must be non-empty and should differ from other secrets.
+func WithContextTokenSecret(secret []byte) Option {
+	return func(a *Ash) { a.contextTokenSecret = append([]byte{}, secret...) }
+}
+
+// ContextToken returns the context token of ctx:
+//
+//	claims = Base64URL(JSON(ContextTokenClaims))
+//	token  = claims + "." + Base64URL(HMAC-SHA256(secret, "ASHv1-context\n" + claims))
+//
+// The claims are signed, not encrypted: the client can read them.
+func ContextToken(secret []byte, ctx *Context) string {
+	data, _ := json.Marshal(ContextTokenClaims{
+		ContextID: ctx.ID,
+		Binding:   ctx.Binding,
+		Mode:      ctx.Mode,
+		ExpiresAt: ctx.ExpiresAt,
+	})
+	claims := Base64URLEncode(data)
+	return claims + "." + contextTokenMAC(secret, claims)
+}
+
+func contextTokenMAC(secret []byte, claims string) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(contextTokenLabel + claims))
+	return Base64URLEncode(h.Sum(nil))
+}
+
+// ParseContextToken checks a token from ContextToken and returns its
+// claims. It fails with ErrInvalidContextToken if the token was not issued
+// under secret, comparing the MAC in constant time, and with
+// ErrContextTokenExpired if its context has expired at now.
+func ParseContextToken(secret []byte, token string, now time.Time) (ContextTokenClaims, error) {
+	claims, mac, ok := strings.Cut(token, ".")
+	if !ok || len(secret) == 0 || !TimingSafeCompare(contextTokenMAC(secret, claims), mac) {
+		return ContextTokenClaims{}, ErrInvalidContextToken
+	}
+	data, err := Base64URLDecode(claims)
+	if err != nil {
+		return ContextTokenClaims{}, ErrInvalidContextToken
+	}
+	var c ContextTokenClaims
+	if err := json.Unmarshal(data, &c); err != nil || c.ContextID == "" {
+		return ContextTokenClaims{}, ErrInvalidContextToken
+	}
+	if now.UnixMilli() >= c.ExpiresAt {
+		return c, ErrContextTokenExpired
+	}
+	return c, nil
+}
+
+// PublicInfo returns the public info of ctx to send to the client: that of
+// ctx.PublicInfo, with its context token under WithContextTokenSecret.
+// Applications that issue contexts with IssueContext rather than through
+// ContextHandler should send this.
+func (a *Ash) PublicInfo(ctx *Context) ContextPublicInfo {
+	info := ctx.PublicInfo()
+	if a.contextTokenSecret != nil {
+		info.Token = ContextToken(a.contextTokenSecret, ctx)
+	}
+	return info
+}
+
+// errInvalidContextToken is the response to a forged or malformed context
+// token.
+var errInvalidContextToken = NewAshError(ErrInvalidContext, "invalid context token")
+
+// requestContextID returns the context ID of r: the ID in its context
+// token if it has one, and otherwise its HeaderContextID header. A token
+// is checked before the store is consulted; on failure the stage and
+// error to fail verification with are returned.
+func (a *Ash) requestContextID(r *http.Request) (string, CheckStage, *AshError) {
+	id := r.Header.Get(headerContextID)
+	token := r.Header.Get(headerContextToken)
+	if token == "" {
+		return id, StageNone, nil
+	}
+	if a.contextTokenSecret == nil {
+		return id, StageHeadersPresent, NewAshError(ErrMalformedRequest, "context tokens are not enabled")
+	}
+	claims, err := ParseContextToken(a.contextTokenSecret, token, a.now())
+	switch {
+	case errors.Is(err, ErrContextTokenExpired):
+		return claims.ContextID, StageExpiry, errContextExpired
+	case err != nil:
+		return id, StageContextLookup, errInvalidContextToken
+	case id != "" && id != claims.ContextID:
+		return id, StageHeadersPresent, NewAshError(ErrMalformedRequest, "context ID does not match the context token")
+	}
+	return claims.ContextID, StageNone, nil
+}
@@ -0,0 +1,177 @@
+package ash
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseContextToken tests context token signing and checking.
+func TestParseContextToken(t *testing.T) {
+	secret := []byte("context-token-secret")
+	now := time.UnixMilli(1700000000000)
+	ctx := &Context{ID: "ash_token", Binding: "POST /api/transfer", Mode: ModeBalanced, ExpiresAt: now.Add(time.Minute).UnixMilli()}
+	token := ContextToken(secret, ctx)
+
+	claims, err := ParseContextToken(secret, token, now)
+	if err != nil {
+		t.Fatalf("ParseContextToken failed: %v", err)
+	}
+	want := ContextTokenClaims{ContextID: ctx.ID, Binding: ctx.Binding, Mode: ctx.Mode, ExpiresAt: ctx.ExpiresAt}
+	if claims != want {
+		t.Errorf("Claims = %+v, want %+v", claims, want)
+	}
+
+	// Swapping in claims for another context invalidates the MAC.
+	forged := ContextToken([]byte("other"), &Context{ID: "ash_other", Binding: ctx.Binding, Mode: ctx.Mode, ExpiresAt: ctx.ExpiresAt})
+	forgedClaims, _, _ := strings.Cut(forged, ".")
+	_, mac, _ := strings.Cut(token, ".")
+	flipped := "A"
+	if strings.HasSuffix(token, "A") {
+		flipped = "B"
+	}
+	for name, tampered := range map[string]string{
+		"claims":     forgedClaims + "." + mac,
+		"mac":        token[:len(token)-1] + flipped,
+		"other key":  forged,
+		"no mac":     strings.Split(token, ".")[0],
+		"empty":      "",
+		"bad base64": "!!!." + contextTokenMAC(secret, "!!!"),
+	} {
+		if _, err := ParseContextToken(secret, tampered, now); err != ErrInvalidContextToken {
+			t.Errorf("%s: expected ErrInvalidContextToken, got %v", name, err)
+		}
+	}
+	if _, err := ParseContextToken(nil, token, now); err != ErrInvalidContextToken {
+		t.Errorf("Expected ErrInvalidContextToken without a secret, got %v", err)
+	}
+
+	if claims, err := ParseContextToken(secret, token, now.Add(time.Minute)); err != ErrContextTokenExpired || claims.ContextID != ctx.ID {
+		t.Errorf("Expected ErrContextTokenExpired with claims, got %+v, %v", claims, err)
+	}
+}
+
+// TestContextTokenMiddleware tests requests naming their context with a
+// context token issued by ContextHandler.
+func TestContextTokenMiddleware(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, store := newTestAsh(t, now, WithContextTokenSecret([]byte("context-token-secret")))
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	body := `{"amount":100}`
+
+	issue := func() ContextPublicInfo {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		NewContextHandler(a).ServeHTTP(rec, httptest.NewRequest("POST", "/api/context?binding=POST+/api/transfer", nil))
+		var info ContextPublicInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil || info.Token == "" {
+			t.Fatalf("Expected a context token, got %s (%v)", rec.Body, err)
+		}
+		return info
+	}
+	send := func(info ContextPublicInfo, edit func(*http.Request)) *httptest.ResponseRecorder {
+		t.Helper()
+		req, _ := http.NewRequest("POST", "http://example.com/api/transfer", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if err := SignRequest(req, info, nil); err != nil {
+			t.Fatalf("SignRequest failed: %v", err)
+		}
+		if edit != nil {
+			edit(req)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		info := issue()
+		rec := send(info, func(req *http.Request) {
+			if req.Header.Get(HeaderContextID) != "" {
+				t.Errorf("SignRequest sent the context ID with a token")
+			}
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+		if ctx, _ := store.Get(info.ContextID); ctx == nil || !ctx.Used {
+			t.Errorf("Context not consumed")
+		}
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		info := issue()
+		other := issue()
+		// A token naming another context, with the first one's MAC.
+		claims, _, _ := strings.Cut(other.Token, ".")
+		_, mac, _ := strings.Cut(info.Token, ".")
+		rec := send(info, func(req *http.Request) { req.Header.Set(HeaderContextToken, claims+"."+mac) })
+		if rec.Code != http.StatusForbidden || decodeError(t, rec).Code != ErrInvalidContext {
+			t.Errorf("Expected 403 %s, got %d: %s", ErrInvalidContext, rec.Code, rec.Body)
+		}
+		for _, id := range []string{info.ContextID, other.ContextID} {
+			if ctx, _ := store.Get(id); ctx == nil || ctx.Used {
+				t.Errorf("Context %s consumed by a tampered token", id)
+			}
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		info := ctx.PublicInfo()
+		info.Token = ContextToken([]byte("context-token-secret"), &Context{
+			ID: ctx.ID, Binding: ctx.Binding, Mode: ctx.Mode, ExpiresAt: now.UnixMilli(),
+		})
+		rec := send(info, nil)
+		if rec.Code != StatusForCode(ErrContextExpired) || decodeError(t, rec).Code != ErrContextExpired {
+			t.Errorf("Expected %d %s, got %d: %s", StatusForCode(ErrContextExpired), ErrContextExpired, rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("issued directly", func(t *testing.T) {
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		info := a.PublicInfo(ctx)
+		if info.Token == "" {
+			t.Fatalf("PublicInfo lacks the context token")
+		}
+		if rec := send(info, nil); rec.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("mismatched ID", func(t *testing.T) {
+		info := issue()
+		rec := send(info, func(req *http.Request) { req.Header.Set(HeaderContextID, "ash_other") })
+		if rec.Code != http.StatusBadRequest || decodeError(t, rec).Code != ErrMalformedRequest {
+			t.Errorf("Expected 400 %s, got %d: %s", ErrMalformedRequest, rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("not enabled", func(t *testing.T) {
+		plain, _ := newTestAsh(t, now)
+		info := issue()
+		req, _ := http.NewRequest("POST", "http://example.com/api/transfer", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if err := SignRequest(req, info, nil); err != nil {
+			t.Fatalf("SignRequest failed: %v", err)
+		}
+		result, err := plain.VerifyRequest(req)
+		if !errors.Is(err, ErrMalformedRequest) || result.Stage != StageHeadersPresent {
+			t.Errorf("Expected %s at %s, got %v", ErrMalformedRequest, StageHeadersPresent, err)
+		}
+	})
+
+	if _, err := New(NewMemoryStore(MemoryStoreOptions{}), WithContextTokenSecret([]byte{})); err != ErrInvalidKey {
+		t.Errorf("Expected ErrInvalidKey for an empty secret, got %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package ash
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// decimalStringsKey is the extension key of the preamble line marking a
+// proof made under a decimal-strings policy. Clients may not send it as
+// an extension of their own.
+const decimalStringsKey = "ash-decimal-strings"
+
+// WithDecimalStrings canonicalizes the JSON values at the given JSON
+// Pointers as decimal strings, so that a client sending an amount as the
+// string "19.990" and one sending the number 19.99 build the same proof.
+// A "*" reference token matches any member or array element, as in
+// "/items/*/price".
+//
+// The value, a string or a number, must be a decimal in the JSON number
+// grammar without an exponent: an optional '-', then digits without
+// leading zeros and an optional fraction. It canonicalizes to the JSON
+// string of the same digits with the trailing zeros of the fraction, and
+// a bare '.', removed, and "-0" becomes "0": both "19.990" and 19.99 give
+// "19.99". Any other value, such as "+1", "1e3", " 1" or true, fails with
+// ReasonInvalidDecimal. Numbers are taken digit for digit, never through
+// a float64. URL-encoded payloads are not affected. A malformed pointer
+// makes canonicalization fail with an error wrapping
+// ErrInvalidJSONPointer.
+func WithDecimalStrings(pointers ...string) CanonicalizeOption {
+	return func(o *canonicalizeOptions) {
+		decimals, err := compilePointerPatterns(pointers)
+		if err != nil && o.err == nil {
+			o.err = err
+		}
+		o.decimals = append(o.decimals, decimals...)
+	}
+}
+
+// isDecimal reports whether the value at pointer is a decimal string.
+func (o *canonicalizeOptions) isDecimal(pointer string) bool {
+	if len(o.decimals) == 0 {
+		return false
+	}
+	path, err := parsePointer(pointer)
+	return err == nil && o.decimals.match(path)
+}
+
+// canonicalDecimalValue returns the canonical decimal string of value, a
+// value at a pointer of WithDecimalStrings.
+func (o *canonicalizeOptions) canonicalDecimalValue(value interface{}, pointer string) (string, error) {
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = v
+	case json.Number:
+		text = string(v)
+	case float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		// A Go number is canonicalized as any other number first.
+		plain := *o
+		plain.decimals = nil
+		number, err := canonicalizeValue(v, pointer, &plain)
+		if err != nil {
+			return "", err
+		}
+		text = formatNumber(number.(float64))
+	default:
+		return "", invalidDecimal(pointer)
+	}
+	decimal, ok := decimalString(text)
+	if !ok {
+		return "", invalidDecimal(pointer)
+	}
+	return decimal, nil
+}
+
+// invalidDecimal is the error for a value that is not a decimal at a
+// pointer of WithDecimalStrings.
+func invalidDecimal(pointer string) *AshError {
+	return canonicalizationError(ReasonInvalidDecimal, pointer, "invalid decimal")
+}
+
+// decimalString returns the canonical form of the decimal s, as described
+// by WithDecimalStrings, and false if s is not a decimal.
+func decimalString(s string) (string, bool) {
+	neg := strings.HasPrefix(s, "-")
+	if neg {
+		s = s[1:]
+	}
+	intPart, fracPart, hasFrac := strings.Cut(s, ".")
+	if !isDigits(intPart) || len(intPart) > 1 && intPart[0] == '0' || hasFrac && !isDigits(fracPart) {
+		return "", false
+	}
+	decimal := intPart
+	if fracPart = strings.TrimRight(fracPart, "0"); fracPart != "" {
+		decimal += "." + fracPart
+	}
+	if neg && decimal != "0" {
+		decimal = "-" + decimal
+	}
+	return decimal, true
+}
+
+// DecimalStringsExtension returns the extension marking a proof made
+// under ContextPublicInfo.DecimalStrings, which clients building proofs
+// with BuildProof add to BuildProofInput.Extensions. SignRequest adds it
+// itself. The preamble line is
+//
+//	ext:ash-decimal-strings=["/amount","/items/*/price"]
+//
+// with the pointers as a canonical JSON array, in the order the context
+// lists them, so that a proof made without the policy never verifies
+// under it, nor the other way round.
+func DecimalStringsExtension(pointers []string) KV {
+	list := make([]interface{}, len(pointers))
+	for i, pointer := range pointers {
+		list[i] = pointer
+	}
+	value, _ := CanonicalizeJSON(list)
+	return KV{Key: decimalStringsKey, Value: value}
+}
+
+// decimalStringsExtensions returns exts with the extension marking
+// proofs for ctx, if it has DecimalStrings.
+func decimalStringsExtensions(exts []KV, ctx *Context) []KV {
+	if len(ctx.DecimalStrings) == 0 {
+		return exts
+	}
+	return append(append([]KV(nil), exts...), DecimalStringsExtension(ctx.DecimalStrings))
+}
+
+// errReservedExtension rejects a client extension with the key of the
+// decimal-strings marker.
+var errReservedExtension = NewAshError(ErrMalformedRequest, "reserved extension key: "+decimalStringsKey)
+
+// checkReservedExtensions returns an error if exts, supplied by the
+// client, has a key the preamble reserves.
+func checkReservedExtensions(exts []KV) error {
+	for _, ext := range exts {
+		if ext.Key == decimalStringsKey {
+			return errReservedExtension
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package ash
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDecimalStrings tests the canonicalization of decimal strings.
+func TestDecimalStrings(t *testing.T) {
+	opt := WithDecimalStrings("/amount", "/items/*/price")
+	tests := []struct {
+		input, want string
+	}{
+		{`{"amount":"19.99"}`, `{"amount":"19.99"}`},
+		{`{"amount":19.99}`, `{"amount":"19.99"}`},
+		{`{"amount":"19.990"}`, `{"amount":"19.99"}`},
+		{`{"amount":19.990}`, `{"amount":"19.99"}`},
+		{`{"amount":"100.00"}`, `{"amount":"100"}`},
+		{`{"amount":100}`, `{"amount":"100"}`},
+		{`{"amount":"-0.00"}`, `{"amount":"0"}`},
+		{`{"amount":-0}`, `{"amount":"0"}`},
+		{`{"amount":"-12.50"}`, `{"amount":"-12.5"}`},
+		{`{"amount":"0.10"}`, `{"amount":"0.1"}`},
+		// Digits beyond float64 precision are kept.
+		{`{"amount":12345678901234567890.123456789}`, `{"amount":"12345678901234567890.123456789"}`},
+		{`{"items":[{"price":"1.50","qty":2.50}],"note":"1.50"}`, `{"items":[{"price":"1.5","qty":2.5}],"note":"1.50"}`},
+	}
+	for _, tt := range tests {
+		got, err := ParseJSON(tt.input, opt)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseJSON(%s) = %s, %v; want %s", tt.input, got, err, tt.want)
+		}
+		var sb strings.Builder
+		if err := CanonicalizeJSONStream(strings.NewReader(tt.input), &sb, opt); err != nil || sb.String() != tt.want {
+			t.Errorf("CanonicalizeJSONStream(%s) = %s, %v; want %s", tt.input, sb.String(), err, tt.want)
+		}
+	}
+
+	// Go numbers are canonicalized as decoded ones.
+	got, err := CanonicalizeJSON(map[string]interface{}{"amount": 19.99, "items": []interface{}{map[string]interface{}{"price": 3}}}, opt)
+	if want := `{"amount":"19.99","items":[{"price":"3"}]}`; err != nil || got != want {
+		t.Errorf("CanonicalizeJSON = %s, %v; want %s", got, err, want)
+	}
+}
+
+// TestDecimalStringsMalformed tests that values that are not decimals are
+// rejected.
+func TestDecimalStringsMalformed(t *testing.T) {
+	opt := WithDecimalStrings("/amount")
+	for _, amount := range []string{
+		`"+1"`, `"1e3"`, `1e3`, `1E-2`, `"1."`, `".5"`, `"01"`, `"-"`, `" 1"`, `"1 "`,
+		`""`, `"abc"`, `"1,5"`, `"NaN"`, `true`, `null`, `{}`, `[1]`,
+	} {
+		input := `{"amount":` + amount + `}`
+		_, err := ParseJSON(input, opt)
+		var ashErr *AshError
+		if !errors.As(err, &ashErr) || ashErr.Reason != ReasonInvalidDecimal || ashErr.Pointer != "/amount" {
+			t.Errorf("ParseJSON(%s) = %v, want %s", input, err, ReasonInvalidDecimal)
+		}
+		err = CanonicalizeJSONStream(strings.NewReader(input), &strings.Builder{}, opt)
+		if !errors.As(err, &ashErr) || ashErr.Reason != ReasonInvalidDecimal {
+			t.Errorf("CanonicalizeJSONStream(%s) = %v, want %s", input, err, ReasonInvalidDecimal)
+		}
+	}
+	if _, err := ParseJSON(`{"amount":"1"}`, WithDecimalStrings("amount")); !errors.Is(err, ErrInvalidJSONPointer) {
+		t.Errorf("Malformed pointer = %v, want ErrInvalidJSONPointer", err)
+	}
+}
+
+// TestDecimalStringsProofParity tests that a client sending an amount as a
+// string and one sending it as a number build the same proof under a
+// binding's decimal-strings policy, and that the proof is marked as such.
+func TestDecimalStringsProofParity(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000),
+		WithBindingPolicy("POST /api/payments", BindingPolicy{DecimalStrings: []string{"/amount"}}))
+	ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/payments"})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	info := a.PublicInfo(ctx)
+	if len(info.DecimalStrings) != 1 || info.DecimalStrings[0] != "/amount" {
+		t.Fatalf("DecimalStrings = %v, want the policy's", info.DecimalStrings)
+	}
+
+	sign := func(body string) *http.Request {
+		req, _ := http.NewRequest("POST", "http://example.com/api/payments", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if err := SignRequest(req, info, []byte(body)); err != nil {
+			t.Fatalf("SignRequest(%s) failed: %v", body, err)
+		}
+		return req
+	}
+	stringly, numeric := sign(`{"amount":"19.90","to":"acct"}`), sign(`{"to":"acct","amount":19.9}`)
+	if stringly.Header.Get(HeaderProof) != numeric.Header.Get(HeaderProof) {
+		t.Fatalf("Proofs differ: %s and %s", stringly.Header.Get(HeaderProof), numeric.Header.Get(HeaderProof))
+	}
+
+	// A proof over the same canonical payload without the marker fails.
+	input := BuildProofInput{Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, Nonce: ctx.Nonce,
+		CanonicalPayload: `{"amount":"19.9","to":"acct"}`}
+	if _, err := a.Verify(ctx.ID, BuildProof(input), ctx.Binding, []byte(`{"amount":19.9,"to":"acct"}`), "application/json"); !errors.Is(err, ErrIntegrityFailed) {
+		t.Errorf("Unmarked proof = %v, want %s", err, ErrIntegrityFailed)
+	}
+	// Clients may not send the marker as an extension of their own.
+	if _, err := a.Verify(ctx.ID, stringly.Header.Get(HeaderProof), ctx.Binding, []byte(`{"amount":19.9,"to":"acct"}`),
+		"application/json", WithExtensions(DecimalStringsExtension(nil))); !errors.Is(err, ErrMalformedRequest) {
+		t.Errorf("Client marker = %v, want %s", err, ErrMalformedRequest)
+	}
+
+	// The string-sending client's proof verifies for the number-sending
+	// client's body, whatever the server receives.
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	numeric.Header.Set(HeaderProof, stringly.Header.Get(HeaderProof))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, numeric)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// A malformed amount is rejected.
+	ctx, _ = a.IssueContext(ContextOptions{Binding: "POST /api/payments"})
+	info = a.PublicInfo(ctx)
+	req, _ := http.NewRequest("POST", "http://example.com/api/payments", strings.NewReader(`{"amount":"1e3"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if err := SignRequest(req, info, []byte(`{"amount":"1e3"}`)); !errors.Is(err, ErrCanonicalizationFailed) {
+		t.Errorf("SignRequest with a malformed amount = %v, want %s", err, ErrCanonicalizationFailed)
+	}
+
+	// Other bindings are unaffected.
+	ctx, _ = a.IssueContext(ContextOptions{Binding: "POST /api/other"})
+	if len(ctx.DecimalStrings) != 0 {
+		t.Errorf("DecimalStrings = %v for a binding without the policy", ctx.DecimalStrings)
+	}
+}
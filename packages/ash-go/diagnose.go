@@ -0,0 +1,297 @@
+package ash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MismatchKind classifies the difference between two canonical payloads.
+type MismatchKind string
+
+const (
+	// MismatchNone means the payloads are identical.
+	MismatchNone MismatchKind = "none"
+	// MismatchKeyOrder means the payloads hold the same members, written
+	// in a different order or layout.
+	MismatchKeyOrder MismatchKind = "key-order"
+	// MismatchNumberFormat means the payloads differ only in how equal
+	// numbers are written, such as 1.0 and 1.
+	MismatchNumberFormat MismatchKind = "number-format"
+	// MismatchUnicodeNormalization means the payloads differ only in the
+	// Unicode normalization of their strings or keys.
+	MismatchUnicodeNormalization MismatchKind = "unicode-normalization"
+	// MismatchValueDifference means the payloads carry different data, or
+	// are not both JSON.
+	MismatchValueDifference MismatchKind = "value-difference"
+	// MismatchEmptyBody means one payload is CanonicalEmptyBody and the
+	// other is not: one side signed or sent no body at all, which is not
+	// the same as {} or [].
+	MismatchEmptyBody MismatchKind = "empty-body"
+)
+
+// diagnoseExcerpt is the number of bytes shown on each side of the first
+// difference in MismatchReport excerpts.
+const diagnoseExcerpt = 24
+
+// MismatchReport describes how a client's canonical payload differs from
+// the server's. See DiagnoseMismatch.
+type MismatchReport struct {
+	// Kind classifies the difference.
+	Kind MismatchKind
+	// Offset is the byte offset of the first difference, or -1 if the
+	// payloads are identical.
+	Offset int
+	// Path is the JSON Pointer of the innermost value containing Offset,
+	// in whichever payload locates it more precisely ("" for the whole
+	// document, and when a payload is not JSON).
+	Path string
+	// Client and Server are the payloads around Offset.
+	Client string
+	Server string
+}
+
+// String renders the report for a developer, for example:
+//
+//	canonical payloads differ at byte 6 (/a): number-format
+//	  client: "{\"a\":1.0}"
+//	  server: "{\"a\":1}"
+func (r MismatchReport) String() string {
+	if r.Kind == MismatchNone {
+		return "canonical payloads match"
+	}
+	if r.Kind == MismatchEmptyBody {
+		if r.Client == CanonicalEmptyBody {
+			return fmt.Sprintf("client signed no body, but the server received one\n  server: %s", strconv.QuoteToGraphic(r.Server))
+		}
+		return fmt.Sprintf("client signed a body, but the server received none\n  client: %s", strconv.QuoteToGraphic(r.Client))
+	}
+	path := r.Path
+	if path == "" {
+		path = "document"
+	}
+	return fmt.Sprintf("canonical payloads differ at byte %d (%s): %s\n  client: %s\n  server: %s",
+		r.Offset, path, r.Kind, strconv.QuoteToGraphic(r.Client), strconv.QuoteToGraphic(r.Server))
+}
+
+// DiagnoseMismatch compares the canonical payload a client signed with the
+// one the server verified, such as one logged under WithDebugResponses,
+// and reports the first differing byte, the JSON Pointer of the value
+// containing it and what kind of difference it is. It is meant for
+// developers chasing ErrIntegrityFailed, not for use in verification.
+//
+// A payload that is CanonicalEmptyBody, where the other is not, is
+// reported as MismatchEmptyBody: one side signed no body and the other
+// sent one, or the other way round.
+//
+// Otherwise the kind describes the payloads as a whole: they differ in
+// value unless that is explained by Unicode normalization (NFKC, which
+// includes NFC), then by the writing of numbers, and otherwise by the
+// order of members.
+func DiagnoseMismatch(clientCanonical, serverCanonical string) MismatchReport {
+	if clientCanonical == serverCanonical {
+		return MismatchReport{Kind: MismatchNone, Offset: -1}
+	}
+	offset := 0
+	for offset < len(clientCanonical) && offset < len(serverCanonical) && clientCanonical[offset] == serverCanonical[offset] {
+		offset++
+	}
+	report := MismatchReport{
+		Kind:   MismatchValueDifference,
+		Offset: offset,
+		Client: excerpt(clientCanonical, offset),
+		Server: excerpt(serverCanonical, offset),
+	}
+	if clientCanonical == CanonicalEmptyBody || serverCanonical == CanonicalEmptyBody {
+		report.Kind = MismatchEmptyBody
+		return report
+	}
+
+	client, clientErr := decodeDiagnosed(clientCanonical)
+	server, serverErr := decodeDiagnosed(serverCanonical)
+	if clientErr != nil || serverErr != nil {
+		return report
+	}
+	report.Path = pointerAt(serverCanonical, offset)
+	if p := pointerAt(clientCanonical, offset); strings.Count(p, "/") > strings.Count(report.Path, "/") {
+		report.Path = p
+	}
+
+	switch {
+	case sameJSON(client, server, exactJSON):
+		report.Kind = MismatchKeyOrder
+	case sameJSON(client, server, numericJSON):
+		report.Kind = MismatchNumberFormat
+	case sameJSON(client, server, normalizedJSON):
+		report.Kind = MismatchUnicodeNormalization
+	}
+	return report
+}
+
+// decodeDiagnosed decodes a single JSON document, keeping numbers as
+// written.
+func decodeDiagnosed(s string) (interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err == nil {
+		return nil, errors.New("trailing data")
+	}
+	return v, nil
+}
+
+// excerpt returns s around offset.
+func excerpt(s string, offset int) string {
+	start := max(offset-diagnoseExcerpt, 0)
+	end := min(offset+diagnoseExcerpt, len(s))
+	return s[start:end]
+}
+
+// jsonComparison sets how sameJSON compares strings, keys and numbers.
+type jsonComparison int
+
+const (
+	// exactJSON compares everything as written.
+	exactJSON jsonComparison = iota
+	// numericJSON compares numbers by value.
+	numericJSON
+	// normalizedJSON also compares strings and keys under NFKC.
+	normalizedJSON
+)
+
+// sameJSON reports whether two decoded documents are equal under cmp,
+// whatever the order of their members.
+func sameJSON(a, b interface{}, cmp jsonComparison) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if cmp == normalizedJSON {
+			a, b = normalizeKeys(a), normalizeKeys(b)
+		}
+		if len(a) != len(b) {
+			return false
+		}
+		for k, av := range a {
+			bv, ok := b[k]
+			if !ok || !sameJSON(av, bv, cmp) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !sameJSON(a[i], b[i], cmp) {
+				return false
+			}
+		}
+		return true
+	case string:
+		b, ok := b.(string)
+		if ok && cmp == normalizedJSON {
+			return norm.NFKC.String(a) == norm.NFKC.String(b)
+		}
+		return ok && a == b
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok || a == b || cmp == exactJSON {
+			return ok && a == b
+		}
+		af, aErr := a.Float64()
+		bf, bErr := b.Float64()
+		return aErr == nil && bErr == nil && af == bf
+	default:
+		return a == b
+	}
+}
+
+// normalizeKeys returns m with its keys in NFKC. Keys that normalize
+// alike collide, and one of their values is kept.
+func normalizeKeys(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[norm.NFKC.String(k)] = v
+	}
+	return out
+}
+
+// pointerAt returns the JSON Pointer of the innermost value of doc whose
+// text contains offset; a member name counts as part of its value.
+func pointerAt(doc string, offset int) string {
+	type frame struct {
+		object  bool
+		key     string
+		index   int
+		wantKey bool
+	}
+	var stack []frame
+	pointer := func() string {
+		p := ""
+		for _, f := range stack {
+			if f.object {
+				p = childPointer(p, f.key)
+			} else {
+				p = childPointer(p, strconv.Itoa(f.index))
+			}
+		}
+		return p
+	}
+	// next moves past a complete value in the innermost container.
+	next := func() {
+		if len(stack) == 0 {
+			return
+		}
+		if top := &stack[len(stack)-1]; top.object {
+			top.wantKey = true
+		} else {
+			top.index++
+		}
+	}
+
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return pointer()
+		}
+		reached := int(dec.InputOffset()) > offset
+		if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+			stack = stack[:len(stack)-1]
+			if reached {
+				return pointer()
+			}
+			next()
+			continue
+		}
+		if len(stack) > 0 && stack[len(stack)-1].object && stack[len(stack)-1].wantKey {
+			top := &stack[len(stack)-1]
+			top.key, top.wantKey = tok.(string), false
+			if reached {
+				return pointer()
+			}
+			continue
+		}
+		if reached {
+			return pointer()
+		}
+		if d, ok := tok.(json.Delim); ok {
+			stack = append(stack, frame{object: d == '{', wantKey: d == '{'})
+			continue
+		}
+		next()
+	}
+}
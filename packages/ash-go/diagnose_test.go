@@ -0,0 +1,62 @@
+package ash
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestDiagnoseMismatch tests the classification and location of
+// differences between canonical payloads.
+func TestDiagnoseMismatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		client string
+		server string
+		kind   MismatchKind
+		offset int
+		path   string
+	}{
+		{"identical", `{"a":1}`, `{"a":1}`, MismatchNone, -1, ""},
+		{"key order", `{"b":1,"a":2}`, `{"a":2,"b":1}`, MismatchKeyOrder, 2, "/a"},
+		{"astral key order", `{"😀":1,"ｚ":2}`, `{"ｚ":2,"😀":1}`, MismatchKeyOrder, 2, "/ｚ"},
+		{"nested key order", `{"x":{"b":1,"a":2}}`, `{"x":{"a":2,"b":1}}`, MismatchKeyOrder, 7, "/x/a"},
+		{"number format", `{"a":1.0}`, `{"a":1}`, MismatchNumberFormat, 6, "/a"},
+		{"exponent", `{"a":[1,2e3]}`, `{"a":[1,2000]}`, MismatchNumberFormat, 9, "/a/1"},
+		{"unicode normalization", "{\"name\":\"Jose\u0301\"}", "{\"name\":\"Jos\u00e9\"}", MismatchUnicodeNormalization, 12, "/name"},
+		{"normalized key", "{\"e\u0301\":1}", "{\"\u00e9\":1}", MismatchUnicodeNormalization, 2, "/\u00e9"},
+		{"compatibility form", "{\"a\":\"\ufb01le\"}", "{\"a\":\"file\"}", MismatchUnicodeNormalization, 6, "/a"},
+		{"value", `{"amount":100,"to":"bob"}`, `{"amount":1000,"to":"bob"}`, MismatchValueDifference, 13, "/amount"},
+		{"missing member", `{"a":1}`, `{"a":1,"b":2}`, MismatchValueDifference, 6, "/b"},
+		{"escaped pointer", `{"a/b":{"c~d":true}}`, `{"a/b":{"c~d":false}}`, MismatchValueDifference, 14, "/a~1b/c~0d"},
+		{"not JSON", `a=1&b=2`, `a=1&b=3`, MismatchValueDifference, 6, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := DiagnoseMismatch(tt.client, tt.server)
+			if report.Kind != tt.kind || report.Offset != tt.offset || report.Path != tt.path {
+				t.Errorf("DiagnoseMismatch = %+v, want kind %s offset %d path %q", report, tt.kind, tt.offset, tt.path)
+			}
+		})
+	}
+}
+
+// TestMismatchReportString tests the rendering of a report.
+func TestMismatchReportString(t *testing.T) {
+	got := DiagnoseMismatch(`{"a":1.0}`, `{"a":1}`).String()
+	want := "canonical payloads differ at byte 6 (/a): number-format\n" +
+		`  client: "{\"a\":1.0}"` + "\n" +
+		`  server: "{\"a\":1}"`
+	if got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got := DiagnoseMismatch("", "").String(); got != "canonical payloads match" {
+		t.Errorf("String() = %q", got)
+	}
+
+	long := `{"data":"` + strings.Repeat("x", 100) + `","z":1}`
+	report := DiagnoseMismatch(long, strings.Replace(long, `"z":1`, `"z":2`, 1))
+	if len(report.Client) != diagnoseExcerpt+len(`1}`) || report.Path != "/z" {
+		t.Errorf("Long report = %+v", report)
+	}
+}
@@ -0,0 +1,291 @@
+package ash
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// Defaults for AsyncOptions.
+const (
+	// DefaultAsyncWorkers is the default number of delivery workers.
+	DefaultAsyncWorkers = 4
+	// DefaultAsyncQueueSize is the default capacity of the delivery queue.
+	DefaultAsyncQueueSize = 1024
+)
+
+// OverflowPolicy selects which delivery is dropped when the queue is full.
+type OverflowPolicy int
+
+const (
+	// DropNewest drops the delivery being queued.
+	DropNewest OverflowPolicy = iota
+	// DropOldest drops the oldest queued delivery to make room.
+	DropOldest
+)
+
+// AsyncOptions configures asynchronous delivery (see WithAsyncDelivery).
+type AsyncOptions struct {
+	// Workers is the number of delivery goroutines
+	// (default: DefaultAsyncWorkers).
+	Workers int
+	// QueueSize caps the deliveries waiting across all workers
+	// (default: DefaultAsyncQueueSize).
+	QueueSize int
+	// Overflow selects what is dropped when the queue is full
+	// (default: DropNewest).
+	Overflow OverflowPolicy
+}
+
+// WithAsyncDelivery moves audit records and hook callbacks off the request
+// path onto a bounded queue served by a pool of workers. Deliveries for the
+// same context are made in order. When the queue is full one delivery is
+// dropped according to opts.Overflow and counted (see AsyncDropped). A
+// delivery that panics is logged with its stack and counted the same way,
+// and its worker carries on.
+//
+// Call Close on shutdown to deliver what is still queued.
+//
+// With WithAuditRequired, audit records are still delivered inline, since
+// their failure must fail verification.
+func WithAsyncDelivery(opts AsyncOptions) Option {
+	return func(a *Ash) { a.asyncOptions = &opts }
+}
+
+// dispatcher delivers tasks asynchronously. Tasks with the same key go to
+// the same worker and so run in the order they were dispatched.
+type dispatcher struct {
+	queues   []*taskQueue
+	overflow OverflowPolicy
+	logger   *slog.Logger
+	dropped  atomic.Int64
+	wg       sync.WaitGroup
+	closed   atomic.Bool
+}
+
+// task is a queued delivery, or a flush barrier when done is set.
+type task struct {
+	fn   func()
+	done chan struct{}
+}
+
+// taskQueue is the bounded FIFO of one worker.
+type taskQueue struct {
+	mu    sync.Mutex
+	tasks []task
+	limit int
+	ready chan struct{}
+	stop  bool
+}
+
+// newDispatcher starts the workers, which log panicking deliveries to
+// logger.
+func newDispatcher(opts AsyncOptions, logger *slog.Logger) *dispatcher {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultAsyncWorkers
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultAsyncQueueSize
+	}
+	d := &dispatcher{overflow: opts.Overflow, logger: logger}
+	limit := max(opts.QueueSize/opts.Workers, 1)
+	for i := 0; i < opts.Workers; i++ {
+		q := &taskQueue{limit: limit, ready: make(chan struct{}, 1)}
+		d.queues = append(d.queues, q)
+		d.wg.Add(1)
+		go d.work(q)
+	}
+	return d
+}
+
+// dispatch queues fn on the worker for key. After close it runs fn inline.
+func (d *dispatcher) dispatch(key string, fn func()) {
+	if d.closed.Load() {
+		fn()
+		return
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	q := d.queues[h.Sum32()%uint32(len(d.queues))]
+
+	q.mu.Lock()
+	if q.stop {
+		q.mu.Unlock()
+		fn()
+		return
+	}
+	if q.len() >= q.limit {
+		d.dropped.Add(1)
+		if d.overflow != DropOldest || !q.dropOldest() {
+			q.mu.Unlock()
+			return
+		}
+	}
+	q.tasks = append(q.tasks, task{fn: fn})
+	q.mu.Unlock()
+	q.signal()
+}
+
+// len returns the number of queued deliveries, not counting barriers.
+func (q *taskQueue) len() int {
+	n := 0
+	for _, t := range q.tasks {
+		if t.done == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// dropOldest removes the oldest delivery, reporting false if there is
+// none. Barriers are never dropped.
+func (q *taskQueue) dropOldest() bool {
+	for i, t := range q.tasks {
+		if t.done == nil {
+			q.tasks = append(q.tasks[:i], q.tasks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// signal wakes the worker.
+func (q *taskQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// work runs the tasks of q until it is stopped and drained.
+func (d *dispatcher) work(q *taskQueue) {
+	defer d.wg.Done()
+	for {
+		q.mu.Lock()
+		if len(q.tasks) == 0 {
+			stop := q.stop
+			q.mu.Unlock()
+			if stop {
+				return
+			}
+			<-q.ready
+			continue
+		}
+		t := q.tasks[0]
+		q.tasks = q.tasks[1:]
+		q.mu.Unlock()
+
+		if t.done != nil {
+			close(t.done)
+		} else {
+			d.run(t.fn)
+		}
+	}
+}
+
+// run runs a delivery on a worker. A panic, such as from a hook or audit
+// sink, is logged and counted as a drop rather than killing the worker,
+// which would stall every later delivery for its keys.
+func (d *dispatcher) run(fn func()) {
+	defer func() {
+		if p := recover(); p != nil {
+			d.dropped.Add(1)
+			d.logger.Error("ash: panic during async delivery", "panic", p, "stack", string(debug.Stack()))
+		}
+	}()
+	fn()
+}
+
+// flush waits until everything queued before the call has been delivered,
+// or until ctx is done.
+func (d *dispatcher) flush(ctx context.Context) error {
+	barriers := make([]chan struct{}, 0, len(d.queues))
+	for _, q := range d.queues {
+		done := make(chan struct{})
+		q.mu.Lock()
+		if q.stop {
+			close(done)
+		} else {
+			q.tasks = append(q.tasks, task{done: done})
+		}
+		q.mu.Unlock()
+		q.signal()
+		barriers = append(barriers, done)
+	}
+	for _, done := range barriers {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// close flushes the queues and stops the workers. Later dispatches run
+// inline.
+func (d *dispatcher) close(ctx context.Context) error {
+	d.closed.Store(true)
+	err := d.flush(ctx)
+	for _, q := range d.queues {
+		q.mu.Lock()
+		q.stop = true
+		q.mu.Unlock()
+		q.signal()
+	}
+	if err != nil {
+		return err
+	}
+	stopped := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deliver runs fn through the dispatcher if asynchronous delivery is
+// enabled, or inline otherwise.
+func (a *Ash) deliver(key string, fn func()) {
+	if a.dispatcher == nil {
+		fn()
+		return
+	}
+	a.dispatcher.dispatch(key, fn)
+}
+
+// Flush waits until queued audit records and hook callbacks have been
+// delivered, or until ctx is done. It returns immediately without
+// WithAsyncDelivery.
+func (a *Ash) Flush(ctx context.Context) error {
+	if a.dispatcher == nil {
+		return nil
+	}
+	return a.dispatcher.flush(ctx)
+}
+
+// Close flushes queued deliveries (see Flush) and stops the delivery
+// workers. Deliveries after Close run inline. It does not close the store.
+func (a *Ash) Close(ctx context.Context) error {
+	if a.dispatcher == nil {
+		return nil
+	}
+	return a.dispatcher.close(ctx)
+}
+
+// AsyncDropped returns the number of deliveries dropped because the queue
+// was full or because they panicked.
+func (a *Ash) AsyncDropped() int64 {
+	if a.dispatcher == nil {
+		return 0
+	}
+	return a.dispatcher.dropped.Load()
+}
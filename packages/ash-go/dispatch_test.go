@@ -0,0 +1,179 @@
+package ash
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestDispatcherOrderPerKey tests that deliveries for the same key run in
+// dispatch order.
+func TestDispatcherOrderPerKey(t *testing.T) {
+	d := newDispatcher(AsyncOptions{Workers: 4, QueueSize: 4000}, slog.Default())
+	var mu sync.Mutex
+	got := make(map[string][]int)
+	for i := 0; i < 100; i++ {
+		for _, key := range []string{"a", "b", "c", "d", "e"} {
+			key, i := key, i
+			d.dispatch(key, func() {
+				mu.Lock()
+				got[key] = append(got[key], i)
+				mu.Unlock()
+			})
+		}
+	}
+	if err := d.close(context.Background()); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	for key, seq := range got {
+		for i, v := range seq {
+			if v != i {
+				t.Fatalf("Deliveries for %q out of order: %v", key, seq)
+			}
+		}
+	}
+	if len(got) != 5 {
+		t.Errorf("Got deliveries for %d keys, want 5", len(got))
+	}
+}
+
+// TestDispatcherOverflow tests the drop policies when the queue is full.
+func TestDispatcherOverflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		overflow OverflowPolicy
+		want     []int
+	}{
+		{"drop newest", DropNewest, []int{0, 1, 2}},
+		{"drop oldest", DropOldest, []int{0, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDispatcher(AsyncOptions{Workers: 1, QueueSize: 2, Overflow: tt.overflow}, slog.Default())
+			started, gate := make(chan struct{}), make(chan struct{})
+			var got []int
+			d.dispatch("k", func() {
+				got = append(got, 0)
+				close(started)
+				<-gate
+			})
+			<-started
+			// The worker is busy, so these queue up and the last overflows.
+			for i := 1; i <= 3; i++ {
+				i := i
+				d.dispatch("k", func() { got = append(got, i) })
+			}
+			close(gate)
+			if err := d.close(context.Background()); err != nil {
+				t.Fatalf("close failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Delivered %v, want %v", got, tt.want)
+			}
+			if n := d.dropped.Load(); n != 1 {
+				t.Errorf("Dropped %d, want 1", n)
+			}
+		})
+	}
+}
+
+// TestAsyncDeliveryCloseFlushes tests that Close delivers every queued
+// audit record and hook callback.
+func TestAsyncDeliveryCloseFlushes(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	var mu sync.Mutex
+	var audited, verified int
+	sink := auditSinkFunc(func(AuditEvent) error {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		audited++
+		mu.Unlock()
+		return nil
+	})
+	hooks := Hooks{OnVerify: func(*VerifyResult) {
+		mu.Lock()
+		verified++
+		mu.Unlock()
+	}}
+	a, _ := newTestAsh(t, now, WithAuditSink(sink), WithHooks(hooks), WithAsyncDelivery(AsyncOptions{Workers: 2}))
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/test"})
+		if _, err := a.Verify(ctx.ID, clientProof(t, ctx, "{}", "application/json"), ctx.Binding, []byte("{}"), "application/json"); err != nil {
+			t.Fatalf("Verify failed: %v", err)
+		}
+	}
+	if err := a.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if audited != n || verified != n {
+		t.Errorf("After Close: %d audited, %d verified; want %d each", audited, verified, n)
+	}
+	if a.AsyncDropped() != 0 {
+		t.Errorf("AsyncDropped = %d, want 0", a.AsyncDropped())
+	}
+}
+
+// TestAsyncDeliveryFlushTimeout tests that Flush gives up when its context
+// is done.
+func TestAsyncDeliveryFlushTimeout(t *testing.T) {
+	d := newDispatcher(AsyncOptions{Workers: 1}, slog.Default())
+	gate := make(chan struct{})
+	d.dispatch("k", func() { <-gate })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := d.flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	close(gate)
+	if err := d.close(context.Background()); err != nil {
+		t.Errorf("close failed: %v", err)
+	}
+}
+
+// TestAsyncDeliveryPanic tests that a panicking hook is logged and counted
+// as a drop, and that its worker goes on delivering.
+func TestAsyncDeliveryPanic(t *testing.T) {
+	var logs bytes.Buffer
+	var mu sync.Mutex
+	var verified []bool
+	hooks := Hooks{OnVerify: func(result *VerifyResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		verified = append(verified, result.Valid)
+		if len(verified) == 1 {
+			panic("hook failed")
+		}
+	}}
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithHooks(hooks),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))), WithAsyncDelivery(AsyncOptions{Workers: 1}))
+
+	for i := 0; i < 3; i++ {
+		ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/test"})
+		if _, err := a.Verify(ctx.ID, clientProof(t, ctx, "{}", "application/json"), ctx.Binding, []byte("{}"), "application/json"); err != nil {
+			t.Fatalf("Verify failed: %v", err)
+		}
+	}
+	if err := a.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(verified) != 3 {
+		t.Errorf("OnVerify called %d times, want 3", len(verified))
+	}
+	if a.AsyncDropped() != 1 {
+		t.Errorf("AsyncDropped = %d, want 1", a.AsyncDropped())
+	}
+	if !strings.Contains(logs.String(), "panic during async delivery") || !strings.Contains(logs.String(), "hook failed") {
+		t.Errorf("Panic not logged: %s", logs.String())
+	}
+}
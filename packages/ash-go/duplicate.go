@@ -0,0 +1,83 @@
+package ash
+
+import (
+	"sync"
+	"time"
+)
+
+// WithDuplicateWindow accepts an identical resubmission of a verified
+// request, such as a double-click or a service worker retry, for window
+// after it was verified. A request is identical when it carries the same
+// context ID and proof and the proof verifies against its payload; it
+// gets a valid result with Duplicate set instead of ErrReplayDetected, and
+// the context is not consumed again. A different payload under the same
+// context is still a replay.
+//
+// Handlers run for every accepted duplicate, so they should check
+// VerifyResult.Duplicate before repeating side effects. Contexts consumed
+// under MiddlewareOptions.DeferConsume are not remembered.
+func WithDuplicateWindow(window time.Duration) Option {
+	return func(a *Ash) {
+		if window > 0 {
+			a.duplicates = &duplicateCache{window: window}
+		}
+	}
+}
+
+// duplicateCache remembers recently verified (context ID, proof) pairs.
+type duplicateCache struct {
+	window time.Duration
+	keys   expiringSet
+}
+
+// duplicateKey is the cache key of a proof for a context.
+func duplicateKey(contextID, proof string) string {
+	return contextID + "\x00" + proof
+}
+
+// add remembers a verified proof from now.
+func (c *duplicateCache) add(contextID, proof string, now time.Time) {
+	c.keys.add(duplicateKey(contextID, proof), now, now.Add(c.window))
+}
+
+// seen reports whether the proof was verified for the context within the
+// window.
+func (c *duplicateCache) seen(contextID, proof string, now time.Time) bool {
+	return c.keys.has(duplicateKey(contextID, proof), now)
+}
+
+// expiringSet is a set of keys that each expire at their own time.
+type expiringSet struct {
+	mu    sync.Mutex
+	until map[string]int64 // key -> expiry, Unix ms
+	// sweepAt is the size at which expired keys are next swept.
+	sweepAt int
+}
+
+// add adds key until the given time, sweeping expired keys once the set
+// has doubled in size since the last sweep.
+func (s *expiringSet) add(key string, now, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nowMs := now.UnixMilli()
+	if s.until == nil {
+		s.until = make(map[string]int64)
+	}
+	if len(s.until) >= s.sweepAt {
+		for key, until := range s.until {
+			if nowMs >= until {
+				delete(s.until, key)
+			}
+		}
+		s.sweepAt = max(2*len(s.until), 64)
+	}
+	s.until[key] = until.UnixMilli()
+}
+
+// has reports whether key is in the set at now.
+func (s *expiringSet) has(key string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.until[key]
+	return ok && now.UnixMilli() < until
+}
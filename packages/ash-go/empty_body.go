@@ -0,0 +1,77 @@
+package ash
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// Proof mismatches between a body and no body have their own messages, as
+// the two sides otherwise only see a generic proof failure.
+var (
+	errProofCoversNoBody = NewAshError(ErrIntegrityFailed, "proof covers no body, but the request has one")
+	errProofCoversBody   = NewAshError(ErrIntegrityFailed, "proof covers a body, but the request has none")
+)
+
+// emptyBodyMismatch returns the error for a proof that failed to match
+// because the client signed no body and sent one, or signed {} or [] and
+// sent none. empty reports whether the request's canonical payload was
+// CanonicalEmptyBody. It returns nil if the proof covers neither.
+//
+// The v1 preimage of a request without a body ends with the empty
+// canonical payload, so the check rebuilds the proof over the other empty
+// forms; it costs a hash of the preamble each, and only on failure.
+func (a *Ash) emptyBodyMismatch(proof string, input BuildProofInput, ctx *Context, empty bool) error {
+	if ctx.RawBody {
+		return nil
+	}
+	candidates, err := []string{CanonicalEmptyBody}, errProofCoversNoBody
+	if empty {
+		candidates, err = []string{CanonicalEmptyObject, CanonicalEmptyArray}, errProofCoversBody
+	}
+	for _, canonical := range candidates {
+		h, mac, keyErr := a.proofHash(proof)
+		if keyErr != nil {
+			return nil
+		}
+		input.CanonicalPayload = canonical
+		input.IncludeLength = ctx.IncludeLength
+		io.WriteString(h, proofPreimage(input))
+		if TimingSafeCompare(a.proofEncoding.Encode(h.Sum(nil)), a.proofEncoding.normalize(mac)) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCounter counts the bytes written through it.
+type writeCounter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ErrPayloadMismatch is returned by SignRequest when the payload to sign
+// is empty and the request has a body, or the other way round. Such a
+// proof never verifies: a missing body and {} are different payloads.
+var ErrPayloadMismatch = errors.New("ash: payload does not match the request body")
+
+// checkPayload checks that payload, which SignRequest is about to sign,
+// agrees with the body req will send on whether there is one. Only a body
+// whose length is known is checked: a request without one may be given
+// its body after signing.
+func checkPayload(req *http.Request, payload []byte) error {
+	switch {
+	case len(payload) == 0 && req.ContentLength > 0:
+		return ErrPayloadMismatch
+	case len(payload) > 0 && req.ContentLength == 0 && req.GetBody != nil:
+		// http.NewRequest built the request with an empty body.
+		return ErrPayloadMismatch
+	}
+	return nil
+}
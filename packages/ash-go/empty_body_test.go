@@ -0,0 +1,111 @@
+package ash
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEmptyBodyMismatch tests the errors for a proof over no body on a
+// request with one, and the other way round.
+func TestEmptyBodyMismatch(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, _ := newTestAsh(t, now)
+	tests := []struct {
+		name         string
+		opts         ContextOptions
+		signed, sent string
+		want         *AshError
+	}{
+		{"signed no body", ContextOptions{}, "", "{}", errProofCoversNoBody},
+		{"signed no body, sent data", ContextOptions{}, "", `{"a":1}`, errProofCoversNoBody},
+		{"signed {}", ContextOptions{}, "{}", "", errProofCoversBody},
+		{"signed []", ContextOptions{}, "[]", "", errProofCoversBody},
+		{"signed {} with length", ContextOptions{IncludeLength: true}, "{}", "", errProofCoversBody},
+		{"signed data", ContextOptions{}, `{"a":1}`, "", errProofMismatch},
+		{"other data", ContextOptions{}, `{"a":1}`, `{"a":2}`, errProofMismatch},
+		{"raw body", ContextOptions{RawBody: true}, "", "{}", errProofMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Binding = "POST /api/items"
+			ctx, err := a.IssueContext(opts)
+			if err != nil {
+				t.Fatalf("IssueContext failed: %v", err)
+			}
+			input := BuildProofInput{
+				Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, Nonce: ctx.Nonce,
+				CanonicalPayload: tt.signed, IncludeLength: ctx.IncludeLength,
+			}
+			result, err := a.Verify(ctx.ID, BuildProof(input), ctx.Binding, []byte(tt.sent), "application/json")
+			if err != tt.want || result.Stage != StageProofMatch {
+				t.Errorf("Verify = %v at %s, want %v", err, result.Stage, tt.want)
+			}
+		})
+	}
+
+	// The middleware reports the mismatch to the client.
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := signedRequest(t, a, "POST", "/api/items", "", "application/json")
+	req.Body = httptest.NewRequest("POST", "/api/items", strings.NewReader("{}")).Body
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := decodeError(t, rec); rec.Code != http.StatusForbidden || got.Message != errProofCoversNoBody.Message {
+		t.Errorf("Expected 403 %q, got %d: %s", errProofCoversNoBody.Message, rec.Code, rec.Body)
+	}
+}
+
+// TestDiagnoseEmptyBody tests the diagnosis of a body signed or sent on
+// one side only.
+func TestDiagnoseEmptyBody(t *testing.T) {
+	tests := []struct {
+		client, server, want string
+	}{
+		{"", "{}", "client signed no body, but the server received one\n  server: \"{}\""},
+		{"[]", "", "client signed a body, but the server received none\n  client: \"[]\""},
+		{"a=1", "", "client signed a body, but the server received none\n  client: \"a=1\""},
+	}
+	for _, tt := range tests {
+		report := DiagnoseMismatch(tt.client, tt.server)
+		if report.Kind != MismatchEmptyBody || report.Offset != 0 {
+			t.Errorf("DiagnoseMismatch(%q, %q) = %+v, want %s", tt.client, tt.server, report, MismatchEmptyBody)
+		}
+		if got := report.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+	if report := DiagnoseMismatch("{}", "[]"); report.Kind != MismatchValueDifference {
+		t.Errorf("DiagnoseMismatch({}, []) = %s, want %s", report.Kind, MismatchValueDifference)
+	}
+}
+
+// TestSignRequestEmptyPayload tests that SignRequest refuses a payload
+// that disagrees with the request on whether there is a body.
+func TestSignRequestEmptyPayload(t *testing.T) {
+	info := ContextPublicInfo{ContextID: "ash_test", Mode: ModeBalanced}
+	newRequest := func(body string) *http.Request {
+		req, _ := http.NewRequest("POST", "http://example.com/api/items", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+	if err := SignRequest(newRequest("{}"), info, []byte{}); !errors.Is(err, ErrPayloadMismatch) {
+		t.Errorf("Empty payload for a body = %v, want ErrPayloadMismatch", err)
+	}
+	if err := SignRequest(newRequest(""), info, []byte("{}")); !errors.Is(err, ErrPayloadMismatch) {
+		t.Errorf("Payload for an empty body = %v, want ErrPayloadMismatch", err)
+	}
+	if err := SignRequest(newRequest("{}"), info, []byte("{}")); err != nil {
+		t.Errorf("SignRequest failed: %v", err)
+	}
+	// A request without a body may get one after signing.
+	req, _ := http.NewRequest("POST", "http://example.com/api/items", nil)
+	req.Header.Set("Content-Type", "application/json")
+	if err := SignRequest(req, info, []byte("{}")); err != nil {
+		t.Errorf("SignRequest before the body is set failed: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package ash
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// ProofEncoding selects how a proof digest is written as text.
+//
+// The client and the server must agree on the encoding: the client passes
+// it in BuildProofInput.Encoding and the server configures it with
+// WithProofEncoding. A proof in any other encoding fails verification with
+// ErrMalformedProof.
+type ProofEncoding int
+
+const (
+	// ProofBase64URL is unpadded Base64URL (43 characters), the default.
+	ProofBase64URL ProofEncoding = iota
+	// ProofBase64Std is standard Base64 (43 characters, or 44 with
+	// padding). Verification accepts both forms.
+	ProofBase64Std
+	// ProofHex is hexadecimal (64 characters). BuildProof writes lowercase;
+	// verification accepts either case.
+	ProofHex
+)
+
+// ErrInvalidProofEncoding is returned for an unknown ProofEncoding.
+var ErrInvalidProofEncoding = errors.New("invalid proof encoding")
+
+// String returns the name of the encoding.
+func (e ProofEncoding) String() string {
+	switch e {
+	case ProofBase64URL:
+		return "Base64URL"
+	case ProofBase64Std:
+		return "Base64"
+	case ProofHex:
+		return "hex"
+	default:
+		return "unknown"
+	}
+}
+
+// valid reports whether e is a known encoding.
+func (e ProofEncoding) valid() bool {
+	return e >= ProofBase64URL && e <= ProofHex
+}
+
+// Encode encodes a digest. Base64 output is unpadded.
+func (e ProofEncoding) Encode(digest []byte) string {
+	switch e {
+	case ProofBase64Std:
+		return base64.RawStdEncoding.EncodeToString(digest)
+	case ProofHex:
+		return hex.EncodeToString(digest)
+	default:
+		return Base64URLEncode(digest)
+	}
+}
+
+// Decode decodes a digest written in the encoding, with the same tolerance
+// as verification: padding for Base64 and Base64URL, either case for hex.
+func (e ProofEncoding) Decode(s string) ([]byte, error) {
+	switch e {
+	case ProofBase64Std:
+		return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+	case ProofHex:
+		return hex.DecodeString(s)
+	case ProofBase64URL:
+		return Base64URLDecode(s)
+	default:
+		return nil, ErrInvalidProofEncoding
+	}
+}
+
+// proofLen returns the length of an encoded SHA-256 or HMAC-SHA256 digest.
+func (e ProofEncoding) proofLen() int {
+	if e == ProofHex {
+		return 64
+	}
+	return 43
+}
+
+// isChar reports whether c is in the encoding's alphabet.
+func (e ProofEncoding) isChar(c byte) bool {
+	alnum := 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9'
+	switch e {
+	case ProofBase64Std:
+		return alnum || c == '+' || c == '/'
+	case ProofHex:
+		return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+	default:
+		return alnum || c == '-' || c == '_'
+	}
+}
+
+// normalize returns a well-formed proof in the form Encode produces, so it
+// can be compared with an expected proof.
+func (e ProofEncoding) normalize(proof string) string {
+	switch e {
+	case ProofBase64Std:
+		return strings.TrimSuffix(proof, "=")
+	case ProofHex:
+		return strings.ToLower(proof)
+	default:
+		return proof
+	}
+}
@@ -0,0 +1,97 @@
+package ash
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestProofEncodingRoundTrip tests that proofs built in each encoding
+// decode to the digest and verify with a matching server.
+func TestProofEncodingRoundTrip(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	body := `{"a":1}`
+	tests := []struct {
+		enc     ProofEncoding
+		length  int
+		variant func(string) string
+	}{
+		{ProofBase64URL, 43, nil},
+		{ProofBase64Std, 43, func(p string) string { return p + "=" }},
+		{ProofHex, 64, strings.ToUpper},
+	}
+	for _, tt := range tests {
+		t.Run(tt.enc.String(), func(t *testing.T) {
+			a, _ := newTestAsh(t, now, WithProofEncoding(tt.enc))
+			proofFor := func(ctx *Context) string {
+				return BuildProof(BuildProofInput{
+					Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID,
+					CanonicalPayload: body, Encoding: tt.enc,
+				})
+			}
+
+			ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/test"})
+			proof := proofFor(ctx)
+			if len(proof) != tt.length {
+				t.Errorf("Proof %q has length %d, want %d", proof, len(proof), tt.length)
+			}
+			preimage := proofPreimage(BuildProofInput{Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, CanonicalPayload: body})
+			digest := sha256.Sum256([]byte(preimage))
+			if decoded, err := tt.enc.Decode(proof); err != nil || !bytes.Equal(decoded, digest[:]) {
+				t.Errorf("Decode(%q) = %x, %v; want %x", proof, decoded, err, digest)
+			}
+			if result, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte(body), "application/json"); err != nil || !result.Valid {
+				t.Errorf("Verify failed: %v", err)
+			}
+
+			// Tolerated variants verify too.
+			if tt.variant != nil {
+				ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/test"})
+				if _, err := a.Verify(ctx.ID, tt.variant(proofFor(ctx)), ctx.Binding, []byte(body), "application/json"); err != nil {
+					t.Errorf("Verify of variant failed: %v", err)
+				}
+			}
+
+			// A proof in another encoding is malformed.
+			other := ProofHex
+			if tt.enc == ProofHex {
+				other = ProofBase64URL
+			}
+			ctx, _ = a.IssueContext(ContextOptions{Binding: "POST /api/test"})
+			input := BuildProofInput{Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, CanonicalPayload: body, Encoding: other}
+			var ashErr *AshError
+			if _, err := a.Verify(ctx.ID, BuildProof(input), ctx.Binding, []byte(body), "application/json"); !errors.As(err, &ashErr) || ashErr.Code != ErrMalformedProof {
+				t.Errorf("Expected %s for %s proof, got %v", ErrMalformedProof, other, err)
+			}
+		})
+	}
+}
+
+// TestKeyedProofEncoding tests keyed proofs in a non-default encoding.
+func TestKeyedProofEncoding(t *testing.T) {
+	ring, err := NewKeyRing(Key{ID: "k1", Secret: []byte("secret")})
+	if err != nil {
+		t.Fatalf("NewKeyRing failed: %v", err)
+	}
+	input := BuildProofInput{Mode: ModeBalanced, Binding: "POST /api/test", ContextID: "ash_1", CanonicalPayload: "{}", Encoding: ProofBase64Std}
+	proof := BuildKeyedProof(input, ring)
+	if err := VerifyKeyedProof(input, proof, ring); err != nil {
+		t.Errorf("VerifyKeyedProof failed: %v", err)
+	}
+	if err := VerifyKeyedProof(input, proof+"=", ring); err != nil {
+		t.Errorf("VerifyKeyedProof of padded proof failed: %v", err)
+	}
+	if err := VerifyKeyedProof(input, proof+"==", ring); err == nil {
+		t.Error("Expected doubly padded proof to be rejected")
+	}
+}
+
+// TestNewRejectsInvalidProofEncoding tests that New validates the encoding.
+func TestNewRejectsInvalidProofEncoding(t *testing.T) {
+	if _, err := New(NewMemoryStore(MemoryStoreOptions{}), WithProofEncoding(ProofEncoding(42))); !errors.Is(err, ErrInvalidProofEncoding) {
+		t.Errorf("Expected ErrInvalidProofEncoding, got %v", err)
+	}
+}
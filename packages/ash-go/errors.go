@@ -0,0 +1,188 @@
+package ash
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Error implements error, so that a code can be the target of errors.Is:
+//
+//	if errors.Is(err, ash.ErrReplayDetected) { ... }
+func (c AshErrorCode) Error() string {
+	return string(c)
+}
+
+// Is reports whether target is the code of e, or an AshError with the same
+// code.
+func (e *AshError) Is(target error) bool {
+	switch t := target.(type) {
+	case AshErrorCode:
+		return e.Code == t
+	case *AshError:
+		return t != nil && e.Code == t.Code
+	}
+	return false
+}
+
+// CanonicalizationReason classifies why a payload was rejected by the
+// canonicalizer. It is carried by AshError.Reason and VerifyResult.Reason,
+// and is stable for use as a metric label.
+type CanonicalizationReason string
+
+const (
+	// ReasonInvalidJSON is a body that is not valid JSON.
+	ReasonInvalidJSON CanonicalizationReason = "invalid-json"
+	// ReasonDepthExceeded is JSON nested deeper than the decoder allows.
+	ReasonDepthExceeded CanonicalizationReason = "depth-exceeded"
+	// ReasonNaN is a NaN number.
+	ReasonNaN CanonicalizationReason = "nan"
+	// ReasonInfinity is an infinite number, or one too large for a float64.
+	ReasonInfinity CanonicalizationReason = "infinity"
+	// ReasonInvalidNumber is a json.Number that is not a number.
+	ReasonInvalidNumber CanonicalizationReason = "invalid-number"
+	// ReasonUnsupportedType is a Go value with no JSON form.
+	ReasonUnsupportedType CanonicalizationReason = "unsupported-type"
+	// ReasonInvalidURLEncoding is a malformed percent escape in a
+	// URL-encoded body.
+	ReasonInvalidURLEncoding CanonicalizationReason = "invalid-url-encoding"
+	// ReasonInvalidMultipart is a multipart/form-data body that cannot be
+	// parsed, or that has a part other than a text field, such as a file.
+	ReasonInvalidMultipart CanonicalizationReason = "invalid-multipart"
+	// ReasonNotObject is a top-level value other than an object under
+	// WithRequireTopLevelObject.
+	ReasonNotObject CanonicalizationReason = "not-object"
+	// ReasonTrailingData is data after the top-level value under
+	// WithRejectTrailingData.
+	ReasonTrailingData CanonicalizationReason = "trailing-data"
+	// ReasonTooManyParams is a form with more parameters than
+	// WithMaxParams allows.
+	ReasonTooManyParams CanonicalizationReason = "too-many-params"
+	// ReasonInvalidDecimal is a value that is not a decimal at a pointer
+	// of WithDecimalStrings.
+	ReasonInvalidDecimal CanonicalizationReason = "invalid-decimal"
+	// ReasonCustom is an error other than an AshError from a canonicalizer
+	// registered with WithCanonicalizer.
+	ReasonCustom CanonicalizationReason = "custom"
+)
+
+// canonicalizationReasons lists every CanonicalizationReason.
+var canonicalizationReasons = []CanonicalizationReason{
+	ReasonInvalidJSON, ReasonDepthExceeded, ReasonNaN, ReasonInfinity,
+	ReasonInvalidNumber, ReasonUnsupportedType, ReasonInvalidURLEncoding, ReasonInvalidMultipart,
+	ReasonNotObject, ReasonTrailingData, ReasonTooManyParams, ReasonInvalidDecimal, ReasonCustom,
+}
+
+// asAshError returns the AshError in err's chain, like errors.As. An
+// AshError returned as is is found without allocating.
+func asAshError(err error) (*AshError, bool) {
+	if ashErr, ok := err.(*AshError); ok {
+		return ashErr, true
+	}
+	var ashErr *AshError
+	ok := errors.As(err, &ashErr)
+	return ashErr, ok
+}
+
+// ashErrorJSON is the JSON form of an AshError.
+type ashErrorJSON struct {
+	Error   AshErrorCode `json:"error"`
+	Message string       `json:"message"`
+	Pointer string       `json:"pointer,omitempty"`
+	Status  int          `json:"status"`
+	Docs    string       `json:"docs,omitempty"`
+	// Supported is sent only with ErrUnsupportedContentType.
+	Supported []string `json:"supported,omitempty"`
+}
+
+// MarshalJSON encodes e as
+//
+//	{"error":"ASH_REPLAY_DETECTED","message":"...","status":409,"docs":"..."}
+//
+// The pointer and docs fields are omitted when empty. An
+// ErrUnsupportedContentType error also carries "supported", the media
+// types the server canonicalizes.
+func (e *AshError) MarshalJSON() ([]byte, error) {
+	status := e.Status
+	if status == 0 {
+		status = StatusForCode(e.Code)
+	}
+	return json.Marshal(ashErrorJSON{
+		Error:     e.Code,
+		Message:   e.Message,
+		Pointer:   e.Pointer,
+		Status:    status,
+		Docs:      e.Docs,
+		Supported: e.Supported,
+	})
+}
+
+// UnmarshalJSON decodes the form written by MarshalJSON, so that clients
+// can turn an error response back into an AshError.
+func (e *AshError) UnmarshalJSON(data []byte) error {
+	var v ashErrorJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*e = AshError{Code: v.Error, Message: v.Message, Pointer: v.Pointer, Status: v.Status, Docs: v.Docs, Supported: v.Supported}
+	return nil
+}
+
+// WithErrorDocs sets the base URL of the error documentation. Error
+// responses then carry a "docs" field linking to the section for their
+// code: base + "#" + the code in lower case without the "ASH_" prefix, with
+// hyphens, e.g. "https://example.com/errors#replay-detected".
+func WithErrorDocs(baseURL string) Option {
+	return func(a *Ash) { a.errorDocs = baseURL }
+}
+
+// ErrorDocsAnchor returns the documentation anchor for a code, e.g.
+// "replay-detected" for ErrReplayDetected.
+func ErrorDocsAnchor(code AshErrorCode) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(string(code), "ASH_")), "_", "-")
+}
+
+// publicError returns a copy of err as sent to clients in a response with
+// the given status.
+func (a *Ash) publicError(status int, err *AshError) *AshError {
+	e := *err
+	e.Status = status
+	if a.errorDocs != "" {
+		e.Docs = a.errorDocs + "#" + ErrorDocsAnchor(err.Code)
+	}
+	return &e
+}
+
+// errorEncoder encodes error responses. Encoders are pooled, so that
+// rejecting a storm of bad requests does not allocate a buffer and an
+// encoder per response.
+type errorEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+	v   ashErrorJSON
+}
+
+var errorEncoders = sync.Pool{New: func() interface{} {
+	e := &errorEncoder{}
+	e.enc = json.NewEncoder(&e.buf)
+	return e
+}}
+
+// writeError writes err as a JSON response with the given status, in the
+// form of publicError(status, err).MarshalJSON.
+func (a *Ash) writeError(w http.ResponseWriter, status int, err *AshError) {
+	e := errorEncoders.Get().(*errorEncoder)
+	defer errorEncoders.Put(e)
+	e.v = ashErrorJSON{Error: err.Code, Message: err.Message, Pointer: err.Pointer, Status: status, Supported: err.Supported}
+	if a.errorDocs != "" {
+		e.v.Docs = a.errorDocs + "#" + ErrorDocsAnchor(err.Code)
+	}
+	e.buf.Reset()
+	e.enc.Encode(&e.v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(e.buf.Bytes())
+}
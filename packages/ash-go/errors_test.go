@@ -0,0 +1,149 @@
+package ash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// allErrorCodes lists every AshErrorCode.
+var allErrorCodes = []AshErrorCode{
+	ErrInvalidContext,
+	ErrContextExpired,
+	ErrReplayDetected,
+	ErrIntegrityFailed,
+	ErrEndpointMismatch,
+	ErrModeViolation,
+	ErrUnsupportedContentType,
+	ErrMalformedRequest,
+	ErrMissingHeaders,
+	ErrMalformedProof,
+	ErrCanonicalizationFailed,
+	ErrRateLimited,
+	ErrTenantMismatch,
+	ErrInternalError,
+	ErrOverloaded,
+}
+
+// TestAshErrorJSONRoundTrip tests that every code survives encoding and
+// decoding, with the status taken from StatusForCode.
+func TestAshErrorJSONRoundTrip(t *testing.T) {
+	for _, code := range allErrorCodes {
+		t.Run(string(code), func(t *testing.T) {
+			in := NewAshError(code, "something failed")
+			b, err := json.Marshal(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := fmt.Sprintf(`{"error":%q,"message":"something failed","status":%d}`, code, StatusForCode(code))
+			if string(b) != want {
+				t.Errorf("Marshal = %s, want %s", b, want)
+			}
+
+			var out AshError
+			if err := json.Unmarshal(b, &out); err != nil {
+				t.Fatal(err)
+			}
+			if out.Code != code || out.Message != in.Message || out.Status != StatusForCode(code) {
+				t.Errorf("Unmarshal = %+v", out)
+			}
+			if !errors.Is(&out, code) || !errors.Is(fmt.Errorf("wrapped: %w", &out), code) {
+				t.Errorf("errors.Is(%v, %s) = false", &out, code)
+			}
+			other := ErrInternalError
+			if code == ErrInternalError {
+				other = ErrInvalidContext
+			}
+			if errors.Is(&out, other) {
+				t.Errorf("errors.Is(%v, %s) = true", &out, other)
+			}
+		})
+	}
+}
+
+// TestAshErrorJSONFields tests the optional fields.
+func TestAshErrorJSONFields(t *testing.T) {
+	in := &AshError{
+		Code:    ErrCanonicalizationFailed,
+		Message: "duplicate key",
+		Pointer: "/a",
+		Status:  http.StatusRequestEntityTooLarge,
+		Docs:    "https://example.com/errors#canonicalization-failed",
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"error":"ASH_CANONICALIZATION_FAILED","message":"duplicate key","pointer":"/a","status":413,"docs":"https://example.com/errors#canonicalization-failed"}`
+	if string(b) != want {
+		t.Errorf("Marshal = %s, want %s", b, want)
+	}
+	var out AshError
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, *in) {
+		t.Errorf("Unmarshal = %+v, want %+v", out, *in)
+	}
+	if !errors.Is(&out, NewAshError(ErrCanonicalizationFailed, "")) {
+		t.Error("Expected errors.Is to match an AshError with the same code")
+	}
+}
+
+// TestErrorDocsAnchor tests the documentation anchors.
+func TestErrorDocsAnchor(t *testing.T) {
+	tests := map[AshErrorCode]string{
+		ErrReplayDetected:         "replay-detected",
+		ErrUnsupportedContentType: "unsupported-content-type",
+		ErrInternalError:          "internal-error",
+	}
+	for code, want := range tests {
+		if got := ErrorDocsAnchor(code); got != want {
+			t.Errorf("ErrorDocsAnchor(%s) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+// TestWriteErrorDocs tests the shape of error responses with and without
+// WithErrorDocs.
+func TestWriteErrorDocs(t *testing.T) {
+	for _, docs := range []string{"", "https://example.com/errors"} {
+		var opts []Option
+		if docs != "" {
+			opts = append(opts, WithErrorDocs(docs))
+		}
+		a, _ := newTestAsh(t, time.UnixMilli(1700000000000), opts...)
+		handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		req := httptest.NewRequest(http.MethodPost, "/api/x", nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		resp := decodeError(t, rec)
+		if resp.Code != ErrMissingHeaders || resp.Status != http.StatusBadRequest {
+			t.Fatalf("Unexpected error %+v", resp)
+		}
+		if want := docsURL(docs, "missing-headers"); resp.Docs != want {
+			t.Errorf("Docs = %q, want %q", resp.Docs, want)
+		}
+
+		rec = httptest.NewRecorder()
+		NewContextHandler(a).ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/ash/context", nil))
+		resp = decodeError(t, rec)
+		if resp.Status != http.StatusMethodNotAllowed || resp.Docs != docsURL(docs, "malformed-request") {
+			t.Errorf("Unexpected error %+v", resp)
+		}
+	}
+}
+
+// docsURL returns the expected docs field for a base URL and anchor.
+func docsURL(base, anchor string) string {
+	if base == "" {
+		return ""
+	}
+	return base + "#" + anchor
+}
@@ -0,0 +1,173 @@
+package ash_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	ash "github.com/3maem/ash-go"
+)
+
+// newExampleAsh returns an instance whose clock, context IDs and nonces are
+// fixed, so that the examples print the same proofs on every run.
+// Production code keeps the defaults.
+func newExampleAsh() *ash.Ash {
+	clock := func() time.Time { return time.UnixMilli(1700000000000) }
+	ids := 0
+	a, err := ash.New(ash.NewMemoryStore(ash.MemoryStoreOptions{Now: clock}),
+		ash.WithClock(clock),
+		ash.WithIDGenerator(ash.IDGeneratorFunc(func() (string, error) {
+			ids++
+			return fmt.Sprintf("ctx_example_%d", ids), nil
+		})),
+		ash.WithNonceProvider(ash.NonceProviderFunc(func(opts ash.ContextOptions) (string, error) {
+			return "example-nonce", nil
+		})),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return a
+}
+
+// The full flow: the server issues a context for a binding, the client
+// signs its request with the context's public info, and the server
+// verifies the request, consuming the context.
+func Example() {
+	a := newExampleAsh()
+
+	// Server: issue a context and send its public info to the client.
+	ctx, err := a.IssueContext(ash.ContextOptions{Binding: ash.NormalizeBinding("post", "/api/transfer")})
+	if err != nil {
+		log.Fatal(err)
+	}
+	info := a.PublicInfo(ctx)
+
+	// Client: sign the request.
+	body := `{"to":"alice","amount":10}`
+	req := httptest.NewRequest("POST", "/api/transfer", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if err := ash.SignRequest(req, info, []byte(body)); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(req.Header.Get(ash.HeaderProof))
+
+	// Server: verify it.
+	result, err := a.VerifyRequest(req)
+	fmt.Println(result.Valid, result.Binding, err)
+
+	// The context is single-use.
+	_, err = a.VerifyRequest(req)
+	fmt.Println(err)
+	// Output:
+	// _cyRSf58TFUTa6PMui90Tj_TLHAH4QS8JVi2zeZ9fBg
+	// true POST /api/transfer <nil>
+	// ASH_REPLAY_DETECTED: context already used
+}
+
+// Verify checks a proof outside of HTTP, given the parts of the request it
+// covers.
+func ExampleAsh_Verify() {
+	a := newExampleAsh()
+	ctx, err := a.IssueContext(ash.ContextOptions{Binding: "POST /api/transfer"})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	payload := []byte(`{"amount":10,"to":"alice"}`)
+	canonical, err := ash.CanonicalizePayload(payload, "application/json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	proof := ash.BuildProof(ash.BuildProofInput{
+		Mode:             ctx.Mode,
+		Binding:          ctx.Binding,
+		ContextID:        ctx.ID,
+		Nonce:            ctx.Nonce,
+		CanonicalPayload: canonical,
+	})
+
+	result, err := a.Verify(ctx.ID, proof, "POST /api/transfer", payload, "application/json")
+	fmt.Println(result.Valid, err)
+	// Output:
+	// true <nil>
+}
+
+// A server with an endpoint issuing contexts and a protected route.
+func ExampleAsh_HTTPMiddleware() {
+	a := newExampleAsh()
+	mux := http.NewServeMux()
+	mux.Handle("/ash/context", ash.NewContextHandler(a))
+	mux.Handle("/api/", a.HTTPMiddleware(ash.MiddlewareOptions{
+		Protected: []string{"POST /api/**"},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "transferred")
+	})))
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The client fetches a context for the request it is about to send.
+	rec := serve(httptest.NewRequest("GET", "/ash/context?binding=POST+/api/transfer", nil))
+	var info ash.ContextPublicInfo
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		log.Fatal(err)
+	}
+
+	body := `{"to":"alice","amount":10}`
+	req := httptest.NewRequest("POST", "/api/transfer", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if err := ash.SignRequest(req, info, []byte(body)); err != nil {
+		log.Fatal(err)
+	}
+	rec = serve(req)
+	fmt.Print(rec.Code, " ", rec.Body)
+
+	// An unsigned request to a protected route is rejected.
+	rec = serve(httptest.NewRequest("POST", "/api/transfer", strings.NewReader(body)))
+	fmt.Println(rec.Code)
+	// Output:
+	// 200 transferred
+	// 400
+}
+
+// goRedis stands in for a client library, such as go-redis, adapted to
+// RedisClient.
+type goRedis struct {
+	eval func(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+func (g goRedis) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	return g.eval(ctx, script, keys, args...)
+}
+
+// Instances behind a load balancer share contexts through Redis. Only the
+// store changes; everything built on the instance stays the same.
+func ExampleNewRedisStore() {
+	var client goRedis // adapts a connected client
+	store := ash.NewRedisStore(ash.RedisStoreOptions{
+		Client:    client,
+		KeyPrefix: "{ash}:",
+	})
+	a, err := ash.New(store, ash.WithTTL(30*time.Second))
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.Handle("/ash/context", ash.NewContextHandler(a))
+}
+
+func ExampleNormalizeBinding() {
+	fmt.Println(ash.NormalizeBinding("post", "/api//transfer/"))
+	fmt.Println(ash.NormalizeBinding("GET", "/search?q=ash"))
+	// Output:
+	// POST /api/transfer
+	// GET /search
+}
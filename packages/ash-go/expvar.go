@@ -0,0 +1,139 @@
+package ash
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// DefaultExpvarName is the expvar name used when WithExpvar is given "".
+const DefaultExpvarName = "ash"
+
+// expvarCounters are the counters published through expvar.
+type expvarCounters struct {
+	vars     *expvar.Map
+	issued   *expvar.Int
+	verified *expvar.Int
+	consumed *expvar.Int
+	replayed *expvar.Int
+	failed   *expvar.Int
+	released *expvar.Int
+
+	unprotectedSigned *expvar.Int
+	selfTests         *expvar.Int
+	selfTestFailures  *expvar.Int
+
+	canonicalizationFailures map[CanonicalizationReason]*expvar.Int
+}
+
+// WithExpvar publishes the instance's counters via expvar under name
+// (default: DefaultExpvarName). Each instance needs a distinct name;
+// New fails if the name is already published.
+//
+// The map contains issued, verified, consumed, replayed and failed counts.
+// Dry runs are not counted. verified counts successful verifications and
+// consumed the contexts they consumed, so it leaves out multi-use contexts
+// and accepted duplicates, and counts a DeferConsume reservation once the
+// handler succeeds. It also contains the released count (see
+// ReleaseContext), the unprotectedSigned count of HTTPMiddleware (see
+// UnprotectedWarn), the asyncDropped count (see WithAsyncDelivery), the
+// selfTests and selfTestFailures counts (see SelfTest),
+// canonicalizationFailures.<reason> counts of failed verifications by
+// CanonicalizationReason, the canonicalCacheHits and canonicalCacheMisses
+// counts (see WithCanonicalCache), the verifyWaiting and verifyRejected
+// counts (see WithVerifyConcurrency), plus storeSize when the store has a
+// Size() int method.
+func WithExpvar(name string) Option {
+	return func(a *Ash) {
+		if name == "" {
+			name = DefaultExpvarName
+		}
+		a.expvarName = name
+	}
+}
+
+// expvarMu serializes the check and Publish in publishExpvar, since
+// expvar.Publish panics on a name already published.
+var expvarMu sync.Mutex
+
+// publishExpvar creates and publishes the counters.
+func (a *Ash) publishExpvar() error {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	if expvar.Get(a.expvarName) != nil {
+		return fmt.Errorf("ash: expvar %q already published", a.expvarName)
+	}
+	c := &expvarCounters{
+		vars:     new(expvar.Map).Init(),
+		issued:   new(expvar.Int),
+		verified: new(expvar.Int),
+		consumed: new(expvar.Int),
+		replayed: new(expvar.Int),
+		failed:   new(expvar.Int),
+		released: new(expvar.Int),
+
+		unprotectedSigned: new(expvar.Int),
+		selfTests:         new(expvar.Int),
+		selfTestFailures:  new(expvar.Int),
+
+		canonicalizationFailures: make(map[CanonicalizationReason]*expvar.Int),
+	}
+	c.vars.Set("issued", c.issued)
+	c.vars.Set("verified", c.verified)
+	c.vars.Set("consumed", c.consumed)
+	c.vars.Set("replayed", c.replayed)
+	c.vars.Set("failed", c.failed)
+	c.vars.Set("released", c.released)
+	c.vars.Set("unprotectedSigned", c.unprotectedSigned)
+	c.vars.Set("selfTests", c.selfTests)
+	c.vars.Set("selfTestFailures", c.selfTestFailures)
+	for _, reason := range canonicalizationReasons {
+		n := new(expvar.Int)
+		c.canonicalizationFailures[reason] = n
+		c.vars.Set("canonicalizationFailures."+string(reason), n)
+	}
+	c.vars.Set("asyncDropped", expvar.Func(func() interface{} { return a.AsyncDropped() }))
+	c.vars.Set("canonicalCacheHits", expvar.Func(func() interface{} { return a.CanonicalCacheStats().Hits }))
+	c.vars.Set("canonicalCacheMisses", expvar.Func(func() interface{} { return a.CanonicalCacheStats().Misses }))
+	c.vars.Set("verifyWaiting", expvar.Func(func() interface{} { return a.VerifyLimiterStats().Waiting }))
+	c.vars.Set("verifyRejected", expvar.Func(func() interface{} { return a.VerifyLimiterStats().Rejected }))
+	if sized, ok := storeAs[interface{ Size() int }](a.store); ok {
+		c.vars.Set("storeSize", expvar.Func(func() interface{} { return sized.Size() }))
+	}
+	expvar.Publish(a.expvarName, c.vars)
+	a.counters = c
+	return nil
+}
+
+// recordVerify updates the counters for a verification result.
+func (c *expvarCounters) recordVerify(result *VerifyResult) {
+	switch {
+	case result.Valid:
+		c.verified.Add(1)
+		if !result.ConsumedAt.IsZero() && !result.Duplicate {
+			c.consumed.Add(1)
+		}
+	case result.Code == ErrReplayDetected:
+		c.replayed.Add(1)
+	default:
+		c.failed.Add(1)
+	}
+	if n := c.canonicalizationFailures[result.Reason]; n != nil {
+		n.Add(1)
+	}
+}
+
+// ExpvarHandler returns a handler rendering the instance's expvar counters
+// as JSON, suitable for mounting at e.g. /debug/ash. It responds 404 when
+// WithExpvar is not enabled.
+func (a *Ash) ExpvarHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.counters == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, a.counters.vars.String())
+	})
+}
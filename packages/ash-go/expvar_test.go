@@ -0,0 +1,306 @@
+package ash
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestExpvarCounters tests the expvar counters after simulated traffic.
+func TestExpvarCounters(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithExpvar("ash_test_counters"))
+
+	body := `{"a":1}`
+	for i := 0; i < 3; i++ {
+		ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/test"})
+		proof := clientProof(t, ctx, body, "application/json")
+		a.Verify(ctx.ID, proof, ctx.Binding, []byte(body), "application/json")
+		if i == 0 {
+			a.Verify(ctx.ID, proof, ctx.Binding, []byte(body), "application/json")
+		}
+	}
+	a.Verify("ash_unknown", "proof", "POST /api/test", nil, "")
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	req.Header.Set(HeaderContextID, "ash_unknown")
+	a.HTTPMiddleware(MiddlewareOptions{Protected: []string{"/api/*"}, Unprotected: UnprotectedWarn})(
+		http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), req)
+
+	vars, ok := expvar.Get("ash_test_counters").(*expvar.Map)
+	if !ok {
+		t.Fatal("Expected counters to be published")
+	}
+	expected := map[string]string{
+		"issued":    "3",
+		"verified":  "3",
+		"consumed":  "3",
+		"replayed":  "1",
+		"failed":    "1",
+		"storeSize": "3",
+
+		"unprotectedSigned": "1",
+	}
+	for key, want := range expected {
+		got := vars.Get(key)
+		if got == nil || got.String() != want {
+			t.Errorf("Expected %s=%s, got %v", key, want, got)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	a.ExpvarHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/ash", nil))
+	var rendered map[string]int
+	if err := json.Unmarshal(rec.Body.Bytes(), &rendered); err != nil {
+		t.Fatalf("Handler output is not JSON: %v: %s", err, rec.Body)
+	}
+	if rendered["issued"] != 3 || rendered["replayed"] != 1 {
+		t.Errorf("Unexpected handler output: %v", rendered)
+	}
+}
+
+// TestExpvarConsumed tests that only verifications that consumed their
+// context count as consumed.
+func TestExpvarConsumed(t *testing.T) {
+	withTestModes(t)
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithExpvar("ash_test_consumed"), WithDuplicateWindow(time.Minute))
+	body := `{"a":1}`
+	verify := func(ctx *Context, opts ...VerifyOption) {
+		t.Helper()
+		if _, err := a.Verify(ctx.ID, clientProof(t, ctx, body, "application/json"), ctx.Binding, []byte(body), "application/json", opts...); err != nil {
+			t.Fatalf("Verify failed: %v", err)
+		}
+	}
+
+	// A multi-use context verifies repeatedly without being consumed.
+	multi, _ := a.IssueContext(ContextOptions{Binding: "POST /api/test", Mode: "test-multi-use"})
+	verify(multi)
+	verify(multi)
+	// A duplicate counts once, when its original consumed the context.
+	single, _ := a.IssueContext(ContextOptions{Binding: "POST /api/test"})
+	verify(single)
+	verify(single)
+	// A dry run is not counted at all.
+	dry, _ := a.IssueContext(ContextOptions{Binding: "POST /api/test"})
+	verify(dry, WithDryRun())
+	// A reservation counts once the handler succeeds.
+	handler := a.HTTPMiddleware(MiddlewareOptions{DeferConsume: true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	for _, path := range []string{"/api/ok", "/api/fail"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, signedRequest(t, a, "POST", path, body, "application/json"))
+	}
+
+	vars := expvar.Get("ash_test_consumed").(*expvar.Map)
+	for key, want := range map[string]string{"verified": "6", "consumed": "2", "failed": "0"} {
+		if got := vars.Get(key).String(); got != want {
+			t.Errorf("%s = %s, want %s", key, got, want)
+		}
+	}
+}
+
+// TestExpvarNameCollision tests that two instances cannot share a name.
+func TestExpvarNameCollision(t *testing.T) {
+	store := NewMemoryStore(MemoryStoreOptions{})
+	if _, err := New(store, WithExpvar("ash_test_collision")); err != nil {
+		t.Fatalf("First instance failed: %v", err)
+	}
+	if _, err := New(store, WithExpvar("ash_test_collision")); err == nil {
+		t.Error("Expected error for duplicate expvar name")
+	}
+}
+
+// TestExpvarNameCollisionConcurrent tests that instances created at once
+// with one name get an error rather than a panic.
+func TestExpvarNameCollisionConcurrent(t *testing.T) {
+	store := NewMemoryStore(MemoryStoreOptions{})
+	const n = 8
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := New(store, WithExpvar("ash_test_collision_concurrent"))
+			errs <- err
+		}()
+	}
+	published := 0
+	for i := 0; i < n; i++ {
+		if <-errs == nil {
+			published++
+		}
+	}
+	if published != 1 {
+		t.Errorf("Expected one instance to publish, got %d", published)
+	}
+}
+
+// TestExpvarDisabled tests that counters are not published by default.
+func TestExpvarDisabled(t *testing.T) {
+	a, _ := newTestAsh(t, time.Now())
+	if a.counters != nil {
+		t.Error("Expected no counters without WithExpvar")
+	}
+	rec := httptest.NewRecorder()
+	a.ExpvarHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/ash", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", rec.Code)
+	}
+}
+
+// TestHooks tests that hooks fire at issuance and verification.
+func TestHooks(t *testing.T) {
+	var issued []*Context
+	var results []*VerifyResult
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithHooks(Hooks{
+		OnIssue:  func(ctx *Context) { issued = append(issued, ctx) },
+		OnVerify: func(result *VerifyResult) { results = append(results, result) },
+	}))
+
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/test"})
+	a.Verify(ctx.ID, clientProof(t, ctx, "", ""), ctx.Binding, nil, "")
+
+	if len(issued) != 1 || issued[0].ID != ctx.ID {
+		t.Errorf("Expected OnIssue for %s, got %v", ctx.ID, issued)
+	}
+	if len(results) != 1 || !results[0].Valid {
+		t.Errorf("Expected one valid OnVerify result, got %v", results)
+	}
+}
+
+// TestOnIssueNotify tests that the issuance notification receives the
+// public info of each issued context and that its failures, and with async
+// delivery its delays, do not affect issuance.
+func TestOnIssueNotify(t *testing.T) {
+	var logs bytes.Buffer
+	var notified []ContextPublicInfo
+	fail := errors.New("channel closed")
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+		WithHooks(Hooks{OnIssueNotify: func(info ContextPublicInfo) error {
+			notified = append(notified, info)
+			switch len(notified) {
+			case 2:
+				return fail
+			case 3:
+				panic("socket gone")
+			}
+			return nil
+		}}))
+
+	for i := 0; i < 3; i++ {
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/test", Mode: ModeStrict, Metadata: map[string]interface{}{"userId": "u1"}})
+		if err != nil {
+			t.Fatalf("IssueContext %d failed: %v", i, err)
+		}
+		if len(notified) != i+1 || !reflect.DeepEqual(notified[i], ctx.PublicInfo()) {
+			t.Errorf("Notified %+v, want %+v", notified, ctx.PublicInfo())
+		}
+	}
+	if !strings.Contains(logs.String(), "channel closed") || !strings.Contains(logs.String(), "socket gone") {
+		t.Errorf("Expected the failures to be logged, got %q", logs.String())
+	}
+
+	// With async delivery a blocked callback does not hold up issuance.
+	release := make(chan struct{})
+	received := make(chan ContextPublicInfo, 1)
+	a, _ = newTestAsh(t, time.UnixMilli(1700000000000), WithAsyncDelivery(AsyncOptions{}),
+		WithHooks(Hooks{OnIssueNotify: func(info ContextPublicInfo) error {
+			<-release
+			received <- info
+			return nil
+		}}))
+	ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/test"})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	close(release)
+	if info := <-received; info.ContextID != ctx.ID {
+		t.Errorf("Notified %s, want %s", info.ContextID, ctx.ID)
+	}
+	a.Close(context.Background())
+}
+
+// TestCanonicalizationFailureHook tests that each rejection by the
+// canonicalizer reaches the hook and counters with its reason.
+func TestCanonicalizationFailureHook(t *testing.T) {
+	type failure struct {
+		reason CanonicalizationReason
+		result *VerifyResult
+	}
+	var failures []failure
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000),
+		WithExpvar("ash_test_canonicalization"),
+		WithJSONStrictness(JSONStrictness{RequireTopLevelObject: true}),
+		WithHooks(Hooks{OnCanonicalizationFailure: func(reason CanonicalizationReason, result *VerifyResult) {
+			failures = append(failures, failure{reason, result})
+		}}))
+
+	tests := []struct {
+		body, contentType string
+		want              CanonicalizationReason
+	}{
+		{`{"a":`, "application/json", ReasonInvalidJSON},
+		{`{"a":` + strings.Repeat("[", 10001) + strings.Repeat("]", 10001) + `}`, "application/json", ReasonDepthExceeded},
+		{`{"a":1e400}`, "application/json", ReasonInfinity},
+		{`[1]`, "application/json", ReasonNotObject},
+		{`{"a":1} {}`, "application/json", ReasonTrailingData},
+		{"a=%zz", "application/x-www-form-urlencoded", ReasonInvalidURLEncoding},
+	}
+	for _, tt := range tests {
+		for _, stream := range []bool{false, true} {
+			failures = nil
+			ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/test"})
+			proof := BuildProof(BuildProofInput{Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID})
+			var result *VerifyResult
+			if stream {
+				result, _ = a.VerifyStream(ctx.ID, proof, ctx.Binding, strings.NewReader(tt.body), tt.contentType)
+			} else {
+				result, _ = a.Verify(ctx.ID, proof, ctx.Binding, []byte(tt.body), tt.contentType)
+			}
+			if result.Reason != tt.want {
+				t.Errorf("%.20q (stream %v): Reason = %q, want %q", tt.body, stream, result.Reason, tt.want)
+			}
+			if len(failures) != 1 || failures[0].reason != tt.want || failures[0].result.ContextID != ctx.ID {
+				t.Errorf("%.20q (stream %v): hook calls = %+v", tt.body, stream, failures)
+			}
+		}
+		if got := expvar.Get("ash_test_canonicalization").(*expvar.Map).Get("canonicalizationFailures." + string(tt.want)); got.String() != "2" {
+			t.Errorf("canonicalizationFailures.%s = %v, want 2", tt.want, got)
+		}
+	}
+
+	// Other failures do not fire the hook.
+	failures = nil
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/test"})
+	if result, _ := a.Verify(ctx.ID, strings.Repeat("A", 43), ctx.Binding, []byte(`{}`), "application/json"); result.Reason != "" || len(failures) != 0 {
+		t.Errorf("Proof mismatch: Reason = %q, hook calls = %+v", result.Reason, failures)
+	}
+
+	// Go values reach reasons that JSON text cannot.
+	for _, tt := range []struct {
+		value interface{}
+		want  CanonicalizationReason
+	}{
+		{map[string]interface{}{"a": math.NaN()}, ReasonNaN},
+		{[]interface{}{math.Inf(-1)}, ReasonInfinity},
+		{json.Number("abc"), ReasonInvalidNumber},
+		{map[string]interface{}{"a": struct{}{}}, ReasonUnsupportedType},
+	} {
+		_, err := CanonicalizeJSON(tt.value)
+		var ashErr *AshError
+		if !errors.As(err, &ashErr) || ashErr.Reason != tt.want {
+			t.Errorf("CanonicalizeJSON(%v) = %v, want reason %q", tt.value, err, tt.want)
+		}
+	}
+}
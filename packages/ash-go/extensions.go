@@ -0,0 +1,120 @@
+package ash
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// extensionPrefix starts each extension line in the proof preamble.
+const extensionPrefix = "ext:"
+
+// KV is a key-value pair bound into the proof as an extension.
+type KV struct {
+	Key   string
+	Value string
+}
+
+// validateExtensions checks that extensions serialize unambiguously: keys
+// are non-empty, unique and free of '=', and neither keys nor values
+// contain line breaks.
+func validateExtensions(exts []KV) error {
+	seen := make(map[string]bool, len(exts))
+	for _, ext := range exts {
+		if ext.Key == "" || strings.ContainsAny(ext.Key, "=\r\n") {
+			return NewAshError(ErrMalformedRequest, "invalid extension key: "+ext.Key)
+		}
+		if strings.ContainsAny(ext.Value, "\r\n") {
+			return NewAshError(ErrMalformedRequest, "invalid extension value for key: "+ext.Key)
+		}
+		if seen[ext.Key] {
+			return NewAshError(ErrMalformedRequest, "duplicate extension key: "+ext.Key)
+		}
+		seen[ext.Key] = true
+	}
+	return nil
+}
+
+// writeExtensions writes the extension lines of the proof preamble in
+// ascending key order.
+func writeExtensions(sb *strings.Builder, exts []KV) {
+	if len(exts) == 0 {
+		return
+	}
+	sorted := append([]KV(nil), exts...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	for _, ext := range sorted {
+		sb.WriteString(extensionPrefix)
+		sb.WriteString(ext.Key)
+		sb.WriteByte('=')
+		sb.WriteString(ext.Value)
+		sb.WriteByte('\n')
+	}
+}
+
+// formatExtensionsHeader encodes exts for HeaderExtensions in ascending
+// key order. The reserved decimal strings marker is left out, since the
+// server derives it from the context.
+func formatExtensionsHeader(exts []KV) string {
+	sorted := make([]KV, 0, len(exts))
+	for _, ext := range exts {
+		if ext.Key != decimalStringsKey {
+			sorted = append(sorted, ext)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	var sb strings.Builder
+	for i, ext := range sorted {
+		if i > 0 {
+			sb.WriteByte('&')
+		}
+		sb.WriteString(url.QueryEscape(ext.Key))
+		sb.WriteByte('=')
+		sb.WriteString(url.QueryEscape(ext.Value))
+	}
+	return sb.String()
+}
+
+// parseExtensionsHeader decodes a HeaderExtensions value. Every pair must
+// have a key, an '=' and valid escapes; the extensions themselves are
+// validated by verification.
+func parseExtensionsHeader(header string) ([]KV, *AshError) {
+	if header == "" {
+		return nil, nil
+	}
+	var exts []KV
+	for _, pair := range strings.Split(header, "&") {
+		rawKey, rawValue, ok := strings.Cut(pair, "=")
+		key, keyErr := url.QueryUnescape(rawKey)
+		value, valueErr := url.QueryUnescape(rawValue)
+		if !ok || key == "" || keyErr != nil || valueErr != nil {
+			return nil, errInvalidExtensionsHeader
+		}
+		exts = append(exts, KV{Key: key, Value: value})
+	}
+	return exts, nil
+}
+
+// errInvalidExtensionsHeader is the error for a malformed HeaderExtensions.
+var errInvalidExtensionsHeader = NewAshError(ErrMalformedRequest, "invalid "+headerExtensions+" header")
+
+// missingExtension returns the first required key not present in exts.
+func missingExtension(required []string, exts []KV) (string, bool) {
+	for _, key := range required {
+		found := false
+		for _, ext := range exts {
+			if ext.Key == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return key, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,202 @@
+package ash
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBuildProofExtensionVectors tests proofs with extensions against
+// fixed vectors.
+func TestBuildProofExtensionVectors(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    BuildProofInput
+		expected string
+	}{
+		{
+			name: "no extensions",
+			input: BuildProofInput{
+				Mode: ModeBalanced, Binding: "POST /api/orders", ContextID: "ash_vector",
+				CanonicalPayload: `{"a":1}`,
+			},
+			expected: "ghanlZ9ZsFQ92ozR_f-BlIVC_TtE8RAm2hF5RR3koxc",
+		},
+		{
+			name: "extensions sorted by key",
+			input: BuildProofInput{
+				Mode: ModeBalanced, Binding: "POST /api/orders", ContextID: "ash_vector",
+				Extensions:       []KV{{"tenant", "acme"}, {"region", "eu"}},
+				CanonicalPayload: `{"a":1}`,
+			},
+			expected: "GFsmSv6wgxtiXg8NH6htZs_28KAwcG55fiTxtPhJKT0",
+		},
+		{
+			name: "extensions after nonce",
+			input: BuildProofInput{
+				Mode: ModeStrict, Binding: "POST /api/orders", ContextID: "ash_vector",
+				Nonce:            "n0nce",
+				Extensions:       []KV{{"tenant", "acme"}},
+				CanonicalPayload: `{"a":1}`,
+			},
+			expected: "3oX472A6zoIdwFx_3qVTb_G3FkjCUjJgAFidRwUdC40",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proof, err := BuildProofChecked(tt.input)
+			if err != nil {
+				t.Fatalf("BuildProofChecked failed: %v", err)
+			}
+			if proof != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, proof)
+			}
+		})
+	}
+}
+
+// TestBuildProofExtensionOrderIndependent tests that extension order does
+// not change the proof.
+func TestBuildProofExtensionOrderIndependent(t *testing.T) {
+	input := BuildProofInput{
+		Mode: ModeBalanced, Binding: "POST /api/orders", ContextID: "ash_vector",
+		Extensions: []KV{{"a", "1"}, {"b", "2"}, {"c", "3"}},
+	}
+	reversed := input
+	reversed.Extensions = []KV{{"c", "3"}, {"b", "2"}, {"a", "1"}}
+
+	if BuildProof(input) != BuildProof(reversed) {
+		t.Error("Extension order changed the proof")
+	}
+	if input.Extensions[0].Key != "a" || reversed.Extensions[0].Key != "c" {
+		t.Error("BuildProof reordered the caller's extensions")
+	}
+}
+
+// TestBuildProofCheckedRejectsAmbiguousExtensions tests extension validation.
+func TestBuildProofCheckedRejectsAmbiguousExtensions(t *testing.T) {
+	tests := []struct {
+		name string
+		exts []KV
+	}{
+		{"empty key", []KV{{"", "v"}}},
+		{"key with equals", []KV{{"a=b", "v"}}},
+		{"key with newline", []KV{{"a\nb", "v"}}},
+		{"value with newline", []KV{{"tenant", "acme\next:admin=true"}}},
+		{"value with carriage return", []KV{{"tenant", "acme\r"}}},
+		{"duplicate key", []KV{{"tenant", "a"}, {"tenant", "b"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := BuildProofChecked(BuildProofInput{
+				Mode: ModeBalanced, Binding: "POST /api/orders", ContextID: "ash_vector",
+				Extensions: tt.exts,
+			})
+			var ashErr *AshError
+			if !errors.As(err, &ashErr) || ashErr.Code != ErrMalformedRequest {
+				t.Errorf("Expected ErrMalformedRequest, got %v", err)
+			}
+		})
+	}
+}
+
+// TestVerifyRequiredExtensions tests per-binding required extensions.
+func TestVerifyRequiredExtensions(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000),
+		WithBindingPolicy("POST /api/orders", BindingPolicy{RequiredExtensions: []string{"tenant"}}))
+
+	sign := func(ctx *Context, exts []KV) string {
+		return BuildProof(BuildProofInput{
+			Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, Nonce: ctx.Nonce,
+			Extensions: exts, CanonicalPayload: `{"a":1}`,
+		})
+	}
+	body := []byte(`{"a":1}`)
+	tenant := KV{"tenant", "acme"}
+
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/orders"})
+	if _, err := a.Verify(ctx.ID, sign(ctx, []KV{tenant}), ctx.Binding, body, "application/json", WithExtensions(tenant)); err != nil {
+		t.Errorf("Verify with required extension failed: %v", err)
+	}
+
+	missing, _ := a.IssueContext(ContextOptions{Binding: "POST /api/orders"})
+	_, err := a.Verify(missing.ID, sign(missing, nil), missing.Binding, body, "application/json")
+	var ashErr *AshError
+	if !errors.As(err, &ashErr) || ashErr.Message != "missing required extension: tenant" {
+		t.Errorf("Expected missing extension error, got %v", err)
+	}
+
+	// A different extension value than the one signed fails the proof.
+	other, _ := a.IssueContext(ContextOptions{Binding: "POST /api/orders"})
+	_, err = a.Verify(other.ID, sign(other, []KV{tenant}), other.Binding, body, "application/json", WithExtensions(KV{"tenant", "globex"}))
+	if !errors.As(err, &ashErr) || ashErr.Code != ErrIntegrityFailed {
+		t.Errorf("Expected ErrIntegrityFailed, got %v", err)
+	}
+
+	// Bindings without a policy accept requests without extensions.
+	free, _ := a.IssueContext(ContextOptions{Binding: "POST /api/other"})
+	if _, err := a.Verify(free.ID, sign(free, nil), free.Binding, body, "application/json"); err != nil {
+		t.Errorf("Verify without policy failed: %v", err)
+	}
+}
+
+// TestExtensionsHeader tests that the middleware verifies the proof over
+// the extensions in HeaderExtensions.
+func TestExtensionsHeader(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000),
+		WithBindingPolicy("POST /api/orders", BindingPolicy{RequiredExtensions: []string{"tenant"}}))
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		name   string
+		header func(string) string
+		code   AshErrorCode
+	}{
+		{name: "as signed", header: func(h string) string { return h }},
+		{name: "changed value", header: func(string) string { return "tenant=globex" }, code: ErrIntegrityFailed},
+		{name: "added extension", header: func(h string) string { return h + "&region=eu" }, code: ErrIntegrityFailed},
+		{name: "removed", header: func(string) string { return "" }, code: ErrMalformedRequest},
+		{name: "no value", header: func(string) string { return "tenant" }, code: ErrMalformedRequest},
+		{name: "bad escape", header: func(string) string { return "tenant=%zz" }, code: ErrMalformedRequest},
+		{name: "duplicate key", header: func(h string) string { return h + "&tenant=acme" }, code: ErrMalformedRequest},
+		{name: "reserved key", header: func(h string) string { return h + "&" + decimalStringsKey + "=%5B%5D" }, code: ErrMalformedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/orders"})
+			if err != nil {
+				t.Fatalf("IssueContext failed: %v", err)
+			}
+			req := httptest.NewRequest("POST", "/api/orders", strings.NewReader(`{"a":1}`))
+			req.Header.Set("Content-Type", "application/json")
+			if err := SignRequest(req, ctx.PublicInfo(), []byte(`{"a":1}`), SignExtensions(KV{"tenant", "acme"})); err != nil {
+				t.Fatalf("SignRequest failed: %v", err)
+			}
+			if got := req.Header.Get(HeaderExtensions); got != "tenant=acme" {
+				t.Fatalf("%s = %q, want %q", HeaderExtensions, got, "tenant=acme")
+			}
+			if h := tt.header(req.Header.Get(HeaderExtensions)); h != "" {
+				req.Header.Set(HeaderExtensions, h)
+			} else {
+				req.Header.Del(HeaderExtensions)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if tt.code == "" {
+				if rec.Code != http.StatusNoContent {
+					t.Errorf("Status = %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+				}
+				return
+			}
+			if got := decodeError(t, rec); got.Code != tt.code {
+				t.Errorf("Code = %s, want %s", got.Code, tt.code)
+			}
+		})
+	}
+}
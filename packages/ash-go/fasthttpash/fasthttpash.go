@@ -0,0 +1,58 @@
+// Package fasthttpash verifies ASH requests served by fasthttp.
+//
+// It lives in its own module so the core ash-go module does not depend on
+// fasthttp.
+package fasthttpash
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+
+	ash "github.com/3maem/ash-go"
+	"github.com/valyala/fasthttp"
+)
+
+// VerifyFastHTTP verifies a fasthttp request, consuming its context on
+// success.
+//
+// The request is converted to an *http.Request and verified with
+// a.VerifyRequest, so its session salt, tenant, context token and
+// duplicate ASH headers are handled as HTTPMiddleware handles them. The
+// binding is built from ctx.Method() and ctx.Path(), and ctx.PostBody() is
+// the payload. Body size limits are enforced by the fasthttp server
+// (Server.MaxRequestBodySize) as well as by a.
+func VerifyFastHTTP(ctx *fasthttp.RequestCtx, a *ash.Ash) (*ash.VerifyResult, error) {
+	return a.VerifyRequest(httpRequest(ctx))
+}
+
+// httpRequest converts ctx to an *http.Request. Unlike
+// fasthttpadaptor.ConvertRequest it copies every value, since fasthttp
+// reuses its buffers once the handler returns, and it keeps repeated
+// headers.
+func httpRequest(ctx *fasthttp.RequestCtx) *http.Request {
+	header := make(http.Header)
+	ctx.Request.Header.VisitAll(func(k, v []byte) {
+		header.Add(string(k), string(v))
+	})
+	header.Del("Host")
+	r := (&http.Request{
+		Method:     string(ctx.Method()),
+		URL:        &url.URL{Path: string(ctx.Path()), RawQuery: string(ctx.QueryArgs().QueryString())},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Host:       string(ctx.Host()),
+		RemoteAddr: ctx.RemoteAddr().String(),
+		RequestURI: string(ctx.RequestURI()),
+	}).WithContext(ctx)
+	if body := ctx.PostBody(); len(body) > 0 {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	} else {
+		r.Body = http.NoBody
+	}
+	return r
+}
@@ -0,0 +1,139 @@
+package fasthttpash
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+
+	ash "github.com/3maem/ash-go"
+	"github.com/valyala/fasthttp"
+)
+
+// newRequestCtx builds a RequestCtx carrying a proof for body.
+func newRequestCtx(t *testing.T, a *ash.Ash, method, uri, body string) *fasthttp.RequestCtx {
+	t.Helper()
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBodyString(body)
+
+	issued, err := a.IssueContext(ash.ContextOptions{
+		Binding: ash.NormalizeBinding(method, string(ctx.Path())),
+	})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	canonical, err := ash.ParseJSON(body)
+	if err != nil {
+		t.Fatalf("ParseJSON failed: %v", err)
+	}
+	ctx.Request.Header.Set(ash.HeaderContextID, issued.ID)
+	ctx.Request.Header.Set(ash.HeaderProof, ash.BuildProof(ash.BuildProofInput{
+		Mode:             issued.Mode,
+		Binding:          issued.Binding,
+		ContextID:        issued.ID,
+		Nonce:            issued.Nonce,
+		CanonicalPayload: canonical,
+	}))
+	return &ctx
+}
+
+// TestVerifyFastHTTP tests verification of a fasthttp request.
+func TestVerifyFastHTTP(t *testing.T) {
+	a, err := ash.New(ash.NewMemoryStore(ash.MemoryStoreOptions{}))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	ctx := newRequestCtx(t, a, "POST", "/api//transfer/?ref=1", `{"amount": 100}`)
+	result, err := VerifyFastHTTP(ctx, a)
+	if err != nil {
+		t.Fatalf("VerifyFastHTTP failed: %v", err)
+	}
+	if !result.Valid || result.Binding != "POST /api/transfer" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	// The context is consumed, so a replay is rejected.
+	_, err = VerifyFastHTTP(ctx, a)
+	var ashErr *ash.AshError
+	if !errors.As(err, &ashErr) || ashErr.Code != ash.ErrReplayDetected {
+		t.Errorf("Expected ErrReplayDetected, got %v", err)
+	}
+
+	// A tampered body fails the proof.
+	tampered := newRequestCtx(t, a, "POST", "/api/transfer", `{"amount": 100}`)
+	tampered.Request.SetBodyString(`{"amount": 1000000}`)
+	if _, err := VerifyFastHTTP(tampered, a); !errors.As(err, &ashErr) || ashErr.Code != ash.ErrIntegrityFailed {
+		t.Errorf("Expected ErrIntegrityFailed, got %v", err)
+	}
+}
+
+// TestVerifyFastHTTPRequestData tests that requests are verified with
+// their session and tenant, and that repeated ASH headers are rejected.
+func TestVerifyFastHTTPRequestData(t *testing.T) {
+	a, err := ash.New(ash.NewMemoryStore(ash.MemoryStoreOptions{}),
+		ash.WithTenantFunc(func(r *http.Request) string { return r.Header.Get("X-Tenant") }),
+		ash.WithSessionSaltFunc(func(r *http.Request) []byte {
+			if c, err := r.Cookie("session"); err == nil {
+				return []byte("salt-of-" + c.Value)
+			}
+			return nil
+		}))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	body := []byte(`{"amount":100}`)
+	signed := func(opts ash.ContextOptions, signOpts ...ash.SignOption) *fasthttp.RequestCtx {
+		t.Helper()
+		opts.Binding = "POST /api/transfer"
+		issued, err := a.IssueContext(opts)
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		req, _ := http.NewRequest("POST", "/api/transfer", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if err := ash.SignRequest(req, a.PublicInfo(issued), body, signOpts...); err != nil {
+			t.Fatalf("SignRequest failed: %v", err)
+		}
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/api/transfer")
+		ctx.Request.SetBody(body)
+		for k := range req.Header {
+			ctx.Request.Header.Set(k, req.Header.Get(k))
+		}
+		return &ctx
+	}
+
+	tests := []struct {
+		name   string
+		ctx    *fasthttp.RequestCtx
+		header [2]string
+		code   ash.AshErrorCode
+	}{
+		{"issuing session", signed(ash.ContextOptions{SessionSalt: []byte("salt-of-alice")}), [2]string{"Cookie", "session=alice"}, ""},
+		{"other session", signed(ash.ContextOptions{SessionSalt: []byte("salt-of-alice")}), [2]string{"Cookie", "session=bob"}, ash.ErrIntegrityFailed},
+		{"tenant", signed(ash.ContextOptions{Tenant: "acme"}, ash.SignTenant("acme")), [2]string{"X-Tenant", "acme"}, ""},
+		{"other tenant", signed(ash.ContextOptions{Tenant: "acme"}, ash.SignTenant("acme")), [2]string{"X-Tenant", "globex"}, ash.ErrTenantMismatch},
+		{"duplicate header", signed(ash.ContextOptions{}), [2]string{ash.HeaderProof, "forged"}, ash.ErrMalformedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.ctx.Request.Header.Add(tt.header[0], tt.header[1])
+			result, err := VerifyFastHTTP(tt.ctx, a)
+			if tt.code == "" {
+				if err != nil || !result.Valid {
+					t.Errorf("VerifyFastHTTP failed: %v", err)
+				}
+				return
+			}
+			var ashErr *ash.AshError
+			if !errors.As(err, &ashErr) || ashErr.Code != tt.code {
+				t.Errorf("Expected %s, got %v", tt.code, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+module github.com/3maem/ash-go/fasthttpash
+
+go 1.21
+
+require (
+	github.com/3maem/ash-go v0.0.0
+	github.com/valyala/fasthttp v1.51.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.0.5 // indirect
+	github.com/klauspost/compress v1.17.0 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
+
+replace github.com/3maem/ash-go => ../
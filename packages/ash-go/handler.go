@@ -0,0 +1,263 @@
+package ash
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContextHandler issues contexts over HTTP.
+//
+// The binding is read from the "binding" query parameter ("METHOD /path")
+// and the mode from the optional "mode" query parameter, which may only
+// ask for a mode at least as strict as the instance mode (see WithMode).
+// The client may request a TTL in milliseconds with the optional "ttlMs"
+// query parameter, or the "ttlMs" member of a JSON request body; it is
+// clamped to MinTTL and MaxTTL and to the range of the context's mode. The
+// response body is the ContextPublicInfo of the issued context, whose
+// expiresAt reflects the TTL applied.
+type ContextHandler struct {
+	ash *Ash
+
+	// Metadata, if set, returns the server-side metadata to attach to the
+	// context issued for r, such as the user ID.
+	Metadata func(r *http.Request) map[string]interface{}
+	// PublicMetadata lists the metadata keys returned to the client in the
+	// "meta" field of the response. All other keys stay server-side.
+	PublicMetadata []string
+	// MinTTL and MaxTTL bound the TTL a client may request. MaxTTL
+	// defaults to the instance TTL (see WithTTL), so without it clients
+	// can only shorten the lifetime of their contexts.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// AllowBindingPatterns lets clients request contexts for binding
+	// patterns and templates, such as "POST /api/*", as needed with
+	// MiddlewareOptions.RoutePattern. Such a context verifies for every
+	// request its binding matches, so by default they are rejected with
+	// ErrMalformedRequest and only concrete bindings are issued.
+	AllowBindingPatterns bool
+}
+
+// NewContextHandler creates a handler that issues contexts from a.
+func NewContextHandler(a *Ash) *ContextHandler {
+	return &ContextHandler{ash: a}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *ContextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		h.ash.writeError(w, http.StatusMethodNotAllowed, NewAshError(ErrMalformedRequest, "method not allowed"))
+		return
+	}
+
+	query := r.URL.Query()
+	binding, ashErr := clientBinding(query.Get("binding"), h.AllowBindingPatterns)
+	if ashErr != nil {
+		h.ash.writeError(w, http.StatusBadRequest, ashErr)
+		return
+	}
+
+	ttl, ashErr := requestedTTL(r)
+	if ashErr != nil {
+		h.ash.writeError(w, http.StatusBadRequest, ashErr)
+		return
+	}
+	mode, ashErr := h.ash.clientMode(query.Get("mode"))
+	if ashErr != nil {
+		h.ash.writeError(w, http.StatusBadRequest, ashErr)
+		return
+	}
+
+	var metadata map[string]interface{}
+	if h.Metadata != nil {
+		metadata = h.Metadata(r)
+	}
+	ctx, status, ashErr := h.ash.issueForClient(ContextOptions{
+		Binding:  binding,
+		Mode:     mode,
+		TTL:      h.clampTTL(ttl, mode),
+		Metadata: metadata,
+		Tenant:   h.ash.tenantFor(r),
+
+		SessionSalt: h.ash.sessionSaltFor(r),
+	})
+	if ashErr != nil {
+		h.ash.writeError(w, status, ashErr)
+		return
+	}
+
+	info := h.ash.PublicInfo(ctx)
+	info.Meta = publicMetadata(ctx.Metadata, h.PublicMetadata)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(info)
+}
+
+// maxTTLRequestBytes bounds the JSON request body read for "ttlMs".
+const maxTTLRequestBytes = 4 << 10
+
+var errInvalidTTLRequest = NewAshError(ErrMalformedRequest, "ttlMs must be a positive integer")
+
+// requestedTTL returns the TTL requested with the "ttlMs" query parameter
+// or JSON body member, or 0 if none was. Only the first
+// maxTTLRequestBytes of the body are looked at, a body that is not a JSON
+// object is ignored, and the body is left readable for
+// ContextHandler.Metadata.
+func requestedTTL(r *http.Request) (time.Duration, *AshError) {
+	raw := r.URL.Query().Get("ttlMs")
+	if raw == "" && r.Method == http.MethodPost && r.Body != nil {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			data, _ := io.ReadAll(io.LimitReader(r.Body, maxTTLRequestBytes))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+			var body struct {
+				TTLMs json.RawMessage `json:"ttlMs"`
+			}
+			if json.Unmarshal(data, &body) == nil && body.TTLMs != nil {
+				if raw = string(body.TTLMs); raw == "null" {
+					raw = ""
+				}
+			}
+		}
+	}
+	if raw == "" {
+		return 0, nil
+	}
+	ms, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, errInvalidTTLRequest
+	}
+	// Larger requests are clamped anyway; keep the conversion in range.
+	return time.Duration(min(ms, math.MaxInt64/int64(time.Millisecond))) * time.Millisecond, nil
+}
+
+// clampTTL clamps a TTL requested by the client to the handler's bounds and
+// the range of mode, or the instance's default mode if it is empty. It
+// returns 0, for the instance TTL, if none was requested.
+func (h *ContextHandler) clampTTL(ttl time.Duration, mode AshMode) time.Duration {
+	if ttl == 0 {
+		return 0
+	}
+	maxTTL := h.MaxTTL
+	if maxTTL == 0 {
+		maxTTL = h.ash.ttl
+	}
+	ttl = min(max(ttl, h.MinTTL), maxTTL)
+	if mode == "" {
+		mode = h.ash.mode
+	}
+	if req, ok := mode.Requirements(); ok {
+		if req.MinTTL > 0 {
+			ttl = max(ttl, req.MinTTL)
+		}
+		if req.MaxTTL > 0 {
+			ttl = min(ttl, req.MaxTTL)
+		}
+	}
+	return ttl
+}
+
+// publicMetadata returns the allowed keys of metadata, or nil if none are
+// present.
+func publicMetadata(metadata map[string]interface{}, allowed []string) map[string]interface{} {
+	var meta map[string]interface{}
+	for _, key := range allowed {
+		if v, ok := metadata[key]; ok {
+			if meta == nil {
+				meta = make(map[string]interface{}, len(allowed))
+			}
+			meta[key] = v
+		}
+	}
+	return meta
+}
+
+// issueForClient issues a context to be handed to a client. On failure it
+// returns the HTTP status and the error to respond with.
+func (a *Ash) issueForClient(opts ContextOptions) (*Context, int, *AshError) {
+	binding := opts.Binding
+	ctx, err := a.IssueContext(opts)
+	if err != nil {
+		var ashErr *AshError
+		if errors.As(err, &ashErr) {
+			status := http.StatusBadRequest
+			if ashErr.Code == ErrRateLimited {
+				status = http.StatusTooManyRequests
+			}
+			return nil, status, ashErr
+		}
+		a.logger.Error("ash: context issuance failed", "binding", binding, "error", err)
+		return nil, http.StatusInternalServerError, NewAshError(ErrInternalError, "context issuance failed")
+	}
+
+	// Never hand out a context the client cannot use.
+	if now := a.now(); ctx.expired(now) {
+		a.logger.Error("ash: issued context would be expired",
+			"contextId", ctx.ID, "binding", binding, "expiresAt", ctx.ExpiresAt, "now", now.UnixMilli())
+		return nil, http.StatusInternalServerError, NewAshError(ErrInternalError, "issued context would be expired")
+	}
+	return ctx, http.StatusOK, nil
+}
+
+// parseBinding normalizes a "METHOD /path" binding string.
+func parseBinding(binding string) (string, bool) {
+	method, path, ok := strings.Cut(strings.TrimSpace(binding), " ")
+	if !ok || method == "" || path == "" {
+		return "", false
+	}
+	return NormalizeBinding(method, strings.TrimSpace(path)), true
+}
+
+var (
+	errInvalidClientBinding = NewAshError(ErrMalformedRequest, "binding must be \"METHOD /path\"")
+	errClientBindingPattern = NewAshError(ErrMalformedRequest, "binding must be a concrete \"METHOD /path\", not a pattern or template")
+)
+
+// clientBinding parses the binding a client requests a context for,
+// rejecting patterns and templates unless allowPatterns is set.
+func clientBinding(raw string, allowPatterns bool) (string, *AshError) {
+	binding, ok := parseBinding(raw)
+	if !ok {
+		return "", errInvalidClientBinding
+	}
+	if !allowPatterns && (IsBindingPattern(binding) || IsBindingTemplate(binding)) {
+		return "", errClientBindingPattern
+	}
+	return binding, nil
+}
+
+// clientMode returns the mode a client requests a context in, or "" for
+// the instance mode. The instance mode is a floor: a client may ask for a
+// stricter mode, but a weaker one fails with ErrModeViolation.
+func (a *Ash) clientMode(raw string) (AshMode, *AshError) {
+	mode := AshMode(raw)
+	if mode != "" && !mode.atLeast(a.mode) {
+		return "", NewAshError(ErrModeViolation, fmt.Sprintf("mode %s is weaker than the server's mode %s", mode, a.mode))
+	}
+	return mode, nil
+}
+
+// errCanonicalizationHidden is the response for canonicalization failures
+// without debug responses.
+var errCanonicalizationHidden = NewAshError(ErrCanonicalizationFailed, "canonicalization failed")
+
+// responseError returns the form of err sent to clients. Unless debug
+// responses are enabled, canonicalization failures are reduced to their
+// code so the response says nothing about the payload.
+func (a *Ash) responseError(err *AshError) *AshError {
+	if err.Code == ErrCanonicalizationFailed && !a.debugResponses {
+		return errCanonicalizationHidden
+	}
+	return err
+}
@@ -0,0 +1,346 @@
+package ash
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAsh creates an Ash instance over a MemoryStore sharing a fixed clock.
+func newTestAsh(t testing.TB, now time.Time, opts ...Option) (*Ash, *MemoryStore) {
+	t.Helper()
+	store := NewMemoryStore(MemoryStoreOptions{Now: fixedClock(now)})
+	defaults := []Option{
+		WithClock(fixedClock(now)),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	}
+	a, err := New(store, append(defaults, opts...)...)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return a, store
+}
+
+// TestNewRejectsInvalidTTL tests that New validates the configured TTL.
+func TestNewRejectsInvalidTTL(t *testing.T) {
+	store := NewMemoryStore(MemoryStoreOptions{})
+	for _, ttl := range []time.Duration{0, -30 * time.Second} {
+		if _, err := New(store, WithTTL(ttl)); !errors.Is(err, ErrInvalidTTL) {
+			t.Errorf("New with TTL %v: got %v, want ErrInvalidTTL", ttl, err)
+		}
+	}
+	if _, err := New(store, WithTTL(time.Millisecond)); err != nil {
+		t.Errorf("New with 1ms TTL failed: %v", err)
+	}
+}
+
+// TestContextHandler tests context issuance over HTTP.
+func TestContextHandler(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, store := newTestAsh(t, now, WithTTL(time.Millisecond))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/ash/context?binding=post+/api//update/", nil)
+	NewContextHandler(a).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var info ContextPublicInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if info.ExpiresAt != now.UnixMilli()+1 {
+		t.Errorf("Expected expiresAt %d, got %d", now.UnixMilli()+1, info.ExpiresAt)
+	}
+	ctx, err := store.Get(info.ContextID)
+	if err != nil {
+		t.Fatalf("Issued context not stored: %v", err)
+	}
+	if ctx.Binding != "POST /api/update" {
+		t.Errorf("Expected normalized binding, got %q", ctx.Binding)
+	}
+}
+
+// TestContextHandlerTTL tests client-requested TTLs and their clamping.
+func TestContextHandlerTTL(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, _ := newTestAsh(t, now)
+	issue := func(h *ContextHandler, req *http.Request) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	get := func(query string) *http.Request {
+		return httptest.NewRequest("GET", "/ash/context?binding=POST+/api/test"+query, nil)
+	}
+	post := func(body string) *http.Request {
+		req := httptest.NewRequest("POST", "/ash/context?binding=POST+/api/test", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+	bounded := NewContextHandler(a)
+	bounded.MinTTL, bounded.MaxTTL = 5*time.Second, 2*time.Minute
+
+	for _, tt := range []struct {
+		name    string
+		handler *ContextHandler
+		req     *http.Request
+		want    time.Duration
+	}{
+		{"default", NewContextHandler(a), get(""), DefaultTTL},
+		{"shorter", NewContextHandler(a), get("&ttlMs=10000"), 10 * time.Second},
+		{"too large", NewContextHandler(a), get("&ttlMs=3600000"), DefaultTTL},
+		{"huge", NewContextHandler(a), get("&ttlMs=9223372036854775807"), DefaultTTL},
+		{"within MaxTTL", bounded, get("&ttlMs=60000"), time.Minute},
+		{"above MaxTTL", bounded, get("&ttlMs=3600000"), 2 * time.Minute},
+		{"below MinTTL", bounded, get("&ttlMs=1"), 5 * time.Second},
+		{"JSON body", NewContextHandler(a), post(`{"ttlMs":10000}`), 10 * time.Second},
+		{"other JSON body", NewContextHandler(a), post(`["ttlMs"]`), DefaultTTL},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := issue(tt.handler, tt.req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+			}
+			var info ContextPublicInfo
+			if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if want := now.Add(tt.want).UnixMilli(); info.ExpiresAt != want {
+				t.Errorf("expiresAt = %d, want %d", info.ExpiresAt, want)
+			}
+		})
+	}
+
+	for _, req := range []*http.Request{get("&ttlMs=0"), get("&ttlMs=-5"), get("&ttlMs=1.5"), get("&ttlMs=abc"), post(`{"ttlMs":"10000"}`)} {
+		if rec := issue(NewContextHandler(a), req); rec.Code != http.StatusBadRequest || decodeError(t, rec).Code != ErrMalformedRequest {
+			t.Errorf("%s: expected 400 %s, got %d: %s", req.URL, ErrMalformedRequest, rec.Code, rec.Body)
+		}
+	}
+
+	// The body stays readable for Metadata.
+	h := NewContextHandler(a)
+	var seen []byte
+	h.Metadata = func(r *http.Request) map[string]interface{} {
+		seen, _ = io.ReadAll(r.Body)
+		return nil
+	}
+	if issue(h, post(`{"ttlMs":10000,"user":"u1"}`)); string(seen) != `{"ttlMs":10000,"user":"u1"}` {
+		t.Errorf("Metadata read %q", seen)
+	}
+}
+
+// TestContextHandlerBadBinding tests that a missing binding is rejected.
+func TestContextHandlerBadBinding(t *testing.T) {
+	a, _ := newTestAsh(t, time.Now())
+	rec := httptest.NewRecorder()
+	NewContextHandler(a).ServeHTTP(rec, httptest.NewRequest("GET", "/ash/context", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", rec.Code)
+	}
+}
+
+// TestContextHandlerBornExpired tests that a context which is already
+// expired when issued is never returned to the client.
+func TestContextHandlerBornExpired(t *testing.T) {
+	issued := time.UnixMilli(1700000000000)
+	store := NewMemoryStore(MemoryStoreOptions{Now: fixedClock(issued)})
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	// The handler's clock runs ahead of the store's clock.
+	a, err := New(store,
+		WithTTL(time.Millisecond),
+		WithClock(fixedClock(issued.Add(time.Millisecond))),
+		WithLogger(logger))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	NewContextHandler(a).ServeHTTP(rec, httptest.NewRequest("GET", "/ash/context?binding=POST+/api/test", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500, got %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "contextId") {
+		t.Errorf("Expired context leaked to client: %s", rec.Body)
+	}
+	if !strings.Contains(logs.String(), "issued context would be expired") {
+		t.Errorf("Expected expiry error to be logged, got %q", logs.String())
+	}
+}
+
+// TestContextHandlerRateLimited tests that exceeding a binding limit is
+// reported as 429.
+func TestContextHandlerRateLimited(t *testing.T) {
+	store := NewMemoryStore(MemoryStoreOptions{BindingLimits: BindingLimits{"POST /api/login": 1}})
+	a, err := New(store, WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	handler := NewContextHandler(a)
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ash/context?binding=POST+/api/login", nil))
+		if rec.Code != want {
+			t.Fatalf("Request %d: expected %d, got %d: %s", i, want, rec.Code, rec.Body)
+		}
+	}
+}
+
+// TestContextHandlerPublicMetadata tests that only allowlisted metadata
+// keys reach the response, while all metadata stays on the context.
+func TestContextHandlerPublicMetadata(t *testing.T) {
+	metadata := map[string]interface{}{"userId": "u_123", "riskScore": 0.9, "displayHint": "Confirm transfer"}
+	for _, tt := range []struct {
+		name    string
+		allowed []string
+		want    map[string]interface{}
+	}{
+		{"none", nil, nil},
+		{"hint", []string{"displayHint", "absent"}, map[string]interface{}{"displayHint": "Confirm transfer"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, store := newTestAsh(t, time.UnixMilli(1700000000000))
+			handler := NewContextHandler(a)
+			handler.Metadata = func(*http.Request) map[string]interface{} { return metadata }
+			handler.PublicMetadata = tt.allowed
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ash/context?binding=POST+/api/transfer", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+			}
+			for _, private := range []string{"userId", "u_123", "riskScore"} {
+				if strings.Contains(rec.Body.String(), private) {
+					t.Errorf("Private metadata %q leaked: %s", private, rec.Body)
+				}
+			}
+			var info ContextPublicInfo
+			if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if !reflect.DeepEqual(info.Meta, tt.want) {
+				t.Errorf("Meta = %v, want %v", info.Meta, tt.want)
+			}
+			if tt.want == nil && strings.Contains(rec.Body.String(), `"meta"`) {
+				t.Errorf("Expected no meta field: %s", rec.Body)
+			}
+			ctx, _ := store.Get(info.ContextID)
+			if !reflect.DeepEqual(ctx.Metadata, metadata) {
+				t.Errorf("Stored metadata = %v, want %v", ctx.Metadata, metadata)
+			}
+		})
+	}
+}
+
+// TestContextHandlerBindingPatterns tests that clients only get contexts
+// for binding patterns and templates when the server allows it, and that
+// such contexts are held to the policy of the endpoint they are used on.
+func TestContextHandlerBindingPatterns(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, store := newTestAsh(t, now,
+		WithBindingPolicy("POST /api/transfer", BindingPolicy{RequiredExtensions: []string{"x-req"}}),
+		WithBindingPolicy("POST /api/upload", BindingPolicy{RawBody: true}))
+	issue := func(h http.Handler, binding string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/ash/context?count=1&binding="+url.QueryEscape(binding), nil))
+		return rec
+	}
+	for _, binding := range []string{"POST /api/*", "POST /api/**", "POST /api/{name}"} {
+		for name, h := range map[string]http.Handler{
+			"ContextHandler":       NewContextHandler(a),
+			"ContextStreamHandler": NewContextStreamHandler(a, ContextStreamOptions{Interval: time.Millisecond}),
+		} {
+			if rec := issue(h, binding); rec.Code != http.StatusBadRequest || decodeError(t, rec).Message != errClientBindingPattern.Message {
+				t.Errorf("%s issued %s: %d %s", name, binding, rec.Code, rec.Body)
+			}
+		}
+	}
+
+	h := NewContextHandler(a)
+	h.AllowBindingPatterns = true
+	rec := issue(h, "POST /api/*")
+	var info ContextPublicInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("Expected 200 with AllowBindingPatterns, got %d: %s", rec.Code, rec.Body)
+	}
+	ctx, _ := store.Get(info.ContextID)
+	body := `{"amount":1}`
+	proofFor := func(binding string, exts ...KV) string {
+		canonical, _ := CanonicalizePayload([]byte(body), "application/json")
+		return BuildProof(BuildProofInput{Mode: ctx.Mode, Binding: binding, ContextID: ctx.ID, Nonce: ctx.Nonce,
+			Extensions: exts, CanonicalPayload: canonical})
+	}
+
+	// The endpoint's required extensions apply.
+	if _, err := a.Verify(ctx.ID, proofFor("POST /api/transfer"), "POST /api/transfer", []byte(body), "application/json",
+		WithDryRun()); !errors.Is(err, ErrMalformedRequest) {
+		t.Errorf("Without the required extension: %v, want %s", err, ErrMalformedRequest)
+	}
+	exts := []KV{{Key: "x-req", Value: "1"}}
+	if result, err := a.Verify(ctx.ID, proofFor("POST /api/transfer", exts...), "POST /api/transfer", []byte(body),
+		"application/json", WithDryRun(), WithExtensions(exts...)); err != nil || !result.Valid {
+		t.Errorf("With the required extension: %v", err)
+	}
+	// A context not issued under the endpoint's policy fails.
+	if _, err := a.Verify(ctx.ID, proofFor("POST /api/upload"), "POST /api/upload", []byte(body), "application/json",
+		WithDryRun()); !errors.Is(err, ErrEndpointMismatch) {
+		t.Errorf("Without the endpoint's raw body policy: %v, want %s", err, ErrEndpointMismatch)
+	}
+	// Endpoints without a policy are unaffected.
+	if _, err := a.Verify(ctx.ID, proofFor("POST /api/other"), "POST /api/other", []byte(body), "application/json"); err != nil {
+		t.Errorf("Endpoint without a policy: %v", err)
+	}
+}
+
+// TestContextHandlerModeFloor tests that clients cannot ask either
+// handler for a mode weaker than the instance mode.
+func TestContextHandlerModeFloor(t *testing.T) {
+	withTestModes(t)
+	now := time.UnixMilli(1700000000000)
+	a, _ := newTestAsh(t, now, WithMode(ModeStrict))
+	handlers := map[string]http.Handler{
+		"ContextHandler":       NewContextHandler(a),
+		"ContextStreamHandler": NewContextStreamHandler(a, ContextStreamOptions{Interval: time.Millisecond}),
+	}
+	for name, h := range handlers {
+		for _, mode := range []AshMode{ModeMinimal, ModeBalanced, "test-multi-use"} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/ash/context?count=1&binding=POST+/api/test&mode="+string(mode), nil))
+			if rec.Code != http.StatusBadRequest || decodeError(t, rec).Code != ErrModeViolation {
+				t.Errorf("%s issued mode %s on a strict server: %d %s", name, mode, rec.Code, rec.Body)
+			}
+		}
+		for _, mode := range []AshMode{"", ModeStrict} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/ash/context?count=1&binding=POST+/api/test&mode="+string(mode), nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("%s refused mode %q: %d %s", name, mode, rec.Code, rec.Body)
+			}
+		}
+	}
+
+	// A stricter mode than the instance's may be asked for.
+	a, _ = newTestAsh(t, now)
+	rec := httptest.NewRecorder()
+	NewContextHandler(a).ServeHTTP(rec, httptest.NewRequest("GET", "/ash/context?binding=POST+/api/test&mode=strict", nil))
+	var info ContextPublicInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil || info.Mode != ModeStrict || info.Nonce == "" {
+		t.Errorf("Stricter mode: %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,39 @@
+package ash
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HealthResponse is the body written by the handler returned by
+// NewHealthHandler.
+type HealthResponse struct {
+	// Status is "ok", or "unavailable" if the self-test failed.
+	Status string `json:"status"`
+	// Contexts is the number of contexts held by the store, for stores
+	// that report it with a Size method, such as MemoryStore.
+	Contexts *int `json:"contexts,omitempty"`
+}
+
+// NewHealthHandler returns a handler reporting the health of a. It runs
+// SelfTest and answers 200 with status "ok", or 503 with status
+// "unavailable" if the self-test failed; the cause is only logged.
+func NewHealthHandler(a *Ash) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var health HealthResponse
+		if s, ok := storeAs[interface{ Size() int }](a.store); ok {
+			n := s.Size()
+			health.Contexts = &n
+		}
+		status := http.StatusOK
+		health.Status = "ok"
+		if _, err := a.SelfTest(r.Context()); err != nil {
+			status = http.StatusServiceUnavailable
+			health.Status = "unavailable"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(health)
+	})
+}
@@ -0,0 +1,46 @@
+package ash
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestHealthHandler tests the health report of working and broken stores.
+func TestHealthHandler(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, _ := newTestAsh(t, now)
+	a.IssueContext(ContextOptions{Binding: "POST /api/x"})
+	broken, _ := New(replayingStore{NewMemoryStore(MemoryStoreOptions{Now: fixedClock(now)})}, WithClock(fixedClock(now)),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+
+	tests := []struct {
+		name     string
+		ash      *Ash
+		status   int
+		expected string
+	}{
+		{"working", a, http.StatusOK, `{"status":"ok","contexts":1}`},
+		{"broken", broken, http.StatusServiceUnavailable, `{"status":"unavailable"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			NewHealthHandler(tt.ash).ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+			if rec.Code != tt.status {
+				t.Errorf("Expected %d, got %d", tt.status, rec.Code)
+			}
+			var got, want HealthResponse
+			json.Unmarshal(rec.Body.Bytes(), &got)
+			json.Unmarshal([]byte(tt.expected), &want)
+			if got.Status != want.Status || (got.Contexts == nil) != (want.Contexts == nil) ||
+				(got.Contexts != nil && *got.Contexts != *want.Contexts) {
+				t.Errorf("Expected %s, got %s", tt.expected, rec.Body)
+			}
+		})
+	}
+}
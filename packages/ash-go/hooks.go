@@ -0,0 +1,68 @@
+package ash
+
+// Hooks are optional callbacks fired at the instrumentation points of an
+// Ash instance. Nil callbacks are skipped. With WithAsyncDelivery they run
+// on the delivery workers and receive copies.
+type Hooks struct {
+	// OnIssue is called after a context has been issued.
+	OnIssue func(ctx *Context)
+	// OnIssueNotify is called after a context has been issued with its
+	// client-safe view, so that integrators can push it to the client over
+	// another channel, such as a WebSocket. An error or panic is logged
+	// and never fails issuance; with WithAsyncDelivery a slow callback
+	// does not delay it either.
+	OnIssueNotify func(info ContextPublicInfo) error
+	// OnVerify is called with the result of every verification.
+	OnVerify func(result *VerifyResult)
+	// OnCanonicalizationFailure is called after OnVerify for every
+	// verification that failed because the canonicalizer rejected the
+	// payload, with the reason (result.Reason).
+	OnCanonicalizationFailure func(reason CanonicalizationReason, result *VerifyResult)
+}
+
+// WithHooks sets the instrumentation callbacks.
+func WithHooks(hooks Hooks) Option {
+	return func(a *Ash) { a.hooks = hooks }
+}
+
+// recordIssue fires the issuance instrumentation point.
+func (a *Ash) recordIssue(ctx *Context) {
+	if a.counters != nil {
+		a.counters.issued.Add(1)
+	}
+	if a.hooks.OnIssue != nil {
+		ctx := ctx.Clone()
+		a.deliver(ctx.ID, func() { a.hooks.OnIssue(ctx) })
+	}
+	if a.hooks.OnIssueNotify != nil {
+		info := a.PublicInfo(ctx)
+		a.deliver(ctx.ID, func() { a.notifyIssue(info) })
+	}
+}
+
+// notifyIssue calls OnIssueNotify, logging its failure.
+func (a *Ash) notifyIssue(info ContextPublicInfo) {
+	defer func() {
+		if p := recover(); p != nil {
+			a.logger.Error("ash: issuance notification panicked", "contextId", info.ContextID, "panic", p)
+		}
+	}()
+	if err := a.hooks.OnIssueNotify(info); err != nil {
+		a.logger.Warn("ash: issuance notification failed", "contextId", info.ContextID, "error", err)
+	}
+}
+
+// recordVerify fires the verification instrumentation point.
+func (a *Ash) recordVerify(result *VerifyResult) {
+	if a.counters != nil && !result.DryRun {
+		a.counters.recordVerify(result)
+	}
+	if a.hooks.OnVerify != nil {
+		result := *result
+		a.deliver(result.ContextID, func() { a.hooks.OnVerify(&result) })
+	}
+	if a.hooks.OnCanonicalizationFailure != nil && result.Reason != "" {
+		result := *result
+		a.deliver(result.ContextID, func() { a.hooks.OnCanonicalizationFailure(result.Reason, &result) })
+	}
+}
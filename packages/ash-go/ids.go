@@ -0,0 +1,140 @@
+package ash
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IDGenerator supplies the ID of a new context.
+//
+// IDs must be unique and unguessable; stores make no other assumption about
+// their format or length.
+type IDGenerator interface {
+	ContextID() (string, error)
+}
+
+// IDGeneratorFunc adapts a function to an IDGenerator.
+type IDGeneratorFunc func() (string, error)
+
+// ContextID calls f().
+func (f IDGeneratorFunc) ContextID() (string, error) {
+	return f()
+}
+
+// DefaultIDGenerator returns the built-in generator: GenerateContextID, a
+// random 128-bit hex ID.
+func DefaultIDGenerator() IDGenerator {
+	return IDGeneratorFunc(GenerateContextID)
+}
+
+// contextIDPrefix prefixes every generated context ID.
+const contextIDPrefix = "ash_"
+
+// crockford is the Crockford base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidLen is the length of an encoded ULID.
+const ulidLen = 26
+
+// errULIDOverflow is returned when more ULIDs are requested within one
+// millisecond than the random component can order.
+var errULIDOverflow = errors.New("ulid: monotonic entropy overflow")
+
+// ulidGenerator generates monotonic ULIDs.
+type ulidGenerator struct {
+	mu   sync.Mutex
+	now  func() time.Time
+	last [16]byte
+	ms   int64
+}
+
+// NewULIDGenerator returns a generator of "ash_"-prefixed ULIDs: 48 bits of
+// issuance time in milliseconds followed by 80 random bits, in Crockford
+// base32. IDs sort by issuance time, and IDs issued by the same generator
+// sort in issuance order even within a millisecond. ParseContextTime
+// recovers the time.
+//
+// now is the clock (nil for time.Now).
+func NewULIDGenerator(now func() time.Time) IDGenerator {
+	if now == nil {
+		now = time.Now
+	}
+	return &ulidGenerator{now: now}
+}
+
+// ContextID returns the next ULID.
+func (g *ulidGenerator) ContextID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := g.now().UnixMilli()
+	if ms <= g.ms {
+		// Same millisecond, or the clock stepped back: keep ordering by
+		// incrementing the previous random component.
+		ms = g.ms
+		if !incrementEntropy(g.last[6:]) {
+			return "", errULIDOverflow
+		}
+	} else if _, err := rand.Read(g.last[6:]); err != nil {
+		return "", err
+	}
+	g.ms = ms
+	for i := 0; i < 6; i++ {
+		g.last[i] = byte(ms >> (40 - 8*i))
+	}
+	return contextIDPrefix + encodeULID(g.last), nil
+}
+
+// incrementEntropy adds one to a big-endian number, reporting false on
+// overflow.
+func incrementEntropy(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID encodes 128 bits as 26 Crockford base32 characters. The first
+// character carries the top 3 bits.
+func encodeULID(id [16]byte) string {
+	var out [ulidLen]byte
+	for i := range out {
+		// Character i covers bits [5i-2, 5i+3) of the 128-bit value.
+		var v byte
+		for bit := 5*i - 2; bit < 5*i+3; bit++ {
+			v <<= 1
+			if bit >= 0 && id[bit/8]&(0x80>>(bit%8)) != 0 {
+				v |= 1
+			}
+		}
+		out[i] = crockford[v]
+	}
+	return string(out[:])
+}
+
+// ParseContextTime returns the issuance time embedded in a context ID made
+// by NewULIDGenerator. It reports false for IDs in any other format,
+// including the default random IDs.
+func ParseContextTime(id string) (time.Time, bool) {
+	ulid, ok := strings.CutPrefix(id, contextIDPrefix)
+	if !ok || len(ulid) != ulidLen || ulid[0] > '7' {
+		return time.Time{}, false
+	}
+	var ms int64
+	for i := 0; i < ulidLen; i++ {
+		v := strings.IndexByte(crockford, ulid[i])
+		if v < 0 {
+			return time.Time{}, false
+		}
+		if i < 10 {
+			ms = ms<<5 | int64(v)
+		}
+	}
+	return time.UnixMilli(ms), true
+}
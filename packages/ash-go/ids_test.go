@@ -0,0 +1,78 @@
+package ash
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestULIDGeneratorMonotonic tests that IDs issued within one millisecond
+// sort in issuance order.
+func TestULIDGeneratorMonotonic(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	gen := NewULIDGenerator(func() time.Time { return now })
+
+	var ids []string
+	for i := 0; i < 1000; i++ {
+		if i == 500 {
+			// A clock step back must not break ordering.
+			now = now.Add(-time.Second)
+		}
+		id, err := gen.ContextID()
+		if err != nil {
+			t.Fatalf("ContextID failed: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if !sort.StringsAreSorted(ids) {
+		t.Error("Expected IDs to sort in issuance order")
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			t.Fatalf("Duplicate ID %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+// TestParseContextTime tests recovery of the issuance time from an ID.
+func TestParseContextTime(t *testing.T) {
+	for _, ms := range []int64{0, 1, 1700000000123, 1<<48 - 1} {
+		issued := time.UnixMilli(ms)
+		id, err := NewULIDGenerator(func() time.Time { return issued }).ContextID()
+		if err != nil {
+			t.Fatalf("ContextID failed: %v", err)
+		}
+		got, ok := ParseContextTime(id)
+		if !ok || !got.Equal(issued) {
+			t.Errorf("ParseContextTime(%s) = %v, %v; want %v", id, got, ok, issued)
+		}
+	}
+
+	random, _ := GenerateContextID()
+	for _, id := range []string{random, "", "ash_", "ash_01ARZ3NDEKTSV4RRFFQ69G5FA", "ash_81ARZ3NDEKTSV4RRFFQ69G5FAV", "ash_01ARZ3NDEKTSV4RRFFQ69G5FAU", "ctx_01ARZ3NDEKTSV4RRFFQ69G5FAV"} {
+		if _, ok := ParseContextTime(id); ok {
+			t.Errorf("ParseContextTime(%q) succeeded, want failure", id)
+		}
+	}
+}
+
+// TestIssueContextWithIDGenerator tests that issued contexts use the
+// configured ID generator.
+func TestIssueContextWithIDGenerator(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, store := newTestAsh(t, now, WithIDGenerator(NewULIDGenerator(fixedClock(now))))
+
+	ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/test"})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	if issued, ok := ParseContextTime(ctx.ID); !ok || !issued.Equal(now) {
+		t.Errorf("ParseContextTime(%s) = %v, %v; want %v", ctx.ID, issued, ok, now)
+	}
+	if _, err := store.Get(ctx.ID); err != nil {
+		t.Errorf("Get failed: %v", err)
+	}
+}
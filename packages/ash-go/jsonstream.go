@@ -0,0 +1,274 @@
+package ash
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// CanonicalizeJSONStream reads one JSON value from r and writes its
+// canonical form to w. The output and errors match ParseJSON on the same
+// input; like ParseJSON, it ignores anything after the value unless
+// WithRejectTrailingData is given.
+//
+// Arrays are written element by element as they are read. Object members
+// must be sorted, so each object is held in memory until it closes: memory
+// use is bounded by the largest object rather than the whole document,
+// and a document that is one large object is held in full.
+//
+// On error, w may already have received part of the output.
+func CanonicalizeJSONStream(r io.Reader, w io.Writer, opts ...CanonicalizeOption) error {
+	o := newCanonicalizeOptions(opts)
+	if o.err != nil {
+		return o.err
+	}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	s := &jsonStreamer{dec: dec, o: o}
+
+	bw := bufio.NewWriter(w)
+	tok, err := dec.Token()
+	if err != nil {
+		return invalidJSON(err)
+	}
+	if err := o.checkTopLevel(tok); err != nil {
+		return err
+	}
+	var canonErr error
+	if err := s.value(bw, "", tok, &canonErr); err != nil {
+		return invalidJSON(err)
+	}
+	if err := o.checkTrailing(dec); err != nil {
+		return err
+	}
+	if canonErr != nil {
+		return canonErr
+	}
+	return bw.Flush()
+}
+
+// jsonStreamer canonicalizes a token stream.
+type jsonStreamer struct {
+	dec *json.Decoder
+	o   *canonicalizeOptions
+}
+
+// streamMember is an object member held until its object closes.
+type streamMember struct {
+	rawKey string
+	value  bytes.Buffer
+	err    error
+}
+
+// value writes the canonical form of the value starting with tok. It
+// returns decoding errors; a canonicalization error is stored in *canonErr
+// (if it is the first) and the rest of the value is still consumed, since
+// a later duplicate key may replace the member that failed, as it would
+// in the map ParseJSON decodes into.
+func (s *jsonStreamer) value(w io.Writer, pointer string, tok json.Token, canonErr *error) error {
+	fail := func(err error) {
+		if *canonErr == nil {
+			*canonErr = err
+		}
+	}
+
+	if s.o.isDecimal(pointer) {
+		switch tok.(type) {
+		case string, json.Number:
+			decimal, err := s.o.canonicalDecimalValue(tok, pointer)
+			if err != nil {
+				fail(err)
+				return nil
+			}
+			io.WriteString(w, quoteJSONString(decimal))
+			return nil
+		}
+		// The value is still read to its end.
+		fail(invalidDecimal(pointer))
+	}
+
+	switch v := tok.(type) {
+	case nil:
+		io.WriteString(w, "null")
+	case bool:
+		io.WriteString(w, strconv.FormatBool(v))
+	case string:
+		io.WriteString(w, quoteJSONString(s.o.normalizeValue(v, pointer)))
+	case json.Number:
+		if canonical, ok := canonicalDecimal(string(v)); ok {
+			io.WriteString(w, canonical)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			fail(numberError(pointer, err))
+			return nil
+		}
+		if f, err = canonicalizeNumberAt(f, pointer); err != nil {
+			fail(err)
+			return nil
+		}
+		io.WriteString(w, formatNumber(f))
+
+	case json.Delim:
+		if v == '[' {
+			return s.array(w, pointer, canonErr)
+		}
+		return s.object(w, pointer, canonErr)
+	}
+	return nil
+}
+
+// array writes an array whose opening bracket has been read.
+func (s *jsonStreamer) array(w io.Writer, pointer string, canonErr *error) error {
+	io.WriteString(w, "[")
+	for i := 0; s.dec.More(); i++ {
+		tok, err := s.dec.Token()
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		if err := s.value(w, childPointer(pointer, strconv.Itoa(i)), tok, canonErr); err != nil {
+			return err
+		}
+	}
+	if _, err := s.dec.Token(); err != nil {
+		return err
+	}
+	io.WriteString(w, "]")
+	return nil
+}
+
+// object writes an object whose opening brace has been read.
+func (s *jsonStreamer) object(w io.Writer, pointer string, canonErr *error) error {
+	// Members are held by their key as written, a later duplicate
+	// replacing an earlier one.
+	raw := make(map[string]*streamMember)
+	for s.dec.More() {
+		tok, err := s.dec.Token()
+		if err != nil {
+			return err
+		}
+		rawKey := tok.(string)
+		m := &streamMember{rawKey: rawKey}
+		raw[rawKey] = m
+
+		if tok, err = s.dec.Token(); err != nil {
+			return err
+		}
+		if err := s.value(&m.value, childPointer(pointer, s.o.form.String(rawKey)), tok, &m.err); err != nil {
+			return err
+		}
+	}
+	if _, err := s.dec.Token(); err != nil {
+		return err
+	}
+
+	// Of distinct keys that normalize to the same form, the one that sorts
+	// last keeps its value, as in canonicalizeValue.
+	members := make(map[string]*streamMember, len(raw))
+	for rawKey, m := range raw {
+		if m.err != nil {
+			if *canonErr == nil {
+				*canonErr = m.err
+			}
+			return nil
+		}
+		key := s.o.form.String(rawKey)
+		if winner, ok := members[key]; !ok || winner.rawKey < rawKey {
+			members[key] = m
+		}
+	}
+	keys := make([]string, 0, len(members))
+	for key, m := range members {
+		if s.o.omitMember(childPointer(pointer, key), func() (string, error) { return m.value.String(), nil }) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	// The decoder replaces invalid UTF-8, so this is code point order, as
+	// in buildCanonicalJSON.
+	sort.Strings(keys)
+
+	io.WriteString(w, "{")
+	for i, key := range keys {
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		io.WriteString(w, quoteJSONString(key))
+		io.WriteString(w, ":")
+		members[key].value.WriteTo(w)
+	}
+	io.WriteString(w, "}")
+	return nil
+}
+
+// streamPayload is a body read from a reader by VerifyStream.
+type streamPayload struct {
+	r io.Reader
+}
+
+func (p streamPayload) writeCanonical(a *Ash, w io.Writer, contentType string, ctx *Context) error {
+	r := &readErrReader{r: p.r}
+	br := bufio.NewReader(r)
+	if _, err := br.Peek(1); err == io.EOF {
+		return nil
+	}
+	if r.err != nil {
+		return errReadBody
+	}
+	if ctx.RawBody {
+		_, err := br.WriteTo(w)
+		if r.err != nil {
+			return errReadBody
+		}
+		return err
+	}
+	c, params, err := a.canonicalizers.lookup(contentType)
+	if err != nil {
+		return err
+	}
+	opts := append(ctx.canonicalizeOptions(), a.strictOptions()...)
+	if sc, ok := c.(streamCanonicalizer); ok {
+		err = sc.canonicalizeStream(br, w, opts)
+	} else {
+		var body []byte
+		if body, err = io.ReadAll(br); err == nil {
+			var canonical string
+			canonical, err = canonicalizeWith(c, body, params, opts)
+			io.WriteString(w, canonical)
+		}
+	}
+	if r.err != nil {
+		return errReadBody
+	}
+	return err
+}
+
+// canonical reports that a streamed body is no longer available.
+func (streamPayload) canonical(*Ash, string, *Context) (string, bool) {
+	return "", false
+}
+
+// errReadBody is returned when a streamed body cannot be read.
+var errReadBody = NewAshError(ErrMalformedRequest, "failed to read request body")
+
+// readErrReader records the first error other than io.EOF from r, so that
+// a failed read is not reported as malformed JSON.
+type readErrReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,165 @@
+package ash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamEqualityInputs are JSON documents on which CanonicalizeJSONStream
+// and ParseJSON must agree.
+var streamEqualityInputs = []string{
+	`{"b":2,"a":1}`,
+	`[3,1,2]`,
+	`{"z":[{"y":1,"x":[true,false,null]},"s"],"a":{"c":{},"b":[]}}`,
+	`"café"`,
+	`1.50`,
+	`-0`,
+	`1e3`,
+	`null`,
+	`{"a":1,"a":2}`,
+	`{"a":1e999,"a":1}`,
+	`{"a":1,"a":1e999}`,
+	"{\"\u00e9\":1,\"e\u0301\":2}",
+	"{\"e\u0301\":2,\"\u00e9\":1}",
+	"{\"e\u0301\":1e999,\"\u00e9\":1}",
+	"{\"e\u0301\":1e999,\"\u00e9\":1,\"e\u0301\":2}",
+	`{"ﬁ":1,"fi":2}`,
+	`{"a":1} trailing`,
+	`  [1, 2]  `,
+	`{"a":[1,2,{"b":1e999}]}`,
+	`{"a":`,
+	`[1,]`,
+	`{"a" 1}`,
+	``,
+	`   `,
+	`]`,
+	`{"<>& ":"\u0000"}`,
+}
+
+// TestCanonicalizeJSONStreamMatchesParseJSON tests that streaming and
+// buffered canonicalization agree, including on failures.
+func TestCanonicalizeJSONStreamMatchesParseJSON(t *testing.T) {
+	for _, form := range []UnicodeForm{UnicodeNFC, UnicodeNFKC} {
+		for _, input := range streamEqualityInputs {
+			want, wantErr := ParseJSON(input, WithUnicodeForm(form))
+			var buf bytes.Buffer
+			err := CanonicalizeJSONStream(strings.NewReader(input), &buf, WithUnicodeForm(form))
+			if (err == nil) != (wantErr == nil) {
+				t.Errorf("%s %q: stream error %v, buffered error %v", form, input, err, wantErr)
+				continue
+			}
+			if err != nil {
+				var got, want *AshError
+				if !errors.As(err, &got) || !errors.As(wantErr, &want) || got.Code != want.Code {
+					t.Errorf("%s %q: stream error %v, buffered error %v", form, input, err, wantErr)
+				}
+				continue
+			}
+			if buf.String() != want {
+				t.Errorf("%s %q: stream = %q, buffered = %q", form, input, buf.String(), want)
+			}
+		}
+	}
+}
+
+// errReader fails after returning its prefix.
+type errReader struct {
+	r io.Reader
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+// TestVerifyStreamMatchesVerify tests that VerifyStream and Verify reach
+// the same outcome on the same bytes.
+func TestVerifyStreamMatchesVerify(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/upload"})
+	signed := `{"items":[{"id":2,"name":"b"},{"id":1,"name":"a"}],"count":2}`
+	proof := clientProof(t, ctx, signed, "application/json")
+
+	type request struct {
+		body, contentType string
+	}
+	requests := []request{
+		{signed, "application/json"},
+		{`{"count":2,"items":[{"name":"b","id":2},{"name":"a","id":1}]}`, "application/json; charset=utf-8"},
+		{`{"count":3,"items":[]}`, "application/json"},
+		{`{"count":`, "application/json"},
+		{`a=1&b=2`, "application/x-www-form-urlencoded"},
+		{signed, "text/plain"},
+		{"", "text/plain"},
+	}
+	for _, req := range requests {
+		want, wantErr := a.Verify(ctx.ID, proof, ctx.Binding, []byte(req.body), req.contentType, WithDryRun())
+		got, err := a.VerifyStream(ctx.ID, proof, ctx.Binding, strings.NewReader(req.body), req.contentType, WithDryRun())
+		if got.Valid != want.Valid || got.Code != want.Code || (err == nil) != (wantErr == nil) {
+			t.Errorf("%q: VerifyStream = %+v, %v; Verify = %+v, %v", req.body, got, err, want, wantErr)
+		}
+	}
+
+	_, err := a.VerifyStream(ctx.ID, proof, ctx.Binding, &errReader{strings.NewReader(`{"items":[`)}, "application/json")
+	var ashErr *AshError
+	if !errors.As(err, &ashErr) || ashErr.Code != ErrMalformedRequest {
+		t.Errorf("Expected %s for a failed read, got %v", ErrMalformedRequest, err)
+	}
+
+	if _, err := a.VerifyStream(ctx.ID, proof, ctx.Binding, strings.NewReader(signed), "application/json"); err != nil {
+		t.Fatalf("VerifyStream failed: %v", err)
+	}
+	if _, err := a.VerifyStream(ctx.ID, proof, ctx.Binding, strings.NewReader(signed), "application/json"); !errors.As(err, &ashErr) || ashErr.Code != ErrReplayDetected {
+		t.Errorf("Expected %s after consumption, got %v", ErrReplayDetected, err)
+	}
+}
+
+// BenchmarkVerifyLargeBody compares buffered and streaming verification
+// of a body of about 8 MiB.
+func BenchmarkVerifyLargeBody(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteString("[")
+	for i := 0; i < 100000; i++ {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		fmt.Fprintf(&sb, `{"name":"item %d","tags":["a","b"],"price":%d.25,"id":%d}`, i, i, i)
+	}
+	sb.WriteString("]")
+	body := []byte(sb.String())
+
+	a, err := New(NewMemoryStore(MemoryStoreOptions{}))
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/upload"})
+	canonical, _ := CanonicalizePayload(body, "application/json")
+	proof := BuildProof(BuildProofInput{Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, CanonicalPayload: canonical})
+
+	b.Run("buffered", func(b *testing.B) {
+		b.SetBytes(int64(len(body)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := a.Verify(ctx.ID, proof, ctx.Binding, body, "application/json", WithDryRun()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("stream", func(b *testing.B) {
+		b.SetBytes(int64(len(body)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := a.VerifyStream(ctx.ID, proof, ctx.Binding, bytes.NewReader(body), "application/json", WithDryRun()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
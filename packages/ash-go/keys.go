@@ -0,0 +1,105 @@
+package ash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"strings"
+)
+
+// keyIDSeparator separates the key ID from the MAC in a keyed proof.
+// It is outside the Base64URL alphabet, so the split is unambiguous.
+const keyIDSeparator = "."
+
+// ErrInvalidKey is returned when a key ID or secret cannot be used.
+var ErrInvalidKey = errors.New("invalid key")
+
+// Key is a server secret identified by a key ID.
+type Key struct {
+	// ID identifies the key in proofs. It must be non-empty ASCII and must
+	// not contain '.'.
+	ID string
+	// Secret is the HMAC secret.
+	Secret []byte
+}
+
+// KeyRing holds the primary signing key plus any older keys that are still
+// accepted for verification.
+//
+// Rotation without downtime:
+//  1. Add the new key as a verification key on every server.
+//  2. Make it the primary key; servers sign with it while still accepting
+//     proofs made with the old key.
+//  3. Once contexts signed with the old key have expired, remove it.
+type KeyRing struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// NewKeyRing creates a key ring that signs with primary and verifies proofs
+// made with primary or any of the verification keys.
+func NewKeyRing(primary Key, verification ...Key) (*KeyRing, error) {
+	ring := &KeyRing{
+		primary: primary.ID,
+		keys:    make(map[string][]byte, len(verification)+1),
+	}
+	for _, key := range append([]Key{primary}, verification...) {
+		if key.ID == "" || !IsASCII(key.ID) || strings.Contains(key.ID, keyIDSeparator) {
+			return nil, ErrInvalidKey
+		}
+		if len(key.Secret) == 0 {
+			return nil, ErrInvalidKey
+		}
+		if _, dup := ring.keys[key.ID]; dup {
+			return nil, ErrInvalidKey
+		}
+		ring.keys[key.ID] = append([]byte(nil), key.Secret...)
+	}
+	return ring, nil
+}
+
+// PrimaryKeyID returns the ID of the signing key.
+func (k *KeyRing) PrimaryKeyID() string {
+	return k.primary
+}
+
+// BuildKeyedProof builds an HMAC-keyed proof with the primary key.
+//
+// The key ID travels in the proof itself:
+//
+//	proof = keyId + "." + Base64URL(HMAC-SHA256(secret, preimage))
+//
+// where preimage is the same string hashed by BuildProof, and the MAC is
+// written in input.Encoding.
+func BuildKeyedProof(input BuildProofInput, ring *KeyRing) string {
+	return ring.primary + keyIDSeparator + keyedMAC(ring.keys[ring.primary], input)
+}
+
+// VerifyKeyedProof verifies a proof built by BuildKeyedProof using the key
+// named by the proof's key ID.
+//
+// A proof that is not shaped like a keyed proof fails with
+// ErrMalformedProof before any MAC is computed; a well-formed proof that
+// does not match fails with ErrIntegrityFailed.
+func VerifyKeyedProof(input BuildProofInput, proof string, ring *KeyRing) error {
+	if err := checkProofFormat(proof, true, input.Encoding); err != nil {
+		return err
+	}
+	keyID, mac, _ := strings.Cut(proof, keyIDSeparator)
+	secret, ok := ring.keys[keyID]
+	if !ok {
+		return NewAshError(ErrIntegrityFailed, "unknown key ID")
+	}
+	if !TimingSafeCompare(keyedMAC(secret, input), input.Encoding.normalize(mac)) {
+		return NewAshError(ErrIntegrityFailed, "proof verification failed")
+	}
+	return nil
+}
+
+// keyedMAC computes the HMAC-SHA256 of the proof preimage, encoded in
+// input.Encoding.
+func keyedMAC(secret []byte, input BuildProofInput) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(proofPreimage(input)))
+	return input.Encoding.Encode(h.Sum(nil))
+}
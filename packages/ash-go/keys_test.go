@@ -0,0 +1,116 @@
+package ash
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testProofInput() BuildProofInput {
+	return BuildProofInput{
+		Mode:             ModeBalanced,
+		Binding:          "POST /api/transfer",
+		ContextID:        "ash_rotation",
+		CanonicalPayload: `{"amount":100}`,
+	}
+}
+
+// TestKeyedProofRotation tests verification during a key rotation overlap.
+func TestKeyedProofRotation(t *testing.T) {
+	oldKey := Key{ID: "k1", Secret: []byte("old-secret")}
+	newKey := Key{ID: "k2", Secret: []byte("new-secret")}
+
+	before, err := NewKeyRing(oldKey)
+	if err != nil {
+		t.Fatalf("NewKeyRing failed: %v", err)
+	}
+	during, err := NewKeyRing(newKey, oldKey)
+	if err != nil {
+		t.Fatalf("NewKeyRing failed: %v", err)
+	}
+	after, err := NewKeyRing(newKey)
+	if err != nil {
+		t.Fatalf("NewKeyRing failed: %v", err)
+	}
+
+	input := testProofInput()
+	oldProof := BuildKeyedProof(input, before)
+	newProof := BuildKeyedProof(input, during)
+
+	if !strings.HasPrefix(oldProof, "k1.") || !strings.HasPrefix(newProof, "k2.") {
+		t.Fatalf("Expected key ID prefixes, got %q and %q", oldProof, newProof)
+	}
+	if err := VerifyKeyedProof(input, oldProof, during); err != nil {
+		t.Errorf("Old-key proof rejected during overlap: %v", err)
+	}
+	if err := VerifyKeyedProof(input, newProof, during); err != nil {
+		t.Errorf("New-key proof rejected during overlap: %v", err)
+	}
+	if err := VerifyKeyedProof(input, newProof, after); err != nil {
+		t.Errorf("New-key proof rejected after rotation: %v", err)
+	}
+	if err := VerifyKeyedProof(input, oldProof, after); err == nil {
+		t.Error("Old-key proof accepted after the old key was removed")
+	}
+}
+
+// TestKeyedProofRejections tests rejection of unknown keys and tampering.
+func TestKeyedProofRejections(t *testing.T) {
+	ring, _ := NewKeyRing(Key{ID: "k1", Secret: []byte("secret")})
+	input := testProofInput()
+	proof := BuildKeyedProof(input, ring)
+	_, mac, _ := strings.Cut(proof, ".")
+
+	tampered := input
+	tampered.CanonicalPayload = `{"amount":1000000}`
+
+	tests := []struct {
+		name    string
+		input   BuildProofInput
+		proof   string
+		code    AshErrorCode
+		message string
+	}{
+		{"unknown key ID", input, "k9." + mac, ErrIntegrityFailed, "unknown key ID"},
+		{"missing key ID", input, mac, ErrMalformedProof, "proof has no key ID"},
+		{"empty key ID", input, "." + mac, ErrMalformedProof, "proof has no key ID"},
+		{"truncated MAC", input, proof[:len(proof)-1], ErrMalformedProof, "proof has the wrong length"},
+		{"tampered payload", tampered, proof, ErrIntegrityFailed, "proof verification failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyKeyedProof(tt.input, tt.proof, ring)
+			var ashErr *AshError
+			if !errors.As(err, &ashErr) || ashErr.Code != tt.code {
+				t.Fatalf("Expected %s, got %v", tt.code, err)
+			}
+			if ashErr.Message != tt.message {
+				t.Errorf("Expected message %q, got %q", tt.message, ashErr.Message)
+			}
+		})
+	}
+}
+
+// TestNewKeyRingValidation tests key validation.
+func TestNewKeyRingValidation(t *testing.T) {
+	secret := []byte("secret")
+	tests := []struct {
+		name string
+		keys []Key
+	}{
+		{"empty ID", []Key{{ID: "", Secret: secret}}},
+		{"ID with separator", []Key{{ID: "k.1", Secret: secret}}},
+		{"non-ASCII ID", []Key{{ID: "clé", Secret: secret}}},
+		{"empty secret", []Key{{ID: "k1"}}},
+		{"duplicate ID", []Key{{ID: "k1", Secret: secret}, {ID: "k1", Secret: secret}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewKeyRing(tt.keys[0], tt.keys[1:]...); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Expected ErrInvalidKey, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,597 @@
+package ash
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrKVNotFound is returned by KVStore.Get for a key that does not exist
+// or has expired.
+var ErrKVNotFound = errors.New("ash: key not found")
+
+// KVStore is a key-value store with per-key expiry, such as Redis, NATS KV,
+// DynamoDB or memcached. It is all NewKVContextStore needs to provide the
+// full ContextStore semantics, so a new backend only implements these four
+// operations.
+//
+// Values are opaque bytes and must be compared byte for byte. Keys are
+// context IDs; a backend shared with other data should prefix them.
+type KVStore interface {
+	// Get returns the value of key, or ErrKVNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// SetNX stores value under key for ttl if key does not exist, and
+	// reports whether it was stored.
+	SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	// CompareAndSwap replaces the value of key with value, expiring after
+	// ttl, if its current value is old, and reports whether it was
+	// replaced. It must be atomic: of two swaps from the same old value,
+	// at most one succeeds.
+	CompareAndSwap(ctx context.Context, key string, old, value []byte, ttl time.Duration) (bool, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// KVCounter is a KVStore that also keeps named counters of members that
+// expire, such as the outstanding contexts of a binding. KVContextStore
+// needs it for BindingLimits, and uses it in Cleanup and Stats.
+type KVCounter interface {
+	// CounterAdd drops the members of counter name expired at now, then
+	// adds member, expiring at expiresAt, unless limit members remain.
+	// It reports whether member was added, and must be atomic: of two
+	// adds racing for the last place, at most one succeeds.
+	CounterAdd(ctx context.Context, name, member string, expiresAt, now time.Time, limit int) (bool, error)
+	// CounterRemove removes member from counter name. Removing a missing
+	// member is not an error.
+	CounterRemove(ctx context.Context, name, member string) error
+	// CounterLen returns the number of members of counter name not yet
+	// dropped, expired or not.
+	CounterLen(ctx context.Context, name string) (int, error)
+	// CounterSweep drops the members expired at now from every counter
+	// and returns the number dropped.
+	CounterSweep(ctx context.Context, now time.Time) (int, error)
+	// CounterCounts returns the number of members unexpired at now of
+	// every counter holding any, by name.
+	CounterCounts(ctx context.Context, now time.Time) (map[string]int, error)
+}
+
+// KVScanner is a KVStore that can list its keys. KVContextStore needs it
+// for Iterate and InvalidateByBinding.
+type KVScanner interface {
+	// Scan calls fn with every key and its value until fn returns an
+	// error or ctx is cancelled, and returns that error. Keys changed
+	// during the scan may be visited with either value, more than once,
+	// or not at all.
+	Scan(ctx context.Context, fn func(key string, value []byte) error) error
+}
+
+// KVCompareAndDeleter is a KVStore that can delete a key only if it holds
+// a given value. KVContextStore uses it in ReleaseContext, which
+// otherwise marks the record released before deleting it.
+type KVCompareAndDeleter interface {
+	// CompareAndDelete deletes key if its current value is old, and
+	// reports whether it was deleted. It must be atomic with
+	// CompareAndSwap.
+	CompareAndDelete(ctx context.Context, key string, old []byte) (bool, error)
+}
+
+// KVContextStoreOptions configures a KVContextStore.
+type KVContextStoreOptions struct {
+	// Now returns the current time (default: time.Now).
+	Now func() time.Time
+	// ConsumedRetention keeps consumed contexts for this long after they
+	// are consumed, even past their expiry, so that replaying them fails
+	// with ErrReplayDetected rather than ErrInvalidContext (0: consumed
+	// contexts expire with their TTL).
+	ConsumedRetention time.Duration
+	// BindingLimits caps the number of outstanding (unconsumed, unexpired)
+	// contexts per binding. See BindingLimits. The KVStore must be a
+	// KVCounter.
+	BindingLimits BindingLimits
+}
+
+// KVContextStore is a ContextStore over a KVStore. It is also a
+// ReservingStore, a ReleasingStore and a StatsStore and, if the KVStore is
+// a KVScanner, an IteratingStore and an InvalidatingStore; otherwise
+// Iterate and InvalidateByBinding fail.
+//
+// Each context is one record holding the context and any reservation,
+// stored as JSON (RedisStore keeps its hash layout instead) and expiring
+// with the context or, once consumed, at the end of the ConsumedRetention
+// window. Every change is a compare-and-swap from the
+// record it was decided on, retried on conflict, so consumption is atomic
+// across instances.
+//
+// With BindingLimits, Create adds each context of a limited binding to the
+// binding's counter before storing it, and consuming or releasing the
+// context removes it afterwards. Should that removal fail, the context
+// stays counted until it expires and Create or Cleanup drops it.
+//
+// RedisStore is a KVContextStore over a KVStore with every capability.
+type KVContextStore struct {
+	kv      KVStore
+	counter KVCounter
+	scanner KVScanner
+	deleter KVCompareAndDeleter
+	records kvRecordCodec
+	// name names the store in errors.
+	name      string
+	limits    *bindingLimiter
+	now       func() time.Time
+	retention int64
+
+	// rateLimited counts the Create calls this instance had rejected,
+	// released the contexts it released, and expired the expired
+	// contexts its Cleanup dropped from counters.
+	rateLimited atomic.Int64
+	released    atomic.Int64
+	expired     atomic.Int64
+}
+
+// NewKVContextStore creates a ContextStore over kv. It panics if a
+// BindingLimits pattern is invalid, or if there are BindingLimits and kv
+// is not a KVCounter.
+func NewKVContextStore(kv KVStore, opts KVContextStoreOptions) *KVContextStore {
+	return newKVContextStore(kv, opts, jsonRecords{}, "kv")
+}
+
+// newKVContextStore creates a KVContextStore storing records with codec.
+func newKVContextStore(kv KVStore, opts KVContextStoreOptions, codec kvRecordCodec, name string) *KVContextStore {
+	s := &KVContextStore{
+		kv:        kv,
+		records:   codec,
+		name:      name,
+		limits:    opts.BindingLimits.mustCompile(),
+		now:       opts.Now,
+		retention: opts.ConsumedRetention.Milliseconds(),
+	}
+	s.counter, _ = kv.(KVCounter)
+	s.scanner, _ = kv.(KVScanner)
+	s.deleter, _ = kv.(KVCompareAndDeleter)
+	if s.counter == nil && len(opts.BindingLimits) > 0 {
+		panic("ash: BindingLimits need a KVStore that is a KVCounter")
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+	return s
+}
+
+// kvRecord is the stored form of a context.
+type kvRecord struct {
+	Context       *Context `json:"context"`
+	Reservation   string   `json:"reservation,omitempty"`
+	ReservedUntil int64    `json:"reservedUntil,omitempty"`
+	// Released marks a context deleted by ReleaseContext until the record
+	// itself is deleted.
+	Released bool `json:"released,omitempty"`
+}
+
+// kvRecordCodec encodes records as KVStore values.
+type kvRecordCodec interface {
+	encode(r *kvRecord) ([]byte, error)
+	decode(data []byte) (*kvRecord, error)
+}
+
+// jsonRecords is the kvRecordCodec of NewKVContextStore.
+type jsonRecords struct{}
+
+func (jsonRecords) encode(r *kvRecord) ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func (jsonRecords) decode(data []byte) (*kvRecord, error) {
+	var r kvRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	if r.Context == nil {
+		return nil, errors.New("no context")
+	}
+	return &r, nil
+}
+
+// errKVUnchanged is returned by a KVContextStore.update function to leave
+// the record as it is.
+var errKVUnchanged = errors.New("ash: record unchanged")
+
+// consumedRetention returns KVContextStoreOptions.ConsumedRetention.
+func (s *KVContextStore) consumedRetention() time.Duration {
+	return time.Duration(s.retention) * time.Millisecond
+}
+
+// Create issues and stores a new context.
+func (s *KVContextStore) Create(opts ContextOptions) (*Context, error) {
+	now := s.now()
+	ctx, err := newContext(opts, now)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.records.encode(&kvRecord{Context: ctx})
+	if err != nil {
+		return nil, fmt.Errorf("ash: %s create: %w", s.name, err)
+	}
+	if err := s.count(ctx, now); err != nil {
+		return nil, err
+	}
+	ok, err := s.kv.SetNX(context.Background(), ctx.ID, data, opts.TTL)
+	if err == nil && !ok {
+		err = fmt.Errorf("context ID %s already exists", ctx.ID)
+	}
+	if err != nil {
+		s.uncount(ctx)
+		return nil, fmt.Errorf("ash: %s create: %w", s.name, err)
+	}
+	return ctx, nil
+}
+
+// count adds ctx to its binding's counter if the binding has a limit. It
+// fails with errBindingLimit if the limit is reached.
+func (s *KVContextStore) count(ctx *Context, now time.Time) error {
+	limit := s.limits.limitFor(ctx.Binding)
+	if limit == 0 {
+		return nil
+	}
+	ok, err := s.counter.CounterAdd(context.Background(), ctx.Binding, ctx.ID, time.UnixMilli(ctx.ExpiresAt), now, limit)
+	if err != nil {
+		return fmt.Errorf("ash: %s create: %w", s.name, err)
+	}
+	if !ok {
+		s.rateLimited.Add(1)
+		return errBindingLimit
+	}
+	return nil
+}
+
+// uncount removes ctx from its binding's counter if the binding has a
+// limit. The change that ended the context is already decided, so a
+// failure only leaves it counted until it expires.
+func (s *KVContextStore) uncount(ctx *Context) {
+	if s.limits.limitFor(ctx.Binding) > 0 {
+		s.counter.CounterRemove(context.Background(), ctx.Binding, ctx.ID)
+	}
+}
+
+// Get returns the context with the given ID.
+func (s *KVContextStore) Get(id string) (*Context, error) {
+	_, r, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return r.Context, nil
+}
+
+// get returns the stored record of id and its decoded form.
+func (s *KVContextStore) get(id string) ([]byte, *kvRecord, error) {
+	data, err := s.kv.Get(context.Background(), id)
+	if errors.Is(err, ErrKVNotFound) {
+		return nil, nil, errContextNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("ash: %s get: %w", s.name, err)
+	}
+	r, err := s.records.decode(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ash: %s get: invalid record for %s: %w", s.name, id, err)
+	}
+	if r.Released {
+		return nil, nil, errContextNotFound
+	}
+	return data, r, nil
+}
+
+// update applies fn to the record of id and swaps the result in, starting
+// over from the new record if another instance changed it first. It
+// returns the record swapped in.
+func (s *KVContextStore) update(id string, fn func(r *kvRecord, now int64) error) (*kvRecord, error) {
+	for {
+		old, r, err := s.get(id)
+		if err != nil {
+			return nil, err
+		}
+		now := s.now().UnixMilli()
+		if err := fn(r, now); err != nil {
+			return nil, err
+		}
+		data, err := s.records.encode(r)
+		if err != nil {
+			return nil, fmt.Errorf("ash: %s update: %w", s.name, err)
+		}
+		ok, err := s.kv.CompareAndSwap(context.Background(), id, old, data, s.ttl(r, now))
+		if err != nil {
+			return nil, fmt.Errorf("ash: %s update: %w", s.name, err)
+		}
+		if ok {
+			return r, nil
+		}
+	}
+}
+
+// ttl returns how long the record r should be kept from now: until the
+// context expires, extended for consumed contexts to the end of the
+// ConsumedRetention window. It is at least a millisecond, since a record
+// swapped in must not expire before it is written.
+func (s *KVContextStore) ttl(r *kvRecord, now int64) time.Duration {
+	until := r.Context.ExpiresAt
+	if r.Context.Used && r.Context.ConsumedAt+s.retention > until {
+		until = r.Context.ConsumedAt + s.retention
+	}
+	return time.Duration(max(until-now, 1)) * time.Millisecond
+}
+
+// usable checks that the context of r is unused, unexpired and not
+// reserved at now.
+func (r *kvRecord) usable(now int64) error {
+	switch {
+	case r.Context.Used:
+		return errContextUsed
+	case now >= r.Context.ExpiresAt:
+		return errContextExpired
+	case r.Reservation != "" && now < r.ReservedUntil:
+		return errContextInUse
+	}
+	return nil
+}
+
+// consume marks the context of r used at now.
+func (r *kvRecord) consume(now int64) {
+	r.Context.Used = true
+	r.Context.ConsumedAt = now
+	r.Reservation, r.ReservedUntil = "", 0
+}
+
+// Consume marks the context as used.
+func (s *KVContextStore) Consume(id string) error {
+	r, err := s.update(id, func(r *kvRecord, now int64) error {
+		if err := r.usable(now); err != nil {
+			return err
+		}
+		r.consume(now)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.uncount(r.Context)
+	return nil
+}
+
+// Reserve holds the context for up to ttl. See ReservingStore.
+func (s *KVContextStore) Reserve(id string, ttl time.Duration) (string, error) {
+	token, err := newReservationToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = s.update(id, func(r *kvRecord, now int64) error {
+		if err := r.usable(now); err != nil {
+			return err
+		}
+		r.Reservation, r.ReservedUntil = token, now+ttl.Milliseconds()
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Release ends a reservation, leaving the context usable.
+func (s *KVContextStore) Release(id, token string) error {
+	_, err := s.update(id, func(r *kvRecord, now int64) error {
+		if r.Reservation != token {
+			return errKVUnchanged
+		}
+		r.Reservation, r.ReservedUntil = "", 0
+		return nil
+	})
+	if err == errKVUnchanged || err == errContextNotFound {
+		return nil
+	}
+	return err
+}
+
+// ConsumeReserved marks a reserved context as used.
+func (s *KVContextStore) ConsumeReserved(id, token string) error {
+	r, err := s.update(id, func(r *kvRecord, now int64) error {
+		if r.Context.Used {
+			return errContextUsed
+		}
+		if r.Reservation != token {
+			return errReservationLost
+		}
+		r.consume(now)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.uncount(r.Context)
+	return nil
+}
+
+// ReleaseContext deletes an unconsumed context. See ReleasingStore.
+//
+// Unless the KVStore is a KVCompareAndDeleter, the record is first marked
+// released, which decides the race with a concurrent Consume, then
+// deleted.
+func (s *KVContextStore) ReleaseContext(id string) error {
+	var r *kvRecord
+	var err error
+	if s.deleter != nil {
+		r, err = s.remove(id)
+	} else {
+		r, err = s.update(id, func(r *kvRecord, now int64) error {
+			if err := r.usable(now); err != nil {
+				return err
+			}
+			r.Released = true
+			return nil
+		})
+		if err == nil {
+			if err := s.kv.Delete(context.Background(), id); err != nil {
+				return fmt.Errorf("ash: %s delete: %w", s.name, err)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	s.uncount(r.Context)
+	s.released.Add(1)
+	return nil
+}
+
+// remove deletes the record of id if its context is usable, starting over
+// from the new record if another instance changed it first. It returns
+// the record deleted.
+func (s *KVContextStore) remove(id string) (*kvRecord, error) {
+	for {
+		old, r, err := s.get(id)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.usable(s.now().UnixMilli()); err != nil {
+			return nil, err
+		}
+		ok, err := s.deleter.CompareAndDelete(context.Background(), id, old)
+		if err != nil {
+			return nil, fmt.Errorf("ash: %s delete: %w", s.name, err)
+		}
+		if ok {
+			return r, nil
+		}
+	}
+}
+
+// Iterate calls fn with every stored context. See IteratingStore. It
+// fails unless the KVStore is a KVScanner.
+func (s *KVContextStore) Iterate(ctx context.Context, fn func(*Context) error) error {
+	if s.scanner == nil {
+		return fmt.Errorf("ash: %s iterate: the KVStore is not a KVScanner", s.name)
+	}
+	var stop error
+	err := s.scanner.Scan(ctx, func(key string, data []byte) error {
+		r, err := s.records.decode(data)
+		if err != nil {
+			return fmt.Errorf("invalid record for %s: %w", key, err)
+		}
+		if r.Released {
+			return nil
+		}
+		stop = fn(r.Context)
+		return stop
+	})
+	if err != nil && err != stop && err != ctx.Err() {
+		return fmt.Errorf("ash: %s iterate: %w", s.name, err)
+	}
+	return err
+}
+
+// InvalidateByBinding consumes every usable context of binding. See
+// InvalidatingStore. It fails unless the KVStore is a KVScanner.
+//
+// It scans every record, as Iterate does, and consumes the matches one by
+// one, so its cost grows with the number of stored contexts, not the
+// number invalidated: keep it for incident response rather than routine
+// use.
+func (s *KVContextStore) InvalidateByBinding(binding string) (int, error) {
+	if s.scanner == nil {
+		return 0, fmt.Errorf("ash: %s invalidate: the KVStore is not a KVScanner", s.name)
+	}
+	invalidated := 0
+	matches := func(r *kvRecord, now int64) bool {
+		return r.Context.Binding == binding && !r.Context.Used && now < r.Context.ExpiresAt
+	}
+	var stop error
+	err := s.scanner.Scan(context.Background(), func(key string, data []byte) error {
+		r, err := s.records.decode(data)
+		if err != nil {
+			return fmt.Errorf("invalid record for %s: %w", key, err)
+		}
+		if r.Released || !matches(r, s.now().UnixMilli()) {
+			return nil
+		}
+		r, err = s.update(key, func(r *kvRecord, now int64) error {
+			if !matches(r, now) {
+				return errKVUnchanged
+			}
+			r.consume(now)
+			return nil
+		})
+		switch err {
+		case nil:
+			s.uncount(r.Context)
+			invalidated++
+		case errKVUnchanged, errContextNotFound:
+		default:
+			stop = err
+			return err
+		}
+		return nil
+	})
+	if err != nil && err != stop {
+		return invalidated, fmt.Errorf("ash: %s invalidate: %w", s.name, err)
+	}
+	return invalidated, err
+}
+
+// Cleanup drops expired contexts from the binding counters and returns the
+// number dropped. Records expire through the KVStore, so without a
+// KVCounter it does nothing and returns 0.
+func (s *KVContextStore) Cleanup() (int, error) {
+	if s.counter == nil {
+		return 0, nil
+	}
+	n, err := s.counter.CounterSweep(context.Background(), s.now())
+	if err != nil {
+		return 0, fmt.Errorf("ash: %s cleanup: %w", s.name, err)
+	}
+	s.expired.Add(int64(n))
+	return n, nil
+}
+
+// Stats reports the outstanding contexts of every binding with a limit,
+// from the counters, and the ErrRateLimited rejections and releases by
+// this instance since it was created. Expired counts the contexts of
+// bindings with a limit that this instance's Cleanup found expired. See
+// StatsStore.
+//
+// ActiveContexts is not reported, since counting contexts would mean
+// scanning every record. The KVStore expires records itself, so there are
+// no evictions, and MaxContexts is not supported.
+func (s *KVContextStore) Stats(ctx context.Context) (Stats, error) {
+	stats := Stats{
+		RateLimited: s.rateLimited.Load(),
+		Released:    s.released.Load(),
+		Expired:     s.expired.Load(),
+	}
+	if s.counter == nil {
+		return stats, nil
+	}
+	counts, err := s.counter.CounterCounts(ctx, s.now())
+	if err != nil {
+		return Stats{}, fmt.Errorf("ash: %s stats: %w", s.name, err)
+	}
+	stats.PerBinding = make(map[string]BindingStats, len(counts))
+	for binding, n := range counts {
+		stats.PerBinding[binding] = BindingStats{Count: n, Limit: s.limits.limitFor(binding)}
+	}
+	return stats, nil
+}
+
+// Outstanding returns the number of unconsumed contexts counted against a
+// binding's limit that have not yet been dropped by Create or Cleanup.
+// It is always 0 for bindings without a limit.
+func (s *KVContextStore) Outstanding(binding string) (int, error) {
+	if s.counter == nil {
+		return 0, nil
+	}
+	n, err := s.counter.CounterLen(context.Background(), binding)
+	if err != nil {
+		return 0, fmt.Errorf("ash: %s outstanding: %w", s.name, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,192 @@
+package ash
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memKV is an in-memory KVStore whose keys expire by its clock.
+type memKV struct {
+	mu       sync.Mutex
+	values   map[string][]byte
+	expireAt map[string]time.Time
+	now      func() time.Time
+	swaps    int
+}
+
+func newMemKV(now func() time.Time) *memKV {
+	return &memKV{values: make(map[string][]byte), expireAt: make(map[string]time.Time), now: now}
+}
+
+// lookup returns the value of key unless it has expired. The caller must
+// hold kv.mu.
+func (kv *memKV) lookup(key string) ([]byte, bool) {
+	value, ok := kv.values[key]
+	if ok && !kv.now().Before(kv.expireAt[key]) {
+		delete(kv.values, key)
+		return nil, false
+	}
+	return value, ok
+}
+
+func (kv *memKV) set(key string, value []byte, ttl time.Duration) {
+	kv.values[key] = value
+	kv.expireAt[key] = kv.now().Add(ttl)
+}
+
+func (kv *memKV) Get(_ context.Context, key string) ([]byte, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	value, ok := kv.lookup(key)
+	if !ok {
+		return nil, ErrKVNotFound
+	}
+	return value, nil
+}
+
+func (kv *memKV) SetNX(_ context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if _, ok := kv.lookup(key); ok {
+		return false, nil
+	}
+	kv.set(key, value, ttl)
+	return true, nil
+}
+
+func (kv *memKV) CompareAndSwap(_ context.Context, key string, old, value []byte, ttl time.Duration) (bool, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if current, ok := kv.lookup(key); !ok || !bytes.Equal(current, old) {
+		return false, nil
+	}
+	kv.set(key, value, ttl)
+	kv.swaps++
+	return true, nil
+}
+
+func (kv *memKV) Delete(_ context.Context, key string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	delete(kv.values, key)
+	return nil
+}
+
+// TestKVContextStoreContract tests KVContextStore over an in-memory
+// KVStore and over RedisKV against the ContextStore contract.
+func TestKVContextStoreContract(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		now := time.UnixMilli(1700000000000)
+		clock := func() time.Time { return now }
+		store := NewKVContextStore(newMemKV(clock), KVContextStoreOptions{Now: clock})
+		testContextStore(t, store, func(d time.Duration) { now = now.Add(d) })
+	})
+	t.Run("redis", func(t *testing.T) {
+		now := time.UnixMilli(1700000000000)
+		clock := func() time.Time { return now }
+		client := newFakeRedis()
+		client.now = clock
+		store := NewKVContextStore(NewRedisKV(client, ""), KVContextStoreOptions{Now: clock})
+		testContextStore(t, store, func(d time.Duration) { now = now.Add(d) })
+		for key := range client.strings {
+			if !strings.HasPrefix(key, DefaultRedisKeyPrefix+"kv:") {
+				t.Errorf("Key %q lacks the default prefix", key)
+			}
+		}
+	})
+}
+
+// TestKVContextStoreReserve tests KVContextStore reservations.
+func TestKVContextStoreReserve(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	clock := func() time.Time { return now }
+	store := NewKVContextStore(newMemKV(clock), KVContextStoreOptions{Now: clock})
+	testReservingStore(t, store, func(d time.Duration) { now = now.Add(d) })
+}
+
+// TestKVContextStoreConsumedRetention tests KVContextStore consumed-context
+// retention.
+func TestKVContextStoreConsumedRetention(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	clock := func() time.Time { return now }
+	store := NewKVContextStore(newMemKV(clock), KVContextStoreOptions{Now: clock, ConsumedRetention: time.Minute})
+	testConsumedRetention(t, store, clock, func(d time.Duration) { now = now.Add(d) })
+}
+
+// TestKVContextStoreConflict tests that an update losing a swap to another
+// instance is decided again on the new record.
+func TestKVContextStoreConflict(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	clock := func() time.Time { return now }
+	kv := newMemKV(clock)
+	store := NewKVContextStore(kv, KVContextStoreOptions{Now: clock})
+	ctx, err := store.Create(ContextOptions{Binding: "POST /api/test", TTL: time.Minute})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// Another instance consumes the context between this instance's read
+	// and its swap.
+	racing := &racingKV{memKV: kv, race: func() {
+		if err := store.Consume(ctx.ID); err != nil {
+			t.Errorf("Racing consume failed: %v", err)
+		}
+	}}
+	err = NewKVContextStore(racing, KVContextStoreOptions{Now: clock}).Consume(ctx.ID)
+	if !errors.Is(err, ErrReplayDetected) {
+		t.Errorf("Expected %s after losing the race, got %v", ErrReplayDetected, err)
+	}
+	if kv.swaps != 1 {
+		t.Errorf("Swaps = %d, want 1", kv.swaps)
+	}
+}
+
+// racingKV runs race once before its first swap.
+type racingKV struct {
+	*memKV
+	race func()
+}
+
+func (kv *racingKV) CompareAndSwap(ctx context.Context, key string, old, value []byte, ttl time.Duration) (bool, error) {
+	if race := kv.race; race != nil {
+		kv.race = nil
+		race()
+	}
+	return kv.memKV.CompareAndSwap(ctx, key, old, value, ttl)
+}
+
+// TestKVContextStoreCapabilities tests a KVContextStore over a KVStore
+// without the optional capabilities, which RedisStore tests with them.
+func TestKVContextStoreCapabilities(t *testing.T) {
+	kv := newMemKV(time.Now)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected a panic for BindingLimits without a KVCounter")
+			}
+		}()
+		NewKVContextStore(kv, KVContextStoreOptions{BindingLimits: BindingLimits{"POST /api/*": 1}})
+	}()
+
+	store := NewKVContextStore(kv, KVContextStoreOptions{})
+	if err := store.Iterate(context.Background(), func(*Context) error { return nil }); err == nil {
+		t.Error("Expected Iterate to fail without a KVScanner")
+	}
+	if _, err := store.InvalidateByBinding("POST /api/test"); err == nil {
+		t.Error("Expected InvalidateByBinding to fail without a KVScanner")
+	}
+	if n, err := store.Cleanup(); n != 0 || err != nil {
+		t.Errorf("Cleanup() = %d, %v; want 0, nil", n, err)
+	}
+	if n, err := store.Outstanding("POST /api/test"); n != 0 || err != nil {
+		t.Errorf("Outstanding() = %d, %v; want 0, nil", n, err)
+	}
+	if stats, err := store.Stats(context.Background()); err != nil || stats.PerBinding != nil {
+		t.Errorf("Stats() = %+v, %v; want no per-binding counts", stats, err)
+	}
+}
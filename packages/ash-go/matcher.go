@@ -0,0 +1,189 @@
+package ash
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidPattern is returned for a binding pattern that cannot match.
+var ErrInvalidPattern = errors.New("invalid binding pattern")
+
+// Kinds of pattern segment, in order of decreasing specificity.
+const (
+	segLiteral = iota
+	segOne
+	segMany
+)
+
+// patternSegment is one path segment of a binding pattern.
+type patternSegment struct {
+	kind    int
+	literal string
+}
+
+// bindingPattern is a compiled binding pattern.
+type bindingPattern struct {
+	raw      string
+	method   string // "" for any method
+	segments []patternSegment
+}
+
+// BindingMatcher matches requests against binding patterns such as
+//
+//	POST /api/login
+//	POST /api/*
+//	* /admin/**
+//	/health
+//
+// A pattern is a method (or "*" for any method) followed by a path; a
+// pattern with no method matches any method. In the path, a "*" segment
+// matches exactly one path segment and a final "**" segment matches one or
+// more. Wildcards must be whole segments.
+//
+// When several patterns match, the most specific wins: paths are compared
+// segment by segment from the left, a literal beating "*" and "*" beating
+// "**"; then a named method beats any method; then the pattern given first
+// wins.
+type BindingMatcher struct {
+	patterns []bindingPattern
+}
+
+// NewBindingMatcher compiles patterns, returning an ErrInvalidPattern error
+// for any malformed one.
+func NewBindingMatcher(patterns ...string) (*BindingMatcher, error) {
+	m := &BindingMatcher{patterns: make([]bindingPattern, 0, len(patterns))}
+	for _, raw := range patterns {
+		p, err := compilePattern(raw)
+		if err != nil {
+			return nil, err
+		}
+		m.patterns = append(m.patterns, p)
+	}
+	return m, nil
+}
+
+// MustBindingMatcher is like NewBindingMatcher but panics on a malformed
+// pattern.
+func MustBindingMatcher(patterns ...string) *BindingMatcher {
+	m, err := NewBindingMatcher(patterns...)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// compilePattern parses one pattern.
+func compilePattern(raw string) (bindingPattern, error) {
+	p := bindingPattern{raw: raw}
+	path := raw
+	if method, rest, ok := strings.Cut(raw, " "); ok {
+		if method == "" || method != "*" && !isMethodToken(method) {
+			return p, fmt.Errorf("%w: %q: bad method", ErrInvalidPattern, raw)
+		}
+		if method != "*" {
+			p.method = strings.ToUpper(method)
+		}
+		path = rest
+	}
+	if !strings.HasPrefix(path, "/") {
+		return p, fmt.Errorf("%w: %q: path must start with /", ErrInvalidPattern, raw)
+	}
+	parts := strings.Split(path[1:], "/")
+	for i, part := range parts {
+		switch {
+		case part == "*":
+			p.segments = append(p.segments, patternSegment{kind: segOne})
+		case part == "**":
+			if i != len(parts)-1 {
+				return p, fmt.Errorf("%w: %q: ** must be the last segment", ErrInvalidPattern, raw)
+			}
+			p.segments = append(p.segments, patternSegment{kind: segMany})
+		case strings.Contains(part, "*"):
+			return p, fmt.Errorf("%w: %q: wildcards must be whole segments", ErrInvalidPattern, raw)
+		case strings.ContainsAny(part, " \t"):
+			return p, fmt.Errorf("%w: %q: path contains whitespace", ErrInvalidPattern, raw)
+		default:
+			p.segments = append(p.segments, patternSegment{literal: part})
+		}
+	}
+	return p, nil
+}
+
+// isMethodToken reports whether s is a plausible HTTP method.
+func isMethodToken(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('A' <= c && c <= 'Z' || 'a' <= c && c <= 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// Match returns the most specific pattern matching the request. The path
+// is normalized as NormalizeBinding does, so every path with the same
+// binding matches the same pattern.
+func (m *BindingMatcher) Match(method, path string) (pattern string, ok bool) {
+	if !strings.HasPrefix(path, "/") {
+		return "", false
+	}
+	path = NormalizeBinding("", path)[1:]
+	parts := strings.Split(path[1:], "/")
+	var best *bindingPattern
+	for i := range m.patterns {
+		p := &m.patterns[i]
+		if !p.matches(method, parts) {
+			continue
+		}
+		if best == nil || p.moreSpecific(best) {
+			best = p
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.raw, true
+}
+
+// MatchBinding is Match for a "METHOD /path" binding.
+func (m *BindingMatcher) MatchBinding(binding string) (pattern string, ok bool) {
+	method, path, found := strings.Cut(binding, " ")
+	if !found {
+		return "", false
+	}
+	return m.Match(method, path)
+}
+
+// matches reports whether p matches a request.
+func (p *bindingPattern) matches(method string, parts []string) bool {
+	if p.method != "" && !strings.EqualFold(p.method, method) {
+		return false
+	}
+	for i, seg := range p.segments {
+		switch seg.kind {
+		case segMany:
+			return len(parts) > i
+		case segOne:
+			if i >= len(parts) {
+				return false
+			}
+		default:
+			if i >= len(parts) || parts[i] != seg.literal {
+				return false
+			}
+		}
+	}
+	return len(parts) == len(p.segments)
+}
+
+// moreSpecific reports whether p is strictly more specific than q.
+func (p *bindingPattern) moreSpecific(q *bindingPattern) bool {
+	for i := 0; i < len(p.segments) && i < len(q.segments); i++ {
+		if a, b := p.segments[i].kind, q.segments[i].kind; a != b {
+			return a < b
+		}
+	}
+	// Both matched the same path, so equal prefixes imply equal lengths.
+	return p.method != "" && q.method == ""
+}
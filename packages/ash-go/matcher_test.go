@@ -0,0 +1,107 @@
+package ash
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestBindingMatcherMatch tests wildcard matching and precedence among
+// overlapping patterns.
+func TestBindingMatcherMatch(t *testing.T) {
+	m := MustBindingMatcher(
+		"POST /api/*",
+		"POST /api/login",
+		"* /api/login",
+		"POST /api/**",
+		"* /admin/**",
+		"GET /admin/*/settings",
+		"* /admin/users/*",
+		"/health",
+		"GET /",
+		"/files/*/meta",
+		"/files/a/*",
+	)
+	tests := []struct {
+		method, path string
+		want         string
+	}{
+		// Exact beats wildcards; a named method beats "*".
+		{"POST", "/api/login", "POST /api/login"},
+		{"GET", "/api/login", "* /api/login"},
+		// "*" matches one segment and beats "**".
+		{"POST", "/api/orders", "POST /api/*"},
+		{"POST", "/api/orders/42", "POST /api/**"},
+		{"POST", "/api", ""},
+		{"GET", "/api/orders", ""},
+		// "**" matches one or more segments.
+		{"DELETE", "/admin/x", "* /admin/**"},
+		{"DELETE", "/admin/x/y/z", "* /admin/**"},
+		{"GET", "/admin", ""},
+		// Leftmost difference decides.
+		{"GET", "/admin/users/settings", "* /admin/users/*"},
+		{"GET", "/admin/roles/settings", "GET /admin/*/settings"},
+		{"POST", "/admin/roles/settings", "* /admin/**"},
+		{"GET", "/files/a/meta", "/files/a/*"},
+		{"GET", "/files/b/meta", "/files/*/meta"},
+		// Method-less patterns match any method; methods ignore case.
+		{"PUT", "/health", "/health"},
+		{"get", "/", "GET /"},
+		{"GET", "/healthz", ""},
+		{"GET", "health", ""},
+		// Paths are normalized as bindings are.
+		{"POST", "/api/login/", "POST /api/login"},
+		{"POST", "//api//login", "POST /api/login"},
+		{"POST", "/api/login?next=/", "POST /api/login"},
+		{"DELETE", "//admin", ""},
+	}
+	for _, tt := range tests {
+		got, ok := m.Match(tt.method, tt.path)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("Match(%q, %q) = %q, %v; want %q", tt.method, tt.path, got, ok, tt.want)
+		}
+	}
+	if got, _ := m.MatchBinding("POST /api/orders"); got != "POST /api/*" {
+		t.Errorf("MatchBinding = %q, want %q", got, "POST /api/*")
+	}
+}
+
+// TestBindingMatcherOrder tests that equally specific patterns resolve to
+// the first given.
+func TestBindingMatcherOrder(t *testing.T) {
+	for _, patterns := range [][]string{
+		{"* /a/*", "/a/*"},
+		{"/a/*", "* /a/*"},
+	} {
+		if got, _ := MustBindingMatcher(patterns...).Match("GET", "/a/b"); got != patterns[0] {
+			t.Errorf("Match with %q = %q, want %q", patterns, got, patterns[0])
+		}
+	}
+}
+
+// TestBindingMatcherInvalid tests that malformed patterns are rejected.
+func TestBindingMatcherInvalid(t *testing.T) {
+	for _, pattern := range []string{
+		"",
+		"api/*",
+		"POST api/*",
+		" /api",
+		"PO$T /api",
+		"POST /api/ord*",
+		"POST /api/**/x",
+		"POST /api/***",
+		"POST /api/a b",
+	} {
+		if _, err := NewBindingMatcher(pattern); !errors.Is(err, ErrInvalidPattern) {
+			t.Errorf("NewBindingMatcher(%q) = %v, want ErrInvalidPattern", pattern, err)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected HTTPMiddleware to panic on an invalid pattern")
+		}
+	}()
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	a.HTTPMiddleware(MiddlewareOptions{Protected: []string{"/api/v*"}})
+}
@@ -0,0 +1,40 @@
+package ash
+
+import "strconv"
+
+// DefaultMaxParams is the default limit on the number of parameters in a
+// URL-encoded payload or fields in a multipart form.
+const DefaultMaxParams = 4096
+
+// WithMaxParams sets the number of parameters, or multipart fields, a form
+// may have before canonicalization rejects it with an ErrMalformedRequest
+// AshError (default: DefaultMaxParams). Zero or less removes the limit.
+// The limit is checked while parsing, so that a body of a million pairs
+// is rejected before they are normalized and sorted.
+func WithMaxParams(n int) CanonicalizeOption {
+	return func(o *canonicalizeOptions) { o.maxParams = n }
+}
+
+// WithMaxURLEncodedParams sets the WithMaxParams limit applied during
+// verification (default: DefaultMaxParams).
+func WithMaxURLEncodedParams(n int) Option {
+	return func(a *Ash) { a.maxParams, a.maxParamsSet = n, true }
+}
+
+// tooManyParams is the error for a form with more than limit parameters.
+func tooManyParams(limit int) *AshError {
+	return &AshError{
+		Code:    ErrMalformedRequest,
+		Message: "more than " + strconv.Itoa(limit) + " form parameters",
+		Reason:  ReasonTooManyParams,
+	}
+}
+
+// checkParams returns an error if a form already holding n parameters
+// may not have another.
+func (o *canonicalizeOptions) checkParams(n int) error {
+	if o.maxParams > 0 && n >= o.maxParams {
+		return tooManyParams(o.maxParams)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package ash
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// manyParams returns a URL-encoded body of n pairs.
+func manyParams(n int) string {
+	return strings.Repeat("a=1&", n-1) + "a=1"
+}
+
+// TestMaxParams tests the limit on the number of form parameters.
+func TestMaxParams(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		opts  []CanonicalizeOption
+		ok    bool
+	}{
+		{"at default", manyParams(DefaultMaxParams), nil, true},
+		{"above default", manyParams(DefaultMaxParams + 1), nil, false},
+		{"million pairs", manyParams(1000000), nil, false},
+		{"empty parts not counted", manyParams(3) + strings.Repeat("&", 10), []CanonicalizeOption{WithMaxParams(3)}, true},
+		{"empty keys not counted", manyParams(3) + "&=1&=2", []CanonicalizeOption{WithMaxParams(3)}, true},
+		{"above custom", manyParams(4), []CanonicalizeOption{WithMaxParams(3)}, false},
+		{"no limit", manyParams(DefaultMaxParams + 1), []CanonicalizeOption{WithMaxParams(0)}, true},
+	}
+	for _, tt := range tests {
+		_, err := CanonicalizeURLEncoded(tt.input, tt.opts...)
+		if tt.ok && err != nil {
+			t.Errorf("%s: CanonicalizeURLEncoded failed: %v", tt.name, err)
+		}
+		var ashErr *AshError
+		if !tt.ok && (!errors.As(err, &ashErr) || ashErr.Code != ErrMalformedRequest || ashErr.Reason != ReasonTooManyParams) {
+			t.Errorf("%s: CanonicalizeURLEncoded = %v, want %s", tt.name, err, ReasonTooManyParams)
+		}
+	}
+
+	body, _ := multipartForm(t, "a", "1", "b", "2", "c", "3")
+	if _, err := CanonicalizeMultipartForm([]byte(body), "ash-test-boundary", WithMaxParams(2)); !errors.Is(err, ErrMalformedRequest) {
+		t.Errorf("CanonicalizeMultipartForm = %v, want %s", err, ErrMalformedRequest)
+	}
+
+	// Rejecting a million pairs does not parse them all.
+	input := manyParams(1000000)
+	allocs := testing.AllocsPerRun(5, func() { CanonicalizeURLEncoded(input) })
+	if allocs > 100 {
+		t.Errorf("Rejecting a million pairs made %v allocations", allocs)
+	}
+}
+
+// TestVerifyMaxParams tests the limit configured for verification.
+func TestVerifyMaxParams(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithMaxURLEncodedParams(10))
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for n, want := range map[int]int{10: http.StatusOK, 11: http.StatusBadRequest} {
+		req := signedRequest(t, a, "POST", "/api/form", manyParams(n), "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%d pairs: status %d, want %d: %s", n, rec.Code, want, rec.Body)
+		}
+		if want != http.StatusOK && decodeError(t, rec).Code != ErrMalformedRequest {
+			t.Errorf("%d pairs: %s, want %s", n, rec.Body, ErrMalformedRequest)
+		}
+	}
+}
+
+// BenchmarkCanonicalizeURLEncodedTooManyParams measures the rejection of a
+// body of a million pairs, which stops at the limit.
+func BenchmarkCanonicalizeURLEncodedTooManyParams(b *testing.B) {
+	input := manyParams(1000000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := CanonicalizeURLEncoded(input); err == nil {
+			b.Fatal("CanonicalizeURLEncoded succeeded")
+		}
+	}
+}
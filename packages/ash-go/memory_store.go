@@ -0,0 +1,516 @@
+package ash
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStoreOptions configures a MemoryStore.
+type MemoryStoreOptions struct {
+	// CleanupInterval is the interval for automatic cleanup (0 to disable).
+	CleanupInterval time.Duration
+	// Cleanup configures the batching of automatic cleanup.
+	Cleanup CleanupOptions
+	// Now returns the current time (default: time.Now).
+	Now func() time.Time
+	// BindingLimits caps the number of outstanding (unconsumed, unexpired)
+	// contexts per binding. See BindingLimits.
+	BindingLimits BindingLimits
+	// ConsumedRetention keeps consumed contexts for this long after they
+	// are consumed, even past their expiry, so that replaying them fails
+	// with ErrReplayDetected rather than ErrInvalidContext (0: consumed
+	// contexts are removed when they expire).
+	ConsumedRetention time.Duration
+	// MaxContexts is a soft cap on the number of stored contexts (0: no
+	// cap). At the cap, Create first evicts the contexts Cleanup would
+	// remove. If there are none, it evicts consumed contexts, including
+	// those kept for ConsumedRetention, whose replays then fail with
+	// ErrInvalidContext. It fails with ErrRateLimited only if that frees no
+	// room. Contexts that can still be verified are never evicted.
+	MaxContexts int
+}
+
+// MemoryStore is an in-memory ContextStore.
+//
+// Suitable for development and single-instance deployments.
+// For production with multiple instances, use a shared store.
+type MemoryStore struct {
+	mu           sync.RWMutex
+	contexts     map[string]*Context
+	outstanding  map[string]int
+	reservations map[string]reservation
+	limits       *bindingLimiter
+	now          func() time.Time
+	retention    int64
+	maxContexts  int
+
+	// nextEvict is the time in Unix milliseconds before which an eviction
+	// pass cannot free anything, and 0 once a consumption may have.
+	nextEvict   int64
+	evictions   int64
+	rateLimited int64
+	released    int64
+	expired     int64
+
+	// nonceMu guards bindingNonces, the nonces of WithBindingNonceWindow,
+	// and nonceSweepAt, the size at which they are next swept.
+	nonceMu       sync.Mutex
+	bindingNonces map[string]bindingNonce
+	nonceSweepAt  int
+
+	// ctx is cancelled by Close to stop the janitor.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// DefaultCleanupBatchSize is the default number of contexts deleted per
+// write-locked batch.
+const DefaultCleanupBatchSize = 1000
+
+// CleanupOptions configures MemoryStore.CleanupBatched.
+type CleanupOptions struct {
+	// BatchSize is the number of contexts deleted per write-locked batch
+	// (default: DefaultCleanupBatchSize).
+	BatchSize int
+	// Pause is an optional sleep between batches, to leave the lock free
+	// for verifications during a large cleanup.
+	Pause time.Duration
+}
+
+// CleanupResult reports the outcome of MemoryStore.CleanupBatched.
+type CleanupResult struct {
+	// Removed is the number of contexts removed.
+	Removed int
+	// Remaining is the number of contexts left in the store when cleanup
+	// finished, expired or not. It is an estimate under concurrent use.
+	Remaining int
+}
+
+// NewMemoryStore creates a new in-memory store. It panics if a
+// BindingLimits pattern is invalid.
+func NewMemoryStore(opts MemoryStoreOptions) *MemoryStore {
+	s := &MemoryStore{
+		contexts:      make(map[string]*Context),
+		outstanding:   make(map[string]int),
+		reservations:  make(map[string]reservation),
+		bindingNonces: make(map[string]bindingNonce),
+		limits:        opts.BindingLimits.mustCompile(),
+		now:           opts.Now,
+		retention:     opts.ConsumedRetention.Milliseconds(),
+		maxContexts:   opts.MaxContexts,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if s.now == nil {
+		s.now = time.Now
+	}
+	if opts.CleanupInterval > 0 {
+		go s.janitor(opts.CleanupInterval, opts.Cleanup)
+	}
+	return s
+}
+
+// janitor periodically removes expired contexts until Close is called.
+func (s *MemoryStore) janitor(interval time.Duration, opts CleanupOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.CleanupBatched(s.ctx, opts)
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// Create issues and stores a new context.
+func (s *MemoryStore) Create(opts ContextOptions) (*Context, error) {
+	now := s.now()
+	ctx, err := newContext(opts, now)
+	if err != nil {
+		return nil, err
+	}
+	ctx.deadline = contextDeadline(now, ctx.ExpiresAt)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if limit := s.limits.limitFor(ctx.Binding); limit > 0 && s.outstanding[ctx.Binding] >= limit {
+		if s.reclaim(ctx.Binding, now); s.outstanding[ctx.Binding] >= limit {
+			s.rateLimited++
+			return nil, errBindingLimit
+		}
+	}
+	if s.maxContexts > 0 && len(s.contexts) >= s.maxContexts {
+		s.evict(now)
+		if len(s.contexts) >= s.maxContexts {
+			s.rateLimited++
+			return nil, errStoreFull
+		}
+	}
+	s.contexts[ctx.ID] = ctx.Clone()
+	s.outstanding[ctx.Binding]++
+	if ctx.ExpiresAt < s.nextEvict {
+		s.nextEvict = ctx.ExpiresAt
+	}
+	return ctx, nil
+}
+
+// errStoreFull is returned by Create when MaxContexts is reached.
+var errStoreFull = NewAshError(ErrRateLimited, "too many stored contexts")
+
+// evict removes the contexts Cleanup would remove (see removable). Only if
+// that frees nothing are consumed contexts evicted as a last resort, even
+// those kept for ConsumedRetention, so that a replay of one fails with
+// ErrInvalidContext rather than ErrReplayDetected. Passes that cannot free
+// anything are skipped until the earliest expiry or the next consumption,
+// so a full store of live contexts does not scan on every Create. The
+// caller must hold s.mu.
+func (s *MemoryStore) evict(now time.Time) {
+	if now.UnixMilli() < s.nextEvict {
+		return
+	}
+	s.nextEvict = 0
+	var next int64
+	freed, consumed := 0, 0
+	for _, c := range s.contexts {
+		switch {
+		case s.removable(c, now):
+			s.remove(c)
+			s.evictions++
+			freed++
+		case c.Used:
+			consumed++
+		case next == 0 || c.ExpiresAt < next:
+			next = c.ExpiresAt
+		}
+	}
+	if consumed == 0 {
+		s.nextEvict = next
+		return
+	}
+	if freed > 0 {
+		return
+	}
+	for _, c := range s.contexts {
+		if c.Used {
+			s.remove(c)
+			s.evictions++
+		}
+	}
+	s.nextEvict = next
+}
+
+// reclaim removes the expired, unconsumed contexts of binding, which still
+// count against its limit when no cleanup has run since they expired. The
+// caller must hold s.mu.
+func (s *MemoryStore) reclaim(binding string, now time.Time) {
+	for _, c := range s.contexts {
+		if c.Binding == binding && !c.Used && c.expired(now) {
+			s.remove(c)
+		}
+	}
+}
+
+// remove deletes c, which is consumed or expired, from the store. The
+// caller must hold s.mu.
+func (s *MemoryStore) remove(c *Context) {
+	delete(s.contexts, c.ID)
+	delete(s.reservations, c.ID)
+	if !c.Used {
+		s.release(c.Binding)
+		s.expired++
+	}
+}
+
+// release decrements the outstanding count of a binding. The caller must
+// hold s.mu.
+func (s *MemoryStore) release(binding string) {
+	if s.outstanding[binding] <= 1 {
+		delete(s.outstanding, binding)
+		return
+	}
+	s.outstanding[binding]--
+}
+
+// Get returns the context with the given ID.
+func (s *MemoryStore) Get(id string) (*Context, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ctx, ok := s.contexts[id]
+	if !ok {
+		return nil, errContextNotFound
+	}
+	return ctx.Clone(), nil
+}
+
+// consumedRetention returns MemoryStoreOptions.ConsumedRetention.
+func (s *MemoryStore) consumedRetention() time.Duration {
+	return time.Duration(s.retention) * time.Millisecond
+}
+
+// reservation is a MemoryStore reservation.
+type reservation struct {
+	token string
+	until int64
+}
+
+// Consume marks the context as used.
+func (s *MemoryStore) Consume(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ctx, err := s.usable(id)
+	if err != nil {
+		return err
+	}
+	s.consume(ctx)
+	return nil
+}
+
+// usable returns the context if it is unused, unexpired and not reserved.
+// The caller must hold s.mu.
+func (s *MemoryStore) usable(id string) (*Context, error) {
+	ctx, ok := s.contexts[id]
+	if !ok {
+		return nil, errContextNotFound
+	}
+	if ctx.Used {
+		return nil, errContextUsed
+	}
+	now := s.now()
+	if ctx.expired(now) {
+		return nil, errContextExpired
+	}
+	if r, ok := s.reservations[id]; ok && now.UnixMilli() < r.until {
+		return nil, errContextInUse
+	}
+	return ctx, nil
+}
+
+// consume marks ctx used. The caller must hold s.mu.
+func (s *MemoryStore) consume(ctx *Context) {
+	ctx.Used = true
+	ctx.ConsumedAt = s.now().UnixMilli()
+	delete(s.reservations, ctx.ID)
+	s.release(ctx.Binding)
+	s.nextEvict = 0
+}
+
+// Reserve holds the context for up to ttl. See ReservingStore.
+func (s *MemoryStore) Reserve(id string, ttl time.Duration) (string, error) {
+	token, err := newReservationToken()
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.usable(id); err != nil {
+		return "", err
+	}
+	s.reservations[id] = reservation{token: token, until: s.now().Add(ttl).UnixMilli()}
+	return token, nil
+}
+
+// Release ends a reservation, leaving the context usable.
+func (s *MemoryStore) Release(id, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.reservations[id]; ok && r.token == token {
+		delete(s.reservations, id)
+	}
+	return nil
+}
+
+// ConsumeReserved marks a reserved context as used.
+func (s *MemoryStore) ConsumeReserved(id, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ctx, ok := s.contexts[id]
+	if !ok {
+		return errContextNotFound
+	}
+	if ctx.Used {
+		return errContextUsed
+	}
+	if r, ok := s.reservations[id]; !ok || r.token != token {
+		return errReservationLost
+	}
+	s.consume(ctx)
+	return nil
+}
+
+// ReleaseContext deletes an unconsumed context. See ReleasingStore.
+func (s *MemoryStore) ReleaseContext(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ctx, err := s.usable(id)
+	if err != nil {
+		return err
+	}
+	delete(s.contexts, id)
+	delete(s.reservations, id)
+	s.release(ctx.Binding)
+	s.released++
+	return nil
+}
+
+// removable reports whether c may be removed at now: once it expires,
+// and for consumed contexts also once the ConsumedRetention window ends.
+func (s *MemoryStore) removable(c *Context, now time.Time) bool {
+	if c.Used && now.UnixMilli() < c.ConsumedAt+s.retention {
+		return false
+	}
+	return c.expired(now)
+}
+
+// Cleanup removes expired contexts and returns the number removed. It is
+// CleanupBatched with default options.
+func (s *MemoryStore) Cleanup() (int, error) {
+	result, err := s.CleanupBatched(context.Background(), CleanupOptions{})
+	return result.Removed, err
+}
+
+// CleanupBatched removes expired contexts without holding the write lock
+// for the whole store: expired IDs are collected under the read lock, which
+// lookups share, then deleted in write-locked batches of opts.BatchSize,
+// pausing opts.Pause between batches.
+//
+// It stops early with ctx.Err() when ctx is cancelled; contexts removed so
+// far are reported. Binding nonces that are no longer current (see
+// WithBindingNonceWindow) are dropped first.
+func (s *MemoryStore) CleanupBatched(ctx context.Context, opts CleanupOptions) (CleanupResult, error) {
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultCleanupBatchSize
+	}
+	now := s.now()
+	s.sweepBindingNonces(now)
+
+	s.mu.RLock()
+	var expired []string
+	for id, c := range s.contexts {
+		if s.removable(c, now) {
+			expired = append(expired, id)
+		}
+	}
+	s.mu.RUnlock()
+
+	var result CleanupResult
+	for len(expired) > 0 {
+		if err := ctx.Err(); err != nil {
+			result.Remaining = s.Size()
+			return result, err
+		}
+		n := min(batchSize, len(expired))
+		result.Removed += s.deleteExpired(expired[:n], now)
+		expired = expired[n:]
+
+		if opts.Pause > 0 && len(expired) > 0 {
+			select {
+			case <-time.After(opts.Pause):
+			case <-ctx.Done():
+			}
+		}
+	}
+	result.Remaining = s.Size()
+	return result, nil
+}
+
+// deleteExpired deletes the given contexts that are still present and
+// expired at now, and returns the number deleted.
+func (s *MemoryStore) deleteExpired(ids []string, now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for _, id := range ids {
+		c, ok := s.contexts[id]
+		if !ok || !s.removable(c, now) {
+			continue
+		}
+		s.remove(c)
+		removed++
+	}
+	return removed
+}
+
+// InvalidateByBinding consumes every usable context of binding. See
+// InvalidatingStore. It holds the write lock while it walks the store.
+func (s *MemoryStore) InvalidateByBinding(binding string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	invalidated := 0
+	for _, c := range s.contexts {
+		if c.Binding == binding && !c.Used && !c.expired(now) {
+			s.consume(c)
+			invalidated++
+		}
+	}
+	return invalidated, nil
+}
+
+// Iterate calls fn with a copy of every stored context. See
+// IteratingStore. The contexts are copied under the read lock, and fn is
+// called without holding it.
+func (s *MemoryStore) Iterate(ctx context.Context, fn func(*Context) error) error {
+	s.mu.RLock()
+	contexts := make([]*Context, 0, len(s.contexts))
+	for _, c := range s.contexts {
+		contexts = append(contexts, c.Clone())
+	}
+	s.mu.RUnlock()
+
+	for _, c := range contexts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Outstanding returns the number of unconsumed contexts for a binding that
+// have not yet been removed by Cleanup.
+func (s *MemoryStore) Outstanding(binding string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.outstanding[binding]
+}
+
+// Stats reports the stored contexts against MaxContexts, the outstanding
+// contexts of each binding against its limit, and the evictions,
+// ErrRateLimited rejections, releases and expirations since the store was
+// created. See StatsStore.
+func (s *MemoryStore) Stats(context.Context) (Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	active := len(s.contexts)
+	stats := Stats{
+		ActiveContexts: &active,
+		MaxContexts:    s.maxContexts,
+		PerBinding:     make(map[string]BindingStats, len(s.outstanding)),
+		Evictions:      s.evictions,
+		RateLimited:    s.rateLimited,
+		Released:       s.released,
+		Expired:        s.expired,
+	}
+	for binding, n := range s.outstanding {
+		stats.PerBinding[binding] = BindingStats{Count: n, Limit: s.limits.limitFor(binding)}
+	}
+	return stats, nil
+}
+
+// Size returns the number of stored contexts.
+func (s *MemoryStore) Size() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.contexts)
+}
+
+// Close stops the cleanup goroutine, cancelling a cleanup in progress.
+func (s *MemoryStore) Close() error {
+	s.cancel()
+	return nil
+}
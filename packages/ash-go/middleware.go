@@ -0,0 +1,600 @@
+package ash
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header names for the ASH protocol.
+const (
+	// HeaderContextID carries the context ID.
+	HeaderContextID = "X-ASH-Context-ID"
+	// HeaderContextToken carries a context token (see
+	// WithContextTokenSecret), which names the context in place of
+	// HeaderContextID.
+	HeaderContextToken = "X-ASH-Context-Token"
+	// HeaderProof carries the proof.
+	HeaderProof = "X-ASH-Proof"
+	// HeaderBinding optionally carries the binding the client signed. It is
+	// a diagnostic hint only and never used for verification.
+	HeaderBinding = "X-ASH-Binding"
+	// HeaderLength optionally carries the canonical payload length the
+	// client signed, for contexts with IncludeLength. Like HeaderBinding it
+	// is a diagnostic hint: the proof itself binds the length.
+	HeaderLength = "X-ASH-Length"
+	// HeaderMode optionally carries the mode the client built its proof
+	// with. A mode other than the context's fails with ErrModeViolation
+	// before the proof is compared; the proof is always checked under the
+	// context's stored mode.
+	HeaderMode = "X-ASH-Mode"
+	// HeaderExtensions carries the extensions the client bound into its
+	// proof, as key=value pairs joined by '&' with each key and value
+	// query-escaped. The server verifies the proof over them, so the
+	// header cannot add or change an extension.
+	HeaderExtensions = "X-ASH-Extensions"
+)
+
+// The header names in canonical form, which http.Header looks up without
+// allocating.
+var (
+	headerContextID    = http.CanonicalHeaderKey(HeaderContextID)
+	headerContextToken = http.CanonicalHeaderKey(HeaderContextToken)
+	headerProof        = http.CanonicalHeaderKey(HeaderProof)
+	headerBinding      = http.CanonicalHeaderKey(HeaderBinding)
+	headerLength       = http.CanonicalHeaderKey(HeaderLength)
+	headerMode         = http.CanonicalHeaderKey(HeaderMode)
+	headerExtensions   = http.CanonicalHeaderKey(HeaderExtensions)
+)
+
+// ashHeaders lists the ASH headers, each of which a request may carry at
+// most once.
+var ashHeaders = [...]string{headerContextID, headerContextToken, headerProof, headerBinding, headerLength, headerMode, headerExtensions}
+
+// checkDuplicateHeaders fails with ErrMalformedRequest if h carries an ASH
+// header more than once. Header.Get would read only the first value, and a
+// proxy may read another, so such a request is ambiguous.
+func checkDuplicateHeaders(h http.Header) *AshError {
+	for _, name := range ashHeaders {
+		if len(h[name]) > 1 {
+			return NewAshError(ErrMalformedRequest, "duplicate "+name+" header")
+		}
+	}
+	return nil
+}
+
+// DefaultMaxBodyBytes is the default limit on request bodies read for
+// verification.
+const DefaultMaxBodyBytes = 1 << 20
+
+// WithMaxBodyBytes limits the size of request bodies read for verification
+// (default: DefaultMaxBodyBytes).
+func WithMaxBodyBytes(n int64) Option {
+	return func(a *Ash) { a.maxBodyBytes = n }
+}
+
+// DefaultBodylessMethods are the methods whose requests are verified
+// without a body read when they carry no body. See WithBodylessMethods.
+var DefaultBodylessMethods = []string{"GET", "HEAD", "DELETE"}
+
+// WithBodylessMethods sets the methods whose requests, when they carry no
+// body, are verified against the empty payload without reading or
+// replacing r.Body (default: DefaultBodylessMethods). A request in the set
+// that does carry a body, such as a DELETE with a body, is read and
+// verified as usual, so its body never reaches the handler unverified.
+// With no methods, every body is read.
+func WithBodylessMethods(methods ...string) Option {
+	return func(a *Ash) {
+		a.bodylessMethods = make(map[string]bool, len(methods))
+		for _, m := range methods {
+			a.bodylessMethods[strings.ToUpper(m)] = true
+		}
+	}
+}
+
+// bodyless reports whether r can be verified without reading its body.
+func (a *Ash) bodyless(r *http.Request) bool {
+	return (r.Body == nil || r.Body == http.NoBody) && a.bodylessMethods[strings.ToUpper(r.Method)]
+}
+
+// verifiedKey is the request context key for verification state.
+type verifiedKey struct{}
+
+// verifiedRequest is the verification state attached to a request.
+type verifiedRequest struct {
+	result       *VerifyResult
+	body         []byte
+	contextID    string
+	contextToken string
+	proof        string
+}
+
+// ResultFromContext returns the verification result attached by
+// HTTPMiddleware.
+func ResultFromContext(ctx context.Context) (*VerifyResult, bool) {
+	v, ok := ctx.Value(verifiedKey{}).(*verifiedRequest)
+	if !ok {
+		return nil, false
+	}
+	return v.result, true
+}
+
+// VerifiedBytes returns the exact body bytes the proof was verified
+// against, or nil if the request was not successfully verified by
+// HTTPMiddleware.
+//
+// Handlers should consume these bytes rather than re-reading r.Body, so
+// that what they process is guaranteed to be what was verified even if a
+// later component replaces the body. The returned slice must not be
+// modified.
+func VerifiedBytes(r *http.Request) []byte {
+	v, ok := r.Context().Value(verifiedKey{}).(*verifiedRequest)
+	if !ok || !v.result.Valid {
+		return nil
+	}
+	return v.body
+}
+
+// errBodyTooLarge is returned when a body exceeds the configured limit.
+var errBodyTooLarge = NewAshError(ErrMalformedRequest, "request body too large")
+
+// readBody reads the request body up to the configured limit. A body that
+// declares a larger Content-Length is rejected without reading it; a body
+// of unknown length, such as a chunked one, is read no further than one
+// byte past the limit.
+func (a *Ash) readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	defer r.Body.Close()
+	if r.ContentLength > a.maxBodyBytes {
+		return nil, errBodyTooLarge
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, a.maxBodyBytes+1))
+	if err != nil {
+		return nil, NewAshError(ErrMalformedRequest, "failed to read request body")
+	}
+	if int64(len(body)) > a.maxBodyBytes {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
+// setBody replaces the request body with a reader over body and makes the
+// framing fields agree with it.
+func setBody(r *http.Request, body []byte) {
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// VerifyRequest verifies an HTTP request against the store, consuming its
+// context on success. The binding is BindingFromRequest(r).
+//
+// The body is read in full and r.Body is replaced with a reader over the
+// bytes that were verified, unless the request has no body and its method
+// is bodyless (see WithBodylessMethods).
+//
+// Verification is idempotent within a request: if HTTPMiddleware already
+// verified r, VerifyRequest returns that outcome without touching the store,
+// provided the context ID and proof headers are unchanged. If they were
+// changed, it fails with ErrMalformedRequest, as it does if r carries an ASH
+// header more than once.
+func (a *Ash) VerifyRequest(r *http.Request) (*VerifyResult, error) {
+	result, _, err := a.verifyRequest(r, BindingFromRequest(r))
+	return result, err
+}
+
+// verifyRequest implements VerifyRequest with the given binding, and also
+// returns the body bytes that were verified.
+//
+// A panic during verification, such as from a misbehaving store, is logged
+// with its stack and reported as ErrInternalError, so the client sees only
+// a generic error.
+func (a *Ash) verifyRequest(r *http.Request, binding string, opts ...VerifyOption) (result *VerifyResult, body []byte, err error) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		if p == http.ErrAbortHandler {
+			panic(p)
+		}
+		a.logger.Error("ash: panic during verification", "binding", binding,
+			"contextId", r.Header.Get(headerContextID), "panic", p, "stack", string(debug.Stack()))
+		result = &VerifyResult{ContextID: r.Header.Get(headerContextID), Binding: binding}
+		result, err = result.fail(errVerifyPanic)
+		a.recordVerify(result)
+		body = nil
+	}()
+
+	if v, ok := r.Context().Value(verifiedKey{}).(*verifiedRequest); ok {
+		return a.reverify(r, v)
+	}
+
+	contextID, stage, headerErr := a.requestContextID(r)
+	if dupErr := checkDuplicateHeaders(r.Header); dupErr != nil {
+		stage, headerErr = StageHeadersPresent, dupErr
+	}
+	exts, extErr := parseExtensionsHeader(r.Header.Get(headerExtensions))
+	if headerErr == nil && extErr != nil {
+		stage, headerErr = StageHeadersPresent, extErr
+	}
+	if headerErr != nil {
+		result := &VerifyResult{ContextID: contextID, Binding: binding}
+		result, err = result.failAt(stage, headerErr)
+		a.recordVerify(result)
+		return result, nil, err
+	}
+	if !a.bodyless(r) {
+		body, err = a.readBody(r)
+		if err != nil {
+			result := &VerifyResult{ContextID: contextID, Binding: binding}
+			result, err = result.fail(err)
+			a.recordVerify(result)
+			return result, nil, err
+		}
+		setBody(r, body)
+	} else if r.Body == nil {
+		r.Body = http.NoBody
+	}
+
+	var requestOpts []VerifyOption
+	if len(exts) > 0 {
+		requestOpts = append(requestOpts, WithExtensions(exts...))
+	}
+	if tenant := a.tenantFor(r); tenant != "" {
+		requestOpts = append(requestOpts, WithTenant(tenant))
+	}
+	if salt := a.sessionSaltFor(r); len(salt) > 0 {
+		requestOpts = append(requestOpts, WithSessionSalt(salt))
+	}
+	if length := r.Header.Get(headerLength); length != "" {
+		if n, err := strconv.Atoi(length); err == nil && n >= 0 {
+			requestOpts = append(requestOpts, WithDeclaredLength(n))
+		}
+	}
+	if mode := r.Header.Get(headerMode); mode != "" {
+		requestOpts = append(requestOpts, WithDeclaredMode(AshMode(mode)))
+	}
+	if a.trustedCanonical(r, body) {
+		requestOpts = append(requestOpts, withTrustedCanonical())
+	}
+	result, err = a.Verify(
+		contextID,
+		r.Header.Get(headerProof),
+		binding,
+		body,
+		r.Header.Get("Content-Type"),
+		append(requestOpts, opts...)...,
+	)
+	return result, body, err
+}
+
+// errVerifyPanic is the cause recorded for a panic during verification.
+// It is not an AshError, so it is reported as ErrInternalError.
+var errVerifyPanic = errors.New("ash: panic during verification")
+
+// reverify handles verification of a request that was already verified.
+func (a *Ash) reverify(r *http.Request, v *verifiedRequest) (*VerifyResult, []byte, error) {
+	if r.Header.Get(headerContextID) != v.contextID || r.Header.Get(headerContextToken) != v.contextToken ||
+		r.Header.Get(headerProof) != v.proof {
+		result := &VerifyResult{ContextID: r.Header.Get(headerContextID), Binding: v.result.Binding}
+		result, err := result.fail(NewAshError(ErrMalformedRequest, "request already verified with different headers"))
+		a.recordVerify(result)
+		return result, nil, err
+	}
+	setBody(r, v.body)
+	if !v.result.Valid {
+		return v.result, nil, NewAshError(v.result.Code, v.result.Message)
+	}
+	return v.result, v.body, nil
+}
+
+// MiddlewareOptions configures HTTPMiddleware.
+type MiddlewareOptions struct {
+	// Protected lists the BindingMatcher patterns of requests that require
+	// verification, such as "/api/**" or "POST /api/orders/*/items". When
+	// empty, every request is verified. A final "*" segment keeps the
+	// prefix meaning these lists had before BindingMatcher: "/api/*"
+	// matches every path under "/api/", as "/api/**" does.
+	Protected []string
+	// Exempt lists the patterns of requests that are not verified even
+	// though they match Protected, such as a public "/api/health" under a
+	// protected "/api/**". Exempt takes precedence: a request matching both
+	// is unprotected. A final "*" segment matches by prefix, as in
+	// Protected.
+	Exempt []string
+	// PathHeader names a header carrying the path the client requested,
+	// such as "X-Forwarded-Path" or "X-Original-URI", for use behind a
+	// proxy that rewrites paths. When set and present, the binding is
+	// built from its path instead of r.URL.Path; Protected and Exempt
+	// still match the request path.
+	//
+	// Only set it when every request arrives through a proxy that sets
+	// or overwrites the header: a client that can set it can choose the
+	// binding its proof is checked against.
+	PathHeader string
+	// RoutePattern builds the binding from the http.ServeMux pattern that
+	// routed the request (r.Pattern, Go 1.23+) instead of its path, so
+	// that "POST /api/orders/{id}" yields one binding for every order that
+	// contexts can be issued for ahead of time. The middleware must wrap
+	// the handler registered with the mux, not the mux itself. Requests
+	// without a pattern, including every request before Go 1.23 or under
+	// the pre-1.22 mux, fall back to the path. It takes precedence over
+	// PathHeader.
+	//
+	// The proof then covers the pattern, not the path parameters: contexts
+	// pinning Params cannot be verified this way.
+	RoutePattern bool
+	// EncodedSlashes sets whether an encoded slash (%2F) in the path is a
+	// separator in the binding (default: EncodedSlashesDecode). It applies
+	// to the path from r.URL and from PathHeader; see RequestPath. Clients
+	// must build the binding the same way.
+	EncodedSlashes EncodedSlashes
+	// Unprotected sets what happens when a request to an unprotected path
+	// carries ASH headers (default: UnprotectedIgnore).
+	Unprotected UnprotectedAction
+	// DeferConsume consumes a verified request's context only if the
+	// handler succeeds. The context is reserved while the handler runs, so
+	// a parallel request using it fails with ErrReplayDetected, and is
+	// consumed if the handler writes a 2xx or 3xx status (or nothing).
+	// Otherwise, including when the handler panics, the reservation is
+	// released and the client may retry with the same context and proof.
+	// The store must be a ReservingStore.
+	//
+	// The reservation is not extended while the handler runs. A handler
+	// that runs longer than ReservationTTL loses it, and a replay of the
+	// request may then run the handler a second time; the loss is logged
+	// and counted in the replayed expvar counter.
+	DeferConsume bool
+	// ReservationTTL bounds how long a DeferConsume reservation is held
+	// if it is never released (default: DefaultReservationTTL). It must
+	// exceed the longest handler run, which is best bounded with a
+	// request timeout such as http.TimeoutHandler.
+	ReservationTTL time.Duration
+}
+
+// UnprotectedAction is the handling of ASH headers on unprotected paths.
+type UnprotectedAction int
+
+const (
+	// UnprotectedIgnore passes the request through untouched.
+	UnprotectedIgnore UnprotectedAction = iota
+	// UnprotectedWarn logs a warning naming the request's binding and the
+	// binding the client claims in X-ASH-Binding, and counts the request
+	// in the unprotectedSigned expvar counter.
+	UnprotectedWarn
+	// UnprotectedVerify verifies the request without enforcing the
+	// outcome: the result, valid or not, is available through
+	// ResultFromContext, and the handler always runs. The context is
+	// consumed on success. Bodies over the size limit are still rejected
+	// with 413, as they cannot be passed on intact.
+	UnprotectedVerify
+)
+
+// bindingOptions returns the BindingFromRequest options of the middleware.
+func (o *MiddlewareOptions) bindingOptions() []BindingOption {
+	opts := []BindingOption{BindingEncodedSlashes(o.EncodedSlashes)}
+	if o.PathHeader != "" {
+		opts = append(opts, BindingPathHeader(o.PathHeader))
+	}
+	if o.RoutePattern {
+		opts = append(opts, BindingRoutePattern())
+	}
+	return opts
+}
+
+// patternPath returns the path of a ServeMux pattern such as
+// "POST example.com/api/orders/{id}", without any trailing "{$}".
+func patternPath(pattern string) string {
+	if i := strings.IndexAny(pattern, " \t"); i >= 0 {
+		pattern = strings.TrimLeft(pattern[i:], " \t")
+	}
+	if i := strings.Index(pattern, "/"); i > 0 {
+		pattern = pattern[i:]
+	}
+	return strings.TrimSuffix(pattern, "{$}")
+}
+
+// hasASHHeaders reports whether r carries ASH headers.
+func hasASHHeaders(r *http.Request) bool {
+	return r.Header.Get(headerContextID) != "" || r.Header.Get(headerContextToken) != "" || r.Header.Get(headerProof) != ""
+}
+
+// protection is the compiled Protected and Exempt lists.
+type protection struct {
+	protected *BindingMatcher // nil when every request is protected
+	exempt    *BindingMatcher
+}
+
+// compile compiles the Protected and Exempt patterns.
+func (o *MiddlewareOptions) compile() (*protection, error) {
+	p := &protection{}
+	var err error
+	if len(o.Protected) > 0 {
+		if p.protected, err = NewBindingMatcher(prefixPatterns(o.Protected)...); err != nil {
+			return nil, err
+		}
+	}
+	if p.exempt, err = NewBindingMatcher(prefixPatterns(o.Exempt)...); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// prefixPatterns rewrites a final "*" segment to "**", so that patterns
+// written for the prefix matching of earlier releases keep matching every
+// path under their prefix.
+func prefixPatterns(patterns []string) []string {
+	out := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/*") {
+			pattern += "*"
+		}
+		out[i] = pattern
+	}
+	return out
+}
+
+// isProtected reports whether a request requires verification: it matches
+// Protected (or Protected is empty) and does not match Exempt. The path is
+// normalized as NormalizeBinding does (see BindingMatcher.Match).
+func (p *protection) isProtected(method, path string) bool {
+	if _, ok := p.exempt.Match(method, path); ok {
+		return false
+	}
+	if p.protected == nil {
+		return true
+	}
+	_, ok := p.protected.Match(method, path)
+	return ok
+}
+
+// HTTPMiddleware returns middleware that verifies requests to protected
+// paths and rejects those that fail.
+//
+// On success the handler sees r.Body as a reader over exactly the verified
+// bytes (with ContentLength set to match), and can read the result with
+// ResultFromContext and the bytes with VerifiedBytes.
+//
+// It panics if a Protected or Exempt pattern is invalid, or if
+// DeferConsume is set and the store is not a ReservingStore.
+func (a *Ash) HTTPMiddleware(opts MiddlewareOptions) func(http.Handler) http.Handler {
+	protection, err := opts.compile()
+	if err != nil {
+		panic(err)
+	}
+	if _, ok := storeAs[ReservingStore](a.store); opts.DeferConsume && !ok {
+		panic("ash: DeferConsume requires a ReservingStore")
+	}
+	if opts.ReservationTTL <= 0 {
+		opts.ReservationTTL = DefaultReservationTTL
+	}
+	bindingOpts := opts.bindingOptions()
+	a.mu.Lock()
+	a.protections = append(a.protections, protection)
+	a.mu.Unlock()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Match the path the binding is built from, normalized as
+			// the binding is, so that no request whose binding is
+			// protected passes through unverified.
+			enforce := protection.isProtected(r.Method, RequestPath(r.URL, opts.EncodedSlashes))
+			if !enforce {
+				if opts.Unprotected == UnprotectedIgnore || !hasASHHeaders(r) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				if opts.Unprotected == UnprotectedWarn {
+					a.warnUnprotected(r, BindingFromRequest(r, bindingOpts...))
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			var verifyOpts []VerifyOption
+			var token *string
+			if opts.DeferConsume {
+				token = new(string)
+				verifyOpts = append(verifyOpts, withReservation(opts.ReservationTTL, token))
+			}
+			result, body, err := a.verifyRequest(r, BindingFromRequest(r, bindingOpts...), verifyOpts...)
+			if err != nil && (enforce || err == errBodyTooLarge) {
+				ashErr, _ := asAshError(err)
+				a.writeVerifyError(w, ashErr)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), verifiedKey{}, &verifiedRequest{
+				result:       result,
+				body:         body,
+				contextID:    r.Header.Get(headerContextID),
+				contextToken: r.Header.Get(headerContextToken),
+				proof:        r.Header.Get(headerProof),
+			})
+			if token != nil && *token != "" {
+				a.serveReserved(next, w, r.WithContext(ctx), result.ContextID, *token)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// warnUnprotected reports ASH headers on an unprotected path.
+func (a *Ash) warnUnprotected(r *http.Request, binding string) {
+	if a.counters != nil {
+		a.counters.unprotectedSigned.Add(1)
+	}
+	a.logger.Warn("ash: signed request to unprotected path",
+		"binding", binding,
+		"claimedBinding", r.Header.Get(headerBinding),
+		"contextId", r.Header.Get(headerContextID))
+}
+
+// WriteVerifyError writes the response HTTPMiddleware sends for a failed
+// verification: the status for the error code, and the error as JSON in
+// the form of AshError.MarshalJSON, with the docs link of WithErrorDocs
+// and canonicalization details only with debug responses. It lets
+// handlers that call Verify themselves reject requests exactly as the
+// middleware does. It writes nothing for a valid result, and responds
+// with ErrInternalError for a nil one.
+func (a *Ash) WriteVerifyError(w http.ResponseWriter, result *VerifyResult) {
+	if result == nil {
+		a.writeVerifyError(w, errNoVerifyResult)
+		return
+	}
+	if result.Valid {
+		return
+	}
+	ashErr := result.err
+	if ashErr == nil {
+		// The result was built or decoded outside verification.
+		ashErr = NewAshError(result.Code, result.Message)
+	}
+	a.writeVerifyError(w, ashErr)
+}
+
+// errNoVerifyResult is written by WriteVerifyError for a nil result.
+var errNoVerifyResult = NewAshError(ErrInternalError, "internal error")
+
+// writeVerifyError writes the response for a verification that failed
+// with err.
+func (a *Ash) writeVerifyError(w http.ResponseWriter, err *AshError) {
+	status := StatusForCode(err.Code)
+	if err == errBodyTooLarge {
+		status = http.StatusRequestEntityTooLarge
+	}
+	a.writeError(w, status, a.responseError(err))
+}
+
+// StatusForCode returns the HTTP status used for an error code.
+func StatusForCode(code AshErrorCode) int {
+	switch code {
+	case ErrMalformedRequest, ErrMissingHeaders, ErrMalformedProof, ErrCanonicalizationFailed:
+		return http.StatusBadRequest
+	case ErrUnsupportedContentType:
+		return http.StatusUnsupportedMediaType
+	case ErrReplayDetected:
+		return http.StatusConflict
+	case ErrRateLimited:
+		return http.StatusTooManyRequests
+	case ErrInternalError:
+		return http.StatusInternalServerError
+	case ErrOverloaded:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusForbidden
+	}
+}
@@ -0,0 +1,999 @@
+package ash
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedRequest issues a context for method and path and returns a request
+// carrying a valid proof for body.
+func signedRequest(t *testing.T, a *Ash, method, path, body, contentType string) *http.Request {
+	t.Helper()
+	ctx, err := a.IssueContext(ContextOptions{Binding: NormalizeBinding(method, path)})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set(HeaderContextID, ctx.ID)
+	req.Header.Set(HeaderProof, clientProof(t, ctx, body, contentType))
+	return req
+}
+
+// decodeError decodes a JSON error response.
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) *AshError {
+	t.Helper()
+	var body AshError
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode error response: %v: %s", err, rec.Body)
+	}
+	if body.Status != rec.Code {
+		t.Errorf("Error status = %d, response status %d", body.Status, rec.Code)
+	}
+	return &body
+}
+
+// TestHTTPMiddleware tests verification of protected requests.
+func TestHTTPMiddleware(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	var seen []byte
+	handler := a.HTTPMiddleware(MiddlewareOptions{Protected: []string{"/api/*"}})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen, _ = io.ReadAll(r.Body)
+			if result, ok := ResultFromContext(r.Context()); r.URL.Path != "/health" && (!ok || !result.Valid) {
+				t.Error("Expected a valid result in the request context")
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+
+	body := `{"amount": 100}`
+	req := signedRequest(t, a, "POST", "/api/transfer", body, "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if string(seen) != body {
+		t.Errorf("Handler saw body %q, want %q", seen, body)
+	}
+
+	// Replaying the same request is rejected.
+	replay := httptest.NewRequest("POST", "/api/transfer", strings.NewReader(body))
+	replay.Header = req.Header.Clone()
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, replay)
+	if rec.Code != http.StatusConflict || decodeError(t, rec).Code != ErrReplayDetected {
+		t.Errorf("Expected 409 %s, got %d: %s", ErrReplayDetected, rec.Code, rec.Body)
+	}
+
+	// Unsigned requests to protected paths are rejected.
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/transfer", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unsigned request, got %d", rec.Code)
+	}
+
+	// Unprotected paths pass through.
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for unprotected path, got %d", rec.Code)
+	}
+}
+
+// TestHTTPMiddlewareBodyLimit tests that oversized bodies are rejected.
+func TestHTTPMiddlewareBodyLimit(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithMaxBodyBytes(16))
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler should not be called")
+	}))
+
+	req := signedRequest(t, a, "POST", "/api/upload", `{"data":"`+strings.Repeat("x", 32)+`"}`, "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d", rec.Code)
+	}
+}
+
+// endlessReader yields an unbounded body and counts the bytes read from it.
+type endlessReader struct {
+	n int64
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.n += int64(len(p))
+	return len(p), nil
+}
+
+// TestHTTPMiddlewareBodyLimitChunked tests that bodies without a usable
+// Content-Length are cut off at the limit rather than read in full, and
+// that an oversized declared length is rejected before reading.
+func TestHTTPMiddlewareBodyLimitChunked(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithMaxBodyBytes(16))
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler should not be called")
+	}))
+
+	t.Run("chunked", func(t *testing.T) {
+		body := &endlessReader{}
+		req := signedRequest(t, a, "POST", "/api/upload", `{}`, "application/json")
+		req.Body = io.NopCloser(body)
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected 413, got %d", rec.Code)
+		}
+		if body.n > 17 {
+			t.Errorf("Read %d bytes of a chunked body, want at most 17", body.n)
+		}
+	})
+
+	t.Run("declared length", func(t *testing.T) {
+		body := &endlessReader{}
+		req := signedRequest(t, a, "POST", "/api/upload", `{}`, "application/json")
+		req.Body = io.NopCloser(body)
+		req.ContentLength = 1 << 30
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected 413, got %d", rec.Code)
+		}
+		if body.n != 0 {
+			t.Errorf("Read %d bytes of a body declared too large", body.n)
+		}
+	})
+
+	t.Run("server", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength != -1 {
+				t.Errorf("Server saw ContentLength %d, want -1 (chunked)", r.ContentLength)
+			}
+			handler.ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/upload"})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		payload := `{"data":"` + strings.Repeat("x", 32) + `"}`
+		// A reader without a known length makes the client send the
+		// body chunked.
+		req, _ := http.NewRequest("POST", srv.URL+"/api/upload", io.MultiReader(strings.NewReader(payload)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(HeaderContextID, ctx.ID)
+		req.Header.Set(HeaderProof, clientProof(t, ctx, payload, "application/json"))
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected 413, got %d", resp.StatusCode)
+		}
+	})
+}
+
+// TestVerifiedBodyDetectsMutation tests that a body swapped between the
+// middleware and the handler is detectable, and that the attested bytes
+// remain available.
+func TestVerifiedBodyDetectsMutation(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	body := `{"amount":100}`
+
+	// Stands in for any component that re-frames the body after
+	// verification (a proxy de-chunking differently, a body rewriter).
+	mutate := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = io.NopCloser(strings.NewReader(`{"amount":1000000}`))
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	var mutated bool
+	var attested []byte
+	final := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read, _ := io.ReadAll(r.Body)
+		attested = VerifiedBytes(r)
+		mutated = !bytes.Equal(read, attested)
+	})
+
+	req := signedRequest(t, a, "POST", "/api/transfer", body, "application/json")
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	a.HTTPMiddleware(MiddlewareOptions{})(mutate(final)).ServeHTTP(httptest.NewRecorder(), req)
+
+	if !mutated {
+		t.Error("Expected the body mutation to be detectable")
+	}
+	if string(attested) != body {
+		t.Errorf("VerifiedBytes = %q, want %q", attested, body)
+	}
+}
+
+// TestVerifyRequestRestoresBody tests that VerifyRequest leaves a body
+// matching the verified bytes.
+func TestVerifyRequestRestoresBody(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	body := "b=2&a=1"
+	req := signedRequest(t, a, "POST", "/api/form", body, "application/x-www-form-urlencoded")
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+
+	if _, err := a.VerifyRequest(req); err != nil {
+		t.Fatalf("VerifyRequest failed: %v", err)
+	}
+	read, _ := io.ReadAll(req.Body)
+	if string(read) != body {
+		t.Errorf("Restored body %q, want %q", read, body)
+	}
+	if req.ContentLength != int64(len(body)) || req.TransferEncoding != nil {
+		t.Errorf("Expected framing to match body, got ContentLength=%d TransferEncoding=%v",
+			req.ContentLength, req.TransferEncoding)
+	}
+	if VerifiedBytes(req) != nil {
+		t.Error("Expected no verified bytes outside the middleware")
+	}
+}
+
+// TestVerifyRequestBodyless tests that bodyless requests are verified
+// without touching the body, and that bodies are read otherwise.
+func TestVerifyRequestBodyless(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+
+	for _, tt := range []struct {
+		name     string
+		method   string
+		body     string
+		methods  []string
+		bodyRead bool
+	}{
+		{"GET without body", "GET", "", nil, false},
+		{"DELETE without body", "DELETE", "", nil, false},
+		{"DELETE with body", "DELETE", `{"reason":"duplicate"}`, nil, true},
+		{"POST without body", "POST", "", nil, true},
+		{"GET not configured", "GET", "", []string{"head"}, true},
+		{"HEAD configured", "HEAD", "", []string{"head"}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []Option
+			if tt.methods != nil {
+				opts = append(opts, WithBodylessMethods(tt.methods...))
+			}
+			a, _ := newTestAsh(t, now, opts...)
+			req := signedRequest(t, a, tt.method, "/api/items", tt.body, "application/json")
+			if tt.body == "" {
+				req.Body = http.NoBody
+			}
+
+			if _, err := a.VerifyRequest(req); err != nil {
+				t.Fatalf("VerifyRequest failed: %v", err)
+			}
+			if bodyRead := req.Body != http.NoBody; bodyRead != tt.bodyRead {
+				t.Errorf("Body read = %v, want %v", bodyRead, tt.bodyRead)
+			}
+			if read, _ := io.ReadAll(req.Body); string(read) != tt.body {
+				t.Errorf("Body = %q, want %q", read, tt.body)
+			}
+		})
+	}
+
+	// A body on a bodyless method is verified, not ignored.
+	a, _ := newTestAsh(t, now)
+	req := signedRequest(t, a, "DELETE", "/api/items", `{"reason":"duplicate"}`, "application/json")
+	req.Body = io.NopCloser(strings.NewReader(`{"reason":"forged"}`))
+	if _, err := a.VerifyRequest(req); !errors.Is(err, ErrIntegrityFailed) {
+		t.Errorf("VerifyRequest with substituted body = %v, want %s", err, ErrIntegrityFailed)
+	}
+}
+
+// TestVerifyRequestAfterMiddleware tests that verifying an already verified
+// request returns the cached result, and fails if the headers changed.
+func TestVerifyRequestAfterMiddleware(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	body := `{"amount":100}`
+
+	var second, tampered error
+	var result *VerifyResult
+	var reread []byte
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		result, second = a.VerifyRequest(r)
+		reread, _ = io.ReadAll(r.Body)
+
+		other := r.Clone(r.Context())
+		other.Header.Set(HeaderProof, "forged")
+		_, tampered = a.VerifyRequest(other)
+	}))
+
+	// Nesting the middleware must not consume the context twice either.
+	rec := httptest.NewRecorder()
+	a.HTTPMiddleware(MiddlewareOptions{})(handler).ServeHTTP(rec,
+		signedRequest(t, a, "POST", "/api/transfer", body, "application/json"))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if second != nil || !result.Valid {
+		t.Errorf("Second verification failed: %v", second)
+	}
+	if string(reread) != body {
+		t.Errorf("Body after second verification = %q, want %q", reread, body)
+	}
+	var ashErr *AshError
+	if !errors.As(tampered, &ashErr) || ashErr.Code != ErrMalformedRequest {
+		t.Errorf("Expected %s for changed headers, got %v", ErrMalformedRequest, tampered)
+	}
+}
+
+// TestHTTPMiddlewareDebugResponses tests that canonicalization details are
+// returned only when debug responses are enabled.
+func TestHTTPMiddlewareDebugResponses(t *testing.T) {
+	body := `{"a":[1e400]}`
+
+	for _, debug := range []bool{false, true} {
+		a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithDebugResponses(debug))
+		handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("Handler should not be called")
+		}))
+
+		rec := httptest.NewRecorder()
+		req := signedRequest(t, a, "POST", "/api/test", `{}`, "application/json")
+		req.Body = io.NopCloser(strings.NewReader(body))
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("debug=%v: expected 400, got %d", debug, rec.Code)
+		}
+		resp := decodeError(t, rec)
+		if resp.Code != ErrCanonicalizationFailed {
+			t.Errorf("debug=%v: expected %s, got %q", debug, ErrCanonicalizationFailed, resp.Code)
+		}
+		if debug {
+			if !strings.Contains(resp.Message, "invalid json.Number") || resp.Pointer != "/a/0" {
+				t.Errorf("Expected detailed error, got %v", resp)
+			}
+		} else if resp.Message != "canonicalization failed" || resp.Pointer != "" {
+			t.Errorf("Expected generic error, got %v", resp)
+		}
+	}
+}
+
+// TestHTTPMiddlewareUnprotected tests the handling of ASH headers on
+// unprotected paths.
+func TestHTTPMiddlewareUnprotected(t *testing.T) {
+	body := `{"amount":100}`
+
+	for _, tt := range []struct {
+		name       string
+		action     UnprotectedAction
+		wantResult bool
+		wantValid  bool
+		wantLog    bool
+	}{
+		{"ignore", UnprotectedIgnore, false, false, false},
+		{"warn", UnprotectedWarn, false, false, true},
+		{"verify", UnprotectedVerify, true, true, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			a, store := newTestAsh(t, time.UnixMilli(1700000000000),
+				WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+
+			var result *VerifyResult
+			var hasResult bool
+			var seen []byte
+			handler := a.HTTPMiddleware(MiddlewareOptions{Protected: []string{"/api/*"}, Unprotected: tt.action})(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					result, hasResult = ResultFromContext(r.Context())
+					seen, _ = io.ReadAll(r.Body)
+				}))
+
+			req := signedRequest(t, a, "POST", "/public/transfer", body, "application/json")
+			req.Header.Set(HeaderBinding, "POST /api/transfer")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK || string(seen) != body {
+				t.Fatalf("Expected pass-through, got %d with body %q", rec.Code, seen)
+			}
+			if hasResult != tt.wantResult || hasResult && result.Valid != tt.wantValid {
+				t.Errorf("ResultFromContext = %+v, %v", result, hasResult)
+			}
+			if got := strings.Contains(logs.String(), `claimedBinding="POST /api/transfer"`); got != tt.wantLog {
+				t.Errorf("Expected warning logged: %v, got logs %q", tt.wantLog, logs.String())
+			}
+			ctx, _ := store.Get(req.Header.Get(HeaderContextID))
+			if ctx.Used != tt.wantValid {
+				t.Errorf("Expected context used: %v", tt.wantValid)
+			}
+		})
+	}
+}
+
+// TestHTTPMiddlewareUnprotectedVerifyFailure tests that opportunistic
+// verification failures are attached but not enforced.
+func TestHTTPMiddlewareUnprotectedVerifyFailure(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+
+	var result *VerifyResult
+	var attested []byte
+	handler := a.HTTPMiddleware(MiddlewareOptions{Protected: []string{"/api/*"}, Unprotected: UnprotectedVerify})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result, _ = ResultFromContext(r.Context())
+			attested = VerifiedBytes(r)
+			if _, err := a.VerifyRequest(r); err == nil {
+				t.Error("Expected VerifyRequest to report the failure")
+			}
+		}))
+
+	// Signed for one path, sent to another.
+	req := signedRequest(t, a, "POST", "/api/transfer", `{}`, "application/json")
+	req.URL.Path = "/public/transfer"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if result == nil || result.Valid || result.Code != ErrEndpointMismatch {
+		t.Errorf("Expected attached %s result, got %+v", ErrEndpointMismatch, result)
+	}
+	if attested != nil {
+		t.Errorf("Expected no verified bytes for a failed verification, got %q", attested)
+	}
+}
+
+// TestHTTPMiddlewarePathHeader tests bindings built from a proxy header.
+func TestHTTPMiddlewarePathHeader(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	body := `{"amount":100}`
+
+	tests := []struct {
+		name     string
+		header   string
+		value    string
+		wantCode int
+	}{
+		{"forwarded path", "X-Forwarded-Path", "/api/transfer", http.StatusOK},
+		{"original URI with query", "X-Original-URI", "/api/transfer?ref=1", http.StatusOK},
+		{"header not configured", "", "/api/transfer", http.StatusForbidden},
+		{"header missing", "X-Forwarded-Path", "", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The proxy strips the /api prefix before forwarding.
+			handler := http.StripPrefix("/api", a.HTTPMiddleware(MiddlewareOptions{PathHeader: tt.header})(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+			req := signedRequest(t, a, "POST", "/api/transfer", body, "application/json")
+			if tt.value != "" {
+				req.Header.Set("X-Forwarded-Path", tt.value)
+				req.Header.Set("X-Original-URI", tt.value)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("Expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+// TestHTTPMiddlewareExempt tests that exempt rules take precedence over
+// protected ones.
+func TestHTTPMiddlewareExempt(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	handler := a.HTTPMiddleware(MiddlewareOptions{
+		Protected: []string{"/api/*"},
+		Exempt:    []string{"/api/health", "GET /api/docs/*"},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/api/health", http.StatusOK},
+		{"POST", "/api/health", http.StatusOK},
+		{"GET", "/api/health/deep", http.StatusBadRequest},
+		{"GET", "/api/docs/index", http.StatusOK},
+		{"POST", "/api/docs/index", http.StatusBadRequest},
+		{"POST", "/api/transfer", http.StatusBadRequest},
+		{"GET", "/public", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: got %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+}
+
+// TestHTTPMiddlewareProtectedNormalized tests that Protected and Exempt
+// match paths as their bindings are normalized, so that a path with a
+// protected binding cannot pass through unverified.
+func TestHTTPMiddlewareProtectedNormalized(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	for _, tt := range []struct {
+		opts  MiddlewareOptions
+		paths []string
+	}{
+		{MiddlewareOptions{Protected: []string{"POST /api/orders"}}, []string{"/api/orders/", "//api/orders", "/api//orders"}},
+		{MiddlewareOptions{Protected: []string{"/api/**"}}, []string{"//api/orders", "/api/orders/"}},
+		{MiddlewareOptions{Protected: []string{"/api/**"}, Exempt: []string{"/api/health"}}, []string{"/api/health%3Fx", "/api/health%23x"}},
+	} {
+		handler := a.HTTPMiddleware(tt.opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("%v: handler called for %s %s", tt.opts.Protected, r.Method, r.URL.Path)
+		}))
+		for _, path := range tt.paths {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("POST", path, nil))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("%v: POST %s: got %d, want 400", tt.opts.Protected, path, rec.Code)
+			}
+		}
+	}
+}
+
+// TestHTTPMiddlewareDuplicateHeaders tests that requests carrying an ASH
+// header more than once are rejected without consuming the context.
+func TestHTTPMiddlewareDuplicateHeaders(t *testing.T) {
+	a, store := newTestAsh(t, time.UnixMilli(1700000000000))
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	body := `{"amount":100}`
+
+	for _, name := range []string{HeaderProof, HeaderContextID, HeaderMode} {
+		t.Run(name, func(t *testing.T) {
+			req := signedRequest(t, a, "POST", "/api/transfer", body, "application/json")
+			value := req.Header.Get(name)
+			if value == "" {
+				value = string(ModeBalanced)
+			}
+			// The valid value comes first, as Header.Get would read it.
+			req.Header.Set(name, value)
+			req.Header.Add(name, "other")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusBadRequest || decodeError(t, rec).Code != ErrMalformedRequest {
+				t.Errorf("Expected 400 %s, got %d: %s", ErrMalformedRequest, rec.Code, rec.Body)
+			}
+			if ctx, err := store.Get(req.Header.Get(HeaderContextID)); err != nil || ctx.Used {
+				t.Errorf("Context consumed by a rejected request: %v", err)
+			}
+		})
+	}
+}
+
+// TestHTTPMiddlewareTenant tests that a context issued over HTTP to one
+// tenant is rejected on another tenant's host.
+func TestHTTPMiddlewareTenant(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000),
+		WithTenantFunc(func(r *http.Request) string { return strings.Split(r.Host, ".")[0] }))
+	body := `{"amount":100}`
+
+	rec := httptest.NewRecorder()
+	NewContextHandler(a).ServeHTTP(rec, httptest.NewRequest("GET", "http://acme.example.com/ash/context?binding=POST+/api/transfer", nil))
+	var info ContextPublicInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Failed to decode context: %v: %s", err, rec.Body)
+	}
+	proof := BuildProof(BuildProofInput{
+		Mode: info.Mode, Binding: "POST /api/transfer", ContextID: info.ContextID,
+		Tenant: "acme", CanonicalPayload: `{"amount":100}`,
+	})
+
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range []struct {
+		host string
+		want int
+	}{
+		{"globex.example.com", http.StatusForbidden},
+		{"acme.example.com", http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "http://"+tt.host+"/api/transfer", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(HeaderContextID, info.ContextID)
+		req.Header.Set(HeaderProof, proof)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: got %d, want %d: %s", tt.host, rec.Code, tt.want, rec.Body)
+		}
+	}
+}
+
+// TestHTTPMiddlewareDeferConsumeFlush tests that a handler under
+// DeferConsume can flush a streamed response.
+func TestHTTPMiddlewareDeferConsumeFlush(t *testing.T) {
+	a, store := newTestAsh(t, time.UnixMilli(1700000000000))
+	handler := a.HTTPMiddleware(MiddlewareOptions{DeferConsume: true})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			flusher, ok := w.(http.Flusher)
+			if !ok {
+				t.Fatal("ResponseWriter is not an http.Flusher")
+			}
+			io.WriteString(w, "data: 1\n\n")
+			flusher.Flush()
+		}))
+
+	req := signedRequest(t, a, "POST", "/api/events", `{}`, "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !rec.Flushed {
+		t.Errorf("Expected a flushed 200, got %d (flushed %v): %s", rec.Code, rec.Flushed, rec.Body)
+	}
+	if ctx, err := store.Get(req.Header.Get(HeaderContextID)); err != nil || !ctx.Used {
+		t.Errorf("Expected the context consumed after a flushed response, got %v", err)
+	}
+}
+
+// TestHTTPMiddlewareDeferConsume tests that a context is consumed only when
+// the handler succeeds, and is blocked while a handler runs.
+func TestHTTPMiddlewareDeferConsume(t *testing.T) {
+	a, store := newTestAsh(t, time.UnixMilli(1700000000000))
+	statuses := make(chan int, 1)
+	entered := make(chan struct{}, 1)
+	handler := a.HTTPMiddleware(MiddlewareOptions{DeferConsume: true})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entered <- struct{}{}
+			if status := <-statuses; status != http.StatusOK {
+				w.WriteHeader(status)
+			}
+		}))
+
+	body := `{"amount":100}`
+	req := signedRequest(t, a, "POST", "/api/transfer", body, "application/json")
+	contextID := req.Header.Get(HeaderContextID)
+	send := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/transfer", strings.NewReader(body))
+		r.Header = req.Header.Clone()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+	used := func() bool {
+		ctx, err := store.Get(contextID)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		return ctx.Used
+	}
+
+	// A parallel request is rejected while the handler runs, and a failed
+	// handler leaves the context usable.
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- send() }()
+	<-entered
+	if rec := send(); rec.Code != http.StatusConflict || decodeError(t, rec).Message != "context in use" {
+		t.Errorf("Expected 409 context in use during the handler, got %d: %s", rec.Code, rec.Body)
+	}
+	statuses <- http.StatusInternalServerError
+	if rec := <-done; rec.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected 500 from the handler, got %d", rec.Code)
+	}
+	if used() {
+		t.Fatal("Context consumed after the handler failed")
+	}
+
+	// A retry with the same proof succeeds and consumes the context.
+	statuses <- http.StatusOK
+	if rec := send(); rec.Code != http.StatusOK {
+		t.Fatalf("Expected retry to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+	<-entered
+	if !used() {
+		t.Error("Context not consumed after the handler succeeded")
+	}
+	if rec := send(); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a replay, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// TestHTTPMiddlewareDeferConsumePanic tests that a panicking handler
+// releases its reservation.
+func TestHTTPMiddlewareDeferConsumePanic(t *testing.T) {
+	a, store := newTestAsh(t, time.UnixMilli(1700000000000))
+	handler := a.HTTPMiddleware(MiddlewareOptions{DeferConsume: true})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { panic("boom") }))
+	req := signedRequest(t, a, "POST", "/api/transfer", `{}`, "application/json")
+
+	func() {
+		defer func() { recover() }()
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	if err := store.Consume(req.Header.Get(HeaderContextID)); err != nil {
+		t.Errorf("Expected context to be usable after a panic, got %v", err)
+	}
+}
+
+// TestHTTPMiddlewareDeferConsumeLapsed tests that a handler outliving its
+// reservation is counted as a replay when another request took the
+// context meanwhile.
+func TestHTTPMiddlewareDeferConsumeLapsed(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	clock := func() time.Time { return now }
+	store := NewMemoryStore(MemoryStoreOptions{Now: clock})
+	a, err := New(store, WithClock(clock), WithExpvar("ash_test_lapsed"),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	body := `{"amount":100}`
+	req := signedRequest(t, a, "POST", "/api/transfer", body, "application/json")
+	send := func(h http.Handler) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/transfer", strings.NewReader(body))
+		r.Header = req.Header.Clone()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	calls := 0
+	var handler http.Handler
+	handler = a.HTTPMiddleware(MiddlewareOptions{DeferConsume: true, ReservationTTL: time.Second})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls++; calls == 1 {
+				// The handler outlives its reservation, and a replay
+				// runs in the meantime.
+				now = now.Add(2 * time.Second)
+				if rec := send(handler); rec.Code != http.StatusOK {
+					t.Errorf("Replay after the lapse: %d %s", rec.Code, rec.Body)
+				}
+			}
+		}))
+	send(handler)
+	if calls != 2 {
+		t.Fatalf("Handler ran %d times, want 2", calls)
+	}
+	vars := expvar.Get("ash_test_lapsed").(*expvar.Map)
+	for key, want := range map[string]string{"consumed": "1", "replayed": "1"} {
+		if got := vars.Get(key).String(); got != want {
+			t.Errorf("%s = %s, want %s", key, got, want)
+		}
+	}
+}
+
+// panickingStore is a store whose lookups panic.
+type panickingStore struct {
+	*MemoryStore
+}
+
+func (s panickingStore) Get(string) (*Context, error) {
+	var m map[string]*Context
+	m["x"] = nil // nil map write
+	return nil, nil
+}
+
+// TestHTTPMiddlewarePanicRecovery tests that a panic during verification
+// becomes a generic 500 and a failed verification.
+func TestHTTPMiddlewarePanicRecovery(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	var logs bytes.Buffer
+	var results []*VerifyResult
+	memory := NewMemoryStore(MemoryStoreOptions{Now: fixedClock(now)})
+	a, err := New(panickingStore{memory},
+		WithClock(fixedClock(now)),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+		WithHooks(Hooks{OnVerify: func(r *VerifyResult) { results = append(results, r) }}))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	called := false
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+
+	req := signedRequest(t, a, "POST", "/api/transfer", `{"amount":1}`, "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError || called {
+		t.Fatalf("Expected 500 without calling the handler, got %d (called=%v)", rec.Code, called)
+	}
+	resp := decodeError(t, rec)
+	if resp.Code != ErrInternalError || resp.Message != "internal error" {
+		t.Errorf("Expected generic internal error, got %+v", resp)
+	}
+	if strings.Contains(rec.Body.String(), "goroutine") || strings.Contains(rec.Body.String(), "nil map") {
+		t.Errorf("Response leaks the panic: %s", rec.Body)
+	}
+	if len(results) != 1 || results[0].Valid || results[0].Code != ErrInternalError || results[0].Binding != "POST /api/transfer" {
+		t.Errorf("Expected one failed verification result, got %+v", results)
+	}
+	if !strings.Contains(logs.String(), "panic during verification") || !strings.Contains(logs.String(), "nil map") {
+		t.Errorf("Expected the panic to be logged, got %s", logs.String())
+	}
+}
+
+// TestHTTPMiddlewareDeclaredMode tests that a declared mode must match the
+// context's, and that the proof is checked under the stored mode either way.
+func TestHTTPMiddlewareDeclaredMode(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	const body = `{"amount":100}`
+
+	request := func(mode AshMode, declared string) *httptest.ResponseRecorder {
+		t.Helper()
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/orders"})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		req := httptest.NewRequest("POST", "/api/orders", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		info := ctx.PublicInfo()
+		info.Mode = mode
+		if err := SignRequest(req, info, []byte(body)); err != nil {
+			t.Fatalf("SignRequest failed: %v", err)
+		}
+		if req.Header.Get(HeaderMode) != string(mode) {
+			t.Errorf("SignRequest set %s %q, want %q", HeaderMode, req.Header.Get(HeaderMode), mode)
+		}
+		if declared == "" {
+			req.Header.Del(HeaderMode)
+		} else {
+			req.Header.Set(HeaderMode, declared)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := request(ModeBalanced, "balanced"); rec.Code != http.StatusOK {
+		t.Errorf("Matching mode: status = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := request(ModeBalanced, ""); rec.Code != http.StatusOK {
+		t.Errorf("Absent mode: status = %d: %s", rec.Code, rec.Body)
+	}
+
+	// The declared mode is checked before the proof.
+	rec := request(ModeMinimal, "minimal")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("Mismatched mode: status = %d, want 403: %s", rec.Code, rec.Body)
+	}
+	if err := decodeError(t, rec); err.Code != ErrModeViolation || err.Message != "mode mismatch: context is balanced, proof declares minimal" {
+		t.Errorf("Mismatched mode: error = %+v", err)
+	}
+
+	// Declaring the stored mode does not make a proof built under another
+	// mode verify, and neither does leaving the header out.
+	for _, declared := range []string{"balanced", ""} {
+		rec := request(ModeMinimal, declared)
+		if rec.Code != http.StatusForbidden || decodeError(t, rec).Code != ErrIntegrityFailed {
+			t.Errorf("Declared %q with a minimal proof: status = %d: %s", declared, rec.Code, rec.Body)
+		}
+	}
+}
+
+// discardResponse is a ResponseWriter that discards the response and
+// reuses its header map, so benchmarks measure only the middleware.
+type discardResponse struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponse) Header() http.Header         { return w.header }
+func (w *discardResponse) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardResponse) WriteHeader(status int)      { w.status = status }
+
+// BenchmarkHTTPMiddlewareRejected measures the rejection path a storm of
+// bad requests takes through the middleware.
+func BenchmarkHTTPMiddlewareRejected(b *testing.B) {
+	a, _ := newTestAsh(b, time.UnixMilli(1700000000000))
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.Fatal("Handler should not be called")
+	}))
+	ctx, err := a.IssueContext(ContextOptions{Binding: "GET /api/orders", Metadata: map[string]interface{}{}})
+	if err != nil {
+		b.Fatalf("IssueContext failed: %v", err)
+	}
+
+	for _, bc := range []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"missing headers", nil, http.StatusBadRequest},
+		{"unknown context", map[string]string{HeaderContextID: "ash_unknown", HeaderProof: strings.Repeat("A", 43)}, http.StatusForbidden},
+		{"bad proof", map[string]string{HeaderContextID: ctx.ID, HeaderProof: strings.Repeat("A", 43)}, http.StatusForbidden},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			req := httptest.NewRequest("GET", "/api/orders", nil)
+			for k, v := range bc.headers {
+				req.Header.Set(k, v)
+			}
+			w := &discardResponse{header: make(http.Header)}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				handler.ServeHTTP(w, req)
+			}
+			if w.status != bc.status {
+				b.Fatalf("Status = %d, want %d", w.status, bc.status)
+			}
+		})
+	}
+}
+
+// TestWriteVerifyError tests the response written for a failed
+// verification of each error code, and that it matches the middleware's.
+func TestWriteVerifyError(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, _ := newTestAsh(t, now, WithErrorDocs("https://example.com/errors"))
+	for _, code := range allErrorCodes {
+		result, _ := (&VerifyResult{}).fail(NewAshError(code, "failed"))
+		rec := httptest.NewRecorder()
+		a.WriteVerifyError(rec, result)
+		message := "failed"
+		if code == ErrCanonicalizationFailed {
+			message = errCanonicalizationHidden.Message
+		}
+		status := StatusForCode(code)
+		want := fmt.Sprintf(`{"error":%q,"message":%q,"status":%d,"docs":"https://example.com/errors#%s"}`+"\n",
+			code, message, status, ErrorDocsAnchor(code))
+		if rec.Code != status || rec.Body.String() != want {
+			t.Errorf("%s: got %d %s, want %d %s", code, rec.Code, rec.Body, status, want)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s: Content-Type = %q", code, got)
+		}
+	}
+
+	// Results decoded from JSON have only the code and message.
+	rec := httptest.NewRecorder()
+	a.WriteVerifyError(rec, &VerifyResult{Code: ErrReplayDetected, Message: "context already used"})
+	if got := decodeError(t, rec); rec.Code != http.StatusConflict || got.Message != "context already used" {
+		t.Errorf("Decoded result: got %d %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	a.WriteVerifyError(rec, &VerifyResult{Valid: true})
+	if rec.Body.Len() != 0 {
+		t.Errorf("Valid result wrote %s", rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	a.WriteVerifyError(rec, nil)
+	if got := decodeError(t, rec); rec.Code != http.StatusInternalServerError || got.Code != ErrInternalError {
+		t.Errorf("Nil result: got %d %s", rec.Code, rec.Body)
+	}
+
+	// A handler calling Verify responds exactly as the middleware does.
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, body := range []string{`{"a":1}`, `{"a":`} {
+		req := signedRequest(t, a, "POST", "/api/items", `{"a":2}`, "application/json")
+		result, _ := a.Verify(req.Header.Get(headerContextID), req.Header.Get(headerProof), "POST /api/items",
+			[]byte(body), "application/json")
+		direct := httptest.NewRecorder()
+		a.WriteVerifyError(direct, result)
+
+		req.Body = io.NopCloser(strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if direct.Code != rec.Code || direct.Body.String() != rec.Body.String() {
+			t.Errorf("Body %s: WriteVerifyError %d %s, middleware %d %s", body, direct.Code, direct.Body, rec.Code, rec.Body)
+		}
+	}
+
+	// Unsupported content types list the supported ones.
+	req := signedRequest(t, a, "POST", "/api/items", "{}", "application/json")
+	result, _ := a.Verify(req.Header.Get(headerContextID), req.Header.Get(headerProof), "POST /api/items", []byte("a"), "text/plain")
+	rec = httptest.NewRecorder()
+	a.WriteVerifyError(rec, result)
+	if got := decodeError(t, rec); rec.Code != http.StatusUnsupportedMediaType || len(got.Supported) == 0 {
+		t.Errorf("Unsupported content type: got %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,105 @@
+package ash
+
+import (
+	"fmt"
+	"time"
+)
+
+// ModeRequirements are the requirements a security mode places on contexts
+// and proofs. They are enforced at context creation, by ValidateProofInput
+// and during verification; a violation fails with ErrModeViolation naming
+// the unmet requirement.
+type ModeRequirements struct {
+	// NonceRequired requires a server nonce in every context and proof.
+	// Contexts are issued with a generated nonce if none is provided.
+	NonceRequired bool
+	// TenantRequired requires contexts and proofs to be bound to a tenant.
+	TenantRequired bool
+	// MinTTL and MaxTTL bound the lifetime of contexts. Zero means no
+	// bound.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// MultiUse lets a context be verified any number of times until it
+	// expires instead of being consumed by its first verification.
+	MultiUse bool
+}
+
+// modeRequirements is the table of security modes. A mode is valid exactly
+// when it has an entry.
+var modeRequirements = map[AshMode]ModeRequirements{
+	ModeMinimal:  {},
+	ModeBalanced: {},
+	ModeStrict:   {NonceRequired: true},
+}
+
+// Requirements returns the requirements of the mode, and false if the mode
+// is not valid.
+func (m AshMode) Requirements() (ModeRequirements, bool) {
+	req, ok := modeRequirements[m]
+	return req, ok
+}
+
+// modeViolation returns the ErrModeViolation error for an unmet
+// requirement of mode.
+func modeViolation(mode AshMode, requirement string) *AshError {
+	return NewAshError(ErrModeViolation, fmt.Sprintf("mode %s requires %s", mode, requirement))
+}
+
+// checkTTL checks a context lifetime against the TTL range.
+func (r ModeRequirements) checkTTL(mode AshMode, ttl time.Duration) error {
+	if r.MinTTL > 0 && ttl < r.MinTTL {
+		return modeViolation(mode, fmt.Sprintf("a TTL of at least %v", r.MinTTL))
+	}
+	if r.MaxTTL > 0 && ttl > r.MaxTTL {
+		return modeViolation(mode, fmt.Sprintf("a TTL of at most %v", r.MaxTTL))
+	}
+	return nil
+}
+
+// checkBound checks that the nonce and tenant a context or proof carries
+// meet the requirements.
+func (r ModeRequirements) checkBound(mode AshMode, nonce, tenant string) error {
+	if r.NonceRequired && nonce == "" {
+		return modeViolation(mode, "a nonce")
+	}
+	if r.TenantRequired && tenant == "" {
+		return modeViolation(mode, "a tenant")
+	}
+	return nil
+}
+
+// checkContext checks a stored context against the requirements of its
+// mode, in case it was written by other software or under an older table,
+// and returns them.
+func checkContext(ctx *Context) (ModeRequirements, error) {
+	req, ok := ctx.Mode.Requirements()
+	if !ok {
+		return req, NewAshError(ErrModeViolation, "invalid mode")
+	}
+	if err := req.checkBound(ctx.Mode, ctx.Nonce, ctx.Tenant); err != nil {
+		return req, err
+	}
+	return req, req.checkTTL(ctx.Mode, time.Duration(ctx.ExpiresAt-ctx.IssuedAt)*time.Millisecond)
+}
+
+// atLeast reports whether mode m is at least as strict as floor: it
+// requires a nonce and a tenant if floor does, bounds the TTL no looser
+// than floor's MaxTTL, and is multi-use only if floor is. Modes that are
+// not valid are reported as at least as strict, so that issuance rejects
+// them as such.
+func (m AshMode) atLeast(floor AshMode) bool {
+	r, ok := m.Requirements()
+	f, floorOK := floor.Requirements()
+	if !ok || !floorOK {
+		return true
+	}
+	switch {
+	case f.NonceRequired && !r.NonceRequired, f.TenantRequired && !r.TenantRequired:
+		return false
+	case f.MaxTTL > 0 && (r.MaxTTL == 0 || r.MaxTTL > f.MaxTTL):
+		return false
+	case r.MultiUse && !f.MultiUse:
+		return false
+	}
+	return true
+}
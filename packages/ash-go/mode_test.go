@@ -0,0 +1,155 @@
+package ash
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTestModes adds modes exercising every requirement to the table for
+// the duration of the test.
+func withTestModes(t *testing.T) {
+	t.Helper()
+	modes := map[AshMode]ModeRequirements{
+		"test-tenant":    {TenantRequired: true},
+		"test-ttl":       {MinTTL: time.Second, MaxTTL: 10 * time.Second},
+		"test-multi-use": {MultiUse: true},
+	}
+	for mode, req := range modes {
+		modeRequirements[mode] = req
+	}
+	t.Cleanup(func() {
+		for mode := range modes {
+			delete(modeRequirements, mode)
+		}
+	})
+}
+
+// assertModeViolation checks that err is ErrModeViolation naming want, or
+// nil when want is empty.
+func assertModeViolation(t *testing.T, err error, want string) {
+	t.Helper()
+	if want == "" {
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		return
+	}
+	var ashErr *AshError
+	if !errors.As(err, &ashErr) || ashErr.Code != ErrModeViolation || !strings.Contains(ashErr.Message, want) {
+		t.Errorf("Expected %s naming %q, got %v", ErrModeViolation, want, err)
+	}
+}
+
+// TestModeRequirementsCreate tests enforcement of every mode's
+// requirements at context creation.
+func TestModeRequirementsCreate(t *testing.T) {
+	withTestModes(t)
+	now := time.UnixMilli(1700000000000)
+	for mode, req := range modeRequirements {
+		t.Run(string(mode), func(t *testing.T) {
+			ctx, err := newContext(ContextOptions{Binding: "POST /api/x", Mode: mode, TTL: 5 * time.Second}, now)
+			if req.TenantRequired {
+				assertModeViolation(t, err, "a tenant")
+				ctx, err = newContext(ContextOptions{Binding: "POST /api/x", Mode: mode, TTL: 5 * time.Second, Tenant: "acme"}, now)
+			}
+			if err != nil {
+				t.Fatalf("newContext failed: %v", err)
+			}
+			if req.NonceRequired != (ctx.Nonce != "") {
+				t.Errorf("Nonce = %q, NonceRequired = %v", ctx.Nonce, req.NonceRequired)
+			}
+
+			for _, ttl := range []time.Duration{time.Millisecond, time.Hour} {
+				_, err := newContext(ContextOptions{Binding: "POST /api/x", Mode: mode, TTL: ttl, Tenant: "acme"}, now)
+				want := ""
+				if req.MinTTL > 0 && ttl < req.MinTTL {
+					want = "at least"
+				} else if req.MaxTTL > 0 && ttl > req.MaxTTL {
+					want = "at most"
+				}
+				assertModeViolation(t, err, want)
+			}
+		})
+	}
+}
+
+// TestModeRequirementsProofInput tests enforcement of every mode's
+// requirements by ValidateProofInput.
+func TestModeRequirementsProofInput(t *testing.T) {
+	withTestModes(t)
+	for mode, req := range modeRequirements {
+		t.Run(string(mode), func(t *testing.T) {
+			input := BuildProofInput{Mode: mode, Binding: "POST /api/x", ContextID: "ash_x"}
+			want := ""
+			if req.NonceRequired {
+				want = "a nonce"
+			} else if req.TenantRequired {
+				want = "a tenant"
+			}
+			assertModeViolation(t, ValidateProofInput(input), want)
+
+			input.Nonce, input.Tenant = "n0nce", "acme"
+			assertModeViolation(t, ValidateProofInput(input), "")
+		})
+	}
+	assertModeViolation(t, ValidateProofInput(BuildProofInput{Mode: "bogus", Binding: "POST /api/x", ContextID: "ash_x"}), "invalid mode")
+}
+
+// rawStore serves contexts as given, bypassing newContext.
+type rawStore struct {
+	*MemoryStore
+	ctx *Context
+}
+
+func (s rawStore) Get(string) (*Context, error) { return s.ctx.Clone(), nil }
+
+// TestModeRequirementsVerify tests enforcement of every mode's
+// requirements on stored contexts during verification.
+func TestModeRequirementsVerify(t *testing.T) {
+	withTestModes(t)
+	now := time.UnixMilli(1700000000000)
+	for mode, req := range modeRequirements {
+		t.Run(string(mode), func(t *testing.T) {
+			ctx := &Context{
+				ID: "ash_raw", Binding: "POST /api/x", Mode: mode,
+				IssuedAt: now.UnixMilli(), ExpiresAt: now.Add(time.Hour).UnixMilli(),
+			}
+			a, err := New(rawStore{NewMemoryStore(MemoryStoreOptions{}), ctx}, WithClock(fixedClock(now)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = a.Verify(ctx.ID, clientProof(t, ctx, "", ""), ctx.Binding, nil, "", WithDryRun())
+			want := ""
+			switch {
+			case req.NonceRequired:
+				want = "a nonce"
+			case req.TenantRequired:
+				want = "a tenant"
+			case req.MaxTTL > 0:
+				want = "at most"
+			}
+			assertModeViolation(t, err, want)
+		})
+	}
+}
+
+// TestModeRequirementsMultiUse tests that a multi-use context is not
+// consumed.
+func TestModeRequirementsMultiUse(t *testing.T) {
+	withTestModes(t)
+	a, store := newTestAsh(t, time.UnixMilli(1700000000000))
+	ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/x", Mode: "test-multi-use"})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := a.Verify(ctx.ID, clientProof(t, ctx, "", ""), ctx.Binding, nil, ""); err != nil {
+			t.Fatalf("Verify %d failed: %v", i, err)
+		}
+	}
+	if got, _ := store.Get(ctx.ID); got.Used {
+		t.Error("Expected a multi-use context to stay unused")
+	}
+}
@@ -0,0 +1,72 @@
+package ash
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+)
+
+// multipartFormError returns the error for a multipart/form-data body that
+// cannot be canonicalized.
+func multipartFormError(message string) *AshError {
+	return canonicalizationError(ReasonInvalidMultipart, "", "invalid multipart form: "+message)
+}
+
+// CanonicalizeMultipartForm canonicalizes multipart/form-data with only
+// text fields, such as a browser sends for a FormData without files.
+// boundary is the boundary parameter of the request's Content-Type.
+//
+// The fields are canonicalized as URL-encoded data: keys are sorted, the
+// values of a key keep the order of their parts, and keys and values are
+// normalized and percent-encoded as by CanonicalizeURLEncoded. A form
+// therefore canonicalizes the same whether it is sent as multipart or
+// URL-encoded data, and the output for r.MultipartForm.Value is that of
+// CanonicalizeURLEncodedFromMap. A field with an empty name is dropped,
+// and the WithMaxParams limit applies to the fields.
+//
+// A part with a filename, even an empty one, or that is not a form-data
+// field fails with ReasonInvalidMultipart, as does a body that does not
+// parse. Files are not covered by the proof, so they are rejected rather
+// than skipped.
+func CanonicalizeMultipartForm(body []byte, boundary string, opts ...CanonicalizeOption) (string, error) {
+	if boundary == "" {
+		return "", multipartFormError("missing boundary")
+	}
+	// The reader finds no parts, rather than failing, in a body without
+	// the boundary.
+	if !bytes.Contains(body, []byte("--"+boundary)) {
+		return "", multipartFormError("boundary not found")
+	}
+	o := newCanonicalizeOptions(opts)
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	var pairs []keyValuePair
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", multipartFormError(err.Error())
+		}
+		disposition, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if err != nil || disposition != "form-data" {
+			return "", multipartFormError("part is not a form field")
+		}
+		if _, ok := params["filename"]; ok {
+			return "", multipartFormError("file parts are not supported")
+		}
+		value, err := io.ReadAll(part)
+		if err != nil {
+			return "", multipartFormError(err.Error())
+		}
+		if name := params["name"]; name != "" {
+			if err := o.checkParams(len(pairs)); err != nil {
+				return "", err
+			}
+			pairs = append(pairs, keyValuePair{Key: name, Value: string(value)})
+		}
+	}
+	return encodeCanonicalPairs(pairs, o), nil
+}
@@ -0,0 +1,108 @@
+package ash
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// multipartForm encodes fields, given as name-value pairs, as a browser
+// encodes a FormData without files, with a fixed boundary, and returns the
+// body and its Content-Type.
+func multipartForm(t *testing.T, fields ...string) (string, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if err := w.SetBoundary("ash-test-boundary"); err != nil {
+		t.Fatalf("SetBoundary failed: %v", err)
+	}
+	for i := 0; i < len(fields); i += 2 {
+		if err := w.WriteField(fields[i], fields[i+1]); err != nil {
+			t.Fatalf("WriteField failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	return buf.String(), w.FormDataContentType()
+}
+
+// TestCanonicalizeMultipartForm tests that a field-only multipart form
+// canonicalizes as the same fields sent URL-encoded.
+func TestCanonicalizeMultipartForm(t *testing.T) {
+	fields := []string{"to", "alice", "tag", "z", "amount", "10", "tag", "a b+c&d", "note", "café", "", "dropped"}
+	body, contentType := multipartForm(t, fields...)
+	form := url.Values{}
+	for i := 0; i < len(fields); i += 2 {
+		form.Add(fields[i], fields[i+1])
+	}
+	const want = "amount=10&note=caf%C3%A9&tag=z&tag=a%20b%2Bc%26d&to=alice"
+
+	got, err := CanonicalizePayload([]byte(body), contentType)
+	if err != nil || got != want {
+		t.Fatalf("CanonicalizePayload = %q, %v, want %q", got, err, want)
+	}
+	if urlEncoded, _ := CanonicalizeURLEncoded(form.Encode()); urlEncoded != got {
+		t.Errorf("CanonicalizeURLEncoded = %q, multipart %q", urlEncoded, got)
+	}
+	if fromMap := CanonicalizeURLEncodedFromMap(form); fromMap != got {
+		t.Errorf("CanonicalizeURLEncodedFromMap = %q, multipart %q", fromMap, got)
+	}
+
+	tests := []struct {
+		name, body, contentType string
+	}{
+		{"missing boundary", body, "multipart/form-data"},
+		{"wrong boundary", body, "multipart/form-data; boundary=other"},
+		{"truncated", body[:len(body)-10], contentType},
+		{"file", "--b\r\nContent-Disposition: form-data; name=\"doc\"; filename=\"a.txt\"\r\n\r\nhello\r\n--b--\r\n", "multipart/form-data; boundary=b"},
+		{"empty file input", "--b\r\nContent-Disposition: form-data; name=\"doc\"; filename=\"\"\r\nContent-Type: application/octet-stream\r\n\r\n\r\n--b--\r\n", "multipart/form-data; boundary=b"},
+		{"not form-data", "--b\r\nContent-Disposition: attachment; name=\"a\"\r\n\r\n1\r\n--b--\r\n", "multipart/form-data; boundary=b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CanonicalizePayload([]byte(tt.body), tt.contentType)
+			if e, ok := asAshError(err); !ok || e.Code != ErrCanonicalizationFailed || e.Reason != ReasonInvalidMultipart {
+				t.Errorf("CanonicalizePayload = %v, want %s", err, ReasonInvalidMultipart)
+			}
+		})
+	}
+}
+
+// TestVerifyMultipartForm tests verification of a FormData POST with only
+// text fields.
+func TestVerifyMultipartForm(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, _ := newTestAsh(t, now)
+	var fields url.Values
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("ParseMultipartForm failed: %v", err)
+		}
+		fields = r.MultipartForm.Value
+	}))
+	body, contentType := multipartForm(t, "to", "alice", "amount", "10")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, signedRequest(t, a, "POST", "/api/transfer", body, contentType))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if fields.Get("to") != "alice" {
+		t.Errorf("Handler read fields %v", fields)
+	}
+
+	// The proof covers the fields: a tampered value fails.
+	req := signedRequest(t, a, "POST", "/api/transfer", body, contentType)
+	tampered, _ := multipartForm(t, "to", "mallory", "amount", "10")
+	req.Body = httptest.NewRequest("POST", "/api/transfer", bytes.NewBufferString(tampered)).Body
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || decodeError(t, rec).Code != ErrIntegrityFailed {
+		t.Errorf("Expected 403 %s, got %d: %s", ErrIntegrityFailed, rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,47 @@
+package ash
+
+// NonceProvider supplies the nonce for a new context.
+//
+// Implementations may return a value with meaning to the application, such
+// as an identifier tied to a payment intent. An empty nonce means the
+// context has none.
+type NonceProvider interface {
+	Nonce(opts ContextOptions) (string, error)
+}
+
+// NonceProviderFunc adapts a function to a NonceProvider.
+type NonceProviderFunc func(opts ContextOptions) (string, error)
+
+// Nonce calls f(opts).
+func (f NonceProviderFunc) Nonce(opts ContextOptions) (string, error) {
+	return f(opts)
+}
+
+// NonceValidator checks the nonce of a context against external state
+// during verification. It is only consulted for contexts with a nonce,
+// once the proof has matched and before the context is consumed.
+//
+// Returning an *AshError fails verification with that error; any other
+// error fails it with ErrIntegrityFailed.
+type NonceValidator interface {
+	ValidateNonce(ctx *Context) error
+}
+
+// NonceValidatorFunc adapts a function to a NonceValidator.
+type NonceValidatorFunc func(ctx *Context) error
+
+// ValidateNonce calls f(ctx).
+func (f NonceValidatorFunc) ValidateNonce(ctx *Context) error {
+	return f(ctx)
+}
+
+// DefaultNonceProvider returns the built-in provider: a random 32-byte nonce
+// for modes that require one (see ModeRequirements) and no nonce otherwise.
+func DefaultNonceProvider() NonceProvider {
+	return NonceProviderFunc(func(opts ContextOptions) (string, error) {
+		if req, _ := opts.Mode.Requirements(); !req.NonceRequired {
+			return "", nil
+		}
+		return GenerateNonce(32)
+	})
+}
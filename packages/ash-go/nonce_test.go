@@ -0,0 +1,125 @@
+package ash
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// paymentIntents is a fake external system whose intent IDs are used as nonces.
+type paymentIntents struct {
+	next int
+	open map[string]bool
+}
+
+func (p *paymentIntents) Nonce(opts ContextOptions) (string, error) {
+	if opts.Mode != ModeStrict {
+		return "", nil
+	}
+	p.next++
+	id := fmt.Sprintf("pi_%04d", p.next)
+	p.open[id] = true
+	return id, nil
+}
+
+func (p *paymentIntents) ValidateNonce(ctx *Context) error {
+	if !p.open[ctx.Nonce] {
+		return errors.New("payment intent is closed")
+	}
+	return nil
+}
+
+// TestCustomNonceProviderAndValidator tests delegating nonces to an external system.
+func TestCustomNonceProviderAndValidator(t *testing.T) {
+	intents := &paymentIntents{open: make(map[string]bool)}
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000),
+		WithMode(ModeStrict),
+		WithNonceProvider(intents),
+		WithNonceValidator(intents))
+
+	ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/pay"})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	if ctx.Nonce != "pi_0001" {
+		t.Fatalf("Expected provider nonce pi_0001, got %q", ctx.Nonce)
+	}
+	if info := ctx.PublicInfo(); info.Nonce != "pi_0001" {
+		t.Errorf("Expected nonce in public info, got %q", info.Nonce)
+	}
+
+	body := `{"amount":100}`
+	if _, err := a.Verify(ctx.ID, clientProof(t, ctx, body, "application/json"), ctx.Binding, []byte(body), "application/json"); err != nil {
+		t.Errorf("Verify with open intent failed: %v", err)
+	}
+
+	// A closed intent fails verification even with a valid proof.
+	closed, _ := a.IssueContext(ContextOptions{Binding: "POST /api/pay"})
+	intents.open[closed.Nonce] = false
+	_, err = a.Verify(closed.ID, clientProof(t, closed, body, "application/json"), closed.Binding, []byte(body), "application/json")
+	var ashErr *AshError
+	if !errors.As(err, &ashErr) || ashErr.Code != ErrIntegrityFailed {
+		t.Errorf("Expected ErrIntegrityFailed for closed intent, got %v", err)
+	}
+
+	// Balanced contexts carry no nonce and skip the validator.
+	balanced, _ := a.IssueContext(ContextOptions{Binding: "POST /api/pay", Mode: ModeBalanced})
+	if balanced.Nonce != "" {
+		t.Errorf("Expected no nonce for balanced mode, got %q", balanced.Nonce)
+	}
+}
+
+// TestNonceValidatorAshError tests that validator AshErrors are passed through.
+func TestNonceValidatorAshError(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000),
+		WithMode(ModeStrict),
+		WithNonceValidator(NonceValidatorFunc(func(ctx *Context) error {
+			return NewAshError(ErrContextExpired, "payment intent expired")
+		})))
+
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/pay"})
+	_, err := a.Verify(ctx.ID, clientProof(t, ctx, "", ""), ctx.Binding, nil, "")
+	var ashErr *AshError
+	if !errors.As(err, &ashErr) || ashErr.Code != ErrContextExpired {
+		t.Errorf("Expected validator error to pass through, got %v", err)
+	}
+}
+
+// TestNonceValidatorAfterProof tests that the validator is not consulted
+// for requests whose proof does not match.
+func TestNonceValidatorAfterProof(t *testing.T) {
+	calls := 0
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000),
+		WithMode(ModeStrict),
+		WithNonceValidator(NonceValidatorFunc(func(ctx *Context) error {
+			calls++
+			return nil
+		})))
+
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/pay"})
+	proof := clientProof(t, ctx, `{"amount":100}`, "application/json")
+	if _, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte(`{"amount":999}`), "application/json"); !errors.Is(err, ErrIntegrityFailed) {
+		t.Fatalf("Expected ErrIntegrityFailed for a tampered body, got %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("Validator called %d times for a proof mismatch", calls)
+	}
+	if _, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte(`{"amount":100}`), "application/json"); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Validator called %d times for a valid proof, want 1", calls)
+	}
+}
+
+// TestDefaultNonceProvider tests the built-in provider.
+func TestDefaultNonceProvider(t *testing.T) {
+	p := DefaultNonceProvider()
+	if nonce, _ := p.Nonce(ContextOptions{Mode: ModeBalanced}); nonce != "" {
+		t.Errorf("Expected no nonce for balanced mode, got %q", nonce)
+	}
+	if nonce, _ := p.Nonce(ContextOptions{Mode: ModeStrict}); len(nonce) != 64 {
+		t.Errorf("Expected 64-char nonce for strict mode, got %q", nonce)
+	}
+}
@@ -0,0 +1,203 @@
+package ash
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// StoreObserver holds optional callbacks fired by ObservedStore after each
+// store operation, with how long the operation took and the error it
+// returned. Nil callbacks are skipped. They run on the goroutine that
+// called the store, so slow callbacks slow down issuance and verification.
+type StoreObserver struct {
+	// OnCreate is called after Create, with the binding of the context.
+	OnCreate func(binding string, d time.Duration, err error)
+	// OnGet is called after Get.
+	OnGet func(id string, d time.Duration, err error)
+	// OnConsume is called after Consume and ConsumeReserved.
+	OnConsume func(id string, d time.Duration, err error)
+	// OnCleanup is called after Cleanup, with the number of contexts
+	// removed.
+	OnCleanup func(removed int, d time.Duration, err error)
+}
+
+// ObservedStore is a ContextStore that reports the latency and errors of
+// the store it wraps to a StoreObserver, so that store health can be
+// watched apart from verification.
+//
+// It implements every optional store interface, such as ReservingStore and
+// StatsStore, by forwarding to the wrapped store. An Ash instance only uses
+// those the wrapped store implements; called directly, the others fail.
+type ObservedStore struct {
+	store    ContextStore
+	observer StoreObserver
+}
+
+// NewObservedStore wraps store, reporting its operations to observer.
+func NewObservedStore(store ContextStore, observer StoreObserver) *ObservedStore {
+	return &ObservedStore{store: store, observer: observer}
+}
+
+// Unwrap returns the wrapped store.
+func (s *ObservedStore) Unwrap() ContextStore {
+	return s.store
+}
+
+// Create implements ContextStore.
+func (s *ObservedStore) Create(opts ContextOptions) (*Context, error) {
+	start := time.Now()
+	ctx, err := s.store.Create(opts)
+	if s.observer.OnCreate != nil {
+		s.observer.OnCreate(opts.Binding, time.Since(start), err)
+	}
+	return ctx, err
+}
+
+// Get implements ContextStore.
+func (s *ObservedStore) Get(id string) (*Context, error) {
+	start := time.Now()
+	ctx, err := s.store.Get(id)
+	if s.observer.OnGet != nil {
+		s.observer.OnGet(id, time.Since(start), err)
+	}
+	return ctx, err
+}
+
+// Consume implements ContextStore.
+func (s *ObservedStore) Consume(id string) error {
+	start := time.Now()
+	err := s.store.Consume(id)
+	s.consumed(id, start, err)
+	return err
+}
+
+func (s *ObservedStore) consumed(id string, start time.Time, err error) {
+	if s.observer.OnConsume != nil {
+		s.observer.OnConsume(id, time.Since(start), err)
+	}
+}
+
+// Cleanup implements ContextStore.
+func (s *ObservedStore) Cleanup() (int, error) {
+	start := time.Now()
+	n, err := s.store.Cleanup()
+	if s.observer.OnCleanup != nil {
+		s.observer.OnCleanup(n, time.Since(start), err)
+	}
+	return n, err
+}
+
+// errNotImplemented is returned by the ObservedStore methods of an
+// optional interface the wrapped store does not implement.
+func errNotImplemented(iface string) error {
+	return fmt.Errorf("ash: observed store is not a %s", iface)
+}
+
+// Reserve implements ReservingStore.
+func (s *ObservedStore) Reserve(id string, ttl time.Duration) (string, error) {
+	store, ok := s.store.(ReservingStore)
+	if !ok {
+		return "", errNotImplemented("ReservingStore")
+	}
+	return store.Reserve(id, ttl)
+}
+
+// Release implements ReservingStore.
+func (s *ObservedStore) Release(id, token string) error {
+	store, ok := s.store.(ReservingStore)
+	if !ok {
+		return errNotImplemented("ReservingStore")
+	}
+	return store.Release(id, token)
+}
+
+// ConsumeReserved implements ReservingStore.
+func (s *ObservedStore) ConsumeReserved(id, token string) error {
+	store, ok := s.store.(ReservingStore)
+	if !ok {
+		return errNotImplemented("ReservingStore")
+	}
+	start := time.Now()
+	err := store.ConsumeReserved(id, token)
+	s.consumed(id, start, err)
+	return err
+}
+
+// ReleaseContext implements ReleasingStore.
+func (s *ObservedStore) ReleaseContext(id string) error {
+	store, ok := s.store.(ReleasingStore)
+	if !ok {
+		return errNotImplemented("ReleasingStore")
+	}
+	return store.ReleaseContext(id)
+}
+
+// InvalidateByBinding implements InvalidatingStore.
+func (s *ObservedStore) InvalidateByBinding(binding string) (int, error) {
+	store, ok := s.store.(InvalidatingStore)
+	if !ok {
+		return 0, errNotImplemented("InvalidatingStore")
+	}
+	return store.InvalidateByBinding(binding)
+}
+
+// Iterate implements IteratingStore.
+func (s *ObservedStore) Iterate(ctx context.Context, fn func(*Context) error) error {
+	store, ok := s.store.(IteratingStore)
+	if !ok {
+		return errNotImplemented("IteratingStore")
+	}
+	return store.Iterate(ctx, fn)
+}
+
+// Stats implements StatsStore.
+func (s *ObservedStore) Stats(ctx context.Context) (Stats, error) {
+	store, ok := s.store.(StatsStore)
+	if !ok {
+		return Stats{}, errNotImplemented("StatsStore")
+	}
+	return store.Stats(ctx)
+}
+
+// BindingNonce implements BindingNonceStore.
+func (s *ObservedStore) BindingNonce(binding string, window time.Duration, generate func() (string, error)) (string, error) {
+	store, ok := s.store.(BindingNonceStore)
+	if !ok {
+		return "", errNotImplemented("BindingNonceStore")
+	}
+	return store.BindingNonce(binding, window, generate)
+}
+
+// Size returns the number of contexts in the wrapped store, or 0 if it
+// does not report one.
+func (s *ObservedStore) Size() int {
+	if store, ok := s.store.(interface{ Size() int }); ok {
+		return store.Size()
+	}
+	return 0
+}
+
+func (s *ObservedStore) consumedRetention() time.Duration {
+	if store, ok := s.store.(consumedRetainer); ok {
+		return store.consumedRetention()
+	}
+	return 0
+}
+
+// storeAs returns store as a T if it implements T and so does every store
+// it wraps, as reported by an Unwrap method. ObservedStore implements
+// every optional interface, but only supports those of the store it wraps.
+func storeAs[T any](store ContextStore) (T, bool) {
+	s, ok := store.(T)
+	for ok {
+		w, wraps := store.(interface{ Unwrap() ContextStore })
+		if !wraps {
+			return s, true
+		}
+		store = w.Unwrap()
+		_, ok = store.(T)
+	}
+	var zero T
+	return zero, false
+}
@@ -0,0 +1,158 @@
+package ash
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowStore is a MemoryStore whose operations take at least delay.
+type slowStore struct {
+	*MemoryStore
+	delay time.Duration
+}
+
+func (s slowStore) Create(opts ContextOptions) (*Context, error) {
+	time.Sleep(s.delay)
+	return s.MemoryStore.Create(opts)
+}
+
+func (s slowStore) Get(id string) (*Context, error) {
+	time.Sleep(s.delay)
+	return s.MemoryStore.Get(id)
+}
+
+func (s slowStore) Consume(id string) error {
+	time.Sleep(s.delay)
+	return s.MemoryStore.Consume(id)
+}
+
+func (s slowStore) ConsumeReserved(id, token string) error {
+	time.Sleep(s.delay)
+	return s.MemoryStore.ConsumeReserved(id, token)
+}
+
+func (s slowStore) Cleanup() (int, error) {
+	time.Sleep(s.delay)
+	return s.MemoryStore.Cleanup()
+}
+
+// storeOp is an operation reported to a StoreObserver.
+type storeOp struct {
+	op, subject string
+	d           time.Duration
+	err         error
+}
+
+// TestObservedStore tests that each store operation is reported with its
+// duration and error.
+func TestObservedStore(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	const delay = 2 * time.Millisecond
+	var ops []storeOp
+	observer := StoreObserver{
+		OnCreate: func(binding string, d time.Duration, err error) {
+			ops = append(ops, storeOp{"create", binding, d, err})
+		},
+		OnGet:     func(id string, d time.Duration, err error) { ops = append(ops, storeOp{"get", id, d, err}) },
+		OnConsume: func(id string, d time.Duration, err error) { ops = append(ops, storeOp{"consume", id, d, err}) },
+		OnCleanup: func(removed int, d time.Duration, err error) {
+			ops = append(ops, storeOp{"cleanup", strings.Repeat("x", removed), d, err})
+		},
+	}
+	inner := NewMemoryStore(MemoryStoreOptions{Now: fixedClock(now)})
+	store := NewObservedStore(slowStore{inner, delay}, observer)
+	a, err := New(store, WithClock(fixedClock(now)), WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	check := func(want ...string) {
+		t.Helper()
+		if len(ops) != len(want) {
+			t.Fatalf("Observed %+v, want %q", ops, want)
+		}
+		for i, op := range ops {
+			if op.op+" "+op.subject != want[i] {
+				t.Errorf("Operation %d = %s %s, want %s", i, op.op, op.subject, want[i])
+			}
+			if op.d < delay {
+				t.Errorf("Operation %s took %v, want at least %v", op.op, op.d, delay)
+			}
+		}
+		ops = nil
+	}
+
+	body := `{"amount":100}`
+	req := signedRequest(t, a, "POST", "/api/transfer", body, "application/json")
+	id := req.Header.Get(HeaderContextID)
+	check("create POST /api/transfer")
+	if _, err := a.VerifyRequest(req); err != nil {
+		t.Fatalf("VerifyRequest failed: %v", err)
+	}
+	check("get "+id, "consume "+id)
+
+	if err := store.Consume("ash_unknown"); !errors.Is(err, ErrInvalidContext) {
+		t.Fatalf("Consume of an unknown context = %v", err)
+	}
+	if len(ops) != 1 || !errors.Is(ops[0].err, ErrInvalidContext) {
+		t.Errorf("Observed %+v, want the Consume error", ops)
+	}
+	check("consume ash_unknown")
+
+	if _, err := a.IssueContext(ContextOptions{Binding: "POST /api/transfer", TTL: time.Second}); err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	check("create POST /api/transfer")
+	inner.now = fixedClock(now.Add(time.Hour))
+	if n, err := store.Cleanup(); err != nil || n != 2 {
+		t.Fatalf("Cleanup = %d, %v", n, err)
+	}
+	check("cleanup xx")
+
+	// Deferred consumption goes through ConsumeReserved.
+	inner.now = fixedClock(now)
+	handler := a.HTTPMiddleware(MiddlewareOptions{DeferConsume: true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req = signedRequest(t, a, "POST", "/api/transfer", body, "application/json")
+	id = req.Header.Get(HeaderContextID)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	check("create POST /api/transfer", "get "+id, "consume "+id)
+}
+
+// TestObservedStoreCapabilities tests that an instance only uses the
+// optional interfaces of the wrapped store.
+func TestObservedStoreCapabilities(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	memory := NewMemoryStore(MemoryStoreOptions{Now: fixedClock(now)})
+	observed, err := New(NewObservedStore(memory, StoreObserver{}))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, ok := storeAs[ReservingStore](observed.store); !ok {
+		t.Errorf("An observed MemoryStore is not a ReservingStore")
+	}
+	if _, ok := storeAs[interface{ Size() int }](observed.store); !ok {
+		t.Errorf("An observed MemoryStore does not report its size")
+	}
+
+	plain, err := New(NewObservedStore(nonReleasingStore{memory}, StoreObserver{}))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := plain.ReleaseContext("ash_any"); err != ErrReleaseUnsupported {
+		t.Errorf("ReleaseContext = %v, want %v", err, ErrReleaseUnsupported)
+	}
+	if _, ok := storeAs[ReservingStore](plain.store); ok {
+		t.Errorf("storeAs ignored the capabilities of the wrapped store")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("DeferConsume accepted a store that cannot reserve")
+		}
+	}()
+	plain.HTTPMiddleware(MiddlewareOptions{DeferConsume: true})
+}
@@ -0,0 +1,109 @@
+package ash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidOptionalField is returned for an OptionalField whose pointer
+// does not name an object member or whose default is not JSON.
+var ErrInvalidOptionalField = errors.New("invalid optional field")
+
+// OptionalField is a JSON object member whose absence does not change the
+// canonical form, so that clients that omit it and clients that send it
+// with its default value build the same proof.
+type OptionalField struct {
+	// Pointer is the JSON Pointer of the member, in which a "*" reference
+	// token matches any member or array element, as in "/items/*/note".
+	// Its last token must be a member name.
+	Pointer string `json:"pointer"`
+	// Default is the JSON text of the value the member takes when absent,
+	// such as "false" or `""`. A member equal to it after canonicalization
+	// is left out. When Default is empty, the member is always left out,
+	// so its value is not covered by the proof.
+	Default string `json:"default,omitempty"`
+}
+
+// optionalField is a compiled OptionalField.
+type optionalField struct {
+	pattern []string
+	def     interface{}
+	drop    bool
+}
+
+// compileOptionalFields parses and checks fields.
+func compileOptionalFields(fields []OptionalField) ([]optionalField, error) {
+	compiled := make([]optionalField, 0, len(fields))
+	for _, f := range fields {
+		pattern, err := parsePointer(f.Pointer)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidOptionalField, err)
+		}
+		if len(pattern) == 0 || pattern[len(pattern)-1] == "*" {
+			return nil, fmt.Errorf("%w: %q does not name a member", ErrInvalidOptionalField, f.Pointer)
+		}
+		c := optionalField{pattern: pattern, drop: f.Default == ""}
+		if !c.drop {
+			dec := json.NewDecoder(strings.NewReader(f.Default))
+			dec.UseNumber()
+			if err := dec.Decode(&c.def); err != nil || dec.More() {
+				return nil, fmt.Errorf("%w: default of %q is not a JSON value", ErrInvalidOptionalField, f.Pointer)
+			}
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// WithOptionalFields leaves the given object members out of the canonical
+// form when they are equal to their default, or always when they have
+// none, so that adding or omitting them does not change the proof. Other
+// members, including those next to the optional ones, are covered as
+// usual, and URL-encoded payloads are not affected. An invalid field makes
+// canonicalization fail with an error wrapping ErrInvalidOptionalField.
+func WithOptionalFields(fields ...OptionalField) CanonicalizeOption {
+	return func(o *canonicalizeOptions) {
+		compiled, err := compileOptionalFields(fields)
+		if err != nil && o.err == nil {
+			o.err = err
+		}
+		o.optional = append(o.optional, compiled...)
+	}
+}
+
+// omitMember reports whether the object member at pointer is an optional
+// field left out of the canonical form. canonical returns the canonical
+// form of the member's value, and is only called for a field with a
+// default.
+func (o *canonicalizeOptions) omitMember(pointer string, canonical func() (string, error)) bool {
+	if len(o.optional) == 0 {
+		return false
+	}
+	path, err := parsePointer(pointer)
+	if err != nil {
+		return false
+	}
+	for _, f := range o.optional {
+		if !(pointerPatterns{f.pattern}).match(path) {
+			continue
+		}
+		if f.drop {
+			return true
+		}
+		value, err := canonical()
+		if err != nil {
+			return false
+		}
+		def, err := canonicalizeValue(f.def, pointer, o)
+		if err != nil {
+			return false
+		}
+		defCanonical, err := buildCanonicalJSON(def, pointer)
+		if err == nil && value == defCanonical {
+			return true
+		}
+	}
+	return false
+}
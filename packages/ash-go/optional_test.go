@@ -0,0 +1,111 @@
+package ash
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOptionalFields tests which members are left out of the canonical
+// form, by ParseJSON and CanonicalizeJSONStream alike.
+func TestOptionalFields(t *testing.T) {
+	opts := []CanonicalizeOption{WithOptionalFields(
+		OptionalField{Pointer: "/notify", Default: "false"},
+		OptionalField{Pointer: "/items/*/note", Default: `""`},
+		OptionalField{Pointer: "/trace"},
+	)}
+	tests := []struct {
+		body, want string
+	}{
+		{`{"amount":10}`, `{"amount":10}`},
+		{`{"amount":10,"notify":false}`, `{"amount":10}`},
+		{`{"amount":10,"notify":true}`, `{"amount":10,"notify":true}`},
+		{`{"amount":10,"trace":"abc"}`, `{"amount":10}`},
+		{`{"items":[{"id":1},{"id":2,"note":""}]}`, `{"items":[{"id":1},{"id":2}]}`},
+		{`{"items":[{"id":1,"note":"gift"}]}`, `{"items":[{"id":1,"note":"gift"}]}`},
+		{`{"notify":false,"x":{"notify":false}}`, `{"x":{"notify":false}}`},
+		{`[{"notify":false}]`, `[{"notify":false}]`},
+	}
+	for _, tt := range tests {
+		got, err := ParseJSON(tt.body, opts...)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseJSON(%s) = %q, %v; want %q", tt.body, got, err, tt.want)
+		}
+		var buf bytes.Buffer
+		if err := CanonicalizeJSONStream(strings.NewReader(tt.body), &buf, opts...); err != nil || buf.String() != tt.want {
+			t.Errorf("CanonicalizeJSONStream(%s) = %q, %v; want %q", tt.body, buf.String(), err, tt.want)
+		}
+	}
+
+	// A default is compared after canonicalization.
+	got, err := ParseJSON(`{"limit":1.0,"tags":{"b":1,"a":2}}`, WithOptionalFields(
+		OptionalField{Pointer: "/limit", Default: "1"},
+		OptionalField{Pointer: "/tags", Default: `{"a":2,"b":1}`},
+	))
+	if err != nil || got != `{}` {
+		t.Errorf("ParseJSON with canonical defaults = %q, %v; want {}", got, err)
+	}
+
+	for _, f := range []OptionalField{
+		{Pointer: "notify"},
+		{Pointer: ""},
+		{Pointer: "/items/*"},
+		{Pointer: "/notify", Default: "fals"},
+		{Pointer: "/notify", Default: "1 2"},
+	} {
+		if _, err := ParseJSON(`{}`, WithOptionalFields(f)); !errors.Is(err, ErrInvalidOptionalField) {
+			t.Errorf("%+v: expected ErrInvalidOptionalField, got %v", f, err)
+		}
+		if _, err := newContext(ContextOptions{Binding: "POST /api/x", TTL: time.Second, OptionalFields: []OptionalField{f}}, time.Now()); !errors.Is(err, ErrInvalidOptionalField) {
+			t.Errorf("%+v: expected ErrInvalidOptionalField from newContext, got %v", f, err)
+		}
+	}
+}
+
+// TestVerifyOptionalFields tests that a proof stays valid when an optional
+// field is added or removed, and fails when any other member changes.
+func TestVerifyOptionalFields(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithCanonicalCache(16))
+	fields := []OptionalField{{Pointer: "/notify", Default: "false"}}
+	signed := `{"amount":10,"to":"bob"}`
+
+	tests := []struct {
+		body  string
+		valid bool
+	}{
+		{`{"amount":10,"to":"bob"}`, true},
+		{`{"amount":10,"to":"bob","notify":false}`, true},
+		{`{"notify":false,"to":"bob","amount":10}`, true},
+		{`{"amount":10,"to":"bob","notify":true}`, false},
+		{`{"amount":10}`, false},
+		{`{"amount":10,"to":"bob","memo":""}`, false},
+	}
+	for _, tt := range tests {
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/transfer", OptionalFields: fields})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		info := ctx.PublicInfo()
+		if len(info.OptionalFields) != 1 {
+			t.Fatalf("PublicInfo().OptionalFields = %v", info.OptionalFields)
+		}
+		canonical, _ := CanonicalizePayload([]byte(signed), "application/json", WithOptionalFields(info.OptionalFields...))
+		proof := BuildProof(BuildProofInput{Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, CanonicalPayload: canonical})
+
+		if _, err := a.VerifyStream(ctx.ID, proof, ctx.Binding, strings.NewReader(tt.body), "application/json", WithDryRun()); (err == nil) != tt.valid {
+			t.Errorf("VerifyStream(%s) = %v, want valid %v", tt.body, err, tt.valid)
+		}
+		if _, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte(tt.body), "application/json"); (err == nil) != tt.valid {
+			t.Errorf("Verify(%s) = %v, want valid %v", tt.body, err, tt.valid)
+		}
+	}
+
+	// Without the schema, the optional field changes the proof.
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+	proof := clientProof(t, ctx, signed, "application/json")
+	if _, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte(`{"amount":10,"to":"bob","notify":false}`), "application/json"); !errors.Is(err, ErrIntegrityFailed) {
+		t.Errorf("Expected %s without optional fields, got %v", ErrIntegrityFailed, err)
+	}
+}
@@ -0,0 +1,69 @@
+package ash
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidJSONPointer is returned for a malformed JSON Pointer.
+var ErrInvalidJSONPointer = errors.New("invalid JSON pointer")
+
+// jsonPointerUnescaper unescapes a reference token per RFC 6901.
+var jsonPointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// parsePointer splits a JSON Pointer into unescaped reference tokens. The
+// empty pointer, which refers to the whole document, has none.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("%w: %q does not start with /", ErrInvalidJSONPointer, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		for j := 0; j < len(token); j++ {
+			if token[j] == '~' && (j+1 == len(token) || token[j+1] != '0' && token[j+1] != '1') {
+				return nil, fmt.Errorf("%w: bad escape in %q", ErrInvalidJSONPointer, pointer)
+			}
+		}
+		tokens[i] = jsonPointerUnescaper.Replace(token)
+	}
+	return tokens, nil
+}
+
+// pointerPatterns are JSON Pointers in which a "*" reference token matches
+// any object member or array element.
+type pointerPatterns [][]string
+
+// compilePointerPatterns parses pointers into patterns.
+func compilePointerPatterns(pointers []string) (pointerPatterns, error) {
+	var p pointerPatterns
+	for _, pointer := range pointers {
+		tokens, err := parsePointer(pointer)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, tokens)
+	}
+	return p, nil
+}
+
+// match reports whether a pattern matches the location with the given
+// reference tokens.
+func (p pointerPatterns) match(path []string) bool {
+outer:
+	for _, pattern := range p {
+		if len(pattern) != len(path) {
+			continue
+		}
+		for i, token := range pattern {
+			if token != "*" && token != path[i] {
+				continue outer
+			}
+		}
+		return true
+	}
+	return false
+}
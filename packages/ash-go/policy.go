@@ -0,0 +1,95 @@
+package ash
+
+import "encoding/json"
+
+// BindingPolicy holds verification requirements for a binding.
+type BindingPolicy struct {
+	// RequiredExtensions are the extension keys a request must bind into
+	// its proof.
+	RequiredExtensions []string
+	// ProofMetadata are the metadata keys bound into the proofs of
+	// contexts issued for the binding (see ContextOptions.ProofMetadata).
+	ProofMetadata []string
+	// RawBody makes contexts issued for the binding cover the body bytes
+	// as sent instead of their canonical form (see ContextOptions.RawBody).
+	RawBody bool
+	// DecimalStrings are the JSON Pointers of values contexts issued for
+	// the binding canonicalize as decimal strings (see
+	// ContextOptions.DecimalStrings).
+	DecimalStrings []string
+}
+
+// WithBindingPolicy sets the verification policy for a binding
+// ("METHOD /path", normalized with NormalizeBinding).
+func WithBindingPolicy(binding string, policy BindingPolicy) Option {
+	return func(a *Ash) {
+		if a.policies == nil {
+			a.policies = make(map[string]BindingPolicy)
+		}
+		a.policies[binding] = policy
+	}
+}
+
+// policyFor returns the policy for a binding, or the zero policy.
+func (a *Ash) policyFor(binding string) BindingPolicy {
+	return a.policies[binding]
+}
+
+// errPolicyNotCovered fails a request to a binding with a policy that its
+// context, issued for another binding, was not issued under.
+var errPolicyNotCovered = NewAshError(ErrEndpointMismatch, "context not issued under the binding's policy")
+
+// checkPolicies checks a request for binding, verified against ctx,
+// against the policies of both the context's binding and binding. A
+// context issued for a pattern or template gets the policy of that
+// binding at issuance, not of the endpoints it matches, so the policy of
+// the request's concrete binding is checked here: its required
+// extensions, and that the context has what the policy sets at issuance.
+func (a *Ash) checkPolicies(ctx *Context, binding string, exts []KV) error {
+	for _, b := range []string{ctx.Binding, binding} {
+		if key, missing := missingExtension(a.policyFor(b).RequiredExtensions, exts); missing {
+			return NewAshError(ErrMalformedRequest, "missing required extension: "+key)
+		}
+	}
+	if binding == ctx.Binding {
+		return nil
+	}
+	policy := a.policyFor(binding)
+	if policy.RawBody && !ctx.RawBody || !coversProofMetadata(ctx, policy.ProofMetadata) ||
+		!containsAll(ctx.DecimalStrings, policy.DecimalStrings) {
+		return errPolicyNotCovered
+	}
+	return nil
+}
+
+// coversProofMetadata reports whether proofs for ctx cover the metadata
+// keys.
+func coversProofMetadata(ctx *Context, keys []string) bool {
+	if len(keys) == 0 {
+		return true
+	}
+	var bound map[string]json.RawMessage
+	if json.Unmarshal([]byte(ctx.ProofMetadata), &bound) != nil {
+		return false
+	}
+	for _, key := range keys {
+		if _, ok := bound[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// containsAll reports whether set has every element of elems.
+func containsAll(set, elems []string) bool {
+outer:
+	for _, e := range elems {
+		for _, s := range set {
+			if s == e {
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package ash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrMissingProofMetadata is returned when a context is issued without a
+// metadata key its proofs must cover.
+var ErrMissingProofMetadata = errors.New("ash: metadata key bound into proofs is missing")
+
+// canonicalProofMetadata returns the canonical JSON of the metadata keys
+// bound into proofs, as written on the "meta:" line of the preamble.
+func canonicalProofMetadata(metadata map[string]interface{}, keys []string) (string, error) {
+	bound := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		v, ok := metadata[key]
+		if !ok {
+			return "", fmt.Errorf("%w: %q", ErrMissingProofMetadata, key)
+		}
+		bound[key] = v
+	}
+	return CanonicalizeJSON(bound)
+}
+
+// checkProofMetadata checks that the metadata bound into the proofs of ctx
+// at issuance is still the context's metadata. The preamble is always
+// rebuilt from the store, but a change would otherwise surface only as a
+// client's proof failing to match.
+func (a *Ash) checkProofMetadata(ctx *Context) error {
+	var bound map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(ctx.ProofMetadata), &bound); err != nil {
+		a.logger.Error("ash: stored proof metadata is not a JSON object", "contextId", ctx.ID, "error", err)
+		return NewAshError(ErrInternalError, "internal error")
+	}
+	keys := make([]string, 0, len(bound))
+	for key := range bound {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	current, err := canonicalProofMetadata(ctx.Metadata, keys)
+	if err != nil || current != ctx.ProofMetadata {
+		a.logger.Error("ash: metadata bound into proofs changed since issuance",
+			"contextId", ctx.ID, "binding", ctx.Binding, "keys", keys, "error", err)
+		return NewAshError(ErrInternalError, "context metadata changed since issuance")
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package ash
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestProofMetadata tests that metadata bound by policy is covered by
+// proofs built from the issued context info, and only from it.
+func TestProofMetadata(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000),
+		WithBindingPolicy("POST /api/checkout", BindingPolicy{ProofMetadata: []string{"price", "currency"}}))
+	h := NewContextHandler(a)
+	h.Metadata = func(r *http.Request) map[string]interface{} {
+		return map[string]interface{}{"price": 12.5, "currency": "EUR", "userId": "u1"}
+	}
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	const body = `{"cart":"c1"}`
+
+	issue := func() ContextPublicInfo {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/ash/context?binding=POST+/api/checkout", nil))
+		var info ContextPublicInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+			t.Fatalf("Failed to decode context: %v: %s", err, rec.Body)
+		}
+		return info
+	}
+
+	info := issue()
+	if string(info.ProofMetadata) != `{"currency":"EUR","price":12.5}` {
+		t.Errorf("ProofMetadata = %s", info.ProofMetadata)
+	}
+	req := httptest.NewRequest("POST", "/api/checkout", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if err := SignRequest(req, info, []byte(body)); err != nil {
+		t.Fatalf("SignRequest failed: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+
+	// A client claiming another quote fails.
+	info = issue()
+	info.ProofMetadata = json.RawMessage(`{"currency":"EUR","price":1}`)
+	req = httptest.NewRequest("POST", "/api/checkout", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	SignRequest(req, info, []byte(body))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || decodeError(t, rec).Code != ErrIntegrityFailed {
+		t.Errorf("Status = %d, want 403: %s", rec.Code, rec.Body)
+	}
+
+	// Proofs without the metadata line fail too.
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/checkout", Metadata: map[string]interface{}{"price": 12.5, "currency": "EUR"}})
+	if _, err := a.Verify(ctx.ID, clientProof(t, ctx, body, "application/json"), ctx.Binding, []byte(body), "application/json"); !errors.Is(err, ErrIntegrityFailed) {
+		t.Errorf("Expected %s without metadata, got %v", ErrIntegrityFailed, err)
+	}
+}
+
+// TestProofMetadataChanged tests that verification fails with
+// ErrInternalError when bound metadata changes in the store after
+// issuance, even for a proof over the new values.
+func TestProofMetadataChanged(t *testing.T) {
+	a, store := newTestAsh(t, time.UnixMilli(1700000000000))
+	ctx, err := a.IssueContext(ContextOptions{
+		Binding:       "POST /api/checkout",
+		Metadata:      map[string]interface{}{"price": 12.5},
+		ProofMetadata: []string{"price"},
+	})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	store.contexts[ctx.ID].Metadata["price"] = 1
+
+	canonical, _ := CanonicalizePayload([]byte(`{}`), "application/json")
+	for _, metadata := range []string{`{"price":12.5}`, `{"price":1}`} {
+		proof := BuildProof(BuildProofInput{Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, Metadata: metadata, CanonicalPayload: canonical})
+		result, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte(`{}`), "application/json")
+		if !errors.Is(err, ErrInternalError) || result.Stage != StageProofMatch {
+			t.Errorf("Verify with %s = %+v, %v; want %s", metadata, result, err, ErrInternalError)
+		}
+	}
+}
+
+// TestProofMetadataMissing tests that a context cannot be issued without
+// the metadata its proofs must cover.
+func TestProofMetadataMissing(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000),
+		WithBindingPolicy("POST /api/checkout", BindingPolicy{ProofMetadata: []string{"price"}}))
+	if _, err := a.IssueContext(ContextOptions{Binding: "POST /api/checkout"}); !errors.Is(err, ErrMissingProofMetadata) {
+		t.Errorf("Expected ErrMissingProofMetadata, got %v", err)
+	}
+	if _, err := a.IssueContext(ContextOptions{Binding: "POST /api/other"}); err != nil {
+		t.Errorf("IssueContext without policy failed: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package ash
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRawBody tests that proofs for raw-body contexts cover the body bytes
+// as sent, so a re-serialized body fails where a canonical context would
+// accept it.
+func TestRawBody(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000),
+		WithBindingPolicy("POST /api/telemetry", BindingPolicy{RawBody: true}))
+	const sent = `{ "temp": 21.50, "id": "s1" }`
+	const reserialized = `{"id":"s1","temp":21.5}`
+
+	ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/telemetry"})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	if !ctx.RawBody || !ctx.PublicInfo().RawBody {
+		t.Fatal("Expected a raw-body context from the binding policy")
+	}
+	rawProof := BuildProof(BuildProofInput{Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, CanonicalPayload: sent})
+
+	// A canonical proof of the same body does not verify.
+	if _, err := a.Verify(ctx.ID, clientProof(t, ctx, sent, "application/json"), ctx.Binding, []byte(sent), "application/json", WithDryRun()); !errors.Is(err, ErrIntegrityFailed) {
+		t.Errorf("Expected %s for a canonical proof, got %v", ErrIntegrityFailed, err)
+	}
+	// A proxy re-serializing the body breaks the proof.
+	if _, err := a.Verify(ctx.ID, rawProof, ctx.Binding, []byte(reserialized), "application/json", WithDryRun()); !errors.Is(err, ErrIntegrityFailed) {
+		t.Errorf("Expected %s for a re-serialized body, got %v", ErrIntegrityFailed, err)
+	}
+	// The bytes need not be valid for the content type.
+	if _, err := a.Verify(ctx.ID, rawProof, ctx.Binding, []byte(sent), "application/octet-stream", WithDryRun()); err != nil {
+		t.Errorf("Verify with another content type failed: %v", err)
+	}
+	if _, err := a.VerifyStream(ctx.ID, rawProof, ctx.Binding, strings.NewReader(sent), "application/json", WithDryRun()); err != nil {
+		t.Errorf("VerifyStream failed: %v", err)
+	}
+	if _, err := a.Verify(ctx.ID, rawProof, ctx.Binding, []byte(sent), "application/json"); err != nil {
+		t.Errorf("Verify failed: %v", err)
+	}
+
+	// Other bindings keep canonical proofs.
+	other, _ := a.IssueContext(ContextOptions{Binding: "POST /api/orders"})
+	if other.RawBody {
+		t.Error("Expected a canonical context outside the policy")
+	}
+}
+
+// TestRawBodySignRequest tests that SignRequest signs the payload as is
+// for raw-body contexts, through the middleware.
+func TestRawBodySignRequest(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	const body = "temp=21.50&id=s1"
+
+	for _, sent := range []string{body, "id=s1&temp=21.50"} {
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/telemetry", RawBody: true})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		req := httptest.NewRequest("POST", "/api/telemetry", strings.NewReader(sent))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err := SignRequest(req, ctx.PublicInfo(), []byte(body)); err != nil {
+			t.Fatalf("SignRequest failed: %v", err)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		want := http.StatusOK
+		if sent != body {
+			want = http.StatusForbidden
+		}
+		if rec.Code != want {
+			t.Errorf("Sent %q: status = %d, want %d: %s", sent, rec.Code, want, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package ash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Redacted is the value that replaces redacted values.
+const Redacted = "[REDACTED]"
+
+// ErrInvalidRedactionRule is returned by NewRedactor for a malformed rule.
+var ErrInvalidRedactionRule = errors.New("invalid redaction rule")
+
+// Redactor replaces sensitive values in payloads before they are emitted,
+// for example "password" in a login request. It never changes what is
+// hashed: verification always uses the full canonical payload.
+//
+// A nil *Redactor redacts nothing.
+type Redactor struct {
+	keys     map[string]bool
+	pointers pointerPatterns
+}
+
+// NewRedactor creates a Redactor from rules of two kinds:
+//
+//   - A key name, such as "password", matches every object member and
+//     form field of that name, at any depth and inside arrays.
+//   - A JSON Pointer (RFC 6901), such as "/card/number", matches that
+//     location only. A "*" reference token matches any member or array
+//     element, as in "/cards/*/number".
+//
+// A matched value is replaced by Redacted whatever its type, so a matched
+// object or array is redacted whole.
+func NewRedactor(rules ...string) (*Redactor, error) {
+	r := &Redactor{keys: make(map[string]bool)}
+	for _, rule := range rules {
+		if rule == "" {
+			return nil, fmt.Errorf("%w: empty rule", ErrInvalidRedactionRule)
+		}
+		if !strings.HasPrefix(rule, "/") {
+			r.keys[rule] = true
+			continue
+		}
+		tokens, err := parsePointer(rule)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRedactionRule, err)
+		}
+		r.pointers = append(r.pointers, tokens)
+	}
+	return r, nil
+}
+
+// matches reports whether the value at path, reached through the member
+// or field key, is redacted.
+func (r *Redactor) matches(path []string, key string, isKey bool) bool {
+	return isKey && r.keys[key] || r.pointers.match(path)
+}
+
+// Redact returns a copy of a parsed JSON value (as decoded into an
+// interface{} by encoding/json) with matched values replaced by Redacted.
+// value itself is not modified.
+func (r *Redactor) Redact(value interface{}) interface{} {
+	if r == nil {
+		return value
+	}
+	return r.redact(value, nil)
+}
+
+// redact redacts value, which is at path.
+func (r *Redactor) redact(value interface{}, path []string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			child := append(path[:len(path):len(path)], key)
+			if r.matches(child, key, true) {
+				out[key] = Redacted
+			} else {
+				out[key] = r.redact(item, child)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			child := append(path[:len(path):len(path)], strconv.Itoa(i))
+			if r.matches(child, "", false) {
+				out[i] = Redacted
+			} else {
+				out[i] = r.redact(item, child)
+			}
+		}
+		return out
+	default:
+		return value
+	}
+}
+
+// RedactPayload returns the canonical payload for contentType (as produced
+// by CanonicalizePayload) with matched values replaced by Redacted, in the
+// same canonical encoding. In a URL-encoded or multipart form payload, a
+// field is matched by its name or by the pointer "/" + name. A payload
+// that cannot be decoded is replaced by Redacted whole, unless the
+// Redactor is nil or has no rules.
+func (r *Redactor) RedactPayload(canonical, contentType string) string {
+	if r == nil || len(r.keys) == 0 && len(r.pointers) == 0 || canonical == CanonicalEmptyBody {
+		return canonical
+	}
+	mediaType, err := payloadMediaType(contentType)
+	if err != nil {
+		return Redacted
+	}
+	if mediaType == ContentTypeJSON {
+		var value interface{}
+		if err := json.Unmarshal([]byte(canonical), &value); err != nil {
+			return Redacted
+		}
+		out, err := buildCanonicalJSON(r.redact(value, nil), "")
+		if err != nil {
+			return Redacted
+		}
+		return out
+	}
+
+	pairs, err := parseURLEncoded(canonical, nil)
+	if err != nil {
+		return Redacted
+	}
+	parts := make([]string, len(pairs))
+	for i, pair := range pairs {
+		if r.matches([]string{pair.Key}, pair.Key, true) {
+			pair.Value = Redacted
+		}
+		parts[i] = percentEncode(pair.Key) + "=" + percentEncode(pair.Value)
+	}
+	return strings.Join(parts, "&")
+}
+
+// WithRedaction sets the Redactor applied to payloads emitted through
+// audit events (see WithAuditPayload) and debug logging (see
+// WithDebugResponses).
+func WithRedaction(r *Redactor) Option {
+	return func(a *Ash) { a.redactor = r }
+}
@@ -0,0 +1,132 @@
+package ash
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRedactor tests key name and pointer rules on parsed values.
+func TestRedactor(t *testing.T) {
+	r, err := NewRedactor("password", "/card/number", "/cards/*/cvv", "/a~1b")
+	if err != nil {
+		t.Fatalf("NewRedactor failed: %v", err)
+	}
+	input := `{
+		"user": "alice",
+		"password": "hunter2",
+		"card": {"number": "4111", "holder": "A", "nested": {"number": "1"}},
+		"cards": [{"cvv": "123", "number": "5"}, {"cvv": "456"}],
+		"history": [{"password": "old"}, ["x", {"password": {"deep": true}}]],
+		"a/b": 1,
+		"number": 2
+	}`
+	var value interface{}
+	if err := json.Unmarshal([]byte(input), &value); err != nil {
+		t.Fatal(err)
+	}
+	var original interface{}
+	json.Unmarshal([]byte(input), &original)
+
+	got := r.Redact(value)
+	var want interface{}
+	json.Unmarshal([]byte(`{
+		"user": "alice",
+		"password": "[REDACTED]",
+		"card": {"number": "[REDACTED]", "holder": "A", "nested": {"number": "1"}},
+		"cards": [{"cvv": "[REDACTED]", "number": "5"}, {"cvv": "[REDACTED]"}],
+		"history": [{"password": "[REDACTED]"}, ["x", {"password": "[REDACTED]"}]],
+		"a/b": "[REDACTED]",
+		"number": 2
+	}`), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Redact = %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(value, original) {
+		t.Error("Redact modified its input")
+	}
+
+	var nilRedactor *Redactor
+	if got := nilRedactor.Redact(value); !reflect.DeepEqual(got, original) {
+		t.Errorf("nil Redact = %v", got)
+	}
+}
+
+// TestNewRedactorInvalid tests rejection of malformed rules.
+func TestNewRedactorInvalid(t *testing.T) {
+	for _, rule := range []string{"", "/a~", "/a~2b"} {
+		if _, err := NewRedactor(rule); !errors.Is(err, ErrInvalidRedactionRule) {
+			t.Errorf("NewRedactor(%q) error = %v, want ErrInvalidRedactionRule", rule, err)
+		}
+	}
+}
+
+// TestRedactPayload tests redaction of canonical payloads.
+func TestRedactPayload(t *testing.T) {
+	r, _ := NewRedactor("password", "/card/number")
+	tests := []struct {
+		body, contentType, want string
+	}{
+		{`{"user":"a","password":"p","items":[{"password":"q","n":1.5}]}`, "application/json",
+			`{"items":[{"n":1.5,"password":"[REDACTED]"}],"password":"[REDACTED]","user":"a"}`},
+		{`{"card":{"number":"4111","cvv":"1"}}`, "application/json; charset=utf-8",
+			`{"card":{"cvv":"1","number":"[REDACTED]"}}`},
+		{"user=a&password=p&password=q", "application/x-www-form-urlencoded",
+			"password=%5BREDACTED%5D&password=%5BREDACTED%5D&user=a"},
+		{"", "application/json", ""},
+	}
+	for _, tt := range tests {
+		canonical, err := CanonicalizePayload([]byte(tt.body), tt.contentType)
+		if err != nil {
+			t.Fatalf("CanonicalizePayload(%q) failed: %v", tt.body, err)
+		}
+		if got := r.RedactPayload(canonical, tt.contentType); got != tt.want {
+			t.Errorf("RedactPayload(%q) = %q, want %q", canonical, got, tt.want)
+		}
+	}
+	if got := r.RedactPayload("{not json", "application/json"); got != Redacted {
+		t.Errorf("RedactPayload of invalid JSON = %q, want %q", got, Redacted)
+	}
+}
+
+// TestAuditPayloadRedacted tests that audit events and debug logs carry
+// the redacted payload while verification hashes the full one.
+func TestAuditPayloadRedacted(t *testing.T) {
+	const body = `{"user":"alice","password":"hunter2","cards":[{"number":"4111"}]}`
+	r, _ := NewRedactor("password", "/cards/*/number")
+	var events []AuditEvent
+	var logs bytes.Buffer
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000),
+		WithRedaction(r),
+		WithAuditPayload(true),
+		WithAuditRequired(true),
+		WithAuditSink(auditSinkFunc(func(e AuditEvent) error { events = append(events, e); return nil })),
+		WithDebugResponses(true),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/login"})
+	proof := clientProof(t, ctx, body, "application/json")
+	if _, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte(`{"user":"alice","password":"wrong","cards":[{"number":"4111"}]}`), "application/json"); err == nil {
+		t.Fatal("Expected a tampered body to fail")
+	}
+	if logs.Len() == 0 || strings.Contains(logs.String(), "wrong") || strings.Contains(logs.String(), "4111") {
+		t.Errorf("Debug log not redacted: %s", logs.String())
+	}
+
+	if _, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte(body), "application/json"); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	want := `{"cards":[{"number":"[REDACTED]"}],"password":"[REDACTED]","user":"alice"}`
+	if len(events) != 1 || events[0].Payload != want {
+		t.Fatalf("Audit events = %+v, want payload %s", events, want)
+	}
+	canonical, _ := CanonicalizePayload([]byte(body), "application/json")
+	if !strings.Contains(canonical, "hunter2") {
+		t.Errorf("Canonical form was redacted: %s", canonical)
+	}
+}
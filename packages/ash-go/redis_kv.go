@@ -0,0 +1,76 @@
+package ash
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RedisKV is a KVStore over Redis, for NewKVContextStore. It has none of
+// the optional capabilities: RedisStore, whose KVStore counts and scans,
+// is the Redis store to use with BindingLimits, Iterate or
+// InvalidateByBinding.
+type RedisKV struct {
+	client RedisClient
+	prefix string
+}
+
+// NewRedisKV creates a KVStore prefixing every key with keyPrefix (default:
+// DefaultRedisKeyPrefix + "kv:").
+func NewRedisKV(client RedisClient, keyPrefix string) *RedisKV {
+	if keyPrefix == "" {
+		keyPrefix = DefaultRedisKeyPrefix + "kv:"
+	}
+	return &RedisKV{client: client, prefix: keyPrefix}
+}
+
+// Scripts of RedisKV. A missing key reads as an empty string, since
+// clients report a nil reply as an error.
+const (
+	redisKVGetScript    = `return redis.call('GET', KEYS[1]) or ''`
+	redisKVSetNXScript  = `if redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2], 'NX') then return 1 end return 0`
+	redisKVDeleteScript = `return redis.call('DEL', KEYS[1])`
+	redisKVCASScript    = `
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+  return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1
+`
+)
+
+// Get implements KVStore.
+func (k *RedisKV) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := k.client.Eval(ctx, redisKVGetScript, []string{k.prefix + key})
+	if err != nil {
+		return nil, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %T", reply)
+	}
+	if value == "" {
+		return nil, ErrKVNotFound
+	}
+	return []byte(value), nil
+}
+
+// SetNX implements KVStore.
+func (k *RedisKV) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	reply, err := k.client.Eval(ctx, redisKVSetNXScript, []string{k.prefix + key}, string(value), ttl.Milliseconds())
+	n, _ := reply.(int64)
+	return n == 1, err
+}
+
+// CompareAndSwap implements KVStore.
+func (k *RedisKV) CompareAndSwap(ctx context.Context, key string, old, value []byte, ttl time.Duration) (bool, error) {
+	reply, err := k.client.Eval(ctx, redisKVCASScript, []string{k.prefix + key}, string(old), string(value), ttl.Milliseconds())
+	n, _ := reply.(int64)
+	return n == 1, err
+}
+
+// Delete implements KVStore.
+func (k *RedisKV) Delete(ctx context.Context, key string) error {
+	_, err := k.client.Eval(ctx, redisKVDeleteScript, []string{k.prefix + key})
+	return err
+}
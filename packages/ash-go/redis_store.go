@@ -0,0 +1,634 @@
+package ash
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisClient is the subset of a Redis client used by RedisStore.
+//
+// It is satisfied by a thin adapter over any client library, for example
+// go-redis:
+//
+//	type goRedis struct{ c *redis.Client }
+//
+//	func (g goRedis) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+//		return g.c.Eval(ctx, script, keys, args...).Result()
+//	}
+//
+// Replies must be decoded as the client library does by default: integers
+// as int64, bulk strings as string and arrays as []interface{}.
+type RedisClient interface {
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// DefaultRedisKeyPrefix is the default prefix for RedisStore keys.
+const DefaultRedisKeyPrefix = "ash:"
+
+// RedisStoreOptions configures a RedisStore.
+type RedisStoreOptions struct {
+	// Client is the Redis client (required).
+	Client RedisClient
+	// KeyPrefix prefixes every key (default: DefaultRedisKeyPrefix). On
+	// Redis Cluster it must contain a hash tag, e.g. "{ash}:", because the
+	// scripts touch per-binding counter keys they derive from the prefix.
+	KeyPrefix string
+	// Now returns the current time (default: time.Now).
+	Now func() time.Time
+	// BindingLimits caps the number of outstanding (unconsumed, unexpired)
+	// contexts per binding. See BindingLimits.
+	BindingLimits BindingLimits
+	// ConsumedRetention keeps consumed contexts for this long after they
+	// are consumed, extending the key TTL past the context's expiry if
+	// needed, so that replaying them fails with ErrReplayDetected rather
+	// than ErrInvalidContext (0: consumed contexts expire with their TTL).
+	ConsumedRetention time.Duration
+	// Codec encodes stored contexts (default: JSONCodec). Contexts encoded
+	// with JSONCodec, Codec or any of DecodeCodecs are read back whatever
+	// Codec is, so contexts stored before a switch stay usable. Contexts
+	// stored with another codec are only readable by the Go SDK.
+	Codec ContextCodec
+	// DecodeCodecs are further codecs contexts may be stored with. To
+	// switch codecs across several instances, first deploy every instance
+	// with the new codec here, then make it Codec, so that no instance
+	// meets a context it cannot decode.
+	DecodeCodecs []ContextCodec
+}
+
+// RedisStore is a ContextStore backed by Redis, for deployments where
+// several instances issue and verify contexts. It is a KVContextStore over
+// Redis, with every optional KVStore capability.
+//
+// Each context is a hash holding the encoded context, its used flag and
+// consumption time, its expiry and any reservation, with a TTL matching the
+// context and extended on consumption by ConsumedRetention. Every change
+// is a script swapping the hash only if it still holds the fields the
+// change was decided on, so consumption is atomic across instances.
+//
+// Bindings with a limit also have a counter key: a sorted set of the
+// outstanding context IDs scored by expiry, whose TTL is extended to the
+// latest expiry. Consume removes the ID, and expired IDs are dropped on the
+// next Create for that binding and by Cleanup.
+//
+// This is the layout of releases before RedisStore was built on
+// KVContextStore, whose scripts change the same fields of the same keys,
+// so instances of both can share a KeyPrefix during an upgrade.
+type RedisStore struct {
+	store  *KVContextStore
+	client RedisClient
+	prefix string
+	now    func() time.Time
+}
+
+// NewRedisStore creates a new Redis-backed store. It panics if a
+// BindingLimits pattern or a codec name is invalid.
+func NewRedisStore(opts RedisStoreOptions) *RedisStore {
+	s := &RedisStore{client: opts.Client, prefix: opts.KeyPrefix, now: opts.Now}
+	if s.prefix == "" {
+		s.prefix = DefaultRedisKeyPrefix
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+	s.store = newKVContextStore(&redisHashKV{client: s.client, prefix: s.prefix}, KVContextStoreOptions{
+		Now:               s.now,
+		ConsumedRetention: opts.ConsumedRetention,
+		BindingLimits:     opts.BindingLimits,
+	}, redisHashRecords{codecs: newContextCodecs(opts.Codec, opts.DecodeCodecs)}, "redis")
+	return s
+}
+
+// Keys are "<prefix>ctx:<id>" for contexts, "<prefix>binding:<binding>" for
+// counter keys, "<prefix>bindings" for the set of counter keys and
+// "<prefix>nonce:<binding>" for binding nonces (see BindingNonce).
+
+// redisHashRecords encodes the records of a RedisStore as the fields of a
+// context hash, in the form of redisHashKV values. Records are
+// never marked released, since redisHashKV is a KVCompareAndDeleter.
+type redisHashRecords struct {
+	codecs *contextCodecs
+}
+
+func (c redisHashRecords) encode(r *kvRecord) ([]byte, error) {
+	// The used flag and consumption time are fields of their own.
+	stored := *r.Context
+	stored.Used, stored.ConsumedAt = false, 0
+	data, err := c.codecs.marshal(&stored)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]string{
+		"ctx":       data,
+		"binding":   r.Context.Binding,
+		"used":      "0",
+		"expiresAt": strconv.FormatInt(r.Context.ExpiresAt, 10),
+	}
+	if r.Context.Used {
+		fields["used"] = "1"
+		fields["consumedAt"] = strconv.FormatInt(r.Context.ConsumedAt, 10)
+	}
+	if r.Reservation != "" {
+		fields["reserved"] = r.Reservation
+		fields["reservedUntil"] = strconv.FormatInt(r.ReservedUntil, 10)
+	}
+	return encodeRedisHash(fields), nil
+}
+
+func (c redisHashRecords) decode(data []byte) (*kvRecord, error) {
+	hash, err := decodeRedisHash(data)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string, len(hash)/2)
+	for i := 0; i < len(hash); i += 2 {
+		fields[hash[i]] = hash[i+1]
+	}
+	var ctx Context
+	if err := c.codecs.unmarshal(fields["ctx"], &ctx); err != nil {
+		return nil, err
+	}
+	r := &kvRecord{Context: &ctx, Reservation: fields["reserved"]}
+	ctx.Used = fields["used"] == "1"
+	if ctx.ConsumedAt, err = redisHashInt(fields, "consumedAt"); err != nil {
+		return nil, err
+	}
+	if r.ReservedUntil, err = redisHashInt(fields, "reservedUntil"); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// redisHashInt parses the integer field name of a context hash, 0 if it is
+// not set.
+func redisHashInt(fields map[string]string, name string) (int64, error) {
+	if fields[name] == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(fields[name], 10, 64)
+}
+
+// redisHashKV is the KVStore of RedisStore. Its values are hashes, encoded
+// by encodeRedisHash, each stored under the context key of its key. Its
+// counters are the counter keys.
+type redisHashKV struct {
+	client RedisClient
+	prefix string
+}
+
+// redisHashGetScript returns a hash as its fields and values,
+// alternating; a missing key reads as an empty hash. Delete shares
+// redisKVDeleteScript.
+const redisHashGetScript = `return redis.call('HGETALL', KEYS[1])`
+
+// redisHashSetNXScript stores a hash, given as redisHashGetScript returns
+// it, for ARGV[1] ms if the key does not exist, and returns 1 if it was
+// stored and 0 otherwise.
+//
+// KEYS: context.
+// ARGV: ttl ms, fields and values.
+const redisHashSetNXScript = `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+  return 0
+end
+redis.call('HSET', KEYS[1], unpack(ARGV, 2))
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+return 1
+`
+
+// redisHashCASScript replaces a hash holding exactly the ARGV[2] old
+// fields and values with the new ones for ARGV[1] ms, or deletes it if
+// there are none, and returns 1 if it was replaced and 0 otherwise.
+//
+// KEYS: context.
+// ARGV: ttl ms, number of old fields and values, old fields and values,
+// new fields and values.
+const redisHashCASScript = `
+local n = tonumber(ARGV[2])
+if redis.call('HLEN', KEYS[1]) * 2 ~= n then
+  return 0
+end
+for i = 3, n + 1, 2 do
+  if redis.call('HGET', KEYS[1], ARGV[i]) ~= ARGV[i + 1] then
+    return 0
+  end
+end
+redis.call('DEL', KEYS[1])
+if #ARGV > n + 2 then
+  redis.call('HSET', KEYS[1], unpack(ARGV, n + 3))
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return 1
+`
+
+// redisHashScanScript returns the next SCAN cursor followed by the key and
+// the hash of each context in the page. Keys removed between SCAN and
+// HGETALL are skipped.
+//
+// KEYS: counter set, only to route the script to the node holding the
+// prefix's keys on Redis Cluster.
+// ARGV: cursor, match pattern, count.
+const redisHashScanScript = `
+local page = redis.call('SCAN', ARGV[1], 'MATCH', ARGV[2], 'COUNT', ARGV[3])
+local out = {page[1]}
+for _, key in ipairs(page[2]) do
+  local fields = redis.call('HGETALL', key)
+  if #fields > 0 then
+    table.insert(out, key)
+    table.insert(out, fields)
+  end
+end
+return out
+`
+
+// redisScanCount is the COUNT hint of each SCAN page.
+const redisScanCount = 100
+
+// redisCounterAddScript drops expired IDs from a counter key, then adds an
+// ID unless ARGV[4] remain, extending the key TTL to its expiry. It
+// returns 1 if the ID was added and 0 otherwise.
+//
+// KEYS: counter, counter set.
+// ARGV: id, expiresAt, now, limit.
+const redisCounterAddScript = `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[3])
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[4]) then
+  return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+local ttl = tonumber(ARGV[2]) - tonumber(ARGV[3])
+if redis.call('PTTL', KEYS[1]) < ttl then
+  redis.call('PEXPIRE', KEYS[1], ttl)
+end
+redis.call('SADD', KEYS[2], KEYS[1])
+return 1
+`
+
+// redisCounterRemoveScript removes an ID from a counter key.
+//
+// KEYS: counter.
+// ARGV: id.
+const redisCounterRemoveScript = `return redis.call('ZREM', KEYS[1], ARGV[1])`
+
+// redisCleanupScript drops expired IDs from every counter key and returns
+// the number dropped. Contexts themselves expire through their TTL.
+//
+// KEYS: counter set.
+// ARGV: now.
+const redisCleanupScript = `
+local removed = 0
+for _, key in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+  removed = removed + redis.call('ZREMRANGEBYSCORE', key, '-inf', ARGV[1])
+  if redis.call('ZCARD', key) == 0 then
+    redis.call('SREM', KEYS[1], key)
+  end
+end
+return removed
+`
+
+// redisStatsScript returns the name and number of unexpired IDs of every
+// counter key, alternating.
+//
+// KEYS: counter set.
+// ARGV: now.
+const redisStatsScript = `
+local out = {}
+for _, key in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+  table.insert(out, key)
+  table.insert(out, redis.call('ZCOUNT', key, '(' .. ARGV[1], '+inf'))
+end
+return out
+`
+
+// redisOutstandingScript returns the size of a counter key.
+//
+// KEYS: counter.
+const redisOutstandingScript = `return redis.call('ZCARD', KEYS[1])`
+
+func (k *redisHashKV) contextKey(id string) string {
+	return k.prefix + "ctx:" + id
+}
+
+func (k *redisHashKV) counterKey(binding string) string {
+	return k.prefix + "binding:" + binding
+}
+
+func (k *redisHashKV) counterSetKey() string {
+	return k.prefix + "bindings"
+}
+
+// encodeRedisHash returns the redisHashKV value of a hash: its fields and
+// values, sorted by field, each preceded by its length as a uvarint. Unlike
+// JSON it carries the output of binary codecs, and equal hashes encode to
+// equal values.
+func encodeRedisHash(fields map[string]string) []byte {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var value []byte
+	for _, name := range names {
+		for _, s := range []string{name, fields[name]} {
+			value = binary.AppendUvarint(value, uint64(len(s)))
+			value = append(value, s...)
+		}
+	}
+	return value
+}
+
+// decodeRedisHash decodes a redisHashKV value into the fields and values
+// of its hash, alternating.
+func decodeRedisHash(value []byte) ([]string, error) {
+	var hash []string
+	for len(value) > 0 {
+		n, size := binary.Uvarint(value)
+		if size <= 0 || n > uint64(len(value)-size) {
+			return nil, errors.New("malformed hash value")
+		}
+		hash = append(hash, string(value[size:size+int(n)]))
+		value = value[size+int(n):]
+	}
+	if len(hash)%2 != 0 {
+		return nil, errors.New("malformed hash value")
+	}
+	return hash, nil
+}
+
+// redisHashArgs returns the fields and values of a redisHashKV value,
+// alternating, as script arguments.
+func redisHashArgs(value []byte) ([]interface{}, error) {
+	hash, err := decodeRedisHash(value)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]interface{}, len(hash))
+	for i, s := range hash {
+		args[i] = s
+	}
+	return args, nil
+}
+
+// redisHashReply returns the redisHashKV value of a hash read as its
+// fields and values, alternating.
+func redisHashReply(hash []interface{}) ([]byte, error) {
+	if len(hash)%2 != 0 {
+		return nil, fmt.Errorf("odd hash reply of %d elements", len(hash))
+	}
+	fields := make(map[string]string, len(hash)/2)
+	for i := 0; i < len(hash); i += 2 {
+		name, _ := hash[i].(string)
+		fields[name], _ = hash[i+1].(string)
+	}
+	return encodeRedisHash(fields), nil
+}
+
+// Get implements KVStore.
+func (k *redisHashKV) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := k.client.Eval(ctx, redisHashGetScript, []string{k.contextKey(key)})
+	if err != nil {
+		return nil, err
+	}
+	hash, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %T", reply)
+	}
+	if len(hash) == 0 {
+		return nil, ErrKVNotFound
+	}
+	return redisHashReply(hash)
+}
+
+// SetNX implements KVStore.
+func (k *redisHashKV) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	fields, err := redisHashArgs(value)
+	if err != nil {
+		return false, err
+	}
+	reply, err := k.client.Eval(ctx, redisHashSetNXScript, []string{k.contextKey(key)},
+		append([]interface{}{ttl.Milliseconds()}, fields...)...)
+	n, _ := reply.(int64)
+	return n == 1, err
+}
+
+// CompareAndSwap implements KVStore.
+func (k *redisHashKV) CompareAndSwap(ctx context.Context, key string, old, value []byte, ttl time.Duration) (bool, error) {
+	return k.swap(ctx, key, old, value, ttl)
+}
+
+// CompareAndDelete implements KVCompareAndDeleter.
+func (k *redisHashKV) CompareAndDelete(ctx context.Context, key string, old []byte) (bool, error) {
+	return k.swap(ctx, key, old, nil, 0)
+}
+
+// swap runs redisHashCASScript, deleting the hash if value is nil.
+func (k *redisHashKV) swap(ctx context.Context, key string, old, value []byte, ttl time.Duration) (bool, error) {
+	oldFields, err := redisHashArgs(old)
+	if err != nil {
+		return false, err
+	}
+	args := append([]interface{}{ttl.Milliseconds(), len(oldFields)}, oldFields...)
+	if value != nil {
+		fields, err := redisHashArgs(value)
+		if err != nil {
+			return false, err
+		}
+		args = append(args, fields...)
+	}
+	reply, err := k.client.Eval(ctx, redisHashCASScript, []string{k.contextKey(key)}, args...)
+	n, _ := reply.(int64)
+	return n == 1, err
+}
+
+// Delete implements KVStore.
+func (k *redisHashKV) Delete(ctx context.Context, key string) error {
+	_, err := k.client.Eval(ctx, redisKVDeleteScript, []string{k.contextKey(key)})
+	return err
+}
+
+// Scan implements KVScanner.
+//
+// It pages through the keyspace with SCAN rather than KEYS, which would
+// block Redis while it walks every key at once. SCAN is incremental but
+// only loosely consistent: a context may be visited more than once. On
+// Redis Cluster, the hash tag in KeyPrefix keeps every context on the node
+// that is scanned.
+func (k *redisHashKV) Scan(ctx context.Context, fn func(key string, value []byte) error) error {
+	cursor := "0"
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		reply, err := k.client.Eval(ctx, redisHashScanScript, []string{k.counterSetKey()},
+			cursor, globEscape(k.prefix)+"ctx:*", redisScanCount)
+		if err != nil {
+			return err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page)%2 != 1 {
+			return fmt.Errorf("unexpected reply %T", reply)
+		}
+		for i := 1; i < len(page); i += 2 {
+			key, _ := page[i].(string)
+			hash, _ := page[i+1].([]interface{})
+			value, err := redisHashReply(hash)
+			if err != nil {
+				return err
+			}
+			if err := fn(strings.TrimPrefix(key, k.contextKey("")), value); err != nil {
+				return err
+			}
+		}
+		if cursor, _ = page[0].(string); cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// globEscape escapes the characters special to Redis glob patterns.
+func globEscape(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// CounterAdd implements KVCounter.
+func (k *redisHashKV) CounterAdd(ctx context.Context, name, member string, expiresAt, now time.Time, limit int) (bool, error) {
+	reply, err := k.client.Eval(ctx, redisCounterAddScript, []string{k.counterKey(name), k.counterSetKey()},
+		member, expiresAt.UnixMilli(), now.UnixMilli(), limit)
+	n, _ := reply.(int64)
+	return n == 1, err
+}
+
+// CounterRemove implements KVCounter.
+func (k *redisHashKV) CounterRemove(ctx context.Context, name, member string) error {
+	_, err := k.client.Eval(ctx, redisCounterRemoveScript, []string{k.counterKey(name)}, member)
+	return err
+}
+
+// CounterLen implements KVCounter.
+func (k *redisHashKV) CounterLen(ctx context.Context, name string) (int, error) {
+	reply, err := k.client.Eval(ctx, redisOutstandingScript, []string{k.counterKey(name)})
+	n, _ := reply.(int64)
+	return int(n), err
+}
+
+// CounterSweep implements KVCounter.
+func (k *redisHashKV) CounterSweep(ctx context.Context, now time.Time) (int, error) {
+	reply, err := k.client.Eval(ctx, redisCleanupScript, []string{k.counterSetKey()}, now.UnixMilli())
+	n, _ := reply.(int64)
+	return int(n), err
+}
+
+// CounterCounts implements KVCounter.
+func (k *redisHashKV) CounterCounts(ctx context.Context, now time.Time) (map[string]int, error) {
+	reply, err := k.client.Eval(ctx, redisStatsScript, []string{k.counterSetKey()}, now.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields)%2 != 0 {
+		return nil, fmt.Errorf("unexpected reply %T", reply)
+	}
+	counts := make(map[string]int, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		key, _ := fields[i].(string)
+		n, _ := fields[i+1].(int64)
+		counts[strings.TrimPrefix(key, k.counterKey(""))] = int(n)
+	}
+	return counts, nil
+}
+
+// consumedRetention returns RedisStoreOptions.ConsumedRetention.
+func (s *RedisStore) consumedRetention() time.Duration {
+	return s.store.consumedRetention()
+}
+
+// Create issues and stores a new context.
+func (s *RedisStore) Create(opts ContextOptions) (*Context, error) {
+	return s.store.Create(opts)
+}
+
+// Get returns the context with the given ID.
+func (s *RedisStore) Get(id string) (*Context, error) {
+	return s.store.Get(id)
+}
+
+// Iterate calls fn with every stored context. See IteratingStore. It
+// pages through the keyspace with SCAN, which may visit a context more
+// than once.
+func (s *RedisStore) Iterate(ctx context.Context, fn func(*Context) error) error {
+	return s.store.Iterate(ctx, fn)
+}
+
+// InvalidateByBinding consumes every usable context of binding. See
+// InvalidatingStore.
+//
+// Contexts are only indexed by binding when the binding has a limit, so it
+// pages through every context key with SCAN, as Iterate does. Its cost
+// grows with the number of stored contexts, not the number invalidated:
+// keep it for incident response rather than routine use.
+func (s *RedisStore) InvalidateByBinding(binding string) (int, error) {
+	return s.store.InvalidateByBinding(binding)
+}
+
+// Consume marks the context as used.
+func (s *RedisStore) Consume(id string) error {
+	return s.store.Consume(id)
+}
+
+// Reserve holds the context for up to ttl. See ReservingStore.
+func (s *RedisStore) Reserve(id string, ttl time.Duration) (string, error) {
+	return s.store.Reserve(id, ttl)
+}
+
+// Release ends a reservation, leaving the context usable.
+func (s *RedisStore) Release(id, token string) error {
+	return s.store.Release(id, token)
+}
+
+// ConsumeReserved marks a reserved context as used.
+func (s *RedisStore) ConsumeReserved(id, token string) error {
+	return s.store.ConsumeReserved(id, token)
+}
+
+// ReleaseContext deletes an unconsumed context. See ReleasingStore.
+func (s *RedisStore) ReleaseContext(id string) error {
+	return s.store.ReleaseContext(id)
+}
+
+// Cleanup drops expired contexts from the binding counters and returns the
+// number dropped. Redis removes the contexts themselves when they expire.
+func (s *RedisStore) Cleanup() (int, error) {
+	return s.store.Cleanup()
+}
+
+// Stats reports the outstanding contexts of every binding with a limit,
+// from the counter keys, and the ErrRateLimited rejections and releases by
+// this instance since it was created. Expired counts the contexts of
+// bindings with a limit that this instance's Cleanup found expired. See
+// StatsStore.
+//
+// ActiveContexts is not reported, since counting contexts would mean
+// scanning the keyspace (see Iterate). Redis expires contexts itself, so
+// there are no evictions, and MaxContexts is not supported.
+func (s *RedisStore) Stats(ctx context.Context) (Stats, error) {
+	return s.store.Stats(ctx)
+}
+
+// Outstanding returns the number of unconsumed contexts counted against a
+// binding's limit that have not yet been dropped by Create or Cleanup.
+// It is always 0 for bindings without a limit.
+func (s *RedisStore) Outstanding(binding string) (int, error) {
+	return s.store.Outstanding(binding)
+}
@@ -0,0 +1,727 @@
+package ash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// legacyRedisStore is RedisStore as it was before being built on
+// KVContextStore, kept to run the store tests against both and to check
+// that each reads and consumes the contexts of the other: they share the
+// key layout, so instances of either can run side by side during an
+// upgrade.
+//
+// Every operation is a single script over the context hash and, for
+// bindings with a limit, the counter key.
+type legacyRedisStore struct {
+	client    RedisClient
+	prefix    string
+	limits    *bindingLimiter
+	now       func() time.Time
+	retention int64
+	codecs    *contextCodecs
+
+	// rateLimited counts the Create calls this instance had rejected,
+	// released the contexts it released, and expired the expired IDs its
+	// Cleanup dropped from counter keys.
+	rateLimited atomic.Int64
+	released    atomic.Int64
+	expired     atomic.Int64
+}
+
+// newLegacyRedisStore creates a legacyRedisStore as NewRedisStore would.
+func newLegacyRedisStore(opts RedisStoreOptions) *legacyRedisStore {
+	s := &legacyRedisStore{
+		client:    opts.Client,
+		prefix:    opts.KeyPrefix,
+		limits:    opts.BindingLimits.mustCompile(),
+		now:       opts.Now,
+		retention: opts.ConsumedRetention.Milliseconds(),
+		codecs:    newContextCodecs(opts.Codec, opts.DecodeCodecs),
+	}
+	if s.prefix == "" {
+		s.prefix = DefaultRedisKeyPrefix
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+	return s
+}
+
+// Keys are "<prefix>ctx:<id>" for contexts, "<prefix>binding:<binding>" for
+// counter keys, "<prefix>bindings" for the set of counter keys and
+// "<prefix>nonce:<binding>" for binding nonces (see BindingNonce).
+
+// redisCreateScript stores a context, enforcing the binding limit in ARGV[7]
+// (0 for none). It returns 0 if the limit is reached and 1 otherwise.
+//
+// KEYS: context, counter, counter set.
+// ARGV: context, binding, ttl ms, expiresAt, id, now, limit.
+const redisCreateScript = `
+local limit = tonumber(ARGV[7])
+if limit > 0 then
+  redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[6])
+  if redis.call('ZCARD', KEYS[2]) >= limit then
+    return 0
+  end
+  redis.call('ZADD', KEYS[2], ARGV[4], ARGV[5])
+  if redis.call('PTTL', KEYS[2]) < tonumber(ARGV[3]) then
+    redis.call('PEXPIRE', KEYS[2], ARGV[3])
+  end
+  redis.call('SADD', KEYS[3], KEYS[2])
+end
+redis.call('HSET', KEYS[1], 'ctx', ARGV[1], 'binding', ARGV[2], 'used', '0', 'expiresAt', ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`
+
+// redisGetScript returns the encoded context, its used flag and its
+// consumption time, or three empty strings if it does not exist.
+//
+// KEYS: context.
+const redisGetScript = `
+local v = redis.call('HMGET', KEYS[1], 'ctx', 'used', 'consumedAt')
+if not v[1] then
+  return {'', '', ''}
+end
+return {v[1], v[2], v[3] or ''}
+`
+
+// Replies of the consume scripts (redisConsumeScript, redisReserveScript,
+// redisConsumeReservedScript and redisReleaseContextScript). Failures are
+// told apart by the script, so Go maps them to an error without a second
+// round trip.
+const (
+	// redisReplyOK reports success.
+	redisReplyOK int64 = 1
+	// redisReplyNotFound reports that the context does not exist, either
+	// never issued or removed by its key TTL.
+	redisReplyNotFound int64 = 0
+	// redisReplyUsed reports that the context was already consumed.
+	redisReplyUsed int64 = -1
+	// redisReplyExpired reports that the context has expired.
+	redisReplyExpired int64 = -2
+	// redisReplyReserved reports that the context is reserved by another
+	// request or, for redisConsumeReservedScript, that the reservation is
+	// no longer held under the token.
+	redisReplyReserved int64 = 2
+)
+
+// redisConsumeScript marks a context used if it exists, is unused, has not
+// expired and is not reserved, records when, retains it for ARGV[4] ms (0
+// for none) and removes it from its binding's counter key.
+//
+// KEYS: context.
+// ARGV: now, id, counter key prefix, retention ms.
+// Returns: redisReplyOK, redisReplyNotFound, redisReplyUsed,
+// redisReplyExpired or redisReplyReserved.
+const redisConsumeScript = `
+local v = redis.call('HMGET', KEYS[1], 'used', 'expiresAt', 'binding', 'reservedUntil')
+if not v[1] then
+  return 0
+end
+if v[1] == '1' then
+  return -1
+end
+if tonumber(v[2]) <= tonumber(ARGV[1]) then
+  return -2
+end
+if v[4] and tonumber(v[4]) > tonumber(ARGV[1]) then
+  return 2
+end
+redis.call('HSET', KEYS[1], 'used', '1', 'consumedAt', ARGV[1])
+redis.call('HDEL', KEYS[1], 'reserved', 'reservedUntil')
+redis.call('ZREM', ARGV[3] .. v[3], ARGV[2])
+local retainUntil = tonumber(ARGV[1]) + tonumber(ARGV[4])
+if tonumber(ARGV[4]) > 0 and retainUntil > tonumber(v[2]) then
+  redis.call('PEXPIREAT', KEYS[1], retainUntil)
+end
+return 1
+`
+
+// redisReserveScript reserves a context under a token if Consume would
+// succeed.
+//
+// KEYS: context.
+// ARGV: now, token, reservedUntil.
+// Returns: as redisConsumeScript.
+const redisReserveScript = `
+local v = redis.call('HMGET', KEYS[1], 'used', 'expiresAt', 'reservedUntil')
+if not v[1] then
+  return 0
+end
+if v[1] == '1' then
+  return -1
+end
+if tonumber(v[2]) <= tonumber(ARGV[1]) then
+  return -2
+end
+if v[3] and tonumber(v[3]) > tonumber(ARGV[1]) then
+  return 2
+end
+redis.call('HSET', KEYS[1], 'reserved', ARGV[2], 'reservedUntil', ARGV[3])
+return 1
+`
+
+// redisReleaseScript ends a reservation if it is held under the token.
+//
+// KEYS: context.
+// ARGV: token.
+const redisReleaseScript = `
+if redis.call('HGET', KEYS[1], 'reserved') == ARGV[1] then
+  redis.call('HDEL', KEYS[1], 'reserved', 'reservedUntil')
+end
+return 1
+`
+
+// redisConsumeReservedScript marks a context used if it is unused and
+// reserved under the token, and otherwise as redisConsumeScript.
+//
+// KEYS: context.
+// ARGV: token, id, counter key prefix, now, retention ms.
+// Returns: redisReplyOK, redisReplyNotFound, redisReplyUsed or
+// redisReplyReserved.
+const redisConsumeReservedScript = `
+local v = redis.call('HMGET', KEYS[1], 'used', 'reserved', 'binding', 'expiresAt')
+if not v[1] then
+  return 0
+end
+if v[1] == '1' then
+  return -1
+end
+if v[2] ~= ARGV[1] then
+  return 2
+end
+redis.call('HSET', KEYS[1], 'used', '1', 'consumedAt', ARGV[4])
+redis.call('HDEL', KEYS[1], 'reserved', 'reservedUntil')
+redis.call('ZREM', ARGV[3] .. v[3], ARGV[2])
+local retainUntil = tonumber(ARGV[4]) + tonumber(ARGV[5])
+if tonumber(ARGV[5]) > 0 and retainUntil > tonumber(v[4]) then
+  redis.call('PEXPIREAT', KEYS[1], retainUntil)
+end
+return 1
+`
+
+// redisReleaseContextScript deletes a context if Consume would succeed on
+// it and removes it from its binding's counter key.
+//
+// KEYS: context.
+// ARGV: now, id, counter key prefix.
+// Returns: as redisConsumeScript.
+const redisReleaseContextScript = `
+local v = redis.call('HMGET', KEYS[1], 'used', 'expiresAt', 'binding', 'reservedUntil')
+if not v[1] then
+  return 0
+end
+if v[1] == '1' then
+  return -1
+end
+if tonumber(v[2]) <= tonumber(ARGV[1]) then
+  return -2
+end
+if v[4] and tonumber(v[4]) > tonumber(ARGV[1]) then
+  return 2
+end
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', ARGV[3] .. v[3], ARGV[2])
+return 1
+`
+
+// redisScanScript returns the next SCAN cursor followed by the encoded
+// context, used flag and consumption time of each context in the page.
+// Keys removed between SCAN and HMGET are skipped.
+//
+// KEYS: counter set, only to route the script to the node holding the
+// prefix's keys on Redis Cluster.
+// ARGV: cursor, match pattern, count.
+const redisScanScript = `
+local page = redis.call('SCAN', ARGV[1], 'MATCH', ARGV[2], 'COUNT', ARGV[3])
+local out = {page[1]}
+for _, key in ipairs(page[2]) do
+  local v = redis.call('HMGET', key, 'ctx', 'used', 'consumedAt')
+  if v[1] then
+    table.insert(out, v[1])
+    table.insert(out, v[2] or '')
+    table.insert(out, v[3] or '')
+  end
+end
+return out
+`
+
+// redisInvalidateScript consumes the unconsumed, unexpired contexts of a
+// binding among one SCAN page, as redisConsumeScript does, and returns the
+// next cursor and the number consumed.
+//
+// KEYS: counter set, only to route the script as for redisScanScript.
+// ARGV: cursor, match pattern, count, binding, now, prefix, retention,
+// context key prefix.
+const redisInvalidateScript = `
+local page = redis.call('SCAN', ARGV[1], 'MATCH', ARGV[2], 'COUNT', ARGV[3])
+local now = tonumber(ARGV[5])
+local retention = tonumber(ARGV[7])
+local n = 0
+for _, key in ipairs(page[2]) do
+  local v = redis.call('HMGET', key, 'binding', 'used', 'expiresAt')
+  if v[1] == ARGV[4] and v[2] == '0' and tonumber(v[3]) > now then
+    redis.call('HSET', key, 'used', '1', 'consumedAt', ARGV[5])
+    redis.call('HDEL', key, 'reserved', 'reservedUntil')
+    redis.call('ZREM', ARGV[6] .. v[1], string.sub(key, #ARGV[8] + 1))
+    if retention > 0 and now + retention > tonumber(v[3]) then
+      redis.call('PEXPIREAT', key, now + retention)
+    end
+    n = n + 1
+  end
+end
+return {page[1], n}
+`
+
+func (s *legacyRedisStore) contextKey(id string) string {
+	return s.prefix + "ctx:" + id
+}
+
+// consumedRetention returns RedisStoreOptions.ConsumedRetention.
+func (s *legacyRedisStore) consumedRetention() time.Duration {
+	return time.Duration(s.retention) * time.Millisecond
+}
+
+func (s *legacyRedisStore) counterPrefix() string {
+	return s.prefix + "binding:"
+}
+
+func (s *legacyRedisStore) counterSetKey() string {
+	return s.prefix + "bindings"
+}
+
+// Create issues and stores a new context.
+func (s *legacyRedisStore) Create(opts ContextOptions) (*Context, error) {
+	now := s.now()
+	ctx, err := newContext(opts, now)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.codecs.marshal(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ash: redis create: %w", err)
+	}
+
+	reply, err := s.client.Eval(context.Background(), redisCreateScript,
+		[]string{s.contextKey(ctx.ID), s.counterPrefix() + ctx.Binding, s.counterSetKey()},
+		data, ctx.Binding, opts.TTL.Milliseconds(), ctx.ExpiresAt, ctx.ID,
+		now.UnixMilli(), s.limits.limitFor(ctx.Binding))
+	if err != nil {
+		return nil, fmt.Errorf("ash: redis create: %w", err)
+	}
+	if n, _ := reply.(int64); n == 0 {
+		s.rateLimited.Add(1)
+		return nil, errBindingLimit
+	}
+	return ctx, nil
+}
+
+// Get returns the context with the given ID.
+func (s *legacyRedisStore) Get(id string) (*Context, error) {
+	reply, err := s.client.Eval(context.Background(), redisGetScript, []string{s.contextKey(id)})
+	if err != nil {
+		return nil, fmt.Errorf("ash: redis get: %w", err)
+	}
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields) != 3 {
+		return nil, fmt.Errorf("ash: redis get: unexpected reply %T", reply)
+	}
+	if data, _ := fields[0].(string); data == "" {
+		return nil, errContextNotFound
+	}
+	ctx, err := s.decodeContext(fields)
+	if err != nil {
+		return nil, fmt.Errorf("ash: redis get: %w", err)
+	}
+	return ctx, nil
+}
+
+// decodeContext decodes the encoded context, used flag and consumption
+// time read from a context hash.
+func (s *legacyRedisStore) decodeContext(fields []interface{}) (*Context, error) {
+	data, _ := fields[0].(string)
+	var ctx Context
+	if err := s.codecs.unmarshal(data, &ctx); err != nil {
+		return nil, err
+	}
+	ctx.Used = fields[1] == "1"
+	if consumedAt, _ := fields[2].(string); consumedAt != "" {
+		var err error
+		if ctx.ConsumedAt, err = strconv.ParseInt(consumedAt, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return &ctx, nil
+}
+
+// Iterate calls fn with every stored context. See IteratingStore.
+//
+// It pages through the keyspace with SCAN rather than KEYS, which would
+// block Redis while it walks every key at once. SCAN is incremental but
+// only loosely consistent: a context may be visited more than once. On
+// Redis Cluster, the hash tag in KeyPrefix keeps every context on the node
+// that is scanned.
+func (s *legacyRedisStore) Iterate(ctx context.Context, fn func(*Context) error) error {
+	cursor := "0"
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		reply, err := s.client.Eval(ctx, redisScanScript, []string{s.counterSetKey()},
+			cursor, globEscape(s.prefix)+"ctx:*", redisScanCount)
+		if err != nil {
+			return fmt.Errorf("ash: redis iterate: %w", err)
+		}
+		fields, ok := reply.([]interface{})
+		if !ok || len(fields)%3 != 1 {
+			return fmt.Errorf("ash: redis iterate: unexpected reply %T", reply)
+		}
+		for i := 1; i < len(fields); i += 3 {
+			c, err := s.decodeContext(fields[i : i+3])
+			if err != nil {
+				return fmt.Errorf("ash: redis iterate: %w", err)
+			}
+			if err := fn(c); err != nil {
+				return err
+			}
+		}
+		if cursor, _ = fields[0].(string); cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// InvalidateByBinding consumes every usable context of binding. See
+// InvalidatingStore.
+//
+// Contexts are only indexed by binding when the binding has a limit, so it
+// pages through every context key with SCAN, as Iterate does, consuming
+// the matches of each page atomically. Its cost grows with the number of
+// stored contexts, not the number invalidated: keep it for incident
+// response rather than routine use.
+func (s *legacyRedisStore) InvalidateByBinding(binding string) (int, error) {
+	invalidated := 0
+	cursor := "0"
+	for {
+		reply, err := s.client.Eval(context.Background(), redisInvalidateScript, []string{s.counterSetKey()},
+			cursor, globEscape(s.prefix)+"ctx:*", redisScanCount, binding, s.now().UnixMilli(),
+			s.counterPrefix(), s.retention, s.contextKey(""))
+		if err != nil {
+			return invalidated, fmt.Errorf("ash: redis invalidate: %w", err)
+		}
+		fields, ok := reply.([]interface{})
+		if !ok || len(fields) != 2 {
+			return invalidated, fmt.Errorf("ash: redis invalidate: unexpected reply %T", reply)
+		}
+		n, _ := fields[1].(int64)
+		invalidated += int(n)
+		if cursor, _ = fields[0].(string); cursor == "0" || cursor == "" {
+			return invalidated, nil
+		}
+	}
+}
+
+// Consume marks the context as used.
+func (s *legacyRedisStore) Consume(id string) error {
+	reply, err := s.client.Eval(context.Background(), redisConsumeScript,
+		[]string{s.contextKey(id)}, s.now().UnixMilli(), id, s.counterPrefix(), s.retention)
+	if err != nil {
+		return fmt.Errorf("ash: redis consume: %w", err)
+	}
+	return redisConsumeError("consume", reply, errContextInUse)
+}
+
+// redisConsumeError maps the reply of a consume script to its error, nil
+// for redisReplyOK. reserved is the error for redisReplyReserved.
+func redisConsumeError(op string, reply interface{}, reserved error) error {
+	n, ok := reply.(int64)
+	if !ok {
+		return fmt.Errorf("ash: redis %s: unexpected reply %T", op, reply)
+	}
+	switch n {
+	case redisReplyOK:
+		return nil
+	case redisReplyNotFound:
+		return errContextNotFound
+	case redisReplyUsed:
+		return errContextUsed
+	case redisReplyExpired:
+		return errContextExpired
+	case redisReplyReserved:
+		return reserved
+	}
+	return fmt.Errorf("ash: redis %s: unexpected reply %d", op, n)
+}
+
+// Reserve holds the context for up to ttl. See ReservingStore.
+func (s *legacyRedisStore) Reserve(id string, ttl time.Duration) (string, error) {
+	token, err := newReservationToken()
+	if err != nil {
+		return "", err
+	}
+	now := s.now()
+	reply, err := s.client.Eval(context.Background(), redisReserveScript,
+		[]string{s.contextKey(id)}, now.UnixMilli(), token, now.Add(ttl).UnixMilli())
+	if err != nil {
+		return "", fmt.Errorf("ash: redis reserve: %w", err)
+	}
+	if err := redisConsumeError("reserve", reply, errContextInUse); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Release ends a reservation, leaving the context usable.
+func (s *legacyRedisStore) Release(id, token string) error {
+	if _, err := s.client.Eval(context.Background(), redisReleaseScript,
+		[]string{s.contextKey(id)}, token); err != nil {
+		return fmt.Errorf("ash: redis release: %w", err)
+	}
+	return nil
+}
+
+// ConsumeReserved marks a reserved context as used.
+func (s *legacyRedisStore) ConsumeReserved(id, token string) error {
+	reply, err := s.client.Eval(context.Background(), redisConsumeReservedScript,
+		[]string{s.contextKey(id)}, token, id, s.counterPrefix(), s.now().UnixMilli(), s.retention)
+	if err != nil {
+		return fmt.Errorf("ash: redis consume reserved: %w", err)
+	}
+	return redisConsumeError("consume reserved", reply, errReservationLost)
+}
+
+// ReleaseContext deletes an unconsumed context. See ReleasingStore.
+func (s *legacyRedisStore) ReleaseContext(id string) error {
+	reply, err := s.client.Eval(context.Background(), redisReleaseContextScript,
+		[]string{s.contextKey(id)}, s.now().UnixMilli(), id, s.counterPrefix())
+	if err != nil {
+		return fmt.Errorf("ash: redis release context: %w", err)
+	}
+	if err := redisConsumeError("release context", reply, errContextInUse); err != nil {
+		return err
+	}
+	s.released.Add(1)
+	return nil
+}
+
+// Cleanup drops expired contexts from the binding counters and returns the
+// number dropped. Redis removes the contexts themselves when they expire.
+func (s *legacyRedisStore) Cleanup() (int, error) {
+	reply, err := s.client.Eval(context.Background(), redisCleanupScript,
+		[]string{s.counterSetKey()}, s.now().UnixMilli())
+	if err != nil {
+		return 0, fmt.Errorf("ash: redis cleanup: %w", err)
+	}
+	n, _ := reply.(int64)
+	s.expired.Add(n)
+	return int(n), nil
+}
+
+// Stats reports the outstanding contexts of every binding with a limit,
+// from the counter keys, and the ErrRateLimited rejections and releases by
+// this instance since it was created. Expired counts the contexts of
+// bindings with a limit that this instance's Cleanup found expired. See
+// StatsStore.
+//
+// ActiveContexts is not reported, since counting contexts would mean
+// scanning the keyspace (see Iterate). Redis expires contexts itself, so
+// there are no evictions, and MaxContexts is not supported.
+func (s *legacyRedisStore) Stats(ctx context.Context) (Stats, error) {
+	reply, err := s.client.Eval(ctx, redisStatsScript, []string{s.counterSetKey()}, s.now().UnixMilli())
+	if err != nil {
+		return Stats{}, fmt.Errorf("ash: redis stats: %w", err)
+	}
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields)%2 != 0 {
+		return Stats{}, fmt.Errorf("ash: redis stats: unexpected reply %T", reply)
+	}
+	stats := Stats{
+		PerBinding:  make(map[string]BindingStats, len(fields)/2),
+		RateLimited: s.rateLimited.Load(),
+		Released:    s.released.Load(),
+		Expired:     s.expired.Load(),
+	}
+	for i := 0; i < len(fields); i += 2 {
+		key, _ := fields[i].(string)
+		n, _ := fields[i+1].(int64)
+		binding := strings.TrimPrefix(key, s.counterPrefix())
+		stats.PerBinding[binding] = BindingStats{Count: int(n), Limit: s.limits.limitFor(binding)}
+	}
+	return stats, nil
+}
+
+// Outstanding returns the number of unconsumed contexts counted against a
+// binding's limit that have not yet been dropped by Create or Cleanup.
+// It is always 0 for bindings without a limit.
+func (s *legacyRedisStore) Outstanding(binding string) (int, error) {
+	reply, err := s.client.Eval(context.Background(), redisOutstandingScript,
+		[]string{s.counterPrefix() + binding})
+	if err != nil {
+		return 0, fmt.Errorf("ash: redis outstanding: %w", err)
+	}
+	n, _ := reply.(int64)
+	return int(n), nil
+}
+
+// replyRedis returns a fixed reply to every script and counts the calls.
+type replyRedis struct {
+	reply interface{}
+	calls int
+}
+
+func (r *replyRedis) Eval(context.Context, string, []string, ...interface{}) (interface{}, error) {
+	r.calls++
+	return r.reply, nil
+}
+
+// TestLegacyRedisStoreConsumeReplies tests the mapping of each consume
+// script reply to its error, in a single round trip.
+func TestLegacyRedisStoreConsumeReplies(t *testing.T) {
+	tests := []struct {
+		reply    interface{}
+		code     AshErrorCode
+		reserved bool
+		invalid  bool
+	}{
+		{reply: redisReplyOK},
+		{reply: redisReplyNotFound, code: ErrInvalidContext},
+		{reply: redisReplyUsed, code: ErrReplayDetected},
+		{reply: redisReplyExpired, code: ErrContextExpired},
+		{reply: redisReplyReserved, reserved: true},
+		{reply: int64(7), invalid: true},
+		{reply: "OK", invalid: true},
+	}
+	for _, tt := range tests {
+		client := &replyRedis{reply: tt.reply}
+		store := newLegacyRedisStore(RedisStoreOptions{Client: client})
+		ops := map[string]func() error{
+			"Consume":         func() error { return store.Consume("ash_x") },
+			"Reserve":         func() error { _, err := store.Reserve("ash_x", time.Second); return err },
+			"ConsumeReserved": func() error { return store.ConsumeReserved("ash_x", "token") },
+			"ReleaseContext":  func() error { return store.ReleaseContext("ash_x") },
+		}
+		for name, op := range ops {
+			client.calls = 0
+			err := op()
+			switch {
+			case tt.invalid:
+				var ashErr *AshError
+				if err == nil || errors.As(err, &ashErr) {
+					t.Errorf("%s with reply %v: expected a plain error, got %v", name, tt.reply, err)
+				}
+			case tt.reserved:
+				want := errContextInUse
+				if name == "ConsumeReserved" {
+					want = errReservationLost
+				}
+				if err != want {
+					t.Errorf("%s with reply %v: got %v, want %v", name, tt.reply, err, want)
+				}
+			case tt.code == "":
+				if err != nil {
+					t.Errorf("%s with reply %v: %v", name, tt.reply, err)
+				}
+			default:
+				if !errors.Is(err, tt.code) {
+					t.Errorf("%s with reply %v: got %v, want %s", name, tt.reply, err, tt.code)
+				}
+			}
+			if client.calls != 1 {
+				t.Errorf("%s with reply %v: %d round trips, want 1", name, tt.reply, client.calls)
+			}
+		}
+	}
+}
+
+// TestRedisStoreLegacyLayout tests that RedisStore and legacyRedisStore
+// read, reserve, consume, invalidate and release each other's contexts and
+// share the binding counters, as instances of both do during an upgrade.
+func TestRedisStoreLegacyLayout(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	clock := func() time.Time { return now }
+	client := newFakeRedis()
+	client.now = clock
+	opts := RedisStoreOptions{
+		Client:            client,
+		Now:               clock,
+		ConsumedRetention: time.Minute,
+		BindingLimits:     BindingLimits{"POST /api/*": 2},
+	}
+	stores := map[string]redisTestStore{"kv": NewRedisStore(opts), "legacy": newLegacyRedisStore(opts)}
+	for from, creator := range stores {
+		for to, user := range stores {
+			if from == to {
+				continue
+			}
+			t.Run(from+" to "+to, func(t *testing.T) {
+				binding := "POST /api/" + from
+				create := func() *Context {
+					t.Helper()
+					ctx, err := creator.Create(ContextOptions{
+						Binding: binding, TTL: time.Minute, Mode: ModeStrict,
+						Metadata: map[string]interface{}{"user": "u1"},
+					})
+					if err != nil {
+						t.Fatalf("Create failed: %v", err)
+					}
+					return ctx
+				}
+				outstanding := func(want int) {
+					t.Helper()
+					if n, err := user.Outstanding(binding); err != nil || n != want {
+						t.Errorf("Outstanding = %d, %v; want %d", n, err, want)
+					}
+				}
+
+				ctx := create()
+				if got, err := user.Get(ctx.ID); err != nil || !reflect.DeepEqual(got, ctx) {
+					t.Errorf("Get = %+v, %v; want %+v", got, err, ctx)
+				}
+				outstanding(1)
+				token, err := user.Reserve(ctx.ID, time.Second)
+				if err != nil {
+					t.Fatalf("Reserve failed: %v", err)
+				}
+				if err := creator.Consume(ctx.ID); err != errContextInUse {
+					t.Errorf("Consume of a reserved context: got %v, want %v", err, errContextInUse)
+				}
+				if err := creator.ConsumeReserved(ctx.ID, token); err != nil {
+					t.Fatalf("ConsumeReserved failed: %v", err)
+				}
+				if err := user.Consume(ctx.ID); !errors.Is(err, ErrReplayDetected) {
+					t.Errorf("Expected %s, got %v", ErrReplayDetected, err)
+				}
+				if got, err := user.Get(ctx.ID); err != nil || !got.Used || got.ConsumedAt != now.UnixMilli() {
+					t.Errorf("Get after ConsumeReserved = %+v, %v", got, err)
+				}
+				outstanding(0)
+
+				invalidated := create()
+				if n, err := user.InvalidateByBinding(binding); err != nil || n != 1 {
+					t.Errorf("InvalidateByBinding = %d, %v; want 1", n, err)
+				}
+				if err := creator.Consume(invalidated.ID); !errors.Is(err, ErrReplayDetected) {
+					t.Errorf("Expected %s after invalidation, got %v", ErrReplayDetected, err)
+				}
+
+				released := create()
+				if err := user.ReleaseContext(released.ID); err != nil {
+					t.Fatalf("ReleaseContext failed: %v", err)
+				}
+				if _, err := creator.Get(released.ID); !errors.Is(err, ErrInvalidContext) {
+					t.Errorf("Expected %s after release, got %v", ErrInvalidContext, err)
+				}
+				outstanding(0)
+			})
+		}
+	}
+}
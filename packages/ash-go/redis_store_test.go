@@ -0,0 +1,643 @@
+package ash
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis emulates the RedisStore, legacyRedisStore and RedisKV scripts
+// in memory. Context key TTLs
+// are modelled only when now is set; otherwise expiry is driven by the
+// store's clock alone.
+type fakeRedis struct {
+	mu       sync.Mutex
+	hashes   map[string]map[string]string
+	strings  map[string]string
+	expireAt map[string]int64
+	zsets    map[string]map[string]int64
+	sets     map[string]map[string]bool
+	now      func() time.Time
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		hashes:   make(map[string]map[string]string),
+		strings:  make(map[string]string),
+		expireAt: make(map[string]int64),
+		zsets:    make(map[string]map[string]int64),
+		sets:     make(map[string]map[string]bool),
+	}
+}
+
+// retain marks a context used at now and extends its key TTL by retention
+// ms past now if that is later than its expiry.
+func (f *fakeRedis) retain(key string, now, retention int64) {
+	h := f.hashes[key]
+	h["used"] = "1"
+	h["consumedAt"] = strconv.FormatInt(now, 10)
+	if expiresAt, _ := strconv.ParseInt(h["expiresAt"], 10, 64); retention > 0 && now+retention > expiresAt {
+		f.expireAt[key] = now + retention
+	}
+}
+
+// scan returns the next cursor and the page at cursor of the context keys
+// matching pattern. Pages hold two keys whatever the COUNT hint, to
+// exercise cursors.
+func (f *fakeRedis) scan(cursor, pattern string) (string, []string) {
+	prefix := strings.TrimSuffix(pattern, "*")
+	prefix = strings.NewReplacer(`\\`, `\`, `\*`, `*`, `\?`, `?`, `\[`, `[`, `\]`, `]`).Replace(prefix)
+	var matched []string
+	for key := range f.hashes {
+		if strings.HasPrefix(key, prefix) {
+			matched = append(matched, key)
+		}
+	}
+	sort.Strings(matched)
+	start, _ := strconv.Atoi(cursor)
+	end := start + 2
+	if end >= len(matched) {
+		return "0", matched[min(start, len(matched)):]
+	}
+	return strconv.Itoa(end), matched[start:end]
+}
+
+// setString sets a string key expiring after ttl ms, which is modelled only
+// when now is set.
+func (f *fakeRedis) setString(key, value string, ttl int64) {
+	f.strings[key] = value
+	f.pexpire(key, ttl)
+}
+
+// setHash sets a hash key to the fields and values in args, alternating,
+// expiring after ttl ms, which is modelled only when now is set.
+func (f *fakeRedis) setHash(key string, args []interface{}, ttl int64) {
+	h := make(map[string]string, len(args)/2)
+	for i := 0; i+1 < len(args); i += 2 {
+		h[fmt.Sprint(args[i])] = fmt.Sprint(args[i+1])
+	}
+	f.hashes[key] = h
+	f.pexpire(key, ttl)
+}
+
+// hashReply returns a hash as HGETALL does.
+func hashReply(h map[string]string) []interface{} {
+	out := []interface{}{}
+	for field, value := range h {
+		out = append(out, field, value)
+	}
+	return out
+}
+
+func (f *fakeRedis) pexpire(key string, ttl int64) {
+	if f.now != nil {
+		f.expireAt[key] = f.now().UnixMilli() + ttl
+	}
+}
+
+// zremExpired removes members of a sorted set scored at or below now.
+func (f *fakeRedis) zremExpired(key string, now int64) int64 {
+	var removed int64
+	for member, score := range f.zsets[key] {
+		if score <= now {
+			delete(f.zsets[key], member)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (f *fakeRedis) Eval(_ context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	arg := func(i int) string { return fmt.Sprint(args[i]) }
+	num := func(i int) int64 {
+		n, _ := strconv.ParseInt(arg(i), 10, 64)
+		return n
+	}
+
+	if f.now != nil {
+		for key, at := range f.expireAt {
+			if at <= f.now().UnixMilli() {
+				delete(f.hashes, key)
+				delete(f.strings, key)
+				delete(f.expireAt, key)
+			}
+		}
+	}
+
+	switch script {
+	case redisCreateScript:
+		if limit := num(6); limit > 0 {
+			f.zremExpired(keys[1], num(5))
+			if int64(len(f.zsets[keys[1]])) >= limit {
+				return int64(0), nil
+			}
+			if f.zsets[keys[1]] == nil {
+				f.zsets[keys[1]] = make(map[string]int64)
+			}
+			f.zsets[keys[1]][arg(4)] = num(3)
+			if f.sets[keys[2]] == nil {
+				f.sets[keys[2]] = make(map[string]bool)
+			}
+			f.sets[keys[2]][keys[1]] = true
+		}
+		f.hashes[keys[0]] = map[string]string{
+			"ctx": arg(0), "binding": arg(1), "used": "0", "expiresAt": arg(3),
+		}
+		f.expireAt[keys[0]] = num(5) + num(2)
+		return int64(1), nil
+
+	case redisBindingNonceScript:
+		if v, ok := f.strings[keys[0]]; ok {
+			at, nonce, _ := strings.Cut(v, ":")
+			if n, _ := strconv.ParseInt(at, 10, 64); n > num(0) {
+				return nonce, nil
+			}
+		}
+		if arg(1) == "" {
+			return "", nil
+		}
+		f.setString(keys[0], arg(2)+":"+arg(1), num(3))
+		return arg(1), nil
+
+	case redisGetScript:
+		h, ok := f.hashes[keys[0]]
+		if !ok {
+			return []interface{}{"", "", ""}, nil
+		}
+		return []interface{}{h["ctx"], h["used"], h["consumedAt"]}, nil
+
+	case redisConsumeScript, redisReserveScript, redisReleaseContextScript:
+		h, ok := f.hashes[keys[0]]
+		if !ok {
+			return redisReplyNotFound, nil
+		}
+		if h["used"] == "1" {
+			return redisReplyUsed, nil
+		}
+		if expiresAt, _ := strconv.ParseInt(h["expiresAt"], 10, 64); expiresAt <= num(0) {
+			return redisReplyExpired, nil
+		}
+		if until, ok := h["reservedUntil"]; ok {
+			if n, _ := strconv.ParseInt(until, 10, 64); n > num(0) {
+				return redisReplyReserved, nil
+			}
+		}
+		if script == redisReserveScript {
+			h["reserved"] = arg(1)
+			h["reservedUntil"] = arg(2)
+			return redisReplyOK, nil
+		}
+		if script == redisReleaseContextScript {
+			delete(f.hashes, keys[0])
+			delete(f.expireAt, keys[0])
+			delete(f.zsets[arg(2)+h["binding"]], arg(1))
+			return redisReplyOK, nil
+		}
+		f.retain(keys[0], num(0), num(3))
+		delete(h, "reserved")
+		delete(h, "reservedUntil")
+		delete(f.zsets[arg(2)+h["binding"]], arg(1))
+		return redisReplyOK, nil
+
+	case redisReleaseScript:
+		if h, ok := f.hashes[keys[0]]; ok && h["reserved"] == arg(0) {
+			delete(h, "reserved")
+			delete(h, "reservedUntil")
+		}
+		return int64(1), nil
+
+	case redisConsumeReservedScript:
+		h, ok := f.hashes[keys[0]]
+		if !ok {
+			return redisReplyNotFound, nil
+		}
+		if h["used"] == "1" {
+			return redisReplyUsed, nil
+		}
+		if h["reserved"] != arg(0) {
+			return redisReplyReserved, nil
+		}
+		f.retain(keys[0], num(3), num(4))
+		delete(h, "reserved")
+		delete(h, "reservedUntil")
+		delete(f.zsets[arg(2)+h["binding"]], arg(1))
+		return redisReplyOK, nil
+
+	case redisCleanupScript:
+		var removed int64
+		for key := range f.sets[keys[0]] {
+			removed += f.zremExpired(key, num(0))
+			if len(f.zsets[key]) == 0 {
+				delete(f.sets[keys[0]], key)
+			}
+		}
+		return removed, nil
+
+	case redisOutstandingScript:
+		return int64(len(f.zsets[keys[0]])), nil
+
+	case redisStatsScript:
+		var out []interface{}
+		for key := range f.sets[keys[0]] {
+			var n int64
+			for _, score := range f.zsets[key] {
+				if score > num(0) {
+					n++
+				}
+			}
+			out = append(out, key, n)
+		}
+		return out, nil
+
+	case redisScanScript:
+		next, page := f.scan(arg(0), arg(1))
+		out := []interface{}{next}
+		for _, key := range page {
+			h := f.hashes[key]
+			out = append(out, h["ctx"], h["used"], h["consumedAt"])
+		}
+		return out, nil
+
+	case redisInvalidateScript:
+		next, page := f.scan(arg(0), arg(1))
+		var n int64
+		for _, key := range page {
+			h := f.hashes[key]
+			if expiresAt, _ := strconv.ParseInt(h["expiresAt"], 10, 64); h["binding"] != arg(3) || h["used"] != "0" || expiresAt <= num(4) {
+				continue
+			}
+			f.retain(key, num(4), num(6))
+			delete(h, "reserved")
+			delete(h, "reservedUntil")
+			delete(f.zsets[arg(5)+h["binding"]], strings.TrimPrefix(key, arg(7)))
+			n++
+		}
+		return []interface{}{next, n}, nil
+
+	case redisHashGetScript:
+		return hashReply(f.hashes[keys[0]]), nil
+	case redisHashSetNXScript:
+		if _, ok := f.hashes[keys[0]]; ok {
+			return int64(0), nil
+		}
+		f.setHash(keys[0], args[1:], num(0))
+		return int64(1), nil
+	case redisHashCASScript:
+		h, n := f.hashes[keys[0]], int(num(1))
+		if 2*len(h) != n {
+			return int64(0), nil
+		}
+		for i := 2; i < n+2; i += 2 {
+			if value, ok := h[arg(i)]; !ok || value != arg(i+1) {
+				return int64(0), nil
+			}
+		}
+		delete(f.hashes, keys[0])
+		delete(f.expireAt, keys[0])
+		if len(args) > n+2 {
+			f.setHash(keys[0], args[n+2:], num(0))
+		}
+		return int64(1), nil
+	case redisHashScanScript:
+		next, page := f.scan(arg(0), arg(1))
+		out := []interface{}{next}
+		for _, key := range page {
+			out = append(out, key, hashReply(f.hashes[key]))
+		}
+		return out, nil
+	case redisCounterAddScript:
+		f.zremExpired(keys[0], num(2))
+		if int64(len(f.zsets[keys[0]])) >= num(3) {
+			return int64(0), nil
+		}
+		if f.zsets[keys[0]] == nil {
+			f.zsets[keys[0]] = make(map[string]int64)
+		}
+		f.zsets[keys[0]][arg(0)] = num(1)
+		if f.sets[keys[1]] == nil {
+			f.sets[keys[1]] = make(map[string]bool)
+		}
+		f.sets[keys[1]][keys[0]] = true
+		return int64(1), nil
+	case redisCounterRemoveScript:
+		delete(f.zsets[keys[0]], arg(0))
+		return int64(1), nil
+
+	case redisKVGetScript:
+		return f.strings[keys[0]], nil
+	case redisKVSetNXScript:
+		if _, ok := f.strings[keys[0]]; ok {
+			return int64(0), nil
+		}
+		f.setString(keys[0], arg(0), num(1))
+		return int64(1), nil
+	case redisKVCASScript:
+		if value, ok := f.strings[keys[0]]; !ok || value != arg(0) {
+			return int64(0), nil
+		}
+		f.setString(keys[0], arg(1), num(2))
+		return int64(1), nil
+	case redisKVDeleteScript:
+		delete(f.strings, keys[0])
+		delete(f.hashes, keys[0])
+		delete(f.expireAt, keys[0])
+		return int64(1), nil
+	}
+	return nil, errors.New("fakeRedis: unknown script")
+}
+
+// redisContextKey returns the key of a context under
+// DefaultRedisKeyPrefix.
+func redisContextKey(id string) string {
+	return DefaultRedisKeyPrefix + "ctx:" + id
+}
+
+// redisTestStore is the API shared by RedisStore and legacyRedisStore.
+type redisTestStore interface {
+	ReservingStore
+	ReleasingStore
+	InvalidatingStore
+	IteratingStore
+	StatsStore
+	Outstanding(binding string) (int, error)
+}
+
+// testRedisStores runs test against RedisStore and against
+// legacyRedisStore, each created by newStore.
+func testRedisStores(t *testing.T, test func(t *testing.T, newStore func(RedisStoreOptions) redisTestStore)) {
+	t.Run("kv", func(t *testing.T) {
+		test(t, func(opts RedisStoreOptions) redisTestStore { return NewRedisStore(opts) })
+	})
+	t.Run("legacy", func(t *testing.T) {
+		test(t, func(opts RedisStoreOptions) redisTestStore { return newLegacyRedisStore(opts) })
+	})
+}
+
+// TestRedisStoreConsume tests consumption and replay detection.
+func TestRedisStoreConsume(t *testing.T) {
+	testRedisStores(t, testRedisStoreConsume)
+}
+
+func testRedisStoreConsume(t *testing.T, newStore func(RedisStoreOptions) redisTestStore) {
+	now := time.UnixMilli(1700000000000)
+	store := newStore(RedisStoreOptions{Client: newFakeRedis(), Now: func() time.Time { return now }})
+
+	ctx, err := store.Create(ContextOptions{
+		Binding: "POST /api/test", TTL: time.Second, Mode: ModeStrict,
+		Metadata: map[string]interface{}{"user": "u1"},
+	})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	got, err := store.Get(ctx.ID)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if got.Binding != ctx.Binding || got.Nonce != ctx.Nonce || got.ExpiresAt != ctx.ExpiresAt || got.Metadata["user"] != "u1" {
+		t.Errorf("Get = %+v, want %+v", got, ctx)
+	}
+
+	assertCode := func(err error, code AshErrorCode) {
+		t.Helper()
+		var ashErr *AshError
+		if !errors.As(err, &ashErr) || ashErr.Code != code {
+			t.Errorf("Expected %s, got %v", code, err)
+		}
+	}
+
+	if err := store.Consume(ctx.ID); err != nil {
+		t.Fatalf("First consume failed: %v", err)
+	}
+	if got, _ := store.Get(ctx.ID); !got.Used {
+		t.Error("Expected consumed context to be marked used")
+	}
+	assertCode(store.Consume(ctx.ID), ErrReplayDetected)
+	assertCode(store.Consume("ash_missing"), ErrInvalidContext)
+
+	expiring, _ := store.Create(ContextOptions{Binding: "POST /api/test", TTL: time.Second})
+	now = now.Add(time.Second)
+	assertCode(store.Consume(expiring.ID), ErrContextExpired)
+}
+
+// TestRedisStoreBindingLimits tests that outstanding contexts are capped
+// per binding and released on consume and on cleanup.
+func TestRedisStoreBindingLimits(t *testing.T) {
+	testRedisStores(t, testRedisStoreBindingLimits)
+}
+
+func testRedisStoreBindingLimits(t *testing.T, newStore func(RedisStoreOptions) redisTestStore) {
+	now := time.UnixMilli(1700000000000)
+	store := newStore(RedisStoreOptions{
+		Client:        newFakeRedis(),
+		Now:           func() time.Time { return now },
+		BindingLimits: BindingLimits{"POST /api/*": 2},
+	})
+	create := func(binding string) error {
+		_, err := store.Create(ContextOptions{Binding: binding, TTL: time.Second})
+		return err
+	}
+	outstanding := func(binding string) int {
+		t.Helper()
+		n, err := store.Outstanding(binding)
+		if err != nil {
+			t.Fatalf("Outstanding failed: %v", err)
+		}
+		return n
+	}
+
+	first, _ := store.Create(ContextOptions{Binding: "POST /api/orders", TTL: time.Second})
+	if err := create("POST /api/orders"); err != nil {
+		t.Fatalf("Create within limit failed: %v", err)
+	}
+	var ashErr *AshError
+	if err := create("POST /api/orders"); !errors.As(err, &ashErr) || ashErr.Code != ErrRateLimited {
+		t.Fatalf("Expected %s, got %v", ErrRateLimited, err)
+	}
+	if err := create("POST /api/refunds"); err != nil {
+		t.Errorf("Create for another binding failed: %v", err)
+	}
+
+	// Consuming releases a slot.
+	if err := store.Consume(first.ID); err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+	if got := outstanding("POST /api/orders"); got != 1 {
+		t.Errorf("Outstanding after consume = %d, want 1", got)
+	}
+	if err := create("POST /api/orders"); err != nil {
+		t.Errorf("Create after consume failed: %v", err)
+	}
+
+	// Cleaning up expired contexts releases their slots.
+	now = now.Add(time.Second)
+	removed, err := store.Cleanup()
+	if err != nil || removed != 3 {
+		t.Errorf("Cleanup() = %d, %v; want 3, nil", removed, err)
+	}
+	if got := outstanding("POST /api/orders"); got != 0 {
+		t.Errorf("Outstanding after cleanup = %d, want 0", got)
+	}
+}
+
+// TestRedisStoreReserve tests RedisStore reservations.
+func TestRedisStoreReserve(t *testing.T) {
+	testRedisStores(t, func(t *testing.T, newStore func(RedisStoreOptions) redisTestStore) {
+		now := time.UnixMilli(1700000000000)
+		store := newStore(RedisStoreOptions{Client: newFakeRedis(), Now: func() time.Time { return now }})
+		testReservingStore(t, store, func(d time.Duration) { now = now.Add(d) })
+	})
+}
+
+// TestRedisStoreConsumedRetention tests RedisStore consumed-context
+// retention.
+func TestRedisStoreConsumedRetention(t *testing.T) {
+	testRedisStores(t, func(t *testing.T, newStore func(RedisStoreOptions) redisTestStore) {
+		now := time.UnixMilli(1700000000000)
+		clock := func() time.Time { return now }
+		client := newFakeRedis()
+		client.now = clock
+		store := newStore(RedisStoreOptions{Client: client, Now: clock, ConsumedRetention: time.Minute})
+		testConsumedRetention(t, store, clock, func(d time.Duration) { now = now.Add(d) })
+	})
+}
+
+// TestRedisStoreInvalidateByBinding tests RedisStore invalidation across
+// SCAN pages.
+func TestRedisStoreInvalidateByBinding(t *testing.T) {
+	testRedisStores(t, func(t *testing.T, newStore func(RedisStoreOptions) redisTestStore) {
+		testInvalidateByBinding(t, newStore(RedisStoreOptions{
+			Client:        newFakeRedis(),
+			BindingLimits: BindingLimits{"POST /api/transfer": 3},
+		}))
+	})
+}
+
+// TestRedisStoreReleaseContext tests RedisStore releases.
+func TestRedisStoreReleaseContext(t *testing.T) {
+	testRedisStores(t, func(t *testing.T, newStore func(RedisStoreOptions) redisTestStore) {
+		now := time.UnixMilli(1700000000000)
+		store := newStore(RedisStoreOptions{
+			Client:        newFakeRedis(),
+			Now:           func() time.Time { return now },
+			BindingLimits: BindingLimits{"POST /api/transfer": 1},
+		})
+		testReleasingStore(t, store, func(d time.Duration) { now = now.Add(d) })
+	})
+}
+
+// gobCodec is a ContextCodec encoding contexts with encoding/gob.
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(ctx *Context) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(ctx)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, ctx *Context) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(ctx)
+}
+
+// TestRedisStoreCodec tests that contexts round-trip through a non-JSON
+// codec and that stores read contexts of every codec they know.
+func TestRedisStoreCodec(t *testing.T) {
+	testRedisStores(t, testRedisStoreCodec)
+}
+
+func testRedisStoreCodec(t *testing.T, newStore func(RedisStoreOptions) redisTestStore) {
+	client := newFakeRedis()
+	jsonStore := newStore(RedisStoreOptions{Client: client})
+	gobStore := newStore(RedisStoreOptions{Client: client, Codec: gobCodec{}})
+	opts := ContextOptions{
+		Binding: "POST /api/accounts/{id}", TTL: time.Minute, Mode: ModeStrict,
+		Metadata: map[string]interface{}{"user": "u1", "limit": 100.0},
+		Params:   map[string]string{"id": "42"},
+	}
+
+	stored, err := gobStore.Create(opts)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if data := client.hashes[redisContextKey(stored.ID)]["ctx"]; !strings.HasPrefix(data, "gob:") {
+		t.Errorf("Stored context = %.20q, want the gob: prefix", data)
+	}
+	if err := gobStore.Consume(stored.ID); err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+	got, err := gobStore.Get(stored.ID)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	stored.Used, stored.ConsumedAt = true, got.ConsumedAt
+	if !reflect.DeepEqual(got, stored) {
+		t.Errorf("Get = %+v, want %+v", got, stored)
+	}
+	if _, err := jsonStore.Get(stored.ID); err == nil || !strings.Contains(err.Error(), `unknown context codec "gob"`) {
+		t.Errorf("Expected an unknown codec error from a JSON store, got %v", err)
+	}
+	migrating := newStore(RedisStoreOptions{Client: client, DecodeCodecs: []ContextCodec{gobCodec{}}})
+	if _, err := migrating.Get(stored.ID); err != nil {
+		t.Errorf("Get with the codec in DecodeCodecs failed: %v", err)
+	}
+
+	// Contexts stored as JSON stay readable after switching codecs.
+	old, err := jsonStore.Create(opts)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if data := client.hashes[redisContextKey(old.ID)]["ctx"]; !strings.HasPrefix(data, "{") {
+		t.Errorf("Stored context = %.20q, want a JSON object", data)
+	}
+	if got, err := gobStore.Get(old.ID); err != nil || got.Metadata["user"] != "u1" {
+		t.Errorf("Get of a JSON context = %+v, %v", got, err)
+	}
+	var n int
+	if err := gobStore.Iterate(context.Background(), func(*Context) error { n++; return nil }); err != nil || n != 2 {
+		t.Errorf("Iterate visited %d contexts, err %v; want 2", n, err)
+	}
+
+	for _, name := range []string{"", "{gob", "gob:v2"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected a panic for codec name %q", name)
+				}
+			}()
+			newStore(RedisStoreOptions{Client: client, Codec: namedCodec{gobCodec{}, name}})
+		}()
+	}
+}
+
+// namedCodec renames a ContextCodec.
+type namedCodec struct {
+	ContextCodec
+	name string
+}
+
+func (c namedCodec) Name() string { return c.name }
+
+// TestRedisStoreContract tests RedisStore against the ContextStore
+// contract.
+func TestRedisStoreContract(t *testing.T) {
+	testRedisStores(t, func(t *testing.T, newStore func(RedisStoreOptions) redisTestStore) {
+		now := time.UnixMilli(1700000000000)
+		clock := func() time.Time { return now }
+		client := newFakeRedis()
+		client.now = clock
+		store := newStore(RedisStoreOptions{Client: client, Now: clock})
+		testContextStore(t, store, func(d time.Duration) { now = now.Add(d) })
+	})
+}
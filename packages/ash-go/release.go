@@ -0,0 +1,88 @@
+package ash
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrReleaseUnsupported is returned by ReleaseContext when the store is
+// not a ReleasingStore.
+var ErrReleaseUnsupported = errors.New("ash: store cannot release contexts")
+
+// ReleaseContext deletes the unconsumed context id, for a client that
+// abandoned the action it was issued for, so that it stops counting
+// against BindingLimits. Verifying it afterwards fails with
+// ErrInvalidContext. It fails like Consume if the context is consumed,
+// expired or reserved, and with ErrReleaseUnsupported if the store is not
+// a ReleasingStore.
+func (a *Ash) ReleaseContext(id string) error {
+	store, ok := storeAs[ReleasingStore](a.store)
+	if !ok {
+		return ErrReleaseUnsupported
+	}
+	if err := store.ReleaseContext(id); err != nil {
+		return err
+	}
+	if a.counters != nil {
+		a.counters.released.Add(1)
+	}
+	return nil
+}
+
+// NewReleaseHandler returns a handler releasing the context named by the
+// HeaderContextID header of a POST or DELETE request, for clients to call
+// when the user cancels. It answers 204 on success and an error response
+// otherwise, with the status of StatusForCode. With WithTenantFunc, a
+// context of another tenant is reported as not found, and so is a context
+// issued with ContextOptions.SessionSalt when the request is not made in
+// the same session (see WithSessionSaltFunc). It answers 501 if the store
+// is not a ReleasingStore.
+func NewReleaseHandler(a *Ash) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := storeAs[ReleasingStore](a.store); !ok {
+			http.Error(w, "store cannot release contexts", http.StatusNotImplemented)
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "POST, DELETE")
+			a.writeError(w, http.StatusMethodNotAllowed, NewAshError(ErrMalformedRequest, "method not allowed"))
+			return
+		}
+		if dupErr := checkDuplicateHeaders(r.Header); dupErr != nil {
+			a.writeError(w, http.StatusBadRequest, dupErr)
+			return
+		}
+		id := r.Header.Get(headerContextID)
+		if id == "" {
+			a.writeError(w, http.StatusBadRequest, errMissingContextID)
+			return
+		}
+
+		ctx, err := a.store.Get(id)
+		if err == nil && !a.mayRelease(r, ctx) {
+			err = errContextNotFound
+		}
+		if err == nil {
+			err = a.ReleaseContext(id)
+		}
+		if err != nil {
+			ashErr, ok := asAshError(err)
+			if !ok {
+				a.logger.Error("ash: context release failed", "contextId", id, "error", err)
+				ashErr = errInternal
+			}
+			a.writeError(w, StatusForCode(ashErr.Code), ashErr)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// mayRelease reports whether r is made for the tenant and in the session
+// ctx was issued to.
+func (a *Ash) mayRelease(r *http.Request, ctx *Context) bool {
+	if a.tenantFunc != nil && !TimingSafeCompare(ctx.Tenant, a.tenantFunc(r)) {
+		return false
+	}
+	return ctx.SessionKey == "" || TimingSafeCompare(ctx.SessionKey, sessionKey(a.sessionSaltFor(r), ctx.ID))
+}
@@ -0,0 +1,189 @@
+package ash
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestReleaseContext tests that a released context cannot be verified and
+// that a consumed one cannot be released.
+func TestReleaseContext(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, _ := newTestAsh(t, now, WithExpvar("ash_release_test"))
+	issue := func() (*Context, string) {
+		t.Helper()
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/confirm"})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		return ctx, clientProof(t, ctx, "", "")
+	}
+
+	ctx, proof := issue()
+	if err := a.ReleaseContext(ctx.ID); err != nil {
+		t.Fatalf("ReleaseContext failed: %v", err)
+	}
+	if _, err := a.Verify(ctx.ID, proof, ctx.Binding, nil, ""); !errors.Is(err, ErrInvalidContext) {
+		t.Errorf("Expected %s after release, got %v", ErrInvalidContext, err)
+	}
+
+	ctx, proof = issue()
+	if _, err := a.Verify(ctx.ID, proof, ctx.Binding, nil, ""); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if err := a.ReleaseContext(ctx.ID); !errors.Is(err, ErrReplayDetected) {
+		t.Errorf("Expected %s releasing a consumed context, got %v", ErrReplayDetected, err)
+	}
+	if _, err := a.Verify(ctx.ID, proof, ctx.Binding, nil, ""); !errors.Is(err, ErrReplayDetected) {
+		t.Errorf("Expected %s on replay after release attempt, got %v", ErrReplayDetected, err)
+	}
+
+	var counts map[string]int
+	if err := json.Unmarshal([]byte(expvar.Get("ash_release_test").String()), &counts); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if counts["released"] != 1 {
+		t.Errorf("released = %d, want 1", counts["released"])
+	}
+
+	other, err := New(nonReleasingStore{NewMemoryStore(MemoryStoreOptions{})})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := other.ReleaseContext(ctx.ID); err != ErrReleaseUnsupported {
+		t.Errorf("Expected ErrReleaseUnsupported, got %v", err)
+	}
+}
+
+// nonReleasingStore hides the ReleaseContext method of its store.
+type nonReleasingStore struct{ ContextStore }
+
+// TestReleaseHandler tests the release endpoint.
+func TestReleaseHandler(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, _ := newTestAsh(t, now, WithTenantFunc(func(r *http.Request) string { return r.Header.Get("X-Tenant") }))
+	handler := NewReleaseHandler(a)
+	issue := func(tenant string) *Context {
+		t.Helper()
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/confirm", Tenant: tenant})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		return ctx
+	}
+	release := func(method, id, tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/context/release", nil)
+		if id != "" {
+			req.Header.Set(HeaderContextID, id)
+		}
+		req.Header.Set("X-Tenant", tenant)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	consumed := issue("acme")
+	if err := a.store.Consume(consumed.ID); err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+	tests := []struct {
+		name   string
+		method string
+		ctx    *Context
+		tenant string
+		status int
+		code   AshErrorCode
+	}{
+		{name: "released", method: http.MethodPost, ctx: issue("acme"), tenant: "acme", status: http.StatusNoContent},
+		{name: "delete", method: http.MethodDelete, ctx: issue("acme"), tenant: "acme", status: http.StatusNoContent},
+		{name: "consumed", method: http.MethodPost, ctx: consumed, tenant: "acme", status: http.StatusConflict, code: ErrReplayDetected},
+		{name: "other tenant", method: http.MethodPost, ctx: issue("acme"), tenant: "globex", status: http.StatusForbidden, code: ErrInvalidContext},
+		{name: "unknown", method: http.MethodPost, ctx: &Context{ID: "ash_unknown"}, status: http.StatusForbidden, code: ErrInvalidContext},
+		{name: "missing ID", method: http.MethodPost, ctx: &Context{}, status: http.StatusBadRequest, code: ErrMissingHeaders},
+		{name: "method", method: http.MethodGet, ctx: issue("acme"), tenant: "acme", status: http.StatusMethodNotAllowed, code: ErrMalformedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := release(tt.method, tt.ctx.ID, tt.tenant)
+			if rec.Code != tt.status {
+				t.Fatalf("Status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.code != "" {
+				if got := decodeError(t, rec); got.Code != tt.code {
+					t.Errorf("Error = %s, want %s", got.Code, tt.code)
+				}
+			}
+			if tt.ctx.ID == "" || tt.ctx.ID == "ash_unknown" {
+				return
+			}
+			_, err := a.store.Get(tt.ctx.ID)
+			if removed, want := err != nil, tt.status == http.StatusNoContent; removed != want {
+				t.Errorf("Context removed = %v, want %v", removed, want)
+			}
+		})
+	}
+
+	ctx := issue("acme")
+	req := httptest.NewRequest(http.MethodPost, "/api/context/release", nil)
+	req.Header.Add(HeaderContextID, ctx.ID)
+	req.Header.Add(HeaderContextID, "ash_other")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest || decodeError(t, rec).Code != ErrMalformedRequest {
+		t.Errorf("Expected 400 %s for duplicate context IDs, got %d: %s", ErrMalformedRequest, rec.Code, rec.Body)
+	}
+
+	unsupported, err := New(nonReleasingStore{NewMemoryStore(MemoryStoreOptions{})})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	NewReleaseHandler(unsupported).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("Status without a ReleasingStore = %d, want %d", rec.Code, http.StatusNotImplemented)
+	}
+}
+
+// TestReleaseHandlerSession tests that a context bound to a session can
+// only be released from that session.
+func TestReleaseHandlerSession(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithSessionSaltFunc(func(r *http.Request) []byte {
+		if s := r.Header.Get("X-Session"); s != "" {
+			return []byte(s)
+		}
+		return nil
+	}))
+	handler := NewReleaseHandler(a)
+	ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/confirm", SessionSalt: []byte("alice")})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	release := func(session string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/context/release", nil)
+		req.Header.Set(HeaderContextID, ctx.ID)
+		if session != "" {
+			req.Header.Set("X-Session", session)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, session := range []string{"mallory", ""} {
+		rec := release(session)
+		if rec.Code != http.StatusForbidden || decodeError(t, rec).Code != ErrInvalidContext {
+			t.Errorf("Release from session %q: expected 403 %s, got %d: %s", session, ErrInvalidContext, rec.Code, rec.Body)
+		}
+		if _, err := a.store.Get(ctx.ID); err != nil {
+			t.Fatalf("Context released from session %q: %v", session, err)
+		}
+	}
+	if rec := release("alice"); rec.Code != http.StatusNoContent {
+		t.Errorf("Release from the issuing session: got %d, want 204: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,144 @@
+package ash
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// EncodedSlashes is how an encoded slash (%2F) in a request path is
+// treated when building the binding.
+type EncodedSlashes int
+
+const (
+	// EncodedSlashesDecode decodes %2F to a path separator, as r.URL.Path
+	// and http.ServeMux do.
+	EncodedSlashesDecode EncodedSlashes = iota
+	// EncodedSlashesOpaque keeps %2F within its segment, as routers that
+	// match on the escaped path do, such as gorilla/mux with
+	// UseEncodedPath. "/files/a%2Fb" then has the binding "/files/a%2Fb"
+	// rather than "/files/a/b".
+	EncodedSlashesOpaque
+)
+
+// RequestPath returns the path of u to build its binding from with
+// NormalizeBinding: the decoded path, except that an encoded '?' or '#'
+// stays escaped as %3F or %23, so that the binding is not cut there, and
+// with EncodedSlashesOpaque an encoded slash stays escaped as %2F. Escapes
+// that stay are written with uppercase hex digits.
+//
+// Clients and servers must build the path the same way, which
+// BindingFromRequest does for both given the same options.
+func RequestPath(u *url.URL, slashes EncodedSlashes) string {
+	// Only an escaped path can hold an encoded '?' or '#', and only a path
+	// with RawPath set an encoded slash.
+	if !strings.ContainsAny(u.Path, "?#") && (slashes != EncodedSlashesOpaque || u.RawPath == "") {
+		return u.Path
+	}
+	escaped := u.EscapedPath()
+	var sb strings.Builder
+	sb.Grow(len(escaped))
+	for {
+		i := strings.IndexByte(escaped, '%')
+		if i == -1 || i+2 >= len(escaped) {
+			sb.WriteString(escaped)
+			break
+		}
+		sb.WriteString(escaped[:i])
+		c, ok := unhexByte(escaped[i+1], escaped[i+2])
+		if !ok {
+			return u.Path
+		}
+		if c == '?' || c == '#' || c == '/' && slashes == EncodedSlashesOpaque {
+			sb.WriteString(strings.ToUpper(escaped[i : i+3]))
+		} else {
+			sb.WriteByte(c)
+		}
+		escaped = escaped[i+3:]
+	}
+	return sb.String()
+}
+
+// BindingOption configures BindingFromRequest.
+type BindingOption func(*bindingOptions)
+
+// bindingOptions are the rules for building the binding of a request.
+type bindingOptions struct {
+	encodedSlashes EncodedSlashes
+	pathHeader     string
+	routePattern   bool
+}
+
+// BindingEncodedSlashes sets whether an encoded slash (%2F) in the path is
+// a separator in the binding (default: EncodedSlashesDecode). See
+// RequestPath.
+func BindingEncodedSlashes(slashes EncodedSlashes) BindingOption {
+	return func(o *bindingOptions) { o.encodedSlashes = slashes }
+}
+
+// BindingPathHeader builds the binding from the path in the named header,
+// such as "X-Forwarded-Path", when the request carries it. See
+// MiddlewareOptions.PathHeader for when this is safe.
+func BindingPathHeader(name string) BindingOption {
+	return func(o *bindingOptions) { o.pathHeader = name }
+}
+
+// BindingRoutePattern builds the binding from the http.ServeMux pattern
+// that routed the request, when it has one. It takes precedence over
+// BindingPathHeader. See MiddlewareOptions.RoutePattern.
+func BindingRoutePattern() BindingOption {
+	return func(o *bindingOptions) { o.routePattern = true }
+}
+
+// BindingFromRequest returns the binding of r: NormalizeBinding of its
+// method and a path chosen by opts, in order of precedence the route
+// pattern, the path header, and the path of r.URL as built by RequestPath.
+// The query string and host are never part of a binding.
+//
+// HTTPMiddleware, VerifyRequest, SignRequest, Transport and adapters built
+// on them all use it, so clients and servers given the same options agree
+// on the binding.
+func BindingFromRequest(r *http.Request, opts ...BindingOption) string {
+	var o bindingOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return NormalizeBinding(r.Method, o.path(r))
+}
+
+// path returns the path the binding of r is built from.
+func (o *bindingOptions) path(r *http.Request) string {
+	if o.routePattern {
+		if pattern := requestPattern(r); pattern != "" {
+			return patternPath(pattern)
+		}
+	}
+	if o.pathHeader != "" {
+		if path := r.Header.Get(o.pathHeader); path != "" {
+			if u, err := url.ParseRequestURI(path); err == nil {
+				return RequestPath(u, o.encodedSlashes)
+			}
+			return path
+		}
+	}
+	return RequestPath(r.URL, o.encodedSlashes)
+}
+
+// unhexByte decodes the two hex digits of a percent-escape.
+func unhexByte(hi, lo byte) (byte, bool) {
+	h, ok1 := unhexDigit(hi)
+	l, ok2 := unhexDigit(lo)
+	return h<<4 | l, ok1 && ok2
+}
+
+func unhexDigit(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
@@ -0,0 +1,121 @@
+package ash
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// DefaultReservationTTL is the default lifetime of the reservation held
+// while a handler runs under MiddlewareOptions.DeferConsume.
+const DefaultReservationTTL = 30 * time.Second
+
+// errContextInUse is returned for a context reserved by another request.
+var errContextInUse = NewAshError(ErrReplayDetected, "context in use")
+
+// errReservationLost is returned by ConsumeReserved when the reservation
+// was replaced by another.
+var errReservationLost = NewAshError(ErrReplayDetected, "reservation lost")
+
+// newReservationToken returns a random reservation token.
+func newReservationToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// withReservation reserves the context for ttl instead of consuming it,
+// storing the reservation token in *token. The store must be a
+// ReservingStore.
+func withReservation(ttl time.Duration, token *string) VerifyOption {
+	return func(o *verifyOptions) {
+		o.reserveTTL = ttl
+		o.reservation = token
+	}
+}
+
+// statusRecorder records the status written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the final status and passes it on.
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write records an implicit 200 status and passes b on.
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush records an implicit 200 status and flushes the underlying
+// ResponseWriter, if it can be flushed, for streaming handlers that assert
+// http.Flusher.
+func (w *statusRecorder) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// succeeded reports whether the handler wrote a 2xx or 3xx status. A
+// handler that wrote nothing succeeded with an implicit 200.
+func (w *statusRecorder) succeeded() bool {
+	return w.status == 0 || w.status < http.StatusBadRequest
+}
+
+// serveReserved runs next while the request's context is reserved under
+// token, consuming it if next succeeded and releasing it otherwise,
+// including when next panics.
+func (a *Ash) serveReserved(next http.Handler, w http.ResponseWriter, r *http.Request, contextID, token string) {
+	store := a.store.(ReservingStore)
+	rec := &statusRecorder{ResponseWriter: w}
+	consumed := false
+	defer func() {
+		if consumed {
+			return
+		}
+		if err := store.Release(contextID, token); err != nil {
+			a.logger.Warn("ash: releasing reservation failed", "contextId", contextID, "error", err)
+		}
+	}()
+
+	next.ServeHTTP(rec, r)
+	if !rec.succeeded() {
+		return
+	}
+	consumed = true
+	if err := store.ConsumeReserved(contextID, token); err != nil {
+		// The reservation lapsed while next ran and another request took
+		// the context, so next ran for a replayed context.
+		if ashErr, ok := asAshError(err); ok && ashErr.Code == ErrReplayDetected {
+			a.logger.Warn("ash: reservation lapsed while the handler ran", "contextId", contextID, "error", err)
+			if a.counters != nil {
+				a.counters.replayed.Add(1)
+			}
+			return
+		}
+		a.logger.Warn("ash: consuming reserved context failed", "contextId", contextID, "error", err)
+		return
+	}
+	a.rememberConsumed(contextID)
+	if a.counters != nil {
+		a.counters.consumed.Add(1)
+	}
+}
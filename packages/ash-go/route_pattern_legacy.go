@@ -0,0 +1,10 @@
+//go:build !go1.23
+
+package ash
+
+import "net/http"
+
+// requestPattern returns "": http.Request has no Pattern before Go 1.23.
+func requestPattern(r *http.Request) string {
+	return ""
+}
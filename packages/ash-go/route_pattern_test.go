@@ -0,0 +1,99 @@
+//go:build go1.23
+
+// The module's go version selects the pre-1.22 ServeMux by default.
+//go:debug httpmuxgo121=0
+
+package ash
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHTTPMiddlewareRoutePattern tests binding to the ServeMux pattern
+// that routed a request.
+func TestHTTPMiddlewareRoutePattern(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	mux := http.NewServeMux()
+	mux.Handle("POST /api/orders/{id}", a.HTTPMiddleware(MiddlewareOptions{RoutePattern: true})(ok))
+	mux.Handle("POST example.com/api/refunds/{id}", a.HTTPMiddleware(MiddlewareOptions{RoutePattern: true})(ok))
+	mux.Handle("POST /api/items/{id}", a.HTTPMiddleware(MiddlewareOptions{})(ok))
+
+	body := `{"amount":100}`
+	send := func(binding, url string) int {
+		t.Helper()
+		ctx, err := a.IssueContext(ContextOptions{Binding: binding})
+		if err != nil {
+			t.Fatalf("IssueContext(%q) failed: %v", binding, err)
+		}
+		req := httptest.NewRequest("POST", url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(HeaderContextID, ctx.ID)
+		req.Header.Set(HeaderProof, clientProof(t, ctx, body, "application/json"))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, tt := range []struct {
+		binding, url string
+		want         int
+	}{
+		{"POST /api/orders/{id}", "/api/orders/42", http.StatusOK},
+		{"POST /api/orders/{id}", "/api/orders/43", http.StatusOK},
+		{"POST /api/refunds/{id}", "http://example.com/api/refunds/7", http.StatusOK},
+		{"POST /api/orders/42", "/api/orders/42", http.StatusForbidden},
+		// Without RoutePattern the proof must cover the concrete path.
+		{"POST /api/items/{id}", "/api/items/42", http.StatusForbidden},
+		{"POST /api/items/42", "/api/items/42", http.StatusOK},
+	} {
+		if got := send(tt.binding, tt.url); got != tt.want {
+			t.Errorf("%s with %q: got %d, want %d", tt.url, tt.binding, got, tt.want)
+		}
+	}
+
+	// Requests not routed by a ServeMux fall back to the path.
+	handler := a.HTTPMiddleware(MiddlewareOptions{RoutePattern: true})(ok)
+	req := signedRequest(t, a, "POST", "/api/orders/42", body, "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected fallback to the path, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// TestPatternPath tests extracting the path of a ServeMux pattern.
+func TestPatternPath(t *testing.T) {
+	for pattern, want := range map[string]string{
+		"/api/orders/{id}":                  "/api/orders/{id}",
+		"POST /api/orders/{id}":             "/api/orders/{id}",
+		"GET  example.com/api/{$}":          "/api/",
+		"example.com/files/{path...}":       "/files/{path...}",
+		"DELETE /api/orders/{id}/items/{n}": "/api/orders/{id}/items/{n}",
+	} {
+		if got := patternPath(pattern); got != want {
+			t.Errorf("patternPath(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+// TestBindingFromRequestRoutePattern tests that the route pattern takes
+// precedence over the path header and the path.
+func TestBindingFromRequestRoutePattern(t *testing.T) {
+	req := httptest.NewRequest("POST", "/internal/orders/42", nil)
+	req.Header.Set("X-Forwarded-Path", "/api/orders/42")
+	req.Pattern = "POST example.com/api/orders/{id}"
+	if got := BindingFromRequest(req, BindingRoutePattern(), BindingPathHeader("X-Forwarded-Path")); got != "POST /api/orders/{id}" {
+		t.Errorf("BindingFromRequest = %q, want %q", got, "POST /api/orders/{id}")
+	}
+	if got := BindingFromRequest(req, BindingPathHeader("X-Forwarded-Path")); got != "POST /api/orders/42" {
+		t.Errorf("BindingFromRequest without BindingRoutePattern = %q, want %q", got, "POST /api/orders/42")
+	}
+	if got := BindingFromRequest(req); got != "POST /internal/orders/42" {
+		t.Errorf("BindingFromRequest without options = %q, want %q", got, "POST /internal/orders/42")
+	}
+}
@@ -0,0 +1,112 @@
+package ash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SelfTestBinding is the binding of the contexts issued by SelfTest.
+const SelfTestBinding = "POST /.ash/self-test"
+
+// ErrReplayNotRejected is returned by SelfTest when the store accepted a
+// second consumption of the same context.
+var ErrReplayNotRejected = errors.New("ash: replay not rejected")
+
+// SelfTestResult reports the outcome of SelfTest.
+type SelfTestResult struct {
+	// OK reports whether every step succeeded and the replay was rejected.
+	OK bool
+	// ContextID is the ID of the context used.
+	ContextID string
+	// ReplayRejected reports whether the second consumption failed with
+	// ErrReplayDetected.
+	ReplayRejected bool
+	// Create, Consume and Replay are the round-trip latencies of the store
+	// calls that issued the context, consumed it and attempted to consume
+	// it again.
+	Create  time.Duration
+	Consume time.Duration
+	Replay  time.Duration
+}
+
+// SelfTest checks that the store enforces single use: it issues a context
+// for SelfTestBinding, consumes it and immediately tries to consume it
+// again, which must fail with ErrReplayDetected. With a shared store such
+// as RedisStore this exercises the same path another instance would see.
+// It is suitable for running at startup or from a health endpoint.
+//
+// The returned error is nil only if the check passed; it wraps
+// ErrReplayNotRejected if the replay was accepted, and ctx.Err() if ctx
+// ended first (the store call in progress is abandoned, not interrupted).
+// Failures are logged, and counted with every run in the selfTests and
+// selfTestFailures expvar counters. Self-test contexts bypass hooks, the
+// audit sink and the other counters.
+func (a *Ash) SelfTest(ctx context.Context) (*SelfTestResult, error) {
+	result := &SelfTestResult{}
+	err := a.selfTest(ctx, result)
+	result.OK = err == nil
+	if a.counters != nil {
+		a.counters.selfTests.Add(1)
+		if err != nil {
+			a.counters.selfTestFailures.Add(1)
+		}
+	}
+	if err != nil {
+		a.logger.Error("ash: self-test failed", "contextId", result.ContextID, "error", err)
+	}
+	return result, err
+}
+
+// selfTest implements SelfTest, filling in result as it goes.
+func (a *Ash) selfTest(ctx context.Context, result *SelfTestResult) error {
+	id, err := a.idGenerator.ContextID()
+	if err != nil {
+		return fmt.Errorf("ash: self-test: generate ID: %w", err)
+	}
+	result.ContextID = id
+
+	if result.Create, err = timeStoreCall(ctx, func() error {
+		_, err := a.store.Create(ContextOptions{ID: id, Binding: SelfTestBinding, TTL: a.ttl, Mode: a.mode})
+		return err
+	}); err != nil {
+		return fmt.Errorf("ash: self-test: create: %w", err)
+	}
+	if result.Consume, err = timeStoreCall(ctx, func() error {
+		return a.store.Consume(id)
+	}); err != nil {
+		return fmt.Errorf("ash: self-test: consume: %w", err)
+	}
+
+	result.Replay, err = timeStoreCall(ctx, func() error {
+		return a.store.Consume(id)
+	})
+	var ashErr *AshError
+	switch {
+	case err == nil:
+		return ErrReplayNotRejected
+	case errors.As(err, &ashErr) && ashErr.Code == ErrReplayDetected:
+		result.ReplayRejected = true
+		return nil
+	default:
+		return fmt.Errorf("ash: self-test: replay: %w", err)
+	}
+}
+
+// timeStoreCall runs call, returning its latency and error, or ctx.Err()
+// if ctx ends first.
+func timeStoreCall(ctx context.Context, call func() error) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- call() }()
+	select {
+	case err := <-done:
+		return time.Since(start), err
+	case <-ctx.Done():
+		return time.Since(start), ctx.Err()
+	}
+}
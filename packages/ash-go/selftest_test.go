@@ -0,0 +1,114 @@
+package ash
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"testing"
+	"time"
+)
+
+// replayingStore is a broken store whose Consume never detects a replay.
+type replayingStore struct {
+	ContextStore
+}
+
+func (replayingStore) Consume(id string) error { return nil }
+
+// blockingStore is a store whose Create blocks until release is closed.
+type blockingStore struct {
+	ContextStore
+	release chan struct{}
+}
+
+func (s blockingStore) Create(opts ContextOptions) (*Context, error) {
+	<-s.release
+	return s.ContextStore.Create(opts)
+}
+
+// TestSelfTest tests the self-test against working stores.
+func TestSelfTest(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	stores := map[string]ContextStore{
+		"memory": NewMemoryStore(MemoryStoreOptions{Now: fixedClock(now)}),
+		"redis":  NewRedisStore(RedisStoreOptions{Client: newFakeRedis(), Now: fixedClock(now)}),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			a, err := New(store, WithClock(fixedClock(now)))
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			result, err := a.SelfTest(context.Background())
+			if err != nil || !result.OK || !result.ReplayRejected || result.ContextID == "" {
+				t.Errorf("SelfTest = %+v, %v", result, err)
+			}
+			if got, _ := store.Get(result.ContextID); got == nil || got.Binding != SelfTestBinding || !got.Used {
+				t.Errorf("Expected a consumed self-test context, got %+v", got)
+			}
+		})
+	}
+}
+
+// TestSelfTestFailures tests that a broken or stalled store fails the
+// self-test and is counted.
+func TestSelfTestFailures(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	memory := NewMemoryStore(MemoryStoreOptions{Now: fixedClock(now)})
+	a, _ := newTestAsh(t, now, WithExpvar("ash_test_selftest"))
+	a.store = replayingStore{memory}
+
+	result, err := a.SelfTest(context.Background())
+	if !errors.Is(err, ErrReplayNotRejected) || result.OK || result.ReplayRejected {
+		t.Errorf("Expected ErrReplayNotRejected, got %+v, %v", result, err)
+	}
+
+	block := make(chan struct{})
+	defer close(block)
+	a.store = blockingStore{memory, block}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := a.SelfTest(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a deadline error from a stalled store, got %v", err)
+	}
+
+	vars := expvar.Get("ash_test_selftest").(*expvar.Map)
+	if got := vars.Get("selfTests").String(); got != "2" {
+		t.Errorf("selfTests = %s, want 2", got)
+	}
+	if got := vars.Get("selfTestFailures").String(); got != "2" {
+		t.Errorf("selfTestFailures = %s, want 2", got)
+	}
+}
+
+// TestRedisStoreCrossNodeReplay tests that a context consumed through one
+// instance is rejected as a replay by another sharing the same Redis.
+func TestRedisStoreCrossNodeReplay(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	redis := newFakeRedis()
+	node := func() *Ash {
+		store := NewRedisStore(RedisStoreOptions{Client: redis, Now: fixedClock(now)})
+		a, err := New(store, WithClock(fixedClock(now)))
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		return a
+	}
+	first, second := node(), node()
+
+	body := `{"amount":100}`
+	ctx, err := first.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	proof := clientProof(t, ctx, body, "application/json")
+	if _, err := second.Verify(ctx.ID, proof, ctx.Binding, []byte(body), "application/json"); err != nil {
+		t.Fatalf("Verify on the second node failed: %v", err)
+	}
+	for name, a := range map[string]*Ash{"first": first, "second": second} {
+		var ashErr *AshError
+		if _, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte(body), "application/json"); !errors.As(err, &ashErr) || ashErr.Code != ErrReplayDetected {
+			t.Errorf("Replay on the %s node: expected %s, got %v", name, ErrReplayDetected, err)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package ash
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Ash holds the server-side configuration shared by context issuance and
+// request verification.
+type Ash struct {
+	store  ContextStore
+	ttl    time.Duration
+	mode   AshMode
+	logger *slog.Logger
+	now    func() time.Time
+
+	clockSkew time.Duration
+	clock     clockWatch
+
+	keyRing        *KeyRing
+	proofEncoding  ProofEncoding
+	idGenerator    IDGenerator
+	nonceProvider  NonceProvider
+	nonceValidator NonceValidator
+	nonceWindow    time.Duration
+
+	policies              map[string]BindingPolicy
+	maxBodyBytes          int64
+	debugResponses        bool
+	errorDocs             string
+	redactor              *Redactor
+	canonicalCache        *canonicalCache
+	canonicalCacheMaxBody int
+	maxParams             int
+	maxParamsSet          bool
+	duplicates            *duplicateCache
+	consumedIDs           *consumedCache
+	verifyLimiter         *verifyLimiter
+
+	hooks      Hooks
+	expvarName string
+	counters   *expvarCounters
+
+	auditSink     AuditSink
+	auditRequired bool
+	auditPayload  bool
+
+	asyncOptions *AsyncOptions
+	dispatcher   *dispatcher
+
+	tenantFunc    func(r *http.Request) string
+	sessionSalt   func(r *http.Request) []byte
+	unicodeForm   UnicodeForm
+	includeLength bool
+
+	consumptionSecret     []byte
+	contextTokenSecret    []byte
+	canonicalHintSecret   []byte
+	bodylessMethods       map[string]bool
+	jsonStrictness        JSONStrictness
+	trimURLEncodedNewline bool
+	strictConfig          bool
+
+	canonicalizers       canonicalizerRegistry
+	customCanonicalizers []Canonicalizer
+
+	// mu guards protections, the paths verified by each HTTPMiddleware
+	// created from the instance, for Validate.
+	mu          sync.Mutex
+	protections []*protection
+}
+
+// Option configures an Ash instance.
+type Option func(*Ash)
+
+// WithTTL sets the lifetime of issued contexts (default: DefaultTTL).
+func WithTTL(ttl time.Duration) Option {
+	return func(a *Ash) { a.ttl = ttl }
+}
+
+// WithMode sets the default security mode of issued contexts.
+func WithMode(mode AshMode) Option {
+	return func(a *Ash) { a.mode = mode }
+}
+
+// WithLogger sets the logger (default: slog.Default()).
+func WithLogger(logger *slog.Logger) Option {
+	return func(a *Ash) { a.logger = logger }
+}
+
+// WithClock sets the function used to read the current time.
+func WithClock(now func() time.Time) Option {
+	return func(a *Ash) { a.now = now }
+}
+
+// WithKeyRing makes verification expect HMAC-keyed proofs built with
+// BuildKeyedProof instead of plain BuildProof proofs.
+func WithKeyRing(ring *KeyRing) Option {
+	return func(a *Ash) { a.keyRing = ring }
+}
+
+// WithProofEncoding sets the encoding expected of incoming proofs
+// (default: ProofBase64URL). Clients must build proofs with the same
+// BuildProofInput.Encoding.
+func WithProofEncoding(enc ProofEncoding) Option {
+	return func(a *Ash) { a.proofEncoding = enc }
+}
+
+// WithIncludeLength makes issued contexts require proofs that bind the
+// byte length of the canonical payload (see BuildProofInput.IncludeLength).
+// Clients learn it from ContextPublicInfo.IncludeLength. A proof whose
+// length line is missing or wrong fails with ErrIntegrityFailed, with a
+// "length mismatch" message when the client declared its length in
+// HeaderLength.
+func WithIncludeLength(on bool) Option {
+	return func(a *Ash) { a.includeLength = on }
+}
+
+// WithTenantFunc sets how the tenant of an HTTP request is determined, for
+// example from the host name or the authenticated user. ContextHandler and
+// ContextStreamHandler issue contexts to the request's tenant, and
+// HTTPMiddleware and VerifyRequest verify with WithTenant.
+func WithTenantFunc(f func(r *http.Request) string) Option {
+	return func(a *Ash) { a.tenantFunc = f }
+}
+
+// tenantFor returns the tenant of r, or "" without WithTenantFunc.
+func (a *Ash) tenantFor(r *http.Request) string {
+	if a.tenantFunc == nil {
+		return ""
+	}
+	return a.tenantFunc(r)
+}
+
+// WithIDGenerator sets how context IDs are generated
+// (default: DefaultIDGenerator).
+func WithIDGenerator(g IDGenerator) Option {
+	return func(a *Ash) { a.idGenerator = g }
+}
+
+// WithNonceProvider delegates nonce generation for new contexts
+// (default: DefaultNonceProvider).
+func WithNonceProvider(p NonceProvider) Option {
+	return func(a *Ash) { a.nonceProvider = p }
+}
+
+// WithNonceValidator adds an external nonce check to verification.
+func WithNonceValidator(v NonceValidator) Option {
+	return func(a *Ash) { a.nonceValidator = v }
+}
+
+// WithDebugResponses makes HTTP error responses for canonicalization
+// failures carry the specific reason and the JSON Pointer of the offending
+// value, and logs the canonical payload of requests whose proof does not
+// match at debug level, redacted by WithRedaction. It must stay off in
+// production: the details describe the payload.
+func WithDebugResponses(on bool) Option {
+	return func(a *Ash) { a.debugResponses = on }
+}
+
+// New creates an Ash instance backed by the given store.
+func New(store ContextStore, opts ...Option) (*Ash, error) {
+	if store == nil {
+		return nil, ErrNilInput
+	}
+	a := &Ash{
+		store:        store,
+		ttl:          DefaultTTL,
+		mode:         ModeBalanced,
+		maxBodyBytes: DefaultMaxBodyBytes,
+		clockSkew:    DefaultClockSkew,
+
+		canonicalCacheMaxBody: DefaultCanonicalCacheMaxBody,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.logger == nil {
+		a.logger = slog.Default()
+	}
+	if a.now == nil {
+		a.now = time.Now
+	}
+	if a.idGenerator == nil {
+		a.idGenerator = DefaultIDGenerator()
+	}
+	if a.nonceProvider == nil {
+		a.nonceProvider = DefaultNonceProvider()
+	}
+	if a.bodylessMethods == nil {
+		WithBodylessMethods(DefaultBodylessMethods...)(a)
+	}
+	if err := ValidateTTL(a.ttl); err != nil {
+		return nil, err
+	}
+	if !IsValidMode(a.mode) {
+		return nil, NewAshError(ErrModeViolation, "invalid mode")
+	}
+	if !a.proofEncoding.valid() {
+		return nil, ErrInvalidProofEncoding
+	}
+	if err := a.unicodeForm.validate(); err != nil {
+		return nil, err
+	}
+	if a.consumptionSecret != nil && len(a.consumptionSecret) == 0 {
+		return nil, ErrInvalidKey
+	}
+	if a.contextTokenSecret != nil && len(a.contextTokenSecret) == 0 {
+		return nil, ErrInvalidKey
+	}
+	if a.canonicalHintSecret != nil {
+		if len(a.canonicalHintSecret) == 0 {
+			return nil, ErrInvalidKey
+		}
+		a.logger.Warn("ash: trusting canonical payload hints; only a trusted gateway may hold the hint secret")
+	}
+	if a.nonceWindow > 0 && a.nonceWindow < time.Millisecond {
+		// Stores keep the window in milliseconds.
+		return nil, errors.New("ash: binding nonce window under 1ms")
+	}
+	if a.asyncOptions != nil && a.asyncOptions.Overflow != DropNewest && a.asyncOptions.Overflow != DropOldest {
+		return nil, errors.New("ash: invalid overflow policy")
+	}
+	a.canonicalizers = defaultCanonicalizers
+	if len(a.customCanonicalizers) > 0 {
+		registry, err := defaultCanonicalizers.withCustom(a.customCanonicalizers)
+		if err != nil {
+			return nil, err
+		}
+		a.canonicalizers = registry
+	}
+	if a.strictConfig {
+		if err := a.validateStrict(); err != nil {
+			return nil, err
+		}
+	}
+	if a.expvarName != "" {
+		if err := a.publishExpvar(); err != nil {
+			return nil, err
+		}
+	}
+	if a.asyncOptions != nil {
+		a.dispatcher = newDispatcher(*a.asyncOptions, a.logger)
+	}
+	return a, nil
+}
+
+// Store returns the context store.
+func (a *Ash) Store() ContextStore {
+	return a.store
+}
+
+// IssueContext creates a new context, applying the instance defaults for
+// TTL and mode and the configured ID generator and nonce provider when they
+// are not set in opts.
+func (a *Ash) IssueContext(opts ContextOptions) (*Context, error) {
+	if opts.TTL == 0 {
+		opts.TTL = a.ttl
+	}
+	if opts.Mode == "" {
+		opts.Mode = a.mode
+	}
+	if opts.UnicodeForm == "" {
+		opts.UnicodeForm = a.unicodeForm
+	}
+	if len(opts.ProofMetadata) == 0 {
+		opts.ProofMetadata = a.policyFor(opts.Binding).ProofMetadata
+	}
+	if !opts.RawBody {
+		opts.RawBody = a.policyFor(opts.Binding).RawBody
+	}
+	if len(opts.DecimalStrings) == 0 {
+		opts.DecimalStrings = a.policyFor(opts.Binding).DecimalStrings
+	}
+	if a.includeLength {
+		opts.IncludeLength = true
+	}
+	if opts.ID == "" {
+		id, err := a.idGenerator.ContextID()
+		if err != nil {
+			return nil, err
+		}
+		opts.ID = id
+	}
+	if opts.Nonce == "" {
+		nonce, err := a.contextNonce(opts)
+		if err != nil {
+			return nil, err
+		}
+		opts.Nonce = nonce
+	}
+	ctx, err := a.store.Create(opts)
+	if err != nil {
+		return nil, err
+	}
+	a.recordIssue(ctx)
+	return ctx, nil
+}
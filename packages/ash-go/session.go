@@ -0,0 +1,52 @@
+package ash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net/http"
+)
+
+// WithSessionSaltFunc sets how the session salt of an HTTP request is
+// determined, for authenticated APIs that bind contexts to the session
+// they were issued to. f derives the salt from the authenticated session
+// on the server, for example as an HMAC of the session ID under a server
+// secret, and returns nil for a request without a session.
+//
+// ContextHandler and ContextStreamHandler issue contexts with
+// ContextOptions.SessionSalt, and HTTPMiddleware and VerifyRequest verify
+// with WithSessionSalt. A context issued to one session then fails
+// verification in any other with ErrIntegrityFailed, even when its proof
+// is replayed whole. Contexts issued without a session verify in any.
+func WithSessionSaltFunc(f func(r *http.Request) []byte) Option {
+	return func(a *Ash) { a.sessionSalt = f }
+}
+
+// sessionSaltFor returns the session salt of r, or nil without
+// WithSessionSaltFunc.
+func (a *Ash) sessionSaltFor(r *http.Request) []byte {
+	if a.sessionSalt == nil {
+		return nil
+	}
+	return a.sessionSalt(r)
+}
+
+// WithSessionSalt supplies the salt of the session the request is made in.
+// A context issued with ContextOptions.SessionSalt fails verification with
+// ErrIntegrityFailed unless salt is the same. It is ignored for contexts
+// issued without one.
+func WithSessionSalt(salt []byte) VerifyOption {
+	return func(o *verifyOptions) { o.sessionSalt = salt }
+}
+
+// sessionKey derives the session key of the context id from salt, or
+// returns "" if salt is empty. The key is sent to the client and covered
+// by proofs; being an HMAC, it does not reveal the salt, and is specific
+// to one context.
+func sessionKey(salt []byte, id string) string {
+	if len(salt) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte("ASH-session\n" + id))
+	return Base64URLEncode(mac.Sum(nil))
+}
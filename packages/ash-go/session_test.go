@@ -0,0 +1,141 @@
+package ash
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSessionSalt tests that a context issued to a session only verifies
+// with the salt of that session.
+func TestSessionSalt(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, store := newTestAsh(t, now)
+	saltA, saltB := []byte("session-a"), []byte("session-b")
+	body := `{"amount":100}`
+	sign := func(ctx *Context) string {
+		t.Helper()
+		canonical, err := CanonicalizePayload([]byte(body), "application/json")
+		if err != nil {
+			t.Fatalf("CanonicalizePayload failed: %v", err)
+		}
+		info := a.PublicInfo(ctx)
+		return BuildProof(BuildProofInput{
+			Mode:             info.Mode,
+			Binding:          "POST /api/transfer",
+			ContextID:        info.ContextID,
+			Nonce:            info.Nonce,
+			SessionKey:       info.SessionKey,
+			CanonicalPayload: canonical,
+		})
+	}
+	issue := func(salt []byte) *Context {
+		t.Helper()
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/transfer", SessionSalt: salt})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		return ctx
+	}
+	verify := func(ctx *Context, proof string, opts ...VerifyOption) error {
+		_, err := a.Verify(ctx.ID, proof, "POST /api/transfer", []byte(body), "application/json", opts...)
+		return err
+	}
+
+	ctx := issue(saltA)
+	if ctx.SessionKey == "" || ctx.SessionKey != a.PublicInfo(ctx).SessionKey {
+		t.Fatalf("Session key %q not in the public info", ctx.SessionKey)
+	}
+	if other := issue(saltA); other.SessionKey == ctx.SessionKey {
+		t.Errorf("Contexts of a session share the session key %q", ctx.SessionKey)
+	}
+	proof := sign(ctx)
+	for name, opts := range map[string][]VerifyOption{
+		"other session": {WithSessionSalt(saltB)},
+		"no session":    nil,
+		"empty salt":    {WithSessionSalt([]byte{})},
+	} {
+		if err := verify(ctx, proof, opts...); !errors.Is(err, ErrIntegrityFailed) {
+			t.Errorf("%s: expected %s, got %v", name, ErrIntegrityFailed, err)
+		}
+	}
+	if stored, _ := store.Get(ctx.ID); stored.Used {
+		t.Fatalf("Context consumed by a failed verification")
+	}
+	if err := verify(ctx, proof, WithSessionSalt(saltA)); err != nil {
+		t.Errorf("Verify in the issuing session failed: %v", err)
+	}
+
+	// A proof built without the session key fails even in the session.
+	ctx = issue(saltA)
+	unbound := BuildProof(BuildProofInput{
+		Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, Nonce: ctx.Nonce, CanonicalPayload: body,
+	})
+	if err := verify(ctx, unbound, WithSessionSalt(saltA)); !errors.Is(err, ErrIntegrityFailed) {
+		t.Errorf("Expected %s for a proof without the session key, got %v", ErrIntegrityFailed, err)
+	}
+
+	// Contexts issued without a session verify in any.
+	ctx = issue(nil)
+	if ctx.SessionKey != "" {
+		t.Errorf("Session key %q without a salt", ctx.SessionKey)
+	}
+	if err := verify(ctx, sign(ctx), WithSessionSalt(saltB)); err != nil {
+		t.Errorf("Verify of a context without a session failed: %v", err)
+	}
+}
+
+// TestSessionSaltFunc tests that ContextHandler and HTTPMiddleware bind
+// contexts to the session of the request, and that the salt never reaches
+// the client.
+func TestSessionSaltFunc(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, _ := newTestAsh(t, now, WithSessionSaltFunc(func(r *http.Request) []byte {
+		if c, err := r.Cookie("session"); err == nil {
+			return []byte("salt-of-" + c.Value)
+		}
+		return nil
+	}))
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	body := `{"amount":100}`
+
+	issue := func(session string) (ContextPublicInfo, string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/context?binding=POST+/api/transfer", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		rec := httptest.NewRecorder()
+		NewContextHandler(a).ServeHTTP(rec, req)
+		var info ContextPublicInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil || info.SessionKey == "" {
+			t.Fatalf("Expected a session key, got %s (%v)", rec.Body, err)
+		}
+		return info, rec.Body.String()
+	}
+	send := func(info ContextPublicInfo, session string) *httptest.ResponseRecorder {
+		t.Helper()
+		req, _ := http.NewRequest("POST", "http://example.com/api/transfer", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		if err := SignRequest(req, info, nil); err != nil {
+			t.Fatalf("SignRequest failed: %v", err)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	info, response := issue("alice")
+	if strings.Contains(response, "salt-of-alice") {
+		t.Errorf("Context response carries the session salt: %s", response)
+	}
+	if rec := send(info, "bob"); rec.Code != http.StatusForbidden || decodeError(t, rec).Code != ErrIntegrityFailed {
+		t.Errorf("Expected 403 %s in another session, got %d: %s", ErrIntegrityFailed, rec.Code, rec.Body)
+	}
+	if rec := send(info, "alice"); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 in the issuing session, got %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,142 @@
+package ash
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ErrBodyUnavailable is returned by SignRequest when no payload is given
+// and the request body cannot be read without consuming it.
+var ErrBodyUnavailable = errors.New("ash: request body unavailable; pass the payload")
+
+// SignOption configures SignRequest.
+type SignOption func(*BuildProofInput)
+
+// SignTenant binds the proof to the tenant the context was issued to.
+func SignTenant(tenant string) SignOption {
+	return func(in *BuildProofInput) { in.Tenant = tenant }
+}
+
+// SignBinding sets the binding the proof covers, for servers that build it
+// other than BindingFromRequest(req) does by default, such as with
+// MiddlewareOptions.RoutePattern or EncodedSlashesOpaque.
+func SignBinding(binding string) SignOption {
+	return func(in *BuildProofInput) { in.Binding = binding }
+}
+
+// SignExtensions binds extension values into the proof.
+func SignExtensions(exts ...KV) SignOption {
+	return func(in *BuildProofInput) { in.Extensions = append(in.Extensions, exts...) }
+}
+
+// SignRequest signs an existing request in place with the context
+// described by info. It canonicalizes payload according to the request's
+// Content-Type, builds the proof over BindingFromRequest(req) (see
+// SignBinding), and sets the HeaderContextID, HeaderProof,
+// HeaderBinding and HeaderMode headers, HeaderLength if
+// info.IncludeLength is set, and HeaderExtensions if extensions are
+// given with SignExtensions. If info.Token is set, it is sent in the
+// HeaderContextToken header in place of HeaderContextID.
+//
+// payload must be the body the request will send. SignRequest never reads
+// req.Body, so the request can still be sent. If payload is nil, the body
+// is read through req.GetBody, or taken as empty if req.Body is nil or
+// http.NoBody; otherwise ErrBodyUnavailable is returned. An empty payload
+// for a request with a body of known length, or a non-empty one for a
+// request built with an empty body, fails with ErrPayloadMismatch.
+// Sending another body than the signed payload is the caller's mistake,
+// and the server rejects it with ErrIntegrityFailed. A JSON payload with trailing data
+// after its value is rejected, as servers reject it by default. If
+// info.RawBody is set, the proof covers payload as is. If
+// info.DecimalStrings is set, the proof carries DecimalStringsExtension.
+func SignRequest(req *http.Request, info ContextPublicInfo, payload []byte, opts ...SignOption) error {
+	if req == nil {
+		return ErrNilInput
+	}
+	var err error
+	if payload == nil {
+		if payload, err = requestPayload(req); err != nil {
+			return err
+		}
+	} else if err := checkPayload(req, payload); err != nil {
+		return err
+	}
+	canonical := string(payload)
+	if !info.RawBody {
+		canonical, err = CanonicalizePayload(payload, req.Header.Get("Content-Type"),
+			WithUnicodeForm(info.UnicodeForm), WithRawStrings(info.RawStrings...),
+			WithOptionalFields(info.OptionalFields...), WithDecimalStrings(info.DecimalStrings...),
+			WithRejectTrailingData())
+		if err != nil {
+			return err
+		}
+	}
+
+	var metadata string
+	if len(info.ProofMetadata) > 0 {
+		if metadata, err = ParseJSON(string(info.ProofMetadata)); err != nil {
+			return err
+		}
+	}
+
+	input := BuildProofInput{
+		Mode:             info.Mode,
+		Binding:          BindingFromRequest(req),
+		ContextID:        info.ContextID,
+		Nonce:            info.Nonce,
+		SessionKey:       info.SessionKey,
+		Metadata:         metadata,
+		CanonicalPayload: canonical,
+		IncludeLength:    info.IncludeLength,
+	}
+	if len(info.DecimalStrings) > 0 {
+		input.Extensions = []KV{DecimalStringsExtension(info.DecimalStrings)}
+	}
+	for _, opt := range opts {
+		opt(&input)
+	}
+	proof, err := BuildProofChecked(input)
+	if err != nil {
+		return err
+	}
+	if info.Token != "" {
+		req.Header.Set(HeaderContextToken, info.Token)
+	} else {
+		req.Header.Set(HeaderContextID, info.ContextID)
+	}
+	req.Header.Set(HeaderProof, proof)
+	req.Header.Set(HeaderBinding, input.Binding)
+	req.Header.Set(HeaderMode, string(input.Mode))
+	if input.IncludeLength {
+		req.Header.Set(HeaderLength, strconv.Itoa(len(canonical)))
+	}
+	if exts := formatExtensionsHeader(input.Extensions); exts != "" {
+		req.Header.Set(HeaderExtensions, exts)
+	} else {
+		req.Header.Del(HeaderExtensions)
+	}
+	return nil
+}
+
+// requestPayload reads the body of req without consuming req.Body.
+func requestPayload(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody == nil {
+		return nil, ErrBodyUnavailable
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("ash: sign request: %w", err)
+	}
+	defer body.Close()
+	payload, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("ash: sign request: %w", err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,123 @@
+package ash
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSignRequest tests signing requests in place against the middleware.
+func TestSignRequest(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	var seen []byte
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = io.ReadAll(r.Body)
+	}))
+
+	tests := []struct {
+		name, method, contentType, body string
+		payload                         []byte
+	}{
+		{name: "json", method: "POST", contentType: "application/json", body: `{"b":2,"a":1}`},
+		{name: "form", method: "POST", contentType: "application/x-www-form-urlencoded", body: "b=2&a=1"},
+		{name: "bodyless", method: "GET"},
+		{name: "explicit payload", method: "PUT", contentType: "application/json", body: `{"a":1}`, payload: []byte(`{"a":1}`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []AshMode{ModeBalanced, ModeStrict} {
+				ctx, err := a.IssueContext(ContextOptions{Binding: NormalizeBinding(tt.method, "/api/items"), Mode: mode})
+				if err != nil {
+					t.Fatalf("IssueContext failed: %v", err)
+				}
+				var body io.Reader
+				if tt.body != "" {
+					body = strings.NewReader(tt.body)
+				}
+				req, _ := http.NewRequest(tt.method, "http://example.com/api/items", body)
+				if tt.contentType != "" {
+					req.Header.Set("Content-Type", tt.contentType)
+				}
+				if tt.payload != nil {
+					req.GetBody = nil
+				}
+
+				if err := SignRequest(req, ctx.PublicInfo(), tt.payload); err != nil {
+					t.Fatalf("SignRequest failed: %v", err)
+				}
+				if req.Header.Get(HeaderContextID) != ctx.ID || req.Header.Get(HeaderBinding) != ctx.Binding {
+					t.Errorf("Unexpected headers: %v", req.Header)
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("mode %s: expected 200, got %d: %s", mode, rec.Code, rec.Body)
+				}
+				if string(seen) != tt.body {
+					t.Errorf("Handler saw %q, want %q (body consumed by SignRequest?)", seen, tt.body)
+				}
+			}
+		})
+	}
+}
+
+// TestSignRequestPayloadMismatch documents that the caller must pass the
+// body actually sent: the server rejects any other.
+func TestSignRequestPayloadMismatch(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/items"})
+
+	req := httptest.NewRequest("POST", "/api/items", strings.NewReader(`{"amount":1000}`))
+	req.Header.Set("Content-Type", "application/json")
+	if err := SignRequest(req, ctx.PublicInfo(), []byte(`{"amount":1}`)); err != nil {
+		t.Fatalf("SignRequest failed: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || decodeError(t, rec).Code != ErrIntegrityFailed {
+		t.Errorf("Expected 403 %s, got %d: %s", ErrIntegrityFailed, rec.Code, rec.Body)
+	}
+}
+
+// onceReader is a body that can be read only once.
+type onceReader struct {
+	io.Reader
+}
+
+func (onceReader) Close() error { return nil }
+
+// TestSignRequestErrors tests the failures of SignRequest.
+func TestSignRequestErrors(t *testing.T) {
+	info := ContextPublicInfo{ContextID: "ash_x", Mode: ModeBalanced}
+
+	req, _ := http.NewRequest("POST", "http://example.com/api", nil)
+	req.Body = onceReader{strings.NewReader(`{"a":1}`)}
+	req.Header.Set("Content-Type", "application/json")
+	if err := SignRequest(req, info, nil); !errors.Is(err, ErrBodyUnavailable) {
+		t.Errorf("Expected ErrBodyUnavailable, got %v", err)
+	}
+	if got, _ := io.ReadAll(req.Body); string(got) != `{"a":1}` {
+		t.Errorf("Body consumed: %q left", got)
+	}
+
+	req, _ = http.NewRequest("POST", "http://example.com/api", bytes.NewReader([]byte("<a/>")))
+	req.Header.Set("Content-Type", "application/xml")
+	if err := SignRequest(req, info, nil); !errors.Is(err, ErrUnsupportedContentType) {
+		t.Errorf("Expected %s, got %v", ErrUnsupportedContentType, err)
+	}
+
+	req, _ = http.NewRequest("POST", "http://example.com/api", nil)
+	strict := ContextPublicInfo{ContextID: "ash_x", Mode: ModeStrict}
+	if err := SignRequest(req, strict, []byte{}); !errors.Is(err, ErrModeViolation) {
+		t.Errorf("Expected %s for a strict context without nonce, got %v", ErrModeViolation, err)
+	}
+	if err := SignRequest(nil, info, nil); !errors.Is(err, ErrNilInput) {
+		t.Errorf("Expected ErrNilInput, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package ash
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// Stats reports how close a store is to its limits.
+type Stats struct {
+	// ActiveContexts is the number of stored contexts, consumed or not,
+	// for stores that can count them cheaply, such as MemoryStore.
+	ActiveContexts *int `json:"activeContexts,omitempty"`
+	// MaxContexts is the cap on stored contexts, or 0 for none.
+	MaxContexts int `json:"maxContexts"`
+	// PerBinding reports the outstanding contexts of each binding the
+	// store counts.
+	PerBinding map[string]BindingStats `json:"perBinding,omitempty"`
+	// Evictions is the number of contexts removed to stay under
+	// MaxContexts since the store was created.
+	Evictions int64 `json:"evictions"`
+	// RateLimited is the number of Create calls rejected with
+	// ErrRateLimited since the store was created.
+	RateLimited int64 `json:"rateLimited"`
+	// Released is the number of contexts deleted by ReleaseContext since
+	// the store was created.
+	Released int64 `json:"released"`
+	// Expired is the number of unconsumed contexts removed after expiring
+	// since the store was created.
+	Expired int64 `json:"expired"`
+}
+
+// BindingStats reports the outstanding contexts of a binding.
+type BindingStats struct {
+	// Count is the number of outstanding contexts.
+	Count int `json:"count"`
+	// Limit is the BindingLimits limit, or 0 if the binding is unlimited.
+	Limit int `json:"limit"`
+}
+
+// StatsStore is a ContextStore that reports Stats.
+type StatsStore interface {
+	ContextStore
+	Stats(ctx context.Context) (Stats, error)
+}
+
+// NewStatsHandler returns a handler writing the Stats of a's store as JSON.
+// It answers 501 if the store is not a StatsStore, and 503 if Stats fails;
+// the cause is only logged.
+func NewStatsHandler(a *Ash) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store, ok := storeAs[StatsStore](a.store)
+		if !ok {
+			http.Error(w, "store does not report stats", http.StatusNotImplemented)
+			return
+		}
+		stats, err := store.Stats(r.Context())
+		if err != nil {
+			a.logger.Error("ash: stats failed", "error", err)
+			http.Error(w, "stats unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(stats)
+	})
+}
@@ -0,0 +1,217 @@
+package ash
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestMemoryStoreStats tests the limits, evictions and rejections reported
+// by a MemoryStore.
+func TestMemoryStoreStats(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	store := NewMemoryStore(MemoryStoreOptions{
+		Now:           func() time.Time { return now },
+		MaxContexts:   2,
+		BindingLimits: BindingLimits{"POST /api/login": 1},
+	})
+	create := func(binding string, ttl time.Duration) (*Context, error) {
+		return store.Create(ContextOptions{Binding: binding, TTL: ttl})
+	}
+
+	if _, err := create("POST /api/login", time.Minute); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	// The binding limit is reached.
+	if _, err := create("POST /api/login", time.Minute); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Create over binding limit = %v, want %s", err, ErrRateLimited)
+	}
+	other, err := create("POST /api/other", 10*time.Second)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	// The store is full of live contexts, so nothing is evicted.
+	if _, err := create("POST /api/other", time.Minute); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Create over MaxContexts = %v, want %s", err, ErrRateLimited)
+	}
+
+	// A consumed context is evicted to make room.
+	if err := store.Consume(other.ID); err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+	if _, err := create("POST /api/other", 10*time.Second); err != nil {
+		t.Fatalf("Create after consumption failed: %v", err)
+	}
+
+	// So is an expired one, once the earliest expiry has passed.
+	now = now.Add(10 * time.Second)
+	if _, err := create("POST /api/other", time.Minute); err != nil {
+		t.Fatalf("Create after expiry failed: %v", err)
+	}
+
+	stats, err := store.Stats(context.Background())
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	active := 2
+	want := Stats{
+		ActiveContexts: &active,
+		MaxContexts:    2,
+		PerBinding: map[string]BindingStats{
+			"POST /api/login": {Count: 1, Limit: 1},
+			"POST /api/other": {Count: 1, Limit: 0},
+		},
+		Evictions:   2,
+		RateLimited: 2,
+		Expired:     1,
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("Stats = %+v, want %+v", stats, want)
+	}
+}
+
+// TestMemoryStoreEvictionRetention tests that contexts kept for
+// ConsumedRetention are evicted only when nothing else can be.
+func TestMemoryStoreEvictionRetention(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	store := NewMemoryStore(MemoryStoreOptions{
+		Now:               func() time.Time { return now },
+		MaxContexts:       3,
+		ConsumedRetention: time.Minute,
+	})
+	create := func(ttl time.Duration) (*Context, error) {
+		return store.Create(ContextOptions{Binding: "POST /api/test", TTL: ttl})
+	}
+	retained, _ := create(10 * time.Second)
+	expired, _ := create(10 * time.Second)
+	if _, err := create(time.Minute); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := store.Consume(retained.ID); err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+	now = now.Add(10 * time.Second)
+
+	// The expired context makes room, and the retained one is kept.
+	if _, err := create(time.Minute); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := store.Get(expired.ID); err == nil {
+		t.Error("Expired context was not evicted")
+	}
+	if ctx, err := store.Get(retained.ID); err != nil || !ctx.Used {
+		t.Errorf("Retained context was evicted: %v", err)
+	}
+
+	// With only live and retained contexts left, the retained one goes.
+	if _, err := create(time.Minute); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := store.Get(retained.ID); !errors.Is(err, ErrInvalidContext) {
+		t.Errorf("Get of the evicted retained context = %v, want %s", err, ErrInvalidContext)
+	}
+
+	// Live contexts are never evicted.
+	if _, err := create(time.Minute); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Create over MaxContexts = %v, want %s", err, ErrRateLimited)
+	}
+	stats, _ := store.Stats(context.Background())
+	if stats.Evictions != 2 || stats.Expired != 1 {
+		t.Errorf("Evictions = %d, Expired = %d; want 2 and 1", stats.Evictions, stats.Expired)
+	}
+}
+
+// TestRedisStoreStats tests the limits and rejections reported by a
+// RedisStore.
+func TestRedisStoreStats(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	store := NewRedisStore(RedisStoreOptions{
+		Client:        newFakeRedis(),
+		Now:           func() time.Time { return now },
+		BindingLimits: BindingLimits{"POST /api/login": 2},
+	})
+	for i := 0; i < 3; i++ {
+		_, err := store.Create(ContextOptions{Binding: "POST /api/login", TTL: time.Minute})
+		if i < 2 && err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if i == 2 && !errors.Is(err, ErrRateLimited) {
+			t.Fatalf("Create over binding limit = %v, want %s", err, ErrRateLimited)
+		}
+	}
+	if _, err := store.Create(ContextOptions{Binding: "POST /api/other", TTL: time.Minute}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	stats, err := store.Stats(context.Background())
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	want := Stats{
+		PerBinding:  map[string]BindingStats{"POST /api/login": {Count: 2, Limit: 2}},
+		RateLimited: 1,
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("Stats = %+v, want %+v", stats, want)
+	}
+
+	// Expired IDs are not counted.
+	now = now.Add(time.Minute)
+	if stats, _ = store.Stats(context.Background()); stats.PerBinding["POST /api/login"].Count != 0 {
+		t.Errorf("Count after expiry = %d, want 0", stats.PerBinding["POST /api/login"].Count)
+	}
+}
+
+// TestStatsHandler tests the rendering of store stats.
+func TestStatsHandler(t *testing.T) {
+	store := NewMemoryStore(MemoryStoreOptions{MaxContexts: 10, BindingLimits: BindingLimits{"POST /api/**": 5}})
+	a, err := New(store)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, err := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"}); err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	NewStatsHandler(a).ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Status = %d, want 200", rec.Code)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	want := map[string]interface{}{
+		"activeContexts": 1.0,
+		"maxContexts":    10.0,
+		"perBinding": map[string]interface{}{
+			"POST /api/transfer": map[string]interface{}{"count": 1.0, "limit": 5.0},
+		},
+		"evictions":   0.0,
+		"rateLimited": 0.0,
+		"released":    0.0,
+		"expired":     0.0,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Body = %s", rec.Body)
+	}
+
+	// Stores without Stats are reported as such.
+	a, err = New(replayingStore{store}, WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	NewStatsHandler(a).ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("Status = %d, want 501", rec.Code)
+	}
+}
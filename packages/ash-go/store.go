@@ -0,0 +1,463 @@
+package ash
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DefaultTTL is the default lifetime of an issued context.
+const DefaultTTL = 30 * time.Second
+
+// ErrInvalidTTL is returned when a context TTL is zero, negative, or not a
+// whole number of milliseconds.
+var ErrInvalidTTL = errors.New("invalid TTL")
+
+// ValidateTTL checks that ttl can be used to issue a context.
+//
+// Expiry timestamps are millisecond precision, so a TTL that is not positive
+// or has a fractional millisecond component would produce a context that is
+// already expired (or expires earlier than configured) at issuance.
+func ValidateTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: %v is not positive", ErrInvalidTTL, ttl)
+	}
+	if ttl%time.Millisecond != 0 {
+		return fmt.Errorf("%w: %v is not a whole number of milliseconds", ErrInvalidTTL, ttl)
+	}
+	return nil
+}
+
+// Lookups that fail for a common reason share one AshError each, so that
+// rejecting a storm of bad requests does not allocate an error per
+// request. Shared errors must not be modified.
+var (
+	errContextNotFound = NewAshError(ErrInvalidContext, "context not found")
+	errContextUsed     = NewAshError(ErrReplayDetected, "context already used")
+	errContextExpired  = NewAshError(ErrContextExpired, "context has expired")
+)
+
+// Context represents a context as held by a ContextStore.
+type Context struct {
+	// ID is the unique context identifier.
+	ID string
+	// Binding is the canonical binding: "METHOD /path".
+	Binding string
+	// Mode is the security mode.
+	Mode AshMode
+	// IssuedAt is the timestamp when context was issued (ms epoch).
+	IssuedAt int64
+	// ExpiresAt is the timestamp when context expires (ms epoch).
+	ExpiresAt int64
+	// Nonce is the optional nonce for server-assisted mode.
+	Nonce string
+	// Used reports whether the context has been consumed.
+	Used bool
+	// ConsumedAt is the timestamp when the context was consumed (ms
+	// epoch), or 0 if it is unused or the store does not record it.
+	ConsumedAt int64
+	// Metadata is optional server-side data attached at issuance.
+	Metadata map[string]interface{}
+	// ProofMetadata is the canonical JSON of the Metadata keys proofs
+	// cover, as captured at issuance, or "" if none. See
+	// ContextOptions.ProofMetadata.
+	ProofMetadata string
+	// Params are the path parameter values pinned at issuance when Binding
+	// is a BindingTemplate.
+	Params map[string]string
+	// Tenant is the tenant the context was issued to, if any.
+	Tenant string
+	// SessionKey is the key derived at issuance from
+	// ContextOptions.SessionSalt, or "" if the context is not bound to a
+	// session. Verification derives it again from the salt of the
+	// request rather than trusting the stored key.
+	SessionKey string
+	// UnicodeForm is the normalization form payloads are canonicalized
+	// with; empty means NFC.
+	UnicodeForm UnicodeForm
+	// RawStrings are the JSON Pointers of string values canonicalized
+	// without normalization. See WithRawStrings.
+	RawStrings []string
+	// OptionalFields are the object members left out of the canonical
+	// form when equal to their default. See WithOptionalFields.
+	OptionalFields []OptionalField
+	// DecimalStrings are the JSON Pointers of values canonicalized as
+	// decimal strings. See ContextOptions.DecimalStrings.
+	DecimalStrings []string
+	// IncludeLength requires proofs to bind the canonical payload length.
+	// See WithIncludeLength.
+	IncludeLength bool
+	// RawBody makes proofs cover the body bytes as sent instead of their
+	// canonical form. See ContextOptions.RawBody.
+	RawBody bool
+	// MultiUse lets the context be verified until it expires instead of
+	// being consumed. See ContextOptions.MultiUse.
+	MultiUse bool
+
+	// deadline is ExpiresAt with the monotonic reading of the issuing
+	// clock, set by MemoryStore, whose contexts never leave the process.
+	// See expired.
+	deadline time.Time
+}
+
+// Clone returns a copy of the context. The Metadata and Params maps and
+// the RawStrings, OptionalFields and DecimalStrings slices are copied;
+// Metadata values are shared. An empty Metadata map is cloned as nil.
+func (c *Context) Clone() *Context {
+	clone := *c
+	clone.Metadata = nil
+	if len(c.Metadata) > 0 {
+		clone.Metadata = make(map[string]interface{}, len(c.Metadata))
+		for k, v := range c.Metadata {
+			clone.Metadata[k] = v
+		}
+	}
+	if c.Params != nil {
+		clone.Params = make(map[string]string, len(c.Params))
+		for k, v := range c.Params {
+			clone.Params[k] = v
+		}
+	}
+	if c.RawStrings != nil {
+		clone.RawStrings = append([]string(nil), c.RawStrings...)
+	}
+	if c.OptionalFields != nil {
+		clone.OptionalFields = append([]OptionalField(nil), c.OptionalFields...)
+	}
+	if c.DecimalStrings != nil {
+		clone.DecimalStrings = append([]string(nil), c.DecimalStrings...)
+	}
+	return &clone
+}
+
+// PublicInfo returns the client-safe view of the context. Ash.PublicInfo
+// adds the context token, if the instance issues them.
+func (c *Context) PublicInfo() ContextPublicInfo {
+	return ContextPublicInfo{
+		ContextID: c.ID,
+		ExpiresAt: c.ExpiresAt,
+		Mode:      c.Mode,
+		Nonce:     c.Nonce,
+
+		SessionKey:     c.SessionKey,
+		ProofMetadata:  json.RawMessage(c.ProofMetadata),
+		UnicodeForm:    c.UnicodeForm,
+		RawStrings:     c.RawStrings,
+		OptionalFields: c.OptionalFields,
+		DecimalStrings: c.DecimalStrings,
+		IncludeLength:  c.IncludeLength,
+		RawBody:        c.RawBody,
+		MultiUse:       c.MultiUse,
+	}
+}
+
+// canonicalizeOptions returns the options payloads verified against the
+// context are canonicalized with.
+func (c *Context) canonicalizeOptions() []CanonicalizeOption {
+	opts := []CanonicalizeOption{WithUnicodeForm(c.UnicodeForm)}
+	if len(c.RawStrings) > 0 {
+		opts = append(opts, WithRawStrings(c.RawStrings...))
+	}
+	if len(c.OptionalFields) > 0 {
+		opts = append(opts, WithOptionalFields(c.OptionalFields...))
+	}
+	if len(c.DecimalStrings) > 0 {
+		opts = append(opts, WithDecimalStrings(c.DecimalStrings...))
+	}
+	return opts
+}
+
+// ContextOptions contains options for creating a context.
+type ContextOptions struct {
+	// ID is the optional context ID. Stores generate one with
+	// GenerateContextID when it is empty.
+	ID string
+	// Binding is the canonical binding: "METHOD /path". It may be a
+	// BindingTemplate such as "POST /api/accounts/{accountId}/transfers",
+	// or a binding pattern such as "GET /api/files/**" (see
+	// IsBindingPattern) to verify requests to any matching path.
+	Binding string
+	// Params pins template parameters to the given values: verification
+	// fails unless the request path has the same values. It requires
+	// Binding to be a template with those parameters.
+	Params map[string]string
+	// Tenant scopes the context to a tenant: it only verifies requests
+	// for the same tenant, and the proof covers it (see BuildProof).
+	Tenant string
+	// SessionSalt binds the context to an authenticated session: a
+	// server-side value derived from the session, never sent by the
+	// client. Proofs cover a key derived from it and the context ID
+	// (ContextPublicInfo.SessionKey), and verify only with the same salt
+	// (see WithSessionSalt). The salt itself is not stored.
+	SessionSalt []byte
+	// TTL is the context lifetime. It must pass ValidateTTL.
+	TTL time.Duration
+	// Mode is the security mode (default: balanced).
+	Mode AshMode
+	// Nonce is the optional nonce. Stores generate one for strict mode
+	// when it is empty.
+	Nonce string
+	// Metadata is optional server-side data attached to the context.
+	Metadata map[string]interface{}
+	// ProofMetadata are the Metadata keys whose values proofs cover, such
+	// as a price quoted at issuance, so the client cannot claim other
+	// values. The client receives them in ContextPublicInfo.ProofMetadata.
+	// IssueContext takes them from BindingPolicy.ProofMetadata when empty.
+	// Every key must be present in Metadata.
+	ProofMetadata []string
+	// UnicodeForm is the normalization form the client canonicalizes
+	// with (default: NFC). See UnicodeForm.
+	UnicodeForm UnicodeForm
+	// RawStrings are the JSON Pointers of string values the client
+	// canonicalizes without normalization, such as base64 fields. See
+	// WithRawStrings.
+	RawStrings []string
+	// OptionalFields are the object members the client leaves out of the
+	// canonical form when equal to their default, so that clients that
+	// omit them and clients that send them build the same proof. See
+	// WithOptionalFields.
+	OptionalFields []OptionalField
+	// DecimalStrings are the JSON Pointers of values, such as amounts,
+	// that the client canonicalizes as decimal strings, so that clients
+	// sending them as strings and as numbers build the same proof. Proofs
+	// then carry the DecimalStringsExtension line. IssueContext takes them
+	// from BindingPolicy.DecimalStrings when empty. See
+	// WithDecimalStrings.
+	DecimalStrings []string
+	// IncludeLength requires proofs to bind the canonical payload length.
+	// See WithIncludeLength.
+	IncludeLength bool
+	// RawBody makes proofs cover the body bytes exactly as sent, for
+	// clients that cannot canonicalize, such as embedded devices. Any
+	// change to the bytes in transit, even re-serialization by a proxy
+	// that keeps the meaning, then fails verification. UnicodeForm,
+	// RawStrings, OptionalFields and DecimalStrings do not apply. IssueContext takes it
+	// from BindingPolicy.RawBody when false.
+	RawBody bool
+	// MultiUse lets the context be verified any number of times until it
+	// expires, as in a mode whose ModeRequirements have MultiUse, for
+	// example across the paths of a binding pattern.
+	MultiUse bool
+}
+
+// newContext validates opts and builds a new context issued at now.
+// Stores call it from Create before persisting the context.
+func newContext(opts ContextOptions, now time.Time) (*Context, error) {
+	if err := ValidateTTL(opts.TTL); err != nil {
+		return nil, err
+	}
+	if opts.Binding == "" {
+		return nil, ErrEmptyBinding
+	}
+	if err := checkParams(opts.Binding, opts.Params); err != nil {
+		return nil, err
+	}
+	if IsBindingPattern(opts.Binding) {
+		if _, err := compileContextPattern(opts.Binding); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateTenant(opts.Tenant); err != nil {
+		return nil, err
+	}
+	var proofMetadata string
+	if len(opts.ProofMetadata) > 0 {
+		var err error
+		if proofMetadata, err = canonicalProofMetadata(opts.Metadata, opts.ProofMetadata); err != nil {
+			return nil, err
+		}
+	}
+	if err := opts.UnicodeForm.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := compilePointerPatterns(opts.RawStrings); err != nil {
+		return nil, err
+	}
+	if _, err := compileOptionalFields(opts.OptionalFields); err != nil {
+		return nil, err
+	}
+	if _, err := compilePointerPatterns(opts.DecimalStrings); err != nil {
+		return nil, err
+	}
+	mode := opts.Mode
+	if mode == "" {
+		mode = ModeBalanced
+	}
+	req, ok := mode.Requirements()
+	if !ok {
+		return nil, NewAshError(ErrModeViolation, "invalid mode")
+	}
+	if err := req.checkTTL(mode, opts.TTL); err != nil {
+		return nil, err
+	}
+
+	var err error
+	id := opts.ID
+	if id == "" {
+		if id, err = GenerateContextID(); err != nil {
+			return nil, err
+		}
+	}
+	nonce := opts.Nonce
+	if nonce == "" && req.NonceRequired {
+		if nonce, err = GenerateNonce(32); err != nil {
+			return nil, err
+		}
+	}
+	if err := req.checkBound(mode, nonce, opts.Tenant); err != nil {
+		return nil, err
+	}
+
+	issuedAt := now.UnixMilli()
+	return &Context{
+		ID:        id,
+		Binding:   opts.Binding,
+		Mode:      mode,
+		IssuedAt:  issuedAt,
+		ExpiresAt: issuedAt + opts.TTL.Milliseconds(),
+		Nonce:     nonce,
+		Metadata:  opts.Metadata,
+		Params:    opts.Params,
+		Tenant:    opts.Tenant,
+
+		SessionKey:    sessionKey(opts.SessionSalt, id),
+		ProofMetadata: proofMetadata,
+
+		UnicodeForm:    opts.UnicodeForm,
+		RawStrings:     opts.RawStrings,
+		OptionalFields: opts.OptionalFields,
+		DecimalStrings: opts.DecimalStrings,
+		IncludeLength:  opts.IncludeLength,
+		RawBody:        opts.RawBody,
+		MultiUse:       opts.MultiUse,
+	}, nil
+}
+
+// BindingLimits maps binding patterns to the maximum number of outstanding
+// (unconsumed, unexpired) contexts allowed per binding. Patterns are
+// BindingMatcher patterns, such as "POST /api/login" or "POST /api/**",
+// and the most specific matching pattern applies. Each concrete binding is
+// counted separately.
+type BindingLimits map[string]int
+
+// bindingLimiter is a compiled BindingLimits.
+type bindingLimiter struct {
+	limits  BindingLimits
+	matcher *BindingMatcher
+}
+
+// compile compiles the limits. Stores call it at construction and panic on
+// an invalid pattern.
+func (l BindingLimits) compile() (*bindingLimiter, error) {
+	patterns := make([]string, 0, len(l))
+	for pattern := range l {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	m, err := NewBindingMatcher(patterns...)
+	if err != nil {
+		return nil, err
+	}
+	return &bindingLimiter{limits: l, matcher: m}, nil
+}
+
+// mustCompile is compile, panicking on an invalid pattern.
+func (l BindingLimits) mustCompile() *bindingLimiter {
+	limiter, err := l.compile()
+	if err != nil {
+		panic(err)
+	}
+	return limiter
+}
+
+// limitFor returns the limit for a binding, or 0 if it is unlimited.
+func (l *bindingLimiter) limitFor(binding string) int {
+	pattern, ok := l.matcher.MatchBinding(binding)
+	if !ok {
+		return 0
+	}
+	return l.limits[pattern]
+}
+
+// errBindingLimit is returned by Create when a binding limit is reached.
+var errBindingLimit = NewAshError(ErrRateLimited, "too many outstanding contexts for binding")
+
+// ContextStore is a storage backend for contexts.
+//
+// Get returns a context even if it has expired or been consumed, so callers
+// can report the precise failure. Consume must be atomic: exactly one caller
+// may consume a given context.
+//
+// Contexts returned by Create and Get are copies: mutating them does not
+// change the stored state.
+type ContextStore interface {
+	// Create issues and stores a new context.
+	Create(opts ContextOptions) (*Context, error)
+	// Get returns the context with the given ID, or an ErrInvalidContext
+	// AshError if it does not exist.
+	Get(id string) (*Context, error)
+	// Consume marks the context as used. It returns an AshError with code
+	// ErrInvalidContext, ErrContextExpired or ErrReplayDetected on failure.
+	Consume(id string) error
+	// Cleanup removes expired contexts and returns the number removed.
+	Cleanup() (int, error)
+}
+
+// ReservingStore is a ContextStore that can hold a context for a single
+// in-flight request, so that it is consumed only once the request has been
+// handled. It is required by MiddlewareOptions.DeferConsume.
+//
+// While a context is reserved, Reserve and Consume fail for it with
+// ErrReplayDetected. A reservation lapses after its TTL, so a crashed
+// holder does not block the context for longer than that.
+type ReservingStore interface {
+	ContextStore
+	// Reserve holds an unused, unexpired context for up to ttl and returns
+	// a token identifying the reservation. It fails like Consume, and with
+	// ErrReplayDetected if the context is already reserved.
+	Reserve(id string, ttl time.Duration) (token string, err error)
+	// Release ends the reservation identified by token, leaving the
+	// context usable. It does nothing if the reservation has been replaced.
+	Release(id, token string) error
+	// ConsumeReserved marks a reserved context as used. It succeeds even if
+	// the reservation has lapsed, provided no other has replaced it, and
+	// fails with ErrReplayDetected otherwise.
+	ConsumeReserved(id, token string) error
+}
+
+// InvalidatingStore is a ContextStore that can invalidate every context
+// of a binding at once, for incident response such as a vulnerable
+// endpoint or a binding changed by a deploy.
+type InvalidatingStore interface {
+	ContextStore
+	// InvalidateByBinding consumes every unconsumed, unexpired context
+	// whose Binding is binding, so that verifying it fails with
+	// ErrReplayDetected, and returns the number consumed. Contexts
+	// created concurrently may be missed.
+	InvalidateByBinding(binding string) (int, error)
+}
+
+// ReleasingStore is a ContextStore that can delete a context its client
+// abandoned, such as when the user cancels a confirmation dialog, so that
+// it stops counting against BindingLimits before it expires.
+type ReleasingStore interface {
+	ContextStore
+	// ReleaseContext deletes an unconsumed, unexpired context that is not
+	// reserved. It fails like Consume otherwise, so a consumed context
+	// cannot be released to make it usable or unknown again.
+	ReleaseContext(id string) error
+}
+
+// IteratingStore is a ContextStore that can list its contexts, for
+// administrative checks such as AuditStore.
+type IteratingStore interface {
+	ContextStore
+	// Iterate calls fn with a copy of every stored context, in no
+	// particular order, until fn returns an error or ctx is cancelled,
+	// and returns that error. Contexts created or removed during the
+	// iteration may or may not be visited.
+	Iterate(ctx context.Context, fn func(*Context) error) error
+}
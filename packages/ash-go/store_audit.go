@@ -0,0 +1,54 @@
+package ash
+
+import "context"
+
+// ContextAnomaly is a stored context that breaks an invariant.
+type ContextAnomaly struct {
+	// ContextID is the ID of the context, which may be empty.
+	ContextID string
+	// Binding is the binding of the context.
+	Binding string
+	// Problem describes the broken invariant.
+	Problem string
+}
+
+// StoreAuditReport reports the outcome of AuditStore.
+type StoreAuditReport struct {
+	// Checked is the number of contexts visited.
+	Checked int
+	// Anomalies lists every broken invariant, one entry per problem.
+	Anomalies []ContextAnomaly
+}
+
+// AuditStore visits every context in store and checks that it has a
+// non-empty ID, a valid mode, the nonce and tenant its mode requires and a
+// TTL within the mode's bounds, and that it expires after it was issued.
+// A nonce on a mode that does not require one is not an anomaly: a
+// NonceProvider may issue nonces in any mode.
+//
+// Such contexts cannot be issued by this package; they point at another
+// writer sharing the store, an older mode table or corruption, and fail
+// verification with ErrModeViolation. The returned error is that of
+// store.Iterate, and the report covers the contexts visited before it.
+func AuditStore(ctx context.Context, store IteratingStore) (*StoreAuditReport, error) {
+	report := &StoreAuditReport{}
+	err := store.Iterate(ctx, func(c *Context) error {
+		report.Checked++
+		flag := func(problem string) {
+			report.Anomalies = append(report.Anomalies, ContextAnomaly{
+				ContextID: c.ID, Binding: c.Binding, Problem: problem,
+			})
+		}
+		if c.ID == "" {
+			flag("empty context ID")
+		}
+		if c.ExpiresAt <= c.IssuedAt {
+			flag("expires at or before it was issued")
+		}
+		if _, err := checkContext(c); err != nil {
+			flag(err.Error())
+		}
+		return nil
+	})
+	return report, err
+}
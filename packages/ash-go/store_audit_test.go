@@ -0,0 +1,80 @@
+package ash
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAuditStore tests AuditStore against store, which seed writes
+// contexts into directly, bypassing Create's checks.
+func testAuditStore(t *testing.T, store IteratingStore, seed func(*Context)) {
+	t.Helper()
+	for i := 0; i < 3; i++ {
+		if _, err := store.Create(ContextOptions{Binding: "POST /api/test", TTL: time.Minute, Mode: ModeStrict}); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+	now := time.Now().UnixMilli()
+	seed(&Context{ID: "ash_nonce", Binding: "POST /api/test", Mode: ModeStrict, IssuedAt: now, ExpiresAt: now + 60000})
+	seed(&Context{ID: "ash_mode", Binding: "POST /api/test", Mode: "paranoid", IssuedAt: now, ExpiresAt: now + 60000})
+	seed(&Context{ID: "ash_expiry", Binding: "POST /api/test", Mode: ModeBalanced, IssuedAt: now, ExpiresAt: now})
+	seed(&Context{Binding: "POST /api/test", Mode: ModeBalanced, IssuedAt: now, ExpiresAt: now + 60000})
+
+	report, err := AuditStore(context.Background(), store)
+	if err != nil {
+		t.Fatalf("AuditStore failed: %v", err)
+	}
+	if report.Checked != 7 {
+		t.Errorf("Checked = %d, want 7", report.Checked)
+	}
+	want := map[string]string{
+		"ash_nonce":  "requires a nonce",
+		"ash_mode":   "invalid mode",
+		"ash_expiry": "expires at or before it was issued",
+		"":           "empty context ID",
+	}
+	if len(report.Anomalies) != len(want) {
+		t.Fatalf("Anomalies = %+v, want %d", report.Anomalies, len(want))
+	}
+	for _, a := range report.Anomalies {
+		if !strings.Contains(a.Problem, want[a.ContextID]) {
+			t.Errorf("Anomaly %q = %q, want %q", a.ContextID, a.Problem, want[a.ContextID])
+		}
+	}
+
+	stop := errors.New("stop")
+	if err := store.Iterate(context.Background(), func(*Context) error { return stop }); err != stop {
+		t.Errorf("Iterate error = %v, want fn's error", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := AuditStore(ctx, store); !errors.Is(err, context.Canceled) {
+		t.Errorf("AuditStore error = %v, want context.Canceled", err)
+	}
+}
+
+// TestAuditStoreMemory tests AuditStore with a MemoryStore.
+func TestAuditStoreMemory(t *testing.T) {
+	store := NewMemoryStore(MemoryStoreOptions{})
+	testAuditStore(t, store, func(c *Context) {
+		store.mu.Lock()
+		store.contexts[c.ID] = c
+		store.mu.Unlock()
+	})
+}
+
+// TestAuditStoreRedis tests AuditStore with a RedisStore, across SCAN
+// pages and ignoring keys outside its prefix.
+func TestAuditStoreRedis(t *testing.T) {
+	client := newFakeRedis()
+	store := NewRedisStore(RedisStoreOptions{Client: client})
+	client.hashes["other:ctx:ash_foreign"] = map[string]string{"ctx": "{}", "used": "0"}
+	testAuditStore(t, store, func(c *Context) {
+		data, _ := json.Marshal(c)
+		client.hashes[redisContextKey(c.ID)] = map[string]string{"ctx": string(data), "used": "0"}
+	})
+}
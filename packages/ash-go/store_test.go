@@ -0,0 +1,707 @@
+package ash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fixedClock returns a clock function that always reports t.
+func fixedClock(t time.Time) func() time.Time {
+	return func() time.Time { return t }
+}
+
+// TestValidateTTL tests TTL validation.
+func TestValidateTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		wantErr bool
+	}{
+		{"zero", 0, true},
+		{"negative", -time.Second, true},
+		{"fractional millisecond", 1500 * time.Microsecond, true},
+		{"sub-millisecond", time.Microsecond, true},
+		{"one millisecond", time.Millisecond, false},
+		{"default", DefaultTTL, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTTL(tt.ttl)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidTTL) {
+					t.Errorf("ValidateTTL(%v) = %v, want ErrInvalidTTL", tt.ttl, err)
+				}
+			} else if err != nil {
+				t.Errorf("ValidateTTL(%v) unexpected error: %v", tt.ttl, err)
+			}
+		})
+	}
+}
+
+// TestMemoryStoreCreateTTL tests that Create rejects invalid TTLs.
+func TestMemoryStoreCreateTTL(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	store := NewMemoryStore(MemoryStoreOptions{Now: fixedClock(now)})
+
+	for _, ttl := range []time.Duration{0, -time.Millisecond} {
+		if _, err := store.Create(ContextOptions{Binding: "POST /api/test", TTL: ttl}); !errors.Is(err, ErrInvalidTTL) {
+			t.Errorf("Create with TTL %v: got %v, want ErrInvalidTTL", ttl, err)
+		}
+	}
+	if store.Size() != 0 {
+		t.Errorf("Expected no stored contexts, got %d", store.Size())
+	}
+
+	ctx, err := store.Create(ContextOptions{Binding: "POST /api/test", TTL: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Create with 1ms TTL failed: %v", err)
+	}
+	if ctx.ExpiresAt != now.UnixMilli()+1 {
+		t.Errorf("Expected ExpiresAt %d, got %d", now.UnixMilli()+1, ctx.ExpiresAt)
+	}
+}
+
+// TestMemoryStoreConsume tests consumption and replay detection.
+func TestMemoryStoreConsume(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	store := NewMemoryStore(MemoryStoreOptions{Now: func() time.Time { return now }})
+
+	ctx, err := store.Create(ContextOptions{Binding: "POST /api/test", TTL: time.Second})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if ctx.Mode != ModeBalanced {
+		t.Errorf("Expected default mode balanced, got %s", ctx.Mode)
+	}
+
+	assertCode := func(err error, code AshErrorCode) {
+		t.Helper()
+		var ashErr *AshError
+		if !errors.As(err, &ashErr) || ashErr.Code != code {
+			t.Errorf("Expected %s, got %v", code, err)
+		}
+	}
+
+	if err := store.Consume(ctx.ID); err != nil {
+		t.Fatalf("First consume failed: %v", err)
+	}
+	assertCode(store.Consume(ctx.ID), ErrReplayDetected)
+	assertCode(store.Consume("ash_missing"), ErrInvalidContext)
+
+	expiring, _ := store.Create(ContextOptions{Binding: "POST /api/test", TTL: time.Second})
+	now = now.Add(time.Second)
+	assertCode(store.Consume(expiring.ID), ErrContextExpired)
+
+	removed, err := store.Cleanup()
+	if err != nil || removed != 2 {
+		t.Errorf("Cleanup() = %d, %v; want 2, nil", removed, err)
+	}
+}
+
+// TestMemoryStoreStrictNonce tests that strict mode contexts carry a nonce.
+func TestMemoryStoreStrictNonce(t *testing.T) {
+	store := NewMemoryStore(MemoryStoreOptions{})
+	ctx, err := store.Create(ContextOptions{Binding: "POST /api/test", TTL: time.Second, Mode: ModeStrict})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if ctx.Nonce == "" {
+		t.Error("Expected nonce for strict mode context")
+	}
+}
+
+// TestBindingLimitsLimitFor tests binding limit pattern matching.
+func TestBindingLimitsLimitFor(t *testing.T) {
+	limits := BindingLimits{
+		"POST /api/login":   1,
+		"POST /api/*":       5,
+		"POST /api/admin/*": 2,
+	}
+	tests := []struct {
+		binding  string
+		expected int
+	}{
+		{"POST /api/login", 1},
+		{"POST /api/orders", 5},
+		{"POST /api/admin/users", 2},
+		{"GET /api/orders", 0},
+	}
+
+	for _, tt := range tests {
+		if got := limits.mustCompile().limitFor(tt.binding); got != tt.expected {
+			t.Errorf("limitFor(%q) = %d, want %d", tt.binding, got, tt.expected)
+		}
+	}
+}
+
+// TestMemoryStoreBindingLimits tests that outstanding contexts are capped
+// per binding and released on consume and on cleanup.
+func TestMemoryStoreBindingLimits(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	store := NewMemoryStore(MemoryStoreOptions{
+		Now:           func() time.Time { return now },
+		BindingLimits: BindingLimits{"POST /api/*": 2},
+	})
+	create := func(binding string) error {
+		_, err := store.Create(ContextOptions{Binding: binding, TTL: time.Second})
+		return err
+	}
+
+	first, _ := store.Create(ContextOptions{Binding: "POST /api/orders", TTL: time.Second})
+	if err := create("POST /api/orders"); err != nil {
+		t.Fatalf("Create within limit failed: %v", err)
+	}
+	var ashErr *AshError
+	if err := create("POST /api/orders"); !errors.As(err, &ashErr) || ashErr.Code != ErrRateLimited {
+		t.Fatalf("Expected %s, got %v", ErrRateLimited, err)
+	}
+	// Bindings are counted separately.
+	if err := create("POST /api/refunds"); err != nil {
+		t.Errorf("Create for another binding failed: %v", err)
+	}
+
+	// Consuming releases a slot.
+	if err := store.Consume(first.ID); err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+	if got := store.Outstanding("POST /api/orders"); got != 1 {
+		t.Errorf("Outstanding after consume = %d, want 1", got)
+	}
+	if err := create("POST /api/orders"); err != nil {
+		t.Errorf("Create after consume failed: %v", err)
+	}
+
+	// Cleaning up expired contexts releases their slots.
+	now = now.Add(time.Second)
+	if _, err := store.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if got := store.Outstanding("POST /api/orders"); got != 0 {
+		t.Errorf("Outstanding after cleanup = %d, want 0", got)
+	}
+	if err := create("POST /api/orders"); err != nil {
+		t.Errorf("Create after cleanup failed: %v", err)
+	}
+}
+
+// TestMemoryStoreBindingLimitsReclaim tests that expired contexts do not
+// hold a binding at its limit when no cleanup runs.
+func TestMemoryStoreBindingLimitsReclaim(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	store := NewMemoryStore(MemoryStoreOptions{
+		Now:           func() time.Time { return now },
+		BindingLimits: BindingLimits{"POST /api/x": 1},
+	})
+	if _, err := store.Create(ContextOptions{Binding: "POST /api/x", TTL: time.Second}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	now = now.Add(time.Hour)
+	if _, err := store.Create(ContextOptions{Binding: "POST /api/x", TTL: time.Second}); err != nil {
+		t.Fatalf("Create after the first context expired failed: %v", err)
+	}
+	if got := store.Outstanding("POST /api/x"); got != 1 {
+		t.Errorf("Outstanding = %d, want 1", got)
+	}
+	if _, err := store.Create(ContextOptions{Binding: "POST /api/x", TTL: time.Second}); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Create over the limit: got %v, want %s", err, ErrRateLimited)
+	}
+}
+
+// TestMemoryStoreReturnsCopies tests that mutating a returned context does
+// not change the stored context.
+func TestMemoryStoreReturnsCopies(t *testing.T) {
+	store := NewMemoryStore(MemoryStoreOptions{})
+	created, err := store.Create(ContextOptions{
+		Binding: "POST /api/test", TTL: time.Second,
+		Metadata: map[string]interface{}{"user": "u1"},
+	})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	created.ExpiresAt = 0
+	created.Metadata["user"] = "u2"
+
+	got, _ := store.Get(created.ID)
+	got.Used = true
+	got.Binding = "POST /api/other"
+	got.Metadata["user"] = "u3"
+
+	stored, _ := store.Get(created.ID)
+	if stored.ExpiresAt == 0 || stored.Used || stored.Binding != "POST /api/test" || stored.Metadata["user"] != "u1" {
+		t.Errorf("Stored context was mutated: %+v", stored)
+	}
+	if err := store.Consume(created.ID); err != nil {
+		t.Errorf("Consume failed: %v", err)
+	}
+}
+
+// TestMemoryStoreCleanupBatched tests batched cleanup and cancellation.
+func TestMemoryStoreCleanupBatched(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	store := NewMemoryStore(MemoryStoreOptions{Now: func() time.Time { return now }})
+	for i := 0; i < 10; i++ {
+		store.Create(ContextOptions{Binding: "POST /api/test", TTL: time.Second})
+	}
+	for i := 0; i < 3; i++ {
+		store.Create(ContextOptions{Binding: "POST /api/test", TTL: time.Minute})
+	}
+	now = now.Add(time.Second)
+
+	// A cancelled cleanup removes nothing.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := store.CleanupBatched(ctx, CleanupOptions{BatchSize: 3})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if result.Removed != 0 || result.Remaining != 13 {
+		t.Errorf("Cancelled cleanup result = %+v, want {0 13}", result)
+	}
+
+	result, err = store.CleanupBatched(context.Background(), CleanupOptions{BatchSize: 3, Pause: time.Millisecond})
+	if err != nil {
+		t.Fatalf("CleanupBatched failed: %v", err)
+	}
+	if result.Removed != 10 || result.Remaining != 3 {
+		t.Errorf("Cleanup result = %+v, want {10 3}", result)
+	}
+	if got := store.Outstanding("POST /api/test"); got != 3 {
+		t.Errorf("Outstanding after cleanup = %d, want 3", got)
+	}
+}
+
+// BenchmarkMemoryStoreCleanup measures cleanup of 500k expired contexts and
+// reports the longest time a concurrent Get waited for the lock.
+func BenchmarkMemoryStoreCleanup(b *testing.B) {
+	const size = 500000
+	for _, batch := range []int{size, DefaultCleanupBatchSize} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			var maxWait time.Duration
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				now := time.UnixMilli(1700000000000)
+				store := NewMemoryStore(MemoryStoreOptions{Now: func() time.Time { return now }})
+				for j := 0; j < size; j++ {
+					store.Create(ContextOptions{ID: fmt.Sprintf("ash_%d", j), Binding: "POST /api/test", TTL: time.Second})
+				}
+				now = now.Add(time.Second)
+
+				done := make(chan struct{})
+				var wg sync.WaitGroup
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						start := time.Now()
+						store.Get("ash_0")
+						if wait := time.Since(start); wait > maxWait {
+							maxWait = wait
+						}
+					}
+				}()
+				b.StartTimer()
+
+				store.CleanupBatched(context.Background(), CleanupOptions{BatchSize: batch})
+
+				b.StopTimer()
+				close(done)
+				wg.Wait()
+			}
+			b.ReportMetric(float64(maxWait.Microseconds()), "max-lock-wait-us")
+		})
+	}
+}
+
+// testReservingStore tests reservation semantics against a store whose
+// clock is moved forward by advance.
+func testReservingStore(t *testing.T, store ReservingStore, advance func(time.Duration)) {
+	t.Helper()
+	assertCode := func(err error, code AshErrorCode) {
+		t.Helper()
+		var ashErr *AshError
+		if !errors.As(err, &ashErr) || ashErr.Code != code {
+			t.Errorf("Expected %s, got %v", code, err)
+		}
+	}
+	create := func() *Context {
+		t.Helper()
+		ctx, err := store.Create(ContextOptions{Binding: "POST /api/test", TTL: time.Minute})
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		return ctx
+	}
+
+	// A reservation blocks other use until released.
+	ctx := create()
+	token, err := store.Reserve(ctx.ID, time.Second)
+	if err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	_, err = store.Reserve(ctx.ID, time.Second)
+	assertCode(err, ErrReplayDetected)
+	assertCode(store.Consume(ctx.ID), ErrReplayDetected)
+	if err := store.Release(ctx.ID, "stale"); err != nil {
+		t.Fatalf("Release with another token failed: %v", err)
+	}
+	assertCode(store.Consume(ctx.ID), ErrReplayDetected)
+	if err := store.Release(ctx.ID, token); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+
+	// After release the context can be reserved again and consumed.
+	token, err = store.Reserve(ctx.ID, time.Second)
+	if err != nil {
+		t.Fatalf("Reserve after release failed: %v", err)
+	}
+	if err := store.ConsumeReserved(ctx.ID, token); err != nil {
+		t.Fatalf("ConsumeReserved failed: %v", err)
+	}
+	if got, _ := store.Get(ctx.ID); !got.Used {
+		t.Error("Expected reserved context to be consumed")
+	}
+	assertCode(store.ConsumeReserved(ctx.ID, token), ErrReplayDetected)
+	_, err = store.Reserve(ctx.ID, time.Second)
+	assertCode(err, ErrReplayDetected)
+	_, err = store.Reserve("ash_missing", time.Second)
+	assertCode(err, ErrInvalidContext)
+
+	// A lapsed reservation frees the context; its holder can still consume
+	// it unless another reservation replaced it.
+	ctx = create()
+	first, _ := store.Reserve(ctx.ID, time.Second)
+	advance(time.Second)
+	second, err := store.Reserve(ctx.ID, time.Second)
+	if err != nil {
+		t.Fatalf("Reserve after lapse failed: %v", err)
+	}
+	assertCode(store.ConsumeReserved(ctx.ID, first), ErrReplayDetected)
+	if err := store.ConsumeReserved(ctx.ID, second); err != nil {
+		t.Errorf("ConsumeReserved by the new holder failed: %v", err)
+	}
+
+	ctx = create()
+	token, _ = store.Reserve(ctx.ID, time.Second)
+	advance(time.Second)
+	if err := store.ConsumeReserved(ctx.ID, token); err != nil {
+		t.Errorf("ConsumeReserved after lapse failed: %v", err)
+	}
+}
+
+// TestMemoryStoreReserve tests MemoryStore reservations.
+func TestMemoryStoreReserve(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	store := NewMemoryStore(MemoryStoreOptions{Now: func() time.Time { return now }})
+	testReservingStore(t, store, func(d time.Duration) { now = now.Add(d) })
+}
+
+// testConsumedRetention tests that a store configured with a one minute
+// ConsumedRetention keeps consumed contexts past their expiry, so that
+// verification reports a replay, while unconsumed contexts expire with
+// their TTL. clock is the store's clock and advance moves it forward.
+func testConsumedRetention(t *testing.T, store ContextStore, clock func() time.Time, advance func(time.Duration)) {
+	t.Helper()
+	a, err := New(store, WithClock(clock), WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	assertCode := func(err error, code AshErrorCode) {
+		t.Helper()
+		if !errors.Is(err, code) {
+			t.Errorf("Expected %s, got %v", code, err)
+		}
+	}
+
+	consumed, _ := a.IssueContext(ContextOptions{Binding: "POST /api/test", TTL: 10 * time.Second})
+	unconsumed, _ := a.IssueContext(ContextOptions{Binding: "POST /api/test", TTL: 10 * time.Second})
+	proof := clientProof(t, consumed, "", "")
+	consumedAt := clock().UnixMilli()
+	if _, err := a.Verify(consumed.ID, proof, consumed.Binding, nil, ""); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	_, err = a.Verify(consumed.ID, proof, consumed.Binding, nil, "")
+	assertCode(err, ErrReplayDetected)
+
+	// Just past expiry.
+	advance(10*time.Second + time.Millisecond)
+	if _, err := store.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	_, err = a.Verify(consumed.ID, proof, consumed.Binding, nil, "")
+	assertCode(err, ErrReplayDetected)
+
+	// Well past expiry, within the retention window.
+	advance(20*time.Second - time.Millisecond)
+	if _, err := store.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	got, err := store.Get(consumed.ID)
+	if err != nil {
+		t.Fatalf("Get of a retained context failed: %v", err)
+	}
+	if !got.Used || got.ConsumedAt != consumedAt {
+		t.Errorf("Get = used %v, consumed at %d; want used, consumed at %d", got.Used, got.ConsumedAt, consumedAt)
+	}
+	_, err = a.Verify(consumed.ID, proof, consumed.Binding, nil, "")
+	assertCode(err, ErrReplayDetected)
+	_, err = a.Verify(unconsumed.ID, clientProof(t, unconsumed, "", ""), unconsumed.Binding, nil, "")
+	assertCode(err, ErrInvalidContext)
+
+	// Past the retention window.
+	advance(31 * time.Second)
+	if _, err := store.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	_, err = store.Get(consumed.ID)
+	assertCode(err, ErrInvalidContext)
+	_, err = a.Verify(consumed.ID, proof, consumed.Binding, nil, "")
+	assertCode(err, ErrInvalidContext)
+}
+
+// TestMemoryStoreConsumedRetention tests MemoryStore consumed-context
+// retention.
+func TestMemoryStoreConsumedRetention(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	clock := func() time.Time { return now }
+	store := NewMemoryStore(MemoryStoreOptions{Now: clock, ConsumedRetention: time.Minute})
+	testConsumedRetention(t, store, clock, func(d time.Duration) { now = now.Add(d) })
+}
+
+// testInvalidateByBinding tests that a store limited to three outstanding
+// contexts for "POST /api/transfer" invalidates them together, leaving
+// other bindings and the limit usable.
+func testInvalidateByBinding(t *testing.T, store InvalidatingStore) {
+	t.Helper()
+	create := func(binding string) *Context {
+		t.Helper()
+		ctx, err := store.Create(ContextOptions{Binding: binding, TTL: time.Minute})
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		return ctx
+	}
+	var transfers []*Context
+	for i := 0; i < 3; i++ {
+		transfers = append(transfers, create("POST /api/transfer"))
+	}
+	other := create("POST /api/other")
+	if err := store.Consume(transfers[0].ID); err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+
+	if n, err := store.InvalidateByBinding("POST /api/transfer"); err != nil || n != 2 {
+		t.Fatalf("InvalidateByBinding = %d, %v, want 2", n, err)
+	}
+	for _, ctx := range transfers {
+		if err := store.Consume(ctx.ID); !errors.Is(err, ErrReplayDetected) {
+			t.Errorf("Consume of invalidated context = %v, want %s", err, ErrReplayDetected)
+		}
+	}
+	if n, _ := store.InvalidateByBinding("POST /api/transfer"); n != 0 {
+		t.Errorf("Second InvalidateByBinding = %d, want 0", n)
+	}
+
+	// The limit's slots are freed and other bindings are untouched.
+	for i := 0; i < 3; i++ {
+		create("POST /api/transfer")
+	}
+	if err := store.Consume(other.ID); err != nil {
+		t.Errorf("Consume of other binding failed: %v", err)
+	}
+}
+
+// testReleasingStore tests ReleaseContext on a store limited to one
+// outstanding context for "POST /api/transfer", with the stats it reports.
+// advance moves the store's clock forward.
+func testReleasingStore(t *testing.T, store ReleasingStore, advance func(time.Duration)) {
+	t.Helper()
+	create := func(binding string, ttl time.Duration) *Context {
+		t.Helper()
+		ctx, err := store.Create(ContextOptions{Binding: binding, TTL: ttl})
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		return ctx
+	}
+	assertCode := func(err error, code AshErrorCode) {
+		t.Helper()
+		if !errors.Is(err, code) {
+			t.Errorf("Expected %s, got %v", code, err)
+		}
+	}
+
+	released := create("POST /api/transfer", time.Minute)
+	if err := store.ReleaseContext(released.ID); err != nil {
+		t.Fatalf("ReleaseContext failed: %v", err)
+	}
+	_, err := store.Get(released.ID)
+	assertCode(err, ErrInvalidContext)
+	assertCode(store.Consume(released.ID), ErrInvalidContext)
+	assertCode(store.ReleaseContext(released.ID), ErrInvalidContext)
+
+	// The limit's slot is freed, and a consumed context stays consumed.
+	consumed := create("POST /api/transfer", time.Minute)
+	if err := store.Consume(consumed.ID); err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+	assertCode(store.ReleaseContext(consumed.ID), ErrReplayDetected)
+	if got, err := store.Get(consumed.ID); err != nil || !got.Used {
+		t.Errorf("Get after release of a consumed context = %+v, %v; want used", got, err)
+	}
+
+	reserved := create("POST /api/other", time.Minute)
+	if _, err := store.(ReservingStore).Reserve(reserved.ID, time.Minute); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	assertCode(store.ReleaseContext(reserved.ID), ErrReplayDetected)
+
+	expired := create("POST /api/transfer", 10*time.Second)
+	advance(11 * time.Second)
+	assertCode(store.ReleaseContext(expired.ID), ErrContextExpired)
+	if _, err := store.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+
+	stats, err := store.(StatsStore).Stats(context.Background())
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if stats.Released != 1 || stats.Expired != 1 {
+		t.Errorf("Stats = %d released, %d expired; want 1 and 1", stats.Released, stats.Expired)
+	}
+}
+
+// TestMemoryStoreReleaseContext tests MemoryStore releases.
+func TestMemoryStoreReleaseContext(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	store := NewMemoryStore(MemoryStoreOptions{
+		Now:           func() time.Time { return now },
+		BindingLimits: BindingLimits{"POST /api/transfer": 1},
+	})
+	testReleasingStore(t, store, func(d time.Duration) { now = now.Add(d) })
+}
+
+// TestMemoryStoreInvalidateByBinding tests MemoryStore invalidation.
+func TestMemoryStoreInvalidateByBinding(t *testing.T) {
+	testInvalidateByBinding(t, NewMemoryStore(MemoryStoreOptions{
+		BindingLimits: BindingLimits{"POST /api/transfer": 3},
+	}))
+}
+
+// testContextStore tests the ContextStore contract, and ReleasingStore if
+// the store implements it, against a store whose clock is moved forward by
+// advance. Its operations must be safe for concurrent use.
+func testContextStore(t *testing.T, store ContextStore, advance func(time.Duration)) {
+	t.Helper()
+	assertCode := func(err error, codes ...AshErrorCode) {
+		t.Helper()
+		for _, code := range codes {
+			if errors.Is(err, code) {
+				return
+			}
+		}
+		t.Errorf("Expected %v, got %v", codes, err)
+	}
+	create := func(ttl time.Duration) *Context {
+		t.Helper()
+		ctx, err := store.Create(ContextOptions{
+			Binding: "POST /api/test", TTL: ttl, Mode: ModeStrict,
+			Metadata: map[string]interface{}{"user": "u1"},
+		})
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		return ctx
+	}
+
+	// Contexts are stored as created and returned as copies.
+	ctx := create(time.Minute)
+	got, err := store.Get(ctx.ID)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, ctx) {
+		t.Errorf("Get = %+v, want %+v", got, ctx)
+	}
+	got.Used = true
+	got.Metadata["user"] = "u2"
+	if again, _ := store.Get(ctx.ID); again.Used || again.Metadata["user"] != "u1" {
+		t.Errorf("Mutating a returned context changed the store: %+v", again)
+	}
+	_, err = store.Get("ash_missing")
+	assertCode(err, ErrInvalidContext)
+	assertCode(store.Consume("ash_missing"), ErrInvalidContext)
+
+	// A context is consumed once and then reported as a replay.
+	if err := store.Consume(ctx.ID); err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+	if got, err := store.Get(ctx.ID); err != nil || !got.Used || got.ConsumedAt == 0 {
+		t.Errorf("Get after Consume = %+v, %v; want used with a consumption time", got, err)
+	}
+	assertCode(store.Consume(ctx.ID), ErrReplayDetected)
+
+	// Of concurrent consumers, exactly one wins.
+	ctx = create(time.Minute)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if store.Consume(ctx.ID) == nil {
+				mu.Lock()
+				won++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if won != 1 {
+		t.Errorf("%d concurrent consumers won, want 1", won)
+	}
+
+	if store, ok := store.(ReleasingStore); ok {
+		released := create(time.Minute)
+		if err := store.ReleaseContext(released.ID); err != nil {
+			t.Fatalf("ReleaseContext failed: %v", err)
+		}
+		_, err := store.Get(released.ID)
+		assertCode(err, ErrInvalidContext)
+		assertCode(store.Consume(released.ID), ErrInvalidContext)
+		assertCode(store.ReleaseContext(ctx.ID), ErrReplayDetected)
+	}
+
+	// An expired context cannot be consumed; the store may already have
+	// removed it.
+	ctx = create(time.Second)
+	advance(time.Second)
+	assertCode(store.Consume(ctx.ID), ErrContextExpired, ErrInvalidContext)
+	if _, err := store.Cleanup(); err != nil {
+		t.Errorf("Cleanup failed: %v", err)
+	}
+	_, err = store.Get(ctx.ID)
+	assertCode(err, ErrInvalidContext)
+}
+
+// TestMemoryStoreContract tests MemoryStore against the ContextStore
+// contract.
+func TestMemoryStoreContract(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	store := NewMemoryStore(MemoryStoreOptions{Now: func() time.Time { return now }})
+	testContextStore(t, store, func(d time.Duration) { now = now.Add(d) })
+}
@@ -0,0 +1,175 @@
+package ash
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for ContextStreamOptions.
+const (
+	// DefaultStreamMaxContexts is the default number of contexts per stream.
+	DefaultStreamMaxContexts = 16
+	// DefaultStreamInterval is the default minimum interval between
+	// streamed contexts.
+	DefaultStreamInterval = 100 * time.Millisecond
+	// DefaultStreamMaxStreams is the default number of streams a handler
+	// serves at once.
+	DefaultStreamMaxStreams = 64
+)
+
+// ContextStreamOptions configures a ContextStreamHandler.
+//
+// MaxContexts and Interval only pace a single stream: a client opening
+// many streams gets MaxContexts from each. MaxStreams bounds the streams
+// open at once, and the store's BindingLimits bound the contexts
+// outstanding per binding across all streams and handlers.
+type ContextStreamOptions struct {
+	// MaxContexts caps the number of contexts sent per stream
+	// (default: DefaultStreamMaxContexts).
+	MaxContexts int
+	// Interval is the minimum time between two contexts of a stream
+	// (default: DefaultStreamInterval).
+	Interval time.Duration
+	// MaxStreams caps the number of streams the handler serves at once
+	// (default: DefaultStreamMaxStreams). A request over the cap fails
+	// with ErrRateLimited (429).
+	MaxStreams int
+	// AllowBindingPatterns lets clients request contexts for binding
+	// patterns and templates (see ContextHandler.AllowBindingPatterns).
+	AllowBindingPatterns bool
+}
+
+// errTooManyStreams is returned when MaxStreams streams are open.
+var errTooManyStreams = NewAshError(ErrRateLimited, "too many context streams")
+
+// ContextStreamHandler issues contexts as a stream of server-sent events so
+// clients can keep a pool of contexts ready.
+//
+// Like ContextHandler it takes the "binding" and optional "mode" query
+// parameters, plus an optional "count" (capped at MaxContexts). Contexts are
+// sent at most one per Interval, each as
+//
+//	event: context
+//	id: <contextId>
+//	data: <ContextPublicInfo JSON>
+//
+// and the stream finishes with an "end" event whose data is {"count":n}.
+// If issuance fails mid-stream an "error" event carrying the usual
+// {"error","message"} object is sent instead and the stream ends.
+type ContextStreamHandler struct {
+	ash  *Ash
+	opts ContextStreamOptions
+
+	streams atomic.Int64
+}
+
+// NewContextStreamHandler creates a handler that streams contexts from a.
+func NewContextStreamHandler(a *Ash, opts ContextStreamOptions) *ContextStreamHandler {
+	if opts.MaxContexts <= 0 {
+		opts.MaxContexts = DefaultStreamMaxContexts
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultStreamInterval
+	}
+	if opts.MaxStreams <= 0 {
+		opts.MaxStreams = DefaultStreamMaxStreams
+	}
+	return &ContextStreamHandler{ash: a, opts: opts}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *ContextStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		h.ash.writeError(w, http.StatusMethodNotAllowed, NewAshError(ErrMalformedRequest, "method not allowed"))
+		return
+	}
+
+	query := r.URL.Query()
+	binding, ashErr := clientBinding(query.Get("binding"), h.opts.AllowBindingPatterns)
+	if ashErr != nil {
+		h.ash.writeError(w, http.StatusBadRequest, ashErr)
+		return
+	}
+	count := h.opts.MaxContexts
+	if v := query.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			h.ash.writeError(w, http.StatusBadRequest, NewAshError(ErrMalformedRequest, "count must be a positive integer"))
+			return
+		}
+		count = min(n, count)
+	}
+	mode, ashErr := h.ash.clientMode(query.Get("mode"))
+	if ashErr != nil {
+		h.ash.writeError(w, http.StatusBadRequest, ashErr)
+		return
+	}
+	defer h.streams.Add(-1)
+	if h.streams.Add(1) > int64(h.opts.MaxStreams) {
+		h.ash.writeError(w, http.StatusTooManyRequests, errTooManyStreams)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.ash.writeError(w, http.StatusInternalServerError, NewAshError(ErrInternalError, "streaming unsupported"))
+		return
+	}
+	issue := ContextOptions{
+		Binding:     binding,
+		Mode:        mode,
+		Tenant:      h.ash.tenantFor(r),
+		SessionSalt: h.ash.sessionSaltFor(r),
+	}
+
+	// Fail with a plain response if not even the first context can be
+	// issued.
+	ctx, status, ashErr := h.ash.issueForClient(issue)
+	if ashErr != nil {
+		h.ash.writeError(w, status, ashErr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	timer := time.NewTimer(h.opts.Interval)
+	defer timer.Stop()
+	sent := 0
+	for {
+		writeEvent(w, "context", ctx.ID, h.ash.PublicInfo(ctx))
+		flusher.Flush()
+		if sent++; sent == count {
+			break
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+			timer.Reset(h.opts.Interval)
+		}
+		if ctx, status, ashErr = h.ash.issueForClient(issue); ashErr != nil {
+			writeEvent(w, "error", "", h.ash.publicError(status, ashErr))
+			flusher.Flush()
+			return
+		}
+	}
+	writeEvent(w, "end", "", map[string]int{"count": sent})
+	flusher.Flush()
+}
+
+// writeEvent writes one server-sent event with JSON data.
+func writeEvent(w http.ResponseWriter, event, id string, data interface{}) {
+	b, _ := json.Marshal(data)
+	fmt.Fprintf(w, "event: %s\n", event)
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", b)
+}
@@ -0,0 +1,156 @@
+package ash
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is a parsed server-sent event.
+type sseEvent struct {
+	event, id, data string
+}
+
+// readEvents parses server-sent events.
+func readEvents(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var cur sseEvent
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			events = append(events, cur)
+			cur = sseEvent{}
+			continue
+		}
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "event":
+			cur.event = value
+		case "id":
+			cur.id = value
+		case "data":
+			cur.data = value
+		default:
+			t.Fatalf("Unexpected SSE line %q", line)
+		}
+	}
+	return events
+}
+
+// TestContextStreamHandler tests streaming contexts as server-sent events.
+func TestContextStreamHandler(t *testing.T) {
+	a, store := newTestAsh(t, time.UnixMilli(1700000000000))
+	handler := NewContextStreamHandler(a, ContextStreamOptions{MaxContexts: 3, Interval: time.Millisecond})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ash/contexts?binding=POST+/api/update&count=2", nil))
+
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected 200 event stream, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	events := readEvents(t, rec.Body.String())
+	if len(events) != 3 {
+		t.Fatalf("Expected 2 contexts and an end event, got %+v", events)
+	}
+	for _, ev := range events[:2] {
+		var info ContextPublicInfo
+		if err := json.Unmarshal([]byte(ev.data), &info); err != nil {
+			t.Fatalf("Invalid context data %q: %v", ev.data, err)
+		}
+		if ev.event != "context" || ev.id != info.ContextID {
+			t.Errorf("Unexpected context event %+v", ev)
+		}
+		if ctx, err := store.Get(info.ContextID); err != nil || ctx.Binding != "POST /api/update" {
+			t.Errorf("Streamed context not stored for the binding: %v", err)
+		}
+	}
+	if events[2].event != "end" || events[2].data != `{"count":2}` {
+		t.Errorf("Unexpected end event %+v", events[2])
+	}
+}
+
+// TestContextStreamHandlerLimits tests the count cap and mid-stream errors.
+func TestContextStreamHandlerLimits(t *testing.T) {
+	store := NewMemoryStore(MemoryStoreOptions{BindingLimits: BindingLimits{"POST /api/update": 2}})
+	a, err := New(store)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	handler := NewContextStreamHandler(a, ContextStreamOptions{MaxContexts: 5, Interval: time.Millisecond})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ash/contexts?binding=POST+/api/update&count=100", nil))
+	events := readEvents(t, rec.Body.String())
+	if len(events) != 3 || events[2].event != "error" || !strings.Contains(events[2].data, string(ErrRateLimited)) {
+		t.Errorf("Expected 2 contexts then a rate limit error, got %+v", events)
+	}
+
+	// Once the limit is reached the stream does not start.
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ash/contexts?binding=POST+/api/update", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got %d", rec.Code)
+	}
+}
+
+// TestContextStreamHandlerMaxStreams tests that streams over MaxStreams
+// are refused while the others are open.
+func TestContextStreamHandlerMaxStreams(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	handler := NewContextStreamHandler(a, ContextStreamOptions{Interval: time.Hour, MaxStreams: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest("GET", "/ash/contexts?binding=POST+/api/update&count=2", nil).WithContext(ctx)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); handler.streams.Load() != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("First stream did not start")
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ash/contexts?binding=POST+/api/update&count=1", nil))
+	if rec.Code != http.StatusTooManyRequests || decodeError(t, rec).Code != ErrRateLimited {
+		t.Errorf("Expected 429 over MaxStreams, got %d: %s", rec.Code, rec.Body)
+	}
+
+	cancel()
+	<-done
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ash/contexts?binding=POST+/api/update&count=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 once the first stream closed, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// TestContextStreamHandlerDefaultMaxStreams tests that streams are capped
+// at DefaultStreamMaxStreams unless MaxStreams is set.
+func TestContextStreamHandlerDefaultMaxStreams(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	handler := NewContextStreamHandler(a, ContextStreamOptions{})
+	if handler.opts.MaxStreams != DefaultStreamMaxStreams {
+		t.Fatalf("MaxStreams = %d, want %d", handler.opts.MaxStreams, DefaultStreamMaxStreams)
+	}
+
+	// Stand in for DefaultStreamMaxStreams open streams.
+	handler.streams.Store(DefaultStreamMaxStreams)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ash/contexts?binding=POST+/api/update&count=1", nil))
+	if rec.Code != http.StatusTooManyRequests || decodeError(t, rec).Code != ErrRateLimited {
+		t.Errorf("Expected 429 over the default MaxStreams, got %d: %s", rec.Code, rec.Body)
+	}
+	if got := handler.streams.Load(); got != DefaultStreamMaxStreams {
+		t.Errorf("Open streams after a refused request = %d, want %d", got, DefaultStreamMaxStreams)
+	}
+}
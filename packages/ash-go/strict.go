@@ -0,0 +1,143 @@
+package ash
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// WithRejectTrailingData rejects JSON documents with anything but
+// whitespace after the first value, such as {"a":1} {"b":2}, with an
+// ErrMalformedRequest AshError. Without it the rest is ignored, so a
+// handler that reads the whole body may act on data the proof does not
+// cover.
+func WithRejectTrailingData() CanonicalizeOption {
+	return func(o *canonicalizeOptions) { o.rejectTrailing = true }
+}
+
+// WithRequireTopLevelObject rejects JSON documents whose top-level value
+// is not an object, such as a bare string or array, with an
+// ErrMalformedRequest AshError.
+func WithRequireTopLevelObject() CanonicalizeOption {
+	return func(o *canonicalizeOptions) { o.requireObject = true }
+}
+
+// WithTrimTrailingNewline drops a single trailing line ending, "\n" or
+// "\r\n", from URL-encoded input before it is parsed, so that "a=1\n"
+// canonicalizes as "a=1" rather than "a=1%0A". JSON documents are
+// unaffected: whitespace after the value never reaches the canonical form.
+func WithTrimTrailingNewline() CanonicalizeOption {
+	return func(o *canonicalizeOptions) { o.trimNewline = true }
+}
+
+// trimURLEncoded applies WithTrimTrailingNewline to URL-encoded input.
+func (o *canonicalizeOptions) trimURLEncoded(input string) string {
+	if !o.trimNewline {
+		return input
+	}
+	if s, ok := strings.CutSuffix(input, "\n"); ok {
+		return strings.TrimSuffix(s, "\r")
+	}
+	return input
+}
+
+// checkTopLevel checks the top-level value v, a decoded value or its
+// first token, against WithRequireTopLevelObject.
+func (o *canonicalizeOptions) checkTopLevel(v interface{}) error {
+	if !o.requireObject {
+		return nil
+	}
+	kind := jsonKind(v)
+	if kind == "object" {
+		return nil
+	}
+	return &AshError{Code: ErrMalformedRequest, Message: "top-level JSON value must be an object, got " + kind, Reason: ReasonNotObject}
+}
+
+// errTrailingData is returned for data after the top-level JSON value.
+var errTrailingData = &AshError{Code: ErrMalformedRequest, Message: "trailing data after top-level JSON value", Reason: ReasonTrailingData}
+
+// checkTrailing checks the input after the first value, which dec has
+// just read, against WithRejectTrailingData.
+func (o *canonicalizeOptions) checkTrailing(dec *json.Decoder) error {
+	if !o.rejectTrailing {
+		return nil
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errTrailingData
+	}
+	return nil
+}
+
+// jsonKind names the kind of a decoded JSON value or of the value a token
+// starts.
+func jsonKind(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case json.Delim:
+		if v == '{' {
+			return "object"
+		}
+		return "array"
+	case string:
+		return "string"
+	case json.Number, float64:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return "null"
+	}
+}
+
+// JSONStrictness configures the parsing of JSON bodies during
+// verification. The zero value rejects trailing data and accepts any
+// top-level value.
+type JSONStrictness struct {
+	// AllowTrailingData ignores anything after the first JSON value
+	// instead of rejecting it (see WithRejectTrailingData).
+	AllowTrailingData bool
+	// RequireTopLevelObject rejects bodies whose top-level value is not
+	// an object (see WithRequireTopLevelObject).
+	RequireTopLevelObject bool
+}
+
+// WithJSONStrictness sets how strictly JSON bodies are parsed during
+// verification. Violations fail with ErrMalformedRequest.
+func WithJSONStrictness(s JSONStrictness) Option {
+	return func(a *Ash) { a.jsonStrictness = s }
+}
+
+// WithTrimURLEncodedNewline makes verification ignore a single trailing
+// newline on URL-encoded bodies, as appended by some clients and shell
+// pipelines, as if the client had not sent it (see
+// WithTrimTrailingNewline). A client that signs the newline as part of the
+// last value then fails with ErrIntegrityFailed. JSON bodies need no such
+// option, since whitespace after the value is ignored, and raw-body
+// contexts always cover the body exactly as sent.
+func WithTrimURLEncodedNewline() Option {
+	return func(a *Ash) { a.trimURLEncodedNewline = true }
+}
+
+// strictOptions returns the canonicalization options implementing the
+// configured JSONStrictness, WithTrimURLEncodedNewline and
+// WithMaxURLEncodedParams.
+func (a *Ash) strictOptions() []CanonicalizeOption {
+	var opts []CanonicalizeOption
+	if !a.jsonStrictness.AllowTrailingData {
+		opts = append(opts, WithRejectTrailingData())
+	}
+	if a.jsonStrictness.RequireTopLevelObject {
+		opts = append(opts, WithRequireTopLevelObject())
+	}
+	if a.trimURLEncodedNewline {
+		opts = append(opts, WithTrimTrailingNewline())
+	}
+	if a.maxParamsSet {
+		opts = append(opts, WithMaxParams(a.maxParams))
+	}
+	return opts
+}
@@ -0,0 +1,167 @@
+package ash
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseJSONStrict tests the strictness options of ParseJSON and
+// CanonicalizeJSONStream.
+func TestParseJSONStrict(t *testing.T) {
+	trailing := WithRejectTrailingData()
+	object := WithRequireTopLevelObject()
+
+	tests := []struct {
+		name    string
+		input   string
+		opts    []CanonicalizeOption
+		want    string
+		message string
+	}{
+		{"trailing ignored by default", `{"a":1} {"b":2}`, nil, `{"a":1}`, ""},
+		{"trailing object", `{"a":1} {"b":2}`, []CanonicalizeOption{trailing}, "", "trailing data after top-level JSON value"},
+		{"trailing garbage", `{"a":1}x`, []CanonicalizeOption{trailing}, "", "trailing data after top-level JSON value"},
+		{"trailing delimiter", `{"a":1}]`, []CanonicalizeOption{trailing}, "", "trailing data after top-level JSON value"},
+		{"trailing scalar", `1 2`, []CanonicalizeOption{trailing}, "", "trailing data after top-level JSON value"},
+		{"trailing whitespace", "{\"a\":1} \n\t\r ", []CanonicalizeOption{trailing}, `{"a":1}`, ""},
+		{"object", `{"a":1}`, []CanonicalizeOption{object}, `{"a":1}`, ""},
+		{"bare string", `"hi"`, []CanonicalizeOption{object}, "", "top-level JSON value must be an object, got string"},
+		{"bare number", `42`, []CanonicalizeOption{object}, "", "top-level JSON value must be an object, got number"},
+		{"bare boolean", `true`, []CanonicalizeOption{object}, "", "top-level JSON value must be an object, got boolean"},
+		{"bare null", `null`, []CanonicalizeOption{object}, "", "top-level JSON value must be an object, got null"},
+		{"array", `[{"a":1}]`, []CanonicalizeOption{object}, "", "top-level JSON value must be an object, got array"},
+		{"scalar allowed by default", `42`, []CanonicalizeOption{trailing}, `42`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			streamErr := CanonicalizeJSONStream(strings.NewReader(tt.input), &buf, tt.opts...)
+			got, err := ParseJSON(tt.input, tt.opts...)
+
+			for name, err := range map[string]error{"ParseJSON": err, "CanonicalizeJSONStream": streamErr} {
+				if tt.message == "" {
+					if err != nil {
+						t.Errorf("%s failed: %v", name, err)
+					}
+					continue
+				}
+				var ashErr *AshError
+				if !errors.As(err, &ashErr) || ashErr.Code != ErrMalformedRequest || ashErr.Message != tt.message {
+					t.Errorf("%s error = %v, want %s: %s", name, err, ErrMalformedRequest, tt.message)
+				}
+			}
+			if tt.message == "" && (got != tt.want || buf.String() != tt.want) {
+				t.Errorf("ParseJSON = %q, stream = %q, want %q", got, buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+// TestVerifyJSONStrictness tests that verification rejects trailing data
+// by default, even when the proof covers the first value, and applies the
+// configured JSONStrictness.
+func TestVerifyJSONStrictness(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		body   string
+		status int
+	}{
+		{"trailing data", nil, `{"amount":1} {"amount":1000}`, http.StatusBadRequest},
+		{"trailing whitespace", nil, "{\"amount\":1}\n", http.StatusOK},
+		{"trailing data allowed", []Option{WithJSONStrictness(JSONStrictness{AllowTrailingData: true})},
+			`{"amount":1} {"amount":1000}`, http.StatusOK},
+		{"bare scalar", nil, `"transfer"`, http.StatusOK},
+		{"bare scalar rejected", []Option{WithJSONStrictness(JSONStrictness{RequireTopLevelObject: true})},
+			`"transfer"`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestAsh(t, now, tt.opts...)
+			handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, signedRequest(t, a, "POST", "/api/transfer", tt.body, "application/json"))
+			if rec.Code != tt.status {
+				t.Fatalf("Status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK && decodeError(t, rec).Code != ErrMalformedRequest {
+				t.Errorf("Code = %s, want %s", decodeError(t, rec).Code, ErrMalformedRequest)
+			}
+		})
+	}
+
+	// SignRequest refuses to sign what the server would reject.
+	a, _ := newTestAsh(t, now)
+	ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/api/transfer", nil)
+	req.Header.Set("Content-Type", "application/json")
+	if err := SignRequest(req, ctx.PublicInfo(), []byte(`{"a":1} {"b":2}`)); !errors.Is(err, ErrMalformedRequest) {
+		t.Errorf("SignRequest with trailing data = %v, want %s", err, ErrMalformedRequest)
+	}
+}
+
+// TestVerifyTrailingNewline tests bodies sent with a trailing newline the
+// client did not sign.
+func TestVerifyTrailingNewline(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	trim := []Option{WithTrimURLEncodedNewline()}
+
+	tests := []struct {
+		name        string
+		opts        []Option
+		contentType string
+		signed      string
+		sent        string
+		status      int
+	}{
+		{"json", nil, "application/json", `{"amount":1}`, "{\"amount\":1}\n", http.StatusOK},
+		{"json crlf", nil, "application/json", `{"amount":1}`, "{\"amount\":1}\r\n", http.StatusOK},
+		{"form", nil, "application/x-www-form-urlencoded", "amount=1", "amount=1\n", http.StatusForbidden},
+		{"form trimmed", trim, "application/x-www-form-urlencoded", "amount=1", "amount=1\n", http.StatusOK},
+		{"form crlf trimmed", trim, "application/x-www-form-urlencoded", "amount=1", "amount=1\r\n", http.StatusOK},
+		{"form two newlines", trim, "application/x-www-form-urlencoded", "amount=1", "amount=1\n\n", http.StatusForbidden},
+		{"form newline signed", trim, "application/x-www-form-urlencoded", "amount=1\n", "amount=1\n", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestAsh(t, now, tt.opts...)
+			handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := signedRequest(t, a, "POST", "/api/transfer", tt.signed, tt.contentType)
+			setBody(req, []byte(tt.sent))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("Status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK && decodeError(t, rec).Code != ErrIntegrityFailed {
+				t.Errorf("Code = %s, want %s", decodeError(t, rec).Code, ErrIntegrityFailed)
+			}
+		})
+	}
+
+	for input, want := range map[string]string{
+		"b=2&a=1\n": "a=1&b=2",
+		"a=1\r\n":   "a=1",
+		"a=1\n\n":   "a=1%0A",
+		"a=1\r":     "a=1%0D",
+		"a=%0A":     "a=%0A",
+		"\n":        "",
+	} {
+		if got, err := CanonicalizeURLEncoded(input, WithTrimTrailingNewline()); err != nil || got != want {
+			t.Errorf("CanonicalizeURLEncoded(%q) = %q, %v, want %q", input, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package ash
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidBindingTemplate is returned when a binding template or its
+// pinned parameters cannot be used.
+var ErrInvalidBindingTemplate = errors.New("invalid binding template")
+
+// Parameter types accepted in a binding template.
+const (
+	// ParamString matches any non-empty path segment ("{name}").
+	ParamString = "string"
+	// ParamInt matches a segment of decimal digits ("{name:int}").
+	ParamInt = "int"
+	// ParamUUID matches a hyphenated hex UUID ("{name:uuid}").
+	ParamUUID = "uuid"
+)
+
+// templateSegment is one path segment of a binding template.
+type templateSegment struct {
+	literal string
+	param   string
+	typ     string
+}
+
+// BindingTemplate is a binding whose path has parameters, such as
+//
+//	POST /api/accounts/{accountId:int}/transfers
+//
+// Each parameter is a whole path segment, written "{name}" or
+// "{name:type}" with type ParamString (the default), ParamInt or
+// ParamUUID, and matches exactly one segment of that type.
+type BindingTemplate struct {
+	raw      string
+	method   string
+	segments []templateSegment
+	types    map[string]string
+}
+
+// IsBindingTemplate reports whether binding has path parameters.
+func IsBindingTemplate(binding string) bool {
+	return strings.Contains(binding, "{")
+}
+
+// ParseBindingTemplate parses a "METHOD /path" binding template. Parameter
+// names must be unique and consist of ASCII letters, digits and '_'.
+func ParseBindingTemplate(binding string) (*BindingTemplate, error) {
+	method, path, ok := strings.Cut(binding, " ")
+	if !ok || method == "" || !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("%w: %q is not \"METHOD /path\"", ErrInvalidBindingTemplate, binding)
+	}
+	t := &BindingTemplate{raw: binding, method: method, types: make(map[string]string)}
+	for _, seg := range strings.Split(path[1:], "/") {
+		if !strings.ContainsAny(seg, "{}") {
+			t.segments = append(t.segments, templateSegment{literal: seg})
+			continue
+		}
+		spec, open := strings.CutPrefix(seg, "{")
+		spec, closed := strings.CutSuffix(spec, "}")
+		if !open || !closed || strings.ContainsAny(spec, "{}") {
+			return nil, fmt.Errorf("%w: segment %q is not a whole parameter", ErrInvalidBindingTemplate, seg)
+		}
+		name, typ, hasType := strings.Cut(spec, ":")
+		if !hasType {
+			typ = ParamString
+		}
+		if !isParamName(name) {
+			return nil, fmt.Errorf("%w: invalid parameter name %q", ErrInvalidBindingTemplate, name)
+		}
+		if typ != ParamString && typ != ParamInt && typ != ParamUUID {
+			return nil, fmt.Errorf("%w: unknown parameter type %q", ErrInvalidBindingTemplate, typ)
+		}
+		if _, dup := t.types[name]; dup {
+			return nil, fmt.Errorf("%w: duplicate parameter %q", ErrInvalidBindingTemplate, name)
+		}
+		t.types[name] = typ
+		t.segments = append(t.segments, templateSegment{param: name, typ: typ})
+	}
+	return t, nil
+}
+
+// String returns the template as written.
+func (t *BindingTemplate) String() string {
+	return t.raw
+}
+
+// Params returns the parameter names in path order.
+func (t *BindingTemplate) Params() []string {
+	names := make([]string, 0, len(t.types))
+	for _, seg := range t.segments {
+		if seg.param != "" {
+			names = append(names, seg.param)
+		}
+	}
+	return names
+}
+
+// Match matches a concrete binding, such as one built by NormalizeBinding,
+// against the template and returns its parameter values.
+func (t *BindingTemplate) Match(binding string) (map[string]string, bool) {
+	method, path, ok := strings.Cut(binding, " ")
+	if !ok || method != t.method || !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	parts := strings.Split(path[1:], "/")
+	if len(parts) != len(t.segments) {
+		return nil, false
+	}
+	params := make(map[string]string, len(t.types))
+	for i, seg := range t.segments {
+		if seg.param == "" {
+			if parts[i] != seg.literal {
+				return nil, false
+			}
+			continue
+		}
+		if !paramMatches(seg.typ, parts[i]) {
+			return nil, false
+		}
+		params[seg.param] = parts[i]
+	}
+	return params, true
+}
+
+// checkPinned checks that every pinned parameter is in the template and
+// has a value of the parameter's type.
+func (t *BindingTemplate) checkPinned(pinned map[string]string) error {
+	for name, value := range pinned {
+		typ, ok := t.types[name]
+		if !ok {
+			return fmt.Errorf("%w: %q has no parameter %q", ErrInvalidBindingTemplate, t.raw, name)
+		}
+		if !paramMatches(typ, value) {
+			return fmt.Errorf("%w: pinned value for %q is not of type %s", ErrInvalidBindingTemplate, name, typ)
+		}
+	}
+	return nil
+}
+
+// IsBindingPattern reports whether binding is a binding pattern, such as
+// "GET /api/files/**": a binding whose path has a "*" segment, matching
+// exactly one path segment, or a final "**" segment, matching one or more,
+// as in BindingMatcher.
+func IsBindingPattern(binding string) bool {
+	_, path, _ := strings.Cut(binding, " ")
+	for _, seg := range strings.Split(path, "/") {
+		if seg == "*" || seg == "**" {
+			return true
+		}
+	}
+	return false
+}
+
+// compileContextPattern compiles the binding pattern of a context. Unlike
+// a BindingMatcher pattern, it must name one method and cannot also be a
+// BindingTemplate.
+func compileContextPattern(binding string) (bindingPattern, error) {
+	p, err := compilePattern(binding)
+	if err != nil {
+		return p, err
+	}
+	if p.method == "" || IsBindingTemplate(binding) {
+		return p, fmt.Errorf("%w: %q: a context pattern needs one method and no parameters", ErrInvalidPattern, binding)
+	}
+	return p, nil
+}
+
+// checkParams validates the pinned parameters of a binding at issuance.
+func checkParams(binding string, pinned map[string]string) error {
+	if !IsBindingTemplate(binding) {
+		if len(pinned) > 0 {
+			return fmt.Errorf("%w: %q has no parameters to pin", ErrInvalidBindingTemplate, binding)
+		}
+		return nil
+	}
+	t, err := ParseBindingTemplate(binding)
+	if err != nil {
+		return err
+	}
+	return t.checkPinned(pinned)
+}
+
+// matchBinding checks a request's concrete binding against a context's
+// binding: exactly, by binding pattern, or by template with every pinned
+// parameter equal. It returns an ErrEndpointMismatch AshError on any
+// difference.
+func matchBinding(ctx *Context, binding string) error {
+	if ctx.Binding == binding && len(ctx.Params) == 0 {
+		// Verified against the template itself, as with
+		// MiddlewareOptions.RoutePattern.
+		return nil
+	}
+	if IsBindingPattern(ctx.Binding) {
+		p, err := compileContextPattern(ctx.Binding)
+		method, path, ok := strings.Cut(binding, " ")
+		if err != nil || !ok || !strings.HasPrefix(path, "/") || !p.matches(method, strings.Split(path[1:], "/")) {
+			return NewAshError(ErrEndpointMismatch, "binding mismatch")
+		}
+		return nil
+	}
+	if !IsBindingTemplate(ctx.Binding) {
+		if ctx.Binding != binding {
+			return NewAshError(ErrEndpointMismatch, "binding mismatch")
+		}
+		return nil
+	}
+	t, err := ParseBindingTemplate(ctx.Binding)
+	if err != nil {
+		return NewAshError(ErrEndpointMismatch, "binding mismatch")
+	}
+	params, ok := t.Match(binding)
+	if !ok {
+		return NewAshError(ErrEndpointMismatch, "binding mismatch")
+	}
+	for name, want := range ctx.Params {
+		if params[name] != want {
+			return NewAshError(ErrEndpointMismatch, "path parameter mismatch: "+name)
+		}
+	}
+	return nil
+}
+
+// isParamName reports whether name is a valid parameter name.
+func isParamName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !('A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// paramMatches reports whether a path segment is a value of type typ.
+func paramMatches(typ, value string) bool {
+	if value == "" {
+		return false
+	}
+	switch typ {
+	case ParamInt:
+		for i := 0; i < len(value); i++ {
+			if value[i] < '0' || value[i] > '9' {
+				return false
+			}
+		}
+		return true
+	case ParamUUID:
+		if len(value) != 36 {
+			return false
+		}
+		for i := 0; i < len(value); i++ {
+			if i == 8 || i == 13 || i == 18 || i == 23 {
+				if value[i] != '-' {
+					return false
+				}
+			} else if !ProofHex.isChar(value[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return !strings.ContainsAny(value, "/")
+	}
+}
@@ -0,0 +1,172 @@
+package ash
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestBindingTemplateMatch tests template parsing and matching.
+func TestBindingTemplateMatch(t *testing.T) {
+	tests := []struct {
+		template string
+		binding  string
+		want     map[string]string
+	}{
+		{"POST /api/accounts/{accountId}/transfers", "POST /api/accounts/a1/transfers", map[string]string{"accountId": "a1"}},
+		{"POST /api/accounts/{accountId:int}/transfers", "POST /api/accounts/42/transfers", map[string]string{"accountId": "42"}},
+		{"POST /api/accounts/{accountId:int}/transfers", "POST /api/accounts/a1/transfers", nil},
+		{"PUT /api/{kind}/{id:uuid}", "PUT /api/orders/123e4567-e89b-12d3-a456-426614174000", map[string]string{"kind": "orders", "id": "123e4567-e89b-12d3-a456-426614174000"}},
+		{"PUT /api/{kind}/{id:uuid}", "PUT /api/orders/123e4567", nil},
+		{"POST /api/accounts/{accountId}/transfers", "PUT /api/accounts/a1/transfers", nil},
+		{"POST /api/accounts/{accountId}/transfers", "POST /api/accounts/a1/transfers/t1", nil},
+		{"POST /api/accounts/{accountId}/transfers", "POST /api/accounts//transfers", nil},
+	}
+	for _, tt := range tests {
+		tmpl, err := ParseBindingTemplate(tt.template)
+		if err != nil {
+			t.Fatalf("ParseBindingTemplate(%q) failed: %v", tt.template, err)
+		}
+		got, ok := tmpl.Match(tt.binding)
+		if ok != (tt.want != nil) || ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q.Match(%q) = %v, %v; want %v", tt.template, tt.binding, got, ok, tt.want)
+		}
+	}
+
+	for _, bad := range []string{
+		"/api/{id}",
+		"POST /api/x{id}",
+		"POST /api/{id",
+		"POST /api/{}",
+		"POST /api/{id:float}",
+		"POST /api/{id}/{id}",
+	} {
+		if _, err := ParseBindingTemplate(bad); !errors.Is(err, ErrInvalidBindingTemplate) {
+			t.Errorf("ParseBindingTemplate(%q) = %v, want ErrInvalidBindingTemplate", bad, err)
+		}
+	}
+}
+
+// TestVerifyBindingTemplate tests verification of contexts issued for a
+// binding template with pinned and unpinned parameters.
+func TestVerifyBindingTemplate(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, _ := newTestAsh(t, now)
+	body := `{"amount":10}`
+	const template = "POST /api/accounts/{accountId:int}/transfers/{kind}"
+
+	tests := []struct {
+		name    string
+		params  map[string]string
+		binding string
+		code    AshErrorCode
+	}{
+		{"pinned match", map[string]string{"accountId": "42"}, "POST /api/accounts/42/transfers/wire", ""},
+		{"pinned mismatch", map[string]string{"accountId": "42"}, "POST /api/accounts/43/transfers/wire", ErrEndpointMismatch},
+		{"unpinned", nil, "POST /api/accounts/43/transfers/ach", ""},
+		{"template mismatch", nil, "POST /api/accounts/x/transfers/ach", ErrEndpointMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, err := a.IssueContext(ContextOptions{Binding: template, Params: tt.params})
+			if err != nil {
+				t.Fatalf("IssueContext failed: %v", err)
+			}
+			// The client proves the concrete binding it calls.
+			concrete := *ctx
+			concrete.Binding = tt.binding
+			proof := clientProof(t, &concrete, body, "application/json")
+
+			_, err = a.Verify(ctx.ID, proof, tt.binding, []byte(body), "application/json")
+			if tt.code == "" {
+				if err != nil {
+					t.Errorf("Verify failed: %v", err)
+				}
+				return
+			}
+			var ashErr *AshError
+			if !errors.As(err, &ashErr) || ashErr.Code != tt.code {
+				t.Errorf("Expected %s, got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+// TestIssueContextPinnedParams tests that pinned parameters are validated
+// at issuance.
+func TestIssueContextPinnedParams(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	tests := []struct {
+		binding string
+		params  map[string]string
+	}{
+		{"POST /api/accounts/42/transfers", map[string]string{"accountId": "42"}},
+		{"POST /api/accounts/{accountId}/transfers", map[string]string{"userId": "7"}},
+		{"POST /api/accounts/{accountId:int}/transfers", map[string]string{"accountId": "a1"}},
+	}
+	for _, tt := range tests {
+		if _, err := a.IssueContext(ContextOptions{Binding: tt.binding, Params: tt.params}); !errors.Is(err, ErrInvalidBindingTemplate) {
+			t.Errorf("IssueContext(%q, %v) = %v, want ErrInvalidBindingTemplate", tt.binding, tt.params, err)
+		}
+	}
+}
+
+// TestVerifyBindingPattern tests a multi-use context issued for a binding
+// pattern: each request proves its own concrete binding.
+func TestVerifyBindingPattern(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	ctx, err := a.IssueContext(ContextOptions{Binding: "GET /api/files/**", MultiUse: true})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	if !ctx.PublicInfo().MultiUse {
+		t.Error("PublicInfo().MultiUse = false")
+	}
+	proofFor := func(binding string) string {
+		concrete := *ctx
+		concrete.Binding = binding
+		return clientProof(t, &concrete, "", "")
+	}
+
+	for _, binding := range []string{"GET /api/files/readme.txt", "GET /api/files/docs/guide.md", "GET /api/files/readme.txt"} {
+		if _, err := a.Verify(ctx.ID, proofFor(binding), binding, nil, ""); err != nil {
+			t.Errorf("Verify(%q) failed: %v", binding, err)
+		}
+	}
+
+	tests := []struct {
+		name, proofBinding, binding string
+		code                        AshErrorCode
+	}{
+		{"outside pattern", "GET /api/users/1", "GET /api/users/1", ErrEndpointMismatch},
+		{"other method", "DELETE /api/files/readme.txt", "DELETE /api/files/readme.txt", ErrEndpointMismatch},
+		{"pattern root", "GET /api/files", "GET /api/files", ErrEndpointMismatch},
+		{"proof for another path", "GET /api/files/a.txt", "GET /api/files/b.txt", ErrIntegrityFailed},
+		{"proof for the pattern", "GET /api/files/**", "GET /api/files/b.txt", ErrIntegrityFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := a.Verify(ctx.ID, proofFor(tt.proofBinding), tt.binding, nil, "")
+			if !errors.Is(err, tt.code) {
+				t.Errorf("Expected %s, got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+// TestIssueContextBindingPattern tests that binding patterns are validated
+// at issuance.
+func TestIssueContextBindingPattern(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	for _, binding := range []string{"GET /api/files/*", "GET /api/*/meta", "POST /api/**"} {
+		if _, err := a.IssueContext(ContextOptions{Binding: binding}); err != nil {
+			t.Errorf("IssueContext(%q) failed: %v", binding, err)
+		}
+	}
+	for _, binding := range []string{"* /api/files/*", "GET /api/**/meta", "GET /api/{id}/*"} {
+		if _, err := a.IssueContext(ContextOptions{Binding: binding}); !errors.Is(err, ErrInvalidPattern) {
+			t.Errorf("IssueContext(%q) = %v, want ErrInvalidPattern", binding, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+//! Prints proof vectors built by ash-core, which ash-node calls through
+//! ash-wasm, for the Go tests to verify. See Cargo.toml for how to run it.
+
+use ash_core::{build_proof, canonicalize_json, AshMode};
+use serde_json::json;
+
+const BINDING: &str = "POST /api/orders";
+const CONTEXT_ID: &str = "ash_sdk_vector";
+const NONCE: &str = "b3f1c2d4e5a6978812345678abcdef00b3f1c2d4e5a6978812345678abcdef00";
+
+/// Request bodies as a client sends them, in JSON text so that number
+/// spellings and escapes reach the canonicalizer as written.
+const CASES: &[(&str, &str)] = &[
+    ("ascii", r#"{"z":1,"a":"hello","m":[true,false,null]}"#),
+    ("html characters", r#"{"html":"<script>alert('x')</script> & \"quotes\""}"#),
+    ("line and paragraph separators", "{\"text\":\"a\u{2028}b\u{2029}c\"}"),
+    ("escaped separators", r#"{"text":"a\u2028b\u2029c"}"#),
+    ("control characters", r#"{"ctl":"\b\f\n\r\t\u0000\u0001\u001f\u007f","tab\tkey":1}"#),
+    ("backslash and slash", r#"{"path":"C:\\dir\\file \/ x"}"#),
+    ("nfd to nfc", "{\"cafe\u{301}\":\"re\u{301}sume\u{301}\"}"),
+    ("astral characters", r#"{"emoji":"\ud83d\ude00\ud83d\udc68\u200d\ud83d\udc69","math":"𝐀"}"#),
+    ("code point key order", "{\"\u{1F600}\":1,\"\u{FF61}\":2,\"\u{E9}\":3,\"e\":4,\"E\":5}"),
+    (
+        "astral key order",
+        "{\"\u{10000}\":1,\"\u{E000}\":2,\"\u{FFFD}\":3,\"\u{1F600}\":4,\"\u{D7FF}\":5,\"\u{1F600}a\":6,\"\u{10FFFF}\":7,\"\u{FFFF}\":8}",
+    ),
+    ("nested", r#"{"b":{"d":[1,{"f":"x","e":"y"}],"c":{}},"a":[]}"#),
+    ("empty object", "{}"),
+    ("integers", r#"{"zero":0,"negZero":-0,"big":9007199254740992,"neg":-42,"max":18446744073709551615}"#),
+    ("decimals", r#"{"a":1.5,"b":0.1,"c":-0.000001,"d":100.25,"e":0.30000000000000004}"#),
+    ("exponent notation", r#"{"small":1e-7,"tiny":5e-324,"large":1e21,"huge":1.5e300,"neg":-2.5e-8}"#),
+    ("whole floats", r#"{"a":1.0,"b":-0.0,"c":2.50,"d":1e2}"#),
+];
+
+fn vector(name: &str, mode: AshMode, nonce: Option<&str>, body: &str) -> serde_json::Value {
+    let canonical = canonicalize_json(body).expect("canonicalize_json");
+    let proof = build_proof(mode, BINDING, CONTEXT_ID, nonce, &canonical).expect("build_proof");
+    json!({
+        "name": name,
+        "mode": mode.to_string(),
+        "binding": BINDING,
+        "contextId": CONTEXT_ID,
+        "nonce": nonce.unwrap_or(""),
+        "body": body,
+        "canonical": canonical,
+        "proof": proof,
+    })
+}
+
+fn main() {
+    let mut vectors: Vec<_> = CASES
+        .iter()
+        .map(|(name, body)| vector(name, AshMode::Balanced, None, body))
+        .collect();
+    vectors.push(vector(
+        "strict with nonce",
+        AshMode::Strict,
+        Some(NONCE),
+        r#"{"amount":100,"currency":"EUR"}"#,
+    ));
+    let out = json!({
+        "generator": "testdata/ash-core/main.rs",
+        "vectors": vectors,
+    });
+    println!("{}", serde_json::to_string_pretty(&out).unwrap());
+}
@@ -0,0 +1,140 @@
+//go:build ignore
+
+// Command record appends a compatibility fixture to testdata/compat/v1: it
+// issues a context, builds the proof the checked-out implementation expects
+// for the given request and writes both to <name>.json. Run it from a
+// release, so that the fixture records what clients of that release send.
+// Existing fixtures are never overwritten.
+//
+// Run from the module root:
+//
+//	go run ./testdata/compat/record.go -name json-nested \
+//	    -binding "POST /api/orders" -body '{"b":[1,2],"a":{"y":1,"x":2}}'
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ash "github.com/3maem/ash-go"
+)
+
+// fixture mirrors compatFixture in compat_test.go.
+type fixture struct {
+	Name        string            `json:"name"`
+	Binding     string            `json:"binding"`
+	ContentType string            `json:"contentType"`
+	Body        string            `json:"body"`
+	ContextID   string            `json:"contextId"`
+	Mode        ash.AshMode       `json:"mode"`
+	Nonce       string            `json:"nonce,omitempty"`
+	Extensions  map[string]string `json:"extensions,omitempty"`
+	Proof       string            `json:"proof"`
+}
+
+// extFlag collects repeated -ext key=value flags.
+type extFlag map[string]string
+
+func (e extFlag) String() string { return fmt.Sprint(map[string]string(e)) }
+
+func (e extFlag) Set(v string) error {
+	key, value, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("extension %q is not key=value", v)
+	}
+	e[key] = value
+	return nil
+}
+
+func main() {
+	exts := extFlag{}
+	name := flag.String("name", "", "fixture name (file name without .json)")
+	binding := flag.String("binding", "POST /api/test", "binding")
+	contentType := flag.String("content-type", "application/json", "content type")
+	body := flag.String("body", "", "raw request body")
+	bodyFile := flag.String("body-file", "", "read the raw request body from a file")
+	mode := flag.String("mode", string(ash.ModeBalanced), "security mode")
+	flag.Var(exts, "ext", "extension key=value (repeatable)")
+	dir := flag.String("dir", "testdata/compat/v1", "fixture directory")
+	flag.Parse()
+
+	if err := record(*dir, *name, *binding, *contentType, *body, *bodyFile, ash.AshMode(*mode), exts); err != nil {
+		fmt.Fprintln(os.Stderr, "record:", err)
+		os.Exit(1)
+	}
+}
+
+func record(dir, name, binding, contentType, body, bodyFile string, mode ash.AshMode, exts map[string]string) error {
+	if name == "" {
+		return fmt.Errorf("-name is required")
+	}
+	if bodyFile != "" {
+		data, err := os.ReadFile(bodyFile)
+		if err != nil {
+			return err
+		}
+		body = string(data)
+	}
+
+	id, err := ash.GenerateContextID()
+	if err != nil {
+		return err
+	}
+	var nonce string
+	if mode == ash.ModeStrict {
+		if nonce, err = ash.GenerateNonce(32); err != nil {
+			return err
+		}
+	}
+	canonical, err := ash.CanonicalizePayload([]byte(body), contentType)
+	if err != nil {
+		return err
+	}
+	input := ash.BuildProofInput{
+		Mode:             mode,
+		Binding:          binding,
+		ContextID:        id,
+		Nonce:            nonce,
+		CanonicalPayload: canonical,
+	}
+	for k, v := range exts {
+		input.Extensions = append(input.Extensions, ash.KV{Key: k, Value: v})
+	}
+	proof, err := ash.BuildProofChecked(input)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(fixture{
+		Name:        name,
+		Binding:     binding,
+		ContentType: contentType,
+		Body:        body,
+		ContextID:   id,
+		Mode:        mode,
+		Nonce:       nonce,
+		Extensions:  exts,
+		Proof:       proof,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name+".json")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Println("wrote", path)
+	return nil
+}
@@ -0,0 +1,130 @@
+package ash
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// Transport is an http.RoundTripper that signs every request with a fresh
+// context. For each request it fetches a context for the request's binding
+// from a ContextHandler at ContextURL, signs a copy of the request with
+// SignRequest and sends it through Base. The original request is not
+// modified.
+//
+// Request bodies without GetBody are read in full to be signed.
+type Transport struct {
+	// ContextURL is the URL of the server's ContextHandler (required).
+	ContextURL string
+	// Mode is the security mode requested for contexts (default: the
+	// server's).
+	Mode AshMode
+	// Base sends the context and signed requests (default:
+	// http.DefaultTransport).
+	Base http.RoundTripper
+	// EncodedSlashes must match the server's
+	// MiddlewareOptions.EncodedSlashes (default: EncodedSlashesDecode).
+	EncodedSlashes EncodedSlashes
+	// Extensions are bound into every proof and sent in HeaderExtensions,
+	// for endpoints whose BindingPolicy requires them.
+	Extensions []KV
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	signed := req.Clone(req.Context())
+	if err := bufferBody(signed); err != nil {
+		return nil, err
+	}
+	path := RequestPath(req.URL, t.EncodedSlashes)
+	info, err := t.FetchContext(req.Context(), req.Method, path)
+	if err != nil {
+		closeBody(signed)
+		return nil, err
+	}
+	if err := SignRequest(signed, info, nil, SignBinding(BindingFromRequest(req, BindingEncodedSlashes(t.EncodedSlashes))),
+		SignExtensions(t.Extensions...)); err != nil {
+		closeBody(signed)
+		return nil, err
+	}
+	return t.base().RoundTrip(signed)
+}
+
+// FetchContext fetches a context for the binding of method and path from
+// the ContextHandler at ContextURL. A refusal by the server is returned as
+// its *AshError.
+func (t *Transport) FetchContext(ctx context.Context, method, path string) (ContextPublicInfo, error) {
+	var info ContextPublicInfo
+	u, err := url.Parse(t.ContextURL)
+	if err != nil {
+		return info, fmt.Errorf("ash: fetch context: %w", err)
+	}
+	query := u.Query()
+	query.Set("binding", NormalizeBinding(method, path))
+	if t.Mode != "" {
+		query.Set("mode", string(t.Mode))
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return info, fmt.Errorf("ash: fetch context: %w", err)
+	}
+	resp, err := t.base().RoundTrip(req)
+	if err != nil {
+		return info, fmt.Errorf("ash: fetch context: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var ashErr AshError
+		if err := json.NewDecoder(resp.Body).Decode(&ashErr); err != nil || ashErr.Code == "" {
+			return info, fmt.Errorf("ash: fetch context: unexpected status %s", resp.Status)
+		}
+		return info, &ashErr
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return info, fmt.Errorf("ash: fetch context: %w", err)
+	}
+	if info.ContextID == "" {
+		return info, errors.New("ash: fetch context: response has no context ID")
+	}
+	return info, nil
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+// bufferBody reads the body of req into memory and sets GetBody, unless
+// the body can already be re-read.
+func bufferBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return fmt.Errorf("ash: read request body: %w", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return nil
+}
+
+// closeBody closes the body of a request that will not be sent, as
+// RoundTrip must.
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
@@ -0,0 +1,122 @@
+package ash
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTransportServer serves a ContextHandler at /ash/context and an
+// echoing handler protected by the middleware everywhere else.
+func newTransportServer(t *testing.T, opts ...Option) *httptest.Server {
+	t.Helper()
+	a, err := New(NewMemoryStore(MemoryStoreOptions{}), append([]Option{WithTTL(time.Minute)}, opts...)...)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/ash/context", NewContextHandler(a))
+	mux.Handle("/", a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// TestTransport tests that requests sent through a Transport verify.
+func TestTransport(t *testing.T) {
+	srv := newTransportServer(t)
+	tests := []struct {
+		name, method, contentType, body string
+		// once sends the body without GetBody.
+		once bool
+	}{
+		{name: "json", method: "POST", contentType: "application/json", body: `{"b":2,"a":1}`},
+		{name: "unbuffered body", method: "PUT", contentType: "application/x-www-form-urlencoded", body: "b=2&a=1", once: true},
+		{name: "bodyless", method: "GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []AshMode{"", ModeStrict} {
+				client := &http.Client{Transport: &Transport{ContextURL: srv.URL + "/ash/context", Mode: mode}}
+				var body io.Reader
+				if tt.once {
+					body = onceReader{strings.NewReader(tt.body)}
+				} else if tt.body != "" {
+					body = strings.NewReader(tt.body)
+				}
+				req, _ := http.NewRequest(tt.method, srv.URL+"/api/items", body)
+				if tt.contentType != "" {
+					req.Header.Set("Content-Type", tt.contentType)
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatalf("mode %q: request failed: %v", mode, err)
+				}
+				got, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK || string(got) != tt.body {
+					t.Errorf("mode %q: got %d %q, want 200 %q", mode, resp.StatusCode, got, tt.body)
+				}
+				if req.Header.Get(HeaderProof) != "" {
+					t.Error("Transport modified the original request")
+				}
+			}
+		})
+	}
+}
+
+// TestTransportExtensions tests that extensions set on a Transport reach
+// verification through HeaderExtensions.
+func TestTransportExtensions(t *testing.T) {
+	srv := newTransportServer(t,
+		WithBindingPolicy("POST /api/items", BindingPolicy{RequiredExtensions: []string{"tenant"}}))
+	tests := []struct {
+		name   string
+		exts   []KV
+		status int
+	}{
+		{name: "required", exts: []KV{{"tenant", "acme"}}, status: http.StatusOK},
+		{name: "escaped", exts: []KV{{"region", "eu west&1=2"}, {"tenant", "acme%"}}, status: http.StatusOK},
+		{name: "missing", exts: []KV{{"region", "eu"}}, status: http.StatusBadRequest},
+		{name: "none", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &Transport{ContextURL: srv.URL + "/ash/context", Extensions: tt.exts}}
+			resp, err := client.Post(srv.URL+"/api/items", "application/json", strings.NewReader(`{"a":1}`))
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("Status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+// TestTransportContextRefused tests that a refused context request is
+// returned as the server's AshError.
+func TestTransportContextRefused(t *testing.T) {
+	srv := newTransportServer(t)
+	client := &http.Client{Transport: &Transport{ContextURL: srv.URL + "/ash/context", Mode: "bogus"}}
+	_, err := client.Post(srv.URL+"/api/items", "application/json", strings.NewReader(`{}`))
+	var ashErr *AshError
+	if !errors.As(err, &ashErr) || ashErr.Code != ErrModeViolation {
+		t.Errorf("Expected %s, got %v", ErrModeViolation, err)
+	}
+
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	missing := &Transport{ContextURL: notFound.URL}
+	if _, err := missing.FetchContext(context.Background(), "GET", "/api/items"); err == nil || errors.As(err, &ashErr) {
+		t.Errorf("Expected a plain error for a missing context handler, got %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package ash
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// UnicodeForm is the Unicode normalization form applied to strings during
+// canonicalization. Client and server must use the same form, so it is
+// chosen at issuance and carried by the context.
+//
+// NFC (the default) and NFD fold only canonically equivalent sequences,
+// such as a precomposed "é" and "e" with a combining accent: they are
+// lossless, and the proof covers what the user typed. NFKC and NFKD also
+// fold compatibility characters, such as fullwidth digits ("１２" to "12")
+// and ligatures ("ﬁ" to "fi"). That stops look-alike identifiers from
+// slipping past checks on the canonical form, but means one proof verifies
+// every raw body that folds to the same text: handlers must act on the
+// normalized values, never the raw bytes.
+type UnicodeForm string
+
+const (
+	// UnicodeNFC is canonical composition, the default.
+	UnicodeNFC UnicodeForm = "NFC"
+	// UnicodeNFD is canonical decomposition.
+	UnicodeNFD UnicodeForm = "NFD"
+	// UnicodeNFKC is compatibility decomposition followed by canonical
+	// composition.
+	UnicodeNFKC UnicodeForm = "NFKC"
+	// UnicodeNFKD is compatibility decomposition.
+	UnicodeNFKD UnicodeForm = "NFKD"
+)
+
+// ErrInvalidUnicodeForm is returned for an unknown UnicodeForm.
+var ErrInvalidUnicodeForm = errors.New("invalid unicode form")
+
+// orDefault returns f, or UnicodeNFC if f is empty.
+func (f UnicodeForm) orDefault() UnicodeForm {
+	if f == "" {
+		return UnicodeNFC
+	}
+	return f
+}
+
+// normForm returns the x/text form for f, which must be valid.
+func (f UnicodeForm) normForm() norm.Form {
+	switch f.orDefault() {
+	case UnicodeNFD:
+		return norm.NFD
+	case UnicodeNFKC:
+		return norm.NFKC
+	case UnicodeNFKD:
+		return norm.NFKD
+	default:
+		return norm.NFC
+	}
+}
+
+// validate checks that f is empty or a known form.
+func (f UnicodeForm) validate() error {
+	switch f {
+	case "", UnicodeNFC, UnicodeNFD, UnicodeNFKC, UnicodeNFKD:
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrInvalidUnicodeForm, string(f))
+}
+
+// CanonicalizeOption configures canonicalization.
+type CanonicalizeOption func(*canonicalizeOptions)
+
+// canonicalizeOptions holds the canonicalization settings.
+type canonicalizeOptions struct {
+	form norm.Form
+	name UnicodeForm
+	raw  pointerPatterns
+	err  error
+
+	// optional are the members left out of the canonical form; see
+	// WithOptionalFields.
+	optional []optionalField
+
+	// rejectTrailing and requireObject apply to JSON documents; see
+	// WithRejectTrailingData and WithRequireTopLevelObject.
+	rejectTrailing bool
+	requireObject  bool
+
+	// trimNewline applies to URL-encoded input; see
+	// WithTrimTrailingNewline.
+	trimNewline bool
+
+	// maxParams limits the pairs of a form; see WithMaxParams.
+	maxParams int
+
+	// decimals are the locations of decimal strings; see
+	// WithDecimalStrings.
+	decimals pointerPatterns
+}
+
+// WithUnicodeForm normalizes strings to form instead of NFC. An unknown
+// form is treated as NFC.
+func WithUnicodeForm(form UnicodeForm) CanonicalizeOption {
+	return func(o *canonicalizeOptions) {
+		if form.validate() != nil {
+			form = UnicodeNFC
+		}
+		o.form = form.normForm()
+		o.name = form.orDefault()
+	}
+}
+
+// WithRawStrings marks the JSON string values at the given JSON Pointers as
+// raw: they are kept byte for byte instead of being normalized, for base64
+// data, opaque tokens and the like. A "*" reference token matches any
+// member or array element, as in "/files/*/data". Object keys and other
+// strings are normalized as usual, and URL-encoded payloads are not
+// affected. A malformed pointer makes canonicalization fail with an error
+// wrapping ErrInvalidJSONPointer.
+func WithRawStrings(pointers ...string) CanonicalizeOption {
+	return func(o *canonicalizeOptions) {
+		raw, err := compilePointerPatterns(pointers)
+		if err != nil && o.err == nil {
+			o.err = err
+		}
+		o.raw = append(o.raw, raw...)
+	}
+}
+
+// normalizeValue normalizes the string value at pointer, unless it is raw.
+func (o *canonicalizeOptions) normalizeValue(s, pointer string) string {
+	if len(o.raw) > 0 {
+		if path, err := parsePointer(pointer); err == nil && o.raw.match(path) {
+			return s
+		}
+	}
+	return o.form.String(s)
+}
+
+// newCanonicalizeOptions applies opts over the defaults: NFC, and at most
+// DefaultMaxParams form parameters.
+func newCanonicalizeOptions(opts []CanonicalizeOption) *canonicalizeOptions {
+	o := &canonicalizeOptions{form: norm.NFC, name: UnicodeNFC, maxParams: DefaultMaxParams}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithDefaultUnicodeForm sets the UnicodeForm of issued contexts that do
+// not set one (default: UnicodeNFC).
+func WithDefaultUnicodeForm(form UnicodeForm) Option {
+	return func(a *Ash) { a.unicodeForm = form }
+}
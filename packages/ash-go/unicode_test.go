@@ -0,0 +1,161 @@
+package ash
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestUnicodeForms tests canonicalization of fullwidth, ligature and
+// accented characters under each normalization form.
+func TestUnicodeForms(t *testing.T) {
+	// "１２" is fullwidth, "ﬁ" a ligature and "é" a precomposed e-acute.
+	const jsonBody = `{"id":"１２","name":"ﬁle","city":"é"}`
+	const formBody = "id=%EF%BC%91%EF%BC%92&name=%EF%AC%81le"
+	tests := []struct {
+		form             UnicodeForm
+		json, urlEncoded string
+	}{
+		{"", `{"city":"é","id":"１２","name":"ﬁle"}`, "id=%EF%BC%91%EF%BC%92&name=%EF%AC%81le"},
+		{UnicodeNFC, `{"city":"é","id":"１２","name":"ﬁle"}`, "id=%EF%BC%91%EF%BC%92&name=%EF%AC%81le"},
+		{UnicodeNFD, "{\"city\":\"e\u0301\",\"id\":\"１２\",\"name\":\"ﬁle\"}", "id=%EF%BC%91%EF%BC%92&name=%EF%AC%81le"},
+		{UnicodeNFKC, `{"city":"é","id":"12","name":"file"}`, "id=12&name=file"},
+		{UnicodeNFKD, "{\"city\":\"e\u0301\",\"id\":\"12\",\"name\":\"file\"}", "id=12&name=file"},
+	}
+	for _, tt := range tests {
+		got, err := ParseJSON(jsonBody, WithUnicodeForm(tt.form))
+		if err != nil || got != tt.json {
+			t.Errorf("ParseJSON in %q = %q, %v; want %q", tt.form, got, err, tt.json)
+		}
+		got, err = CanonicalizeURLEncoded(formBody, WithUnicodeForm(tt.form))
+		if err != nil || got != tt.urlEncoded {
+			t.Errorf("CanonicalizeURLEncoded in %q = %q, %v; want %q", tt.form, got, err, tt.urlEncoded)
+		}
+	}
+
+	// Keys that only fold together under NFKC collide there, and the one
+	// that sorts last wins.
+	if got, err := ParseJSON(`{"ﬁ":1,"fi":2}`); err != nil || got != `{"fi":2,"ﬁ":1}` {
+		t.Errorf("Expected distinct keys under NFC, got %q, %v", got, err)
+	}
+	if got, err := ParseJSON(`{"ﬁ":1,"fi":2}`, WithUnicodeForm(UnicodeNFKC)); err != nil || got != `{"fi":1}` {
+		t.Errorf("Colliding keys under NFKC: got %q, %v", got, err)
+	}
+}
+
+// TestCanonicalizeJSONKeyCollision tests that of keys normalizing to the
+// same form, the one that sorts last keeps its value whatever the order
+// of the members, as in ash-core.
+func TestCanonicalizeJSONKeyCollision(t *testing.T) {
+	for _, input := range []string{
+		"{\"\u00e9\":2,\"e\u0301\":1}",
+		"{\"e\u0301\":1,\"\u00e9\":2}",
+	} {
+		if got, err := ParseJSON(input); err != nil || got != "{\"\u00e9\":2}" {
+			t.Errorf("ParseJSON(%q) = %q, %v", input, got, err)
+		}
+	}
+}
+
+// TestVerifyUnicodeForm tests that verification canonicalizes with the
+// context's form.
+func TestVerifyUnicodeForm(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithDefaultUnicodeForm(UnicodeNFKC))
+	body := `{"amount":"１００"}`
+	proofFor := func(ctx *Context, form UnicodeForm) string {
+		canonical, err := CanonicalizePayload([]byte(body), "application/json", WithUnicodeForm(form))
+		if err != nil {
+			t.Fatalf("CanonicalizePayload failed: %v", err)
+		}
+		return BuildProof(BuildProofInput{Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, CanonicalPayload: canonical})
+	}
+
+	for _, tt := range []struct {
+		issued, proved UnicodeForm
+		code           AshErrorCode
+	}{
+		{"", UnicodeNFKC, ""},
+		{"", UnicodeNFC, ErrIntegrityFailed},
+		{UnicodeNFC, UnicodeNFC, ""},
+	} {
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/pay", UnicodeForm: tt.issued})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		want := tt.issued
+		if want == "" {
+			want = UnicodeNFKC
+		}
+		if ctx.UnicodeForm != want || ctx.PublicInfo().UnicodeForm != want {
+			t.Errorf("Issued context has form %q, want %q", ctx.UnicodeForm, want)
+		}
+		_, err = a.Verify(ctx.ID, proofFor(ctx, tt.proved), ctx.Binding, []byte(body), "application/json")
+		var ashErr *AshError
+		if tt.code == "" && err != nil || tt.code != "" && (!errors.As(err, &ashErr) || ashErr.Code != tt.code) {
+			t.Errorf("Issued %q, proved %q: got %v, want %q", tt.issued, tt.proved, err, tt.code)
+		}
+	}
+
+	if _, err := a.IssueContext(ContextOptions{Binding: "POST /api/pay", UnicodeForm: "NFX"}); !errors.Is(err, ErrInvalidUnicodeForm) {
+		t.Errorf("Expected ErrInvalidUnicodeForm, got %v", err)
+	}
+	if _, err := New(NewMemoryStore(MemoryStoreOptions{}), WithDefaultUnicodeForm("nfc")); !errors.Is(err, ErrInvalidUnicodeForm) {
+		t.Errorf("Expected New to reject an invalid form, got %v", err)
+	}
+}
+
+// TestRawStrings tests that strings marked raw keep their bytes while
+// their neighbors are normalized.
+func TestRawStrings(t *testing.T) {
+	// Each value is "e" followed by a combining acute accent, which NFC
+	// composes to "é".
+	const body = "{\"sig\":\"e\u0301\",\"name\":\"e\u0301\",\"files\":[{\"data\":\"e\u0301\",\"type\":\"e\u0301\"}]}"
+	opts := []CanonicalizeOption{WithRawStrings("/sig", "/files/*/data")}
+	want := "{\"files\":[{\"data\":\"e\u0301\",\"type\":\"\u00e9\"}],\"name\":\"\u00e9\",\"sig\":\"e\u0301\"}"
+
+	got, err := ParseJSON(body, opts...)
+	if err != nil || got != want {
+		t.Errorf("ParseJSON = %q, %v; want %q", got, err, want)
+	}
+	var buf bytes.Buffer
+	if err := CanonicalizeJSONStream(strings.NewReader(body), &buf, opts...); err != nil || buf.String() != want {
+		t.Errorf("CanonicalizeJSONStream = %q, %v; want %q", buf.String(), err, want)
+	}
+	if got, _ := ParseJSON(body); got == want {
+		t.Error("Expected normalization without raw strings")
+	}
+
+	if _, err := ParseJSON(body, WithRawStrings("sig")); !errors.Is(err, ErrInvalidJSONPointer) {
+		t.Errorf("Expected ErrInvalidJSONPointer, got %v", err)
+	}
+	if _, err := newContext(ContextOptions{Binding: "POST /api/x", TTL: time.Second, RawStrings: []string{"/a~2"}}, time.Now()); !errors.Is(err, ErrInvalidJSONPointer) {
+		t.Errorf("Expected ErrInvalidJSONPointer from newContext, got %v", err)
+	}
+}
+
+// TestVerifyRawStrings tests that verification canonicalizes with the
+// context's raw strings.
+func TestVerifyRawStrings(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithCanonicalCache(16))
+	const body = "{\"token\":\"e\u0301\",\"note\":\"e\u0301\"}"
+	for _, raw := range [][]string{nil, {"/token"}} {
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/upload", RawStrings: raw})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		if info := ctx.PublicInfo(); len(info.RawStrings) != len(raw) {
+			t.Errorf("PublicInfo().RawStrings = %v, want %v", info.RawStrings, raw)
+		}
+		canonical, _ := CanonicalizePayload([]byte(body), "application/json", WithRawStrings(ctx.PublicInfo().RawStrings...))
+		proof := BuildProof(BuildProofInput{Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, CanonicalPayload: canonical})
+
+		if _, err := a.VerifyStream(ctx.ID, proof, ctx.Binding, strings.NewReader(body), "application/json", WithDryRun()); err != nil {
+			t.Errorf("VerifyStream with raw strings %v failed: %v", raw, err)
+		}
+		if _, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte(body), "application/json"); err != nil {
+			t.Errorf("Verify with raw strings %v failed: %v", raw, err)
+		}
+	}
+}
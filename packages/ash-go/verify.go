@@ -0,0 +1,656 @@
+package ash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"strings"
+	"time"
+)
+
+// VerifyResult describes the outcome of verifying a request.
+type VerifyResult struct {
+	// Valid reports whether verification succeeded.
+	Valid bool
+	// Code is the error code when verification failed.
+	Code AshErrorCode
+	// Message is the error message when verification failed.
+	Message string
+	// ContextID is the context ID presented by the client.
+	ContextID string
+	// Binding is the binding the request was verified against.
+	Binding string
+	// Mode is the security mode of the context.
+	Mode AshMode
+	// Tenant is the tenant of the context, if any.
+	Tenant string
+	// Metadata is the server-side metadata of the context.
+	Metadata map[string]interface{}
+	// Duration is how long verification took.
+	Duration time.Duration
+	// DryRun reports that the context was not consumed (see WithDryRun).
+	DryRun bool
+	// Duplicate reports an identical resubmission of a request already
+	// verified (see WithDuplicateWindow).
+	Duplicate bool
+	// Stage is the check verification stopped at when it failed, and
+	// StageNone when it succeeded.
+	Stage CheckStage
+	// Reason classifies a failure caused by the canonicalizer rejecting
+	// the payload, and is empty otherwise.
+	Reason CanonicalizationReason
+	// ConsumedAt is when verification consumed the context, or for a
+	// Duplicate when the original verification did if the store records
+	// it. It is zero if the context was not consumed.
+	ConsumedAt time.Time
+	// ConsumptionToken is the consumption token of the context when it
+	// was consumed (see WithConsumptionSecret).
+	ConsumptionToken string
+
+	// err is the error verification failed with, for WriteVerifyError.
+	err *AshError
+}
+
+// CheckStage identifies a group of verification checks. It is finer than
+// the error code: ErrInvalidContext, for example, comes from
+// StageContextLookup for an unknown context but from StageBindingMatch for
+// a request outside a BindingTemplate.
+type CheckStage int
+
+const (
+	// StageNone means no check failed, or verification failed outside the
+	// checks, such as while reading the request body.
+	StageNone CheckStage = iota
+	// StageHeadersPresent checks that the context ID and a well-formed
+	// proof are present.
+	StageHeadersPresent
+	// StageContextLookup looks the context up and checks that it is usable:
+	// valid for its mode and not already consumed.
+	StageContextLookup
+	// StageExpiry checks that the context has not expired.
+	StageExpiry
+	// StageBindingMatch checks the binding, tenant and extensions of the
+	// request against the context.
+	StageBindingMatch
+	// StageProofMatch canonicalizes the payload and compares the proof,
+	// including the nonce, key ID and payload length checks.
+	StageProofMatch
+	// StageConsume consumes or reserves the context and records the audit
+	// event.
+	StageConsume
+)
+
+// String returns the name of the stage, as used in the JSON encoding of
+// VerifyResult.
+func (s CheckStage) String() string {
+	switch s {
+	case StageNone:
+		return "none"
+	case StageHeadersPresent:
+		return "headers_present"
+	case StageContextLookup:
+		return "context_lookup"
+	case StageExpiry:
+		return "expiry"
+	case StageBindingMatch:
+		return "binding_match"
+	case StageProofMatch:
+		return "proof_match"
+	case StageConsume:
+		return "consume"
+	default:
+		return "unknown"
+	}
+}
+
+// VerifyResultSchemaVersion is the version of the VerifyResult JSON
+// encoding. It changes only when fields are removed or change meaning.
+const VerifyResultSchemaVersion = 1
+
+// verifyResultJSON is the JSON encoding of a VerifyResult.
+type verifyResultJSON struct {
+	Version   int                    `json:"version"`
+	Valid     bool                   `json:"valid"`
+	Code      AshErrorCode           `json:"code,omitempty"`
+	Message   string                 `json:"message,omitempty"`
+	ContextID string                 `json:"contextId,omitempty"`
+	Binding   string                 `json:"binding,omitempty"`
+	Mode      AshMode                `json:"mode,omitempty"`
+	Tenant    string                 `json:"tenant,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	DryRun    bool                   `json:"dryRun,omitempty"`
+	Duplicate bool                   `json:"duplicate,omitempty"`
+	Stage     string                 `json:"stage,omitempty"`
+	Timings   verifyTimingsJSON      `json:"timings"`
+}
+
+// verifyTimingsJSON is the timings object of verifyResultJSON.
+type verifyTimingsJSON struct {
+	TotalMicros int64 `json:"totalMicros"`
+}
+
+// MarshalJSON encodes the result as:
+//
+//	{
+//	  "version": 1,
+//	  "valid": false,
+//	  "code": "ASH_INTEGRITY_FAILED",   // omitted when valid
+//	  "message": "...",                 // omitted when valid
+//	  "contextId": "ash_...",
+//	  "binding": "POST /api/transfer",
+//	  "mode": "balanced",
+//	  "tenant": "acme",
+//	  "metadata": {...},                // omitted when empty
+//	  "dryRun": true,                   // omitted when false
+//	  "duplicate": true,                // omitted when false
+//	  "stage": "proof_match",           // omitted for StageNone
+//	  "timings": {"totalMicros": 42}
+//	}
+//
+// Empty strings are omitted. New fields may be added within a version.
+func (r *VerifyResult) MarshalJSON() ([]byte, error) {
+	var stage string
+	if r.Stage != StageNone {
+		stage = r.Stage.String()
+	}
+	return json.Marshal(verifyResultJSON{
+		Version:   VerifyResultSchemaVersion,
+		Valid:     r.Valid,
+		Code:      r.Code,
+		Message:   r.Message,
+		ContextID: r.ContextID,
+		Binding:   r.Binding,
+		Mode:      r.Mode,
+		Tenant:    r.Tenant,
+		Metadata:  r.Metadata,
+		DryRun:    r.DryRun,
+		Duplicate: r.Duplicate,
+		Stage:     stage,
+		Timings:   verifyTimingsJSON{TotalMicros: r.Duration.Microseconds()},
+	})
+}
+
+// VerifyOption supplies per-request verification inputs.
+type VerifyOption func(*verifyOptions)
+
+// verifyOptions holds the per-request verification inputs.
+type verifyOptions struct {
+	extensions []KV
+	dryRun     bool
+	tenant     string
+	// sessionSalt is the salt of the request's session (see
+	// WithSessionSalt).
+	sessionSalt []byte
+
+	// declaredLength is the canonical payload length the client declared,
+	// if lengthDeclared.
+	declaredLength int
+	lengthDeclared bool
+	// declaredMode is the mode the client declared, if any.
+	declaredMode AshMode
+	// trustedCanonical verifies a buffered payload as its own canonical
+	// form (see WithTrustedCanonicalHints).
+	trustedCanonical bool
+
+	// bufferLimit is the size up to which VerifyStreaming verifies a body
+	// before returning it, if bufferLimitSet.
+	bufferLimit    int64
+	bufferLimitSet bool
+
+	// reservation, when set, receives the token of a reservation held for
+	// reserveTTL in place of consumption.
+	reservation *string
+	reserveTTL  time.Duration
+}
+
+// WithTenant supplies the tenant the request is for. A context issued to
+// a different tenant, or to a tenant when none is given (and vice versa),
+// fails verification with ErrTenantMismatch.
+func WithTenant(tenant string) VerifyOption {
+	return func(o *verifyOptions) { o.tenant = tenant }
+}
+
+// WithExtensions supplies the extension values the client bound into its
+// proof. Bindings whose policy requires extensions fail verification when
+// any required key is absent.
+func WithExtensions(exts ...KV) VerifyOption {
+	return func(o *verifyOptions) { o.extensions = append(o.extensions, exts...) }
+}
+
+// WithDeclaredLength supplies the canonical payload length the client
+// declared it signed. It only improves diagnostics: for a context with
+// IncludeLength, a different actual length fails with a "length mismatch"
+// message instead of a generic proof failure.
+func WithDeclaredLength(n int) VerifyOption {
+	return func(o *verifyOptions) { o.declaredLength, o.lengthDeclared = n, true }
+}
+
+// Verification failures with a fixed message share one AshError each (see
+// errContextNotFound).
+var (
+	errMissingContextID = NewAshError(ErrMissingHeaders, "missing context ID")
+	errMissingProof     = NewAshError(ErrMissingHeaders, "missing proof")
+	errProofNoKeyID     = NewAshError(ErrMalformedProof, "proof has no key ID")
+	errProofLength      = NewAshError(ErrMalformedProof, "proof has the wrong length")
+	errTenantMismatch   = NewAshError(ErrTenantMismatch, "tenant mismatch")
+	errSessionMismatch  = NewAshError(ErrIntegrityFailed, "session mismatch")
+	errUnknownKeyID     = NewAshError(ErrIntegrityFailed, "unknown key ID")
+	errProofMismatch    = NewAshError(ErrIntegrityFailed, "proof verification failed")
+	errInternal         = NewAshError(ErrInternalError, "internal error")
+)
+
+// WithDeclaredMode supplies the mode the client declared it built its
+// proof with. A mode other than the context's fails with ErrModeViolation
+// before the proof is compared, so that a client using the wrong mode
+// learns why. The proof is always checked under the context's mode.
+func WithDeclaredMode(mode AshMode) VerifyOption {
+	return func(o *verifyOptions) { o.declaredMode = mode }
+}
+
+// checkProofFormat checks that proof is shaped like a BuildProof proof in
+// encoding enc, or a BuildKeyedProof proof if keyed, without comparing it to
+// anything. It returns an ErrMalformedProof AshError otherwise.
+func checkProofFormat(proof string, keyed bool, enc ProofEncoding) error {
+	mac := proof
+	if keyed {
+		keyID, rest, ok := strings.Cut(proof, keyIDSeparator)
+		if !ok || keyID == "" {
+			return errProofNoKeyID
+		}
+		mac = rest
+	}
+	if enc == ProofBase64Std && len(mac) == enc.proofLen()+1 {
+		mac = strings.TrimSuffix(mac, "=")
+	}
+	if len(mac) != enc.proofLen() {
+		return errProofLength
+	}
+	for i := 0; i < len(mac); i++ {
+		if !enc.isChar(mac[i]) {
+			return NewAshError(ErrMalformedProof, "proof is not "+enc.String())
+		}
+	}
+	return nil
+}
+
+// WithDryRun checks the request without consuming the context, so the
+// same proof still verifies afterwards. It never produces an audit event.
+func WithDryRun() VerifyOption {
+	return func(o *verifyOptions) { o.dryRun = true }
+}
+
+// CanonicalizePayload canonicalizes a request body according to its
+// content type with the built-in canonicalizers. A nil or empty body
+// canonicalizes to CanonicalEmptyBody, whatever the content type; the JSON
+// bodies {} and [] do not.
+func CanonicalizePayload(body []byte, contentType string, opts ...CanonicalizeOption) (string, error) {
+	return defaultCanonicalizers.canonicalize(body, contentType, opts)
+}
+
+// errInvalidContentType is returned for a Content-Type that cannot be
+// parsed.
+var errInvalidContentType = NewAshError(ErrUnsupportedContentType, "invalid content type")
+
+// payloadMediaType returns the media type of a non-empty body, or an
+// ErrUnsupportedContentType AshError if it cannot be canonicalized.
+func payloadMediaType(contentType string) (SupportedContentType, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", errInvalidContentType
+	}
+	switch SupportedContentType(mediaType) {
+	case ContentTypeJSON, ContentTypeURLEncoded, ContentTypeMultipartForm:
+		return SupportedContentType(mediaType), nil
+	default:
+		return "", NewAshError(ErrUnsupportedContentType, "unsupported content type: "+mediaType)
+	}
+}
+
+// Verify verifies a proof over payload against the stored context and
+// consumes the context on success, unless it is multi-use.
+//
+// binding is the request's concrete binding. When the context was issued
+// for a BindingTemplate or a binding pattern, binding must match it (and a
+// template's pinned parameters), and the proof covers the concrete binding.
+//
+// On failure the returned result carries the error code and the error is
+// the corresponding *AshError.
+func (a *Ash) Verify(contextID, proof, binding string, payload []byte, contentType string, opts ...VerifyOption) (*VerifyResult, error) {
+	var o verifyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	start := time.Now()
+	result, err := a.verify(contextID, proof, binding, bufferedPayload(payload), contentType, &o)
+	result.Duration = time.Since(start)
+	a.recordVerify(result)
+	return result, err
+}
+
+// VerifyStream is Verify for a body read from r, for gateways handling
+// large uploads. A JSON body is canonicalized by CanonicalizeJSONStream
+// straight into the proof hash, so neither the body nor its canonical form
+// is buffered in full (within the limits described there); other bodies
+// are read in full. The outcome is the same as Verify on the same bytes.
+//
+// r is read only once the context checks pass, and a JSON body only up to
+// the end of its value. Callers should limit its size, for example with
+// http.MaxBytesReader. The canonical cache is not used.
+func (a *Ash) VerifyStream(contextID, proof, binding string, r io.Reader, contentType string, opts ...VerifyOption) (*VerifyResult, error) {
+	var o verifyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	start := time.Now()
+	result, err := a.verify(contextID, proof, binding, streamPayload{r}, contentType, &o)
+	result.Duration = time.Since(start)
+	a.recordVerify(result)
+	return result, err
+}
+
+// verify implements Verify and VerifyStream without instrumentation.
+func (a *Ash) verify(contextID, proof, binding string, payload verifyPayload, contentType string, o *verifyOptions) (*VerifyResult, error) {
+	result := &VerifyResult{ContextID: contextID, Binding: binding, DryRun: o.dryRun}
+	if p, ok := payload.(bufferedPayload); ok && o.trustedCanonical {
+		payload = trustedCanonicalPayload(p)
+	}
+
+	if contextID == "" {
+		return result.failAt(StageHeadersPresent, errMissingContextID)
+	}
+	if proof == "" {
+		return result.failAt(StageHeadersPresent, errMissingProof)
+	}
+	if err := checkProofFormat(proof, a.keyRing != nil, a.proofEncoding); err != nil {
+		return result.failAt(StageHeadersPresent, err)
+	}
+
+	ctx, err := a.store.Get(contextID)
+	if err != nil {
+		return result.failAt(StageContextLookup, err)
+	}
+	result.Mode = ctx.Mode
+	result.Tenant = ctx.Tenant
+	result.Metadata = ctx.Metadata
+	req, err := checkContext(ctx)
+	if err != nil {
+		return result.failAt(StageContextLookup, err)
+	}
+
+	// A consumed context is a replay even past its expiry, for as long as
+	// the store retains it (see ConsumedRetention), or as this instance
+	// remembers consuming it (see WithConsumedCache).
+	if ctx.Used || a.locallyConsumed(ctx) {
+		if a.duplicates == nil || !a.duplicates.seen(ctx.ID, proof, a.now()) {
+			return result.failAt(StageContextLookup, errContextUsed)
+		}
+		// Verify the resubmission in full, but do not consume again.
+		result.Duplicate = true
+	}
+	now := a.checkClock()
+	if err := a.checkIssuedAt(ctx, now); err != nil {
+		return result.failAt(StageExpiry, err)
+	}
+	if ctx.expired(now) {
+		return result.failAt(StageExpiry, errContextExpired)
+	}
+	// The request is matched against the context's binding, which may be
+	// a template or pattern covering many requests, but the proof always
+	// covers the request's concrete binding, so that a proof for one path
+	// does not verify on another.
+	if err := matchBinding(ctx, binding); err != nil {
+		return result.failAt(StageBindingMatch, err)
+	}
+	if !TimingSafeCompare(ctx.Tenant, o.tenant) {
+		return result.failAt(StageBindingMatch, errTenantMismatch)
+	}
+	if o.declaredMode != "" && o.declaredMode != ctx.Mode {
+		return result.failAt(StageBindingMatch, NewAshError(ErrModeViolation,
+			fmt.Sprintf("mode mismatch: context is %s, proof declares %s", ctx.Mode, o.declaredMode)))
+	}
+
+	if err := validateExtensions(o.extensions); err != nil {
+		return result.failAt(StageBindingMatch, err)
+	}
+	if err := checkReservedExtensions(o.extensions); err != nil {
+		return result.failAt(StageBindingMatch, err)
+	}
+	if err := a.checkPolicies(ctx, binding, o.extensions); err != nil {
+		return result.failAt(StageBindingMatch, err)
+	}
+
+	// Bound metadata comes from the store, never from the request.
+	if ctx.ProofMetadata != "" {
+		if err := a.checkProofMetadata(ctx); err != nil {
+			return result.failAt(StageProofMatch, err)
+		}
+	}
+	// The session key comes from the request's session, never from the
+	// store, so that a context only verifies in the session it was issued
+	// to.
+	var session string
+	if ctx.SessionKey != "" {
+		if session = sessionKey(o.sessionSalt, ctx.ID); session == "" {
+			return result.failAt(StageProofMatch, errSessionMismatch)
+		}
+	}
+	input := BuildProofInput{
+		Mode:       ctx.Mode,
+		Binding:    binding,
+		ContextID:  ctx.ID,
+		Nonce:      ctx.Nonce,
+		Tenant:     ctx.Tenant,
+		SessionKey: session,
+		Metadata:   ctx.ProofMetadata,
+		Extensions: decimalStringsExtensions(o.extensions, ctx),
+	}
+	h, mac, keyErr := a.proofHash(proof)
+	if p, ok := payload.(streamPayload); ok && a.verifyLimiter != nil {
+		payload = streamPayload{slotReader{p.r, a.verifyLimiter}}
+	}
+	var empty bool
+	var lengthErr, hashErr error
+	if err := a.verifyLimiter.run(func() {
+		empty, lengthErr, hashErr = a.hashPayload(h, input, payload, contentType, ctx, o)
+	}); err != nil {
+		return result.fail(err)
+	}
+	if hashErr != nil {
+		return result.failAt(StageProofMatch, hashErr)
+	}
+	if keyErr != nil {
+		return result.failAt(StageProofMatch, keyErr)
+	}
+	// The proof is compared in full even when the lengths already differ.
+	if match := TimingSafeCompare(a.proofEncoding.Encode(h.Sum(nil)), a.proofEncoding.normalize(mac)); !match || lengthErr != nil {
+		if a.debugResponses {
+			if canonical, ok := a.emittedPayload(payload, contentType, ctx); ok {
+				a.logger.Debug("ash: proof mismatch", "contextId", contextID, "binding", binding, "canonical", canonical)
+			}
+		}
+		if lengthErr != nil {
+			return result.failAt(StageProofMatch, lengthErr)
+		}
+		if err := a.emptyBodyMismatch(proof, input, ctx, empty); err != nil {
+			return result.failAt(StageProofMatch, err)
+		}
+		return result.failAt(StageProofMatch, errProofMismatch)
+	}
+
+	// The validator only sees requests that proved the context, so it
+	// cannot be probed or loaded with guessed proofs.
+	if ctx.Nonce != "" && a.nonceValidator != nil {
+		if err := a.nonceValidator.ValidateNonce(ctx); err != nil {
+			var ashErr *AshError
+			if !errors.As(err, &ashErr) {
+				a.logger.Warn("ash: nonce rejected", "contextId", contextID, "error", err)
+				err = NewAshError(ErrIntegrityFailed, "nonce rejected")
+			}
+			return result.failAt(StageProofMatch, err)
+		}
+	}
+
+	if o.dryRun {
+		result.Valid = true
+		return result, nil
+	}
+	if result.Duplicate {
+		if ctx.ConsumedAt != 0 {
+			a.consumed(result, time.UnixMilli(ctx.ConsumedAt))
+		}
+		result.Valid = true
+		return result, nil
+	}
+	if req.MultiUse || ctx.MultiUse {
+		if err := a.audit(ctx, payload, contentType); err != nil {
+			return result.failAt(StageConsume, err)
+		}
+		result.Valid = true
+		return result, nil
+	}
+	if o.reservation != nil {
+		store := a.store.(ReservingStore)
+		token, err := store.Reserve(ctx.ID, o.reserveTTL)
+		if err != nil {
+			return result.failAt(StageConsume, err)
+		}
+		if err := a.audit(ctx, payload, contentType); err != nil {
+			store.Release(ctx.ID, token)
+			return result.failAt(StageConsume, err)
+		}
+		*o.reservation = token
+		result.Valid = true
+		return result, nil
+	}
+	if err := a.store.Consume(ctx.ID); err != nil {
+		return result.failAt(StageConsume, err)
+	}
+	a.rememberConsumed(ctx.ID)
+	if err := a.audit(ctx, payload, contentType); err != nil {
+		return result.failAt(StageConsume, err)
+	}
+	if a.duplicates != nil {
+		a.duplicates.add(ctx.ID, proof, a.now())
+	}
+
+	a.consumed(result, a.now())
+	result.Valid = true
+	return result, nil
+}
+
+// hashPayload writes the proof preimage of input, completed with the
+// canonical form of payload, to h. empty reports that the canonical form
+// is CanonicalEmptyBody, and lengthErr a canonical length other than the
+// one the client declared.
+func (a *Ash) hashPayload(h hash.Hash, input BuildProofInput, payload verifyPayload, contentType string, ctx *Context, o *verifyOptions) (empty bool, lengthErr, err error) {
+	if !ctx.IncludeLength {
+		var preamble strings.Builder
+		writePreamble(&preamble, input)
+		io.WriteString(h, preamble.String())
+		w := &writeCounter{w: h}
+		err := payload.writeCanonical(a, w, contentType, ctx)
+		return w.n == 0, nil, err
+	}
+	// The length precedes the payload in the preimage, so the canonical
+	// form is built in full first, even by VerifyStream.
+	var canonical strings.Builder
+	if err := payload.writeCanonical(a, &canonical, contentType, ctx); err != nil {
+		return false, nil, err
+	}
+	input.IncludeLength = true
+	input.CanonicalPayload = canonical.String()
+	io.WriteString(h, proofPreimage(input))
+	if o.lengthDeclared && o.declaredLength != len(input.CanonicalPayload) {
+		lengthErr = NewAshError(ErrIntegrityFailed,
+			fmt.Sprintf("length mismatch: expected %d got %d", o.declaredLength, len(input.CanonicalPayload)))
+	}
+	return canonical.Len() == 0, lengthErr, nil
+}
+
+// proofHash returns the hash a proof is checked against, fed with the
+// proof preimage, and the encoded MAC within the proof: HMAC-SHA256 under
+// the key named by the proof with a key ring, SHA-256 otherwise. For an
+// unknown key ID it also returns an ErrIntegrityFailed AshError, with a
+// hash that is still usable so the payload is checked first.
+func (a *Ash) proofHash(proof string) (hash.Hash, string, error) {
+	if a.keyRing == nil {
+		return sha256.New(), proof, nil
+	}
+	keyID, mac, _ := strings.Cut(proof, keyIDSeparator)
+	secret, ok := a.keyRing.keys[keyID]
+	if !ok {
+		return sha256.New(), mac, errUnknownKeyID
+	}
+	return hmac.New(sha256.New, secret), mac, nil
+}
+
+// verifyPayload is the body of a request being verified.
+type verifyPayload interface {
+	// writeCanonical writes the canonical form of the body, as
+	// canonicalized for ctx, to w.
+	writeCanonical(a *Ash, w io.Writer, contentType string, ctx *Context) error
+	// canonical returns the canonical form of the body, if it is still
+	// available.
+	canonical(a *Ash, contentType string, ctx *Context) (string, bool)
+}
+
+// emittedPayload returns the canonical form of payload as it may be
+// emitted outside verification, redacted by the configured Redactor.
+func (a *Ash) emittedPayload(payload verifyPayload, contentType string, ctx *Context) (string, bool) {
+	canonical, ok := payload.canonical(a, contentType, ctx)
+	if !ok {
+		return "", false
+	}
+	return a.redactor.RedactPayload(canonical, contentType), true
+}
+
+// bufferedPayload is a body held in memory, canonicalized through the
+// canonical cache.
+type bufferedPayload []byte
+
+func (p bufferedPayload) writeCanonical(a *Ash, w io.Writer, contentType string, ctx *Context) error {
+	if ctx.RawBody {
+		_, err := w.Write(p)
+		return err
+	}
+	canonical, err := a.canonicalize(p, contentType, ctx)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, canonical)
+	return err
+}
+
+func (p bufferedPayload) canonical(a *Ash, contentType string, ctx *Context) (string, bool) {
+	if ctx.RawBody {
+		return string(p), true
+	}
+	canonical, err := a.canonicalize(p, contentType, ctx)
+	return canonical, err == nil
+}
+
+// failAt records err on the result as a failure of stage.
+func (r *VerifyResult) failAt(stage CheckStage, err error) (*VerifyResult, error) {
+	r.Stage = stage
+	return r.fail(err)
+}
+
+// fail records err on the result. Errors that are not AshErrors (such as
+// store failures) are reported as internal errors without their details.
+func (r *VerifyResult) fail(err error) (*VerifyResult, error) {
+	ashErr, ok := asAshError(err)
+	if !ok {
+		ashErr = errInternal
+	}
+	r.Valid = false
+	r.Code = ashErr.Code
+	r.Message = ashErr.Message
+	r.Reason = ashErr.Reason
+	r.err = ashErr
+	return r, ashErr
+}
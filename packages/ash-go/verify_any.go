@@ -0,0 +1,81 @@
+package ash
+
+import "time"
+
+// MaxCandidateBindings is the most bindings VerifyAnyBinding accepts.
+const MaxCandidateBindings = 4
+
+var (
+	errNoCandidateBindings      = NewAshError(ErrMalformedRequest, "no candidate bindings")
+	errTooManyCandidateBindings = NewAshError(ErrMalformedRequest, "too many candidate bindings")
+)
+
+// VerifyAnyBinding is Verify for a request whose concrete binding is not
+// known exactly, such as behind a router that cannot report the matched
+// route. It succeeds if the proof verifies for any of bindings, tried in
+// order, and consumes the context only then. The result's Binding is the
+// binding that verified.
+//
+// Each candidate is checked without consuming the context, then the one
+// that matched is verified again for real, so the payload is canonicalized
+// more than once unless the canonical cache is enabled, and a
+// NonceValidator is consulted for each check. At most
+// MaxCandidateBindings are accepted, as every candidate costs a proof
+// computation. If none verifies, the failure that got furthest through the
+// checks is returned.
+func (a *Ash) VerifyAnyBinding(contextID, proof string, bindings []string, payload []byte, contentType string, opts ...VerifyOption) (*VerifyResult, error) {
+	var o verifyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	start := time.Now()
+	result, err := a.verifyAnyBinding(contextID, proof, bindings, payload, contentType, &o)
+	result.Duration = time.Since(start)
+	a.recordVerify(result)
+	return result, err
+}
+
+func (a *Ash) verifyAnyBinding(contextID, proof string, bindings []string, payload []byte, contentType string, o *verifyOptions) (*VerifyResult, error) {
+	if len(bindings) == 0 {
+		result := &VerifyResult{ContextID: contextID, DryRun: o.dryRun}
+		return result.failAt(StageHeadersPresent, errNoCandidateBindings)
+	}
+	if len(bindings) > MaxCandidateBindings {
+		result := &VerifyResult{ContextID: contextID, DryRun: o.dryRun}
+		return result.failAt(StageHeadersPresent, errTooManyCandidateBindings)
+	}
+
+	dryRun := *o
+	dryRun.dryRun = true
+	var best *VerifyResult
+	var bestErr error
+	for i, binding := range bindings {
+		if containsString(bindings[:i], binding) {
+			continue
+		}
+		result, err := a.verify(contextID, proof, binding, bufferedPayload(payload), contentType, &dryRun)
+		if err == nil {
+			return a.verify(contextID, proof, binding, bufferedPayload(payload), contentType, o)
+		}
+		if best == nil || result.Stage > best.Stage {
+			best, bestErr = result, err
+		}
+		// Checks before the binding match do not depend on the binding,
+		// so the other candidates would fail the same way.
+		if result.Stage < StageBindingMatch {
+			break
+		}
+	}
+	best.DryRun = o.dryRun
+	return best, bestErr
+}
+
+// containsString reports whether s is in list.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package ash
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestVerifyAnyBinding tests verification against candidate bindings.
+func TestVerifyAnyBinding(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, store := newTestAsh(t, now)
+	body := `{"a":1}`
+
+	issue := func(binding string) (*Context, string) {
+		t.Helper()
+		ctx, err := a.IssueContext(ContextOptions{Binding: binding})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		return ctx, clientProof(t, ctx, body, "application/json")
+	}
+
+	t.Run("matching candidate", func(t *testing.T) {
+		ctx, proof := issue("POST /api/orders")
+		bindings := []string{"POST /api/orders/", "POST /api/orders/", "POST /api/orders"}
+		result, err := a.VerifyAnyBinding(ctx.ID, proof, bindings, []byte(body), "application/json")
+		if err != nil {
+			t.Fatalf("VerifyAnyBinding failed: %v", err)
+		}
+		if result.Binding != "POST /api/orders" || !result.Valid {
+			t.Errorf("result = %+v, want valid for POST /api/orders", result)
+		}
+		if stored, _ := store.Get(ctx.ID); stored == nil || !stored.Used {
+			t.Errorf("Context not consumed")
+		}
+		_, err = a.VerifyAnyBinding(ctx.ID, proof, bindings, []byte(body), "application/json")
+		if !errors.Is(err, ErrReplayDetected) {
+			t.Errorf("Expected %s on replay, got %v", ErrReplayDetected, err)
+		}
+	})
+
+	t.Run("no matching candidate", func(t *testing.T) {
+		ctx, proof := issue("POST /api/orders")
+		result, err := a.VerifyAnyBinding(ctx.ID, proof, []string{"POST /api/order", "PUT /api/orders"}, []byte(body), "application/json")
+		if !errors.Is(err, ErrEndpointMismatch) || result.Stage != StageBindingMatch {
+			t.Errorf("Expected %s at binding match, got %v at %s", ErrEndpointMismatch, err, result.Stage)
+		}
+		if stored, _ := store.Get(ctx.ID); stored == nil || stored.Used {
+			t.Errorf("Context consumed by a failed verification")
+		}
+	})
+
+	t.Run("furthest failure", func(t *testing.T) {
+		// The proof covers the concrete binding the client signed, so a
+		// candidate within the pattern that is not that binding fails at
+		// the proof match, which is reported over the binding mismatch.
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/orders/*"})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		canonical, _ := CanonicalizePayload([]byte(body), "application/json")
+		proof := BuildProof(BuildProofInput{
+			Mode:             ctx.Mode,
+			Binding:          "POST /api/orders/42",
+			ContextID:        ctx.ID,
+			Nonce:            ctx.Nonce,
+			CanonicalPayload: canonical,
+		})
+		result, err := a.VerifyAnyBinding(ctx.ID, proof, []string{"POST /api/items/42", "POST /api/orders/43"}, []byte(body), "application/json")
+		if !errors.Is(err, ErrIntegrityFailed) || result.Binding != "POST /api/orders/43" {
+			t.Errorf("Expected %s for POST /api/orders/43, got %v for %s", ErrIntegrityFailed, err, result.Binding)
+		}
+		result, err = a.VerifyAnyBinding(ctx.ID, proof, []string{"POST /api/orders/43", "POST /api/orders/42"}, []byte(body), "application/json")
+		if err != nil || result.Binding != "POST /api/orders/42" {
+			t.Errorf("VerifyAnyBinding = %s, %v; want POST /api/orders/42", result.Binding, err)
+		}
+	})
+
+	t.Run("candidate limits", func(t *testing.T) {
+		ctx, proof := issue("POST /api/orders")
+		tooMany := make([]string, MaxCandidateBindings+1)
+		for i := range tooMany {
+			tooMany[i] = "POST /api/orders"
+		}
+		for _, bindings := range [][]string{nil, tooMany} {
+			result, err := a.VerifyAnyBinding(ctx.ID, proof, bindings, []byte(body), "application/json")
+			if !errors.Is(err, ErrMalformedRequest) || result.Stage != StageHeadersPresent {
+				t.Errorf("Expected %s for %d candidates, got %v", ErrMalformedRequest, len(bindings), err)
+			}
+		}
+	})
+
+	t.Run("unknown context", func(t *testing.T) {
+		_, proof := issue("POST /api/orders")
+		result, err := a.VerifyAnyBinding("ash_unknown", proof, []string{"POST /a", "POST /b"}, []byte(body), "application/json")
+		if !errors.Is(err, ErrInvalidContext) || result.Stage != StageContextLookup {
+			t.Errorf("Expected %s at context lookup, got %v", ErrInvalidContext, err)
+		}
+	})
+}
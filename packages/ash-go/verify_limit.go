@@ -0,0 +1,124 @@
+package ash
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// errOverloaded is returned when no verification slot frees up in time.
+var errOverloaded = NewAshError(ErrOverloaded, "too many concurrent verifications")
+
+// WithVerifyConcurrency caps the number of verifications canonicalizing
+// and hashing a payload at once (default: unlimited), so that a burst of
+// large payloads cannot take every CPU of a shared host. A verification
+// waits up to wait for a slot, then fails with ErrOverloaded (503); with a
+// zero wait it fails as soon as every slot is taken. The context checks
+// before canonicalization and the consumption after it are not limited.
+// A streamed body (VerifyStream, VerifyStreaming) gives its slot back
+// while its reader blocks and waits for one again, without a time limit,
+// once the read returns, so a slow client does not keep a slot while it
+// sends the body. A max of zero or less leaves verification unlimited.
+func WithVerifyConcurrency(max int, wait time.Duration) Option {
+	return func(a *Ash) {
+		if max > 0 {
+			a.verifyLimiter = &verifyLimiter{slots: make(chan struct{}, max), wait: wait}
+		} else {
+			a.verifyLimiter = nil
+		}
+	}
+}
+
+// VerifyLimiterStats reports the use of the WithVerifyConcurrency limit.
+type VerifyLimiterStats struct {
+	// Max is the number of slots, or 0 when verification is unlimited.
+	Max int
+	// InFlight is the number of verifications holding a slot.
+	InFlight int
+	// Waiting is the number of verifications queued for a slot.
+	Waiting int64
+	// Rejected counts the verifications that failed with ErrOverloaded.
+	Rejected int64
+}
+
+// VerifyLimiterStats returns the verification limit counters, which are
+// zero when WithVerifyConcurrency is not enabled.
+func (a *Ash) VerifyLimiterStats() VerifyLimiterStats {
+	l := a.verifyLimiter
+	if l == nil {
+		return VerifyLimiterStats{}
+	}
+	return VerifyLimiterStats{
+		Max:      cap(l.slots),
+		InFlight: len(l.slots),
+		Waiting:  l.waiting.Load(),
+		Rejected: l.rejected.Load(),
+	}
+}
+
+// verifyLimiter is a semaphore over canonicalization and hashing.
+type verifyLimiter struct {
+	slots chan struct{}
+	wait  time.Duration
+
+	waiting  atomic.Int64
+	rejected atomic.Int64
+}
+
+// acquire takes a slot, waiting up to l.wait, and returns errOverloaded if
+// none frees up. A nil limiter always succeeds.
+func (l *verifyLimiter) acquire() error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if l.wait > 0 {
+		l.waiting.Add(1)
+		defer l.waiting.Add(-1)
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+			return nil
+		case <-timer.C:
+		}
+	}
+	l.rejected.Add(1)
+	return errOverloaded
+}
+
+// release returns a slot taken by acquire.
+func (l *verifyLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// run calls fn holding a slot, and returns errOverloaded without calling
+// it if none frees up. The slot is returned even if fn panics.
+func (l *verifyLimiter) run(fn func()) error {
+	if err := l.acquire(); err != nil {
+		return err
+	}
+	defer l.release()
+	fn()
+	return nil
+}
+
+// slotReader reads a streamed body without holding the verification slot
+// while the underlying reader blocks. It must only be read from within
+// verifyLimiter.run.
+type slotReader struct {
+	r io.Reader
+	l *verifyLimiter
+}
+
+func (s slotReader) Read(p []byte) (int, error) {
+	s.l.release()
+	defer func() { s.l.slots <- struct{}{} }()
+	return s.r.Read(p)
+}
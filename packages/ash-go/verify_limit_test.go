@@ -0,0 +1,238 @@
+package ash
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedReader is a slow body: its first Read signals started and then
+// blocks until release is closed.
+type gatedReader struct {
+	r       io.Reader
+	started chan struct{}
+	release chan struct{}
+	once    bool
+}
+
+func newGatedReader(body string) *gatedReader {
+	return &gatedReader{r: strings.NewReader(body), started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	if !g.once {
+		g.once = true
+		close(g.started)
+		<-g.release
+	}
+	return g.r.Read(p)
+}
+
+// gatedCanonicalizer canonicalizes "application/x-gated" bodies as they
+// are, but blocks on the gate registered for a body until it is released,
+// standing in for slow canonicalization.
+type gatedCanonicalizer struct {
+	gates sync.Map
+}
+
+func (*gatedCanonicalizer) ContentTypes() []string { return []string{"application/x-gated"} }
+
+func (c *gatedCanonicalizer) Canonicalize(body []byte, _ map[string]string) (string, error) {
+	if g, ok := c.gates.Load(string(body)); ok {
+		g := g.(*gatedReader)
+		close(g.started)
+		<-g.release
+	}
+	return string(body), nil
+}
+
+// startSlowVerify starts a verification whose canonicalization blocks
+// until the returned gate is released, and waits for it to hold a slot.
+func startSlowVerify(t *testing.T, a *Ash, c *gatedCanonicalizer) (*gatedReader, <-chan error) {
+	t.Helper()
+	ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/upload"})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	body := ctx.ID
+	proof := BuildProof(BuildProofInput{Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, CanonicalPayload: body})
+	gate := newGatedReader(body)
+	c.gates.Store(body, gate)
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte(body), "application/x-gated")
+		done <- err
+	}()
+	<-gate.started
+	return gate, done
+}
+
+// TestVerifyConcurrencyQueue tests that verifications over the limit wait
+// for a slot and then succeed.
+func TestVerifyConcurrencyQueue(t *testing.T) {
+	c := &gatedCanonicalizer{}
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithCanonicalizer(c), WithVerifyConcurrency(2, 10*time.Second))
+	first, firstDone := startSlowVerify(t, a, c)
+	second, secondDone := startSlowVerify(t, a, c)
+	if stats := a.VerifyLimiterStats(); stats.Max != 2 || stats.InFlight != 2 {
+		t.Fatalf("Stats with two slow verifications = %+v", stats)
+	}
+
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+	body := `{"amount":10}`
+	proof := clientProof(t, ctx, body, "application/json")
+	queued := make(chan error, 1)
+	go func() {
+		_, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte(body), "application/json")
+		queued <- err
+	}()
+	for deadline := time.Now().Add(5 * time.Second); a.VerifyLimiterStats().Waiting != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Verification was not queued: %+v", a.VerifyLimiterStats())
+		}
+	}
+	select {
+	case err := <-queued:
+		t.Fatalf("Verification over the limit finished while slots were taken: %v", err)
+	default:
+	}
+
+	close(first.release)
+	if err := <-firstDone; err != nil {
+		t.Errorf("Slow verification failed: %v", err)
+	}
+	if err := <-queued; err != nil {
+		t.Errorf("Queued verification failed: %v", err)
+	}
+	close(second.release)
+	if err := <-secondDone; err != nil {
+		t.Errorf("Slow verification failed: %v", err)
+	}
+	if stats := a.VerifyLimiterStats(); stats.InFlight != 0 || stats.Waiting != 0 || stats.Rejected != 0 {
+		t.Errorf("Stats after the burst = %+v", stats)
+	}
+}
+
+// TestVerifyConcurrencyTimeout tests that a verification that finds no
+// free slot in time fails with ErrOverloaded without consuming its
+// context, and that the middleware answers it with 503.
+func TestVerifyConcurrencyTimeout(t *testing.T) {
+	c := &gatedCanonicalizer{}
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithCanonicalizer(c), WithVerifyConcurrency(1, 20*time.Millisecond))
+	gate, done := startSlowVerify(t, a, c)
+
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+	body := `{"amount":10}`
+	proof := clientProof(t, ctx, body, "application/json")
+	start := time.Now()
+	result, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte(body), "application/json")
+	if !errors.Is(err, ErrOverloaded) || result.Valid || result.Stage != StageNone {
+		t.Fatalf("Verify = %+v, %v; want %s", result, err, ErrOverloaded)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Verify gave up after %v, before the wait", elapsed)
+	}
+
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, signedRequest(t, a, "POST", "/api/transfer", body, "application/json"))
+	if rec.Code != http.StatusServiceUnavailable || decodeError(t, rec).Code != ErrOverloaded {
+		t.Errorf("Middleware status = %d, want 503: %s", rec.Code, rec.Body)
+	}
+	if stats := a.VerifyLimiterStats(); stats.Rejected != 2 {
+		t.Errorf("Rejected = %d, want 2", stats.Rejected)
+	}
+
+	close(gate.release)
+	if err := <-done; err != nil {
+		t.Errorf("Slow verification failed: %v", err)
+	}
+	if _, err := a.Verify(ctx.ID, proof, ctx.Binding, []byte(body), "application/json"); err != nil {
+		t.Errorf("Retry after overload failed: %v", err)
+	}
+}
+
+// TestVerifyConcurrencyUnlimited tests that the limit is off by default.
+func TestVerifyConcurrencyUnlimited(t *testing.T) {
+	c := &gatedCanonicalizer{}
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithCanonicalizer(c), WithVerifyConcurrency(0, time.Second))
+	gate, done := startSlowVerify(t, a, c)
+	defer func() {
+		close(gate.release)
+		<-done
+	}()
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+	body := `{"amount":10}`
+	if _, err := a.Verify(ctx.ID, clientProof(t, ctx, body, "application/json"), ctx.Binding, []byte(body), "application/json"); err != nil {
+		t.Errorf("Verify failed: %v", err)
+	}
+	if stats := a.VerifyLimiterStats(); stats != (VerifyLimiterStats{}) {
+		t.Errorf("Stats = %+v, want zero", stats)
+	}
+}
+
+// panicCanonicalizer panics on every body.
+type panicCanonicalizer struct{}
+
+func (panicCanonicalizer) ContentTypes() []string { return []string{"application/x-panic"} }
+
+func (panicCanonicalizer) Canonicalize([]byte, map[string]string) (string, error) {
+	panic("canonicalizer bug")
+}
+
+// TestVerifyConcurrencyPanic tests that a verification panicking while it
+// holds a slot gives the slot back.
+func TestVerifyConcurrencyPanic(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithCanonicalizer(panicCanonicalizer{}), WithVerifyConcurrency(1, 0))
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/upload"})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Verify did not panic")
+			}
+		}()
+		proof := BuildProof(BuildProofInput{Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, CanonicalPayload: "x"})
+		a.Verify(ctx.ID, proof, ctx.Binding, []byte("x"), "application/x-panic")
+	}()
+	if stats := a.VerifyLimiterStats(); stats.InFlight != 0 {
+		t.Fatalf("InFlight after a panic = %d, want 0", stats.InFlight)
+	}
+	ctx, _ = a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+	body := `{"amount":10}`
+	if _, err := a.Verify(ctx.ID, clientProof(t, ctx, body, "application/json"), ctx.Binding, []byte(body), "application/json"); err != nil {
+		t.Errorf("Verify after a panic failed: %v", err)
+	}
+}
+
+// TestVerifyConcurrencySlowStream tests that a streamed body does not keep
+// its slot while the client is slow to send it.
+func TestVerifyConcurrencySlowStream(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithVerifyConcurrency(1, 0))
+	upload, _ := a.IssueContext(ContextOptions{Binding: "POST /api/upload"})
+	body := `{"data":"x"}`
+	gate := newGatedReader(body)
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.VerifyStream(upload.ID, clientProof(t, upload, body, "application/json"), upload.Binding, gate, "application/json")
+		done <- err
+	}()
+	<-gate.started
+
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+	transfer := `{"amount":10}`
+	if _, err := a.Verify(ctx.ID, clientProof(t, ctx, transfer, "application/json"), ctx.Binding, []byte(transfer), "application/json"); err != nil {
+		t.Errorf("Verify beside a slow stream failed: %v", err)
+	}
+	close(gate.release)
+	if err := <-done; err != nil {
+		t.Errorf("Slow stream failed: %v", err)
+	}
+	if stats := a.VerifyLimiterStats(); stats.InFlight != 0 || stats.Rejected != 0 {
+		t.Errorf("Stats = %+v", stats)
+	}
+}
@@ -0,0 +1,250 @@
+package ash
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultStreamingBufferLimit is the size up to which VerifyStreaming
+// verifies a body before returning any of it, unless
+// WithStreamingBufferLimit sets another.
+const DefaultStreamingBufferLimit = 64 << 10
+
+// WithStreamingBufferLimit sets the size up to which VerifyStreaming
+// verifies a body in full before returning any of it (default:
+// DefaultStreamingBufferLimit). Zero or less streams every body.
+func WithStreamingBufferLimit(n int64) VerifyOption {
+	return func(o *verifyOptions) { o.bufferLimit, o.bufferLimitSet = n, true }
+}
+
+// errStreamClosed fails a streaming verification whose reader was closed
+// before the end of the body.
+var errStreamClosed = errors.New("ash: verifying reader closed")
+
+// VerifyingReader is the body returned by VerifyStreaming. It reads the
+// body it wraps while the proof is verified over the same bytes, and
+// reports the outcome at the end of the body.
+type VerifyingReader struct {
+	body   io.Reader
+	closer io.Closer
+	// buffered is set when the body was verified before VerifyStreaming
+	// returned; body then reads the buffered bytes.
+	buffered bool
+	pw       *io.PipeWriter
+
+	// buf holds the bytes read from body: pending have been hashed but
+	// not yet returned.
+	buf     []byte
+	pending []byte
+	eof     bool
+
+	done   chan struct{}
+	result *VerifyResult
+	err    error
+	once   sync.Once
+}
+
+// VerifyStreaming is VerifyStream for proxies that forward a body while
+// verifying it, and cannot buffer large bodies. The proxy reads the body
+// from the returned VerifyingReader, which passes each chunk to the proof
+// hash before returning it, through the same canonicalization as
+// VerifyStream. Memory use does not grow with the body, within the limits
+// of CanonicalizeJSONStream for JSON bodies; a raw-body context (see
+// ContextOptions.RawBody) only hashes it.
+//
+// The decision comes as early as the body allows:
+//   - A body of at most the streaming buffer limit (see
+//     WithStreamingBufferLimit) is read and verified in full before
+//     VerifyStreaming returns, so nothing of it is forwarded unless it is
+//     valid.
+//   - A failure found before the body is read, such as an unknown context
+//     or a malformed proof, is returned by VerifyStreaming.
+//   - Otherwise the body is forwarded as it is read. A failure found in
+//     the body, such as malformed JSON, fails the next Read. A proof that
+//     does not match fails the Read that reaches the end of the body, in
+//     place of io.EOF and without the last byte, so that the upstream
+//     never receives a complete body. A proxy must therefore abort the
+//     upstream request when reading the body fails, as net/http does for a
+//     request body, and must not act on a partial body.
+//
+// Result returns the decision once the body is read to the end, for
+// example to send it to the upstream in a trailer. The context is
+// consumed only then, on success. Closing the reader before the end fails
+// verification with ErrMalformedRequest. The VerifyingReader is returned
+// with the error, so that its Result reports the failure.
+func (a *Ash) VerifyStreaming(contextID, proof, binding string, body io.Reader, contentType string, opts ...VerifyOption) (*VerifyingReader, error) {
+	var o verifyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	limit := int64(DefaultStreamingBufferLimit)
+	if o.bufferLimitSet {
+		limit = o.bufferLimit
+	}
+	v := &VerifyingReader{done: make(chan struct{})}
+	v.closer, _ = body.(io.Closer)
+	start := time.Now()
+
+	if limit > 0 {
+		prefix, err := io.ReadAll(io.LimitReader(body, limit+1))
+		if err != nil {
+			result, err := (&VerifyResult{ContextID: contextID, Binding: binding}).fail(errReadBody)
+			result.Duration = time.Since(start)
+			a.recordVerify(result)
+			v.body = bytes.NewReader(nil)
+			v.finish(result, err)
+			return v, err
+		}
+		if int64(len(prefix)) <= limit {
+			v.body, v.buffered = bytes.NewReader(prefix), true
+			v.finish(a.Verify(contextID, proof, binding, prefix, contentType, opts...))
+			return v, v.err
+		}
+		body = io.MultiReader(bytes.NewReader(prefix), body)
+	}
+
+	pr, pw := io.Pipe()
+	v.body, v.pw = body, pw
+	started := make(chan struct{})
+	go func() {
+		payload := &startReader{r: pr, started: started}
+		result, err := a.verify(contextID, proof, binding, streamPayload{payload}, contentType, &o)
+		result.Duration = time.Since(start)
+		a.recordVerify(result)
+		// Writes of the rest of the body no longer block.
+		pr.CloseWithError(io.ErrClosedPipe)
+		v.finish(result, err)
+	}()
+	select {
+	case <-started:
+		return v, nil
+	case <-v.done:
+		return v, v.err
+	}
+}
+
+// finish records the decision.
+func (v *VerifyingReader) finish(result *VerifyResult, err error) {
+	v.once.Do(func() {
+		v.result, v.err = result, err
+		close(v.done)
+	})
+}
+
+// failed returns the error of a decided verification that failed.
+func (v *VerifyingReader) failed() error {
+	select {
+	case <-v.done:
+		return v.err
+	default:
+		return nil
+	}
+}
+
+// streamingChunk is the size of the reads VerifyingReader makes from the
+// body it wraps.
+const streamingChunk = 32 << 10
+
+// Read reads the body. It fails with the verification error once
+// verification has failed, and at the end of the body returns io.EOF only
+// if the proof verified.
+func (v *VerifyingReader) Read(p []byte) (int, error) {
+	if err := v.failed(); err != nil {
+		return 0, err
+	}
+	if v.buffered {
+		return v.body.Read(p)
+	}
+	// The last byte is held back until the end of the body is known, so
+	// that an upstream counting on Content-Length never receives a
+	// complete body whose proof failed.
+	for len(v.pending) <= 1 && !v.eof {
+		if err := v.fill(); err != nil {
+			return 0, err
+		}
+		if err := v.failed(); err != nil {
+			return 0, err
+		}
+	}
+	if v.eof {
+		<-v.done
+		if v.err != nil {
+			return 0, v.err
+		}
+		if len(v.pending) == 0 {
+			return 0, io.EOF
+		}
+		n := copy(p, v.pending)
+		v.pending = v.pending[n:]
+		return n, nil
+	}
+	n := copy(p, v.pending[:len(v.pending)-1])
+	v.pending = v.pending[n:]
+	return n, nil
+}
+
+// fill reads the next chunk of the body after the pending bytes and passes
+// it to verification.
+func (v *VerifyingReader) fill() error {
+	if v.buf == nil {
+		v.buf = make([]byte, streamingChunk)
+	}
+	k := copy(v.buf, v.pending)
+	n, err := v.body.Read(v.buf[k:])
+	v.pending = v.buf[:k+n]
+	if n > 0 {
+		// Verification may have stopped reading, such as after a JSON
+		// value; the rest of the body is then forwarded as is.
+		v.pw.Write(v.buf[k : k+n])
+	}
+	switch {
+	case err == io.EOF:
+		v.eof = true
+		v.pw.Close()
+	case err != nil:
+		v.pw.CloseWithError(err)
+		return err
+	}
+	return nil
+}
+
+// Close closes the body if it is an io.Closer. Verification that has not
+// reached the end of the body fails.
+func (v *VerifyingReader) Close() error {
+	if v.pw != nil {
+		v.pw.CloseWithError(errStreamClosed)
+	}
+	if v.closer != nil {
+		return v.closer.Close()
+	}
+	return nil
+}
+
+// Done returns a channel that is closed once the decision is made.
+func (v *VerifyingReader) Done() <-chan struct{} {
+	return v.done
+}
+
+// Result waits for the decision and returns it, as Verify would. It
+// blocks until the body has been read to the end, or the reader closed,
+// unless verification failed earlier.
+func (v *VerifyingReader) Result() (*VerifyResult, error) {
+	<-v.done
+	return v.result, v.err
+}
+
+// startReader closes started on the first Read, when verification reaches
+// the body.
+type startReader struct {
+	r       io.Reader
+	started chan struct{}
+	once    sync.Once
+}
+
+func (r *startReader) Read(p []byte) (int, error) {
+	r.once.Do(func() { close(r.started) })
+	return r.r.Read(p)
+}
@@ -0,0 +1,233 @@
+package ash
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// patternReader is a synthetic body of n bytes that is never held in
+// memory, with the byte at offset flip altered if flip is not negative.
+type patternReader struct {
+	n, off, flip int64
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.off >= r.n {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n-r.off {
+		p = p[:r.n-r.off]
+	}
+	for i := range p {
+		p[i] = byte('a' + (r.off+int64(i))%26)
+		if r.off+int64(i) == r.flip {
+			p[i] = '!'
+		}
+	}
+	r.off += int64(len(p))
+	return len(p), nil
+}
+
+// rawStreamProof builds the proof for a raw-body context over a body of n
+// pattern bytes, hashing it as a stream.
+func rawStreamProof(ctx *Context, n int64) string {
+	var sb strings.Builder
+	writePreamble(&sb, BuildProofInput{Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, Nonce: ctx.Nonce})
+	h := sha256.New()
+	io.WriteString(h, sb.String())
+	io.Copy(h, &patternReader{n: n, flip: -1})
+	return Base64URLEncode(h.Sum(nil))
+}
+
+// heapWatcher is a writer that discards what it is given and records the
+// largest heap in use, sampled every few megabytes.
+type heapWatcher struct {
+	written, next int64
+	maxHeap       uint64
+}
+
+func (w *heapWatcher) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	if w.written >= w.next {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if m.HeapInuse > w.maxHeap {
+			w.maxHeap = m.HeapInuse
+		}
+		w.next = w.written + 4<<20
+	}
+	return len(p), nil
+}
+
+// TestVerifyStreamingLarge tests that a 100 MB body is forwarded and
+// verified in constant memory.
+func TestVerifyStreamingLarge(t *testing.T) {
+	const size = 100 << 20
+	a, store := newTestAsh(t, time.UnixMilli(1700000000000))
+	ctx, err := a.IssueContext(ContextOptions{Binding: "PUT /api/upload", RawBody: true})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	proof := rawStreamProof(ctx, size)
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	v, err := a.VerifyStreaming(ctx.ID, proof, ctx.Binding, &patternReader{n: size, flip: -1}, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("VerifyStreaming failed: %v", err)
+	}
+	upstream := &heapWatcher{}
+	if n, err := io.Copy(upstream, v); err != nil || n != size {
+		t.Fatalf("Forwarded %d bytes, %v", n, err)
+	}
+	if grown := int64(upstream.maxHeap) - int64(before.HeapInuse); grown > 16<<20 {
+		t.Errorf("Heap grew by %d bytes forwarding %d", grown, size)
+	}
+	if result, err := v.Result(); err != nil || !result.Valid {
+		t.Fatalf("Result = %+v, %v", result, err)
+	}
+	if stored, _ := store.Get(ctx.ID); !stored.Used {
+		t.Errorf("Context not consumed")
+	}
+}
+
+// TestVerifyStreamingTampered tests that a large body whose proof fails
+// is never forwarded whole.
+func TestVerifyStreamingTampered(t *testing.T) {
+	const size = 8 << 20
+	a, store := newTestAsh(t, time.UnixMilli(1700000000000))
+	for _, flip := range []int64{0, size / 2, size - 1} {
+		ctx, _ := a.IssueContext(ContextOptions{Binding: "PUT /api/upload", RawBody: true})
+		v, err := a.VerifyStreaming(ctx.ID, rawStreamProof(ctx, size), ctx.Binding, &patternReader{n: size, flip: flip}, "application/octet-stream")
+		if err != nil {
+			t.Fatalf("VerifyStreaming failed: %v", err)
+		}
+		n, err := io.Copy(io.Discard, v)
+		if !errors.Is(err, ErrIntegrityFailed) || n >= size {
+			t.Errorf("Byte %d altered: forwarded %d of %d bytes, %v", flip, n, size, err)
+		}
+		if result, err := v.Result(); result.Valid || !errors.Is(err, ErrIntegrityFailed) || result.Stage != StageProofMatch {
+			t.Errorf("Byte %d altered: Result = %+v, %v", flip, result, err)
+		}
+		if stored, _ := store.Get(ctx.ID); stored.Used {
+			t.Errorf("Byte %d altered: context consumed", flip)
+		}
+	}
+}
+
+// countingReader counts the reads made from it.
+type countingReader struct {
+	io.Reader
+	reads int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	return r.Reader.Read(p)
+}
+
+// TestVerifyStreamingEarly tests the decisions made before any of the
+// body is forwarded.
+func TestVerifyStreamingEarly(t *testing.T) {
+	a, store := newTestAsh(t, time.UnixMilli(1700000000000))
+	body := `{"items":[1,2,3]}`
+
+	// A small body is verified before VerifyStreaming returns.
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/upload"})
+	if _, err := a.VerifyStreaming(ctx.ID, clientProof(t, ctx, `{"items":[]}`, "application/json"), ctx.Binding,
+		strings.NewReader(body), "application/json"); !errors.Is(err, ErrIntegrityFailed) {
+		t.Errorf("Expected %s for a small body, got %v", ErrIntegrityFailed, err)
+	}
+	v, err := a.VerifyStreaming(ctx.ID, clientProof(t, ctx, body, "application/json"), ctx.Binding,
+		strings.NewReader(body), "application/json")
+	if err != nil {
+		t.Fatalf("VerifyStreaming failed: %v", err)
+	}
+	if stored, _ := store.Get(ctx.ID); !stored.Used {
+		t.Errorf("Small body: context not consumed before forwarding")
+	}
+	if forwarded, err := io.ReadAll(v); string(forwarded) != body || err != nil {
+		t.Errorf("Forwarded %q, %v", forwarded, err)
+	}
+
+	// Context checks fail before the body is read.
+	r := &countingReader{Reader: &patternReader{n: 1 << 20, flip: -1}}
+	v, err = a.VerifyStreaming("ash_unknown", clientProof(t, ctx, body, "application/json"), ctx.Binding, r,
+		"application/json", WithStreamingBufferLimit(0))
+	if !errors.Is(err, ErrInvalidContext) || r.reads != 0 {
+		t.Errorf("Unknown context: %v after %d reads", err, r.reads)
+	}
+	if result, _ := v.Result(); result.Stage != StageContextLookup {
+		t.Errorf("Result stage = %s, want %s", result.Stage, StageContextLookup)
+	}
+	if _, err := v.Read(make([]byte, 8)); !errors.Is(err, ErrInvalidContext) {
+		t.Errorf("Read after rejection = %v", err)
+	}
+}
+
+// TestVerifyStreamingJSON tests a streamed JSON body, and a body that
+// fails to canonicalize part way.
+func TestVerifyStreamingJSON(t *testing.T) {
+	a, store := newTestAsh(t, time.UnixMilli(1700000000000))
+	var sb strings.Builder
+	sb.WriteString(`[`)
+	for i := 0; i < 20000; i++ {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(`{"b":2,"a":1}`)
+	}
+	sb.WriteString(`]`)
+	body := sb.String()
+
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/upload"})
+	proof := clientProof(t, ctx, body, "application/json")
+	v, err := a.VerifyStreaming(ctx.ID, proof, ctx.Binding, strings.NewReader(body), "application/json",
+		WithStreamingBufferLimit(1024))
+	if err != nil {
+		t.Fatalf("VerifyStreaming failed: %v", err)
+	}
+	select {
+	case <-v.Done():
+		t.Fatalf("Decided before the body was read")
+	default:
+	}
+	if forwarded, err := io.ReadAll(v); string(forwarded) != body || err != nil {
+		t.Fatalf("Forwarded %d bytes, %v", len(forwarded), err)
+	}
+	if result, err := v.Result(); err != nil || !result.Valid {
+		t.Errorf("Result = %+v, %v", result, err)
+	}
+
+	// Malformed JSON fails the read that finds it.
+	ctx, _ = a.IssueContext(ContextOptions{Binding: "POST /api/upload"})
+	malformed := body[:len(body)/2] + "}" + strings.Repeat(" ", 1<<20)
+	v, err = a.VerifyStreaming(ctx.ID, proof, ctx.Binding, strings.NewReader(malformed), "application/json",
+		WithStreamingBufferLimit(1024))
+	if err != nil {
+		t.Fatalf("VerifyStreaming failed: %v", err)
+	}
+	n, err := io.Copy(io.Discard, v)
+	if !errors.Is(err, ErrCanonicalizationFailed) || n >= int64(len(malformed))/2 {
+		t.Errorf("Forwarded %d of %d bytes, %v", n, len(malformed), err)
+	}
+
+	// Closing the reader early fails verification.
+	ctx, _ = a.IssueContext(ContextOptions{Binding: "POST /api/upload"})
+	v, _ = a.VerifyStreaming(ctx.ID, clientProof(t, ctx, body, "application/json"), ctx.Binding,
+		strings.NewReader(body), "application/json", WithStreamingBufferLimit(1024))
+	v.Read(make([]byte, 512))
+	v.Close()
+	if _, err := v.Result(); !errors.Is(err, ErrMalformedRequest) {
+		t.Errorf("Result after Close = %v, want %s", err, ErrMalformedRequest)
+	}
+	if stored, _ := store.Get(ctx.ID); stored.Used {
+		t.Errorf("Context consumed after Close")
+	}
+}
@@ -0,0 +1,439 @@
+package ash
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientProof builds the proof a client would send for ctx and body.
+func clientProof(t *testing.T, ctx *Context, body, contentType string) string {
+	t.Helper()
+	canonical, err := CanonicalizePayload([]byte(body), contentType)
+	if err != nil {
+		t.Fatalf("CanonicalizePayload failed: %v", err)
+	}
+	return BuildProof(BuildProofInput{
+		Mode:             ctx.Mode,
+		Binding:          ctx.Binding,
+		ContextID:        ctx.ID,
+		Nonce:            ctx.Nonce,
+		CanonicalPayload: canonical,
+		IncludeLength:    ctx.IncludeLength,
+	})
+}
+
+// TestVerify tests the verification flow and its failure codes.
+func TestVerify(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, _ := newTestAsh(t, now)
+	body := `{"b": 2, "a": 1}`
+
+	ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/update"})
+	if err != nil {
+		t.Fatalf("IssueContext failed: %v", err)
+	}
+	proof := clientProof(t, ctx, body, "application/json")
+
+	tampered, _ := a.IssueContext(ContextOptions{Binding: "POST /api/update"})
+	tamperedProof := clientProof(t, tampered, `{"a":1,"b":3}`, "application/json")
+
+	result, err := a.Verify(ctx.ID, proof, "POST /api/update", []byte(body), "application/json; charset=utf-8")
+	if err != nil || !result.Valid {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if result.Mode != ModeBalanced || result.ContextID != ctx.ID {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	tests := []struct {
+		name        string
+		contextID   string
+		proof       string
+		binding     string
+		body        string
+		contentType string
+		code        AshErrorCode
+	}{
+		{"replay", ctx.ID, proof, "POST /api/update", body, "application/json", ErrReplayDetected},
+		{"missing context", "", proof, "POST /api/update", body, "application/json", ErrMissingHeaders},
+		{"missing proof", tampered.ID, "", "POST /api/update", body, "application/json", ErrMissingHeaders},
+		{"short proof", tampered.ID, tamperedProof[:42], "POST /api/update", body, "application/json", ErrMalformedProof},
+		{"long proof", tampered.ID, tamperedProof + "A", "POST /api/update", body, "application/json", ErrMalformedProof},
+		{"padded proof", tampered.ID, tamperedProof[:42] + "=", "POST /api/update", body, "application/json", ErrMalformedProof},
+		{"standard base64 proof", tampered.ID, "+" + tamperedProof[1:], "POST /api/update", body, "application/json", ErrMalformedProof},
+		{"hex proof", tampered.ID, strings.Repeat("ab", 32), "POST /api/update", body, "application/json", ErrMalformedProof},
+		{"unknown context", "ash_unknown", proof, "POST /api/update", body, "application/json", ErrInvalidContext},
+		{"binding mismatch", tampered.ID, tamperedProof, "POST /api/other", body, "application/json", ErrEndpointMismatch},
+		{"unsupported content type", tampered.ID, tamperedProof, "POST /api/update", body, "text/plain", ErrUnsupportedContentType},
+		{"tampered payload", tampered.ID, tamperedProof, "POST /api/update", body, "application/json", ErrIntegrityFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := a.Verify(tt.contextID, tt.proof, tt.binding, []byte(tt.body), tt.contentType)
+			var ashErr *AshError
+			if !errors.As(err, &ashErr) || ashErr.Code != tt.code {
+				t.Fatalf("Expected %s, got %v", tt.code, err)
+			}
+			if result.Valid || result.Code != tt.code {
+				t.Errorf("Expected invalid result with %s, got %+v", tt.code, result)
+			}
+		})
+	}
+}
+
+// TestVerifyExpired tests that an expired context is rejected.
+func TestVerifyExpired(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	store := NewMemoryStore(MemoryStoreOptions{Now: fixedClock(now)})
+	a, _ := New(store, WithClock(fixedClock(now.Add(DefaultTTL))))
+
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/update"})
+	_, err := a.Verify(ctx.ID, clientProof(t, ctx, "", ""), "POST /api/update", nil, "")
+	var ashErr *AshError
+	if !errors.As(err, &ashErr) || ashErr.Code != ErrContextExpired {
+		t.Errorf("Expected ErrContextExpired, got %v", err)
+	}
+}
+
+// TestVerifyKeyRing tests verification with HMAC-keyed proofs.
+func TestVerifyKeyRing(t *testing.T) {
+	ring, _ := NewKeyRing(Key{ID: "k1", Secret: []byte("secret")})
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithKeyRing(ring))
+
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/update"})
+	input := BuildProofInput{Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID, CanonicalPayload: `{"a":1}`}
+
+	if _, err := a.Verify(ctx.ID, BuildProof(input), ctx.Binding, []byte(`{"a":1}`), "application/json"); err == nil {
+		t.Error("Expected unkeyed proof to be rejected")
+	}
+	if _, err := a.Verify(ctx.ID, BuildKeyedProof(input, ring), ctx.Binding, []byte(`{"a":1}`), "application/json"); err != nil {
+		t.Errorf("Keyed proof rejected: %v", err)
+	}
+}
+
+// TestVerifyEmptyPayloads tests that a missing body, an empty body, {} and
+// [] are distinct proof inputs, and that nil and empty bodies are the same.
+func TestVerifyEmptyPayloads(t *testing.T) {
+	for _, tt := range []struct {
+		body, want string
+	}{
+		{"", CanonicalEmptyBody},
+		{"{}", CanonicalEmptyObject},
+		{" { } ", CanonicalEmptyObject},
+		{"[]", CanonicalEmptyArray},
+	} {
+		if got, err := CanonicalizePayload([]byte(tt.body), "application/json"); err != nil || got != tt.want {
+			t.Errorf("CanonicalizePayload(%q) = %q, %v; want %q", tt.body, got, err, tt.want)
+		}
+	}
+	if got, _ := CanonicalizePayload(nil, ""); got != CanonicalEmptyBody {
+		t.Errorf("CanonicalizePayload(nil) = %q, want %q", got, CanonicalEmptyBody)
+	}
+
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	issue := func() *Context {
+		ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/test"})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		return ctx
+	}
+	ctx := issue()
+	proofs := map[string]bool{}
+	for _, body := range []string{"", "{}", "[]"} {
+		proofs[clientProof(t, ctx, body, "application/json")] = true
+	}
+	if len(proofs) != 3 {
+		t.Errorf("Expected 3 distinct proofs for \"\", {} and [], got %d", len(proofs))
+	}
+
+	for _, tt := range []struct {
+		name         string
+		signed, sent []byte
+		valid        bool
+	}{
+		{"nil body for empty proof", []byte(""), nil, true},
+		{"empty body for empty proof", []byte(""), []byte(""), true},
+		{"empty body for {} proof", []byte("{}"), []byte(""), false},
+		{"{} body for empty proof", []byte(""), []byte("{}"), false},
+		{"[] body for {} proof", []byte("{}"), []byte("[]"), false},
+	} {
+		ctx := issue()
+		proof := clientProof(t, ctx, string(tt.signed), "application/json")
+		result, _ := a.Verify(ctx.ID, proof, ctx.Binding, tt.sent, "application/json")
+		if result.Valid != tt.valid {
+			t.Errorf("%s: Valid = %v, want %v (%s)", tt.name, result.Valid, tt.valid, result.Code)
+		}
+	}
+}
+
+// TestVerifyTenant tests that contexts only verify requests for the tenant
+// they were issued to.
+func TestVerifyTenant(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000))
+	body := `{"a":1}`
+	proofFor := func(ctx *Context, tenant string) string {
+		return BuildProof(BuildProofInput{
+			Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID,
+			Tenant: tenant, CanonicalPayload: body,
+		})
+	}
+
+	for _, tt := range []struct {
+		name                        string
+		issuedTo, provedFor, sentTo string
+		code                        AshErrorCode
+	}{
+		{"same tenant", "tenant-a", "tenant-a", "tenant-a", ""},
+		{"untenanted", "", "", "", ""},
+		{"other tenant", "tenant-a", "tenant-a", "tenant-b", ErrTenantMismatch},
+		{"other tenant proof", "tenant-a", "tenant-b", "tenant-b", ErrTenantMismatch},
+		{"tenant missing from request", "tenant-a", "tenant-a", "", ErrTenantMismatch},
+		{"untenanted context for tenant", "", "", "tenant-a", ErrTenantMismatch},
+		{"proof without tenant", "tenant-a", "", "tenant-a", ErrIntegrityFailed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/test", Tenant: tt.issuedTo})
+			if err != nil {
+				t.Fatalf("IssueContext failed: %v", err)
+			}
+			result, err := a.Verify(ctx.ID, proofFor(ctx, tt.provedFor), ctx.Binding, []byte(body), "application/json", WithTenant(tt.sentTo))
+			if tt.code == "" {
+				if err != nil || result.Tenant != tt.issuedTo {
+					t.Errorf("Verify = %+v, %v", result, err)
+				}
+				return
+			}
+			var ashErr *AshError
+			if !errors.As(err, &ashErr) || ashErr.Code != tt.code {
+				t.Errorf("Expected %s, got %v", tt.code, err)
+			}
+		})
+	}
+
+	if _, err := a.IssueContext(ContextOptions{Binding: "POST /api/test", Tenant: "a\nb"}); !errors.Is(err, ErrInvalidTenant) {
+		t.Errorf("Expected ErrInvalidTenant, got %v", err)
+	}
+}
+
+// TestVerifyDuplicateWindow tests that an identical resubmission is
+// accepted within the window while other reuse of the context is not.
+func TestVerifyDuplicateWindow(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, _ := newTestAsh(t, now, WithDuplicateWindow(2*time.Second), WithClock(func() time.Time { return now }))
+	body := `{"amount":100}`
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/transfer"})
+	proof := clientProof(t, ctx, body, "application/json")
+	verify := func(proof, body string) (*VerifyResult, AshErrorCode) {
+		t.Helper()
+		result, err := a.Verify(ctx.ID, proof, "POST /api/transfer", []byte(body), "application/json")
+		var ashErr *AshError
+		if errors.As(err, &ashErr) {
+			return result, ashErr.Code
+		}
+		return result, ""
+	}
+
+	if result, code := verify(proof, body); code != "" || result.Duplicate {
+		t.Fatalf("First Verify = %+v, %s", result, code)
+	}
+	if result, code := verify(proof, body); code != "" || !result.Valid || !result.Duplicate {
+		t.Errorf("Expected identical resubmission to be a valid duplicate, got %+v, %s", result, code)
+	}
+
+	// A different payload, with its own proof or the original one, is
+	// still rejected.
+	other := `{"amount":999}`
+	if _, code := verify(clientProof(t, ctx, other, "application/json"), other); code != ErrReplayDetected {
+		t.Errorf("Expected %s for a different payload, got %q", ErrReplayDetected, code)
+	}
+	if _, code := verify(proof, other); code != ErrIntegrityFailed {
+		t.Errorf("Expected %s for the proof over a different payload, got %q", ErrIntegrityFailed, code)
+	}
+
+	// The window closes.
+	now = now.Add(2 * time.Second)
+	if _, code := verify(proof, body); code != ErrReplayDetected {
+		t.Errorf("Expected %s after the window, got %q", ErrReplayDetected, code)
+	}
+}
+
+// TestVerifyIncludeLength tests proofs that bind the payload length, with
+// the option enabled and disabled.
+func TestVerifyIncludeLength(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	const body = `{"b":2,"a":"\u00e9"}`
+	canonical, _ := CanonicalizePayload([]byte(body), "application/json")
+
+	for _, enabled := range []bool{false, true} {
+		a, _ := newTestAsh(t, now, WithIncludeLength(enabled))
+		issue := func() *Context {
+			t.Helper()
+			ctx, err := a.IssueContext(ContextOptions{Binding: "POST /api/x"})
+			if err != nil {
+				t.Fatalf("IssueContext failed: %v", err)
+			}
+			if ctx.IncludeLength != enabled || ctx.PublicInfo().IncludeLength != enabled {
+				t.Fatalf("IncludeLength = %v, want %v", ctx.IncludeLength, enabled)
+			}
+			return ctx
+		}
+		proof := func(ctx *Context, includeLength bool) string {
+			return BuildProof(BuildProofInput{
+				Mode: ctx.Mode, Binding: ctx.Binding, ContextID: ctx.ID,
+				CanonicalPayload: canonical, IncludeLength: includeLength,
+			})
+		}
+
+		// Only a proof built with the same setting verifies, buffered or
+		// streamed.
+		for _, includeLength := range []bool{false, true} {
+			ctx := issue()
+			_, err := a.Verify(ctx.ID, proof(ctx, includeLength), ctx.Binding, []byte(body), "application/json")
+			if includeLength == enabled && err != nil {
+				t.Errorf("enabled=%v: Verify failed: %v", enabled, err)
+			} else if includeLength != enabled && !errors.Is(err, ErrIntegrityFailed) {
+				t.Errorf("enabled=%v: expected %s for includeLength=%v, got %v", enabled, ErrIntegrityFailed, includeLength, err)
+			}
+			if includeLength == enabled {
+				ctx := issue()
+				if _, err := a.VerifyStream(ctx.ID, proof(ctx, includeLength), ctx.Binding, strings.NewReader(body), "application/json"); err != nil {
+					t.Errorf("enabled=%v: VerifyStream failed: %v", enabled, err)
+				}
+			}
+		}
+
+		// A declared length only matters to contexts with IncludeLength.
+		ctx := issue()
+		_, err := a.Verify(ctx.ID, proof(ctx, enabled), ctx.Binding, []byte(body), "application/json",
+			WithDeclaredLength(len(canonical)+1))
+		if enabled {
+			var ashErr *AshError
+			want := "length mismatch: expected 17 got 16"
+			if !errors.As(err, &ashErr) || ashErr.Code != ErrIntegrityFailed || ashErr.Message != want {
+				t.Errorf("Expected %s %q, got %v", ErrIntegrityFailed, want, err)
+			}
+		} else if err != nil {
+			t.Errorf("Declared length rejected with IncludeLength disabled: %v", err)
+		}
+	}
+}
+
+// TestVerifyIncludeLengthTruncated tests that a truncated body is reported
+// as a length mismatch through the middleware.
+func TestVerifyIncludeLengthTruncated(t *testing.T) {
+	a, _ := newTestAsh(t, time.UnixMilli(1700000000000), WithIncludeLength(true))
+	handler := a.HTTPMiddleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ctx, _ := a.IssueContext(ContextOptions{Binding: "POST /api/items"})
+
+	req, _ := http.NewRequest("POST", "http://example.com/api/items", strings.NewReader(`{"items":[1,2,3]}`))
+	req.Header.Set("Content-Type", "application/json")
+	if err := SignRequest(req, ctx.PublicInfo(), nil); err != nil {
+		t.Fatalf("SignRequest failed: %v", err)
+	}
+	if got := req.Header.Get(HeaderLength); got != "17" {
+		t.Errorf("%s = %q, want 17", HeaderLength, got)
+	}
+	req.Body = io.NopCloser(strings.NewReader(`{"items":[1]}`))
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403, got %d: %s", rec.Code, rec.Body)
+	}
+	if e := decodeError(t, rec); e.Code != ErrIntegrityFailed || e.Message != "length mismatch: expected 17 got 13" {
+		t.Errorf("Unexpected error: %+v", e)
+	}
+}
+
+// consumeFailStore is a MemoryStore whose Consume always fails.
+type consumeFailStore struct {
+	*MemoryStore
+}
+
+func (consumeFailStore) Consume(string) error { return errors.New("store unavailable") }
+
+// TestVerifyStage tests the stage reported for each failure type.
+func TestVerifyStage(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	a, _ := newTestAsh(t, now)
+	issue := func(binding string) *Context {
+		t.Helper()
+		ctx, err := a.IssueContext(ContextOptions{Binding: binding, TTL: time.Second})
+		if err != nil {
+			t.Fatalf("IssueContext failed: %v", err)
+		}
+		return ctx
+	}
+	const body = `{"a":1}`
+
+	used := issue("POST /api/x")
+	if _, err := a.Verify(used.ID, clientProof(t, used, body, "application/json"), used.Binding, []byte(body), "application/json"); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	expired, _ := NewMemoryStore(MemoryStoreOptions{Now: fixedClock(now.Add(-time.Hour))}).Create(ContextOptions{Binding: "POST /api/x", TTL: time.Second})
+	a.store.(*MemoryStore).contexts[expired.ID] = expired
+	failing, _ := New(consumeFailStore{a.store.(*MemoryStore)}, WithClock(fixedClock(now)))
+
+	tests := []struct {
+		name   string
+		verify func() (*VerifyResult, error)
+		stage  CheckStage
+		code   AshErrorCode
+	}{
+		{"valid", func() (*VerifyResult, error) {
+			ctx := issue("POST /api/x")
+			return a.Verify(ctx.ID, clientProof(t, ctx, body, "application/json"), ctx.Binding, []byte(body), "application/json")
+		}, StageNone, ""},
+		{"missing context ID", func() (*VerifyResult, error) {
+			return a.Verify("", "proof", "POST /api/x", nil, "")
+		}, StageHeadersPresent, ErrMissingHeaders},
+		{"malformed proof", func() (*VerifyResult, error) {
+			ctx := issue("POST /api/x")
+			return a.Verify(ctx.ID, "not-a-proof", ctx.Binding, nil, "")
+		}, StageHeadersPresent, ErrMalformedProof},
+		{"unknown context", func() (*VerifyResult, error) {
+			return a.Verify("ash_missing", clientProof(t, used, "", ""), "POST /api/x", nil, "")
+		}, StageContextLookup, ErrInvalidContext},
+		{"replay", func() (*VerifyResult, error) {
+			return a.Verify(used.ID, clientProof(t, used, body, "application/json"), used.Binding, []byte(body), "application/json")
+		}, StageContextLookup, ErrReplayDetected},
+		{"expired", func() (*VerifyResult, error) {
+			return a.Verify(expired.ID, clientProof(t, expired, "", ""), expired.Binding, nil, "")
+		}, StageExpiry, ErrContextExpired},
+		{"binding mismatch", func() (*VerifyResult, error) {
+			ctx := issue("POST /api/x")
+			return a.Verify(ctx.ID, clientProof(t, ctx, "", ""), "POST /api/y", nil, "")
+		}, StageBindingMatch, ErrEndpointMismatch},
+		{"tenant mismatch", func() (*VerifyResult, error) {
+			ctx := issue("POST /api/x")
+			return a.Verify(ctx.ID, clientProof(t, ctx, "", ""), ctx.Binding, nil, "", WithTenant("acme"))
+		}, StageBindingMatch, ErrTenantMismatch},
+		{"invalid payload", func() (*VerifyResult, error) {
+			ctx := issue("POST /api/x")
+			return a.Verify(ctx.ID, clientProof(t, ctx, "", ""), ctx.Binding, []byte("{"), "application/json")
+		}, StageProofMatch, ErrCanonicalizationFailed},
+		{"proof mismatch", func() (*VerifyResult, error) {
+			ctx := issue("POST /api/x")
+			return a.Verify(ctx.ID, clientProof(t, ctx, `{"a":2}`, "application/json"), ctx.Binding, []byte(body), "application/json")
+		}, StageProofMatch, ErrIntegrityFailed},
+		{"consume failure", func() (*VerifyResult, error) {
+			ctx := issue("POST /api/x")
+			return failing.Verify(ctx.ID, clientProof(t, ctx, "", ""), ctx.Binding, nil, "")
+		}, StageConsume, ErrInternalError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := tt.verify()
+			if result.Stage != tt.stage || result.Code != tt.code {
+				t.Errorf("Got stage %s, code %q (%v); want stage %s, code %q", result.Stage, result.Code, err, tt.stage, tt.code)
+			}
+		})
+	}
+}